@@ -0,0 +1,122 @@
+package nds
+
+import (
+	"errors"
+	"sync"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/datastore"
+)
+
+// IDAllocator is implemented by a DatastoreClient that can allocate IDs.
+// AllocateIDs must behave like datastore.AllocateIDs, returning the range of
+// IDs [low, high) for n entities of kind with parent that automatic ID
+// allocation will never use.
+type IDAllocator interface {
+	AllocateIDs(c context.Context, kind string, parent *datastore.Key,
+		n int) (low, high int64, err error)
+}
+
+var idPoolKey = "used for *idPool"
+
+// idPool holds IDs allocated from the datastore that have not been handed
+// out yet.
+type idPool struct {
+	sync.Mutex
+	size int
+
+	// ranges holds the unused IDs [low, high) for each kind and parent,
+	// keyed by an encoded incomplete key.
+	ranges map[string][2]int64
+}
+
+// WithIDPool returns a context that makes AllocateIDs reserve at least size
+// IDs from the datastore at a time. IDs that are not needed straight away are
+// kept and handed out by later AllocateIDs calls using the returned context,
+// or any context derived from it. IDs that are never handed out are simply
+// not used, so the pool should be scoped to a single request or job.
+func WithIDPool(c context.Context, size int) context.Context {
+	return context.WithValue(c, &idPoolKey, &idPool{
+		size:   size,
+		ranges: map[string][2]int64{},
+	})
+}
+
+// AllocateIDs returns n complete keys with the given kind and parent whose
+// IDs will never be used by the datastore's automatic ID allocation. Unlike
+// incomplete keys, entities put with these keys are locked and cached by NDS
+// straight away. kind cannot be empty and parent may be nil.
+//
+// With a context returned by WithIDPool the IDs are taken from the pool,
+// only calling the datastore when it runs out. IDs are allocated by the
+// DatastoreClient set with WithDatastore, which must implement IDAllocator.
+func AllocateIDs(c context.Context, kind string, parent *datastore.Key,
+	n int) ([]*datastore.Key, error) {
+
+	if kind == "" {
+		return nil, errors.New("nds: AllocateIDs given an empty kind")
+	}
+	if n < 0 {
+		return nil, errors.New("nds: AllocateIDs given a negative count")
+	}
+
+	pool, ok := c.Value(&idPoolKey).(*idPool)
+	if !ok {
+		low, _, err := allocateIDs(c, kind, parent, n)
+		if err != nil {
+			return nil, err
+		}
+		return idKeys(c, kind, parent, low, low+int64(n)), nil
+	}
+
+	pool.Lock()
+	defer pool.Unlock()
+
+	poolKey := datastore.NewIncompleteKey(c, kind, parent).Encode()
+	keys := make([]*datastore.Key, 0, n)
+	for len(keys) < n {
+		r := pool.ranges[poolKey]
+		if r[0] == r[1] {
+			count := n - len(keys)
+			if count < pool.size {
+				count = pool.size
+			}
+			low, high, err := allocateIDs(c, kind, parent, count)
+			if err != nil {
+				return nil, err
+			}
+			r = [2]int64{low, high}
+		}
+
+		high := r[0] + int64(n-len(keys))
+		if high > r[1] {
+			high = r[1]
+		}
+		keys = append(keys, idKeys(c, kind, parent, r[0], high)...)
+		pool.ranges[poolKey] = [2]int64{high, r[1]}
+	}
+	return keys, nil
+}
+
+// allocateIDs allocates n IDs with the DatastoreClient of c.
+func allocateIDs(c context.Context, kind string, parent *datastore.Key,
+	n int) (int64, int64, error) {
+
+	allocator, ok := datastoreFromContext(c).(IDAllocator)
+	if !ok {
+		return 0, 0, errors.New(
+			"nds: DatastoreClient does not implement IDAllocator")
+	}
+	return allocator.AllocateIDs(c, kind, parent, n)
+}
+
+// idKeys returns keys with the IDs [low, high).
+func idKeys(c context.Context, kind string, parent *datastore.Key,
+	low, high int64) []*datastore.Key {
+
+	keys := make([]*datastore.Key, 0, high-low)
+	for id := low; id < high; id++ {
+		keys = append(keys, datastore.NewKey(c, kind, "", id, parent))
+	}
+	return keys
+}
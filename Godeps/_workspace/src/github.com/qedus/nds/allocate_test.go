@@ -0,0 +1,77 @@
+package nds_test
+
+import (
+	"testing"
+
+	"github.com/qedus/nds"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/datastore"
+)
+
+func TestAllocateIDs(t *testing.T) {
+	c, closeFunc := NewContext(t, nil)
+	defer closeFunc()
+
+	type testEntity struct {
+		Val int
+	}
+
+	allocateCalls := 0
+	nds.SetDatastoreAllocateIDs(func(c context.Context, kind string,
+		parent *datastore.Key, n int) (int64, int64, error) {
+		allocateCalls++
+		return datastore.AllocateIDs(c, kind, parent, n)
+	})
+	defer nds.SetDatastoreAllocateIDs(datastore.AllocateIDs)
+
+	pc := nds.WithIDPool(c, 10)
+	parent := datastore.NewKey(c, "Parent", "", 1, nil)
+
+	seen := map[int64]bool{}
+	for _, n := range []int{3, 3, 5} {
+		keys, err := nds.AllocateIDs(pc, "Entity", parent, n)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(keys) != n {
+			t.Fatal("incorrect number of keys", len(keys))
+		}
+		for _, key := range keys {
+			if key.Incomplete() || !key.Parent().Equal(parent) ||
+				key.Kind() != "Entity" {
+				t.Fatal("incorrect key", key)
+			}
+			if seen[key.IntID()] {
+				t.Fatal("duplicate ID", key.IntID())
+			}
+			seen[key.IntID()] = true
+		}
+	}
+	if allocateCalls != 2 {
+		t.Fatal("expected 2 datastore allocations", allocateCalls)
+	}
+
+	// Allocated keys are locked and cached straight away.
+	keys, err := nds.AllocateIDs(c, "Entity", nil, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rc := &recordingCache{}
+	if _, err := nds.Put(nds.WithCache(c, rc), keys[0],
+		&testEntity{1}); err != nil {
+		t.Fatal(err)
+	}
+	if len(rc.setItems) != 1 {
+		t.Fatal("expected entity to be locked", len(rc.setItems))
+	}
+
+	if _, err := nds.AllocateIDs(c, "", nil, 1); err == nil {
+		t.Fatal("expected empty kind error")
+	}
+
+	// Allocations go to the DatastoreClient set with WithDatastore.
+	if _, err := nds.AllocateIDs(nds.WithDatastore(c, &countingDatastore{}),
+		"Entity", nil, 1); err == nil {
+		t.Fatal("expected IDAllocator error")
+	}
+}
@@ -0,0 +1,89 @@
+package nds
+
+import (
+	"sync"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/datastore"
+)
+
+var asyncInvalidationKey = "used for async cache invalidation"
+
+// WithAsyncCacheInvalidation returns a context that makes PutMulti return as
+// soon as the entities are saved to the datastore, removing the cache locks it
+// set before the put in the background instead. This takes a cache round trip
+// off the critical path of write heavy requests. Each background removal is
+// added to wg so the caller can wait for them all to finish, for example before
+// a request handler returns.
+//
+// Until the locks are removed GetMulti reads the entities from the datastore
+// without caching them, so deferring the removal only delays caching the new
+// entities again. However, a lock lasts for the lock time (32 seconds by
+// default) and once it expires nothing stops the entity read before the put
+// being cached, so the lock time must comfortably cover the background
+// removal. For the same reason the locks are still removed before PutMulti
+// returns when c uses WithoutLocks, WithNoCache or WithFailClosed, as then
+// there is either no lock covering the put or the caller needs to know the
+// removal succeeded. Removal failures are logged as warnings.
+func WithAsyncCacheInvalidation(c context.Context,
+	wg *sync.WaitGroup) context.Context {
+	return context.WithValue(c, &asyncInvalidationKey, wg)
+}
+
+// asyncInvalidationGroup returns the WaitGroup of c to remove the locks of a
+// put in the background with, if they can be.
+func asyncInvalidationGroup(c context.Context) (*sync.WaitGroup, bool) {
+	wg, _ := c.Value(&asyncInvalidationKey).(*sync.WaitGroup)
+	if wg == nil || isWithoutLocks(c) || isNoCache(c) || isFailClosed(c) {
+		return nil, false
+	}
+	return wg, true
+}
+
+// invalidatePut removes the locks of the cache keys set before putting the
+// entities for keys, or any cached entities if they were not locked, or
+// replaces them with refresh markers if WithGraceRefresh is used.
+func invalidatePut(c context.Context, cacheKeys []string,
+	keys []*datastore.Key) error {
+
+	countInvalidations(c, cacheKeys)
+	err := retry(c, func() error {
+		if d, ok := graceRefresh(c); ok {
+			return invalidationCache(c).SetMulti(c,
+				newRefreshItems(cacheKeys, d))
+		}
+		return invalidationCache(c).DeleteMulti(c, cacheKeys)
+	})
+	// Readers may have added the old entities to the process cache while the
+	// put held its locks.
+	evictProcessCache(c, cacheKeys)
+	if err != nil && !isCacheMissErrors(err) {
+		if isFailClosed(c) {
+			return err
+		}
+		invalidationWarningf(c, "putMulti memcache.DeleteMulti %s", cacheKeys,
+			err)
+	} else {
+		invalidated(c, keys)
+		rewarmPinned(c, keys)
+	}
+	return nil
+}
+
+// invalidatePutAsync runs invalidatePut in the background, adding it to wg.
+// The batch contexts of WithFailFast are cancelled once PutMulti returns, so
+// the removal only stops when the context of the PutMulti call does.
+func invalidatePutAsync(c context.Context, wg *sync.WaitGroup,
+	cacheKeys []string, keys []*datastore.Key) {
+
+	c = withoutBatchLogging(withoutFailFastCancel(c))
+	wg.Add(1)
+	go func() {
+		defer func() {
+			wg.Done()
+			// As with Prefetch, give up if the request behind c has finished.
+			recover()
+		}()
+		invalidatePut(c, cacheKeys, keys)
+	}()
+}
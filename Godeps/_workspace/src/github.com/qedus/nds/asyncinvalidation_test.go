@@ -0,0 +1,129 @@
+package nds_test
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/qedus/nds"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/memcache"
+)
+
+// gatedCache is a recordingCache whose DeleteMulti waits for release.
+type gatedCache struct {
+	*recordingCache
+	release chan struct{}
+}
+
+func (gc *gatedCache) DeleteMulti(c context.Context, keys []string) error {
+	<-gc.release
+	return gc.recordingCache.DeleteMulti(c, keys)
+}
+
+func TestWithAsyncCacheInvalidation(t *testing.T) {
+	c, closeFunc := NewContext(t, nil)
+	defer closeFunc()
+
+	type testEntity struct {
+		Val int
+	}
+
+	gc := &gatedCache{&recordingCache{}, make(chan struct{})}
+	wg := &sync.WaitGroup{}
+	ac := nds.WithAsyncCacheInvalidation(nds.WithCache(c, gc), wg)
+
+	key := datastore.NewKey(c, "Entity", "", 1, nil)
+	if _, err := nds.Put(ac, key, &testEntity{1}); err != nil {
+		t.Fatal(err)
+	}
+
+	// The lock is still held so the entity is read from the datastore.
+	item, err := memcache.Get(c, nds.CreateMemcacheKey(key))
+	if err != nil {
+		t.Fatal(err)
+	} else if item.Flags != nds.LockItem {
+		t.Fatal("expected lock item", item.Flags)
+	}
+	te := &testEntity{}
+	if err := nds.Get(nds.WithCache(c, gc), key, te); err != nil {
+		t.Fatal(err)
+	} else if te.Val != 1 {
+		t.Fatal("incorrect val", te.Val)
+	}
+
+	close(gc.release)
+	wg.Wait()
+	if len(gc.delKeys) != 1 {
+		t.Fatal("expected lock to be removed", len(gc.delKeys))
+	}
+	if _, err := memcache.Get(c,
+		nds.CreateMemcacheKey(key)); err != memcache.ErrCacheMiss {
+		t.Fatal("expected cache miss", err)
+	}
+}
+
+func TestWithAsyncCacheInvalidationWithoutLocks(t *testing.T) {
+	c, closeFunc := NewContext(t, nil)
+	defer closeFunc()
+
+	type testEntity struct {
+		Val int
+	}
+
+	rc := &recordingCache{}
+	wg := &sync.WaitGroup{}
+	ac := nds.WithAsyncCacheInvalidation(nds.WithoutLocks(
+		nds.WithCache(c, rc)), wg)
+
+	key := datastore.NewKey(c, "Entity", "", 1, nil)
+	if _, err := nds.Put(ac, key, &testEntity{1}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Without a lock covering the put the cache is cleared straight away.
+	if len(rc.delKeys) != 1 {
+		t.Fatal("expected cache to be cleared", len(rc.delKeys))
+	}
+}
+
+func TestWithAsyncCacheInvalidationBatches(t *testing.T) {
+	c, closeFunc := NewContext(t, nil)
+	defer closeFunc()
+
+	type testEntity struct {
+		Val int
+	}
+
+	keys := []*datastore.Key{
+		datastore.NewKey(c, "Entity", "", 1, nil),
+		datastore.NewKey(c, "Entity", "", 2, nil),
+	}
+	for _, failFast := range []bool{false, true} {
+		gc := &gatedCache{&recordingCache{}, make(chan struct{})}
+		wg := &sync.WaitGroup{}
+		ac := nds.WithAsyncCacheInvalidation(nds.WithMaxBatchSize(
+			nds.WithCache(c, gc), 1), wg)
+		if failFast {
+			ac = nds.WithFailFast(ac)
+		}
+
+		if _, err := nds.PutMulti(ac, keys,
+			[]testEntity{{1}, {2}}); err != nil {
+			t.Fatal(err)
+		}
+
+		// The removals outlive the batches that started them.
+		close(gc.release)
+		wg.Wait()
+		if len(gc.delKeys) != len(keys) {
+			t.Fatal("expected locks to be removed", failFast, gc.delKeys)
+		}
+		for _, key := range keys {
+			if _, err := memcache.Get(c,
+				nds.CreateMemcacheKey(key)); err != memcache.ErrCacheMiss {
+				t.Fatal("expected cache miss", failFast, err)
+			}
+		}
+	}
+}
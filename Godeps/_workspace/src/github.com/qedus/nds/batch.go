@@ -0,0 +1,163 @@
+package nds
+
+import (
+	"sync"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine"
+)
+
+var maxBatchSizeKey = "used for max batch size"
+
+// WithMaxBatchSize returns a context that limits the number of entities NDS
+// sends to the datastore and memcache in a single call to n. Larger
+// PutMulti, GetMulti and DeleteMulti calls are split into batches of at most n
+// entities. Values of n above the App Engine limit of 500 are clamped to 500
+// and values of zero or less use the default batch sizes.
+func WithMaxBatchSize(c context.Context, n int) context.Context {
+	return context.WithValue(c, &maxBatchSizeKey, n)
+}
+
+// batchSize returns the number of entities that should be processed at once
+// by an operation whose API limit is limit.
+func batchSize(c context.Context, limit int) int {
+	n, ok := c.Value(&maxBatchSizeKey).(int)
+	if !ok || n <= 0 {
+		return limit
+	}
+	if n > putMultiLimit {
+		warningf(c, "nds: max batch size %d clamped to %d",
+			n, putMultiLimit)
+		n = putMultiLimit
+	}
+	if n > limit {
+		n = limit
+	}
+	return n
+}
+
+var concurrencyKey = "used for batch concurrency"
+
+// WithConcurrency returns a context that lets NDS run up to n batches of a
+// large PutMulti or DeleteMulti at once rather than one after another, which
+// can greatly reduce the latency of very large calls. It also limits GetMulti,
+// which runs all its batches at once by default, to n batches at a time.
+// Results and errors are reported in the same order as the keys regardless of
+// the order batches complete in. Values of n of one or less run put and delete
+// batches one at a time, which is the default.
+func WithConcurrency(c context.Context, n int) context.Context {
+	return context.WithValue(c, &concurrencyKey, n)
+}
+
+// concurrency returns the number of batches that may run at once for c, or
+// zero if no limit was set.
+func concurrency(c context.Context) int {
+	n, _ := c.Value(&concurrencyKey).(int)
+	if n < 1 {
+		return 0
+	}
+	return n
+}
+
+// runBatches calls f for consecutive batches of at most size indexes that
+// cover [0, count). Errors are collated into a appengine.MultiError of length
+// count. A batch error that is not a appengine.MultiError is reported for
+// every index within that batch. If c is done before a batch starts the
+// remaining batches are abandoned and c.Err() is returned. Batches that have
+// already run will have cleaned up after themselves.
+//
+// Up to concurrency(c) batches are run at once, so f must be safe to call
+// concurrently for different batches when a concurrency is set.
+func runBatches(c context.Context, count, size int,
+	f func(lo, hi int) error) error {
+	return runBudgetedBatches(c, count, size, nil, f)
+}
+
+// runBudgetedBatches works just like runBatches except that, if budget is not
+// nil, a batch that budget does not expect to finish before the deadline of c
+// is not started. If every batch before it succeeded a *DeadlineBudgetError
+// is returned, otherwise ErrDeadlineBudgetExceeded is reported for the indexes
+// of the batches that were not started.
+func runBudgetedBatches(c context.Context, count, size int,
+	budget *batchBudget, f func(lo, hi int) error) error {
+
+	errs := make([]error, (count-1)/size+1)
+	n := concurrency(c)
+	if n < 1 {
+		n = 1
+	}
+	sem := make(chan struct{}, n)
+	wg := sync.WaitGroup{}
+	var cancelErr error
+	started := len(errs)
+	for lo := 0; lo < count; lo += size {
+		sem <- struct{}{}
+		if err := c.Err(); err != nil {
+			cancelErr = err
+			break
+		}
+		if budget != nil && !budget.fits(c) {
+			started = lo / size
+			break
+		}
+		hi := lo + size
+		if hi > count {
+			hi = count
+		}
+
+		wg.Add(1)
+		go func(index, lo, hi int) {
+			start := timeNow()
+			errs[index] = f(lo, hi)
+			if budget != nil {
+				budget.record(timeNow().Sub(start))
+			}
+			<-sem
+			wg.Done()
+		}(lo/size, lo, hi)
+	}
+	wg.Wait()
+
+	if cancelErr != nil {
+		return cancelErr
+	}
+	if started < len(errs) {
+		if groupBatchErrors(count, size, errs) == nil {
+			return &DeadlineBudgetError{Completed: started, Done: started * size}
+		}
+		for i := started; i < len(errs); i++ {
+			errs[i] = ErrDeadlineBudgetExceeded
+		}
+	}
+	return groupBatchErrors(count, size, errs)
+}
+
+// groupBatchErrors collates the errors from each batch of runBatches.
+func groupBatchErrors(count, size int, errs []error) error {
+	errsNil := true
+	for _, err := range errs {
+		if err != nil {
+			errsNil = false
+		}
+	}
+	if errsNil {
+		return nil
+	}
+
+	groupedErrs := make(appengine.MultiError, count)
+	for i, err := range errs {
+		lo := i * size
+		hi := lo + size
+		if hi > count {
+			hi = count
+		}
+		if me, ok := err.(appengine.MultiError); ok {
+			copy(groupedErrs[lo:hi], me)
+		} else if err != nil {
+			for j := lo; j < hi; j++ {
+				groupedErrs[j] = err
+			}
+		}
+	}
+	return groupedErrs
+}
@@ -0,0 +1,235 @@
+package nds_test
+
+import (
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/qedus/nds"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+)
+
+func TestWithMaxBatchSize(t *testing.T) {
+	c, closeFunc := NewContext(t, nil)
+	defer closeFunc()
+
+	type testEntity struct {
+		IntVal int
+	}
+
+	putSizes, getSizes, deleteSizes := []int{}, []int{}, []int{}
+	nds.SetDatastorePutMulti(func(c context.Context,
+		keys []*datastore.Key, vals interface{}) ([]*datastore.Key, error) {
+		putSizes = append(putSizes, len(keys))
+		return datastore.PutMulti(c, keys, vals)
+	})
+	nds.SetDatastoreGetMulti(func(c context.Context,
+		keys []*datastore.Key, vals interface{}) error {
+		getSizes = append(getSizes, len(keys))
+		return datastore.GetMulti(c, keys, vals)
+	})
+	nds.SetDatastoreDeleteMulti(func(c context.Context,
+		keys []*datastore.Key) error {
+		deleteSizes = append(deleteSizes, len(keys))
+		return datastore.DeleteMulti(c, keys)
+	})
+	defer func() {
+		nds.SetDatastorePutMulti(datastore.PutMulti)
+		nds.SetDatastoreGetMulti(datastore.GetMulti)
+		nds.SetDatastoreDeleteMulti(datastore.DeleteMulti)
+	}()
+
+	keys := []*datastore.Key{}
+	entities := []testEntity{}
+	for i := 0; i < 5; i++ {
+		keys = append(keys, datastore.NewKey(c, "Entity", "", int64(i+1), nil))
+		entities = append(entities, testEntity{i})
+	}
+
+	bc := nds.WithMaxBatchSize(c, 2)
+	putKeys, err := nds.PutMulti(bc, keys, entities)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, key := range putKeys {
+		if !key.Equal(keys[i]) {
+			t.Fatal("keys out of order")
+		}
+	}
+	if len(putSizes) != 3 || putSizes[0] != 2 || putSizes[2] != 1 {
+		t.Fatal("incorrect put batches", putSizes)
+	}
+
+	respEntities := make([]testEntity, len(keys))
+	if err := nds.GetMulti(bc, keys, respEntities); err != nil {
+		t.Fatal(err)
+	}
+	for i, te := range respEntities {
+		if te.IntVal != i {
+			t.Fatal("entities out of order")
+		}
+	}
+	if len(getSizes) != 3 {
+		t.Fatal("incorrect get batches", getSizes)
+	}
+
+	if err := nds.DeleteMulti(bc, keys); err != nil {
+		t.Fatal(err)
+	}
+	if len(deleteSizes) != 3 {
+		t.Fatal("incorrect delete batches", deleteSizes)
+	}
+}
+
+func TestWithMaxBatchSizeClamped(t *testing.T) {
+	c, closeFunc := NewContext(t, nil)
+	defer closeFunc()
+
+	type testEntity struct {
+		IntVal int
+	}
+
+	putSizes := []int{}
+	nds.SetDatastorePutMulti(func(c context.Context,
+		keys []*datastore.Key, vals interface{}) ([]*datastore.Key, error) {
+		putSizes = append(putSizes, len(keys))
+		return datastore.PutMulti(c, keys, vals)
+	})
+	defer nds.SetDatastorePutMulti(datastore.PutMulti)
+
+	keys := []*datastore.Key{}
+	entities := []testEntity{}
+	for i := 0; i < 501; i++ {
+		keys = append(keys,
+			datastore.NewKey(c, "Entity", strconv.Itoa(i), 0, nil))
+		entities = append(entities, testEntity{i})
+	}
+
+	if _, err := nds.PutMulti(nds.WithMaxBatchSize(c, 1000),
+		keys, entities); err != nil {
+		t.Fatal(err)
+	}
+	if len(putSizes) != 2 || putSizes[0] != 500 || putSizes[1] != 1 {
+		t.Fatal("incorrect put batches", putSizes)
+	}
+}
+
+func TestBatchesStopWhenCancelled(t *testing.T) {
+	c, closeFunc := NewContext(t, nil)
+	defer closeFunc()
+
+	type testEntity struct {
+		IntVal int
+	}
+
+	cc, cancel := context.WithCancel(nds.WithMaxBatchSize(c, 2))
+	defer cancel()
+
+	putCalls := 0
+	nds.SetDatastorePutMulti(func(c context.Context,
+		keys []*datastore.Key, vals interface{}) ([]*datastore.Key, error) {
+		putCalls++
+		defer cancel()
+		return datastore.PutMulti(c, keys, vals)
+	})
+	defer nds.SetDatastorePutMulti(datastore.PutMulti)
+
+	keys := make([]*datastore.Key, 5)
+	entities := make([]testEntity, 5)
+	for i := range keys {
+		keys[i] = datastore.NewKey(c, "Entity", "", int64(i+1), nil)
+	}
+
+	if _, err := nds.PutMulti(cc, keys, entities); err != context.Canceled {
+		t.Fatal("expected context.Canceled", err)
+	}
+	if putCalls != 1 {
+		t.Fatal("expected 1 datastore put", putCalls)
+	}
+
+	// The first batch was still committed.
+	te := &testEntity{}
+	if err := nds.Get(c, keys[0], te); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := nds.DeleteMulti(cc, keys); err != context.Canceled {
+		t.Fatal("expected context.Canceled", err)
+	}
+	if err := nds.GetMulti(cc, keys, entities); err != context.Canceled {
+		t.Fatal("expected context.Canceled", err)
+	}
+}
+
+func TestWithConcurrency(t *testing.T) {
+	c, closeFunc := NewContext(t, nil)
+	defer closeFunc()
+
+	type testEntity struct {
+		IntVal int
+	}
+
+	var mu sync.Mutex
+	inFlight, maxInFlight := 0, 0
+	nds.SetDatastorePutMulti(func(c context.Context,
+		keys []*datastore.Key, vals interface{}) ([]*datastore.Key, error) {
+		mu.Lock()
+		inFlight++
+		if inFlight > maxInFlight {
+			maxInFlight = inFlight
+		}
+		mu.Unlock()
+
+		time.Sleep(10 * time.Millisecond)
+		keys, err := datastore.PutMulti(c, keys, vals)
+
+		mu.Lock()
+		inFlight--
+		mu.Unlock()
+		return keys, err
+	})
+	defer nds.SetDatastorePutMulti(datastore.PutMulti)
+
+	keys := make([]*datastore.Key, 10)
+	entities := make([]testEntity, len(keys))
+	for i := range keys {
+		keys[i] = datastore.NewIncompleteKey(c, "Entity", nil)
+		entities[i].IntVal = i
+	}
+
+	cc := nds.WithConcurrency(nds.WithMaxBatchSize(c, 2), 3)
+	putKeys, err := nds.PutMulti(cc, keys, entities)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if maxInFlight < 2 || maxInFlight > 3 {
+		t.Fatal("unexpected concurrency", maxInFlight)
+	}
+
+	// Results are in key order.
+	got := make([]testEntity, len(putKeys))
+	if err := nds.GetMulti(cc, putKeys, got); err != nil {
+		t.Fatal(err)
+	}
+	for i, entity := range got {
+		if entity.IntVal != i {
+			t.Fatal("incorrect entity order", i, entity.IntVal)
+		}
+	}
+
+	// Errors keep their index positions.
+	putKeys[3] = datastore.NewKey(c, "Other", "", 1, nil)
+	err = nds.GetMulti(cc, putKeys, make([]testEntity, len(putKeys)))
+	if me, ok := err.(appengine.MultiError); !ok {
+		t.Fatal("expected appengine.MultiError", err)
+	} else {
+		for i, err := range me {
+			if (i == 3) != (err == datastore.ErrNoSuchEntity) {
+				t.Fatal("incorrect error", i, err)
+			}
+		}
+	}
+}
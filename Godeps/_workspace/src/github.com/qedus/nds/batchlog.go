@@ -0,0 +1,105 @@
+package nds
+
+import (
+	"sync"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/memcache"
+)
+
+var batchLoggingKey = "used for batch logging"
+
+// WithBatchLogging returns a context that makes PutMulti and DeleteMulti log
+// the cache invalidations that fail across all of their batches as a single
+// warning, such as "nds: 3/500 cache deletes failed: keys [...]", once the
+// call has finished, instead of logging a warning for each failure. This keeps
+// the log volume of write heavy requests down without losing which entries
+// may still be cached. The warning goes to the Logger set with WithLogger, if
+// any. Invalidations done in the background with WithAsyncCacheInvalidation
+// are still logged as they fail.
+func WithBatchLogging(c context.Context) context.Context {
+	return context.WithValue(c, &batchLoggingKey, true)
+}
+
+func isBatchLogging(c context.Context) bool {
+	batchLogging, _ := c.Value(&batchLoggingKey).(bool)
+	return batchLogging
+}
+
+var invalidationLogKey = "used for *invalidationLog"
+
+// invalidationLog collects the cache invalidations of a PutMulti or
+// DeleteMulti call made with WithBatchLogging.
+type invalidationLog struct {
+	mu         sync.Mutex
+	total      int
+	failedKeys []string
+	err        error
+}
+
+func invalidationLogFromContext(c context.Context) (*invalidationLog, bool) {
+	l, _ := c.Value(&invalidationLogKey).(*invalidationLog)
+	return l, l != nil
+}
+
+// batchLogging returns a context collecting the invalidation failures of c
+// if it uses WithBatchLogging, and a function logging them once the call is
+// done. Calls nested within one that already collects them, and contexts not
+// using WithBatchLogging, are returned as they are.
+func batchLogging(c context.Context) (context.Context, func()) {
+	if _, ok := invalidationLogFromContext(c); ok || !isBatchLogging(c) {
+		return c, func() {}
+	}
+	l := &invalidationLog{}
+	return context.WithValue(c, &invalidationLogKey, l), func() {
+		if len(l.failedKeys) > 0 {
+			warningf(c, "nds: %d/%d cache deletes failed: keys %v: %s",
+				len(l.failedKeys), l.total, l.failedKeys, l.err)
+		}
+	}
+}
+
+// withoutBatchLogging returns a context that logs invalidation failures as
+// they happen, used for invalidations that may outlast their call.
+func withoutBatchLogging(c context.Context) context.Context {
+	return context.WithValue(c, &invalidationLogKey, (*invalidationLog)(nil))
+}
+
+// countInvalidations counts cacheKeys as being invalidated for the batch log
+// of c, if it has one.
+func countInvalidations(c context.Context, cacheKeys []string) {
+	if l, ok := invalidationLogFromContext(c); ok {
+		l.mu.Lock()
+		l.total += len(cacheKeys)
+		l.mu.Unlock()
+	}
+}
+
+// invalidationWarningf logs err, the error invalidating cacheKeys, with
+// format, or records the keys it failed for in the batch log of c. Failures to
+// reach a cache known to be unavailable are only logged at debug level.
+func invalidationWarningf(c context.Context, format string,
+	cacheKeys []string, err error) {
+
+	l, ok := invalidationLogFromContext(c)
+	if !ok && isCacheUnavailable(c) {
+		// The failure is expected and was logged when the cache was probed.
+		debugf(c, format, err)
+		return
+	} else if !ok {
+		warningf(c, format, err)
+		return
+	}
+
+	me, isMultiError := err.(appengine.MultiError)
+	isMultiError = isMultiError && len(me) == len(cacheKeys)
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for i, cacheKey := range cacheKeys {
+		if !isMultiError || me[i] != nil && me[i] != memcache.ErrCacheMiss {
+			l.failedKeys = append(l.failedKeys, cacheKey)
+		}
+	}
+	l.err = err
+}
@@ -0,0 +1,67 @@
+package nds_test
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/qedus/nds"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/memcache"
+)
+
+func TestWithBatchLogging(t *testing.T) {
+	c, closeFunc := NewContext(t, nil)
+	defer closeFunc()
+
+	type testEntity struct {
+		Val int
+	}
+
+	nds.SetMemcacheDeleteMulti(func(c context.Context, keys []string) error {
+		return errors.New("expected error")
+	})
+	defer nds.SetMemcacheDeleteMulti(memcache.DeleteMulti)
+
+	keys := make([]*datastore.Key, 5)
+	for i := range keys {
+		keys[i] = datastore.NewKey(c, "Entity", "", int64(i+1), nil)
+	}
+	rl := &recordingLogger{}
+	lc := nds.WithMaxBatchSize(nds.WithLogger(c, rl), 2)
+
+	// Without batch logging each batch logs its failure.
+	if _, err := nds.PutMulti(lc, keys,
+		make([]testEntity, len(keys))); err != nil {
+		t.Fatal(err)
+	}
+	if len(rl.warnings) != 3 {
+		t.Fatal("expected a warning per batch", rl.warnings)
+	}
+
+	rl.warnings = nil
+	bc := nds.WithBatchLogging(lc)
+	if _, err := nds.PutMulti(bc, keys,
+		make([]testEntity, len(keys))); err != nil {
+		t.Fatal(err)
+	}
+	if len(rl.warnings) != 1 || !strings.HasPrefix(rl.warnings[0],
+		"nds: 5/5 cache deletes failed: keys [") {
+		t.Fatal("expected one aggregated warning", rl.warnings)
+	}
+	for _, key := range keys {
+		if !strings.Contains(rl.warnings[0], nds.CacheKey(c, key)) {
+			t.Fatal("expected the failed key to be logged", key)
+		}
+	}
+
+	rl.warnings = nil
+	if err := nds.DeleteMulti(nds.WithoutLocks(bc), keys); err != nil {
+		t.Fatal(err)
+	}
+	if len(rl.warnings) != 1 || !strings.HasPrefix(rl.warnings[0],
+		"nds: 5/5 cache deletes failed: keys [") {
+		t.Fatal("expected one aggregated warning", rl.warnings)
+	}
+}
@@ -0,0 +1,216 @@
+package nds
+
+import (
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/memcache"
+)
+
+// BreakerOpts tunes the circuit breaker set with WithCircuitBreaker.
+type BreakerOpts struct {
+	// Threshold is the number of consecutive cache errors that opens the
+	// breaker. The default is 5.
+	Threshold int
+
+	// Window is how close together the errors must be. An error more than
+	// Window after the first of a run of errors starts a new run. The
+	// default is 10 seconds.
+	Window time.Duration
+
+	// CoolDown is how long the breaker stays open before a single request is
+	// let through to the cache to probe whether it has recovered. The
+	// default is 30 seconds.
+	CoolDown time.Duration
+}
+
+func (opts BreakerOpts) withDefaults() BreakerOpts {
+	if opts.Threshold <= 0 {
+		opts.Threshold = 5
+	}
+	if opts.Window <= 0 {
+		opts.Window = 10 * time.Second
+	}
+	if opts.CoolDown <= 0 {
+		opts.CoolDown = 30 * time.Second
+	}
+	return opts
+}
+
+// breaker is the state of a circuit breaker, shared by every context using
+// the same BreakerOpts.
+type breaker struct {
+	sync.Mutex
+	opts BreakerOpts
+
+	failures     int
+	firstFailure time.Time
+
+	open      bool
+	openUntil time.Time
+
+	// probeUntil is when a probe let through an open breaker is given up on
+	// so another request can probe.
+	probeUntil time.Time
+}
+
+var breakers = struct {
+	sync.Mutex
+	m map[BreakerOpts]*breaker
+}{m: map[BreakerOpts]*breaker{}}
+
+var breakerKey = "used for circuit breaker"
+
+// WithCircuitBreaker returns a context that stops NDS using the cache during
+// a sustained cache outage, rather than waiting for every cache call to fail
+// before falling back to the datastore. Once opts.Threshold consecutive cache
+// calls have failed within opts.Window the breaker opens and, for
+// opts.CoolDown, NDS behaves as though WithNoCache had been used: GetMulti
+// reads straight from the datastore and PutMulti and DeleteMulti write without
+// locking the cache, though they still try to delete cached copies afterwards
+// so entities are not left stale. After the cool-down one request probes the
+// cache, closing the breaker if its cache calls succeed and opening it for
+// another cool-down if not.
+//
+// The breaker state is shared between all contexts, and so all requests in
+// the instance, that use equal opts. Whether the cache is used is decided
+// once when GetMulti, PutMulti or DeleteMulti is called and holds for the
+// whole call.
+func WithCircuitBreaker(c context.Context, opts BreakerOpts) context.Context {
+	opts = opts.withDefaults()
+	breakers.Lock()
+	b, ok := breakers.m[opts]
+	if !ok {
+		b = &breaker{opts: opts}
+		breakers.m[opts] = b
+	}
+	breakers.Unlock()
+	return context.WithValue(c, &breakerKey, b)
+}
+
+func breakerFromContext(c context.Context) (*breaker, bool) {
+	b, ok := c.Value(&breakerKey).(*breaker)
+	return b, ok
+}
+
+var breakerDecisionKey = "used for circuit breaker decision"
+
+// withBreakerDecision returns a context carrying whether the circuit breaker
+// of c lets the operation started with c use the cache. Every step of the
+// operation then sees the same answer, so a put that locks the cache also
+// invalidates it, and a probe let through an open breaker is taken by one
+// operation rather than by one of its steps.
+func withBreakerDecision(c context.Context) context.Context {
+	b, ok := breakerFromContext(c)
+	if !ok {
+		return c
+	}
+	if _, decided := c.Value(&breakerDecisionKey).(bool); decided {
+		return c
+	}
+	return context.WithValue(c, &breakerDecisionKey, !b.allow())
+}
+
+// isBreakerOpen reports whether the circuit breaker of c, if any, is keeping
+// NDS from using the cache.
+func isBreakerOpen(c context.Context) bool {
+	if open, ok := c.Value(&breakerDecisionKey).(bool); ok {
+		return open
+	}
+	b, ok := breakerFromContext(c)
+	return ok && !b.allow()
+}
+
+// allow reports whether the cache may be used, letting a probe through once
+// the cool-down of an open breaker has passed.
+func (b *breaker) allow() bool {
+	b.Lock()
+	defer b.Unlock()
+	if !b.open {
+		return true
+	}
+	now := time.Now()
+	if now.Before(b.openUntil) || now.Before(b.probeUntil) {
+		return false
+	}
+	b.probeUntil = now.Add(b.opts.CoolDown)
+	return true
+}
+
+// record updates the breaker with the result of a cache call.
+func (b *breaker) record(err error) {
+	b.Lock()
+	defer b.Unlock()
+	now := time.Now()
+	if !isCacheFailure(err) {
+		b.failures, b.open = 0, false
+		return
+	}
+
+	if b.open {
+		// A failed probe, or a call that started before the breaker opened.
+		b.openUntil = now.Add(b.opts.CoolDown)
+		return
+	}
+	if b.failures == 0 || now.Sub(b.firstFailure) > b.opts.Window {
+		b.failures, b.firstFailure = 0, now
+	}
+	b.failures++
+	if b.failures >= b.opts.Threshold {
+		b.open, b.openUntil = true, now.Add(b.opts.CoolDown)
+	}
+}
+
+// isCacheFailure reports whether err means the cache could not be used, as
+// opposed to reporting the outcome for individual items.
+func isCacheFailure(err error) bool {
+	switch err {
+	case nil, memcache.ErrCacheMiss, memcache.ErrNotStored,
+		memcache.ErrCASConflict:
+		return false
+	}
+	_, ok := err.(appengine.MultiError)
+	return !ok
+}
+
+// breakerCache records the result of every call to a Cache with a breaker.
+type breakerCache struct {
+	cache   Cache
+	breaker *breaker
+}
+
+func (bc breakerCache) AddMulti(c context.Context,
+	items []*memcache.Item) error {
+	err := bc.cache.AddMulti(c, items)
+	bc.breaker.record(err)
+	return err
+}
+
+func (bc breakerCache) CompareAndSwapMulti(c context.Context,
+	items []*memcache.Item) error {
+	err := bc.cache.CompareAndSwapMulti(c, items)
+	bc.breaker.record(err)
+	return err
+}
+
+func (bc breakerCache) DeleteMulti(c context.Context, keys []string) error {
+	err := bc.cache.DeleteMulti(c, keys)
+	bc.breaker.record(err)
+	return err
+}
+
+func (bc breakerCache) GetMulti(c context.Context,
+	keys []string) (map[string]*memcache.Item, error) {
+	items, err := bc.cache.GetMulti(c, keys)
+	bc.breaker.record(err)
+	return items, err
+}
+
+func (bc breakerCache) SetMulti(c context.Context,
+	items []*memcache.Item) error {
+	err := bc.cache.SetMulti(c, items)
+	bc.breaker.record(err)
+	return err
+}
@@ -0,0 +1,132 @@
+package nds_test
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/qedus/nds"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/memcache"
+)
+
+// flakyCache is a recordingCache whose calls all fail while down is set.
+type flakyCache struct {
+	recordingCache
+	mu    sync.Mutex
+	down  bool
+	calls int
+}
+
+func (fc *flakyCache) call() error {
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+	fc.calls++
+	if fc.down {
+		return errors.New("expected error")
+	}
+	return nil
+}
+
+func (fc *flakyCache) AddMulti(c context.Context, items []*memcache.Item) error {
+	if err := fc.call(); err != nil {
+		return err
+	}
+	return fc.recordingCache.AddMulti(c, items)
+}
+
+func (fc *flakyCache) CompareAndSwapMulti(c context.Context,
+	items []*memcache.Item) error {
+	if err := fc.call(); err != nil {
+		return err
+	}
+	return fc.recordingCache.CompareAndSwapMulti(c, items)
+}
+
+func (fc *flakyCache) DeleteMulti(c context.Context, keys []string) error {
+	if err := fc.call(); err != nil {
+		return err
+	}
+	return fc.recordingCache.DeleteMulti(c, keys)
+}
+
+func (fc *flakyCache) GetMulti(c context.Context,
+	keys []string) (map[string]*memcache.Item, error) {
+	if err := fc.call(); err != nil {
+		return nil, err
+	}
+	return fc.recordingCache.GetMulti(c, keys)
+}
+
+func (fc *flakyCache) SetMulti(c context.Context, items []*memcache.Item) error {
+	if err := fc.call(); err != nil {
+		return err
+	}
+	return fc.recordingCache.SetMulti(c, items)
+}
+
+func TestWithCircuitBreaker(t *testing.T) {
+	c, closeFunc := NewContext(t, nil)
+	defer closeFunc()
+
+	type testEntity struct {
+		Val int
+	}
+
+	fc := &flakyCache{}
+	bc := nds.WithCircuitBreaker(nds.WithCache(c, fc), nds.BreakerOpts{
+		Threshold: 2,
+		Window:    time.Minute,
+		CoolDown:  50 * time.Millisecond,
+	})
+
+	key := datastore.NewKey(c, "Entity", "", 1, nil)
+	if _, err := nds.Put(bc, key, &testEntity{1}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Failing cache calls trip the breaker.
+	fc.down = true
+	if err := nds.Get(bc, key, &testEntity{}); err != nil {
+		t.Fatal(err)
+	}
+
+	// The cache is no longer called yet reads and writes still work.
+	fc.calls = 0
+	te := &testEntity{}
+	if err := nds.Get(bc, key, te); err != nil {
+		t.Fatal(err)
+	} else if te.Val != 1 {
+		t.Fatal("incorrect val", te.Val)
+	}
+	if fc.calls != 0 {
+		t.Fatal("expected the cache to be skipped", fc.calls)
+	}
+
+	// Writes skip the locks but still try to invalidate the cache.
+	if _, err := nds.Put(bc, key, &testEntity{2}); err != nil {
+		t.Fatal(err)
+	}
+	if fc.calls != 1 {
+		t.Fatal("expected only the invalidation to reach the cache", fc.calls)
+	}
+
+	// Once the cache recovers a probe after the cool-down closes the breaker.
+	fc.down = false
+	time.Sleep(60 * time.Millisecond)
+	te = &testEntity{}
+	if err := nds.Get(bc, key, te); err != nil {
+		t.Fatal(err)
+	} else if te.Val != 2 {
+		t.Fatal("incorrect val", te.Val)
+	}
+	fc.calls = 0
+	if err := nds.Get(bc, key, &testEntity{}); err != nil {
+		t.Fatal(err)
+	}
+	if fc.calls == 0 {
+		t.Fatal("expected the cache to be used again")
+	}
+}
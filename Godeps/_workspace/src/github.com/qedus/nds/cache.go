@@ -0,0 +1,97 @@
+package nds
+
+import (
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/memcache"
+)
+
+// Cache is the storage backend NDS uses for its caching strategy. By default
+// App Engine memcache is used but any backend that honours the memcache.Item
+// semantics below can be plugged in using WithCache.
+//
+// Implementations must store and return the Flags, Value and Expiration of
+// each item unaltered as NDS uses Flags to tell lock items apart from cached
+// entities. AddMulti must only store items whose key is not already present.
+// CompareAndSwapMulti is only ever called with items previously returned by
+// GetMulti and must only store an item if it has not been modified since it
+// was returned. Errors for individual items should be reported using a
+// appengine.MultiError.
+type Cache interface {
+	AddMulti(c context.Context, items []*memcache.Item) error
+	CompareAndSwapMulti(c context.Context, items []*memcache.Item) error
+	DeleteMulti(c context.Context, keys []string) error
+	GetMulti(c context.Context, keys []string) (map[string]*memcache.Item, error)
+	SetMulti(c context.Context, items []*memcache.Item) error
+}
+
+var cacheKey = "used for Cache"
+
+// WithCache returns a context that makes NDS use cache instead of App Engine
+// memcache for all operations using the returned context.
+func WithCache(c context.Context, cache Cache) context.Context {
+	return context.WithValue(c, &cacheKey, cache)
+}
+
+func cacheFromContext(c context.Context) Cache {
+	if isCacheUnavailable(c) {
+		return unavailableCache{}
+	}
+	return contextCache(c)
+}
+
+// contextCache returns the cache set on c, wrapped as required by the other
+// options of c.
+func contextCache(c context.Context) Cache {
+	cache, ok := c.Value(&cacheKey).(Cache)
+	if !ok || cache == nil {
+		cache = memcacheCache{}
+	}
+	if b, ok := breakerFromContext(c); ok {
+		cache = breakerCache{cache, b}
+	}
+	if _, ok := tracerFromContext(c); ok {
+		return tracedCache{cache}
+	}
+	if _, ok := slowOpFromContext(c); ok {
+		return tracedCache{cache}
+	}
+	if _, ok := operationObserverFunc(); ok {
+		return tracedCache{cache}
+	}
+	return cache
+}
+
+// memcacheCache is the default Cache and uses App Engine memcache.
+type memcacheCache struct{}
+
+func (memcacheCache) AddMulti(c context.Context, items []*memcache.Item) error {
+	return memcacheAddMulti(c, items)
+}
+
+func (memcacheCache) CompareAndSwapMulti(c context.Context,
+	items []*memcache.Item) error {
+	return memcacheCompareAndSwapMulti(c, items)
+}
+
+func (memcacheCache) DeleteMulti(c context.Context, keys []string) error {
+	return memcacheDeleteMulti(c, keys)
+}
+
+func (memcacheCache) GetMulti(c context.Context,
+	keys []string) (map[string]*memcache.Item, error) {
+	return memcacheGetMulti(c, keys)
+}
+
+func (memcacheCache) SetMulti(c context.Context, items []*memcache.Item) error {
+	return memcacheSetMulti(c, items)
+}
+
+func (memcacheCache) Increment(c context.Context, key string, delta int64,
+	initialValue uint64) (uint64, error) {
+	return memcacheIncrement(c, key, delta, initialValue)
+}
+
+func (memcacheCache) IncrementExisting(c context.Context, key string,
+	delta int64) (uint64, error) {
+	return memcacheIncrementExisting(c, key, delta)
+}
@@ -0,0 +1,129 @@
+package nds_test
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/qedus/nds"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/memcache"
+)
+
+// recordingCache is a nds.Cache that records the items it is asked to store
+// before passing the request on to memcache.
+type recordingCache struct {
+	sync.Mutex
+	setItems []*memcache.Item
+	addItems []*memcache.Item
+	casItems []*memcache.Item
+	getKeys  []string
+	delKeys  []string
+}
+
+func (rc *recordingCache) AddMulti(c context.Context,
+	items []*memcache.Item) error {
+	rc.Lock()
+	rc.addItems = append(rc.addItems, items...)
+	rc.Unlock()
+	return memcache.AddMulti(c, items)
+}
+
+func (rc *recordingCache) CompareAndSwapMulti(c context.Context,
+	items []*memcache.Item) error {
+	rc.Lock()
+	rc.casItems = append(rc.casItems, items...)
+	rc.Unlock()
+	return memcache.CompareAndSwapMulti(c, items)
+}
+
+func (rc *recordingCache) DeleteMulti(c context.Context, keys []string) error {
+	rc.Lock()
+	rc.delKeys = append(rc.delKeys, keys...)
+	rc.Unlock()
+	return memcache.DeleteMulti(c, keys)
+}
+
+func (rc *recordingCache) GetMulti(c context.Context,
+	keys []string) (map[string]*memcache.Item, error) {
+	rc.Lock()
+	rc.getKeys = append(rc.getKeys, keys...)
+	rc.Unlock()
+	return memcache.GetMulti(c, keys)
+}
+
+func (rc *recordingCache) SetMulti(c context.Context,
+	items []*memcache.Item) error {
+	rc.Lock()
+	rc.setItems = append(rc.setItems, items...)
+	rc.Unlock()
+	return memcache.SetMulti(c, items)
+}
+
+func TestWithCache(t *testing.T) {
+	c, closeFunc := NewContext(t, nil)
+	defer closeFunc()
+
+	type testEntity struct {
+		IntVal int
+	}
+
+	rc := &recordingCache{}
+	cc := nds.WithCache(c, rc)
+
+	key := datastore.NewKey(c, "Entity", "", 1, nil)
+	memcacheKey := nds.CreateMemcacheKey(key)
+
+	if _, err := nds.Put(cc, key, &testEntity{42}); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(rc.setItems) != 1 {
+		t.Fatal("expected 1 lock item", len(rc.setItems))
+	}
+	if item := rc.setItems[0]; item.Key != memcacheKey {
+		t.Fatal("incorrect lock key", item.Key)
+	} else if item.Flags != nds.LockItem {
+		t.Fatal("expected lock item flags", item.Flags)
+	}
+	if len(rc.delKeys) != 1 || rc.delKeys[0] != memcacheKey {
+		t.Fatal("expected lock to be removed", rc.delKeys)
+	}
+
+	te := &testEntity{}
+	if err := nds.Get(cc, key, te); err != nil {
+		t.Fatal(err)
+	}
+	if te.IntVal != 42 {
+		t.Fatal("expected 42", te.IntVal)
+	}
+	if len(rc.addItems) != 1 || rc.addItems[0].Flags != nds.LockItem {
+		t.Fatal("expected read lock to be added")
+	}
+	if len(rc.casItems) != 1 || rc.casItems[0].Flags != nds.EntityItem {
+		t.Fatal("expected entity to be cached")
+	}
+
+	// The entity should now be served from the injected cache.
+	if _, err := memcache.Get(c, memcacheKey); err != nil {
+		t.Fatal(err)
+	}
+	rc.getKeys = nil
+	te = &testEntity{}
+	if err := nds.Get(cc, key, te); err != nil {
+		t.Fatal(err)
+	}
+	if te.IntVal != 42 {
+		t.Fatal("expected 42", te.IntVal)
+	}
+	if len(rc.getKeys) != 1 {
+		t.Fatal("expected a single cache lookup", rc.getKeys)
+	}
+
+	if err := nds.Delete(cc, key); err != nil {
+		t.Fatal(err)
+	}
+	if len(rc.setItems) != 2 || rc.setItems[1].Flags != nds.LockItem {
+		t.Fatal("expected delete to lock the item")
+	}
+}
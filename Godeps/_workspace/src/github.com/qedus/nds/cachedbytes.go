@@ -0,0 +1,75 @@
+package nds
+
+import (
+	"reflect"
+	"sync"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/datastore"
+)
+
+var cachedBytesKey = "used for *cachedBytesRecorder"
+
+// cachedBytesRecorder collects the entity items written through by putMulti,
+// keyed by memcache key.
+type cachedBytesRecorder struct {
+	mu   sync.Mutex
+	data map[string][]byte
+}
+
+// PutMultiWithCachedBytes is a PutMulti that also returns, for each entity,
+// the serialized cache entry that caches it, header, compression and all, as
+// GetMulti and WithWriteThrough write it. This allows what is cached to be
+// mirrored elsewhere byte for byte. With WithWriteThrough the bytes are those
+// PutMulti wrote; otherwise they are those a later read caches, except for the
+// header's expiry and write times, which are taken when the entry is written.
+//
+// The bytes of an entity put with an incomplete key are those of the key the
+// datastore assigned it. Bytes are nil for entities that cannot be cached,
+// such as entities too large for the cache. The bytes are nil and the error is
+// that of PutMulti if the put fails.
+func PutMultiWithCachedBytes(c context.Context, keys []*datastore.Key,
+	vals interface{}) ([]*datastore.Key, [][]byte, error) {
+
+	r := &cachedBytesRecorder{data: map[string][]byte{}}
+	putKeys, err := PutMulti(context.WithValue(c, &cachedBytesKey, r), keys,
+		vals)
+	if err != nil {
+		return putKeys, nil, err
+	}
+
+	cacheKeys := putKeys
+	if f, ok := keyMapperFromContext(c); ok {
+		if cacheKeys, err = mapKeys(putKeys, f); err != nil {
+			return putKeys, nil, err
+		}
+	}
+
+	v := reflect.ValueOf(vals)
+	data := make([][]byte, len(cacheKeys))
+	for i, key := range cacheKeys {
+		if recorded, ok := r.data[createMemcacheKey(c, key)]; ok {
+			data[i] = recorded
+			continue
+		}
+		item, _, err := cachedPutItem(c, key, v.Index(i))
+		if err != nil {
+			debugf(c, "nds:PutMultiWithCachedBytes %s %s", key, err)
+			continue
+		}
+		data[i] = item
+	}
+	return putKeys, data, nil
+}
+
+// recordCachedBytes records data as written through for key if the context
+// is from PutMultiWithCachedBytes.
+func recordCachedBytes(c context.Context, key *datastore.Key, data []byte) {
+	r, ok := c.Value(&cachedBytesKey).(*cachedBytesRecorder)
+	if !ok || data == nil {
+		return
+	}
+	r.mu.Lock()
+	r.data[createMemcacheKey(c, key)] = data
+	r.mu.Unlock()
+}
@@ -0,0 +1,63 @@
+package nds_test
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/qedus/nds"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/memcache"
+)
+
+func TestPutMultiWithCachedBytes(t *testing.T) {
+	c, closeFunc := NewContext(t, nil)
+	defer closeFunc()
+
+	type testEntity struct {
+		Val int
+	}
+
+	keys := []*datastore.Key{
+		datastore.NewIncompleteKey(c, "Entity", nil),
+		datastore.NewKey(c, "Entity", "", 1, nil),
+	}
+	putKeys, data, err := nds.PutMultiWithCachedBytes(c, keys,
+		[]testEntity{{1}, {2}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if putKeys[0].Incomplete() {
+		t.Fatal("expected key to be assigned")
+	}
+
+	// The bytes are those a read caches.
+	if err := nds.GetMulti(c, putKeys, make([]testEntity, 2)); err != nil {
+		t.Fatal(err)
+	}
+	for i, key := range putKeys {
+		item, err := memcache.Get(c, nds.CacheKey(c, key))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(item.Value, data[i]) {
+			t.Fatal("incorrect bytes", i)
+		}
+	}
+
+	// Written through entities are compressed as they are cached.
+	wc := nds.WithCompression(nds.WithWriteThrough(c), 1)
+	_, data, err = nds.PutMultiWithCachedBytes(wc, putKeys,
+		[]testEntity{{3}, {4}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, key := range putKeys {
+		item, err := memcache.Get(c, nds.CacheKey(c, key))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(item.Value, data[i]) {
+			t.Fatal("incorrect written through bytes", i)
+		}
+	}
+}
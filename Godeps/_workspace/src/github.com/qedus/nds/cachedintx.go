@@ -0,0 +1,46 @@
+package nds
+
+import (
+	"reflect"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/datastore"
+)
+
+var cachedInTxKey = "used for cached reads in transactions"
+
+// GetMultiCachedInTx works just like GetMulti except that within a
+// transaction the entities are read through the cache, as they are outside
+// transactions, instead of always being read from the datastore. This saves
+// transactional datastore reads for reference data that never changes.
+//
+// Warning: only use GetMultiCachedInTx for entities that are never written,
+// or at least are never written within the transaction. A cached entity can
+// be older than the one the transaction would read, and entities served from
+// the cache are not part of the transaction, so the transaction does not fail
+// if they are modified concurrently. Using it for any other entities breaks
+// the serializable reads transactions otherwise guarantee.
+//
+// Entities already put or deleted within the transaction are still returned
+// as they were written. Outside a transaction it is the same as GetMulti.
+func GetMultiCachedInTx(c context.Context,
+	keys []*datastore.Key, vals interface{}) error {
+
+	return GetMulti(context.WithValue(c, &cachedInTxKey, true), keys, vals)
+}
+
+func isCachedInTx(c context.Context) bool {
+	cached, _ := c.Value(&cachedInTxKey).(bool)
+	return cached
+}
+
+// txGetDatastore gets the entities within a transaction that were not written
+// by it, through the cache if GetMultiCachedInTx is used.
+func txGetDatastore(c context.Context,
+	keys []*datastore.Key, vals reflect.Value) error {
+
+	if isCachedInTx(c) && !isNoCache(c) {
+		return getMulti(c, keys, vals)
+	}
+	return getDatastore(c, keys, vals.Interface())
+}
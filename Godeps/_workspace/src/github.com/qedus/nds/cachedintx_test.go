@@ -0,0 +1,60 @@
+package nds_test
+
+import (
+	"testing"
+
+	"github.com/qedus/nds"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/datastore"
+)
+
+func TestGetMultiCachedInTx(t *testing.T) {
+	c, closeFunc := NewContext(t, nil)
+	defer closeFunc()
+
+	type testEntity struct {
+		Val int
+	}
+
+	keys := []*datastore.Key{
+		datastore.NewKey(c, "Entity", "", 1, nil),
+		datastore.NewKey(c, "Entity", "", 2, nil),
+	}
+	if _, err := nds.PutMulti(c, keys,
+		[]testEntity{{1}, {2}}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := nds.Warm(c, keys); err != nil {
+		t.Fatal(err)
+	}
+
+	cd := &countingDatastore{}
+	if err := nds.RunInTransaction(nds.WithDatastore(c, cd),
+		func(tc context.Context) error {
+			if _, err := nds.Put(tc, keys[1], &testEntity{3}); err != nil {
+				return err
+			}
+
+			entities := make([]testEntity, len(keys))
+			if err := nds.GetMultiCachedInTx(tc, keys, entities); err != nil {
+				return err
+			}
+			if cd.gets != 0 {
+				t.Fatal("expected entities to be read from the cache", cd.gets)
+			}
+			if entities[0].Val != 1 || entities[1].Val != 3 {
+				t.Fatal("incorrect entities", entities)
+			}
+
+			// Plain reads still go to the datastore.
+			if err := nds.Get(tc, keys[0], &testEntity{}); err != nil {
+				return err
+			}
+			if cd.gets != 1 {
+				t.Fatal("expected entity to be read from the datastore", cd.gets)
+			}
+			return nil
+		}, nil); err != nil {
+		t.Fatal(err)
+	}
+}
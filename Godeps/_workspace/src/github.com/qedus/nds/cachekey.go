@@ -0,0 +1,120 @@
+package nds
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/datastore"
+)
+
+var cacheKeyPrefixKey = "used for cache key prefix"
+
+// WithCacheKeyPrefix returns a context that prepends prefix to every memcache
+// key NDS uses. Apps that share a memcache instance, such as different
+// versions of the same app, can use distinct prefixes to stop their cache
+// entries colliding. The prefix must leave room for a hashed key within the
+// 250 byte memcache key limit otherwise operations using the context fail.
+func WithCacheKeyPrefix(c context.Context, prefix string) context.Context {
+	return context.WithValue(c, &cacheKeyPrefixKey, prefix)
+}
+
+func cacheKeyPrefix(c context.Context) string {
+	prefix, _ := c.Value(&cacheKeyPrefixKey).(string)
+	return prefix
+}
+
+// checkCacheKeyPrefix returns an error if the prefix configured for c is too
+// long to create valid memcache keys with. Every memcache key NDS uses, along
+// with any suffix it has, is limited by limitPrefixedMemcacheKey so the
+// longest key is the prefix, any cache pool prefix, which cachePoolPrefix
+// keeps within the same bound, and a hash.
+func checkCacheKeyPrefix(c context.Context) error {
+	prefix := cacheKeyPrefix(c)
+	if len(prefix)+hex.EncodedLen(sha1.Size) > memcacheMaxKeySize {
+		return fmt.Errorf("nds: cache key prefix of %d bytes is too long",
+			len(prefix))
+	}
+	return nil
+}
+
+// CacheKey returns the memcache key NDS uses to cache the entity for key,
+// including any prefix set on c with WithCacheKeyPrefix. This allows external
+// tools to inspect or delete the cache entries NDS creates. If c has a key
+// mapper set with WithKeyMapper the cache key of the mapped key is returned,
+// and if it has a key alias set with WithKeyAlias that of the canonical key.
+func CacheKey(c context.Context, key *datastore.Key) string {
+	if f, ok := keyMapperFromContext(c); ok {
+		if mapped := f(key); mapped != nil {
+			key = mapped
+		}
+	}
+	return createMemcacheKey(c, key)
+}
+
+// createMemcacheKey derives the memcache key from the datastore key, or the
+// key it is aliased to with WithKeyAlias, encoded with the key codec of c.
+// Both key codecs include the app ID and namespace of key so entities from
+// different namespaces never share a cache entry, even when the cache itself
+// is not namespaced.
+func createMemcacheKey(c context.Context, key *datastore.Key) string {
+	return createSuffixedMemcacheKey(c, key, "")
+}
+
+// createSuffixedMemcacheKey returns the memcache key of entity key followed by
+// suffix, limited as a whole so the suffix can never push the key past the
+// memcache key limit.
+func createSuffixedMemcacheKey(c context.Context, key *datastore.Key,
+	suffix string) string {
+
+	key = canonicalKey(c, key)
+	return limitKindMemcacheKey(c, key.Kind(),
+		memcachePrefix+encodeCacheKey(c, key)+suffix)
+}
+
+var keyHasherKey = "used for key hasher"
+
+// WithKeyHasher returns a context that makes NDS use h to shorten cache keys
+// that would otherwise exceed the 250 byte memcache key limit, which happens
+// for keys with deep ancestor paths. h must be deterministic and should
+// return at most 200 bytes of memcache safe characters, such as a hex encoded
+// hash. Results that are still too long are ignored in favour of the default
+// hex encoded SHA-1 hash. All contexts sharing a cache must use the same h.
+func WithKeyHasher(c context.Context, h func(string) string) context.Context {
+	return context.WithValue(c, &keyHasherKey, h)
+}
+
+// limitMemcacheKey prepends the cache key prefix of c to memcacheKey, hashing
+// the result if it is too long to be a memcache key.
+func limitMemcacheKey(c context.Context, memcacheKey string) string {
+	return limitPrefixedMemcacheKey(c, cacheKeyPrefix(c), memcacheKey)
+}
+
+// limitKindMemcacheKey works like limitMemcacheKey for the memcache key of an
+// entity of kind, also prepending the cache pool prefix of the kind.
+func limitKindMemcacheKey(c context.Context, kind,
+	memcacheKey string) string {
+
+	return limitPrefixedMemcacheKey(c,
+		cacheKeyPrefix(c)+cachePoolPrefix(c, kind), memcacheKey)
+}
+
+// limitPrefixedMemcacheKey prepends prefix to memcacheKey, hashing the rest of
+// the result if it is too long to be a memcache key.
+func limitPrefixedMemcacheKey(c context.Context, prefix,
+	memcacheKey string) string {
+
+	memcacheKey = prefix + memcacheKey
+	if len(memcacheKey) <= memcacheMaxKeySize {
+		return memcacheKey
+	}
+
+	if h, ok := c.Value(&keyHasherKey).(func(string) string); ok && h != nil {
+		if hashed := prefix + h(memcacheKey); len(hashed) <= memcacheMaxKeySize {
+			return hashed
+		}
+	}
+	hash := sha1.Sum([]byte(memcacheKey))
+	return prefix + hex.EncodeToString(hash[:])
+}
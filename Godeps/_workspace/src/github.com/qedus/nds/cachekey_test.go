@@ -0,0 +1,197 @@
+package nds_test
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+	"testing"
+
+	"github.com/qedus/nds"
+	"google.golang.org/appengine/datastore"
+)
+
+func TestWithCacheKeyPrefix(t *testing.T) {
+	c, closeFunc := NewContext(t, nil)
+	defer closeFunc()
+
+	type testEntity struct {
+		IntVal int
+	}
+
+	rc := &recordingCache{}
+	stagingCtx := nds.WithCacheKeyPrefix(nds.WithCache(c, rc), "staging:")
+	prodCtx := nds.WithCacheKeyPrefix(nds.WithCache(c, rc), "prod:")
+
+	key := datastore.NewKey(c, "Entity", "", 1, nil)
+	if _, err := nds.Put(stagingCtx, key, &testEntity{42}); err != nil {
+		t.Fatal(err)
+	}
+	expectedKey := "staging:" + nds.CreateMemcacheKey(key)
+	if rc.setItems[0].Key != expectedKey {
+		t.Fatal("incorrect lock key", rc.setItems[0].Key)
+	}
+	if rc.delKeys[0] != expectedKey {
+		t.Fatal("incorrect unlock key", rc.delKeys[0])
+	}
+
+	if err := nds.Get(stagingCtx, key, &testEntity{}); err != nil {
+		t.Fatal(err)
+	}
+	if len(rc.casItems) != 1 || rc.casItems[0].Key != expectedKey {
+		t.Fatal("expected entity cached under prefixed key")
+	}
+
+	// A different prefix must not see the cached entity.
+	if err := nds.Get(prodCtx, key, &testEntity{}); err != nil {
+		t.Fatal(err)
+	}
+	if len(rc.casItems) != 2 || rc.casItems[1].Key != "prod:"+nds.CreateMemcacheKey(key) {
+		t.Fatal("expected entity cached under second prefix")
+	}
+
+	// Long keys are hashed but keep their prefix.
+	longKey := datastore.NewKey(c, "Entity",
+		strings.Repeat("a", nds.MemcacheMaxKeySize), 0, nil)
+	if _, err := nds.Put(stagingCtx, longKey, &testEntity{43}); err != nil {
+		t.Fatal(err)
+	}
+	lockKey := rc.setItems[len(rc.setItems)-1].Key
+	if !strings.HasPrefix(lockKey, "staging:") {
+		t.Fatal("expected prefixed hashed key", lockKey)
+	} else if len(lockKey) > nds.MemcacheMaxKeySize {
+		t.Fatal("key too long", len(lockKey))
+	}
+}
+
+func TestWithCacheKeyPrefixTooLong(t *testing.T) {
+	c, closeFunc := NewContext(t, nil)
+	defer closeFunc()
+
+	type testEntity struct {
+		IntVal int
+	}
+
+	pc := nds.WithCacheKeyPrefix(c, strings.Repeat("p", nds.MemcacheMaxKeySize))
+	key := datastore.NewKey(c, "Entity", "", 1, nil)
+
+	if _, err := nds.Put(pc, key, &testEntity{42}); err == nil {
+		t.Fatal("expected prefix error")
+	}
+	if err := nds.Get(pc, key, &testEntity{}); err == nil {
+		t.Fatal("expected prefix error")
+	}
+	if err := nds.Delete(pc, key); err == nil {
+		t.Fatal("expected prefix error")
+	}
+}
+
+func TestCacheKey(t *testing.T) {
+	c, closeFunc := NewContext(t, nil)
+	defer closeFunc()
+
+	type testEntity struct {
+		IntVal int
+	}
+
+	rc := &recordingCache{}
+	pc := nds.WithCacheKeyPrefix(nds.WithCache(c, rc), "prefix:")
+
+	key := datastore.NewKey(c, "Entity", "", 1, nil)
+	if _, err := nds.Put(pc, key, &testEntity{1}); err != nil {
+		t.Fatal(err)
+	}
+
+	if cacheKey := nds.CacheKey(pc, key); rc.setItems[0].Key != cacheKey {
+		t.Fatal("incorrect cache key", cacheKey)
+	}
+	if nds.CacheKey(c, key) != nds.CreateMemcacheKey(key) {
+		t.Fatal("expected unprefixed cache key")
+	}
+}
+
+func TestCacheKeySuffixLimited(t *testing.T) {
+	c, closeFunc := NewContext(t, nil)
+	defer closeFunc()
+
+	type testEntity struct {
+		IntVal int
+	}
+
+	// Find a key whose cache key only just fits within the limit.
+	var key *datastore.Key
+	for n := 1; ; n++ {
+		k := datastore.NewKey(c, "Entity", strings.Repeat("a", n), 0, nil)
+		if len(nds.CacheKey(c, k)) > nds.MemcacheMaxKeySize {
+			break
+		}
+		key = k
+	}
+
+	rc := &recordingCache{}
+	if err := nds.GetOrPut(nds.WithCache(c, rc), key, &testEntity{},
+		func() error { return nil }); err != nil {
+		t.Fatal(err)
+	}
+	if len(rc.addItems) == 0 {
+		t.Fatal("expected a populate lock to be added")
+	}
+	for _, item := range rc.addItems {
+		if len(item.Key) > nds.MemcacheMaxKeySize {
+			t.Fatal("memcache key too long", len(item.Key), item.Key)
+		}
+	}
+}
+
+func TestWithKeyHasher(t *testing.T) {
+	c, closeFunc := NewContext(t, nil)
+	defer closeFunc()
+
+	type testEntity struct {
+		Val int
+	}
+
+	// A deep ancestor path produces a key too long for memcache.
+	var key *datastore.Key
+	for i := 0; i < 20; i++ {
+		key = datastore.NewKey(c, "Ancestor", "", int64(i+1), key)
+	}
+	if len(key.Encode()) <= nds.MemcacheMaxKeySize {
+		t.Fatal("expected key to exceed memcache limit", len(key.Encode()))
+	}
+
+	hashed := 0
+	hc := nds.WithKeyHasher(c, func(s string) string {
+		hashed++
+		hash := sha256.Sum256([]byte(s))
+		return "sha256:" + hex.EncodeToString(hash[:])
+	})
+
+	cacheKey := nds.CacheKey(hc, key)
+	if !strings.HasPrefix(cacheKey, "sha256:") || hashed == 0 {
+		t.Fatal("expected hashed cache key", cacheKey)
+	}
+	if cacheKey == nds.CacheKey(c, key) {
+		t.Fatal("expected custom hash to differ from default")
+	}
+
+	if _, err := nds.Put(hc, key, &testEntity{1}); err != nil {
+		t.Fatal(err)
+	}
+
+	// The first get caches the entity and the second reads it from the
+	// cache.
+	for i := 0; i < 2; i++ {
+		te := &testEntity{}
+		if err := nds.Get(hc, key, te); err != nil {
+			t.Fatal(err)
+		} else if te.Val != 1 {
+			t.Fatal("incorrect val", i, te.Val)
+		}
+	}
+	if present, err := nds.Peek(hc, []*datastore.Key{key},
+		make([]testEntity, 1)); err != nil {
+		t.Fatal(err)
+	} else if !present[0] {
+		t.Fatal("expected entity to be cached under hashed key")
+	}
+}
@@ -0,0 +1,58 @@
+package nds
+
+import (
+	"errors"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine"
+)
+
+// ErrCacheMiss is reported by GetMulti, within a appengine.MultiError, for
+// each entity that is not cached when its context is from WithCacheOnlyReads.
+// It is distinct from datastore.ErrNoSuchEntity, which is still reported for
+// entities cached as missing.
+var ErrCacheMiss = errors.New("nds: entity not cached")
+
+var cacheOnlyReadsKey = "used for cache only reads"
+
+// WithCacheOnlyReads returns a context that makes GetMulti load only the
+// entities it finds cached, reporting ErrCacheMiss for the others instead of
+// reading them from the datastore. This lets a degraded endpoint shed
+// datastore load during an incident while keeping the GetMulti call shape and
+// error handling, unlike Peek. Entities that are locked by a put, or whose
+// cache entries cannot be decoded or are too old, count as misses, and no
+// locks or entries are written to the cache. Cached entities are not
+// revalidated with WithStaleWhileRevalidate or checked with WithShadowRead.
+//
+// As entities are never read from the datastore, every entity reports
+// ErrCacheMiss with WithNoCache or WithStrongRead, and for kinds passed to
+// WithUncachedKinds. Cache only reads have no effect within a transaction.
+func WithCacheOnlyReads(c context.Context) context.Context {
+	return context.WithValue(c, &cacheOnlyReadsKey, true)
+}
+
+func isCacheOnlyReads(c context.Context) bool {
+	cacheOnly, _ := c.Value(&cacheOnlyReadsKey).(bool)
+	return cacheOnly
+}
+
+// markCacheMisses reports ErrCacheMiss for the cacheItems that were not found
+// in the cache so they are not read from the datastore.
+func markCacheMisses(cacheItems []cacheItem) {
+	for i, cacheItem := range cacheItems {
+		switch cacheItem.state {
+		case miss, internalLock, externalLock:
+			cacheItems[i].state = done
+			cacheItems[i].err = ErrCacheMiss
+		}
+	}
+}
+
+// cacheMissErrors returns the error reporting ErrCacheMiss for n entities.
+func cacheMissErrors(n int) error {
+	errs := make(appengine.MultiError, n)
+	for i := range errs {
+		errs[i] = ErrCacheMiss
+	}
+	return errs
+}
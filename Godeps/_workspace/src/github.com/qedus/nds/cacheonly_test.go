@@ -0,0 +1,68 @@
+package nds_test
+
+import (
+	"testing"
+
+	"github.com/qedus/nds"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/memcache"
+)
+
+func TestWithCacheOnlyReads(t *testing.T) {
+	c, closeFunc := NewContext(t, nil)
+	defer closeFunc()
+
+	type testEntity struct {
+		Val int
+	}
+
+	keys := []*datastore.Key{
+		datastore.NewKey(c, "Entity", "", 1, nil),
+		datastore.NewKey(c, "Entity", "", 2, nil),
+		datastore.NewKey(c, "Entity", "", 3, nil),
+	}
+	if _, err := nds.PutMulti(c, keys[:2], []testEntity{{1}, {2}}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Cache the first entity and the missing one.
+	if err := nds.GetMulti(c, []*datastore.Key{keys[0], keys[2]},
+		make([]testEntity, 2)); err == nil {
+		t.Fatal("expected missing entity error")
+	}
+
+	cd := &countingDatastore{}
+	cc := nds.WithCacheOnlyReads(nds.WithDatastore(c, cd))
+	entities := make([]testEntity, len(keys))
+	err := nds.GetMulti(cc, keys, entities)
+	me, ok := err.(appengine.MultiError)
+	if !ok {
+		t.Fatal("expected appengine.MultiError", err)
+	}
+	if me[0] != nil || me[1] != nds.ErrCacheMiss ||
+		me[2] != datastore.ErrNoSuchEntity {
+		t.Fatal("incorrect errors", me)
+	}
+	if entities[0].Val != 1 {
+		t.Fatal("incorrect val", entities[0].Val)
+	}
+	if cd.gets != 0 {
+		t.Fatal("expected no datastore reads", cd.gets)
+	}
+
+	// The missed entity is not locked.
+	if _, err := memcache.Get(c,
+		nds.CacheKey(c, keys[1])); err != memcache.ErrCacheMiss {
+		t.Fatal("expected no cache entry", err)
+	}
+
+	// Entities are never read from the datastore, even without the cache.
+	err = nds.GetMulti(nds.WithNoCache(cc), keys, make([]testEntity, 3))
+	if me, ok := err.(appengine.MultiError); !ok || me[0] != nds.ErrCacheMiss {
+		t.Fatal("expected cache misses", err)
+	}
+	if cd.gets != 0 {
+		t.Fatal("expected no datastore reads", cd.gets)
+	}
+}
@@ -0,0 +1,118 @@
+package nds
+
+import (
+	"math"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/memcache"
+)
+
+var cacheOptionalKey = "used for cache optional"
+
+// cacheProbeInterval is how long a cache found to be unavailable is left
+// before it is probed again.
+const cacheProbeInterval = time.Minute
+
+// WithCacheOptional returns a context that lets NDS run without a cache, such
+// as on a development server where memcache is not configured. The first time
+// such a context is used the cache is probed and, if it cannot be reached, a
+// warning is logged and NDS behaves as though WithNoCache had been used, so
+// PutMulti and DeleteMulti no longer fail to lock the cache and GetMulti reads
+// straight from the datastore. PutMulti and DeleteMulti still try to delete
+// cached copies of the entities they write, in case other instances can reach
+// the cache. Cache calls made directly, such as by Count and GetAllCached, find
+// nothing cached and cache nothing, while counters, which only exist in the
+// cache, are unavailable.
+//
+// An unavailable cache is probed again once a minute, so a cache that was only
+// briefly unreachable is used again once it recovers. Once the cache has been
+// reached it is not probed again; use WithCircuitBreaker to ride out cache
+// outages instead.
+func WithCacheOptional(c context.Context) context.Context {
+	return context.WithValue(c, &cacheOptionalKey, true)
+}
+
+// cacheProbe records whether the cache was found to be unavailable by a
+// context using WithCacheOptional.
+var cacheProbe = &cacheAvailability{}
+
+// cacheAvailability is read and written atomically so probing the cache never
+// blocks the contexts that only need the result.
+type cacheAvailability struct {
+	unavailable int32
+	probing     int32
+	// nextProbe is when, in Unix nanoseconds, the cache is next probed.
+	nextProbe int64
+}
+
+// isCacheUnavailable reports whether c uses WithCacheOptional and the cache
+// could not be reached, probing it if it is due to be. Only one context
+// probes at a time, and the others use the result of the last probe.
+func isCacheUnavailable(c context.Context) bool {
+	if optional, _ := c.Value(&cacheOptionalKey).(bool); !optional {
+		return false
+	}
+
+	now := timeNow()
+	if now.UnixNano() >= atomic.LoadInt64(&cacheProbe.nextProbe) &&
+		atomic.CompareAndSwapInt32(&cacheProbe.probing, 0, 1) {
+		probeCache(c, now)
+		atomic.StoreInt32(&cacheProbe.probing, 0)
+	}
+	return atomic.LoadInt32(&cacheProbe.unavailable) == 1
+}
+
+// probeCache records whether the cache of c can be reached.
+func probeCache(c context.Context, now time.Time) {
+	_, err := contextCache(c).GetMulti(c,
+		[]string{cacheKeyPrefix(c) + memcachePrefix + "probe"})
+	// A probe cut short by c says nothing about the cache.
+	if c.Err() != nil {
+		return
+	}
+	if !isCacheFailure(err) {
+		atomic.StoreInt32(&cacheProbe.unavailable, 0)
+		atomic.StoreInt64(&cacheProbe.nextProbe, math.MaxInt64)
+		return
+	}
+	if atomic.SwapInt32(&cacheProbe.unavailable, 1) == 0 {
+		warningf(c, "nds: cache unavailable, using the datastore only: %s", err)
+	}
+	atomic.StoreInt64(&cacheProbe.nextProbe,
+		now.Add(cacheProbeInterval).UnixNano())
+}
+
+// invalidationCache returns the cache to remove the entities written with c
+// from. Unlike cacheFromContext it is the cache of c even when that was found
+// to be unavailable, as other instances may still be reading it.
+func invalidationCache(c context.Context) Cache {
+	return contextCache(c)
+}
+
+// unavailableCache is used in place of a cache found to be unavailable. It
+// never holds any items.
+type unavailableCache struct{}
+
+func (unavailableCache) AddMulti(context.Context, []*memcache.Item) error {
+	return nil
+}
+
+func (unavailableCache) CompareAndSwapMulti(context.Context,
+	[]*memcache.Item) error {
+	return nil
+}
+
+func (unavailableCache) DeleteMulti(context.Context, []string) error {
+	return nil
+}
+
+func (unavailableCache) GetMulti(context.Context,
+	[]string) (map[string]*memcache.Item, error) {
+	return map[string]*memcache.Item{}, nil
+}
+
+func (unavailableCache) SetMulti(context.Context, []*memcache.Item) error {
+	return nil
+}
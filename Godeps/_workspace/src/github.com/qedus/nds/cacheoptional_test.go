@@ -0,0 +1,118 @@
+package nds_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/qedus/nds"
+	"google.golang.org/appengine/datastore"
+)
+
+func TestWithCacheOptional(t *testing.T) {
+	c, closeFunc := NewContext(t, nil)
+	defer closeFunc()
+
+	type testEntity struct {
+		Val int
+	}
+
+	nds.ResetCacheProbe()
+	defer nds.ResetCacheProbe()
+
+	fc := &flakyCache{down: true}
+	cc := nds.WithCache(c, fc)
+	key := datastore.NewKey(c, "Entity", "", 1, nil)
+
+	// Without the option puts fail when the cache cannot be locked.
+	if _, err := nds.Put(cc, key, &testEntity{1}); err == nil {
+		t.Fatal("expected error")
+	}
+
+	fc.calls = 0
+	oc := nds.WithCacheOptional(cc)
+	if _, err := nds.Put(oc, key, &testEntity{2}); err != nil {
+		t.Fatal(err)
+	}
+	te := &testEntity{}
+	if err := nds.Get(oc, key, te); err != nil {
+		t.Fatal(err)
+	} else if te.Val != 2 {
+		t.Fatal("incorrect val", te.Val)
+	}
+	if err := nds.Delete(oc, key); err != nil {
+		t.Fatal(err)
+	}
+	if err := nds.Get(oc, key, te); err != datastore.ErrNoSuchEntity {
+		t.Fatal("expected ErrNoSuchEntity", err)
+	}
+
+	// Only the probe and the invalidations of the writes reach the cache.
+	if fc.calls != 3 {
+		t.Fatal("expected three cache calls", fc.calls)
+	}
+}
+
+func TestWithCacheOptionalReprobe(t *testing.T) {
+	c, closeFunc := NewContext(t, nil)
+	defer closeFunc()
+
+	type testEntity struct {
+		Val int
+	}
+
+	nds.ResetCacheProbe()
+	defer nds.ResetCacheProbe()
+	now := time.Now()
+	nds.SetTimeNow(func() time.Time { return now })
+	defer nds.SetTimeNow(time.Now)
+
+	fc := &flakyCache{down: true}
+	oc := nds.WithCacheOptional(nds.WithCache(c, fc))
+	key := datastore.NewKey(c, "Entity", "", 1, nil)
+	if _, err := nds.Put(oc, key, &testEntity{1}); err != nil {
+		t.Fatal(err)
+	}
+
+	// The cache is not probed again until the cool-down has passed.
+	fc.down = false
+	fc.calls = 0
+	if err := nds.Get(oc, key, &testEntity{}); err != nil {
+		t.Fatal(err)
+	}
+	if fc.calls != 0 {
+		t.Fatal("expected the cache to be skipped", fc.calls)
+	}
+
+	now = now.Add(2 * time.Minute)
+	if err := nds.Get(oc, key, &testEntity{}); err != nil {
+		t.Fatal(err)
+	}
+	if len(fc.casItems) != 1 {
+		t.Fatal("expected the recovered cache to be used", fc.casItems)
+	}
+}
+
+func TestWithCacheOptionalAvailable(t *testing.T) {
+	c, closeFunc := NewContext(t, nil)
+	defer closeFunc()
+
+	type testEntity struct {
+		Val int
+	}
+
+	nds.ResetCacheProbe()
+	defer nds.ResetCacheProbe()
+
+	rc := &recordingCache{}
+	oc := nds.WithCacheOptional(nds.WithCache(c, rc))
+	key := datastore.NewKey(c, "Entity", "", 1, nil)
+	if _, err := nds.Put(oc, key, &testEntity{1}); err != nil {
+		t.Fatal(err)
+	}
+	if err := nds.Get(oc, key, &testEntity{}); err != nil {
+		t.Fatal(err)
+	}
+	if len(rc.casItems) != 1 {
+		t.Fatal("expected entity to be cached")
+	}
+}
@@ -0,0 +1,45 @@
+package nds
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+
+	"golang.org/x/net/context"
+)
+
+var cachePoolKey = "used for cache pools"
+
+// WithCachePool returns a context that assigns the cache entries of each kind
+// to the pool poolForKind returns for it, so a kind that fills the cache can
+// be kept from evicting the entities of every other kind. The pool name and a
+// colon are prepended to the memcache keys of entities of the kind, just after
+// any prefix set with WithCacheKeyPrefix, and an empty pool name leaves the
+// keys unchanged. Pooled keys are never hashed away so a Cache set with
+// WithCache can route each pool to a separate memcache instance by the start
+// of its keys; without one the pools share a single memcache but still never
+// share entries.
+//
+// Reads, writes and invalidations of an entity all use the pool of its kind,
+// as do its replicas, projections and unique and dependency records. All
+// contexts sharing a cache must use the same poolForKind. Pool names too long
+// to leave room for a hashed key within the 250 byte memcache key limit are
+// ignored.
+func WithCachePool(c context.Context,
+	poolForKind func(kind string) string) context.Context {
+	return context.WithValue(c, &cachePoolKey, poolForKind)
+}
+
+// cachePoolPrefix returns the prefix of the memcache keys of entities of kind
+// in the cache pool of c, if any.
+func cachePoolPrefix(c context.Context, kind string) string {
+	poolForKind, _ := c.Value(&cachePoolKey).(func(string) string)
+	if poolForKind == nil {
+		return ""
+	}
+	pool := poolForKind(kind)
+	if pool == "" || len(cacheKeyPrefix(c))+len(pool)+1+
+		hex.EncodedLen(sha1.Size) > memcacheMaxKeySize {
+		return ""
+	}
+	return pool + ":"
+}
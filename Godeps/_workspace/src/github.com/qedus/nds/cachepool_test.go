@@ -0,0 +1,68 @@
+package nds_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/qedus/nds"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/memcache"
+)
+
+func TestWithCachePool(t *testing.T) {
+	c, closeFunc := NewContext(t, nil)
+	defer closeFunc()
+
+	type testEntity struct {
+		Val int
+	}
+
+	pc := nds.WithCachePool(c, func(kind string) string {
+		if kind == "Hot" {
+			return "hot"
+		}
+		return ""
+	})
+
+	hotKey := datastore.NewKey(c, "Hot", "", 1, nil)
+	coldKey := datastore.NewKey(c, "Cold", "", 1, nil)
+	keys := []*datastore.Key{hotKey, coldKey}
+	if _, err := nds.PutMulti(pc, keys, []testEntity{{1}, {2}}); err != nil {
+		t.Fatal(err)
+	}
+
+	hotCacheKey := nds.CacheKey(pc, hotKey)
+	if !strings.HasPrefix(hotCacheKey, "hot:") {
+		t.Fatal("expected pooled cache key", hotCacheKey)
+	}
+	if coldCacheKey := nds.CacheKey(pc, coldKey); coldCacheKey !=
+		nds.CacheKey(c, coldKey) {
+		t.Fatal("expected unpooled cache key", coldCacheKey)
+	}
+
+	// Reads cache the entity in its pool.
+	if err := nds.GetMulti(pc, keys, make([]testEntity, 2)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := memcache.Get(c, hotCacheKey); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := memcache.Get(c,
+		nds.CacheKey(c, hotKey)); err != memcache.ErrCacheMiss {
+		t.Fatal("expected no unpooled entry", err)
+	}
+
+	// Writes invalidate the entity in its pool.
+	if _, err := nds.Put(pc, hotKey, &testEntity{3}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := memcache.Get(c, hotCacheKey); err != memcache.ErrCacheMiss {
+		t.Fatal("expected pooled entry to be invalidated", err)
+	}
+	te := &testEntity{}
+	if err := nds.Get(pc, hotKey, te); err != nil {
+		t.Fatal(err)
+	} else if te.Val != 3 {
+		t.Fatal("incorrect val", te.Val)
+	}
+}
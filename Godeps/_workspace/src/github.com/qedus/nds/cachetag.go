@@ -0,0 +1,143 @@
+package nds
+
+import (
+	"reflect"
+	"strings"
+	"sync"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/datastore"
+)
+
+// noCacheTag is the value of the nds struct tag that keeps a field out of the
+// cache, as in
+//
+//	type Article struct {
+//		Title string
+//		Index []byte `datastore:",noindex" nds:"nocache"`
+//	}
+//
+// Tagged fields are still put to and read from the datastore as normal but are
+// left out of the entity NDS caches, keeping large derived fields from filling
+// memcache items. Entities cached without such fields are partial: a cache hit
+// loads the tagged fields as their zero values unless GetMulti is called with
+// WithFullEntities. Only the fields of the top level struct are considered.
+//
+// Putting an entity loaded from a partial hit writes those zero values to the
+// datastore, replacing the tagged fields stored there. Entities that are read,
+// modified and put back must be got with WithFullEntities.
+const noCacheTag = "nocache"
+
+var noCacheProperties = struct {
+	sync.RWMutex
+	m map[reflect.Type][]string
+}{m: map[reflect.Type][]string{}}
+
+var fullEntitiesKey = "used for full entities"
+
+// WithFullEntities returns a context that makes GetMulti read entities
+// cached without their nds:"nocache" fields from the datastore, so every field
+// is loaded. The partial cache entries are left in place for other readers,
+// and partial entities held by the local or process cache are skipped.
+func WithFullEntities(c context.Context) context.Context {
+	return context.WithValue(c, &fullEntitiesKey, true)
+}
+
+func isFullEntities(c context.Context) bool {
+	full, _ := c.Value(&fullEntitiesKey).(bool)
+	return full
+}
+
+// entityType returns the struct type val holds an entity of, or nil if it does
+// not hold a struct.
+func entityType(val reflect.Value) reflect.Type {
+	if val.Kind() == reflect.Interface {
+		val = val.Elem()
+	}
+	if !val.IsValid() {
+		return nil
+	}
+	t := val.Type()
+	if t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if t.Kind() != reflect.Struct {
+		return nil
+	}
+	return t
+}
+
+// noCachePropertyNames returns the property names of the fields of the struct
+// type t tagged nds:"nocache".
+func noCachePropertyNames(t reflect.Type) []string {
+	noCacheProperties.RLock()
+	names, ok := noCacheProperties.m[t]
+	noCacheProperties.RUnlock()
+	if ok {
+		return names
+	}
+
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.Tag.Get("nds") != noCacheTag {
+			continue
+		}
+		name := strings.Split(f.Tag.Get("datastore"), ",")[0]
+		if name == "" {
+			name = f.Name
+		}
+		if name != "-" {
+			names = append(names, name)
+		}
+	}
+
+	noCacheProperties.Lock()
+	noCacheProperties.m[t] = names
+	noCacheProperties.Unlock()
+	return names
+}
+
+// cacheablePropertyList returns pl without the properties of the fields of t
+// tagged nds:"nocache", along with partialFlag if any were tagged. t may be
+// nil for entities that are not structs.
+func cacheablePropertyList(t reflect.Type,
+	pl datastore.PropertyList) (datastore.PropertyList, uint32) {
+
+	if t == nil {
+		return pl, 0
+	}
+	names := noCachePropertyNames(t)
+	if len(names) == 0 {
+		return pl, 0
+	}
+
+	cacheable := make(datastore.PropertyList, 0, len(pl))
+	for _, p := range pl {
+		if !isNoCacheProperty(p.Name, names) {
+			cacheable = append(cacheable, p)
+		}
+	}
+	return cacheable, partialFlag
+}
+
+// isNoCacheProperty reports whether the property name belongs to one of the
+// fields names, including the flattened properties of struct fields.
+func isNoCacheProperty(name string, names []string) bool {
+	for _, n := range names {
+		if name == n || strings.HasPrefix(name, n+".") {
+			return true
+		}
+	}
+	return false
+}
+
+// encodeCacheableEntityItem serializes the cacheable properties of pl, the
+// entity for key loaded into val, into the value and flags of a memcache
+// entity item.
+func encodeCacheableEntityItem(c context.Context, key *datastore.Key,
+	val reflect.Value, pl datastore.PropertyList) ([]byte, uint32, error) {
+
+	pl, partial := cacheablePropertyList(entityType(val), pl)
+	data, flags, err := encodeEntityItem(c, key, codecFor(c, key), pl)
+	return data, flags | partial, err
+}
@@ -0,0 +1,132 @@
+package nds_test
+
+import (
+	"testing"
+
+	"github.com/qedus/nds"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/memcache"
+)
+
+func TestCacheTag(t *testing.T) {
+	c, closeFunc := NewContext(t, nil)
+	defer closeFunc()
+
+	type testEntity struct {
+		Val     int
+		Derived string `datastore:"derived,noindex" nds:"nocache"`
+	}
+
+	key := datastore.NewKey(c, "Entity", "", 1, nil)
+	if _, err := nds.Put(c, key, &testEntity{1, "large"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// The first read comes from the datastore and has every field.
+	entity := &testEntity{}
+	if err := nds.Get(c, key, entity); err != nil {
+		t.Fatal(err)
+	} else if entity.Val != 1 || entity.Derived != "large" {
+		t.Fatal("incorrect entity", entity)
+	}
+
+	// The tagged field is not cached.
+	item, err := memcache.Get(c, nds.CreateMemcacheKey(key))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cached := &testEntity{}
+	if err := nds.UnmarshalEntity(c, item.Value, cached); err != nil {
+		t.Fatal(err)
+	} else if cached.Val != 1 || cached.Derived != "" {
+		t.Fatal("incorrect cached entity", cached)
+	}
+
+	// A cache hit leaves the tagged field empty.
+	entity = &testEntity{}
+	if err := nds.Get(c, key, entity); err != nil {
+		t.Fatal(err)
+	} else if entity.Val != 1 || entity.Derived != "" {
+		t.Fatal("incorrect entity", entity)
+	}
+
+	// Full entities are read from the datastore.
+	rc := &recordingCache{}
+	entity = &testEntity{}
+	if err := nds.Get(nds.WithFullEntities(nds.WithCache(c, rc)), key,
+		entity); err != nil {
+		t.Fatal(err)
+	} else if entity.Val != 1 || entity.Derived != "large" {
+		t.Fatal("incorrect entity", entity)
+	}
+	if len(rc.addItems) != 0 || len(rc.casItems) != 0 {
+		t.Fatal("expected the partial entry to be left in place")
+	}
+
+	// The partial entry is not reported as drifted.
+	drifted, err := nds.Verify(c, []*datastore.Key{key})
+	if err != nil {
+		t.Fatal(err)
+	} else if len(drifted) != 0 {
+		t.Fatal("expected no drift", drifted)
+	}
+}
+
+// missFirstCache misses on its first GetMulti, as if the entry it holds were
+// cached after a reader looked for it.
+type missFirstCache struct {
+	recordingCache
+	got bool
+}
+
+func (mc *missFirstCache) GetMulti(c context.Context,
+	keys []string) (map[string]*memcache.Item, error) {
+	if !mc.got {
+		mc.got = true
+		return map[string]*memcache.Item{}, nil
+	}
+	return mc.recordingCache.GetMulti(c, keys)
+}
+
+func TestCacheTagFullEntities(t *testing.T) {
+	c, closeFunc := NewContext(t, nil)
+	defer closeFunc()
+
+	type testEntity struct {
+		Val     int
+		Derived string `datastore:"derived,noindex" nds:"nocache"`
+	}
+
+	key := datastore.NewKey(c, "Entity", "", 1, nil)
+	if _, err := nds.Put(c, key, &testEntity{1, "large"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := nds.Get(c, key, &testEntity{}); err != nil {
+		t.Fatal(err)
+	}
+
+	// A partial entry cached after the first look is not returned.
+	entity := &testEntity{}
+	if err := nds.Get(nds.WithFullEntities(nds.WithCache(c,
+		&missFirstCache{})), key, entity); err != nil {
+		t.Fatal(err)
+	} else if entity.Val != 1 || entity.Derived != "large" {
+		t.Fatal("incorrect entity", entity)
+	}
+
+	// A partial hit held by the local cache is not returned.
+	lc := nds.WithLocalCache(c)
+	entity = &testEntity{}
+	if err := nds.Get(lc, key, entity); err != nil {
+		t.Fatal(err)
+	} else if entity.Derived != "" {
+		t.Fatal("expected a partial hit", entity)
+	}
+	entity = &testEntity{}
+	if err := nds.Get(nds.WithFullEntities(lc), key, entity); err != nil {
+		t.Fatal(err)
+	} else if entity.Val != 1 || entity.Derived != "large" {
+		t.Fatal("incorrect entity", entity)
+	}
+}
@@ -0,0 +1,65 @@
+package nds
+
+import (
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+
+	"golang.org/x/net/context"
+)
+
+var checksumKey = "used for checksums"
+
+// errChecksumMismatch is returned when decoding a cached entity whose value
+// does not match its checksum.
+var errChecksumMismatch = errors.New("nds: cached entity failed its checksum")
+
+// checksumSize is the size of the CRC-32 checksum appended to the value of
+// entity items carrying checksumFlag.
+const checksumSize = 4
+
+// WithChecksum returns a context that makes GetMulti store a CRC-32 checksum
+// with the entities it caches. Cached entities that do not match their
+// checksum, because their value was corrupted, are treated as cache misses and
+// replaced with the entity read from the datastore rather than being decoded.
+// The checksum counts towards the maximum size of cached entities. Checksums
+// are verified whether or not c uses WithChecksum.
+func WithChecksum(c context.Context) context.Context {
+	return context.WithValue(c, &checksumKey, true)
+}
+
+func isChecksum(c context.Context) bool {
+	checksum, _ := c.Value(&checksumKey).(bool)
+	return checksum
+}
+
+// addChecksum appends the checksum of data to it if c uses WithChecksum,
+// returning the modifier flag to store with it.
+func addChecksum(c context.Context, data []byte) ([]byte, uint32) {
+	if !isChecksum(c) {
+		return data, 0
+	}
+	sum := make([]byte, checksumSize)
+	binary.BigEndian.PutUint32(sum, crc32.ChecksumIEEE(data))
+	return append(data, sum...), checksumFlag
+}
+
+// verifyChecksum checks the checksum at the end of data and returns data
+// without it.
+func verifyChecksum(data []byte) ([]byte, error) {
+	if len(data) < checksumSize {
+		return nil, errChecksumMismatch
+	}
+	n := len(data) - checksumSize
+	if crc32.ChecksumIEEE(data[:n]) != binary.BigEndian.Uint32(data[n:]) {
+		return nil, errChecksumMismatch
+	}
+	return data[:n], nil
+}
+
+// isReplaceableItemError reports whether err means a cached entity should be
+// treated as missing and replaced, rather than as a failure to decode it.
+func isReplaceableItemError(err error) bool {
+	return err == errSchemaMismatch || err == errChecksumMismatch ||
+		err == errKindMismatch || err == errGenerationMismatch
+}
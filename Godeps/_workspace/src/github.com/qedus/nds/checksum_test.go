@@ -0,0 +1,61 @@
+package nds_test
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/qedus/nds"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/memcache"
+)
+
+func TestWithChecksum(t *testing.T) {
+	c, closeFunc := NewContext(t, nil)
+	defer closeFunc()
+
+	type testEntity struct {
+		Val string
+	}
+
+	key := datastore.NewKey(c, "Entity", "", 1, nil)
+	if _, err := nds.Put(c, key, &testEntity{"value"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Cache the entity with a checksum.
+	cc := nds.WithChecksum(c)
+	if err := nds.Get(cc, key, &testEntity{}); err != nil {
+		t.Fatal(err)
+	}
+
+	memcacheKey := nds.CreateMemcacheKey(key)
+	item, err := memcache.Get(c, memcacheKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cached := append([]byte{}, item.Value...)
+
+	// Corrupt the cached entity.
+	item.Value[len(item.Value)/2] ^= 0xff
+	if err := memcache.Set(c, item); err != nil {
+		t.Fatal(err)
+	}
+
+	cd := &countingDatastore{}
+	te := &testEntity{}
+	if err := nds.Get(nds.WithDatastore(cc, cd), key, te); err != nil {
+		t.Fatal(err)
+	} else if te.Val != "value" {
+		t.Fatal("incorrect val", te.Val)
+	}
+	if cd.gets != 1 {
+		t.Fatal("expected entity to be read from the datastore", cd.gets)
+	}
+
+	// The corrupted entity has been replaced.
+	if item, err := memcache.Get(c, memcacheKey); err != nil {
+		t.Fatal(err)
+	} else if !bytes.Equal(item.Value, cached) {
+		t.Fatal("expected corrupted entity to be replaced")
+	}
+}
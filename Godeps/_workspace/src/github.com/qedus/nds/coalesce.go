@@ -0,0 +1,260 @@
+package nds
+
+import (
+	"reflect"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+)
+
+var coalescingKey = "used for coalescing window"
+
+var coalescers = struct {
+	sync.Mutex
+	m map[coalescingOptions]*coalescer
+}{m: map[coalescingOptions]*coalescer{}}
+
+// coalescingOptions are the options that change how a coalesced batch is got.
+// Only calls with equal options are merged.
+type coalescingOptions struct {
+	window time.Duration
+
+	strongRead, cacheOnly, eventual, decodeFallback bool
+
+	cache, datastore, codec, fallbackCodec interface{}
+	kindCodecs                             uintptr
+}
+
+// coalescer merges the keys of the GetMulti calls made within a window into
+// a single batch.
+type coalescer struct {
+	sync.Mutex
+	window time.Duration
+
+	// pending are the gets of the batch waiting to be run, by memcache key.
+	pending map[string]*coalescedGet
+}
+
+// coalescedGet is the entity for a key requested by one or more GetMulti
+// calls. done is closed once pl and err are set. batchFailed is set instead if
+// the batch failed as a whole.
+type coalescedGet struct {
+	key         *datastore.Key
+	pl          datastore.PropertyList
+	err         error
+	batchFailed bool
+	done        chan struct{}
+}
+
+// WithCoalescing returns a context that makes GetMulti, and Get, hold its keys
+// for up to window so they can be merged with the keys of other GetMulti calls
+// using the same window, from any goroutine. The merged keys, each requested
+// once however many calls asked for it, are then got with a single GetMulti
+// and the entity or error for each key is returned to every call that asked
+// for it. This cuts cache calls for hot keys read by many goroutines at the
+// cost of up to window of added latency.
+//
+// Only calls that read alike are merged: they must use the same Cache,
+// DatastoreClient and codecs, and agree on WithStrongRead, WithCacheOnlyReads,
+// WithEventualConsistency and WithDecodeFallback. Keys with different cache
+// key prefixes or namespaces are never merged. Each batch is got with the
+// other options of the call that started it, but is not cut short when that
+// call's context is cancelled or its request ends. If a batch fails as a
+// whole, each call merged into it gets its own keys instead. Calls within a
+// transaction, using WithProjection or using WithNoCache, or with a Cache,
+// DatastoreClient or Codec that cannot be compared, are not coalesced. A
+// window of zero or less disables coalescing.
+func WithCoalescing(c context.Context, window time.Duration) context.Context {
+	return context.WithValue(c, &coalescingKey, window)
+}
+
+// coalescerFromContext returns the coalescer for the window of c, if GetMulti
+// calls using c are coalesced.
+func coalescerFromContext(c context.Context) (*coalescer, bool) {
+	window, _ := c.Value(&coalescingKey).(time.Duration)
+	if window <= 0 {
+		return nil, false
+	}
+	if _, ok := transactionFromContext(c); ok {
+		return nil, false
+	}
+	if _, ok := projectionFromContext(c); ok || isNoCache(c) {
+		return nil, false
+	}
+	opts, ok := coalescingOptionsFromContext(c, window)
+	if !ok {
+		return nil, false
+	}
+
+	coalescers.Lock()
+	defer coalescers.Unlock()
+	co, ok := coalescers.m[opts]
+	if !ok {
+		co = &coalescer{
+			window:  window,
+			pending: map[string]*coalescedGet{},
+		}
+		coalescers.m[opts] = co
+	}
+	return co, true
+}
+
+// coalescingOptionsFromContext returns the coalescing options of c, or false
+// if one of them cannot be compared.
+func coalescingOptionsFromContext(c context.Context,
+	window time.Duration) (coalescingOptions, bool) {
+
+	opts := coalescingOptions{
+		window:         window,
+		strongRead:     isStrongRead(c),
+		cacheOnly:      isCacheOnlyReads(c),
+		eventual:       isEventualConsistency(c),
+		decodeFallback: isDecodeFallback(c),
+	}
+	if codecs, _ := c.Value(&kindCodecsKey).(map[string]Codec); codecs != nil {
+		opts.kindCodecs = reflect.ValueOf(codecs).Pointer()
+	}
+	fallback, _ := fallbackCodec(c)
+	values := []interface{}{c.Value(&cacheKey), c.Value(&datastoreKey),
+		c.Value(&codecKey), fallback}
+	for i, dst := range []*interface{}{&opts.cache, &opts.datastore,
+		&opts.codec, &opts.fallbackCodec} {
+		id, ok := optionIdentity(values[i])
+		if !ok {
+			return coalescingOptions{}, false
+		}
+		*dst = id
+	}
+	return opts, true
+}
+
+// optionIdentity returns v if it can be used in a map key, such as a pointer
+// or a comparable struct, and false if it cannot.
+func optionIdentity(v interface{}) (id interface{}, ok bool) {
+	defer func() {
+		if recover() != nil {
+			id, ok = nil, false
+		}
+	}()
+	// Hashing panics for values that cannot be compared.
+	_ = map[interface{}]bool{v: true}
+	return v, true
+}
+
+// detachedContext has the values of its Context but is never cancelled and
+// has no deadline, so work shared by several calls is not cut short when the
+// call that started it ends.
+type detachedContext struct {
+	context.Context
+}
+
+func (detachedContext) Deadline() (time.Time, bool) {
+	return time.Time{}, false
+}
+
+func (detachedContext) Done() <-chan struct{} {
+	return nil
+}
+
+func (detachedContext) Err() error {
+	return nil
+}
+
+// getCoalesced gets the entities for keys with the next batch of co and loads
+// them into vals.
+func getCoalesced(c context.Context, co *coalescer,
+	keys []*datastore.Key, vals reflect.Value) error {
+
+	gets := make([]*coalescedGet, len(keys))
+	co.Lock()
+	start := len(co.pending) == 0
+	for i, key := range keys {
+		memcacheKey := createMemcacheKey(c, key)
+		g, ok := co.pending[memcacheKey]
+		if !ok {
+			g = &coalescedGet{key: key, done: make(chan struct{})}
+			co.pending[memcacheKey] = g
+		}
+		gets[i] = g
+	}
+	co.Unlock()
+
+	if start {
+		bc := context.WithValue(detachedContext{c}, &coalescingKey,
+			time.Duration(0))
+		go func() {
+			time.Sleep(co.window)
+			co.run(bc)
+		}()
+	}
+
+	me, errsNil := make(appengine.MultiError, len(keys)), true
+	for i, g := range gets {
+		select {
+		case <-g.done:
+		case <-c.Done():
+			return c.Err()
+		}
+
+		if g.batchFailed {
+			return GetMulti(context.WithValue(c, &coalescingKey,
+				time.Duration(0)), keys, vals.Interface())
+		}
+		me[i] = g.err
+		if me[i] == nil {
+			me[i] = setValue(vals.Index(i), g.pl)
+		}
+		if me[i] != nil {
+			errsNil = false
+		}
+	}
+
+	if errsNil {
+		return nil
+	}
+	return me
+}
+
+// run gets the pending batch of co and hands the results to its waiters.
+func (co *coalescer) run(c context.Context) {
+	co.Lock()
+	pending := co.pending
+	co.pending = map[string]*coalescedGet{}
+	co.Unlock()
+
+	gets := make([]*coalescedGet, 0, len(pending))
+	keys := make([]*datastore.Key, 0, len(pending))
+	for _, g := range pending {
+		gets = append(gets, g)
+		keys = append(keys, g.key)
+	}
+
+	// The request behind c may have finished, which can make its API calls
+	// panic.
+	defer func() {
+		if recover() != nil {
+			for _, g := range gets {
+				g.batchFailed = true
+				close(g.done)
+			}
+		}
+	}()
+
+	pls := make([]datastore.PropertyList, len(keys))
+	err := GetMulti(c, keys, pls)
+	me, ok := err.(appengine.MultiError)
+	for i, g := range gets {
+		switch {
+		case err == nil:
+			g.pl = pls[i]
+		case ok:
+			g.pl, g.err = pls[i], me[i]
+		default:
+			g.batchFailed = true
+		}
+		close(g.done)
+	}
+}
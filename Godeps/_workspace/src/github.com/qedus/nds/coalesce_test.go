@@ -0,0 +1,116 @@
+package nds_test
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/qedus/nds"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/datastore"
+)
+
+func TestWithCoalescing(t *testing.T) {
+	c, closeFunc := NewContext(t, nil)
+	defer closeFunc()
+
+	type testEntity struct {
+		Val int
+	}
+
+	keys := []*datastore.Key{
+		datastore.NewKey(c, "Entity", "", 1, nil),
+		datastore.NewKey(c, "Entity", "", 2, nil),
+	}
+	if _, err := nds.Put(c, keys[0], &testEntity{1}); err != nil {
+		t.Fatal(err)
+	}
+
+	rc := &recordingCache{}
+	cc := nds.WithCoalescing(nds.WithCache(c, rc), 50*time.Millisecond)
+
+	const callers = 10
+	entities := make([]testEntity, callers)
+	errs := make([]error, callers)
+	missingErrs := make([]error, callers)
+	wg := sync.WaitGroup{}
+	for i := 0; i < callers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			errs[i] = nds.Get(cc, keys[0], &entities[i])
+			missingErrs[i] = nds.Get(cc, keys[1], &testEntity{})
+			wg.Done()
+		}(i)
+	}
+	wg.Wait()
+
+	for i := 0; i < callers; i++ {
+		if errs[i] != nil {
+			t.Fatal(errs[i])
+		} else if entities[i].Val != 1 {
+			t.Fatal("incorrect val", i, entities[i].Val)
+		}
+		if missingErrs[i] != datastore.ErrNoSuchEntity {
+			t.Fatal("expected datastore.ErrNoSuchEntity", i, missingErrs[i])
+		}
+	}
+
+	// Each batch reads a key from the cache at most twice, when the entity is
+	// loaded and when it is locked, so far fewer reads than callers are made.
+	counts := map[string]int{}
+	for _, key := range rc.getKeys {
+		counts[key]++
+	}
+	for _, key := range keys {
+		if n := counts[nds.CreateMemcacheKey(key)]; n > callers/2 {
+			t.Fatal("expected gets to be coalesced", n)
+		}
+	}
+}
+
+func TestWithCoalescingSeparateCalls(t *testing.T) {
+	c, closeFunc := NewContext(t, nil)
+	defer closeFunc()
+
+	type testEntity struct {
+		Val int
+	}
+
+	key := datastore.NewKey(c, "Entity", "", 1, nil)
+	if _, err := nds.Put(c, key, &testEntity{1}); err != nil {
+		t.Fatal(err)
+	}
+
+	cc := nds.WithCoalescing(c, 50*time.Millisecond)
+	started := make(chan struct{})
+	cancelled, cancel := context.WithCancel(cc)
+	cacheOnly := nds.WithCacheOnlyReads(cc)
+	startErrs := make([]error, 2)
+	wg := sync.WaitGroup{}
+	for i, sc := range []context.Context{cancelled, cacheOnly} {
+		wg.Add(1)
+		go func(i int, sc context.Context) {
+			defer wg.Done()
+			if i == 0 {
+				close(started)
+			}
+			startErrs[i] = nds.Get(sc, key, &testEntity{})
+		}(i, sc)
+	}
+
+	// A call merged into the batch of a cancelled call, or next to a cache
+	// only call, still gets the entity.
+	<-started
+	time.Sleep(10 * time.Millisecond)
+	cancel()
+	entity := &testEntity{}
+	if err := nds.Get(cc, key, entity); err != nil {
+		t.Fatal(err)
+	} else if entity.Val != 1 {
+		t.Fatal("incorrect val", entity.Val)
+	}
+	wg.Wait()
+	if startErrs[0] != context.Canceled {
+		t.Fatal("expected the cancelled call to fail", startErrs[0])
+	}
+}
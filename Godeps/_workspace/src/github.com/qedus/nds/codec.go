@@ -0,0 +1,87 @@
+package nds
+
+import (
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/datastore"
+)
+
+// Codec serializes entities to and from the bytes NDS stores in memcache.
+type Codec interface {
+	Marshal(pl datastore.PropertyList) ([]byte, error)
+	Unmarshal(data []byte) (datastore.PropertyList, error)
+}
+
+var codecKey = "used for Codec"
+
+// WithCodec returns a context that makes NDS serialize cached entities using
+// codec. The default codec uses encoding/gob and is byte compatible with
+// entities cached by previous versions of NDS.
+//
+// Every context that reads or writes the same memcache keys must use the same
+// codec. Cached entities that fail to decode are read from the datastore
+// instead but stay in memcache until they are next put or deleted. When
+// switching codecs use WithCacheKeyPrefix with a new prefix so entities
+// cached with the old codec are not read at all, or WithFallbackCodec so they
+// are still decoded.
+func WithCodec(c context.Context, codec Codec) context.Context {
+	return context.WithValue(c, &codecKey, codec)
+}
+
+func codecFromContext(c context.Context) Codec {
+	if codec, ok := c.Value(&codecKey).(Codec); ok && codec != nil {
+		return codec
+	}
+	return gobCodec{}
+}
+
+var kindCodecsKey = "used for kind Codecs"
+
+// WithKindCodec returns a context that makes NDS serialize cached entities of
+// kind using codec instead of the codec selected with WithCodec. This allows
+// the cache entries of a kind to be stored in a format that services written
+// in other languages can read. Calls can be chained to select codecs for
+// several kinds, and a nil codec returns kind to the codec selected with
+// WithCodec. As with WithCodec, every context that reads or writes the same
+// memcache keys must use the same codec for kind.
+//
+// MarshalEntity, UnmarshalEntity and MigrateCache are not given keys so they
+// use the codec selected with WithCodec or the codecs passed to them.
+func WithKindCodec(c context.Context, kind string,
+	codec Codec) context.Context {
+
+	codecs, _ := c.Value(&kindCodecsKey).(map[string]Codec)
+	copied := make(map[string]Codec, len(codecs)+1)
+	for k, kc := range codecs {
+		copied[k] = kc
+	}
+	if codec == nil {
+		delete(copied, kind)
+	} else {
+		copied[kind] = codec
+	}
+	return context.WithValue(c, &kindCodecsKey, copied)
+}
+
+// codecFor returns the codec used to cache the entity for key.
+func codecFor(c context.Context, key *datastore.Key) Codec {
+	codecs, _ := c.Value(&kindCodecsKey).(map[string]Codec)
+	if codec, ok := codecs[key.Kind()]; ok {
+		return codec
+	}
+	return codecFromContext(c)
+}
+
+// gobCodec is the default Codec.
+type gobCodec struct{}
+
+func (gobCodec) Marshal(pl datastore.PropertyList) ([]byte, error) {
+	return marshal(pl)
+}
+
+func (gobCodec) Unmarshal(data []byte) (datastore.PropertyList, error) {
+	pl := datastore.PropertyList{}
+	if err := unmarshal(data, &pl); err != nil {
+		return nil, err
+	}
+	return pl, nil
+}
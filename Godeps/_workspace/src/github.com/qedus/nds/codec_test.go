@@ -0,0 +1,170 @@
+package nds_test
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/qedus/nds"
+	"google.golang.org/appengine/datastore"
+)
+
+// prefixCodec prepends a version byte to gob encoded entities.
+type prefixCodec struct {
+	marshals, unmarshals int
+}
+
+func (pc *prefixCodec) Marshal(pl datastore.PropertyList) ([]byte, error) {
+	pc.marshals++
+	data, err := nds.MarshalPropertyList(pl)
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte{1}, data...), nil
+}
+
+func (pc *prefixCodec) Unmarshal(data []byte) (datastore.PropertyList, error) {
+	pc.unmarshals++
+	pl := datastore.PropertyList{}
+	if err := nds.UnmarshalPropertyList(data[1:], &pl); err != nil {
+		return nil, err
+	}
+	return pl, nil
+}
+
+func TestWithCodec(t *testing.T) {
+	c, closeFunc := NewContext(t, nil)
+	defer closeFunc()
+
+	type testEntity struct {
+		Val int
+	}
+
+	pc := &prefixCodec{}
+	rc := &recordingCache{}
+	cc := nds.WithCodec(nds.WithCache(c, rc), pc)
+
+	key := datastore.NewKey(c, "Entity", "", 1, nil)
+	if _, err := nds.Put(cc, key, &testEntity{3}); err != nil {
+		t.Fatal(err)
+	}
+
+	// The first get populates the cache and the second reads it back.
+	for i := 0; i < 2; i++ {
+		te := &testEntity{}
+		if err := nds.Get(cc, key, te); err != nil {
+			t.Fatal(err)
+		} else if te.Val != 3 {
+			t.Fatal("incorrect val", te.Val)
+		}
+	}
+
+	if pc.marshals != 1 {
+		t.Fatal("expected 1 marshal", pc.marshals)
+	}
+	if pc.unmarshals != 1 {
+		t.Fatal("expected 1 unmarshal", pc.unmarshals)
+	}
+	if len(rc.casItems) != 1 || rc.casItems[0].Value[0] != 1 {
+		t.Fatal("expected entity cached with codec")
+	}
+}
+
+func TestDefaultCodecCompatible(t *testing.T) {
+	c, closeFunc := NewContext(t, nil)
+	defer closeFunc()
+
+	type testEntity struct {
+		Val int
+	}
+
+	rc := &recordingCache{}
+	cc := nds.WithCache(c, rc)
+
+	key := datastore.NewKey(c, "Entity", "", 1, nil)
+	if _, err := nds.Put(cc, key, &testEntity{3}); err != nil {
+		t.Fatal(err)
+	}
+	if err := nds.Get(cc, key, &testEntity{}); err != nil {
+		t.Fatal(err)
+	}
+
+	pl, err := datastore.SaveStruct(&testEntity{3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := nds.MarshalPropertyList(pl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rc.casItems) != 1 || !bytes.Equal(rc.casItems[0].Value, data) {
+		t.Fatal("expected gob encoded entity")
+	}
+}
+
+func TestWithKindCodec(t *testing.T) {
+	c, closeFunc := NewContext(t, nil)
+	defer closeFunc()
+
+	type testEntity struct {
+		Val int
+	}
+
+	pc := &prefixCodec{}
+	rc := &recordingCache{}
+	cc := nds.WithKindCodec(nds.WithCache(c, rc), "Proto", pc)
+
+	keys := []*datastore.Key{
+		datastore.NewKey(c, "Proto", "", 1, nil),
+		datastore.NewKey(c, "Entity", "", 1, nil),
+	}
+	if _, err := nds.PutMulti(cc, keys,
+		[]testEntity{{1}, {2}}); err != nil {
+		t.Fatal(err)
+	}
+
+	// The first get populates the cache and the second reads it back.
+	for i := 0; i < 2; i++ {
+		tes := make([]testEntity, len(keys))
+		if err := nds.GetMulti(cc, keys, tes); err != nil {
+			t.Fatal(err)
+		}
+		for j, te := range tes {
+			if te.Val != j+1 {
+				t.Fatal("incorrect val", j, te.Val)
+			}
+		}
+	}
+
+	if pc.marshals != 1 {
+		t.Fatal("expected 1 marshal", pc.marshals)
+	}
+	if pc.unmarshals != 1 {
+		t.Fatal("expected 1 unmarshal", pc.unmarshals)
+	}
+
+	pl, err := datastore.SaveStruct(&testEntity{2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	gobData, err := nds.MarshalPropertyList(pl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rc.casItems) != 2 {
+		t.Fatal("expected 2 cached entities", len(rc.casItems))
+	}
+	for _, item := range rc.casItems {
+		switch item.Key {
+		case nds.CreateMemcacheKey(keys[0]):
+			if item.Value[0] != 1 {
+				t.Fatal("expected entity cached with kind codec")
+			}
+		case nds.CreateMemcacheKey(keys[1]):
+			if !bytes.Equal(item.Value, gobData) {
+				t.Fatal("expected gob encoded entity")
+			}
+		default:
+			t.Fatal("unexpected item", item.Key)
+		}
+	}
+}
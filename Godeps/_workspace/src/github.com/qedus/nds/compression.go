@@ -0,0 +1,51 @@
+package nds
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+
+	"golang.org/x/net/context"
+)
+
+var compressionKey = "used for compression threshold"
+
+// WithCompression returns a context that gzip compresses entities of at
+// least minBytes serialized bytes before they are stored in memcache. This
+// allows entities with large []byte or string properties to fit within the
+// memcache item size limit. Entities that are still too large after
+// compression are not cached and are always read from the datastore.
+//
+// Compressed entities can be read by any context, compression only needs to
+// be enabled on contexts that write to the cache.
+func WithCompression(c context.Context, minBytes int) context.Context {
+	return context.WithValue(c, &compressionKey, minBytes)
+}
+
+// compressionThreshold returns the minimum number of bytes a serialized
+// entity must be to be compressed and whether compression is enabled.
+func compressionThreshold(c context.Context) (int, bool) {
+	minBytes, ok := c.Value(&compressionKey).(int)
+	return minBytes, ok
+}
+
+func compress(data []byte) ([]byte, error) {
+	buf := bytes.Buffer{}
+	w := gzip.NewWriter(&buf)
+	if _, err := w.Write(data); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func decompress(data []byte) ([]byte, error) {
+	r, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return ioutil.ReadAll(r)
+}
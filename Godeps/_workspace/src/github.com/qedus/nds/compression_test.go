@@ -0,0 +1,79 @@
+package nds_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/qedus/nds"
+	"google.golang.org/appengine/datastore"
+)
+
+func TestWithCompression(t *testing.T) {
+	c, closeFunc := NewContext(t, nil)
+	defer closeFunc()
+
+	type testEntity struct {
+		Text string `datastore:",noindex"`
+	}
+
+	rc := &recordingCache{}
+	cc := nds.WithCompression(nds.WithCache(c, rc), 1024)
+
+	text := strings.Repeat("compressible ", 40000)
+	key := datastore.NewKey(c, "Entity", "", 1, nil)
+	if _, err := nds.Put(cc, key, &testEntity{text}); err != nil {
+		t.Fatal(err)
+	}
+
+	te := &testEntity{}
+	if err := nds.Get(cc, key, te); err != nil {
+		t.Fatal(err)
+	} else if te.Text != text {
+		t.Fatal("incorrect text")
+	}
+
+	if len(rc.casItems) != 1 {
+		t.Fatal("expected entity to be cached")
+	}
+	item := rc.casItems[0]
+	if item.Flags != nds.EntityItem|nds.CompressedFlag {
+		t.Fatal("expected compressed entity flags", item.Flags)
+	}
+	if len(item.Value) >= len(text) {
+		t.Fatal("expected value to be compressed", len(item.Value))
+	}
+
+	// Compressed entities are readable from contexts without compression.
+	te = &testEntity{}
+	if err := nds.Get(nds.WithCache(c, rc), key, te); err != nil {
+		t.Fatal(err)
+	} else if te.Text != text {
+		t.Fatal("incorrect text")
+	}
+	if len(rc.casItems) != 1 {
+		t.Fatal("expected entity to be served from cache")
+	}
+}
+
+func TestWithCompressionBelowThreshold(t *testing.T) {
+	c, closeFunc := NewContext(t, nil)
+	defer closeFunc()
+
+	type testEntity struct {
+		IntVal int
+	}
+
+	rc := &recordingCache{}
+	cc := nds.WithCompression(nds.WithCache(c, rc), 1024)
+
+	key := datastore.NewKey(c, "Entity", "", 1, nil)
+	if _, err := nds.Put(cc, key, &testEntity{42}); err != nil {
+		t.Fatal(err)
+	}
+	if err := nds.Get(cc, key, &testEntity{}); err != nil {
+		t.Fatal(err)
+	}
+	if len(rc.casItems) != 1 || rc.casItems[0].Flags != nds.EntityItem {
+		t.Fatal("expected uncompressed entity")
+	}
+}
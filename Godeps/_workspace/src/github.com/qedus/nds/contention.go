@@ -0,0 +1,29 @@
+package nds
+
+import (
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/datastore"
+)
+
+var contentionHandlerKey = "used for contention handler"
+
+// WithContentionHandler returns a context that makes GetMulti call f with the
+// key of every entity it finds locked by another request. Such entities are
+// read from the datastore without being cached, so frequent contention on a
+// key suggests it is written often or that the lock time set by WithLockTime
+// is too long. f is called synchronously from the read path, possibly from
+// several goroutines at once, so it must be quick and safe for concurrent use.
+func WithContentionHandler(c context.Context,
+	f func(key *datastore.Key)) context.Context {
+	return context.WithValue(c, &contentionHandlerKey, f)
+}
+
+// lockContention records that the entity for key was locked by another
+// request.
+func lockContention(c context.Context, key *datastore.Key) {
+	addStat(c, statLockContentions, 1)
+	if f, ok := c.Value(&contentionHandlerKey).(func(*datastore.Key)); ok &&
+		f != nil {
+		f(key)
+	}
+}
@@ -0,0 +1,51 @@
+package nds_test
+
+import (
+	"testing"
+
+	"github.com/qedus/nds"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/memcache"
+)
+
+func TestWithContentionHandler(t *testing.T) {
+	c, closeFunc := NewContext(t, nil)
+	defer closeFunc()
+
+	type testEntity struct {
+		Val int
+	}
+
+	keys := []*datastore.Key{
+		datastore.NewKey(c, "Entity", "", 1, nil),
+		datastore.NewKey(c, "Entity", "", 2, nil),
+	}
+	if _, err := nds.PutMulti(c, keys, []testEntity{{1}, {2}}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Simulate a concurrent put holding the lock for the first key.
+	if err := memcache.Set(c, &memcache.Item{
+		Key:   nds.CreateMemcacheKey(keys[0]),
+		Flags: nds.LockItem,
+		Value: []byte{1, 2, 3, 4},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	contended := []*datastore.Key{}
+	hc := nds.WithContentionHandler(c, func(key *datastore.Key) {
+		contended = append(contended, key)
+	})
+
+	entities := make([]testEntity, len(keys))
+	if err := nds.GetMulti(hc, keys, entities); err != nil {
+		t.Fatal(err)
+	}
+	if entities[0].Val != 1 || entities[1].Val != 2 {
+		t.Fatal("incorrect entities", entities)
+	}
+	if len(contended) != 1 || !contended[0].Equal(keys[0]) {
+		t.Fatal("expected contention on the first key", contended)
+	}
+}
@@ -0,0 +1,306 @@
+package nds
+
+import (
+	"errors"
+	"strconv"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/memcache"
+)
+
+// Incrementer is implemented by a Cache that can atomically increment the
+// decimal integer values of items, as memcache.Increment and
+// memcache.IncrementExisting do. IncrementMulti and FlushCounters require the
+// Cache set with WithCache to implement it. App Engine memcache always does.
+type Incrementer interface {
+	Increment(c context.Context, key string, delta int64,
+		initialValue uint64) (uint64, error)
+	IncrementExisting(c context.Context, key string,
+		delta int64) (uint64, error)
+}
+
+// CounterProperty is the name of the int64 property of counter entities that
+// IncrementMulti and FlushCounters persist counts to.
+const CounterProperty = "Count"
+
+// counterOffset is added to counts held in the cache so that counts can go
+// below zero, as cache increments never take values below zero.
+const counterOffset uint64 = 1 << 62
+
+// defaultCounterConcurrency is how many counters are updated at once when no
+// limit is set with WithConcurrency.
+const defaultCounterConcurrency = 20
+
+// counterFlushInterval is the least time between the automatic flushes of a
+// counter to the datastore.
+const counterFlushInterval = time.Minute
+
+// IncrementMulti atomically adds delta to the counter for each key and
+// returns the new counts. Counts are held in the cache, using the atomic
+// increments of memcache, so no datastore reads or transactions are needed
+// for each increment. A counter missing from the cache starts at the
+// CounterProperty of its entity, or zero if there is none. Errors for
+// individual counters are returned in a appengine.MultiError alongside the
+// counts of the others.
+//
+// Counts are flushed to the CounterProperty of their entities, keeping any
+// other properties, by the first IncrementMulti call for a key each minute or
+// by calling FlushCounters. Warning: counts are only durable once flushed.
+// Increments made since the last flush are lost if the cache evicts the
+// counter, and reading counter entities with GetMulti returns the count as of
+// the last flush.
+//
+// Counters are incremented concurrently, at most as many at once as
+// WithConcurrency allows or 20 by default. IncrementMulti cannot be used
+// within a transaction as cache increments are not transactional.
+func IncrementMulti(c context.Context, keys []*datastore.Key,
+	delta int64) ([]int64, error) {
+
+	inc, err := counterCache(c, keys)
+	if err != nil {
+		return nil, err
+	}
+
+	counts := make([]int64, len(keys))
+	errs := make(appengine.MultiError, len(keys))
+	misses := make([]bool, len(keys))
+	forEachCounter(c, keys, func(i int) {
+		v, err := inc.IncrementExisting(c, counterMemcacheKey(c, keys[i]),
+			delta)
+		switch err {
+		case nil:
+			counts[i] = int64(v - counterOffset)
+		case memcache.ErrCacheMiss:
+			misses[i] = true
+		default:
+			errs[i] = err
+		}
+	})
+
+	// Start missing counters at the counts persisted in the datastore.
+	missKeys := make([]*datastore.Key, 0, len(keys))
+	missIndexes := make([]int, 0, len(keys))
+	for i, miss := range misses {
+		if miss {
+			missKeys = append(missKeys, keys[i])
+			missIndexes = append(missIndexes, i)
+		}
+	}
+	if len(missKeys) > 0 {
+		persisted, err := persistedCounts(c, missKeys)
+		if err != nil {
+			return nil, err
+		}
+		forEachCounter(c, missKeys, func(j int) {
+			i := missIndexes[j]
+			v, err := inc.Increment(c, counterMemcacheKey(c, keys[i]), delta,
+				counterOffset+uint64(persisted[j]))
+			if err == nil {
+				counts[i] = int64(v - counterOffset)
+			}
+			errs[i] = err
+		})
+	}
+
+	if err := flushDueCounters(c, keys, errs); err != nil {
+		warningf(c, "nds:IncrementMulti flushDueCounters %s", err)
+	}
+
+	for _, err := range errs {
+		if err != nil {
+			return counts, errs
+		}
+	}
+	return counts, nil
+}
+
+// FlushCounters persists the cached counts of the counters for keys to the
+// CounterProperty of their entities straight away. Each entity is updated
+// within its own transaction, as many at once as IncrementMulti increments.
+// Keys without a cached counter are left unchanged.
+func FlushCounters(c context.Context, keys []*datastore.Key) error {
+	if _, err := counterCache(c, keys); err != nil {
+		return err
+	}
+
+	memcacheKeys := make([]string, len(keys))
+	for i, key := range keys {
+		memcacheKeys[i] = counterMemcacheKey(c, key)
+	}
+	items, err := cacheFromContext(c).GetMulti(c, memcacheKeys)
+	if err != nil {
+		return err
+	}
+
+	errs := make(appengine.MultiError, len(keys))
+	forEachCounter(c, keys, func(i int) {
+		item, ok := items[memcacheKeys[i]]
+		if !ok {
+			return
+		}
+		v, err := strconv.ParseUint(string(item.Value), 10, 64)
+		if err != nil {
+			errs[i] = err
+			return
+		}
+		errs[i] = persistCount(c, keys[i], int64(v-counterOffset))
+	})
+
+	for _, err := range errs {
+		if err != nil {
+			return errs
+		}
+	}
+	return nil
+}
+
+// counterCache checks that counters can be used for keys with c and returns
+// the Incrementer to use.
+func counterCache(c context.Context,
+	keys []*datastore.Key) (Incrementer, error) {
+
+	if _, ok := transactionFromContext(c); ok {
+		return nil, errors.New("nds: counters cannot be used in a transaction")
+	}
+	if err := checkCacheKeyPrefix(c); err != nil {
+		return nil, err
+	}
+	for _, key := range keys {
+		if key == nil || key.Incomplete() {
+			return nil, datastore.ErrInvalidKey
+		}
+	}
+
+	cache, ok := c.Value(&cacheKey).(Cache)
+	if !ok || cache == nil {
+		cache = memcacheCache{}
+	}
+	inc, ok := cache.(Incrementer)
+	if !ok {
+		return nil, errors.New("nds: cache does not implement Incrementer")
+	}
+	return inc, nil
+}
+
+// counterMemcacheKey returns the memcache key of the counter for key.
+func counterMemcacheKey(c context.Context, key *datastore.Key) string {
+	return createSuffixedMemcacheKey(c, key, ":counter")
+}
+
+// forEachCounter calls f concurrently for each index of keys, running at most
+// the concurrency of c, or defaultCounterConcurrency, at once.
+func forEachCounter(c context.Context, keys []*datastore.Key, f func(i int)) {
+	n := concurrency(c)
+	if n == 0 {
+		n = defaultCounterConcurrency
+	}
+	sem := make(chan struct{}, n)
+	wg := sync.WaitGroup{}
+	wg.Add(len(keys))
+	for i := range keys {
+		sem <- struct{}{}
+		go func(i int) {
+			f(i)
+			<-sem
+			wg.Done()
+		}(i)
+	}
+	wg.Wait()
+}
+
+// persistedCounts returns the counts persisted in the entities for keys.
+func persistedCounts(c context.Context,
+	keys []*datastore.Key) ([]int64, error) {
+
+	pls := make([]datastore.PropertyList, len(keys))
+	err := getDatastore(c, keys, pls)
+	me, ok := err.(appengine.MultiError)
+	if err != nil && !ok {
+		return nil, err
+	}
+
+	counts := make([]int64, len(keys))
+	for i, pl := range pls {
+		if me != nil && me[i] != nil && me[i] != datastore.ErrNoSuchEntity {
+			return nil, me[i]
+		}
+		for _, p := range pl {
+			if p.Name == CounterProperty {
+				counts[i], _ = p.Value.(int64)
+			}
+		}
+	}
+	return counts, nil
+}
+
+// flushDueCounters flushes the counters for keys, other than those with
+// errs, that have not been flushed within the flush interval.
+func flushDueCounters(c context.Context, keys []*datastore.Key,
+	errs appengine.MultiError) error {
+
+	dueKeys := make([]*datastore.Key, 0, len(keys))
+	items := make([]*memcache.Item, 0, len(keys))
+	for i, key := range keys {
+		if errs[i] == nil {
+			dueKeys = append(dueKeys, key)
+			items = append(items, &memcache.Item{
+				Key:        createSuffixedMemcacheKey(c, key, ":counter:flushed"),
+				Value:      []byte{},
+				Expiration: counterFlushInterval,
+			})
+		}
+	}
+	if len(items) == 0 {
+		return nil
+	}
+
+	// Only the items that were not already present are due.
+	err := checkMultiError(cacheFromContext(c).AddMulti(c, items),
+		len(items))
+	me, ok := err.(appengine.MultiError)
+	switch {
+	case err == memcache.ErrNotStored:
+		return nil
+	case err != nil && !ok:
+		return err
+	case ok:
+		due := dueKeys[:0]
+		for i, key := range dueKeys {
+			if me[i] == nil {
+				due = append(due, key)
+			}
+		}
+		dueKeys = due
+	}
+	if len(dueKeys) == 0 {
+		return nil
+	}
+	return FlushCounters(c, dueKeys)
+}
+
+// persistCount sets the CounterProperty of the entity for key to count.
+func persistCount(c context.Context, key *datastore.Key, count int64) error {
+	return RunInTransaction(c, func(tc context.Context) error {
+		pls := make([]datastore.PropertyList, 1)
+		err := getDatastore(tc, []*datastore.Key{key}, pls)
+		err = singleError(err)
+		if err != nil && err != datastore.ErrNoSuchEntity {
+			return err
+		}
+
+		pl := make(datastore.PropertyList, 0, len(pls[0])+1)
+		for _, p := range pls[0] {
+			if p.Name != CounterProperty {
+				pl = append(pl, p)
+			}
+		}
+		pl = append(pl, datastore.Property{Name: CounterProperty, Value: count})
+
+		_, err = Put(tc, key, &pl)
+		return err
+	}, nil)
+}
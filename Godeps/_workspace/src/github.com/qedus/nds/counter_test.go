@@ -0,0 +1,139 @@
+package nds_test
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/qedus/nds"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/memcache"
+)
+
+// boundedIncrementer is a recordingCache that implements nds.Incrementer and
+// records the most increments it has seen running at once.
+type boundedIncrementer struct {
+	*recordingCache
+	mu            sync.Mutex
+	running, most int
+}
+
+func (bi *boundedIncrementer) track(f func() (uint64, error)) (uint64,
+	error) {
+	bi.mu.Lock()
+	if bi.running++; bi.running > bi.most {
+		bi.most = bi.running
+	}
+	bi.mu.Unlock()
+	defer func() {
+		bi.mu.Lock()
+		bi.running--
+		bi.mu.Unlock()
+	}()
+	return f()
+}
+
+func (bi *boundedIncrementer) Increment(c context.Context, key string,
+	delta int64, initialValue uint64) (uint64, error) {
+	return bi.track(func() (uint64, error) {
+		return memcache.Increment(c, key, delta, initialValue)
+	})
+}
+
+func (bi *boundedIncrementer) IncrementExisting(c context.Context,
+	key string, delta int64) (uint64, error) {
+	return bi.track(func() (uint64, error) {
+		return memcache.IncrementExisting(c, key, delta)
+	})
+}
+
+func TestIncrementMulti(t *testing.T) {
+	c, closeFunc := NewContext(t, nil)
+	defer closeFunc()
+
+	keys := []*datastore.Key{
+		datastore.NewKey(c, "Counter", "", 1, nil),
+		datastore.NewKey(c, "Counter", "", 2, nil),
+	}
+
+	// The second counter starts at its persisted count.
+	if _, err := nds.Put(c, keys[1], &datastore.PropertyList{
+		{Name: nds.CounterProperty, Value: int64(10)},
+		{Name: "Name", Value: "views"},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	counts, err := nds.IncrementMulti(c, keys, 2)
+	if err != nil {
+		t.Fatal(err)
+	} else if counts[0] != 2 || counts[1] != 12 {
+		t.Fatal("incorrect counts", counts)
+	}
+
+	counts, err = nds.IncrementMulti(c, keys, -5)
+	if err != nil {
+		t.Fatal(err)
+	} else if counts[0] != -3 || counts[1] != 7 {
+		t.Fatal("incorrect counts", counts)
+	}
+
+	// Only the first increments were flushed straight away.
+	persisted := func() []datastore.PropertyList {
+		pls := make([]datastore.PropertyList, len(keys))
+		if err := nds.GetMulti(c, keys, pls); err != nil {
+			t.Fatal(err)
+		}
+		return pls
+	}
+	count := func(pl datastore.PropertyList) interface{} {
+		for _, p := range pl {
+			if p.Name == nds.CounterProperty {
+				return p.Value
+			}
+		}
+		return nil
+	}
+	pls := persisted()
+	if count(pls[0]) != int64(2) || count(pls[1]) != int64(12) {
+		t.Fatal("incorrect persisted counts", pls)
+	}
+
+	if err := nds.FlushCounters(c, keys); err != nil {
+		t.Fatal(err)
+	}
+	pls = persisted()
+	if count(pls[0]) != int64(-3) || count(pls[1]) != int64(7) {
+		t.Fatal("incorrect persisted counts", pls)
+	}
+	if len(pls[1]) != 2 {
+		t.Fatal("expected other properties to be kept", pls[1])
+	}
+
+	// Custom caches must support increments.
+	if _, err := nds.IncrementMulti(nds.WithCache(c, &recordingCache{}),
+		keys, 1); err == nil {
+		t.Fatal("expected error for cache without increments")
+	}
+}
+
+func TestIncrementMultiConcurrency(t *testing.T) {
+	c, closeFunc := NewContext(t, nil)
+	defer closeFunc()
+
+	keys := make([]*datastore.Key, 10)
+	for i := range keys {
+		keys[i] = datastore.NewKey(c, "Counter", "", int64(i+1), nil)
+	}
+
+	bi := &boundedIncrementer{recordingCache: &recordingCache{}}
+	bc := nds.WithConcurrency(nds.WithCache(c, bi), 1)
+	for i := 0; i < 2; i++ {
+		if _, err := nds.IncrementMulti(bc, keys, 1); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if bi.most != 1 {
+		t.Fatal("expected one increment at a time", bi.most)
+	}
+}
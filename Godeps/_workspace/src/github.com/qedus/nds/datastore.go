@@ -0,0 +1,77 @@
+package nds
+
+import (
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/datastore"
+)
+
+// DatastoreClient is the entity store NDS caches. By default App Engine
+// datastore is used but any store that honours the datastore package
+// semantics below can be plugged in using WithDatastore.
+//
+// GetMulti, PutMulti and DeleteMulti must behave like their datastore package
+// counterparts, including reporting errors for individual entities using a
+// appengine.MultiError and returning datastore.ErrNoSuchEntity for missing
+// entities. RunInTransaction must call f with a context that makes the other
+// methods operate within the transaction.
+//
+// Only the entity store is pluggable. NDS and its DatastoreClient still take
+// App Engine datastore.Key values, not those of cloud.google.com/go/datastore,
+// and c must still be an App Engine context, which NDS uses to build keys and
+// to log. The cache can be replaced separately with WithCache.
+type DatastoreClient interface {
+	DeleteMulti(c context.Context, keys []*datastore.Key) error
+	GetMulti(c context.Context, keys []*datastore.Key, vals interface{}) error
+	PutMulti(c context.Context, keys []*datastore.Key,
+		vals interface{}) ([]*datastore.Key, error)
+	RunInTransaction(c context.Context, f func(tc context.Context) error,
+		opts *datastore.TransactionOptions) error
+}
+
+var datastoreKey = "used for DatastoreClient"
+
+// WithDatastore returns a context that makes NDS use client instead of App
+// Engine datastore for all operations using the returned context. Keys are
+// still datastore.Key values so client is responsible for converting them to
+// and from its own key type.
+func WithDatastore(c context.Context, client DatastoreClient) context.Context {
+	return context.WithValue(c, &datastoreKey, client)
+}
+
+func datastoreFromContext(c context.Context) DatastoreClient {
+	if client, ok := c.Value(&datastoreKey).(DatastoreClient); ok &&
+		client != nil {
+		return client
+	}
+	return appengineDatastore{}
+}
+
+// appengineDatastore is the default DatastoreClient and uses App Engine
+// datastore.
+type appengineDatastore struct{}
+
+func (appengineDatastore) DeleteMulti(c context.Context,
+	keys []*datastore.Key) error {
+	return datastoreDeleteMulti(c, keys)
+}
+
+func (appengineDatastore) AllocateIDs(c context.Context, kind string,
+	parent *datastore.Key, n int) (int64, int64, error) {
+	return datastoreAllocateIDs(c, kind, parent, n)
+}
+
+func (appengineDatastore) GetMulti(c context.Context, keys []*datastore.Key,
+	vals interface{}) error {
+	return datastoreGetMulti(c, keys, vals)
+}
+
+func (appengineDatastore) PutMulti(c context.Context, keys []*datastore.Key,
+	vals interface{}) ([]*datastore.Key, error) {
+	return datastorePutMulti(c, keys, vals)
+}
+
+func (appengineDatastore) RunInTransaction(c context.Context,
+	f func(tc context.Context) error,
+	opts *datastore.TransactionOptions) error {
+	return datastore.RunInTransaction(c, f, opts)
+}
@@ -0,0 +1,77 @@
+package nds_test
+
+import (
+	"testing"
+
+	"github.com/qedus/nds"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/datastore"
+)
+
+// countingDatastore counts calls before delegating to App Engine datastore.
+type countingDatastore struct {
+	deletes, gets, puts, transactions int
+}
+
+func (cd *countingDatastore) DeleteMulti(c context.Context,
+	keys []*datastore.Key) error {
+	cd.deletes++
+	return datastore.DeleteMulti(c, keys)
+}
+
+func (cd *countingDatastore) GetMulti(c context.Context, keys []*datastore.Key,
+	vals interface{}) error {
+	cd.gets++
+	return datastore.GetMulti(c, keys, vals)
+}
+
+func (cd *countingDatastore) PutMulti(c context.Context, keys []*datastore.Key,
+	vals interface{}) ([]*datastore.Key, error) {
+	cd.puts++
+	return datastore.PutMulti(c, keys, vals)
+}
+
+func (cd *countingDatastore) RunInTransaction(c context.Context,
+	f func(tc context.Context) error,
+	opts *datastore.TransactionOptions) error {
+	cd.transactions++
+	return datastore.RunInTransaction(c, f, opts)
+}
+
+func TestWithDatastore(t *testing.T) {
+	c, closeFunc := NewContext(t, nil)
+	defer closeFunc()
+
+	type testEntity struct {
+		Val int
+	}
+
+	cd := &countingDatastore{}
+	dc := nds.WithDatastore(c, cd)
+
+	key := datastore.NewKey(c, "Entity", "", 1, nil)
+	if _, err := nds.Put(dc, key, &testEntity{4}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Only the first get should reach the datastore.
+	for i := 0; i < 2; i++ {
+		te := &testEntity{}
+		if err := nds.Get(dc, key, te); err != nil {
+			t.Fatal(err)
+		} else if te.Val != 4 {
+			t.Fatal("incorrect val", te.Val)
+		}
+	}
+
+	if err := nds.RunInTransaction(dc, func(tc context.Context) error {
+		return nds.Delete(tc, key)
+	}, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	if cd.puts != 1 || cd.gets != 1 || cd.deletes != 1 ||
+		cd.transactions != 1 {
+		t.Fatal("unexpected call counts", cd)
+	}
+}
@@ -0,0 +1,75 @@
+package nds
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// ErrDeadlineBudgetExceeded is wrapped by the *DeadlineBudgetError returned
+// when there is not enough time left before the deadline of the context to
+// run the next batch of a large PutMulti or DeleteMulti.
+var ErrDeadlineBudgetExceeded = errors.New("nds: deadline budget exceeded")
+
+// DeadlineBudgetError is returned by PutMulti and DeleteMulti when they stop
+// before the deadline of their context rather than run a batch that is unlikely
+// to finish in time. Every batch that was started has completed successfully,
+// so the call can be resumed with the keys and vals from index Done onwards.
+// PutMulti also returns the keys of the entities that were put.
+//
+// How long a batch takes is estimated from a moving average of the batches of
+// the same call, so the first batch always runs. Calls small enough for a
+// single batch, and contexts without a deadline, are unaffected.
+type DeadlineBudgetError struct {
+	// Completed is the number of batches that were run.
+	Completed int
+
+	// Done is the number of keys covered by the completed batches.
+	Done int
+}
+
+func (e *DeadlineBudgetError) Error() string {
+	return fmt.Sprintf("%s after %d batches covering %d keys",
+		ErrDeadlineBudgetExceeded, e.Completed, e.Done)
+}
+
+// Unwrap returns ErrDeadlineBudgetExceeded.
+func (e *DeadlineBudgetError) Unwrap() error {
+	return ErrDeadlineBudgetExceeded
+}
+
+// batchBudget keeps a moving average of how long the batches of a call take
+// to decide whether the next one fits before the deadline of the context.
+type batchBudget struct {
+	mu      sync.Mutex
+	average time.Duration
+	samples int
+}
+
+// fits reports whether another batch is likely to finish before the deadline
+// of c.
+func (b *batchBudget) fits(c context.Context) bool {
+	deadline, ok := c.Deadline()
+	if !ok {
+		return true
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.samples == 0 || deadline.Sub(timeNow()) >= b.average
+}
+
+// record adds the duration of a completed batch to the moving average,
+// weighting recent batches more heavily.
+func (b *batchBudget) record(d time.Duration) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.samples == 0 {
+		b.average = d
+	} else {
+		b.average = (b.average*3 + d) / 4
+	}
+	b.samples++
+}
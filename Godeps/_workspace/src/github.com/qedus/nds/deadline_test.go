@@ -0,0 +1,92 @@
+package nds_test
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/qedus/nds"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/datastore"
+)
+
+// deadlineContext reports a deadline without ever being done, so deadline
+// budgets can be tested against a fake clock.
+type deadlineContext struct {
+	context.Context
+	deadline time.Time
+}
+
+func (dc deadlineContext) Deadline() (time.Time, bool) {
+	return dc.deadline, true
+}
+
+func TestDeadlineBudget(t *testing.T) {
+	c, closeFunc := NewContext(t, nil)
+	defer closeFunc()
+
+	type testEntity struct {
+		Val int
+	}
+
+	var mu sync.Mutex
+	now := time.Unix(1000, 0)
+	nds.SetTimeNow(func() time.Time {
+		mu.Lock()
+		defer mu.Unlock()
+		return now
+	})
+	defer nds.SetTimeNow(time.Now)
+
+	// Each batch takes 100ms.
+	nds.SetDatastorePutMulti(func(c context.Context, keys []*datastore.Key,
+		vals interface{}) ([]*datastore.Key, error) {
+		mu.Lock()
+		now = now.Add(100 * time.Millisecond)
+		mu.Unlock()
+		return datastore.PutMulti(c, keys, vals)
+	})
+	defer nds.SetDatastorePutMulti(datastore.PutMulti)
+
+	keys := []*datastore.Key{
+		datastore.NewKey(c, "Entity", "", 1, nil),
+		datastore.NewKey(c, "Entity", "", 2, nil),
+		datastore.NewKey(c, "Entity", "", 3, nil),
+		datastore.NewKey(c, "Entity", "", 4, nil),
+	}
+	vals := []testEntity{{1}, {2}, {3}, {4}}
+
+	// Only two batches fit before the deadline.
+	dc := deadlineContext{nds.WithMaxBatchSize(c, 1),
+		now.Add(250 * time.Millisecond)}
+	putKeys, err := nds.PutMulti(dc, keys, vals)
+	be, ok := err.(*nds.DeadlineBudgetError)
+	if !ok {
+		t.Fatal("expected *nds.DeadlineBudgetError", err)
+	}
+	if !errors.Is(err, nds.ErrDeadlineBudgetExceeded) {
+		t.Fatal("expected ErrDeadlineBudgetExceeded")
+	}
+	if be.Completed != 2 || be.Done != 2 {
+		t.Fatal("expected two batches", be.Completed, be.Done)
+	}
+	if len(putKeys) != 2 || !putKeys[1].Equal(keys[1]) {
+		t.Fatal("expected keys of completed batches", putKeys)
+	}
+
+	// The call can be resumed from where it stopped.
+	if _, err := nds.PutMulti(nds.WithMaxBatchSize(c, 1), keys[be.Done:],
+		vals[be.Done:]); err != nil {
+		t.Fatal(err)
+	}
+	got := make([]testEntity, len(keys))
+	if err := nds.GetMulti(c, keys, got); err != nil {
+		t.Fatal(err)
+	}
+	for i, te := range got {
+		if te.Val != i+1 {
+			t.Fatal("incorrect val", i, te.Val)
+		}
+	}
+}
@@ -0,0 +1,20 @@
+package nds
+
+import "golang.org/x/net/context"
+
+var decodeFallbackKey = "used for decode fallback"
+
+// WithDecodeFallback returns a context that makes GetMulti treat cached
+// entities that cannot be decoded, or loaded into the destination, as cache
+// misses. The entity is read from the datastore instead and its cache entry
+// is replaced with the fresh entity. This allows entity structs to change
+// shape without flushing the cache. Each such failure is logged at debug
+// level rather than as a warning.
+func WithDecodeFallback(c context.Context) context.Context {
+	return context.WithValue(c, &decodeFallbackKey, true)
+}
+
+func isDecodeFallback(c context.Context) bool {
+	fallback, _ := c.Value(&decodeFallbackKey).(bool)
+	return fallback
+}
@@ -0,0 +1,64 @@
+package nds_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/qedus/nds"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/memcache"
+)
+
+func TestWithDecodeFallback(t *testing.T) {
+	c, closeFunc := NewContext(t, nil)
+	defer closeFunc()
+
+	type testEntity struct {
+		Val int
+	}
+
+	key := datastore.NewKey(c, "Entity", "", 1, nil)
+	if _, err := nds.Put(c, key, &testEntity{1}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Cache bytes that cannot be decoded.
+	if err := memcache.Set(c, &memcache.Item{
+		Key:   nds.CacheKey(c, key),
+		Flags: nds.EntityItem,
+		Value: []byte("not an entity"),
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	rl := &recordingLogger{}
+	fc := nds.WithDecodeFallback(nds.WithLogger(c, rl))
+
+	te := &testEntity{}
+	if err := nds.Get(fc, key, te); err != nil {
+		t.Fatal(err)
+	} else if te.Val != 1 {
+		t.Fatal("incorrect val", te.Val)
+	}
+	if len(rl.debugs) == 0 {
+		t.Fatal("expected decode failure to be logged")
+	}
+	for _, warning := range rl.warnings {
+		if strings.Contains(warning, "unmarshal") ||
+			strings.Contains(warning, "decode") {
+			t.Fatal("expected decode failure at debug level", warning)
+		}
+	}
+
+	// The bad entry has been replaced.
+	item, err := memcache.Get(c, nds.CacheKey(c, key))
+	if err != nil {
+		t.Fatal(err)
+	}
+	te = &testEntity{}
+	if err := nds.UnmarshalEntity(c, item.Value, te); err != nil {
+		t.Fatal(err)
+	} else if te.Val != 1 {
+		t.Fatal("incorrect cached val", te.Val)
+	}
+}
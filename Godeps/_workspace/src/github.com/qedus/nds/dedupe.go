@@ -0,0 +1,88 @@
+package nds
+
+import (
+	"reflect"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+)
+
+// distinctKeys returns the index of the first occurrence of each key in keys,
+// and whether any key occurs more than once.
+func distinctKeys(keys []*datastore.Key) ([]int, bool) {
+	firsts := make([]int, len(keys))
+	seen := make(map[string]int, len(keys))
+	dups := false
+	for i, key := range keys {
+		encoded := key.Encode()
+		if first, ok := seen[encoded]; ok {
+			firsts[i], dups = first, true
+			continue
+		}
+		seen[encoded] = i
+		firsts[i] = i
+	}
+	return firsts, dups
+}
+
+// getDeduped gets each distinct key in keys once and loads the result into
+// every element of vals whose key it is. firsts holds the index of the first
+// occurrence of each key, as returned by distinctKeys.
+func getDeduped(c context.Context, keys []*datastore.Key, vals reflect.Value,
+	firsts []int) error {
+
+	var indexes []int
+	for i, first := range firsts {
+		if i == first {
+			indexes = append(indexes, i)
+		}
+	}
+
+	distinct := make([]*datastore.Key, len(indexes))
+	distinctVals := reflect.MakeSlice(vals.Type(), len(indexes), len(indexes))
+	for i, index := range indexes {
+		distinct[i] = keys[index]
+		distinctVals.Index(i).Set(vals.Index(index))
+	}
+
+	err := GetMulti(c, distinct, distinctVals.Interface())
+	me, ok := err.(appengine.MultiError)
+	if err != nil && !ok {
+		return err
+	}
+
+	errs := make(appengine.MultiError, len(keys))
+	for i, index := range indexes {
+		vals.Index(index).Set(distinctVals.Index(i))
+		if ok {
+			errs[index] = me[i]
+		}
+	}
+
+	// Fan out copies of each entity that was loaded to its duplicates.
+	errsNil := err == nil
+	for i, first := range firsts {
+		if i == first {
+			continue
+		}
+		errs[i] = errs[first]
+		_, mismatch := errs[i].(*datastore.ErrFieldMismatch)
+		if errs[i] == nil || mismatch {
+			pl, err := saveValue(vals.Index(first))
+			if err == nil {
+				err = setValue(vals.Index(i), pl)
+			}
+			if err != nil {
+				errs[i] = err
+			}
+		}
+		if errs[i] != nil {
+			errsNil = false
+		}
+	}
+	if errsNil {
+		return nil
+	}
+	return errs
+}
@@ -0,0 +1,81 @@
+package nds_test
+
+import (
+	"testing"
+
+	"github.com/qedus/nds"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+)
+
+func TestGetMultiDuplicateKeys(t *testing.T) {
+	c, closeFunc := NewContext(t, nil)
+	defer closeFunc()
+
+	type testEntity struct {
+		Val  int
+		Tags []string
+	}
+
+	keys := []*datastore.Key{
+		datastore.NewKey(c, "Entity", "", 1, nil),
+		datastore.NewKey(c, "Entity", "", 2, nil),
+	}
+	if _, err := nds.PutMulti(c, keys, []testEntity{
+		{1, []string{"a"}}, {2, []string{"b"}},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	missing := datastore.NewKey(c, "Entity", "", 3, nil)
+
+	rc := &recordingCache{}
+	cc := nds.WithCache(c, rc)
+
+	getKeys := []*datastore.Key{
+		keys[0], missing, keys[1], keys[0], missing, keys[1], keys[0],
+	}
+	vals := make([]*testEntity, len(getKeys))
+	err := nds.GetMulti(cc, getKeys, vals)
+	me, ok := err.(appengine.MultiError)
+	if !ok {
+		t.Fatal("expected appengine.MultiError", err)
+	}
+	for i, key := range getKeys {
+		switch {
+		case key.Equal(missing):
+			if me[i] != datastore.ErrNoSuchEntity {
+				t.Fatal("expected datastore.ErrNoSuchEntity", i, me[i])
+			}
+		case me[i] != nil:
+			t.Fatal(i, me[i])
+		case vals[i].Val != int(key.IntID()) || len(vals[i].Tags) != 1:
+			t.Fatal("incorrect val", i, vals[i])
+		}
+	}
+
+	// Duplicates must not share their entities.
+	vals[0].Tags[0] = "changed"
+	if vals[3].Tags[0] != "a" {
+		t.Fatal("expected distinct entities", vals[3])
+	}
+
+	counts := map[string]int{}
+	for _, key := range rc.getKeys {
+		counts[key]++
+	}
+	for _, key := range getKeys {
+		// Once to load the cache and once to lock it.
+		if n := counts[nds.CacheKey(c, key)]; n > 2 {
+			t.Fatal("expected each key to be got once", key, n)
+		}
+	}
+
+	// Cached entities are fanned out too.
+	structVals := make([]testEntity, len(getKeys))
+	if err := nds.GetMulti(cc, getKeys, structVals); err == nil {
+		t.Fatal("expected error")
+	}
+	if structVals[6].Val != 1 || structVals[5].Val != 2 {
+		t.Fatal("incorrect vals", structVals)
+	}
+}
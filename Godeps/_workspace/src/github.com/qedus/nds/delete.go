@@ -1,55 +1,298 @@
 package nds
 
 import (
+	"reflect"
+
 	"golang.org/x/net/context"
 	"google.golang.org/appengine"
 	"google.golang.org/appengine/datastore"
 	"google.golang.org/appengine/memcache"
 )
 
+// deleteMultiLimit is the App Engine datastore limit for the maximum number
+// of entities that can be deleted by datastore.DeleteMulti at once.
+const deleteMultiLimit = 500
+
 // DeleteMulti works just like datastore.DeleteMulti except it maintains
-// cache consistency with other NDS methods.
+// cache consistency with other NDS methods. It also removes the API limit of
+// 500 entities per request by calling the datastore as many times as
+// required. If c is cancelled part way through, the remaining entities are not
+// deleted and c.Err() is returned. If c has a deadline too close for the next
+// batch, the remaining entities are not deleted and a *DeadlineBudgetError is
+// returned.
 func DeleteMulti(c context.Context, keys []*datastore.Key) error {
-	return deleteMulti(c, keys)
+	if err := checkAppIDs(c, keys); err != nil {
+		return err
+	}
+
+	c = withBreakerDecision(c)
+	c, flush := batchLogging(c)
+	defer flush()
+
+	if r, ok := recorderFromContext(c); ok {
+		return recordDeleteMulti(c, r, keys, DeleteMulti)
+	}
+
+	if f, ok := keyMapperFromContext(c); ok {
+		physicalKeys, err := mapKeys(keys, f)
+		if err != nil {
+			return err
+		}
+		return DeleteMulti(withoutKeyMapper(c), physicalKeys)
+	}
+
+	if uncached, cached := splitUncachedKinds(c, keys); len(uncached) > 0 {
+		_, err := runUncachedSplit(c, keys, reflect.Value{}, uncached, cached,
+			func(c context.Context, keys []*datastore.Key,
+				_ reflect.Value) ([]*datastore.Key, error) {
+				return nil, DeleteMulti(c, keys)
+			})
+		return err
+	}
+
+	addStat(c, statDeletes, len(keys))
+
+	size := batchSize(c, deleteMultiLimit)
+	if len(keys) <= size {
+		return deleteMulti(c, keys)
+	}
+
+	fc, ff := newFailFast(c)
+	err := runBudgetedBatches(fc, len(keys), size, &batchBudget{},
+		func(lo, hi int) error {
+			err := deleteMulti(fc, keys[lo:hi])
+			ff.record(err)
+			return err
+		})
+	return ff.done(err)
+}
+
+// DeleteMultiExisting works just like DeleteMulti except that it also returns
+// the keys that had an entity immediately before they were deleted. Existence
+// is checked by reading the entities from the datastore first, so outside of a
+// transaction an entity created or deleted concurrently between the read and
+// the delete may be misreported. The cache is invalidated for every key
+// whether or not its entity existed. The entities are read in batches as
+// DeleteMulti deletes them, and if c is done or its deadline would be passed
+// before every batch has been read nothing is deleted.
+func DeleteMultiExisting(c context.Context,
+	keys []*datastore.Key) ([]*datastore.Key, error) {
+
+	physicalKeys := keys
+	if f, ok := keyMapperFromContext(c); ok {
+		var err error
+		if physicalKeys, err = mapKeys(keys, f); err != nil {
+			return nil, err
+		}
+		c = withoutKeyMapper(c)
+	}
+
+	exists := make([]bool, len(keys))
+	err := runBudgetedBatches(c, len(keys), batchSize(c, getMultiLimit),
+		&batchBudget{}, func(lo, hi int) error {
+			// Invalid keys are left for DeleteMulti to report.
+			pls := make([]datastore.PropertyList, hi-lo)
+			err := getDatastore(c, physicalKeys[lo:hi], pls)
+			me, ok := err.(appengine.MultiError)
+			if err != nil && !ok {
+				return err
+			}
+			for i := lo; i < hi; i++ {
+				exists[i] = me == nil || me[i-lo] == nil
+			}
+			return nil
+		})
+	if err != nil {
+		return nil, err
+	}
+
+	if err := DeleteMulti(c, physicalKeys); err != nil {
+		return nil, err
+	}
+
+	existing := make([]*datastore.Key, 0, len(keys))
+	for i, key := range keys {
+		if exists[i] {
+			existing = append(existing, key)
+		}
+	}
+	return existing, nil
+}
+
+// DeleteByQuery deletes every entity matching q, using DeleteMulti so the
+// cache is invalidated as usual, and returns the number of entities deleted.
+// q is run keys only, one page of up to the delete batch size at a time, so
+// entities are never loaded and only one page of keys is held at once. If an
+// error occurs the entities deleted before it are still counted. Entities
+// created after their page has been read are not deleted.
+func DeleteByQuery(c context.Context, q *datastore.Query) (int, error) {
+	size := batchSize(c, deleteMultiLimit)
+	q = q.KeysOnly().Limit(size)
+
+	deleted := 0
+	var cursor *datastore.Cursor
+	for {
+		if err := c.Err(); err != nil {
+			return deleted, err
+		}
+
+		pq := q
+		if cursor != nil {
+			pq = q.Start(*cursor)
+		}
+		keys := make([]*datastore.Key, 0, size)
+		t := pq.Run(c)
+		for {
+			key, err := t.Next(nil)
+			if err == datastore.Done {
+				break
+			} else if err != nil {
+				return deleted, err
+			}
+			keys = append(keys, key)
+		}
+		if len(keys) == 0 {
+			return deleted, nil
+		}
+
+		next, err := t.Cursor()
+		if err != nil {
+			return deleted, err
+		}
+		if err := DeleteMulti(c, keys); err != nil {
+			return deleted, err
+		}
+		deleted += len(keys)
+		if len(keys) < size {
+			return deleted, nil
+		}
+		cursor = &next
+	}
+}
+
+// DeleteMultiAndEvict works just like DeleteMulti but also removes the raw
+// memcache keys in extraCacheKeys once the entities have been deleted. This
+// allows custom cache entries that depend on the deleted entities, such as
+// cached query results, to be invalidated along with them. Failing to remove
+// extraCacheKeys is logged but does not cause an error. Inside a transaction
+// extraCacheKeys are removed before the transaction commits.
+func DeleteMultiAndEvict(c context.Context, keys []*datastore.Key,
+	extraCacheKeys []string) error {
+
+	if err := DeleteMulti(c, keys); err != nil {
+		return err
+	}
+
+	if len(extraCacheKeys) == 0 {
+		return nil
+	}
+	if err := cacheFromContext(c).DeleteMulti(c,
+		extraCacheKeys); err != nil && !isCacheMissErrors(err) {
+		warningf(c, "nds:DeleteMultiAndEvict DeleteMulti %s", err)
+	}
+	return nil
+}
+
+// isCacheMissErrors reports whether err only reports memcache keys that were
+// not present.
+func isCacheMissErrors(err error) bool {
+	me, ok := err.(appengine.MultiError)
+	if !ok {
+		return err == memcache.ErrCacheMiss
+	}
+	for _, e := range me {
+		if e != nil && e != memcache.ErrCacheMiss {
+			return false
+		}
+	}
+	return true
 }
 
 // Delete deletes the entity for the given key.
 func Delete(c context.Context, key *datastore.Key) error {
-	err := deleteMulti(c, []*datastore.Key{key})
-	if me, ok := err.(appengine.MultiError); ok {
-		return me[0]
+	if err := checkAppIDs(c, []*datastore.Key{key}); err != nil {
+		return err
 	}
-	return err
+	c = withBreakerDecision(c)
+	if r, ok := recorderFromContext(c); ok {
+		return singleError(recordDeleteMulti(c, r, []*datastore.Key{key},
+			deleteMulti))
+	}
+	return singleError(deleteMulti(c, []*datastore.Key{key}))
 }
 
 func deleteMulti(c context.Context, keys []*datastore.Key) error {
 
-	lockMemcacheItems := []*memcache.Item{}
-	for _, key := range keys {
-		// Worst case scenario is that we lock the entity for memcacheLockTime.
-		// datastore.Delete will raise the appropriate error.
-		if key == nil || key.Incomplete() {
-			continue
-		}
+	expiration, err := lockTime(c)
+	if err != nil {
+		return err
+	}
+	if err := checkCacheKeyPrefix(c); err != nil {
+		return err
+	}
+
+	if recordDryRun(c, "DeleteMulti", keys) {
+		return nil
+	}
 
-		item := &memcache.Item{
-			Key:        createMemcacheKey(key),
-			Flags:      lockItem,
-			Value:      itemLock(),
-			Expiration: memcacheLockTime,
+	if tx, ok := transactionFromContext(c); ok {
+		if err := tx.addEntityGroups(keys); err != nil {
+			return err
 		}
-		lockMemcacheItems = append(lockMemcacheItems, item)
 	}
 
+	// Nil and incomplete keys are not locked. datastore.Delete will raise the
+	// appropriate error.
+	lockMemcacheItems, lockMemcacheKeys, lockedKeys := newLockItems(c, keys,
+		expiration)
+
 	// Make sure we can lock memcache with no errors before deleting.
 	if tx, ok := transactionFromContext(c); ok {
-		tx.Lock()
-		tx.lockMemcacheItems = append(tx.lockMemcacheItems,
-			lockMemcacheItems...)
-		tx.Unlock()
-	} else if err := memcacheSetMulti(c, lockMemcacheItems); err != nil {
-		return err
+		if isWithoutLocks(c) && !isStrictCommitOrdering(c) {
+			tx.addDeleteKeys(lockMemcacheKeys, lockedKeys)
+		} else {
+			tx.addLockItems(c, lockMemcacheItems, lockedKeys)
+		}
+	} else if !isNoCache(c) && !isWithoutLocks(c) {
+		recordEntryAges(c, lockedKeys)
+		if err := setLocks(c, lockMemcacheItems); err != nil {
+			return err
+		}
 	}
 
-	return datastoreDeleteMulti(c, keys)
+	err = retry(c, func() error {
+		sc, endSpan := startSpan(c, "datastore", "datastore.DeleteMulti",
+			len(keys))
+		err := datastoreFromContext(c).DeleteMulti(sc, keys)
+		endSpan(err)
+		return checkMultiError(err, len(keys))
+	})
+	evictLocalCache(c, lockMemcacheKeys)
+
+	if tx, ok := transactionFromContext(c); ok {
+		if err == nil {
+			tx.deleteEntities(c, keys)
+		}
+	} else if ttl, ok := tombstoneTTL(c); ok && err == nil &&
+		!isNoCache(c) && setTombstones(c, lockMemcacheKeys, ttl) {
+		invalidated(c, lockedKeys)
+	} else if d, ok := graceRefresh(c); ok && err == nil &&
+		setRefreshMarkers(c, lockMemcacheKeys, d) {
+		invalidated(c, lockedKeys)
+	} else if isNoCache(c) || isWithoutLocks(c) {
+		countInvalidations(c, lockMemcacheKeys)
+		if cacheErr := invalidationCache(c).DeleteMulti(c,
+			lockMemcacheKeys); cacheErr != nil && !isCacheMissErrors(cacheErr) {
+			invalidationWarningf(c, "deleteMulti memcache.DeleteMulti %s",
+				lockMemcacheKeys, cacheErr)
+		} else if err == nil {
+			invalidated(c, lockedKeys)
+		}
+	} else if err == nil {
+		invalidated(c, lockedKeys)
+	}
+	// Readers may have added the old entities to the process cache while the
+	// delete held its locks.
+	evictProcessCache(c, lockMemcacheKeys)
+	return err
 }
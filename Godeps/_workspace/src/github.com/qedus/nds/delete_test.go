@@ -134,3 +134,155 @@ func TestDeleteInTransaction(t *testing.T) {
 		t.Fatal(err)
 	}
 }
+
+func TestDeleteMultiAndEvict(t *testing.T) {
+	c, closeFunc := NewContext(t, nil)
+	defer closeFunc()
+
+	type testEntity struct {
+		Val int
+	}
+
+	key := datastore.NewKey(c, "TestEntity", "", 1, nil)
+	if _, err := nds.Put(c, key, &testEntity{2}); err != nil {
+		t.Fatal(err)
+	}
+
+	extraKey := "custom:list"
+	if err := memcache.Set(c, &memcache.Item{
+		Key:   extraKey,
+		Value: []byte("cached"),
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Missing extra keys must not cause an error.
+	if err := nds.DeleteMultiAndEvict(c, []*datastore.Key{key},
+		[]string{extraKey, "custom:missing"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := nds.Get(c, key, &testEntity{}); err != datastore.ErrNoSuchEntity {
+		t.Fatal("expected ErrNoSuchEntity", err)
+	}
+
+	if _, err := memcache.Get(c, extraKey); err != memcache.ErrCacheMiss {
+		t.Fatal("expected extra key to be evicted", err)
+	}
+}
+
+func TestDeleteMultiExisting(t *testing.T) {
+	c, closeFunc := NewContext(t, nil)
+	defer closeFunc()
+
+	type testEntity struct {
+		Val int
+	}
+
+	keys := []*datastore.Key{
+		datastore.NewKey(c, "Entity", "", 1, nil),
+		datastore.NewKey(c, "Entity", "", 2, nil),
+		datastore.NewKey(c, "Entity", "", 3, nil),
+	}
+	if _, err := nds.PutMulti(c, []*datastore.Key{keys[0], keys[2]},
+		[]testEntity{{1}, {3}}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Cache the missing entity so its invalidation can be checked.
+	if err := nds.Get(c, keys[1], &testEntity{}); err != datastore.ErrNoSuchEntity {
+		t.Fatal("expected datastore.ErrNoSuchEntity", err)
+	}
+
+	rc := &recordingCache{}
+	existing, err := nds.DeleteMultiExisting(nds.WithCache(c, rc), keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(existing) != 2 || !existing[0].Equal(keys[0]) ||
+		!existing[1].Equal(keys[2]) {
+		t.Fatal("incorrect existing keys", existing)
+	}
+
+	// Every key is locked even if it had no entity.
+	if len(rc.setItems) != len(keys) {
+		t.Fatal("expected all keys to be invalidated", len(rc.setItems))
+	}
+
+	existing, err = nds.DeleteMultiExisting(c, keys)
+	if err != nil {
+		t.Fatal(err)
+	} else if len(existing) != 0 {
+		t.Fatal("expected no existing keys", existing)
+	}
+
+	// Nothing is deleted once the context is done.
+	if _, err := nds.Put(c, keys[0], &testEntity{1}); err != nil {
+		t.Fatal(err)
+	}
+	cc, cancel := context.WithCancel(c)
+	cancel()
+	if _, err := nds.DeleteMultiExisting(cc,
+		keys); err != context.Canceled {
+		t.Fatal("expected context.Canceled", err)
+	}
+	if err := nds.Get(c, keys[0], &testEntity{}); err != nil {
+		t.Fatal("expected entity not to be deleted", err)
+	}
+}
+
+func TestDeleteByQuery(t *testing.T) {
+	c, closeFunc := NewContext(t, nil)
+	defer closeFunc()
+
+	type testEntity struct {
+		Val int
+	}
+
+	parent := datastore.NewKey(c, "Parent", "", 1, nil)
+	keys := make([]*datastore.Key, 5)
+	entities := make([]testEntity, len(keys))
+	for i := range keys {
+		keys[i] = datastore.NewKey(c, "Entity", "", int64(i+1), parent)
+		entities[i].Val = i
+	}
+	other := datastore.NewKey(c, "Entity", "", 1, nil)
+	if _, err := nds.PutMulti(c, append(keys, other),
+		append(entities, testEntity{})); err != nil {
+		t.Fatal(err)
+	}
+
+	// Cache the entities so the cache must be invalidated.
+	if err := nds.GetMulti(c, keys, make([]testEntity, len(keys))); err != nil {
+		t.Fatal(err)
+	}
+
+	// Delete in pages of two.
+	bc := nds.WithMaxBatchSize(c, 2)
+	q := datastore.NewQuery("Entity").Ancestor(parent)
+	if n, err := nds.DeleteByQuery(bc, q); err != nil {
+		t.Fatal(err)
+	} else if n != len(keys) {
+		t.Fatal("incorrect number deleted", n)
+	}
+
+	err := nds.GetMulti(c, keys, make([]testEntity, len(keys)))
+	if me, ok := err.(appengine.MultiError); !ok {
+		t.Fatal("expected appengine.MultiError", err)
+	} else {
+		for i, err := range me {
+			if err != datastore.ErrNoSuchEntity {
+				t.Fatal("expected datastore.ErrNoSuchEntity", i, err)
+			}
+		}
+	}
+	if err := nds.Get(c, other, &testEntity{}); err != nil {
+		t.Fatal(err)
+	}
+
+	if n, err := nds.DeleteByQuery(bc, q); err != nil {
+		t.Fatal(err)
+	} else if n != 0 {
+		t.Fatal("expected nothing to be deleted", n)
+	}
+}
@@ -0,0 +1,143 @@
+package nds
+
+import (
+	"fmt"
+	"strings"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/memcache"
+)
+
+// dependencyRegisterAttempts is how many times RegisterDependency tries to add
+// a dependent to the registry of a source that is changed concurrently.
+const dependencyRegisterAttempts = 3
+
+func createDependencyMemcacheKey(c context.Context,
+	source *datastore.Key) string {
+	return limitKindMemcacheKey(c, source.Kind(),
+		memcachePrefix+encodeCacheKey(c, source)+":dependents")
+}
+
+// RegisterDependency records that the cached entity for dependent, such as one
+// holding a denormalized copy of another entity, must be evicted whenever the
+// entity for source is written. From then on putting or deleting source with
+// PutMulti or DeleteMulti also removes dependent from the cache, and in turn
+// the dependents registered for dependent, so it is next read from the
+// datastore. Registering the same dependency again does nothing.
+//
+// The registry is kept in the cache alongside the entities, one item per
+// source, so it is shared by every instance. Dependency tracking is only
+// eventually consistent: a registry item can be evicted like any other cache
+// item, losing its dependencies until they are registered again, so register
+// dependencies whenever the denormalized entity is built. Every write looks up
+// the registry items of the entities it writes, whichever instance registered
+// them, unless the cache is known to be unavailable. Dependents are evicted
+// rather than locked, so a dependent read from the datastore just before its
+// source is written can still be cached afterwards.
+func RegisterDependency(c context.Context,
+	dependent, source *datastore.Key) error {
+
+	if dependent == nil || dependent.Incomplete() ||
+		source == nil || source.Incomplete() {
+		return datastore.ErrInvalidKey
+	}
+	if err := checkCacheKeyPrefix(c); err != nil {
+		return err
+	}
+
+	memcacheKey := createDependencyMemcacheKey(c, source)
+	encoded := encodeCacheKey(c, dependent)
+	for attempt := 1; ; attempt++ {
+		items, err := cacheFromContext(c).GetMulti(c, []string{memcacheKey})
+		if err != nil {
+			return err
+		}
+
+		item, ok := items[memcacheKey]
+		if ok && itemType(item.Flags) == keyItem {
+			for _, d := range strings.Split(string(item.Value), "\n") {
+				if d == encoded {
+					return nil
+				}
+			}
+			item.Value = append(append(item.Value, '\n'), encoded...)
+			if len(item.Value) > maxItemSize(c) {
+				return fmt.Errorf("nds: too many dependents registered for %s",
+					source)
+			}
+			err = cacheFromContext(c).CompareAndSwapMulti(c,
+				[]*memcache.Item{item})
+		} else {
+			err = cacheFromContext(c).AddMulti(c, []*memcache.Item{{
+				Key:   memcacheKey,
+				Flags: keyItem,
+				Value: []byte(encoded),
+			}})
+		}
+
+		if err == nil {
+			return nil
+		}
+		err = singleError(err)
+		if (err != memcache.ErrCASConflict && err != memcache.ErrNotStored) ||
+			attempt == dependencyRegisterAttempts {
+			return err
+		}
+	}
+}
+
+// evictDependents removes the cached entities of the dependents registered for
+// keys, and of their dependents in turn. Nothing is looked up while the cache
+// is known to be unavailable.
+func evictDependents(c context.Context, keys []*datastore.Key) {
+	if isBreakerOpen(c) || isCacheUnavailable(c) {
+		return
+	}
+
+	visited := map[string]bool{}
+	for len(keys) > 0 {
+		var dependencyKeys []string
+		for _, key := range keys {
+			memcacheKey := createDependencyMemcacheKey(c, key)
+			if !visited[memcacheKey] {
+				visited[memcacheKey] = true
+				dependencyKeys = append(dependencyKeys, memcacheKey)
+			}
+		}
+		if len(dependencyKeys) == 0 {
+			return
+		}
+
+		items, err := cacheFromContext(c).GetMulti(c, dependencyKeys)
+		if err != nil {
+			warningf(c, "nds:evictDependents GetMulti %s", err)
+			return
+		}
+		keys = nil
+		var memcacheKeys []string
+		for _, item := range items {
+			if itemType(item.Flags) != keyItem {
+				continue
+			}
+			for _, encoded := range strings.Split(string(item.Value), "\n") {
+				key, err := decodeCacheKey(c, encoded)
+				if err != nil {
+					warningf(c, "nds:evictDependents DecodeKey %s", err)
+					continue
+				}
+				keys = append(keys, key)
+				memcacheKeys = append(memcacheKeys, writeMemcacheKeys(c, key)...)
+			}
+		}
+		if len(memcacheKeys) == 0 {
+			return
+		}
+
+		evictLocalCache(c, memcacheKeys)
+		if err := cacheFromContext(c).DeleteMulti(c,
+			memcacheKeys); err != nil && !isCacheMissErrors(err) {
+			warningf(c, "nds:evictDependents DeleteMulti %s", err)
+		}
+	}
+}
@@ -0,0 +1,98 @@
+package nds_test
+
+import (
+	"testing"
+
+	"github.com/qedus/nds"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/memcache"
+)
+
+func TestRegisterDependency(t *testing.T) {
+	c, closeFunc := NewContext(t, nil)
+	defer closeFunc()
+
+	type testEntity struct {
+		Val int
+	}
+
+	source := datastore.NewKey(c, "Source", "", 1, nil)
+	dependent := datastore.NewKey(c, "Dependent", "", 1, nil)
+	indirect := datastore.NewKey(c, "Indirect", "", 1, nil)
+	keys := []*datastore.Key{source, dependent, indirect}
+	if _, err := nds.PutMulti(c, keys,
+		[]testEntity{{1}, {2}, {3}}); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 2; i++ {
+		if err := nds.RegisterDependency(c, dependent, source); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := nds.RegisterDependency(c, indirect, dependent); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := nds.GetMulti(c, keys, make([]testEntity, 3)); err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range keys {
+		if _, err := memcache.Get(c, nds.CreateMemcacheKey(key)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Writing the source evicts its dependents, directly or not.
+	if _, err := nds.Put(c, source, &testEntity{4}); err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range keys {
+		if _, err := memcache.Get(c,
+			nds.CreateMemcacheKey(key)); err != memcache.ErrCacheMiss {
+			t.Fatal("expected cache miss", key, err)
+		}
+	}
+
+	if err := nds.RegisterDependency(c, dependent,
+		nil); err != datastore.ErrInvalidKey {
+		t.Fatal("expected invalid key", err)
+	}
+}
+
+func TestDependencyRegisteredElsewhere(t *testing.T) {
+	c, closeFunc := NewContext(t, nil)
+	defer closeFunc()
+
+	type testEntity struct {
+		Val int
+	}
+
+	source := datastore.NewKey(c, "UnregisteredSource", "", 1, nil)
+	dependent := datastore.NewKey(c, "Dependent", "", 1, nil)
+	keys := []*datastore.Key{source, dependent}
+	if _, err := nds.PutMulti(c, keys,
+		[]testEntity{{1}, {2}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := nds.GetMulti(c, keys, make([]testEntity, 2)); err != nil {
+		t.Fatal(err)
+	}
+
+	// The registry item as another instance would have added it.
+	if err := memcache.Set(c, &memcache.Item{
+		Key:   nds.CreateDependencyMemcacheKey(c, source),
+		Flags: nds.KeyItem,
+		Value: []byte(dependent.Encode()),
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := nds.Put(c, source, &testEntity{3}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := memcache.Get(c,
+		nds.CreateMemcacheKey(dependent)); err != memcache.ErrCacheMiss {
+		t.Fatal("expected cache miss", err)
+	}
+}
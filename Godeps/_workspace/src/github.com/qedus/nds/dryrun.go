@@ -0,0 +1,75 @@
+package nds
+
+import (
+	"sync"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/datastore"
+)
+
+// DryRunOp describes a write that a context returned by WithDryRun skipped.
+type DryRunOp struct {
+	// Op is the NDS operation that was skipped, either "PutMulti" or
+	// "DeleteMulti".
+	Op string
+
+	// Key is the key of the entity that would have been written.
+	Key *datastore.Key
+
+	// MemcacheKey is the cache entry that would have been locked and
+	// invalidated. It is empty for incomplete keys.
+	MemcacheKey string
+}
+
+var dryRunKey = "used for *dryRun"
+
+type dryRun struct {
+	sync.Mutex
+	ops []DryRunOp
+}
+
+// WithDryRun returns a context that makes PutMulti, DeleteMulti and the
+// functions built on them record what they would have done instead of doing
+// it. Neither memcache nor the datastore is written to, as writing the
+// datastore without invalidating the cache would leave stale cached entities.
+// PutMulti returns the keys it was given, so incomplete keys stay incomplete.
+// The skipped writes can be retrieved with DryRunOps.
+func WithDryRun(c context.Context) context.Context {
+	return context.WithValue(c, &dryRunKey, &dryRun{})
+}
+
+// DryRunOps returns the writes skipped so far by operations using c, or a
+// context derived from it, which must have been returned by WithDryRun.
+func DryRunOps(c context.Context) []DryRunOp {
+	dr, ok := c.Value(&dryRunKey).(*dryRun)
+	if !ok {
+		return nil
+	}
+
+	dr.Lock()
+	defer dr.Unlock()
+	return append([]DryRunOp(nil), dr.ops...)
+}
+
+// recordDryRun records op for keys and returns true if c is a dry run.
+func recordDryRun(c context.Context, op string, keys []*datastore.Key) bool {
+	dr, ok := c.Value(&dryRunKey).(*dryRun)
+	if !ok {
+		return false
+	}
+
+	dr.Lock()
+	defer dr.Unlock()
+	for _, key := range keys {
+		memcacheKey := ""
+		if key != nil && !key.Incomplete() {
+			memcacheKey = createMemcacheKey(c, key)
+		}
+		dr.ops = append(dr.ops, DryRunOp{
+			Op:          op,
+			Key:         key,
+			MemcacheKey: memcacheKey,
+		})
+	}
+	return true
+}
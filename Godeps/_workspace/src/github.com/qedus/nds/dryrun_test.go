@@ -0,0 +1,62 @@
+package nds_test
+
+import (
+	"testing"
+
+	"github.com/qedus/nds"
+	"google.golang.org/appengine/datastore"
+)
+
+func TestWithDryRun(t *testing.T) {
+	c, closeFunc := NewContext(t, nil)
+	defer closeFunc()
+
+	type testEntity struct {
+		Val int
+	}
+
+	rc := &recordingCache{}
+	cd := &countingDatastore{}
+	dc := nds.WithDryRun(nds.WithDatastore(nds.WithCache(c, rc), cd))
+
+	keys := []*datastore.Key{
+		datastore.NewKey(c, "Entity", "", 1, nil),
+		datastore.NewIncompleteKey(c, "Entity", nil),
+	}
+	putKeys, err := nds.PutMulti(dc, keys, []testEntity{{1}, {2}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !putKeys[0].Equal(keys[0]) || !putKeys[1].Incomplete() {
+		t.Fatal("expected the given keys", putKeys)
+	}
+	if err := nds.Delete(dc, keys[0]); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(rc.setItems) != 0 || len(rc.delKeys) != 0 {
+		t.Fatal("expected memcache to be untouched")
+	}
+	if cd.puts != 0 || cd.deletes != 0 {
+		t.Fatal("expected the datastore to be untouched")
+	}
+
+	ops := nds.DryRunOps(dc)
+	if len(ops) != 3 {
+		t.Fatal("expected 3 ops", ops)
+	}
+	memcacheKey := nds.CreateMemcacheKey(keys[0])
+	if ops[0].Op != "PutMulti" || ops[0].MemcacheKey != memcacheKey {
+		t.Fatal("incorrect op", ops[0])
+	}
+	if ops[1].Op != "PutMulti" || ops[1].MemcacheKey != "" {
+		t.Fatal("incorrect op", ops[1])
+	}
+	if ops[2].Op != "DeleteMulti" || !ops[2].Key.Equal(keys[0]) {
+		t.Fatal("incorrect op", ops[2])
+	}
+
+	if err := nds.Get(c, keys[0], &testEntity{}); err != datastore.ErrNoSuchEntity {
+		t.Fatal("expected datastore.ErrNoSuchEntity", err)
+	}
+}
@@ -0,0 +1,59 @@
+package nds
+
+import (
+	"errors"
+	"fmt"
+
+	"golang.org/x/net/context"
+)
+
+// ErrTooManyEntityGroups is wrapped by the *TooManyEntityGroupsError returned
+// by PutMulti and DeleteMulti within a transaction, and so by
+// RunInTransaction, when they would take the transaction over its entity group
+// limit.
+var ErrTooManyEntityGroups = errors.New(
+	"nds: transaction would write to too many entity groups")
+
+// TooManyEntityGroupsError reports the entity groups a write would have taken
+// its transaction to and the limit it would have exceeded.
+type TooManyEntityGroupsError struct {
+	// Groups is the number of entity groups the transaction would write to.
+	Groups int
+
+	// Limit is the entity group limit of the transaction.
+	Limit int
+}
+
+func (e *TooManyEntityGroupsError) Error() string {
+	return fmt.Sprintf("%s: %d, more than the %d allowed",
+		ErrTooManyEntityGroups, e.Groups, e.Limit)
+}
+
+// Unwrap returns ErrTooManyEntityGroups.
+func (e *TooManyEntityGroupsError) Unwrap() error {
+	return ErrTooManyEntityGroups
+}
+
+var maxEntityGroupsKey = "used for max entity groups"
+
+// WithMaxEntityGroups returns a context that makes RunInTransaction limit the
+// transactions it runs to writing n entity groups, instead of the datastore
+// limit of one, or 25 for cross group transactions. Writes that would exceed
+// the limit fail with a *TooManyEntityGroupsError before anything is written. A
+// lower limit catches transactions that are growing towards the datastore
+// limit early, while a higher one only moves the failure to the commit. An n
+// of zero or less keeps the datastore limit.
+func WithMaxEntityGroups(c context.Context, n int) context.Context {
+	return context.WithValue(c, &maxEntityGroupsKey, n)
+}
+
+// maxEntityGroups returns the entity group limit of the transactions run with
+// c, which are cross group if xg is set.
+func maxEntityGroups(c context.Context, xg bool) int {
+	if n, _ := c.Value(&maxEntityGroupsKey).(int); n > 0 {
+		return n
+	} else if xg {
+		return maxXGEntityGroups
+	}
+	return 1
+}
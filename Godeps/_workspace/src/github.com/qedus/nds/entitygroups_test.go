@@ -0,0 +1,48 @@
+package nds_test
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/qedus/nds"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/datastore"
+)
+
+func TestWithMaxEntityGroups(t *testing.T) {
+	c, closeFunc := NewContext(t, nil)
+	defer closeFunc()
+
+	type testEntity struct {
+		Val int
+	}
+
+	// Children share the entity group of their root.
+	parent := datastore.NewKey(c, "Parent", "", 1, nil)
+	keys := []*datastore.Key{
+		parent,
+		datastore.NewKey(c, "Entity", "", 1, parent),
+		datastore.NewKey(c, "Entity", "", 2, nil),
+		datastore.NewKey(c, "Entity", "", 3, nil),
+	}
+
+	mc := nds.WithMaxEntityGroups(c, 2)
+	opts := &datastore.TransactionOptions{XG: true}
+	err := nds.RunInTransaction(mc, func(tc context.Context) error {
+		if _, err := nds.PutMulti(tc, keys[:3],
+			make([]testEntity, 3)); err != nil {
+			t.Fatal(err)
+		}
+		return nds.Delete(tc, keys[3])
+	}, opts)
+	if !errors.Is(err, nds.ErrTooManyEntityGroups) {
+		t.Fatal("expected entity group limit error", err)
+	}
+
+	if err := nds.RunInTransaction(mc, func(tc context.Context) error {
+		_, err := nds.PutMulti(tc, keys[:3], make([]testEntity, 3))
+		return err
+	}, opts); err != nil {
+		t.Fatal(err)
+	}
+}
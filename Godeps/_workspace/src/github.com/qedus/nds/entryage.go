@@ -0,0 +1,125 @@
+package nds
+
+import (
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/datastore"
+)
+
+// entryAgeBuckets are the upper bounds of the buckets of the entry age
+// histogram. Older entries are counted in a final unbounded bucket.
+var entryAgeBuckets = [...]time.Duration{
+	time.Second,
+	10 * time.Second,
+	time.Minute,
+	10 * time.Minute,
+	time.Hour,
+	6 * time.Hour,
+	24 * time.Hour,
+	7 * 24 * time.Hour,
+}
+
+var entryAgesKey = "used for entry ages"
+
+// WithEntryAges returns a context that records how long cache entries
+// survive before they are invalidated by a write. Entities cached through it
+// carry the time they were written, as with WithMaxCacheAge, and PutMulti and
+// DeleteMulti read the entries they are about to invalidate to add their ages
+// to a histogram for the process, reported by EntryAges and exported by
+// PublishExpvar and NewCollector.
+//
+// Comparing the ages with the expirations set by WithKindTTL shows whether
+// entries are usually invalidated long before they would expire, in which
+// case a shorter expiration frees cache memory at little cost. Entries that
+// expire or are evicted are not recorded, nor are entries cached without the
+// write time. Without WithEntryAges writes make no extra cache reads.
+func WithEntryAges(c context.Context) context.Context {
+	return context.WithValue(c, &entryAgesKey, true)
+}
+
+func isEntryAges(c context.Context) bool {
+	enabled, _ := c.Value(&entryAgesKey).(bool)
+	return enabled
+}
+
+// EntryAgeHistogram describes the ages of the cache entries recorded when
+// they were invalidated by a write through a context using WithEntryAges.
+type EntryAgeHistogram struct {
+	// Buckets are the upper bounds of the buckets, in increasing order.
+	Buckets []time.Duration
+
+	// Counts are the number of entries in each bucket, that is with ages
+	// above the previous bound and up to the bucket's own. It has a final
+	// element for entries older than the last bound.
+	Counts []int64
+
+	// Count is the total number of entries recorded.
+	Count int64
+
+	// Sum is the total age of the entries recorded.
+	Sum time.Duration
+}
+
+// entryAges is the entry age histogram of the process.
+var entryAges struct {
+	counts [len(entryAgeBuckets) + 1]int64
+	sum    int64
+}
+
+// EntryAges returns the entry age histogram of the process.
+func EntryAges() EntryAgeHistogram {
+	h := EntryAgeHistogram{
+		Buckets: append([]time.Duration(nil), entryAgeBuckets[:]...),
+		Counts:  make([]int64, len(entryAges.counts)),
+		Sum:     time.Duration(atomic.LoadInt64(&entryAges.sum)),
+	}
+	for i := range h.Counts {
+		h.Counts[i] = atomic.LoadInt64(&entryAges.counts[i])
+		h.Count += h.Counts[i]
+	}
+	return h
+}
+
+// observeEntryAge adds age to the entry age histogram of the process.
+func observeEntryAge(age time.Duration) {
+	if age < 0 {
+		age = 0
+	}
+	i := 0
+	for i < len(entryAgeBuckets) && age > entryAgeBuckets[i] {
+		i++
+	}
+	atomic.AddInt64(&entryAges.counts[i], 1)
+	atomic.AddInt64(&entryAges.sum, int64(age))
+}
+
+// recordEntryAges records the ages of the cached entities for keys, which a
+// write is about to lock, if c uses WithEntryAges. Only the first replica of
+// each entity is read.
+func recordEntryAges(c context.Context, keys []*datastore.Key) {
+	if !isEntryAges(c) || len(keys) == 0 {
+		return
+	}
+
+	memcacheKeys := make([]string, len(keys))
+	for i, key := range keys {
+		memcacheKeys[i] = createMemcacheKey(c, key)
+	}
+	cached, err := cacheFromContext(c).GetMulti(c, memcacheKeys)
+	if err != nil {
+		warningf(c, "nds:recordEntryAges GetMulti %s", err)
+		return
+	}
+
+	now := timeNow()
+	for _, item := range cached {
+		if itemType(item.Flags) != entityItem {
+			continue
+		}
+		if header, _ := splitItemHeader(item); !header.written.IsZero() {
+			observeEntryAge(now.Sub(header.written))
+		}
+	}
+}
@@ -0,0 +1,65 @@
+package nds_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/qedus/nds"
+	"google.golang.org/appengine/datastore"
+)
+
+func TestWithEntryAges(t *testing.T) {
+	c, closeFunc := NewContext(t, nil)
+	defer closeFunc()
+
+	type testEntity struct {
+		Val int
+	}
+
+	now := time.Now()
+	nds.SetTimeNow(func() time.Time { return now })
+	defer nds.SetTimeNow(time.Now)
+
+	ec := nds.WithEntryAges(c)
+	key := datastore.NewKey(c, "Entity", "", 1, nil)
+	if _, err := nds.Put(ec, key, &testEntity{1}); err != nil {
+		t.Fatal(err)
+	}
+	if err := nds.Get(ec, key, &testEntity{}); err != nil {
+		t.Fatal(err)
+	}
+	before := nds.EntryAges()
+
+	// Writes without WithEntryAges record nothing.
+	if _, err := nds.Put(c, key, &testEntity{2}); err != nil {
+		t.Fatal(err)
+	}
+	if h := nds.EntryAges(); h.Count != before.Count {
+		t.Fatal("expected no entry age to be recorded", h.Count)
+	}
+
+	// An entry cached 90 seconds before a write is counted as up to ten
+	// minutes old.
+	if err := nds.Get(ec, key, &testEntity{}); err != nil {
+		t.Fatal(err)
+	}
+	now = now.Add(90 * time.Second)
+	if err := nds.Delete(ec, key); err != nil {
+		t.Fatal(err)
+	}
+
+	h := nds.EntryAges()
+	if h.Count != before.Count+1 {
+		t.Fatal("expected one entry age to be recorded", h.Count)
+	}
+	if h.Sum-before.Sum != 90*time.Second {
+		t.Fatal("incorrect age", h.Sum-before.Sum)
+	}
+	for i, bound := range h.Buckets {
+		n := h.Counts[i] - before.Counts[i]
+		if bound == 10*time.Minute && n != 1 || bound != 10*time.Minute &&
+			n != 0 {
+			t.Fatal("incorrect bucket count", bound, n)
+		}
+	}
+}
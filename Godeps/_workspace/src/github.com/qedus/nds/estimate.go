@@ -0,0 +1,86 @@
+package nds
+
+import (
+	"golang.org/x/net/context"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+)
+
+// EstimateCacheSize reads the entities for keys from the datastore and
+// returns the size in bytes of the cache item value each would be cached with,
+// along with their total, without reading or writing the cache. Entities are
+// serialized exactly as GetMulti would cache them through c, with its codec,
+// compression and item headers, except that fields tagged nds:"nocache" are
+// included as the entity types are not known. Missing entities are cached as
+// empty items so have a size of zero.
+//
+// This is intended for estimating the cache footprint of a kind before caching
+// it. Sizes above the memcache limit, or the limit set by WithMaxItemSize, are
+// of entities that would never be cached but are still included in the total.
+// Errors reading or serializing individual entities are returned in a
+// appengine.MultiError and leave their sizes at zero.
+func EstimateCacheSize(c context.Context,
+	keys []*datastore.Key) (int, []int, error) {
+
+	physicalKeys := keys
+	if f, ok := keyMapperFromContext(c); ok {
+		var err error
+		if physicalKeys, err = mapKeys(keys, f); err != nil {
+			return 0, nil, err
+		}
+	}
+
+	sizes := make([]int, len(keys))
+	err := runBatches(c, len(keys), batchSize(c, getMultiLimit),
+		func(lo, hi int) error {
+			return estimateMulti(c, physicalKeys[lo:hi], sizes[lo:hi])
+		})
+	if _, ok := err.(appengine.MultiError); err != nil && !ok {
+		return 0, nil, err
+	}
+
+	total := 0
+	for _, size := range sizes {
+		total += size
+	}
+	return total, sizes, err
+}
+
+func estimateMulti(c context.Context, keys []*datastore.Key,
+	sizes []int) error {
+
+	pls := make([]datastore.PropertyList, len(keys))
+	err := getDatastore(c, keys, pls)
+	me, ok := err.(appengine.MultiError)
+	if err != nil && !ok {
+		return err
+	}
+
+	errs, errsNil := make(appengine.MultiError, len(keys)), true
+	for i, key := range keys {
+		if me != nil && me[i] != nil {
+			if me[i] != datastore.ErrNoSuchEntity {
+				errs[i] = me[i]
+				errsNil = false
+			}
+			continue
+		}
+
+		pl := pls[i]
+		sortProperties(pl)
+		data, flags, err := encodeEntityItem(c, key, codecFor(c, key), pl)
+		if err != nil {
+			errs[i] = err
+			errsNil = false
+			continue
+		}
+		data, _ = newItemHeader(c, key, entityExpiration(c, key)).add(data,
+			flags)
+		sizes[i] = len(data)
+	}
+
+	if errsNil {
+		return nil
+	}
+	return errs
+}
@@ -0,0 +1,75 @@
+package nds_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/qedus/nds"
+	"google.golang.org/appengine/datastore"
+)
+
+func TestEstimateCacheSize(t *testing.T) {
+	c, closeFunc := NewContext(t, nil)
+	defer closeFunc()
+
+	type testEntity struct {
+		Val string
+	}
+
+	keys := []*datastore.Key{
+		datastore.NewKey(c, "Entity", "", 1, nil),
+		datastore.NewKey(c, "Entity", "", 2, nil),
+		datastore.NewKey(c, "Entity", "", 3, nil),
+	}
+	if _, err := datastore.PutMulti(c, keys[:2], []testEntity{
+		{"small"}, {strings.Repeat("large", 1000)},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	total, sizes, err := nds.EstimateCacheSize(nds.WithMaxBatchSize(c, 2),
+		keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sizes[0] == 0 || sizes[1] <= sizes[0] || sizes[2] != 0 {
+		t.Fatal("incorrect sizes", sizes)
+	}
+	if total != sizes[0]+sizes[1] {
+		t.Fatal("incorrect total", total)
+	}
+
+	// Nothing was cached.
+	entries, err := nds.InspectCache(c, keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, entry := range entries {
+		if entry.Present {
+			t.Fatal("expected no cache item", entry)
+		}
+	}
+
+	// The estimates match the items GetMulti caches.
+	if err := nds.GetMulti(c, keys[:2],
+		make([]testEntity, 2)); err != nil {
+		t.Fatal(err)
+	}
+	if entries, err = nds.InspectCache(c, keys[:2]); err != nil {
+		t.Fatal(err)
+	}
+	for i, entry := range entries {
+		if entry.Size != sizes[i] {
+			t.Fatal("incorrect estimate", i, sizes[i], entry.Size)
+		}
+	}
+
+	// Compression is estimated too.
+	_, compressed, err := nds.EstimateCacheSize(
+		nds.WithCompression(c, 100), keys[1:2])
+	if err != nil {
+		t.Fatal(err)
+	} else if compressed[0] >= sizes[1] {
+		t.Fatal("expected smaller compressed size", compressed[0])
+	}
+}
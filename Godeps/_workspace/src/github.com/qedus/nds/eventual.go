@@ -0,0 +1,100 @@
+package nds
+
+import (
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/datastore"
+)
+
+// EventualGetter is implemented by a DatastoreClient that can read entities
+// with the eventual consistency read policy. GetMultiEventual must behave like
+// GetMulti except that it may return entities as they were before recent
+// writes.
+type EventualGetter interface {
+	GetMultiEventual(c context.Context, keys []*datastore.Key,
+		vals interface{}) error
+}
+
+var eventualConsistencyKey = "used for eventual consistency"
+
+// WithEventualConsistency returns a context that makes GetMulti read entities
+// that are not cached with the eventual consistency read policy, trading
+// freshness for lower latency and cost. Entities read this way can be missing
+// recent writes so they are never cached, and cache entries are not locked
+// for them, leaving the cache as consistent as before. Cached entities are
+// returned as usual.
+//
+// The read policy is only used when the DatastoreClient set with
+// WithDatastore implements EventualGetter. The App Engine datastore package
+// does not expose a read policy for gets, so by default the option has no
+// effect and entities are read strongly consistently and cached as usual.
+// Within a transaction the option is ignored.
+func WithEventualConsistency(c context.Context) context.Context {
+	return context.WithValue(c, &eventualConsistencyKey, true)
+}
+
+// isEventualConsistency reports whether entities that are not cached are read
+// from the DatastoreClient of c with the eventual consistency read policy.
+func isEventualConsistency(c context.Context) bool {
+	eventual, _ := c.Value(&eventualConsistencyKey).(bool)
+	if !eventual {
+		return false
+	}
+	if _, inTx := transactionFromContext(c); inTx {
+		return false
+	}
+	_, ok := datastoreFromContext(c).(EventualGetter)
+	return ok
+}
+
+// ReadPolicy is the read consistency GetMultiWithReadPolicy reads entities
+// that are not cached with.
+type ReadPolicy int
+
+const (
+	// Strong reads entities with the strong consistency read policy, so
+	// they always include the latest writes, and caches them.
+	Strong ReadPolicy = iota
+
+	// Eventual reads entities with the eventual consistency read policy, as
+	// WithEventualConsistency does.
+	Eventual
+)
+
+// GetMultiWithReadPolicy works just like GetMulti except that entities that
+// are not cached are read with policy, whatever WithEventualConsistency
+// selected for c. This allows individual calls that need the latest writes to
+// read strongly consistently through a context that reads eventually
+// consistently by default, and the reverse. Within a transaction entities are
+// always read strongly consistently.
+func GetMultiWithReadPolicy(c context.Context, keys []*datastore.Key,
+	vals interface{}, policy ReadPolicy) error {
+
+	return GetMulti(context.WithValue(c, &eventualConsistencyKey,
+		policy == Eventual), keys, vals)
+}
+
+// datastoreGetMultiFor gets entities from the DatastoreClient of c, using the
+// eventual consistency read policy if it is selected and supported, and then
+// any missing from the secondary datastore of c.
+func datastoreGetMultiFor(c context.Context, keys []*datastore.Key,
+	vals interface{}) error {
+
+	client := datastoreFromContext(c)
+	var err error
+	if isEventualConsistency(c) {
+		err = client.(EventualGetter).GetMultiEventual(c, keys, vals)
+	} else {
+		err = client.GetMulti(c, keys, vals)
+	}
+	return getSecondary(c, keys, vals, checkMultiError(err, len(keys)))
+}
+
+// skipLocks marks the cache misses of cacheItems as externally locked so they
+// are read from the datastore without being cached.
+func skipLocks(cacheItems []cacheItem) {
+	for i, cacheItem := range cacheItems {
+		if cacheItem.state == miss {
+			cacheItems[i].state = externalLock
+		}
+	}
+}
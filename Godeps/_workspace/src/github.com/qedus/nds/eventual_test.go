@@ -0,0 +1,155 @@
+package nds_test
+
+import (
+	"testing"
+
+	"github.com/qedus/nds"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/datastore"
+)
+
+// eventualDatastore is a countingDatastore that counts eventually consistent
+// reads.
+type eventualDatastore struct {
+	countingDatastore
+	eventualGets int
+}
+
+func (ed *eventualDatastore) GetMultiEventual(c context.Context,
+	keys []*datastore.Key, vals interface{}) error {
+	ed.eventualGets++
+	return datastore.GetMulti(c, keys, vals)
+}
+
+func TestWithEventualConsistency(t *testing.T) {
+	c, closeFunc := NewContext(t, nil)
+	defer closeFunc()
+
+	type testEntity struct {
+		Val int
+	}
+
+	key := datastore.NewKey(c, "Entity", "", 1, nil)
+	if _, err := nds.Put(c, key, &testEntity{1}); err != nil {
+		t.Fatal(err)
+	}
+
+	ed := &eventualDatastore{}
+	rc := &recordingCache{}
+	dc := nds.WithCache(nds.WithDatastore(c, ed), rc)
+	ec := nds.WithEventualConsistency(dc)
+
+	te := &testEntity{}
+	if err := nds.Get(ec, key, te); err != nil {
+		t.Fatal(err)
+	} else if te.Val != 1 {
+		t.Fatal("incorrect val", te.Val)
+	}
+	if ed.eventualGets != 1 || ed.gets != 0 {
+		t.Fatal("expected an eventual read", ed.eventualGets, ed.gets)
+	}
+	if len(rc.addItems) != 0 || len(rc.casItems) != 0 {
+		t.Fatal("expected nothing to be cached")
+	}
+
+	// Cached entities are still used.
+	if err := nds.Get(dc, key, &testEntity{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := nds.Get(ec, key, &testEntity{}); err != nil {
+		t.Fatal(err)
+	}
+	if ed.eventualGets != 1 || ed.gets != 1 {
+		t.Fatal("expected a cached read", ed.eventualGets, ed.gets)
+	}
+
+	// Transactions always read strongly.
+	if err := nds.RunInTransaction(ec, func(tc context.Context) error {
+		return nds.Get(tc, key, &testEntity{})
+	}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if ed.eventualGets != 1 {
+		t.Fatal("expected a strong read in the transaction", ed.eventualGets)
+	}
+}
+
+func TestWithEventualConsistencyUnsupported(t *testing.T) {
+	c, closeFunc := NewContext(t, nil)
+	defer closeFunc()
+
+	type testEntity struct {
+		Val int
+	}
+
+	key := datastore.NewKey(c, "Entity", "", 1, nil)
+	if _, err := nds.Put(c, key, &testEntity{1}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Strongly consistent reads are cached as usual.
+	rc := &recordingCache{}
+	ec := nds.WithEventualConsistency(nds.WithCache(c, rc))
+	if err := nds.Get(ec, key, &testEntity{}); err != nil {
+		t.Fatal(err)
+	}
+	if len(rc.casItems) != 1 {
+		t.Fatal("expected the entity to be cached", len(rc.casItems))
+	}
+}
+
+func TestGetMultiWithReadPolicy(t *testing.T) {
+	c, closeFunc := NewContext(t, nil)
+	defer closeFunc()
+
+	type testEntity struct {
+		Val int
+	}
+
+	keys := []*datastore.Key{
+		datastore.NewKey(c, "Entity", "", 1, nil),
+		datastore.NewKey(c, "Entity", "", 2, nil),
+		datastore.NewKey(c, "Entity", "", 3, nil),
+	}
+	if _, err := nds.PutMulti(c, keys,
+		[]testEntity{{1}, {2}, {3}}); err != nil {
+		t.Fatal(err)
+	}
+
+	ed := &eventualDatastore{}
+	dc := nds.WithDatastore(c, ed)
+	ec := nds.WithEventualConsistency(dc)
+
+	// Strong reads override an eventual default.
+	vals := make([]testEntity, 1)
+	if err := nds.GetMultiWithReadPolicy(ec, keys[:1], vals,
+		nds.Strong); err != nil {
+		t.Fatal(err)
+	} else if vals[0].Val != 1 {
+		t.Fatal("incorrect val", vals[0].Val)
+	}
+	if ed.gets != 1 || ed.eventualGets != 0 {
+		t.Fatal("expected a strong read", ed.gets, ed.eventualGets)
+	}
+
+	// Eventual reads override a strong default.
+	if err := nds.GetMultiWithReadPolicy(dc, keys[1:2], vals,
+		nds.Eventual); err != nil {
+		t.Fatal(err)
+	} else if vals[0].Val != 2 {
+		t.Fatal("incorrect val", vals[0].Val)
+	}
+	if ed.gets != 1 || ed.eventualGets != 1 {
+		t.Fatal("expected an eventual read", ed.gets, ed.eventualGets)
+	}
+
+	// Transactions always read strongly.
+	if err := nds.RunInTransaction(dc, func(tc context.Context) error {
+		return nds.GetMultiWithReadPolicy(tc, keys[2:], vals, nds.Eventual)
+	}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if ed.eventualGets != 1 {
+		t.Fatal("expected a strong read in the transaction", ed.eventualGets)
+	}
+}
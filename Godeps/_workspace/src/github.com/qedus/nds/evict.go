@@ -0,0 +1,52 @@
+package nds
+
+import (
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/datastore"
+)
+
+// EvictDescendants removes the cached entities of ancestor and all its
+// descendants from memcache without touching the datastore. This is useful
+// after modifying entities directly with the datastore package, such as
+// during a data migration, without flushing all of memcache.
+//
+// Memcache cannot list keys so the descendants are found using a keys only
+// ancestor query. Entities created after the query starts are not evicted.
+func EvictDescendants(c context.Context, ancestor *datastore.Key) error {
+	if err := checkCacheKeyPrefix(c); err != nil {
+		return err
+	}
+
+	size := batchSize(c, deleteMultiLimit)
+	memcacheKeys := make([]string, 0, size)
+	flush := func() error {
+		if len(memcacheKeys) == 0 {
+			return nil
+		}
+		evictLocalCache(c, memcacheKeys)
+		err := cacheFromContext(c).DeleteMulti(c, memcacheKeys)
+		memcacheKeys = memcacheKeys[:0]
+		if err != nil && !isCacheMissErrors(err) {
+			return err
+		}
+		return nil
+	}
+
+	q := datastore.NewQuery("").Ancestor(ancestor).KeysOnly()
+	for t := q.Run(c); ; {
+		key, err := t.Next(nil)
+		if err == datastore.Done {
+			break
+		} else if err != nil {
+			return err
+		}
+
+		memcacheKeys = append(memcacheKeys, writeMemcacheKeys(c, key)...)
+		if len(memcacheKeys) >= size {
+			if err := flush(); err != nil {
+				return err
+			}
+		}
+	}
+	return flush()
+}
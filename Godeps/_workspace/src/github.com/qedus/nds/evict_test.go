@@ -0,0 +1,52 @@
+package nds_test
+
+import (
+	"testing"
+
+	"github.com/qedus/nds"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/memcache"
+)
+
+func TestEvictDescendants(t *testing.T) {
+	c, closeFunc := NewContext(t, nil)
+	defer closeFunc()
+
+	type testEntity struct {
+		Val int
+	}
+
+	parent := datastore.NewKey(c, "Parent", "", 1, nil)
+	other := datastore.NewKey(c, "Parent", "", 2, nil)
+	keys := []*datastore.Key{
+		parent,
+		datastore.NewKey(c, "Child", "", 1, parent),
+		datastore.NewKey(c, "Child", "", 2, parent),
+		other,
+	}
+	entities := []testEntity{{1}, {2}, {3}, {4}}
+	if _, err := nds.PutMulti(c, keys, entities); err != nil {
+		t.Fatal(err)
+	}
+
+	// Prime the cache.
+	if err := nds.GetMulti(c, keys, make([]testEntity, len(keys))); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := nds.EvictDescendants(nds.WithMaxBatchSize(c, 2),
+		parent); err != nil {
+		t.Fatal(err)
+	}
+
+	for i, key := range keys {
+		_, err := memcache.Get(c, nds.CreateMemcacheKey(key))
+		if key.Equal(other) {
+			if err != nil {
+				t.Fatal("expected unrelated entity to stay cached", err)
+			}
+		} else if err != memcache.ErrCacheMiss {
+			t.Fatal("expected entity to be evicted", i, err)
+		}
+	}
+}
@@ -0,0 +1,221 @@
+package nds
+
+import (
+	"sync"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+)
+
+// existsMultiLimit is the maximum number of keys ExistsMulti checks at once.
+const existsMultiLimit = 500
+
+// ExistenceChecker is implemented by a DatastoreClient that can report whether
+// entities exist without loading them. ExistsMulti must return whether an
+// entity exists for each of keys, reporting errors for individual keys with an
+// appengine.MultiError as GetMulti does.
+type ExistenceChecker interface {
+	ExistsMulti(c context.Context, keys []*datastore.Key) ([]bool, error)
+}
+
+// ExistsMulti reports whether an entity exists for each of keys without
+// loading the entities. Entities that are cached, or cached as missing, are
+// answered from the cache. The rest are checked with a keys-only query per key
+// so entity bodies are never read from the datastore, running at most
+// WithConcurrency queries at once. Invalid keys report datastore.ErrInvalidKey
+// within an appengine.MultiError.
+//
+// If the DatastoreClient set with WithDatastore implements ExistenceChecker
+// its ExistsMulti is used instead of the queries. Other clients cannot be
+// queried, so the entities are got with their GetMulti.
+//
+// Within a transaction entities written by the transaction are answered as
+// they were written and the cache is not consulted.
+func ExistsMulti(c context.Context,
+	keys []*datastore.Key) ([]bool, error) {
+
+	if err := checkCacheKeyPrefix(c); err != nil {
+		return nil, err
+	}
+
+	if f, ok := keyMapperFromContext(c); ok {
+		physicalKeys, err := mapKeys(keys, f)
+		if err != nil {
+			return nil, err
+		}
+		keys = physicalKeys
+	}
+
+	exists := make([]bool, len(keys))
+	if len(keys) == 0 {
+		return exists, nil
+	}
+	err := runBatches(c, len(keys), batchSize(c, existsMultiLimit),
+		func(lo, hi int) error {
+			return existsMulti(c, keys[lo:hi], exists[lo:hi])
+		})
+	return exists, err
+}
+
+func existsMulti(c context.Context, keys []*datastore.Key,
+	exists []bool) error {
+
+	errs := make(appengine.MultiError, len(keys))
+	resolved := make([]bool, len(keys))
+	for i, key := range keys {
+		if key == nil || key.Incomplete() {
+			errs[i] = datastore.ErrInvalidKey
+			resolved[i] = true
+		}
+	}
+
+	if tx, ok := transactionFromContext(c); ok {
+		tx.Lock()
+		for i, key := range keys {
+			if resolved[i] {
+				continue
+			}
+			if pl, ok := tx.entities[createMemcacheKey(c, key)]; ok {
+				exists[i], resolved[i] = pl != nil, true
+			}
+		}
+		tx.Unlock()
+	} else if !isNoCache(c) {
+		memcacheKeys := make([]string, 0, len(keys))
+		for i, key := range keys {
+			if !resolved[i] {
+				memcacheKeys = append(memcacheKeys, createMemcacheKey(c, key))
+			}
+		}
+		items, err := cacheFromContext(c).GetMulti(c, memcacheKeys)
+		if err != nil {
+			items = nil
+			warningf(c, "nds:existsMulti GetMulti %s", err)
+		}
+		for i, key := range keys {
+			if resolved[i] {
+				continue
+			}
+			item, ok := items[createMemcacheKey(c, key)]
+			if !ok {
+				continue
+			}
+			switch itemType(item.Flags) {
+			case entityItem:
+				exists[i], resolved[i] = true, true
+			case noneItem, tombstoneItem:
+				resolved[i] = true
+			}
+		}
+	}
+
+	var indexes []int
+	var unresolved []*datastore.Key
+	for i, key := range keys {
+		if !resolved[i] {
+			indexes = append(indexes, i)
+			unresolved = append(unresolved, key)
+		}
+	}
+	found, foundErrs := datastoreExistsMulti(c, unresolved)
+	for i, index := range indexes {
+		exists[index], errs[index] = found[i], foundErrs[i]
+	}
+
+	for _, err := range errs {
+		if err != nil {
+			return errs
+		}
+	}
+	return nil
+}
+
+// datastoreExistsMulti reports whether an entity exists for each of keys, and
+// any error checking it, using the DatastoreClient of c.
+func datastoreExistsMulti(c context.Context,
+	keys []*datastore.Key) ([]bool, []error) {
+
+	exists := make([]bool, len(keys))
+	errs := make([]error, len(keys))
+	if len(keys) == 0 {
+		return exists, errs
+	}
+
+	switch client := datastoreFromContext(c).(type) {
+	case appengineDatastore:
+		var sem chan struct{}
+		if n := concurrency(c); n > 0 {
+			sem = make(chan struct{}, n)
+		}
+		wg := sync.WaitGroup{}
+		for i := range keys {
+			wg.Add(1)
+			if sem != nil {
+				sem <- struct{}{}
+			}
+			go func(i int) {
+				exists[i], errs[i] = keyExists(c, keys[i])
+				if sem != nil {
+					<-sem
+				}
+				wg.Done()
+			}(i)
+		}
+		wg.Wait()
+	case ExistenceChecker:
+		sc, endSpan := startSpan(c, "datastore", "ExistsMulti", len(keys))
+		found, err := client.ExistsMulti(sc, keys)
+		endSpan(err)
+		spreadExistsError(err, errs)
+		if len(found) == len(keys) {
+			copy(exists, found)
+		}
+	default:
+		pls := make([]datastore.PropertyList, len(keys))
+		sc, endSpan := startSpan(c, "datastore", "datastore.GetMulti",
+			len(keys))
+		err := client.GetMulti(sc, keys, pls)
+		endSpan(err)
+		spreadExistsError(err, errs)
+		for i, err := range errs {
+			if err == datastore.ErrNoSuchEntity {
+				errs[i] = nil
+			} else if err == nil {
+				exists[i] = true
+			}
+		}
+	}
+	return exists, errs
+}
+
+// spreadExistsError sets errs to the error for each key reported by err.
+func spreadExistsError(err error, errs []error) {
+	if me, ok := err.(appengine.MultiError); ok && len(me) == len(errs) {
+		copy(errs, me)
+	} else if err != nil {
+		for i := range errs {
+			errs[i] = err
+		}
+	}
+}
+
+// keyExists reports whether an entity exists for key with a keys-only query.
+// The query is an ancestor query so it is strongly consistent and can be run
+// within a transaction.
+func keyExists(c context.Context, key *datastore.Key) (bool, error) {
+	q := datastore.NewQuery(key.Kind()).Ancestor(key).
+		Filter("__key__ =", key).KeysOnly().Limit(1)
+
+	sc, endSpan := startSpan(c, "datastore", "datastore.Run", 1)
+	_, err := q.Run(sc).Next(nil)
+	endSpan(err)
+	switch err {
+	case nil:
+		return true, nil
+	case datastore.Done:
+		return false, nil
+	default:
+		return false, err
+	}
+}
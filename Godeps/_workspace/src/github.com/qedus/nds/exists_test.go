@@ -0,0 +1,109 @@
+package nds_test
+
+import (
+	"testing"
+
+	"github.com/qedus/nds"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+)
+
+// queryingDatastore is a countingDatastore that checks whether entities exist
+// with a keys-only query per key, counting the queries.
+type queryingDatastore struct {
+	countingDatastore
+	queries int
+}
+
+func (qd *queryingDatastore) ExistsMulti(c context.Context,
+	keys []*datastore.Key) ([]bool, error) {
+	exists := make([]bool, len(keys))
+	for i, key := range keys {
+		qd.queries++
+		keys, err := datastore.NewQuery(key.Kind()).Ancestor(key).
+			Filter("__key__ =", key).KeysOnly().GetAll(c, nil)
+		if err != nil {
+			return nil, err
+		}
+		exists[i] = len(keys) > 0
+	}
+	return exists, nil
+}
+
+func TestExistsMulti(t *testing.T) {
+	c, closeFunc := NewContext(t, nil)
+	defer closeFunc()
+
+	type testEntity struct {
+		Val int
+	}
+
+	keys := []*datastore.Key{
+		datastore.NewKey(c, "Entity", "", 1, nil),
+		datastore.NewKey(c, "Entity", "", 2, nil),
+		datastore.NewKey(c, "Entity", "", 3, nil),
+		datastore.NewKey(c, "Entity", "", 4, nil),
+	}
+	if _, err := nds.PutMulti(c, []*datastore.Key{keys[0], keys[2]},
+		[]testEntity{{1}, {3}}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Cache the first and second entities so only the rest are queried.
+	if _, err := nds.Warm(c, keys[:2]); err != nil {
+		t.Fatal(err)
+	}
+
+	qd := &queryingDatastore{}
+	exists, err := nds.ExistsMulti(nds.WithDatastore(c, qd), keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !exists[0] || exists[1] || !exists[2] || exists[3] {
+		t.Fatal("incorrect exists", exists)
+	}
+	if qd.queries != 2 || qd.gets != 0 {
+		t.Fatal("expected only uncached keys to be queried", qd.queries,
+			qd.gets)
+	}
+
+	// Clients that cannot check existence are got from instead.
+	cd := &countingDatastore{}
+	exists, err = nds.ExistsMulti(nds.WithDatastore(c, cd), keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !exists[0] || exists[1] || !exists[2] || exists[3] {
+		t.Fatal("incorrect exists", exists)
+	}
+	if cd.gets != 1 {
+		t.Fatal("expected uncached keys to be got at once", cd.gets)
+	}
+
+	// Invalid keys are reported.
+	exists, err = nds.ExistsMulti(c, []*datastore.Key{keys[0],
+		datastore.NewIncompleteKey(c, "Entity", nil)})
+	if me, ok := err.(appengine.MultiError); !ok {
+		t.Fatal("expected appengine.MultiError", err)
+	} else if me[0] != nil || me[1] != datastore.ErrInvalidKey {
+		t.Fatal("incorrect errors", me)
+	}
+	if !exists[0] || exists[1] {
+		t.Fatal("incorrect exists", exists)
+	}
+
+	// Writes within a transaction are seen.
+	if err := nds.RunInTransaction(c, func(tc context.Context) error {
+		if err := nds.Delete(tc, keys[0]); err != nil {
+			return err
+		}
+		exists, err := nds.ExistsMulti(tc, keys[:1])
+		if err == nil && exists[0] {
+			t.Fatal("expected deleted entity not to exist")
+		}
+		return err
+	}, nil); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,60 @@
+package nds
+
+import (
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/datastore"
+)
+
+// GetMultiWithExpiry works just like GetMulti except that it also returns how
+// long the cache entry each entity was served from has left before it
+// expires. This allows callers to build their own cache policies, such as
+// revalidating entities that are close to expiring, on top of the
+// expirations set with WithKindTTL.
+//
+// Entries that never expire report zero, as do entities served from the
+// process and local caches or from WithPreloaded, whose entries carry no
+// expiry. Entities read from the datastore report a negative duration as they
+// have no expiry information, as do missing entities and entries served after
+// they expired. If GetMulti returns an error other than a
+// appengine.MultiError no durations are returned.
+func GetMultiWithExpiry(c context.Context,
+	keys []*datastore.Key, vals interface{}) ([]time.Duration, error) {
+
+	sr := &sourceRecorder{
+		hits:     map[string]bool{},
+		expiries: map[string]time.Time{},
+	}
+	c = context.WithValue(c, &sourceKey, sr)
+	sources, err := sr.sources(c, keys, GetMulti(c, keys, vals))
+	if sources == nil && err != nil {
+		return nil, err
+	}
+
+	physicalKeys := keys
+	if f, ok := keyMapperFromContext(c); ok {
+		var mapErr error
+		if physicalKeys, mapErr = mapKeys(keys, f); mapErr != nil {
+			return nil, mapErr
+		}
+	}
+
+	now := timeNow()
+	remaining := make([]time.Duration, len(keys))
+	for i, key := range physicalKeys {
+		if sources[i] != CacheHit {
+			remaining[i] = -1
+			continue
+		}
+		expiry := sr.expiries[createMemcacheKey(c, key)]
+		if expiry.IsZero() {
+			continue
+		}
+		// Zero is left for entries that never expire.
+		if remaining[i] = expiry.Sub(now); remaining[i] == 0 {
+			remaining[i] = -1
+		}
+	}
+	return remaining, err
+}
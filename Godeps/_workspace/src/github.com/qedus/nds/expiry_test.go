@@ -0,0 +1,68 @@
+package nds_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/qedus/nds"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+)
+
+func TestGetMultiWithExpiry(t *testing.T) {
+	c, closeFunc := NewContext(t, nil)
+	defer closeFunc()
+
+	type testEntity struct {
+		Val int
+	}
+
+	now := time.Now()
+	nds.SetTimeNow(func() time.Time { return now })
+	defer nds.SetTimeNow(time.Now)
+
+	kc := nds.WithKindTTL(c, map[string]time.Duration{"Expiring": time.Hour})
+	keys := []*datastore.Key{
+		datastore.NewKey(c, "Expiring", "", 1, nil),
+		datastore.NewKey(c, "Entity", "", 1, nil),
+		datastore.NewKey(c, "Expiring", "", 2, nil),
+	}
+	if _, err := nds.PutMulti(c, keys[:2],
+		[]testEntity{{1}, {2}}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Entities read from the datastore have no expiry information.
+	remaining, err := nds.GetMultiWithExpiry(kc, keys,
+		make([]testEntity, len(keys)))
+	if me, ok := err.(appengine.MultiError); !ok ||
+		me[2] != datastore.ErrNoSuchEntity {
+		t.Fatal("expected missing entity", err)
+	}
+	for i, d := range remaining {
+		if d >= 0 {
+			t.Fatal("expected negative duration", i, d)
+		}
+	}
+
+	now = now.Add(10 * time.Minute)
+	entities := make([]testEntity, len(keys))
+	remaining, err = nds.GetMultiWithExpiry(kc, keys, entities)
+	if me, ok := err.(appengine.MultiError); !ok ||
+		me[2] != datastore.ErrNoSuchEntity {
+		t.Fatal("expected missing entity", err)
+	}
+	if remaining[0] != 50*time.Minute {
+		t.Fatal("incorrect remaining expiration", remaining[0])
+	}
+	if remaining[1] != 0 {
+		t.Fatal("expected no expiration", remaining[1])
+	}
+	if remaining[2] >= 0 {
+		t.Fatal("expected negative duration for missing entity",
+			remaining[2])
+	}
+	if entities[0].Val != 1 || entities[1].Val != 2 {
+		t.Fatal("incorrect entities", entities)
+	}
+}
@@ -2,6 +2,8 @@ package nds
 
 import (
 	"reflect"
+	"sync/atomic"
+	"time"
 
 	"golang.org/x/net/context"
 	"google.golang.org/appengine/datastore"
@@ -11,11 +13,25 @@ import (
 var (
 	MarshalPropertyList   = marshalPropertyList
 	UnmarshalPropertyList = unmarshalPropertyList
+	GobCodec              = Codec(gobCodec{})
 
 	NoneItem   = noneItem
 	EntityItem = entityItem
+	LockItem   = lockItem
+	KeyItem    = keyItem
+
+	UnknownItem = unknownItem
+
+	CompressedFlag      = compressedFlag
+	FieldCompressedFlag = fieldCompressedFlag
+	WrittenFlag         = writtenFlag
+	KindFlag            = kindFlag
+
+	ItemType = itemType
 
 	MemcacheMaxKeySize = memcacheMaxKeySize
+
+	CreateDependencyMemcacheKey = createDependencyMemcacheKey
 )
 
 func SetMemcacheAddMulti(f func(c context.Context,
@@ -65,5 +81,24 @@ func SetValue(val reflect.Value, pl datastore.PropertyList) error {
 }
 
 func CreateMemcacheKey(key *datastore.Key) string {
-	return createMemcacheKey(key)
+	return createMemcacheKey(context.Background(), key)
+}
+
+func SetDatastoreDeleteMulti(f func(c context.Context,
+	keys []*datastore.Key) error) {
+	datastoreDeleteMulti = f
+}
+
+func SetDatastoreAllocateIDs(f func(c context.Context, kind string,
+	parent *datastore.Key, n int) (int64, int64, error)) {
+	datastoreAllocateIDs = f
+}
+
+func SetTimeNow(f func() time.Time) {
+	timeNow = f
+}
+
+func ResetCacheProbe() {
+	atomic.StoreInt32(&cacheProbe.unavailable, 0)
+	atomic.StoreInt64(&cacheProbe.nextProbe, 0)
 }
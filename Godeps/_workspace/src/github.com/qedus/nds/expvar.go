@@ -0,0 +1,38 @@
+package nds
+
+import (
+	"expvar"
+	"sync"
+	"sync/atomic"
+)
+
+var publishExpvarOnce sync.Once
+
+// PublishExpvar publishes counters describing every NDS operation made by
+// the process as the expvar map "nds". The map holds the number of entities
+// requested by Gets, put by Puts and deleted by Deletes, along with the
+// MemcacheHits, MemcacheMisses, DatastoreReads and LockContentions described
+// by Stats, and EntryAges holding the EntryAgeHistogram recorded with
+// WithEntryAges. It is safe to call PublishExpvar more than once.
+func PublishExpvar() {
+	publishExpvarOnce.Do(func() {
+		m := expvar.NewMap("nds")
+		for name, s := range map[string]stat{
+			"Gets":            statGets,
+			"Puts":            statPuts,
+			"Deletes":         statDeletes,
+			"MemcacheHits":    statMemcacheHits,
+			"MemcacheMisses":  statMemcacheMisses,
+			"DatastoreReads":  statDatastoreReads,
+			"LockContentions": statLockContentions,
+		} {
+			s := s
+			m.Set(name, expvar.Func(func() interface{} {
+				return atomic.LoadInt64(&processStats.counts[s])
+			}))
+		}
+		m.Set("EntryAges", expvar.Func(func() interface{} {
+			return EntryAges()
+		}))
+	})
+}
@@ -0,0 +1,68 @@
+package nds_test
+
+import (
+	"expvar"
+	"strconv"
+	"testing"
+
+	"github.com/qedus/nds"
+	"google.golang.org/appengine/datastore"
+)
+
+func expvarCount(t *testing.T, name string) int64 {
+	m, ok := expvar.Get("nds").(*expvar.Map)
+	if !ok {
+		t.Fatal("expected nds expvar map")
+	}
+	n, err := strconv.ParseInt(m.Get(name).String(), 10, 64)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return n
+}
+
+func TestPublishExpvar(t *testing.T) {
+	c, closeFunc := NewContext(t, nil)
+	defer closeFunc()
+
+	type testEntity struct {
+		Val int
+	}
+
+	nds.PublishExpvar()
+	nds.PublishExpvar()
+
+	names := []string{"Gets", "Puts", "Deletes", "MemcacheHits",
+		"MemcacheMisses", "DatastoreReads"}
+	before := map[string]int64{}
+	for _, name := range names {
+		before[name] = expvarCount(t, name)
+	}
+
+	key := datastore.NewKey(c, "Entity", "", 1, nil)
+	if _, err := nds.Put(c, key, &testEntity{1}); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		if err := nds.Get(c, key, &testEntity{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := nds.Delete(c, key); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[string]int64{
+		"Gets":           2,
+		"Puts":           1,
+		"Deletes":        1,
+		"MemcacheHits":   1,
+		"MemcacheMisses": 1,
+		"DatastoreReads": 1,
+	}
+	for _, name := range names {
+		if n := expvarCount(t, name) - before[name]; n != expected[name] {
+			t.Fatal("incorrect", name, n)
+		}
+	}
+}
@@ -0,0 +1,26 @@
+package nds
+
+import "golang.org/x/net/context"
+
+var failClosedKey = "used for fail closed"
+
+// WithFailClosed returns a context that makes PutMulti return an error if the
+// cache cannot be cleared after the entities have been saved to the datastore.
+// By default such failures are only logged as the locks set before the put
+// expire after the lock time, during which reads go to the datastore. However
+// if the locks themselves were evicted, or memcache is flushed and refilled
+// from a stale source, the pre-put entities could be served until they
+// expire.
+//
+// Failing closed lets callers retry the whole operation for data critical
+// writes. The trade-off is availability: a memcache outage causes every put to
+// report an error even though the entities were saved to the datastore, so
+// callers must be prepared to retry puts that may already have succeeded.
+func WithFailClosed(c context.Context) context.Context {
+	return context.WithValue(c, &failClosedKey, true)
+}
+
+func isFailClosed(c context.Context) bool {
+	failClosed, _ := c.Value(&failClosedKey).(bool)
+	return failClosed
+}
@@ -0,0 +1,46 @@
+package nds_test
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/qedus/nds"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/memcache"
+)
+
+func TestWithFailClosed(t *testing.T) {
+	c, closeFunc := NewContext(t, nil)
+	defer closeFunc()
+
+	type testEntity struct {
+		Val int
+	}
+
+	expectedErr := errors.New("expected error")
+	nds.SetMemcacheDeleteMulti(func(c context.Context, keys []string) error {
+		return expectedErr
+	})
+	defer nds.SetMemcacheDeleteMulti(memcache.DeleteMulti)
+
+	key := datastore.NewKey(c, "Entity", "", 1, nil)
+
+	// By default the failure is only logged.
+	if _, err := nds.Put(c, key, &testEntity{1}); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := nds.Put(nds.WithFailClosed(c), key,
+		&testEntity{2}); err != expectedErr {
+		t.Fatal("expected error", err)
+	}
+
+	// The entity was still saved.
+	te := &testEntity{}
+	if err := datastore.Get(c, key, te); err != nil {
+		t.Fatal(err)
+	} else if te.Val != 2 {
+		t.Fatal("incorrect val", te.Val)
+	}
+}
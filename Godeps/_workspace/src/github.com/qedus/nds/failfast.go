@@ -0,0 +1,136 @@
+package nds
+
+import (
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+)
+
+var failFastKey = "used for fail fast"
+
+var failFastParentKey = "used for fail fast parent context"
+
+// WithFailFast returns a context that makes GetMulti, PutMulti and
+// DeleteMulti return the first error any of their batches reports instead of
+// a appengine.MultiError covering every key. Batches that have not started
+// yet are skipped, and those still running are cancelled through their
+// context. Missing entities, reported with datastore.ErrNoSuchEntity or
+// ErrDeleted, are not treated as errors so a GetMulti with only missing
+// entities still returns a appengine.MultiError.
+//
+// This trades complete error reporting for latency when any error aborts the
+// caller anyway. Calls small enough for a single batch are unaffected. Puts
+// and deletes cancelled part way through leave their entities locked in the
+// cache, so they are read from the datastore until the locks expire. Locks
+// removed in the background with WithAsyncCacheInvalidation are still removed
+// once the call returns.
+func WithFailFast(c context.Context) context.Context {
+	return context.WithValue(c, &failFastKey, true)
+}
+
+func isFailFast(c context.Context) bool {
+	failFast, _ := c.Value(&failFastKey).(bool)
+	return failFast
+}
+
+// failFast tracks the first hard error of the batches of a call made with
+// WithFailFast and cancels the context of the batches when it is found.
+type failFast struct {
+	once   sync.Once
+	cancel context.CancelFunc
+	err    error
+}
+
+// newFailFast returns a context for the batches of a call made with c and the
+// failFast for them, or nil if c does not use WithFailFast.
+func newFailFast(c context.Context) (context.Context, *failFast) {
+	if !isFailFast(c) {
+		return c, nil
+	}
+	fc, cancel := context.WithCancel(c)
+	fc = context.WithValue(fc, &failFastParentKey, c)
+	return fc, &failFast{cancel: cancel}
+}
+
+// withoutFailFastCancel returns a context with the values of c that is only
+// cancelled by the context the outermost failFast of c was made from, so work
+// outliving a batch, such as a background cache invalidation, is not aborted
+// when the call returns.
+func withoutFailFastCancel(c context.Context) context.Context {
+	parent, ok := c.Value(&failFastParentKey).(context.Context)
+	if !ok {
+		return c
+	}
+	for {
+		p, ok := parent.Value(&failFastParentKey).(context.Context)
+		if !ok {
+			break
+		}
+		parent = p
+	}
+	return failFastDetachedContext{c, parent}
+}
+
+// failFastDetachedContext has the values of its Context but the deadline and
+// cancellation of parent.
+type failFastDetachedContext struct {
+	context.Context
+	parent context.Context
+}
+
+func (dc failFastDetachedContext) Deadline() (time.Time, bool) {
+	return dc.parent.Deadline()
+}
+
+func (dc failFastDetachedContext) Done() <-chan struct{} {
+	return dc.parent.Done()
+}
+
+func (dc failFastDetachedContext) Err() error {
+	return dc.parent.Err()
+}
+
+// record notes err, the error of a batch, cancelling the remaining batches if
+// it holds a hard error.
+func (ff *failFast) record(err error) {
+	if ff == nil {
+		return
+	}
+	if hard := firstHardError(err); hard != nil {
+		ff.once.Do(func() {
+			ff.err = hard
+			ff.cancel()
+		})
+	}
+}
+
+// done releases the context of the batches and returns err, or the first
+// hard error recorded instead if there was one.
+func (ff *failFast) done(err error) error {
+	if ff == nil {
+		return err
+	}
+	ff.cancel()
+	if ff.err != nil {
+		return ff.err
+	}
+	return err
+}
+
+// firstHardError returns the first error held by err, which may be a
+// appengine.MultiError, that does not just report a missing entity.
+func firstHardError(err error) error {
+	me, ok := err.(appengine.MultiError)
+	if !ok {
+		return err
+	}
+	for _, e := range me {
+		if e != nil && e != datastore.ErrNoSuchEntity && e != ErrDeleted {
+			return e
+		}
+	}
+	return nil
+}
@@ -0,0 +1,100 @@
+package nds_test
+
+import (
+	"errors"
+	"sync"
+	"testing"
+
+	"github.com/qedus/nds"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+)
+
+func TestWithFailFast(t *testing.T) {
+	c, closeFunc := NewContext(t, nil)
+	defer closeFunc()
+
+	type testEntity struct {
+		Val int
+	}
+
+	keys := []*datastore.Key{
+		datastore.NewKey(c, "Entity", "", 1, nil),
+		datastore.NewKey(c, "Entity", "", 2, nil),
+		datastore.NewKey(c, "Entity", "", 3, nil),
+	}
+	if _, err := nds.PutMulti(c, keys[1:],
+		[]testEntity{{2}, {3}}); err != nil {
+		t.Fatal(err)
+	}
+
+	// The first batch fails and each batch is a single key.
+	dsErr := errors.New("datastore failed")
+	mu := sync.Mutex{}
+	gets, puts := 0, 0
+	nds.SetDatastoreGetMulti(func(c context.Context,
+		keys []*datastore.Key, vals interface{}) error {
+		mu.Lock()
+		gets++
+		mu.Unlock()
+		if keys[0].IntID() == 1 {
+			return dsErr
+		}
+		return datastore.GetMulti(c, keys, vals)
+	})
+	defer nds.SetDatastoreGetMulti(datastore.GetMulti)
+	nds.SetDatastorePutMulti(func(c context.Context, keys []*datastore.Key,
+		vals interface{}) ([]*datastore.Key, error) {
+		mu.Lock()
+		puts++
+		mu.Unlock()
+		if keys[0].IntID() == 1 {
+			return nil, dsErr
+		}
+		return datastore.PutMulti(c, keys, vals)
+	})
+	defer nds.SetDatastorePutMulti(datastore.PutMulti)
+
+	bc := nds.WithConcurrency(nds.WithMaxBatchSize(nds.WithNoCache(c), 1), 1)
+
+	// By default every batch runs.
+	if err := nds.GetMulti(bc, keys,
+		make([]testEntity, len(keys))); err != dsErr {
+		t.Fatal("expected dsErr", err)
+	}
+	if gets != 3 {
+		t.Fatal("expected three gets", gets)
+	}
+
+	ffc := nds.WithFailFast(bc)
+	gets = 0
+	if err := nds.GetMulti(ffc, keys,
+		make([]testEntity, len(keys))); err != dsErr {
+		t.Fatal("expected dsErr", err)
+	}
+	if gets != 1 {
+		t.Fatal("expected the remaining batches to be skipped", gets)
+	}
+
+	if _, err := nds.PutMulti(ffc, keys,
+		[]testEntity{{1}, {2}, {3}}); err != dsErr {
+		t.Fatal("expected dsErr", err)
+	}
+	if puts != 1 {
+		t.Fatal("expected the remaining batches to be skipped", puts)
+	}
+
+	// Missing entities are not errors.
+	missing := []*datastore.Key{
+		datastore.NewKey(c, "Entity", "", 4, nil),
+		datastore.NewKey(c, "Entity", "", 5, nil),
+	}
+	err := nds.GetMulti(ffc, missing, make([]testEntity, len(missing)))
+	if me, ok := err.(appengine.MultiError); !ok {
+		t.Fatal("expected appengine.MultiError", err)
+	} else if me[0] != datastore.ErrNoSuchEntity ||
+		me[1] != datastore.ErrNoSuchEntity {
+		t.Fatal(me)
+	}
+}
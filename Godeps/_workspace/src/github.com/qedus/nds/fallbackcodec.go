@@ -0,0 +1,108 @@
+package nds
+
+import (
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/memcache"
+)
+
+var fallbackCodecKey = "used for fallback Codec"
+
+// WithFallbackCodec returns a context that makes GetMulti, Peek and
+// projected reads decode cached entities with fallback when the codec selected
+// with WithCodec or WithKindCodec fails to decode them. Only once fallback
+// fails too is the entity treated as undecodable and read from the datastore.
+// This allows entities cached with the previous codec to keep being served
+// while a new codec is rolled out, without changing the cache key prefix.
+//
+// Entries decoded with fallback stay in their old format unless the context
+// is also from WithFallbackRewrite. A nil fallback disables the fallback.
+func WithFallbackCodec(c context.Context, fallback Codec) context.Context {
+	return context.WithValue(c, &fallbackCodecKey, fallback)
+}
+
+func fallbackCodec(c context.Context) (Codec, bool) {
+	codec, ok := c.Value(&fallbackCodecKey).(Codec)
+	return codec, ok && codec != nil
+}
+
+var fallbackRewriteKey = "used for fallback rewrite"
+
+// WithFallbackRewrite returns a context that makes GetMulti replace the cache
+// entries it decodes with the codec from WithFallbackCodec with entries
+// encoded with the primary codec, migrating them as MigrateCache would as they
+// are read. Entries are replaced using compare and swap so an entity put or
+// deleted meanwhile is never overwritten, and entries that fail to be replaced
+// are left as they are. Only use it once every context reading the entries
+// can decode the primary codec.
+func WithFallbackRewrite(c context.Context) context.Context {
+	return context.WithValue(c, &fallbackRewriteKey, true)
+}
+
+func isFallbackRewrite(c context.Context) bool {
+	rewrite, _ := c.Value(&fallbackRewriteKey).(bool)
+	return rewrite
+}
+
+// decodeCachedEntity deserializes the entity for key from item with the codec
+// selected for key, or with the fallback codec if that fails. It reports
+// whether the fallback codec decoded the entity. Errors that do not come from
+// the codec, such as kind mismatches, are returned without trying the
+// fallback, as is the primary codec's error if both fail.
+func decodeCachedEntity(c context.Context, key *datastore.Key,
+	item *memcache.Item) (datastore.PropertyList, bool, error) {
+
+	pl, err := decodeEntityItem(c, key, codecFor(c, key), item)
+	fallback, ok := fallbackCodec(c)
+	if err == nil || !ok || isReplaceableItemError(err) {
+		return pl, false, err
+	}
+	if pl, fallbackErr := decodeEntityItem(c, key, fallback,
+		item); fallbackErr == nil {
+		return pl, true, nil
+	}
+	return nil, false, err
+}
+
+// fallbackRewrites collects the entries decoded with the fallback codec that
+// are to be encoded again with the primary codec.
+type fallbackRewrites []fallbackRewrite
+
+type fallbackRewrite struct {
+	key  *datastore.Key
+	item *memcache.Item
+	pl   datastore.PropertyList
+}
+
+// add records item, the entry caching pl for key, to be rewritten if
+// fellBack reports it was decoded with the fallback codec.
+func (r *fallbackRewrites) add(c context.Context, key *datastore.Key,
+	item *memcache.Item, pl datastore.PropertyList, fellBack bool) {
+
+	if fellBack && isFallbackRewrite(c) {
+		*r = append(*r, fallbackRewrite{key, item, pl})
+	}
+}
+
+// save encodes the recorded entries with the primary codec and replaces them
+// using compare and swap. Copies of the items are rewritten, as the read that
+// got them may still be using them in other goroutines.
+func (r *fallbackRewrites) save(c context.Context) {
+	items := make([]*memcache.Item, 0, len(*r))
+	for _, rewrite := range *r {
+		item := *rewrite.item
+		if err := reencodeItem(c, rewrite.key, codecFor(c, rewrite.key),
+			&item, rewrite.pl); err != nil {
+			debugf(c, "nds:fallbackRewrites reencodeItem %s", err)
+			continue
+		}
+		items = append(items, &item)
+	}
+	if len(items) == 0 {
+		return
+	}
+	if err := checkMultiError(cacheFromContext(c).CompareAndSwapMulti(c,
+		items), len(items)); err != nil {
+		debugf(c, "nds:fallbackRewrites CompareAndSwapMulti %s", err)
+	}
+}
@@ -0,0 +1,63 @@
+package nds_test
+
+import (
+	"testing"
+
+	"github.com/qedus/nds"
+	"google.golang.org/appengine/datastore"
+)
+
+func TestWithFallbackCodec(t *testing.T) {
+	c, closeFunc := NewContext(t, nil)
+	defer closeFunc()
+
+	type testEntity struct {
+		Val int
+	}
+
+	// Cache the entity in the old format.
+	key := datastore.NewKey(c, "Entity", "", 1, nil)
+	if _, err := nds.Put(c, key, &testEntity{1}); err != nil {
+		t.Fatal(err)
+	}
+	if err := nds.Get(c, key, &testEntity{}); err != nil {
+		t.Fatal(err)
+	}
+
+	cd := &countingDatastore{}
+	pc := &prefixCodec{}
+	pcc := nds.WithCodec(nds.WithDatastore(c, cd), pc)
+	fc := nds.WithFallbackCodec(pcc, nds.GobCodec)
+	entity := &testEntity{}
+	if err := nds.Get(fc, key, entity); err != nil {
+		t.Fatal(err)
+	} else if entity.Val != 1 {
+		t.Fatal("incorrect val", entity.Val)
+	}
+	if cd.gets != 0 {
+		t.Fatal("expected the fallback codec to decode the entity", cd.gets)
+	}
+
+	// Without WithFallbackRewrite the entry keeps its old format.
+	if err := nds.Get(nds.WithDatastore(c, cd), key,
+		&testEntity{}); err != nil {
+		t.Fatal(err)
+	} else if cd.gets != 0 {
+		t.Fatal("expected the old format to be cached", cd.gets)
+	}
+
+	// Rewritten entries are decoded by the primary codec alone.
+	if err := nds.Get(nds.WithFallbackRewrite(fc), key,
+		&testEntity{}); err != nil {
+		t.Fatal(err)
+	}
+	entity = &testEntity{}
+	if err := nds.Get(pcc, key, entity); err != nil {
+		t.Fatal(err)
+	} else if entity.Val != 1 {
+		t.Fatal("incorrect val", entity.Val)
+	}
+	if cd.gets != 0 {
+		t.Fatal("expected the entry to be rewritten", cd.gets)
+	}
+}
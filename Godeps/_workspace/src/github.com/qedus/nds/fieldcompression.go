@@ -0,0 +1,150 @@
+package nds
+
+import (
+	"errors"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/datastore"
+)
+
+var fieldCompressionKey = "used for field compression"
+
+// compressedFieldsProperty names the properties added to a cached entity to
+// record the name of each field that was compressed.
+const compressedFieldsProperty = "__nds_compressed__"
+
+// Prefixes of a compressed field value recording the type it had.
+const (
+	compressedString byte = 's'
+	compressedBytes  byte = 'b'
+)
+
+var errCompressedField = errors.New("nds: invalid compressed field")
+
+// WithFieldCompression returns a context that gzip compresses the string and
+// []byte values of the named fields of entities of kind before they are
+// serialized for memcache, leaving the other fields as they are. For entities
+// that are mostly small fields with one large text or blob field this shrinks
+// the cached item while only spending CPU on the large field. Fields are named
+// as their properties are, so fields of nested structs use their full dotted
+// name, and values of other types are left uncompressed. Calls can be chained
+// to compress fields of several kinds, and nil fields stops compressing fields
+// of kind.
+//
+// As with WithCompression, entities with compressed fields can be read by any
+// context, field compression only needs to be enabled on contexts that write to
+// the cache. It works with any Codec that can serialize []byte values.
+func WithFieldCompression(c context.Context, kind string,
+	fields []string) context.Context {
+
+	kinds, _ := c.Value(&fieldCompressionKey).(map[string]map[string]bool)
+	copied := make(map[string]map[string]bool, len(kinds)+1)
+	for k, names := range kinds {
+		copied[k] = names
+	}
+	if len(fields) == 0 {
+		delete(copied, kind)
+	} else {
+		names := make(map[string]bool, len(fields))
+		for _, field := range fields {
+			names[field] = true
+		}
+		copied[kind] = names
+	}
+	return context.WithValue(c, &fieldCompressionKey, copied)
+}
+
+// compressFields returns pl with the values of the fields of key selected with
+// WithFieldCompression compressed, and fieldCompressedFlag if any were.
+func compressFields(c context.Context, key *datastore.Key,
+	pl datastore.PropertyList) (datastore.PropertyList, uint32, error) {
+
+	kinds, _ := c.Value(&fieldCompressionKey).(map[string]map[string]bool)
+	names := kinds[key.Kind()]
+	if len(names) == 0 {
+		return pl, 0, nil
+	}
+
+	var compressed datastore.PropertyList
+	seen := map[string]bool{}
+	for i, p := range pl {
+		if !names[p.Name] {
+			continue
+		}
+
+		var prefix byte
+		var data []byte
+		switch v := p.Value.(type) {
+		case string:
+			prefix, data = compressedString, []byte(v)
+		case []byte:
+			prefix, data = compressedBytes, v
+		default:
+			continue
+		}
+		z, err := compress(data)
+		if err != nil {
+			return nil, 0, err
+		}
+
+		if compressed == nil {
+			compressed = make(datastore.PropertyList, len(pl), len(pl)+1)
+			copy(compressed, pl)
+		}
+		compressed[i].Value = append([]byte{prefix}, z...)
+		if !seen[p.Name] {
+			seen[p.Name] = true
+			compressed = append(compressed, datastore.Property{
+				Name:     compressedFieldsProperty,
+				Value:    p.Name,
+				NoIndex:  true,
+				Multiple: true,
+			})
+		}
+	}
+	if compressed == nil {
+		return pl, 0, nil
+	}
+	return compressed, fieldCompressedFlag, nil
+}
+
+// expandFields returns pl, an entity cached with fieldCompressedFlag, with its
+// compressed fields decompressed and the record of them removed.
+func expandFields(pl datastore.PropertyList) (datastore.PropertyList, error) {
+	names := map[string]bool{}
+	expanded := make(datastore.PropertyList, 0, len(pl))
+	for _, p := range pl {
+		if p.Name != compressedFieldsProperty {
+			expanded = append(expanded, p)
+			continue
+		}
+		name, ok := p.Value.(string)
+		if !ok {
+			return nil, errCompressedField
+		}
+		names[name] = true
+	}
+
+	for i, p := range expanded {
+		if !names[p.Name] {
+			continue
+		}
+		z, ok := p.Value.([]byte)
+		if !ok || len(z) == 0 {
+			return nil, errCompressedField
+		}
+		data, err := decompress(z[1:])
+		if err != nil {
+			return nil, err
+		}
+		switch z[0] {
+		case compressedString:
+			expanded[i].Value = string(data)
+		case compressedBytes:
+			expanded[i].Value = data
+		default:
+			return nil, errCompressedField
+		}
+	}
+	return expanded, nil
+}
@@ -0,0 +1,97 @@
+package nds_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/qedus/nds"
+	"google.golang.org/appengine/datastore"
+)
+
+func TestWithFieldCompression(t *testing.T) {
+	c, closeFunc := NewContext(t, nil)
+	defer closeFunc()
+
+	type testEntity struct {
+		Name string
+		Size int
+		Text string `datastore:",noindex"`
+		Data []byte
+	}
+
+	text := strings.Repeat("compressible ", 40000)
+	data := []byte(strings.Repeat("bytes ", 10000))
+	keys := []*datastore.Key{
+		datastore.NewKey(c, "Entity", "", 1, nil),
+		datastore.NewKey(c, "Entity", "", 2, nil),
+	}
+	if _, err := nds.PutMulti(c, keys, []testEntity{
+		{"one", 1, text, data},
+		{"two", 2, text, data},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Cache the first entity as usual and the second with field compression.
+	rc := &recordingCache{}
+	cc := nds.WithCache(c, rc)
+	fc := nds.WithFieldCompression(cc, "Entity", []string{"Text", "Data"})
+	if err := nds.Get(cc, keys[0], &testEntity{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := nds.Get(fc, keys[1], &testEntity{}); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(rc.casItems) != 2 {
+		t.Fatal("expected entities to be cached", len(rc.casItems))
+	}
+	plain, compressed := rc.casItems[0], rc.casItems[1]
+	if plain.Flags != nds.EntityItem {
+		t.Fatal("expected plain entity flags", plain.Flags)
+	}
+	if compressed.Flags != nds.EntityItem|nds.FieldCompressedFlag {
+		t.Fatal("expected field compressed entity flags", compressed.Flags)
+	}
+	if len(compressed.Value) >= len(plain.Value)/10 {
+		t.Fatal("expected fields to be compressed",
+			len(compressed.Value), len(plain.Value))
+	}
+
+	// Compressed fields are readable from contexts without field compression.
+	te := &testEntity{}
+	if err := nds.Get(cc, keys[1], te); err != nil {
+		t.Fatal(err)
+	}
+	if te.Name != "two" || te.Size != 2 || te.Text != text ||
+		string(te.Data) != string(data) {
+		t.Fatal("incorrect entity", te.Name, te.Size)
+	}
+	if len(rc.casItems) != 2 {
+		t.Fatal("expected entity to be served from cache")
+	}
+}
+
+func TestWithFieldCompressionOtherKind(t *testing.T) {
+	c, closeFunc := NewContext(t, nil)
+	defer closeFunc()
+
+	type testEntity struct {
+		Text string `datastore:",noindex"`
+	}
+
+	rc := &recordingCache{}
+	cc := nds.WithFieldCompression(nds.WithCache(c, rc), "Other",
+		[]string{"Text"})
+
+	key := datastore.NewKey(c, "Entity", "", 1, nil)
+	if _, err := nds.Put(cc, key, &testEntity{"text"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := nds.Get(cc, key, &testEntity{}); err != nil {
+		t.Fatal(err)
+	}
+	if len(rc.casItems) != 1 || rc.casItems[0].Flags != nds.EntityItem {
+		t.Fatal("expected uncompressed entity")
+	}
+}
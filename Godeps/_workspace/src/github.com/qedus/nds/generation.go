@@ -0,0 +1,50 @@
+package nds
+
+import (
+	"errors"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/memcache"
+)
+
+var cacheGenerationKey = "used for the cache generation"
+
+// errGenerationMismatch is returned when decoding a cached entity stored in a
+// different cache generation from the one selected with WithCacheGeneration.
+var errGenerationMismatch = errors.New(
+	"nds: cached entity has another cache generation")
+
+// WithCacheGeneration returns a context that tags the entities GetMulti
+// caches with generation gen, such as the version of the deployed app.
+// Cached entities tagged with any other generation, or cached without one,
+// are treated as cache misses and replaced with the entity read from the
+// datastore, as if the cache had been flushed. Setting gen to the deploy
+// version at startup therefore stops entities cached by a previous deploy,
+// which may serialize them differently, being read by the new one. This is
+// coarser than WithSchemaVersion but needs no upkeep. Entities cached as
+// missing carry no generation and are unaffected.
+//
+// The generation counts towards the maximum size of cached entities and must
+// be shorter than 64KB. An empty gen is the same as not setting a generation.
+func WithCacheGeneration(c context.Context, gen string) context.Context {
+	return context.WithValue(c, &cacheGenerationKey, gen)
+}
+
+func cacheGeneration(c context.Context) string {
+	gen, _ := c.Value(&cacheGenerationKey).(string)
+	return gen
+}
+
+// checkItemGeneration returns errGenerationMismatch if the entity item was
+// stored in a generation other than that of c.
+func checkItemGeneration(c context.Context, item *memcache.Item) error {
+	var gen string
+	if item.Flags&generationFlag != 0 {
+		header, _ := splitItemHeader(item)
+		gen = header.generation
+	}
+	if gen != cacheGeneration(c) {
+		return errGenerationMismatch
+	}
+	return nil
+}
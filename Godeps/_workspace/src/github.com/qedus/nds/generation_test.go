@@ -0,0 +1,61 @@
+package nds_test
+
+import (
+	"testing"
+
+	"github.com/qedus/nds"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/datastore"
+)
+
+func TestWithCacheGeneration(t *testing.T) {
+	c, closeFunc := NewContext(t, nil)
+	defer closeFunc()
+
+	type testEntity struct {
+		Val int
+	}
+
+	keys := []*datastore.Key{
+		datastore.NewKey(c, "Entity", "", 1, nil),
+		datastore.NewKey(c, "Other", "", 1, nil),
+	}
+	if _, err := nds.PutMulti(c, keys, []testEntity{{1}, {1}}); err != nil {
+		t.Fatal(err)
+	}
+
+	get := func(c context.Context, expected int) {
+		entities := make([]testEntity, len(keys))
+		if err := nds.GetMulti(c, keys, entities); err != nil {
+			t.Fatal(err)
+		}
+		for i, entity := range entities {
+			if entity.Val != expected {
+				t.Fatal("incorrect val", i, entity.Val, expected)
+			}
+		}
+	}
+	// Change the entities behind the cache's back.
+	change := func(val int) {
+		if _, err := datastore.PutMulti(c, keys,
+			[]testEntity{{val}, {val}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Entries cached without a generation are bypassed by the first.
+	get(c, 1)
+	change(2)
+	get(c, 1)
+	g1 := nds.WithCacheGeneration(c, "v1")
+	get(g1, 2)
+	change(3)
+	get(g1, 2)
+
+	// Changing the generation bypasses every existing entry.
+	g2 := nds.WithCacheGeneration(c, "v2")
+	get(g2, 3)
+	change(4)
+	get(g2, 3)
+	get(g1, 4)
+}
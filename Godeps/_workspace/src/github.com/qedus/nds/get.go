@@ -2,13 +2,15 @@ package nds
 
 import (
 	"bytes"
+	"errors"
+	"fmt"
 	"reflect"
 	"sync"
+	"time"
 
 	"golang.org/x/net/context"
 	"google.golang.org/appengine"
 	"google.golang.org/appengine/datastore"
-	"google.golang.org/appengine/log"
 	"google.golang.org/appengine/memcache"
 )
 
@@ -47,10 +49,15 @@ const getMultiLimit = 1000
 // type I, or some non-interface non-pointer type P such that P or *P implements
 // datastore.PropertyLoadSaver. If an []I, each element must be a valid dst for
 // Get: it must be a struct pointer or implement datastore.PropertyLoadSaver.
+// The elements of an []I may be of different types so entities of different
+// kinds can be got with a single call.
 //
 // As a special case, datastore.PropertyList is an invalid type for dst, even
 // though a PropertyList is a slice of structs. It is treated as invalid to
 // avoid being mistakenly passed when []datastore.PropertyList was intended.
+//
+// Keys that occur more than once are only got once. The entity, or error, is
+// then copied to every element of vals with that key.
 func GetMulti(c context.Context,
 	keys []*datastore.Key, vals interface{}) error {
 
@@ -58,19 +65,87 @@ func GetMulti(c context.Context,
 	if err := checkMultiArgs(keys, v); err != nil {
 		return err
 	}
+	if err := checkAppIDs(c, keys); err != nil {
+		return err
+	}
+	c = withBreakerDecision(c)
+
+	if r, ok := recorderFromContext(c); ok {
+		return recordGetMulti(c, r, keys, vals)
+	}
 
 	if len(keys) == 0 {
 		return nil
 	}
 
-	callCount := (len(keys)-1)/getMultiLimit + 1
+	if isKindCheck(c) {
+		if err := checkKinds(keys, v); err != nil {
+			return err
+		}
+	}
+
+	if isMissingAsNil(c) {
+		return dropMissing(GetMulti(context.WithValue(c, &missingAsNilKey,
+			false), keys, vals))
+	}
+
+	if fieldName, ok := keyFieldFromContext(c); ok {
+		err := GetMulti(context.WithValue(c, &keyFieldKey, ""), keys, vals)
+		setKeyFields(keys, v, fieldName, err)
+		return err
+	}
+
+	if f, ok := keyMapperFromContext(c); ok {
+		physicalKeys, err := mapKeys(keys, f)
+		if err != nil {
+			return err
+		}
+		return GetMulti(withoutKeyMapper(c), physicalKeys, vals)
+	}
+
+	if uncached, cached := splitUncachedKinds(c, keys); len(uncached) > 0 {
+		_, err := runUncachedSplit(c, keys, v, uncached, cached,
+			func(c context.Context, keys []*datastore.Key,
+				vals reflect.Value) ([]*datastore.Key, error) {
+				return nil, GetMulti(c, keys, vals.Interface())
+			})
+		return err
+	}
+
+	if filtered, rest := splitLoadFields(c, keys); len(filtered) > 0 {
+		return getLoadFields(c, keys, v, filtered, rest)
+	}
+
+	if co, ok := coalescerFromContext(c); ok {
+		return getCoalesced(c, co, keys, v)
+	}
+
+	if firsts, dups := distinctKeys(keys); dups {
+		return getDeduped(c, keys, v, firsts)
+	}
+
+	addStat(c, statGets, len(keys))
+
+	size := batchSize(c, getMultiLimit)
+	callCount := (len(keys)-1)/size + 1
 	errs := make([]error, callCount)
 
+	var ff *failFast
+	if callCount > 1 {
+		c, ff = newFailFast(c)
+	}
+
+	// Limit the batches in flight if a concurrency was set.
+	var sem chan struct{}
+	if n := concurrency(c); n > 0 {
+		sem = make(chan struct{}, n)
+	}
+
 	wg := sync.WaitGroup{}
 	wg.Add(callCount)
 	for i := 0; i < callCount; i++ {
-		lo := i * getMultiLimit
-		hi := (i + 1) * getMultiLimit
+		lo := i * size
+		hi := (i + 1) * size
 		if hi > len(keys) {
 			hi = len(keys)
 		}
@@ -79,18 +154,40 @@ func GetMulti(c context.Context,
 		keySlice := keys[lo:hi]
 		valSlice := v.Slice(lo, hi)
 
+		if sem != nil {
+			sem <- struct{}{}
+		}
 		go func() {
-			if _, ok := transactionFromContext(c); ok {
-				errs[index] = datastoreGetMulti(c,
-					keySlice, valSlice.Interface())
+			if err := c.Err(); err != nil {
+				errs[index] = err
+			} else if tx, ok := transactionFromContext(c); ok {
+				errs[index] = txGetMulti(c, tx, keySlice, valSlice)
+			} else if fields, ok := projectionFromContext(c); ok {
+				errs[index] = getProjected(c, keySlice, valSlice, fields)
+			} else if isNoCache(c) && isCacheOnlyReads(c) {
+				errs[index] = cacheMissErrors(len(keySlice))
+			} else if isNoCache(c) {
+				errs[index] = getNoCache(c, keySlice, valSlice)
 			} else {
 				errs[index] = getMulti(c, keySlice, valSlice)
 			}
+			ff.record(errs[index])
+			if sem != nil {
+				<-sem
+			}
 			wg.Done()
 		}()
 	}
 	wg.Wait()
 
+	if err := ff.done(nil); err != nil {
+		return err
+	}
+
+	if isPartial(c) {
+		return groupBatchErrors(len(keys), size, errs)
+	}
+
 	// Quick escape if all errors are nil.
 	errsNil := true
 	for _, err := range errs {
@@ -104,8 +201,8 @@ func GetMulti(c context.Context,
 
 	groupedErrs := make(appengine.MultiError, len(keys))
 	for i, err := range errs {
-		lo := i * getMultiLimit
-		hi := (i + 1) * getMultiLimit
+		lo := i * size
+		hi := (i + 1) * size
 		if hi > len(keys) {
 			hi = len(keys)
 		}
@@ -118,9 +215,209 @@ func GetMulti(c context.Context,
 	return groupedErrs
 }
 
-// Get loads the entity stored for key into val, which must be a struct pointer.
-// Currently PropertyLoadSaver is not implemented. If there is no such entity
-// for the key, Get returns ErrNoSuchEntity.
+// getDatastore gets entities straight from the datastore.
+func getDatastore(c context.Context,
+	keys []*datastore.Key, vals interface{}) error {
+
+	sc, endSpan := startSpan(c, "datastore", "datastore.GetMulti", len(keys))
+	err := datastoreFromContext(c).GetMulti(sc, keys, vals)
+	endSpan(err)
+	addStat(c, statDatastoreReads, len(keys))
+	return checkMultiError(err, len(keys))
+}
+
+var partialKey = "used for partial GetMulti"
+
+// GetMultiPartial works just like GetMulti except that an error loading one
+// entity never prevents the others from being loaded. As many vals as possible
+// are filled and a appengine.MultiError is returned with a nil element for
+// each entity that loaded successfully. This is useful for iterating over
+// entities where a few no longer match the shape of their struct.
+func GetMultiPartial(c context.Context,
+	keys []*datastore.Key, vals interface{}) error {
+
+	return GetMulti(context.WithValue(c, &partialKey, true), keys, vals)
+}
+
+func isPartial(c context.Context) bool {
+	partial, _ := c.Value(&partialKey).(bool)
+	return partial
+}
+
+// GetMultiInto works just like GetMulti except that the entities are appended
+// to dst instead of being loaded into a slice of the same length as keys. dst
+// must be a settable slice, such as reflect.ValueOf(&s).Elem(), with enough
+// spare capacity for len(keys) more elements so that pages of entities can be
+// accumulated without reallocating. If GetMulti returns a
+// appengine.MultiError the entities are still appended, so the errors line up
+// with the new elements of dst. On any other error dst is left unchanged.
+func GetMultiInto(c context.Context,
+	keys []*datastore.Key, dst reflect.Value) error {
+
+	if err := checkAccumulatorArgs(keys, dst); err != nil {
+		return err
+	}
+
+	lo, hi := dst.Len(), dst.Len()+len(keys)
+	err := GetMulti(c, keys, dst.Slice(lo, hi).Interface())
+	if _, ok := err.(appengine.MultiError); err == nil || ok {
+		dst.SetLen(hi)
+	}
+	return err
+}
+
+// checkAccumulatorArgs checks that dst can have len(keys) entities appended to
+// it in place and that the appended elements are valid GetMulti vals.
+func checkAccumulatorArgs(keys []*datastore.Key, dst reflect.Value) error {
+	if dst.Kind() != reflect.Slice {
+		return errors.New("nds: dst is not a slice")
+	}
+	if !dst.CanSet() {
+		return errors.New("nds: dst is not settable")
+	}
+	if dst.Cap()-dst.Len() < len(keys) {
+		return fmt.Errorf("nds: dst has capacity for %d more entities, need %d",
+			dst.Cap()-dst.Len(), len(keys))
+	}
+	return checkMultiArgs(keys, dst.Slice(dst.Len(), dst.Len()+len(keys)))
+}
+
+// GetMultiProps works just like GetMulti except that the entities are returned
+// as property lists, for callers without a struct type for them. Entities are
+// cached exactly as GetMulti caches them. The returned slice has an element
+// for every key, including those GetMulti reports an error for, which are
+// left nil.
+func GetMultiProps(c context.Context,
+	keys []*datastore.Key) ([]datastore.PropertyList, error) {
+
+	pls := make([]datastore.PropertyList, len(keys))
+	if err := GetMulti(c, keys, pls); err != nil {
+		if _, ok := err.(appengine.MultiError); !ok {
+			return nil, err
+		}
+		return pls, err
+	}
+	return pls, nil
+}
+
+// GetMultiDispatch works just like GetMulti except that the entity for each
+// key is loaded into a new value returned by factory for the kind of the key.
+// factory must return a valid dst for Get, usually a pointer to a new struct,
+// or an error is returned. The loaded values are returned in the same order
+// as keys, including those GetMulti reports an error for.
+func GetMultiDispatch(c context.Context, keys []*datastore.Key,
+	factory func(kind string) interface{}) ([]interface{}, error) {
+
+	vals := make([]interface{}, len(keys))
+	for i, key := range keys {
+		if key == nil {
+			continue
+		}
+		if vals[i] = factory(key.Kind()); vals[i] == nil {
+			return nil, fmt.Errorf("nds: factory returned nil for kind %s",
+				key.Kind())
+		}
+	}
+
+	if err := GetMulti(c, keys, vals); err != nil {
+		if _, ok := err.(appengine.MultiError); !ok {
+			return nil, err
+		}
+		return vals, err
+	}
+	return vals, nil
+}
+
+// GetWithAncestors gets the entity for key and the entities of each of its
+// ancestors with a single GetMulti, loading each into a new value returned by
+// factory for its kind as GetMultiDispatch does. The entities are returned in
+// key path order, from the root ancestor to the entity for key.
+// datastore.ErrNoSuchEntity is returned if the entity for key does not exist
+// and an error naming the ancestor if any ancestor does not, as a broken chain
+// of ancestors usually means the data is corrupt.
+func GetWithAncestors(c context.Context, key *datastore.Key,
+	factory func(kind string) interface{}) ([]interface{}, error) {
+
+	if key == nil {
+		return nil, datastore.ErrInvalidKey
+	}
+
+	var keys []*datastore.Key
+	for k := key; k != nil; k = k.Parent() {
+		keys = append(keys, k)
+	}
+	for i, j := 0, len(keys)-1; i < j; i, j = i+1, j-1 {
+		keys[i], keys[j] = keys[j], keys[i]
+	}
+
+	vals, err := GetMultiDispatch(c, keys, factory)
+	me, ok := err.(appengine.MultiError)
+	if err != nil && !ok {
+		return nil, err
+	}
+	for i, err := range me {
+		switch {
+		case err == nil:
+		case err != datastore.ErrNoSuchEntity:
+			return nil, me
+		case i == len(keys)-1:
+			return nil, err
+		default:
+			return nil, fmt.Errorf("nds: ancestor %s of %s does not exist",
+				keys[i], key)
+		}
+	}
+	return vals, nil
+}
+
+// GetMultiMap works just like GetMulti except that the entities are added to
+// the map dst points to, keyed by key.Encode(), rather than being loaded into
+// a slice. dst must be a *map[string]*S for some struct type S and the map is
+// created if it is nil. Keys without an entity are left out of the map. If
+// GetMulti returns a appengine.MultiError for other errors the entities that
+// loaded are still added and the errors are returned in the order of keys.
+func GetMultiMap(c context.Context,
+	keys []*datastore.Key, dst interface{}) error {
+
+	d := reflect.ValueOf(dst)
+	if d.Kind() != reflect.Ptr || d.IsNil() || d.Elem().Kind() != reflect.Map {
+		return errors.New("nds: dst is not a pointer to a map")
+	}
+	m := d.Elem()
+	if m.Type().Key().Kind() != reflect.String {
+		return errors.New("nds: dst map keys are not strings")
+	}
+	elemType := m.Type().Elem()
+	if elemType.Kind() != reflect.Ptr ||
+		elemType.Elem().Kind() != reflect.Struct {
+		return errors.New("nds: dst map values are not struct pointers")
+	}
+
+	vals := reflect.MakeSlice(reflect.SliceOf(elemType), len(keys), len(keys))
+	for i := range keys {
+		vals.Index(i).Set(reflect.New(elemType.Elem()))
+	}
+	err := GetMulti(c, keys, vals.Interface())
+	me, ok := err.(appengine.MultiError)
+	if err != nil && !ok {
+		return err
+	}
+
+	if m.IsNil() {
+		m.Set(reflect.MakeMap(m.Type()))
+	}
+	for i, key := range keys {
+		if me == nil || me[i] == nil {
+			m.SetMapIndex(reflect.ValueOf(key.Encode()).Convert(
+				m.Type().Key()), vals.Index(i))
+		}
+	}
+	return dropMissing(err)
+}
+
+// Get loads the entity stored for key into val, which must be a struct pointer
+// or implement datastore.PropertyLoadSaver. If there is no such entity for the
+// key, Get returns ErrNoSuchEntity.
 //
 // The values of val's unmatched struct fields are not modified, and matching
 // slice-typed fields are not reset before appending to them. In particular, it
@@ -135,11 +432,8 @@ func Get(c context.Context, key *datastore.Key, val interface{}) error {
 		return datastore.ErrInvalidEntityType
 	}
 
-	err := GetMulti(c, []*datastore.Key{key}, []interface{}{val})
-	if me, ok := err.(appengine.MultiError); ok {
-		return me[0]
-	}
-	return err
+	return singleError(GetMulti(c, []*datastore.Key{key},
+		[]interface{}{val}))
 }
 
 type cacheState byte
@@ -156,11 +450,31 @@ type cacheItem struct {
 	memcacheKey string
 
 	val reflect.Value
+	pl  datastore.PropertyList
 	err error
 
 	item *memcache.Item
 
 	state cacheState
+
+	// partial is set for entities loaded from a cache entry made without
+	// their nds:"nocache" fields.
+	partial bool
+
+	// waitUntil is when to stop waiting for another reader to refresh the
+	// entity, if it is externally locked by one.
+	waitUntil time.Time
+}
+
+// getNoCache gets entities straight from the datastore for contexts made with
+// WithNoCache, once the fallback rate limiter of c allows it.
+func getNoCache(c context.Context,
+	keys []*datastore.Key, vals reflect.Value) error {
+	if err := waitFallbackLimiter(c); err != nil {
+		return err
+	}
+	return getSecondary(c, keys, vals.Interface(),
+		getDatastore(c, keys, vals.Interface()))
 }
 
 // getMulti attempts to get entities from, memcache, then the datastore.
@@ -172,17 +486,49 @@ type cacheItem struct {
 func getMulti(c context.Context,
 	keys []*datastore.Key, vals reflect.Value) error {
 
+	expiration, err := lockTime(c)
+	if err != nil {
+		return err
+	}
+	if err := checkCacheKeyPrefix(c); err != nil {
+		return err
+	}
+
 	cacheItems := make([]cacheItem, len(keys))
 	for i, key := range keys {
 		cacheItems[i].key = key
-		cacheItems[i].memcacheKey = createMemcacheKey(key)
+		cacheItems[i].memcacheKey = readMemcacheKey(c, key)
 		cacheItems[i].val = vals.Index(i)
 		cacheItems[i].state = miss
 	}
 
-	loadMemcache(c, cacheItems)
+	loadPreloaded(c, cacheItems)
+
+	if !isStrongRead(c) {
+		loadIntercepted(c, cacheItems)
+
+		loadProcessCache(c, cacheItems)
+
+		loadLocalCache(c, cacheItems)
+
+		loadMemcache(c, cacheItems)
+	}
+	recordCacheHits(c, cacheItems)
+	if isCacheOnlyReads(c) {
+		markCacheMisses(cacheItems)
+	}
+
+	// Wait before locking so a denied read leaves no locks behind.
+	if err := waitFallbackRateLimit(c, cacheItems); err != nil {
+		return err
+	}
 
-	lockMemcache(c, cacheItems)
+	if isEventualConsistency(c) {
+		skipLocks(cacheItems)
+	} else {
+		lockMemcache(c, cacheItems, expiration)
+	}
+	waitForRefreshes(c, cacheItems)
 
 	if err := loadDatastore(c, cacheItems, vals.Type()); err != nil {
 		return err
@@ -190,6 +536,10 @@ func getMulti(c context.Context,
 
 	saveMemcache(c, cacheItems)
 
+	saveLocalCache(c, cacheItems)
+
+	saveProcessCache(c, cacheItems)
+
 	me, errsNil := make(appengine.MultiError, len(cacheItems)), true
 	for i, cacheItem := range cacheItems {
 		if cacheItem.err != nil {
@@ -206,62 +556,123 @@ func getMulti(c context.Context,
 
 func loadMemcache(c context.Context, cacheItems []cacheItem) {
 
-	memcacheKeys := make([]string, len(cacheItems))
-	for i, cacheItem := range cacheItems {
-		memcacheKeys[i] = cacheItem.memcacheKey
+	memcacheKeys := make([]string, 0, len(cacheItems))
+	for _, cacheItem := range cacheItems {
+		if cacheItem.state == miss {
+			memcacheKeys = append(memcacheKeys, cacheItem.memcacheKey)
+		}
+	}
+	if len(memcacheKeys) == 0 {
+		return
 	}
 
-	items, err := memcacheGetMulti(c, memcacheKeys)
+	items, err := cacheFromContext(c).GetMulti(c, memcacheKeys)
 	if err != nil {
-		for i := range cacheItems {
-			cacheItems[i].state = externalLock
+		for i, cacheItem := range cacheItems {
+			if cacheItem.state == miss {
+				cacheItems[i].state = externalLock
+			}
 		}
-		log.Warningf(c, "nds:loadMemcache GetMulti %s", err)
+		warningf(c, "nds:loadMemcache GetMulti %s", err)
 		return
 	}
 
-	for i, memcacheKey := range memcacheKeys {
-		if item, ok := items[memcacheKey]; ok {
-			switch item.Flags {
+	var rewrites fallbackRewrites
+	defer rewrites.save(c)
+	for i, cacheItem := range cacheItems {
+		if cacheItem.state != miss {
+			continue
+		}
+		if item, ok := items[cacheItem.memcacheKey]; ok {
+			switch itemType(item.Flags) {
 			case lockItem:
+				if isAbandonedLock(c, item) {
+					// Replace the abandoned lock using CAS.
+					cacheItems[i].item = item
+					cacheItems[i].state = internalLock
+					break
+				}
 				cacheItems[i].state = externalLock
+				cacheItems[i].waitUntil = refreshWaitDeadline(item)
+				lockContention(c, cacheItem.key)
+			case refreshItem:
+				// Leave as a miss so the marker is claimed when locking.
+				cacheItems[i].item = item
 			case noneItem:
 				cacheItems[i].state = done
 				cacheItems[i].err = datastore.ErrNoSuchEntity
+				addStat(c, statMemcacheHits, 1)
+				shadowRead(c, cacheItem.key, item)
+			case tombstoneItem:
+				cacheItems[i].state = done
+				cacheItems[i].err = ErrDeleted
+				addStat(c, statMemcacheHits, 1)
 			case entityItem:
-				pl := datastore.PropertyList{}
-				if err := unmarshal(item.Value, &pl); err != nil {
-					log.Warningf(c, "nds:loadMemcache unmarshal %s", err)
+				if isTooOld(c, item) {
+					// Replace the entry using CAS as if it were missing.
+					cacheItems[i].item = item
+					cacheItems[i].state = internalLock
+					break
+				}
+				if item.Flags&partialFlag != 0 && isFullEntities(c) {
+					// Read the whole entity without replacing the entry.
+					cacheItems[i].state = externalLock
+					break
+				}
+				pl, fellBack, err := decodeCachedEntity(c, cacheItem.key,
+					item)
+				if err != nil {
+					if isReplaceableItemError(err) || isDecodeFallback(c) {
+						// Leave as a miss so the entry is replaced.
+						debugf(c, "nds:loadMemcache unmarshal %s", err)
+						break
+					}
+					warningf(c, "nds:loadMemcache unmarshal %s", err)
 					cacheItems[i].state = externalLock
 					break
 				}
 				if err := setValue(cacheItems[i].val, pl); err == nil {
+					cacheItems[i].pl = pl
+					cacheItems[i].partial = item.Flags&partialFlag != 0
 					cacheItems[i].state = done
+					addStat(c, statMemcacheHits, 1)
+					rewrites.add(c, cacheItem.key, item, pl, fellBack)
+					recordCacheExpiry(c, cacheItem.key, item)
+					revalidateIfStale(c, cacheItem.key, item,
+						entityType(cacheItems[i].val))
+					shadowRead(c, cacheItem.key, item)
+				} else if isDecodeFallback(c) {
+					debugf(c, "nds:loadMemcache setValue %s", err)
 				} else {
-					log.Warningf(c, "nds:loadMemcache setValue %s", err)
+					warningf(c, "nds:loadMemcache setValue %s", err)
 					cacheItems[i].state = externalLock
 				}
 			default:
-				log.Warningf(c, "nds:loadMemcache unknown item.Flags %d", item.Flags)
+				warningf(c, "nds:loadMemcache unknown item.Flags %d", item.Flags)
 				cacheItems[i].state = externalLock
 			}
 		}
 	}
 }
 
-func lockMemcache(c context.Context, cacheItems []cacheItem) {
+func lockMemcache(c context.Context, cacheItems []cacheItem,
+	expiration time.Duration) {
 
 	lockItems := make([]*memcache.Item, 0, len(cacheItems))
 	lockMemcacheKeys := make([]string, 0, len(cacheItems))
+	var claimItems []*memcache.Item
 	for i, cacheItem := range cacheItems {
 		if cacheItem.state == miss {
-
-			item := &memcache.Item{
-				Key:        cacheItem.memcacheKey,
-				Flags:      lockItem,
-				Value:      itemLock(),
-				Expiration: memcacheLockTime,
+			if item := cacheItem.item; item != nil &&
+				itemType(item.Flags) == refreshItem {
+				claimRefreshItem(item, expiration)
+				claimItems = append(claimItems, item)
+				lockMemcacheKeys = append(lockMemcacheKeys,
+					cacheItem.memcacheKey)
+				continue
 			}
+
+			item := newLockItem(cacheItem.memcacheKey, expiration)
 			cacheItems[i].item = item
 			lockItems = append(lockItems, item)
 			lockMemcacheKeys = append(lockMemcacheKeys, cacheItem.memcacheKey)
@@ -269,12 +680,20 @@ func lockMemcache(c context.Context, cacheItems []cacheItem) {
 	}
 
 	// We don't care if there are errors here.
-	if err := memcacheAddMulti(c, lockItems); err != nil {
-		log.Warningf(c, "nds:lockMemcache AddMulti %s", err)
+	if err := cacheFromContext(c).AddMulti(c, lockItems); err != nil {
+		warningf(c, "nds:lockMemcache AddMulti %s", err)
+	}
+
+	// Only one reader claims each refresh marker, the others wait for it.
+	if len(claimItems) > 0 {
+		if err := cacheFromContext(c).CompareAndSwapMulti(c,
+			claimItems); err != nil {
+			debugf(c, "nds:lockMemcache CompareAndSwapMulti %s", err)
+		}
 	}
 
 	// Get the items again so we can use CAS when updating the cache.
-	items, err := memcacheGetMulti(c, lockMemcacheKeys)
+	items, err := cacheFromContext(c).GetMulti(c, lockMemcacheKeys)
 
 	// Cache failed so forget about it and just use the datastore.
 	if err != nil {
@@ -283,40 +702,81 @@ func lockMemcache(c context.Context, cacheItems []cacheItem) {
 				cacheItems[i].state = externalLock
 			}
 		}
-		log.Warningf(c, "nds:lockMemcache GetMulti %s", err)
+		warningf(c, "nds:lockMemcache GetMulti %s", err)
 		return
 	}
 
 	// Cache worked so figure out what items we got.
+	var rewrites fallbackRewrites
+	defer rewrites.save(c)
 	for i, cacheItem := range cacheItems {
 		if cacheItem.state == miss {
-			if item, ok := items[cacheItem.memcacheKey]; ok {
-				switch item.Flags {
+			item, ok := items[cacheItem.memcacheKey]
+			if ok && itemType(item.Flags) != lockItem && isStrongRead(c) {
+				// Replace the cached value using CAS so a lock set by a
+				// concurrent put or delete is never overwritten.
+				cacheItems[i].item = item
+				cacheItems[i].state = internalLock
+				continue
+			}
+			if ok {
+				switch itemType(item.Flags) {
 				case lockItem:
-					if bytes.Equal(item.Value, cacheItem.item.Value) {
+					if bytes.Equal(item.Value, cacheItem.item.Value) ||
+						isAbandonedLock(c, item) {
 						cacheItems[i].item = item
 						cacheItems[i].state = internalLock
 					} else {
 						cacheItems[i].state = externalLock
+						cacheItems[i].waitUntil = refreshWaitDeadline(item)
+						lockContention(c, cacheItem.key)
 					}
 				case noneItem:
 					cacheItems[i].state = done
 					cacheItems[i].err = datastore.ErrNoSuchEntity
+					addStat(c, statMemcacheHits, 1)
+				case tombstoneItem:
+					cacheItems[i].state = done
+					cacheItems[i].err = ErrDeleted
+					addStat(c, statMemcacheHits, 1)
+				case refreshItem:
+					// The marker was written after the cache was read.
+					cacheItems[i].state = externalLock
 				case entityItem:
-					pl := datastore.PropertyList{}
-					if err := unmarshal(item.Value, &pl); err != nil {
-						log.Warningf(c, "nds:lockMemcache unmarshal %s", err)
+					if isTooOld(c, item) {
+						cacheItems[i].item = item
+						cacheItems[i].state = internalLock
+						break
+					}
+					if item.Flags&partialFlag != 0 && isFullEntities(c) {
+						// Read the whole entity without replacing the entry.
 						cacheItems[i].state = externalLock
 						break
 					}
-					if err := setValue(cacheItems[i].val, pl); err == nil {
+					pl, fellBack, err := decodeCachedEntity(c,
+						cacheItem.key, item)
+					if err == nil {
+						err = setValue(cacheItems[i].val, pl)
+					}
+					switch {
+					case err == nil:
+						cacheItems[i].pl = pl
+						cacheItems[i].partial = item.Flags&partialFlag != 0
 						cacheItems[i].state = done
-					} else {
-						log.Warningf(c, "nds:lockMemcache setValue %s", err)
+						addStat(c, statMemcacheHits, 1)
+						rewrites.add(c, cacheItem.key, item, pl, fellBack)
+						recordCacheExpiry(c, cacheItem.key, item)
+					case isReplaceableItemError(err) || isDecodeFallback(c):
+						// Replace the undecodable entry using CAS.
+						debugf(c, "nds:lockMemcache decode %s", err)
+						cacheItems[i].item = item
+						cacheItems[i].state = internalLock
+					default:
+						warningf(c, "nds:lockMemcache decode %s", err)
 						cacheItems[i].state = externalLock
 					}
 				default:
-					log.Warningf(c, "nds:lockMemcache unknown item.Flags %d",
+					warningf(c, "nds:lockMemcache unknown item.Flags %d",
 						item.Flags)
 					cacheItems[i].state = externalLock
 				}
@@ -345,8 +805,15 @@ func loadDatastore(c context.Context, cacheItems []cacheItem,
 		}
 	}
 
+	addStat(c, statMemcacheMisses, len(keys))
+	addStat(c, statDatastoreReads, len(keys))
+
+	sc, endSpan := startSpan(c, "datastore", "datastore.GetMulti", len(keys))
+	err := datastoreGetMultiFor(sc, keys, vals)
+	endSpan(err)
+
 	var me appengine.MultiError
-	if err := datastoreGetMulti(c, keys, vals); err == nil {
+	if err == nil {
 		me = make(appengine.MultiError, len(keys))
 	} else if e, ok := err.(appengine.MultiError); ok {
 		me = e
@@ -358,25 +825,41 @@ func loadDatastore(c context.Context, cacheItems []cacheItem,
 		switch me[i] {
 		case nil:
 			pl := vals[i]
+			sortProperties(pl)
 			val := cacheItems[index].val
 			if err := setValue(val, pl); err != nil {
-				return err
+				if !isPartial(c) && !isPartialDecode(c) {
+					return err
+				}
+				cacheItems[index].err = err
+			} else {
+				cacheItems[index].pl = pl
 			}
 
 			if cacheItems[index].state == internalLock {
-				cacheItems[index].item.Flags = entityItem
-				cacheItems[index].item.Expiration = 0
-				if data, err := marshal(pl); err == nil {
-					cacheItems[index].item.Value = data
-				} else {
+				expiration := entityExpiration(c, cacheItems[index].key)
+				cacheItems[index].item.Expiration = expiration
+				data, flags, err := encodeCacheableEntityItem(c,
+					cacheItems[index].key, val, pl)
+				data, flags = newItemHeader(c, cacheItems[index].key,
+					expiration).add(data, flags)
+				switch {
+				case err != nil:
+					cacheItems[index].state = externalLock
+					warningf(c, "nds:loadDatastore marshal %s", err)
+				case len(data) > maxItemSize(c):
 					cacheItems[index].state = externalLock
-					log.Warningf(c, "nds:loadDatastore marshal %s", err)
+					warningf(c, "nds:loadDatastore %s too large to cache"+
+						" at %d bytes", cacheItems[index].key, len(data))
+				default:
+					cacheItems[index].item.Flags = flags
+					cacheItems[index].item.Value = data
 				}
 			}
 		case datastore.ErrNoSuchEntity:
 			if cacheItems[index].state == internalLock {
 				cacheItems[index].item.Flags = noneItem
-				cacheItems[index].item.Expiration = 0
+				cacheItems[index].item.Expiration = negativeCacheExpiration(c)
 				cacheItems[index].item.Value = []byte{}
 			}
 			cacheItems[index].err = datastore.ErrNoSuchEntity
@@ -397,7 +880,7 @@ func saveMemcache(c context.Context, cacheItems []cacheItem) {
 		}
 	}
 
-	if err := memcacheCompareAndSwapMulti(c, saveItems); err != nil {
-		log.Warningf(c, "nds:saveMemcache CompareAndSwapMulti %s", err)
+	if err := cacheFromContext(c).CompareAndSwapMulti(c, saveItems); err != nil {
+		warningf(c, "nds:saveMemcache CompareAndSwapMulti %s", err)
 	}
 }
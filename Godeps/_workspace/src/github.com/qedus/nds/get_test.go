@@ -3,6 +3,7 @@ package nds_test
 import (
 	"io"
 	"reflect"
+	"strings"
 	"testing"
 
 	"github.com/qedus/nds"
@@ -1153,3 +1154,517 @@ func TestGetMultiPaths(t *testing.T) {
 		t.Log("End", test.description)
 	}
 }
+
+func TestGetMultiPartial(t *testing.T) {
+	c, closeFunc := NewContext(t, nil)
+	defer closeFunc()
+
+	type oldEntity struct {
+		Val string
+	}
+	type newEntity struct {
+		Val int64
+	}
+
+	keys := []*datastore.Key{
+		datastore.NewKey(c, "Entity", "", 1, nil),
+		datastore.NewKey(c, "Entity", "", 2, nil),
+		datastore.NewKey(c, "Entity", "", 3, nil),
+	}
+	if _, err := nds.PutMulti(c, keys[:1], []newEntity{{1}}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := nds.PutMulti(c, keys[1:2], []oldEntity{{"two"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Run twice so both the datastore and memcache paths are used.
+	for i := 0; i < 2; i++ {
+		vals := make([]newEntity, len(keys))
+		err := nds.GetMultiPartial(c, keys, vals)
+		me, ok := err.(appengine.MultiError)
+		if !ok {
+			t.Fatal("expected appengine.MultiError", err)
+		}
+		if me[0] != nil {
+			t.Fatal("expected first entity to load", me[0])
+		}
+		if vals[0].Val != 1 {
+			t.Fatal("expected 1", vals[0].Val)
+		}
+		if _, ok := me[1].(*datastore.ErrFieldMismatch); !ok {
+			t.Fatal("expected datastore.ErrFieldMismatch", me[1])
+		}
+		if me[2] != datastore.ErrNoSuchEntity {
+			t.Fatal("expected datastore.ErrNoSuchEntity", me[2])
+		}
+	}
+}
+
+// prefixedTestEntity stores Name with a prefix that Load removes again so
+// tests can tell whether entities pass through Save and Load.
+type prefixedTestEntity struct {
+	Name string
+}
+
+func (pte *prefixedTestEntity) Load(pl []datastore.Property) error {
+	for _, p := range pl {
+		if p.Name == "Name" {
+			pte.Name = strings.TrimPrefix(p.Value.(string), "saved:")
+		}
+	}
+	return nil
+}
+
+func (pte *prefixedTestEntity) Save() ([]datastore.Property, error) {
+	return []datastore.Property{
+		{Name: "Name", Value: "saved:" + pte.Name},
+	}, nil
+}
+
+func TestGetMultiPropertyLoadSaverStruct(t *testing.T) {
+	c, closeFunc := NewContext(t, nil)
+	defer closeFunc()
+
+	keys := []*datastore.Key{
+		datastore.NewKey(c, "Entity", "", 1, nil),
+		datastore.NewKey(c, "Entity", "", 2, nil),
+	}
+	entities := []*prefixedTestEntity{{"one"}, {"two"}}
+	if _, err := nds.PutMulti(c, keys, entities); err != nil {
+		t.Fatal(err)
+	}
+
+	// The first GetMulti reads from the datastore and the second from
+	// memcache. Both must go through Load and allocate nil elements.
+	for i := 0; i < 2; i++ {
+		got := make([]*prefixedTestEntity, len(keys))
+		if err := nds.GetMulti(c, keys, got); err != nil {
+			t.Fatal(err)
+		}
+		for j, e := range entities {
+			if got[j] == nil || got[j].Name != e.Name {
+				t.Fatal("incorrect entity", i, j, got[j])
+			}
+		}
+	}
+
+	pl := datastore.PropertyList{}
+	if err := nds.Get(c, keys[0], &pl); err != nil {
+		t.Fatal(err)
+	}
+	if len(pl) != 1 || pl[0].Value != "saved:one" {
+		t.Fatal("expected cached entity to be stored via Save", pl)
+	}
+}
+
+func TestGetMultiHeterogeneous(t *testing.T) {
+	c, closeFunc := NewContext(t, nil)
+	defer closeFunc()
+
+	type userEntity struct {
+		Name string
+	}
+	type postEntity struct {
+		Title string
+		Likes int
+	}
+
+	keys := []*datastore.Key{
+		datastore.NewKey(c, "User", "", 1, nil),
+		datastore.NewKey(c, "Post", "", 1, nil),
+		datastore.NewKey(c, "Prefixed", "", 1, nil),
+	}
+	entities := []interface{}{
+		&userEntity{"user"},
+		&postEntity{"post", 3},
+		&prefixedTestEntity{"prefixed"},
+	}
+	if _, err := nds.PutMulti(c, keys, entities); err != nil {
+		t.Fatal(err)
+	}
+
+	// Get from the datastore then from the cache.
+	for i := 0; i < 2; i++ {
+		got := []interface{}{
+			&userEntity{},
+			&postEntity{},
+			&prefixedTestEntity{},
+		}
+		if err := nds.GetMulti(c, keys, got); err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got, entities) {
+			t.Fatal("incorrect entities", i, got)
+		}
+	}
+}
+
+func TestGetMultiInvalidInterfaceVals(t *testing.T) {
+	c, closeFunc := NewContext(t, nil)
+	defer closeFunc()
+
+	type testEntity struct {
+		IntVal int64
+	}
+
+	keys := []*datastore.Key{
+		datastore.NewKey(c, "Entity", "", 1, nil),
+		datastore.NewKey(c, "Entity", "", 2, nil),
+		datastore.NewKey(c, "Entity", "", 3, nil),
+		datastore.NewKey(c, "Entity", "", 4, nil),
+	}
+	var nilEntity *testEntity
+	vals := []interface{}{&testEntity{}, nil, testEntity{}, nilEntity}
+
+	err := nds.GetMulti(c, keys, vals)
+	me, ok := err.(appengine.MultiError)
+	if !ok {
+		t.Fatal("expected appengine.MultiError", err)
+	}
+	if me[0] != nil {
+		t.Fatal("expected valid element", me[0])
+	}
+	if me[1] != datastore.ErrInvalidEntityType ||
+		me[3] != datastore.ErrInvalidEntityType {
+		t.Fatal("expected datastore.ErrInvalidEntityType for nil vals", me)
+	}
+
+	// Non pointer vals are rejected when their entity is loaded.
+	if _, err := nds.Put(c, keys[2], &testEntity{3}); err != nil {
+		t.Fatal(err)
+	}
+	if err := nds.GetMulti(c, keys[2:3],
+		[]interface{}{testEntity{}}); err == nil {
+		t.Fatal("expected error for struct")
+	}
+}
+
+func TestGetMultiInto(t *testing.T) {
+	c, closeFunc := NewContext(t, nil)
+	defer closeFunc()
+
+	type testEntity struct {
+		Val int
+	}
+
+	keys := make([]*datastore.Key, 4)
+	for i := range keys {
+		keys[i] = datastore.NewKey(c, "Entity", "", int64(i+1), nil)
+		if _, err := nds.Put(c, keys[i], &testEntity{i + 1}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	entities := make([]testEntity, 0, len(keys))
+	dst := reflect.ValueOf(&entities).Elem()
+	for lo := 0; lo < len(keys); lo += 2 {
+		if err := nds.GetMultiInto(c, keys[lo:lo+2], dst); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if len(entities) != len(keys) || cap(entities) != len(keys) {
+		t.Fatal("expected entities to be appended in place", len(entities),
+			cap(entities))
+	}
+	for i, entity := range entities {
+		if entity.Val != i+1 {
+			t.Fatal("incorrect val", i, entity.Val)
+		}
+	}
+
+	// There is no capacity left.
+	if err := nds.GetMultiInto(c, keys[:1], dst); err == nil {
+		t.Fatal("expected capacity error")
+	} else if len(entities) != len(keys) {
+		t.Fatal("dst should be unchanged", len(entities))
+	}
+
+	// dst must be settable.
+	if err := nds.GetMultiInto(c, keys[:1],
+		reflect.ValueOf(make([]testEntity, 0, 1))); err == nil {
+		t.Fatal("expected settable error")
+	}
+
+	// Missing entities are still appended so errors line up.
+	missing := datastore.NewKey(c, "Entity", "", 100, nil)
+	entities = make([]testEntity, 1, 3)
+	dst = reflect.ValueOf(&entities).Elem()
+	err := nds.GetMultiInto(c, []*datastore.Key{keys[0], missing}, dst)
+	if me, ok := err.(appengine.MultiError); !ok {
+		t.Fatal("expected appengine.MultiError", err)
+	} else if me[0] != nil || me[1] != datastore.ErrNoSuchEntity {
+		t.Fatal("incorrect errors", me)
+	}
+	if len(entities) != 3 || entities[1].Val != 1 {
+		t.Fatal("incorrect entities", entities)
+	}
+}
+
+func TestGetMultiProps(t *testing.T) {
+	c, closeFunc := NewContext(t, nil)
+	defer closeFunc()
+
+	type testEntity struct {
+		Val int
+	}
+
+	keys := []*datastore.Key{
+		datastore.NewKey(c, "Entity", "", 1, nil),
+		datastore.NewKey(c, "Entity", "", 2, nil),
+	}
+	if _, err := nds.Put(c, keys[0], &testEntity{5}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Once to fill the cache and once to read from it.
+	for i := 0; i < 2; i++ {
+		pls, err := nds.GetMultiProps(c, keys)
+		me, ok := err.(appengine.MultiError)
+		if !ok {
+			t.Fatal("expected appengine.MultiError", err)
+		} else if me[0] != nil || me[1] != datastore.ErrNoSuchEntity {
+			t.Fatal("incorrect errors", me)
+		}
+		if len(pls) != 2 || len(pls[0]) != 1 || pls[0][0].Name != "Val" ||
+			pls[0][0].Value != int64(5) {
+			t.Fatal("incorrect properties", pls)
+		}
+	}
+}
+
+func TestGetMultiDispatch(t *testing.T) {
+	c, closeFunc := NewContext(t, nil)
+	defer closeFunc()
+
+	type user struct {
+		Name string
+	}
+	type post struct {
+		Title string
+	}
+
+	keys := []*datastore.Key{
+		datastore.NewKey(c, "User", "", 1, nil),
+		datastore.NewKey(c, "Post", "", 1, nil),
+		datastore.NewKey(c, "Post", "", 2, nil),
+	}
+	if _, err := nds.PutMulti(c, keys[:2], []interface{}{
+		&user{"alice"}, &post{"hello"},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	factory := func(kind string) interface{} {
+		switch kind {
+		case "User":
+			return &user{}
+		case "Post":
+			return &post{}
+		}
+		return nil
+	}
+
+	vals, err := nds.GetMultiDispatch(c, keys, factory)
+	me, ok := err.(appengine.MultiError)
+	if !ok {
+		t.Fatal("expected appengine.MultiError", err)
+	} else if me[0] != nil || me[1] != nil || me[2] != datastore.ErrNoSuchEntity {
+		t.Fatal("incorrect errors", me)
+	}
+	if u, ok := vals[0].(*user); !ok || u.Name != "alice" {
+		t.Fatal("incorrect user", vals[0])
+	}
+	if p, ok := vals[1].(*post); !ok || p.Title != "hello" {
+		t.Fatal("incorrect post", vals[1])
+	}
+
+	unknown := []*datastore.Key{datastore.NewKey(c, "Unknown", "", 1, nil)}
+	if _, err := nds.GetMultiDispatch(c, unknown, factory); err == nil {
+		t.Fatal("expected nil factory error")
+	}
+}
+
+func TestGetMultiMap(t *testing.T) {
+	c, closeFunc := NewContext(t, nil)
+	defer closeFunc()
+
+	type testEntity struct {
+		Val int
+	}
+
+	keys := []*datastore.Key{
+		datastore.NewKey(c, "Entity", "", 1, nil),
+		datastore.NewKey(c, "Entity", "", 2, nil),
+		datastore.NewKey(c, "Entity", "", 3, nil),
+	}
+	if _, err := nds.PutMulti(c, keys[:2],
+		[]testEntity{{1}, {2}}); err != nil {
+		t.Fatal(err)
+	}
+
+	var m map[string]*testEntity
+	if err := nds.GetMultiMap(c, keys, &m); err != nil {
+		t.Fatal(err)
+	}
+	if len(m) != 2 {
+		t.Fatal("incorrect map", m)
+	}
+	for i, key := range keys[:2] {
+		if te, ok := m[key.Encode()]; !ok || te.Val != i+1 {
+			t.Fatal("incorrect entity", i, te)
+		}
+	}
+
+	if err := nds.GetMultiMap(c, keys, m); err == nil {
+		t.Fatal("expected error for non pointer dst")
+	}
+	if err := nds.GetMultiMap(c, keys,
+		&map[string]testEntity{}); err == nil {
+		t.Fatal("expected error for non pointer map values")
+	}
+}
+
+func TestGetWithAncestors(t *testing.T) {
+	c, closeFunc := NewContext(t, nil)
+	defer closeFunc()
+
+	type folder struct {
+		Name string
+	}
+	type document struct {
+		Title string
+	}
+
+	root := datastore.NewKey(c, "Folder", "", 1, nil)
+	sub := datastore.NewKey(c, "Folder", "", 2, root)
+	doc := datastore.NewKey(c, "Document", "", 1, sub)
+	if _, err := nds.PutMulti(c, []*datastore.Key{root, sub, doc},
+		[]interface{}{&folder{"root"}, &folder{"sub"},
+			&document{"doc"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	factory := func(kind string) interface{} {
+		if kind == "Folder" {
+			return &folder{}
+		}
+		return &document{}
+	}
+
+	vals, err := nds.GetWithAncestors(c, doc, factory)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(vals) != 3 || vals[0].(*folder).Name != "root" ||
+		vals[1].(*folder).Name != "sub" ||
+		vals[2].(*document).Title != "doc" {
+		t.Fatal("incorrect chain", vals)
+	}
+
+	missing := datastore.NewKey(c, "Document", "", 2, sub)
+	if _, err := nds.GetWithAncestors(c, missing,
+		factory); err != datastore.ErrNoSuchEntity {
+		t.Fatal("expected datastore.ErrNoSuchEntity", err)
+	}
+
+	if err := nds.Delete(c, sub); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := nds.GetWithAncestors(c, doc, factory); err == nil ||
+		err == datastore.ErrNoSuchEntity {
+		t.Fatal("expected missing ancestor error", err)
+	}
+}
+
+func TestGetMultiLengthMismatch(t *testing.T) {
+	c, closeFunc := NewContext(t, nil)
+	defer closeFunc()
+
+	type testEntity struct {
+		IntVal int64
+	}
+
+	keys := []*datastore.Key{
+		datastore.NewKey(c, "Entity", "", 1, nil),
+		datastore.NewKey(c, "Entity", "", 2, nil),
+	}
+
+	// More keys than vals.
+	err := nds.GetMulti(c, keys, make([]testEntity, 1))
+	expected := "nds: keys and vals slices have different lengths " +
+		"(got 2 keys, 1 vals)"
+	if err == nil || err.Error() != expected {
+		t.Fatal("expected length error", err)
+	}
+
+	// More vals than keys.
+	err = nds.GetMulti(c, keys[:1], make([]*testEntity, 2))
+	expected = "nds: keys and vals slices have different lengths " +
+		"(got 1 keys, 2 vals)"
+	if err == nil || err.Error() != expected {
+		t.Fatal("expected length error", err)
+	}
+}
+
+// labelledEntity stores the labels of a map as a repeated property, saving
+// them in map iteration order between properties that are not indexed.
+type labelledEntity struct {
+	Labels map[string]string
+	loaded []string
+}
+
+func (le *labelledEntity) Load(pl []datastore.Property) error {
+	le.Labels = map[string]string{}
+	le.loaded = nil
+	for _, p := range pl {
+		le.loaded = append(le.loaded, p.Name+"="+p.Value.(string))
+		if p.Name == "Label" {
+			kv := strings.SplitN(p.Value.(string), "=", 2)
+			le.Labels[kv[0]] = kv[1]
+		}
+	}
+	return nil
+}
+
+func (le *labelledEntity) Save() ([]datastore.Property, error) {
+	var pl []datastore.Property
+	for k, v := range le.Labels {
+		pl = append(pl,
+			datastore.Property{Name: "Label", Value: k + "=" + v,
+				Multiple: true},
+			datastore.Property{Name: "Note", Value: k, NoIndex: true,
+				Multiple: true})
+	}
+	return pl, nil
+}
+
+func TestGetMultiMapProperties(t *testing.T) {
+	c, closeFunc := NewContext(t, nil)
+	defer closeFunc()
+
+	key := datastore.NewKey(c, "Entity", "", 1, nil)
+	labels := map[string]string{"a": "1", "b": "2", "c": "3", "d": "4"}
+	if _, err := nds.Put(c, key, &labelledEntity{Labels: labels}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Read from the datastore and then from the cache.
+	fromDatastore := &labelledEntity{}
+	if err := nds.Get(c, key, fromDatastore); err != nil {
+		t.Fatal(err)
+	}
+	fromCache := &labelledEntity{}
+	if err := nds.Get(c, key, fromCache); err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(fromDatastore.Labels, labels) {
+		t.Fatal("incorrect labels", fromDatastore.Labels)
+	}
+	if !reflect.DeepEqual(fromDatastore, fromCache) {
+		t.Fatal("expected identical entities", fromDatastore.loaded,
+			fromCache.loaded)
+	}
+}
@@ -0,0 +1,45 @@
+package nds
+
+import (
+	"errors"
+	"reflect"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/datastore"
+)
+
+// GetOrDefault loads the entity for key into val, as Get does, or copies def
+// into val and returns nil if there is no such entity. def must be a value of
+// the type val points to or a pointer to one, and is copied shallowly, so
+// slices and maps it holds are shared with val. Only
+// datastore.ErrNoSuchEntity is replaced with def; every other error, including
+// a *datastore.ErrFieldMismatch, is returned as Get returns it.
+//
+// Missing entities are cached like any other, so repeated lookups of an
+// absent entity, such as an optional settings singleton, are served from the
+// cache. Use WithNegativeCache to choose how long they are cached for.
+func GetOrDefault(c context.Context, key *datastore.Key, val interface{},
+	def interface{}) error {
+
+	v := reflect.ValueOf(val)
+	if v.Kind() != reflect.Ptr || v.IsNil() {
+		return errors.New("nds: val must be a non-nil pointer")
+	}
+	d := reflect.ValueOf(def)
+	if d.Kind() == reflect.Ptr && d.Type() != v.Type().Elem() {
+		if d.IsNil() {
+			return errors.New("nds: def is a nil pointer")
+		}
+		d = d.Elem()
+	}
+	if !d.IsValid() || d.Type() != v.Type().Elem() {
+		return errors.New("nds: def must be of the type val points to")
+	}
+
+	err := Get(c, key, val)
+	if err == datastore.ErrNoSuchEntity {
+		v.Elem().Set(d)
+		return nil
+	}
+	return err
+}
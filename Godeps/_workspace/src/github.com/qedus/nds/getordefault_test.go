@@ -0,0 +1,49 @@
+package nds_test
+
+import (
+	"testing"
+
+	"github.com/qedus/nds"
+	"google.golang.org/appengine/datastore"
+)
+
+func TestGetOrDefault(t *testing.T) {
+	c, closeFunc := NewContext(t, nil)
+	defer closeFunc()
+
+	type testEntity struct {
+		Val int
+	}
+
+	key := datastore.NewKey(c, "Entity", "", 1, nil)
+	def := testEntity{5}
+
+	// Missing entities get the default, by value or by pointer.
+	for _, d := range []interface{}{def, &def} {
+		te := &testEntity{}
+		if err := nds.GetOrDefault(c, key, te, d); err != nil {
+			t.Fatal(err)
+		} else if te.Val != 5 {
+			t.Fatal("expected default val", te.Val)
+		}
+	}
+
+	if _, err := nds.Put(c, key, &testEntity{1}); err != nil {
+		t.Fatal(err)
+	}
+	te := &testEntity{}
+	if err := nds.GetOrDefault(c, key, te, def); err != nil {
+		t.Fatal(err)
+	} else if te.Val != 1 {
+		t.Fatal("incorrect val", te.Val)
+	}
+
+	// Other errors are not replaced.
+	if err := nds.GetOrDefault(c, nil, &testEntity{},
+		def); err != datastore.ErrInvalidKey {
+		t.Fatal("expected invalid key", err)
+	}
+	if err := nds.GetOrDefault(c, key, &testEntity{}, 5); err == nil {
+		t.Fatal("expected error for mismatched default")
+	}
+}
@@ -0,0 +1,93 @@
+package nds
+
+import (
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/memcache"
+)
+
+// getOrPutPollInterval is how often GetOrPut checks whether another request
+// has finished populating an entity.
+var getOrPutPollInterval = 50 * time.Millisecond
+
+// GetOrPut loads the entity for key into val, which must be a struct pointer
+// or implement datastore.PropertyLoadSaver, as Get does. If there is no such
+// entity it calls supplier to fill val and then puts val with key, so the
+// entity is computed once and cached from then on.
+//
+// Concurrent calls for a missing entity are serialized with a populate lock in
+// the cache. Only the caller holding the lock runs supplier while the others
+// wait, for at most the lock time, for the entity to appear and then load it.
+// If supplier returns an error nothing is put and the error is returned.
+// Within a transaction no lock is taken as the transaction itself serializes
+// writers.
+func GetOrPut(c context.Context, key *datastore.Key, val interface{},
+	supplier func() error) error {
+
+	err := Get(c, key, val)
+	if err != datastore.ErrNoSuchEntity {
+		return err
+	}
+
+	if _, ok := transactionFromContext(c); ok {
+		return supplyAndPut(c, key, val, supplier)
+	}
+
+	expiration, err := lockTime(c)
+	if err != nil {
+		return err
+	}
+	populateKey := createSuffixedMemcacheKey(c, key, ":populate")
+	deadline := time.Now().Add(expiration)
+
+	for {
+		err := cacheFromContext(c).AddMulti(c, []*memcache.Item{
+			newLockItem(populateKey, expiration),
+		})
+		if err == nil {
+			// Another request may have populated the entity before the lock
+			// was taken.
+			defer func() {
+				if err := cacheFromContext(c).DeleteMulti(c,
+					[]string{populateKey}); err != nil &&
+					!isCacheMissErrors(err) {
+					warningf(c, "nds:GetOrPut DeleteMulti %s", err)
+				}
+			}()
+			err := Get(WithStrongRead(c), key, val)
+			if err != datastore.ErrNoSuchEntity {
+				return err
+			}
+			return supplyAndPut(c, key, val, supplier)
+		} else if !isNotStoredErrors(err) {
+			// The cache cannot serialize callers so just populate.
+			warningf(c, "nds:GetOrPut AddMulti %s", err)
+			return supplyAndPut(c, key, val, supplier)
+		}
+
+		if time.Now().After(deadline) {
+			return supplyAndPut(c, key, val, supplier)
+		}
+		select {
+		case <-c.Done():
+			return c.Err()
+		case <-time.After(getOrPutPollInterval):
+		}
+
+		if err := Get(c, key, val); err != datastore.ErrNoSuchEntity {
+			return err
+		}
+	}
+}
+
+func supplyAndPut(c context.Context, key *datastore.Key, val interface{},
+	supplier func() error) error {
+
+	if err := supplier(); err != nil {
+		return err
+	}
+	_, err := Put(c, key, val)
+	return err
+}
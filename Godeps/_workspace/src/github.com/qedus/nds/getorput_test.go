@@ -0,0 +1,65 @@
+package nds_test
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/qedus/nds"
+	"google.golang.org/appengine/datastore"
+)
+
+func TestGetOrPut(t *testing.T) {
+	c, closeFunc := NewContext(t, nil)
+	defer closeFunc()
+
+	type testEntity struct {
+		Val int
+	}
+
+	key := datastore.NewKey(c, "Entity", "", 1, nil)
+
+	expectedErr := errors.New("expected error")
+	if err := nds.GetOrPut(c, key, &testEntity{}, func() error {
+		return expectedErr
+	}); err != expectedErr {
+		t.Fatal("expected supplier error", err)
+	}
+	if err := nds.Get(c, key, &testEntity{}); err != datastore.ErrNoSuchEntity {
+		t.Fatal("expected nothing to be put", err)
+	}
+
+	var mu sync.Mutex
+	calls := 0
+	wg := sync.WaitGroup{}
+	entities := make([]testEntity, 3)
+	errs := make([]error, len(entities))
+	for i := range entities {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			te := &entities[i]
+			errs[i] = nds.GetOrPut(c, key, te, func() error {
+				mu.Lock()
+				calls++
+				mu.Unlock()
+				time.Sleep(100 * time.Millisecond)
+				te.Val = 42
+				return nil
+			})
+		}(i)
+	}
+	wg.Wait()
+
+	for i, err := range errs {
+		if err != nil {
+			t.Fatal(i, err)
+		} else if entities[i].Val != 42 {
+			t.Fatal("incorrect val", i, entities[i].Val)
+		}
+	}
+	if calls != 1 {
+		t.Fatal("expected supplier to run once", calls)
+	}
+}
@@ -0,0 +1,158 @@
+package nds
+
+import (
+	"encoding/binary"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/memcache"
+)
+
+// refreshPollDelay is how long a reader waiting for a refresh first waits
+// before reading the cache again. It doubles after every read.
+const refreshPollDelay = 5 * time.Millisecond
+
+var graceRefreshKey = "used for grace refresh"
+
+// WithGraceRefresh returns a context that makes PutMulti and DeleteMulti
+// replace the cache entry of each written entity with a refresh marker lasting
+// for d, instead of removing it. The first reader to find a marker, through
+// any context, claims it and reads the entity through to the cache while
+// other readers, rather than all reading the datastore at once, wait for up
+// to d for the entity to be cached. This softens the burst of datastore reads
+// that follows the invalidation of a hot entity. Readers that are still
+// waiting when d elapses, or when their context is done, read the datastore
+// without caching as they would for any other lock.
+//
+// d should be short, a little longer than a datastore read. Markers are not
+// written for writes within a transaction and a d of zero or less disables
+// them, which is the default.
+func WithGraceRefresh(c context.Context, d time.Duration) context.Context {
+	return context.WithValue(c, &graceRefreshKey, d)
+}
+
+func graceRefresh(c context.Context) (time.Duration, bool) {
+	d, _ := c.Value(&graceRefreshKey).(time.Duration)
+	if d > memcacheMaxExpiration {
+		d = memcacheMaxExpiration
+	}
+	return d, d > 0
+}
+
+// newRefreshItems returns a refresh marker lasting for d for each of
+// memcacheKeys. Markers hold a lock value whose time is when waiting for the
+// refresh is given up on.
+func newRefreshItems(memcacheKeys []string, d time.Duration) []*memcache.Item {
+	// Memcache expirations are whole seconds, and zero means never, so the
+	// marker outlasts d slightly rather than forever.
+	expiration := d
+	if expiration < time.Second {
+		expiration = time.Second
+	}
+	deadline := uint64(time.Now().Add(d).UnixNano())
+
+	items := make([]*memcache.Item, len(memcacheKeys))
+	for i, memcacheKey := range memcacheKeys {
+		value := itemLock()
+		binary.BigEndian.PutUint64(value[4:], deadline)
+		items[i] = &memcache.Item{
+			Key:        memcacheKey,
+			Flags:      refreshItem,
+			Value:      value,
+			Expiration: expiration,
+		}
+	}
+	return items
+}
+
+// setRefreshMarkers replaces the cache entries at memcacheKeys with refresh
+// markers lasting for d, reporting whether it succeeded.
+func setRefreshMarkers(c context.Context, memcacheKeys []string,
+	d time.Duration) bool {
+
+	if err := invalidationCache(c).SetMulti(c,
+		newRefreshItems(memcacheKeys, d)); err != nil {
+		warningf(c, "nds:setRefreshMarkers SetMulti %s", err)
+		return false
+	}
+	return true
+}
+
+// claimRefreshItem turns the refresh marker item into a refresh lock, to
+// replace the marker with using CAS. The lock keeps the time after which
+// other readers stop waiting for it.
+func claimRefreshItem(item *memcache.Item, expiration time.Duration) {
+	value := itemLock()
+	if len(item.Value) == lockValueSize {
+		copy(value[4:], item.Value[4:])
+	}
+	item.Flags = lockItem | refreshFlag
+	item.Value = value
+	item.Expiration = expiration
+}
+
+// refreshWaitDeadline returns the time until which readers wait for the
+// refresh lock item to be replaced by the entity, or the zero time if item is
+// not a refresh lock.
+func refreshWaitDeadline(item *memcache.Item) time.Time {
+	if item.Flags&refreshFlag == 0 || len(item.Value) != lockValueSize {
+		return time.Time{}
+	}
+	return time.Unix(0, int64(binary.BigEndian.Uint64(item.Value[4:])))
+}
+
+// waitForRefreshes reads the cache again, with increasing delays, for the
+// cache items that are locked by another reader refreshing them until they
+// are cached or their waits run out.
+func waitForRefreshes(c context.Context, cacheItems []cacheItem) {
+	delay := refreshPollDelay
+	for {
+		now := time.Now()
+		var first time.Time
+		for i, cacheItem := range cacheItems {
+			if cacheItem.state != externalLock ||
+				cacheItem.waitUntil.IsZero() {
+				continue
+			}
+			if !now.Before(cacheItem.waitUntil) {
+				cacheItems[i].waitUntil = time.Time{}
+			} else if first.IsZero() || cacheItem.waitUntil.Before(first) {
+				first = cacheItem.waitUntil
+			}
+		}
+		if first.IsZero() {
+			return
+		}
+
+		wait := delay
+		if d := first.Sub(now); d < wait {
+			wait = d
+		}
+		select {
+		case <-time.After(wait):
+		case <-c.Done():
+			for i := range cacheItems {
+				cacheItems[i].waitUntil = time.Time{}
+			}
+			return
+		}
+
+		for i, cacheItem := range cacheItems {
+			if cacheItem.state == externalLock &&
+				!cacheItem.waitUntil.IsZero() {
+				cacheItems[i].state = miss
+				cacheItems[i].waitUntil = time.Time{}
+			}
+		}
+		loadMemcache(c, cacheItems)
+
+		// Entries that are no longer locked are read without being cached
+		// rather than locked again.
+		for i, cacheItem := range cacheItems {
+			if cacheItem.state == miss {
+				cacheItems[i].state = externalLock
+			}
+		}
+		delay *= 2
+	}
+}
@@ -0,0 +1,91 @@
+package nds_test
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/qedus/nds"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/datastore"
+)
+
+func TestGraceRefresh(t *testing.T) {
+	c, closeFunc := NewContext(t, nil)
+	defer closeFunc()
+
+	type testEntity struct {
+		Val int
+	}
+
+	mu := sync.Mutex{}
+	reads := 0
+	nds.SetDatastoreGetMulti(func(c context.Context,
+		keys []*datastore.Key, vals interface{}) error {
+		if len(keys) > 0 {
+			mu.Lock()
+			reads += len(keys)
+			mu.Unlock()
+			// Slow reads down so the readers below overlap.
+			time.Sleep(50 * time.Millisecond)
+		}
+		return datastore.GetMulti(c, keys, vals)
+	})
+	defer nds.SetDatastoreGetMulti(datastore.GetMulti)
+
+	key := datastore.NewKey(c, "Entity", "", 1, nil)
+	if _, err := nds.Put(c, key, &testEntity{1}); err != nil {
+		t.Fatal(err)
+	}
+
+	// getConcurrently gets the entity from many readers at once, returning
+	// the number of datastore reads made.
+	getConcurrently := func(expected error, val int) int {
+		mu.Lock()
+		reads = 0
+		mu.Unlock()
+
+		wg := sync.WaitGroup{}
+		for i := 0; i < 10; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				te := &testEntity{}
+				if err := nds.Get(c, key, te); err != expected {
+					t.Error("unexpected error", err)
+				} else if err == nil && te.Val != val {
+					t.Error("incorrect val", te.Val)
+				}
+			}()
+		}
+		wg.Wait()
+
+		mu.Lock()
+		defer mu.Unlock()
+		return reads
+	}
+
+	gc := nds.WithGraceRefresh(c, 5*time.Second)
+	if _, err := nds.Put(gc, key, &testEntity{2}); err != nil {
+		t.Fatal(err)
+	}
+	if n := getConcurrently(nil, 2); n != 1 {
+		t.Fatal("expected one datastore read after put", n)
+	}
+
+	if err := nds.Delete(gc, key); err != nil {
+		t.Fatal(err)
+	}
+	if n := getConcurrently(datastore.ErrNoSuchEntity, 0); n != 1 {
+		t.Fatal("expected one datastore read after delete", n)
+	}
+
+	// Without grace refresh every reader goes to the datastore while the
+	// first one fills the cache.
+	if _, err := nds.Put(c, key, &testEntity{3}); err != nil {
+		t.Fatal(err)
+	}
+	if n := getConcurrently(nil, 3); n <= 1 {
+		t.Fatal("expected many datastore reads", n)
+	}
+}
@@ -0,0 +1,148 @@
+package nds
+
+import (
+	"encoding/binary"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/memcache"
+)
+
+// timeHeaderSize is the size of each time prepended to the value of entity
+// items carrying expiryFlag or writtenFlag.
+const timeHeaderSize = 8
+
+// kindLengthSize is the size of the length prepended to the kind of entity
+// items carrying kindFlag, and to the generation of those carrying
+// generationFlag.
+const kindLengthSize = 2
+
+// timeNow returns the current time. It is a variable so tests can move the
+// clock the item header is written and checked with.
+var timeNow = time.Now
+
+// itemHeader holds the fields prepended to the value of an entity item. The
+// expiry time comes first if the item carries expiryFlag, followed by the
+// write time if it carries writtenFlag, then the length prefixed kind if it
+// carries kindFlag and the length prefixed generation if it carries
+// generationFlag. Zero fields are not stored.
+type itemHeader struct {
+	// expiry is when the item expires, as used by WithStaleWhileRevalidate.
+	expiry time.Time
+
+	// written is when the item was written, as used by WithMaxCacheAge and
+	// WithEntryAges.
+	written time.Time
+
+	// kind is the kind of the key of the entity, as used by WithKindHeader.
+	kind string
+
+	// generation is the cache generation the item was written in, as used
+	// by WithCacheGeneration.
+	generation string
+}
+
+// newItemHeader returns the header of the entity item for key written now
+// with c that expires after expiration, or never if expiration is zero.
+func newItemHeader(c context.Context, key *datastore.Key,
+	expiration time.Duration) itemHeader {
+
+	now := timeNow()
+	header := itemHeader{}
+	if expiration > 0 {
+		header.expiry = now.Add(expiration)
+	}
+	if _, ok := maxCacheAge(c); ok || isEntryAges(c) {
+		header.written = now
+	}
+	if isKindHeader(c) {
+		header.kind = key.Kind()
+	}
+	header.generation = cacheGeneration(c)
+	return header
+}
+
+// add prepends the header to data, the value of an entity item with flags.
+func (h itemHeader) add(data []byte, flags uint32) ([]byte, uint32) {
+	times := make([]time.Time, 0, 2)
+	if !h.expiry.IsZero() {
+		times = append(times, h.expiry)
+		flags |= expiryFlag
+	}
+	if !h.written.IsZero() {
+		times = append(times, h.written)
+		flags |= writtenFlag
+	}
+	size := timeHeaderSize * len(times)
+	if h.kind != "" {
+		size += kindLengthSize + len(h.kind)
+		flags |= kindFlag
+	}
+	if h.generation != "" {
+		size += kindLengthSize + len(h.generation)
+		flags |= generationFlag
+	}
+	if size == 0 {
+		return data, flags
+	}
+
+	header := make([]byte, 0, size+len(data))
+	for _, t := range times {
+		header = appendUint64(header, uint64(t.UnixNano()))
+	}
+	if h.kind != "" {
+		header = appendString(header, h.kind)
+	}
+	if h.generation != "" {
+		header = appendString(header, h.generation)
+	}
+	return append(header, data...), flags
+}
+
+func appendString(b []byte, s string) []byte {
+	length := make([]byte, kindLengthSize)
+	binary.BigEndian.PutUint16(length, uint16(len(s)))
+	return append(append(b, length...), s...)
+}
+
+func appendUint64(b []byte, v uint64) []byte {
+	buf := make([]byte, timeHeaderSize)
+	binary.BigEndian.PutUint64(buf, v)
+	return append(b, buf...)
+}
+
+// splitItemHeader returns the header of an entity item and its value without
+// the header.
+func splitItemHeader(item *memcache.Item) (itemHeader, []byte) {
+	header, data := itemHeader{}, item.Value
+	if item.Flags&expiryFlag != 0 && len(data) >= timeHeaderSize {
+		header.expiry = time.Unix(0, int64(binary.BigEndian.Uint64(data)))
+		data = data[timeHeaderSize:]
+	}
+	if item.Flags&writtenFlag != 0 && len(data) >= timeHeaderSize {
+		header.written = time.Unix(0, int64(binary.BigEndian.Uint64(data)))
+		data = data[timeHeaderSize:]
+	}
+	if item.Flags&kindFlag != 0 {
+		header.kind, data = splitString(data)
+	}
+	if item.Flags&generationFlag != 0 {
+		header.generation, data = splitString(data)
+	}
+	return header, data
+}
+
+// splitString returns the length prefixed string at the start of data and the
+// rest of data, or an empty string and data if data is too short to hold one.
+func splitString(data []byte) (string, []byte) {
+	if len(data) < kindLengthSize {
+		return "", data
+	}
+	n := int(binary.BigEndian.Uint16(data))
+	if len(data) < kindLengthSize+n {
+		return "", data
+	}
+	data = data[kindLengthSize:]
+	return string(data[:n]), data[n:]
+}
@@ -0,0 +1,43 @@
+package nds
+
+import (
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/datastore"
+)
+
+var idAssignedHandlerKey = "used for ID assigned handler"
+
+// WithIDAssignedHandler returns a context that makes PutMulti call f with the
+// index and the complete key of each entity put with an incomplete key, once
+// the datastore has assigned its ID, so callers need not compare the returned
+// keys with those given. f can, for example, warm the cache for the new entity
+// or emit an event. It is called from the goroutine calling PutMulti after the
+// put, and only if PutMulti returns the keys of the entities it put, including
+// those put before a *DeadlineBudgetError. Within a transaction f is called
+// before the transaction commits, so the entity may never exist.
+func WithIDAssignedHandler(c context.Context,
+	f func(index int, key *datastore.Key)) context.Context {
+	return context.WithValue(c, &idAssignedHandlerKey, f)
+}
+
+func idAssignedHandler(c context.Context) (func(int, *datastore.Key), bool) {
+	f, _ := c.Value(&idAssignedHandlerKey).(func(int, *datastore.Key))
+	return f, f != nil
+}
+
+func withoutIDAssignedHandler(c context.Context) context.Context {
+	return context.WithValue(c, &idAssignedHandlerKey,
+		(func(int, *datastore.Key))(nil))
+}
+
+// idsAssigned calls f for each of keys that was incomplete and has been put
+// with the key at the same index of putKeys.
+func idsAssigned(f func(int, *datastore.Key), keys,
+	putKeys []*datastore.Key) {
+
+	for i, putKey := range putKeys {
+		if keys[i] != nil && keys[i].Incomplete() && putKey != nil {
+			f(i, putKey)
+		}
+	}
+}
@@ -0,0 +1,43 @@
+package nds_test
+
+import (
+	"testing"
+
+	"github.com/qedus/nds"
+	"google.golang.org/appengine/datastore"
+)
+
+func TestWithIDAssignedHandler(t *testing.T) {
+	c, closeFunc := NewContext(t, nil)
+	defer closeFunc()
+
+	type testEntity struct {
+		Val int
+	}
+
+	assigned := map[int]*datastore.Key{}
+	ic := nds.WithIDAssignedHandler(c, func(index int, key *datastore.Key) {
+		assigned[index] = key
+	})
+
+	keys := []*datastore.Key{
+		datastore.NewIncompleteKey(c, "Entity", nil),
+		datastore.NewKey(c, "Entity", "", 1, nil),
+		datastore.NewIncompleteKey(c, "Entity", nil),
+	}
+	entities := []testEntity{{1}, {2}, {3}}
+	putKeys, err := nds.PutMulti(ic, keys, entities)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(assigned) != 2 {
+		t.Fatal("expected two assigned keys", len(assigned))
+	}
+	for _, index := range []int{0, 2} {
+		if key := assigned[index]; key == nil || key.Incomplete() ||
+			!key.Equal(putKeys[index]) {
+			t.Fatal("incorrect assigned key", index, key)
+		}
+	}
+}
@@ -0,0 +1,121 @@
+package nds
+
+import (
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/datastore"
+)
+
+// CacheEntry describes the cache item an entity is held in, as reported by
+// InspectCache.
+type CacheEntry struct {
+	Key *datastore.Key
+
+	// Present is whether the cache holds an item for Key. The remaining
+	// fields are only set if it does.
+	Present bool
+
+	// Type is one of "none" for an entity cached as missing, "entity",
+	// "lock", "key", "tombstone", "refresh" or "unknown" for items written
+	// by a newer version of NDS.
+	Type string
+
+	// Flags are the raw memcache flags of the item.
+	Flags uint32
+
+	// Compressed is whether the value of an entity is compressed.
+	Compressed bool
+
+	// Size is the length of the item value in bytes.
+	Size int
+
+	// Expiry is when the entity expires from the cache. memcache does not
+	// report expirations, so it is only known for entities cached using
+	// WithStaleWhileRevalidate and is otherwise the zero time.
+	Expiry time.Time
+
+	// Written is when the entity was cached. It is only known for entities
+	// cached using WithMaxCacheAge and is otherwise the zero time.
+	Written time.Time
+}
+
+// InspectCache returns the state of the cache items for keys, for debugging
+// entries that appear to be stuck. The cache is read directly, the local cache
+// and transactions are not consulted, and nothing is ever modified. The
+// returned types and flags are internal details of NDS that can change
+// between versions, so production code should use GetMulti instead.
+func InspectCache(c context.Context,
+	keys []*datastore.Key) ([]CacheEntry, error) {
+
+	if err := checkCacheKeyPrefix(c); err != nil {
+		return nil, err
+	}
+
+	physicalKeys := keys
+	if f, ok := keyMapperFromContext(c); ok {
+		var err error
+		if physicalKeys, err = mapKeys(keys, f); err != nil {
+			return nil, err
+		}
+	}
+
+	entries := make([]CacheEntry, len(keys))
+	err := runBatches(c, len(keys), batchSize(c, getMultiLimit),
+		func(lo, hi int) error {
+			return inspectMulti(c, physicalKeys[lo:hi], entries[lo:hi])
+		})
+	if err != nil {
+		return nil, err
+	}
+	for i, key := range keys {
+		entries[i].Key = key
+	}
+	return entries, nil
+}
+
+func inspectMulti(c context.Context, keys []*datastore.Key,
+	entries []CacheEntry) error {
+
+	memcacheKeys := make([]string, len(keys))
+	for i, key := range keys {
+		memcacheKeys[i] = createMemcacheKey(c, key)
+	}
+
+	items, err := cacheFromContext(c).GetMulti(c, memcacheKeys)
+	if err != nil {
+		return err
+	}
+
+	for i, memcacheKey := range memcacheKeys {
+		item, ok := items[memcacheKey]
+		if !ok {
+			continue
+		}
+
+		entry := &entries[i]
+		entry.Present = true
+		entry.Flags = item.Flags
+		entry.Size = len(item.Value)
+		switch itemType(item.Flags) {
+		case noneItem:
+			entry.Type = "none"
+		case entityItem:
+			entry.Type = "entity"
+			entry.Compressed = item.Flags&compressedFlag != 0
+			header, _ := splitItemHeader(item)
+			entry.Expiry, entry.Written = header.expiry, header.written
+		case lockItem:
+			entry.Type = "lock"
+		case keyItem:
+			entry.Type = "key"
+		case tombstoneItem:
+			entry.Type = "tombstone"
+		case refreshItem:
+			entry.Type = "refresh"
+		default:
+			entry.Type = "unknown"
+		}
+	}
+	return nil
+}
@@ -0,0 +1,71 @@
+package nds_test
+
+import (
+	"testing"
+
+	"github.com/qedus/nds"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/memcache"
+)
+
+func TestInspectCache(t *testing.T) {
+	c, closeFunc := NewContext(t, nil)
+	defer closeFunc()
+
+	type testEntity struct {
+		Val int
+	}
+
+	keys := []*datastore.Key{
+		datastore.NewKey(c, "Entity", "", 1, nil),
+		datastore.NewKey(c, "Entity", "", 2, nil),
+		datastore.NewKey(c, "Entity", "", 3, nil),
+		datastore.NewKey(c, "Entity", "", 4, nil),
+	}
+	if _, err := nds.Put(c, keys[0], &testEntity{1}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Cache the first entity and the second as missing, then lock the third.
+	if _, err := nds.Warm(c, keys[:2]); err != nil {
+		t.Fatal(err)
+	}
+	if err := memcache.Set(c, &memcache.Item{
+		Key:   nds.CreateMemcacheKey(keys[2]),
+		Flags: nds.LockItem,
+		Value: []byte{1, 2, 3, 4},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	rc := &recordingCache{}
+	entries, err := nds.InspectCache(nds.WithCache(c, rc), keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !entries[0].Present || entries[0].Type != "entity" ||
+		entries[0].Size == 0 {
+		t.Fatal("expected cached entity", entries[0])
+	}
+	if !entries[1].Present || entries[1].Type != "none" {
+		t.Fatal("expected entity cached as missing", entries[1])
+	}
+	if !entries[2].Present || entries[2].Type != "lock" ||
+		entries[2].Flags != nds.LockItem || entries[2].Size != 4 {
+		t.Fatal("expected lock", entries[2])
+	}
+	if entries[3].Present || entries[3].Type != "" {
+		t.Fatal("expected no cache item", entries[3])
+	}
+	for i, entry := range entries {
+		if !entry.Key.Equal(keys[i]) {
+			t.Fatal("incorrect key", i, entry.Key)
+		}
+	}
+
+	if len(rc.setItems) != 0 || len(rc.addItems) != 0 ||
+		len(rc.casItems) != 0 || len(rc.delKeys) != 0 {
+		t.Fatal("expected cache not to be modified")
+	}
+}
@@ -0,0 +1,68 @@
+package nds
+
+import (
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/datastore"
+)
+
+// ReadInterceptor resolves entities for GetMulti from a cache of the caller's
+// own. It is given the keys GetMulti still has to resolve and returns the
+// entities it found, keyed by their index in keys, along with the keys that
+// GetMulti should still look up.
+type ReadInterceptor func(keys []*datastore.Key) (found map[int]interface{},
+	remaining []*datastore.Key)
+
+var readInterceptorKey = "used for read interceptor"
+
+// WithReadInterceptor returns a context that makes GetMulti call f before
+// reading the cache, so callers with their own in-memory cache can resolve
+// entities themselves. f is called once per batch with the keys not resolved
+// by WithPreloaded, and only the keys it returns in remaining are looked up in
+// the cache and datastore. Keys that are neither found nor remaining are
+// reported as datastore.ErrNoSuchEntity, so f can resolve missing entities
+// too. The entities in found are set into vals as with WithPreloaded and are
+// never written to any cache.
+//
+// Within a transaction, with WithNoCache or with WithStrongRead, f is not
+// called.
+func WithReadInterceptor(c context.Context, f ReadInterceptor) context.Context {
+	return context.WithValue(c, &readInterceptorKey, f)
+}
+
+func loadIntercepted(c context.Context, cacheItems []cacheItem) {
+	f, ok := c.Value(&readInterceptorKey).(ReadInterceptor)
+	if !ok || f == nil {
+		return
+	}
+
+	keys := make([]*datastore.Key, 0, len(cacheItems))
+	indexes := make([]int, 0, len(cacheItems))
+	for i, cacheItem := range cacheItems {
+		if cacheItem.state == miss {
+			keys = append(keys, cacheItem.key)
+			indexes = append(indexes, i)
+		}
+	}
+	if len(keys) == 0 {
+		return
+	}
+
+	found, remaining := f(keys)
+	lookup := make(map[string]bool, len(remaining))
+	for _, key := range remaining {
+		if key != nil {
+			lookup[key.String()] = true
+		}
+	}
+
+	for i, index := range indexes {
+		if entity, ok := found[i]; ok && entity != nil {
+			cacheItems[index].err = setPreloadedValue(cacheItems[index].val,
+				entity)
+			cacheItems[index].state = done
+		} else if !lookup[keys[i].String()] {
+			cacheItems[index].err = datastore.ErrNoSuchEntity
+			cacheItems[index].state = done
+		}
+	}
+}
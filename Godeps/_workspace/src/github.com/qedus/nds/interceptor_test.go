@@ -0,0 +1,78 @@
+package nds_test
+
+import (
+	"testing"
+
+	"github.com/qedus/nds"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+)
+
+func TestWithReadInterceptor(t *testing.T) {
+	c, closeFunc := NewContext(t, nil)
+	defer closeFunc()
+
+	type testEntity struct {
+		Val int
+	}
+
+	keys := []*datastore.Key{
+		datastore.NewKey(c, "Entity", "", 1, nil),
+		datastore.NewKey(c, "Entity", "", 2, nil),
+		datastore.NewKey(c, "Entity", "", 3, nil),
+	}
+	if _, err := nds.PutMulti(c, keys,
+		[]testEntity{{1}, {2}, {3}}); err != nil {
+		t.Fatal(err)
+	}
+
+	// The interceptor resolves the second entity, reports the third as
+	// missing and leaves the first to NDS.
+	var intercepted []*datastore.Key
+	rc := &recordingCache{}
+	ic := nds.WithReadInterceptor(nds.WithCache(c, rc),
+		func(keys []*datastore.Key) (map[int]interface{},
+			[]*datastore.Key) {
+			intercepted = keys
+			return map[int]interface{}{1: &testEntity{20}},
+				[]*datastore.Key{keys[0]}
+		})
+
+	entities := make([]testEntity, len(keys))
+	err := nds.GetMulti(ic, keys, entities)
+	me, ok := err.(appengine.MultiError)
+	if !ok {
+		t.Fatal("expected appengine.MultiError", err)
+	}
+	if me[0] != nil || me[1] != nil || me[2] != datastore.ErrNoSuchEntity {
+		t.Fatal("incorrect errors", me)
+	}
+	if entities[0].Val != 1 || entities[1].Val != 20 {
+		t.Fatal("incorrect vals", entities)
+	}
+	if len(intercepted) != 3 {
+		t.Fatal("expected every key to be intercepted", intercepted)
+	}
+
+	// Only the remaining key should touch the cache.
+	for _, key := range rc.getKeys {
+		if key != nds.CacheKey(c, keys[0]) {
+			t.Fatal("intercepted key read from cache", key)
+		}
+	}
+	for _, item := range append(rc.setItems, rc.casItems...) {
+		if item.Key != nds.CacheKey(c, keys[0]) {
+			t.Fatal("intercepted entity written to cache", item.Key)
+		}
+	}
+
+	// Strong reads are not intercepted.
+	intercepted = nil
+	if err := nds.GetMulti(nds.WithStrongRead(ic), keys,
+		entities); err != nil {
+		t.Fatal(err)
+	}
+	if intercepted != nil || entities[1].Val != 2 {
+		t.Fatal("expected strong read not to be intercepted")
+	}
+}
@@ -0,0 +1,37 @@
+package nds
+
+import (
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/datastore"
+)
+
+var invalidationHookKey = "used for invalidation hook"
+
+// WithInvalidationHook returns a context that makes NDS call f with the keys
+// of the entities whose cache entries it has just invalidated. f is called
+// once PutMulti has cleared the cache after writing, once DeleteMulti has
+// deleted locked entities, and once a transaction run with RunInTransaction
+// has committed and locked the entities written within it. Only distinct
+// complete keys are passed to f and the datastore write has already happened
+// when f is called, so it cannot be undone by anything f does. This allows
+// invalidations to be forwarded to other caches, such as one in another
+// region.
+func WithInvalidationHook(c context.Context,
+	f func(keys []*datastore.Key)) context.Context {
+	return context.WithValue(c, &invalidationHookKey, f)
+}
+
+// invalidated clears the unique mappings to keys and their projections, evicts
+// their dependents and reports keys to the invalidation hook of c, if any.
+func invalidated(c context.Context, keys []*datastore.Key) {
+	if len(keys) == 0 {
+		return
+	}
+	clearUniqueMappings(c, keys)
+	clearProjections(c, keys)
+	evictDependents(c, keys)
+	if f, ok := c.Value(&invalidationHookKey).(func([]*datastore.Key)); ok &&
+		f != nil {
+		f(keys)
+	}
+}
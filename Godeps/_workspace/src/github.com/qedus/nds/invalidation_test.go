@@ -0,0 +1,62 @@
+package nds_test
+
+import (
+	"testing"
+
+	"github.com/qedus/nds"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/datastore"
+)
+
+func TestWithInvalidationHook(t *testing.T) {
+	c, closeFunc := NewContext(t, nil)
+	defer closeFunc()
+
+	type testEntity struct {
+		Val int
+	}
+
+	var invalidated [][]*datastore.Key
+	ic := nds.WithInvalidationHook(c, func(keys []*datastore.Key) {
+		invalidated = append(invalidated, keys)
+	})
+
+	keys := []*datastore.Key{
+		datastore.NewKey(c, "Entity", "", 1, nil),
+		datastore.NewKey(c, "Entity", "", 1, nil),
+		datastore.NewIncompleteKey(c, "Entity", nil),
+	}
+	if _, err := nds.PutMulti(ic, keys,
+		[]testEntity{{1}, {2}, {3}}); err != nil {
+		t.Fatal(err)
+	}
+	if len(invalidated) != 1 || len(invalidated[0]) != 1 ||
+		!invalidated[0][0].Equal(keys[0]) {
+		t.Fatal("expected distinct complete keys", invalidated)
+	}
+
+	if err := nds.Delete(ic, keys[0]); err != nil {
+		t.Fatal(err)
+	}
+	if len(invalidated) != 2 || !invalidated[1][0].Equal(keys[0]) {
+		t.Fatal("expected delete invalidation", invalidated)
+	}
+
+	// Transactions report their keys once they commit.
+	key := datastore.NewKey(c, "Entity", "", 2, nil)
+	if err := nds.RunInTransaction(ic, func(tc context.Context) error {
+		if _, err := nds.Put(tc, key, &testEntity{4}); err != nil {
+			return err
+		}
+		if len(invalidated) != 2 {
+			t.Fatal("expected no invalidation before commit", invalidated)
+		}
+		return nil
+	}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if len(invalidated) != 3 || len(invalidated[2]) != 1 ||
+		!invalidated[2][0].Equal(key) {
+		t.Fatal("expected transaction invalidation", invalidated)
+	}
+}
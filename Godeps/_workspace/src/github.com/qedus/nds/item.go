@@ -0,0 +1,125 @@
+package nds
+
+import (
+	"reflect"
+	"sort"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/memcache"
+)
+
+// encodeEntityItem serializes pl, the entity for key, with codec into the
+// value and flags of a memcache entity item.
+func encodeEntityItem(c context.Context, key *datastore.Key, codec Codec,
+	pl datastore.PropertyList) ([]byte, uint32, error) {
+
+	pl, flags, err := compressFields(c, key, pl)
+	if err != nil {
+		return nil, 0, err
+	}
+	data, err := codec.Marshal(pl)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	flags |= entityItem
+	if minBytes, ok := compressionThreshold(c); ok && len(data) >= minBytes {
+		if data, err = compress(data); err != nil {
+			return nil, 0, err
+		}
+		flags |= compressedFlag
+	}
+	data, schema := addSchemaHeader(c, data)
+	data, checksum := addChecksum(c, data)
+	return data, flags | schema | checksum, nil
+}
+
+// decodeEntityItem deserializes the entity for key stored with codec in a
+// memcache entity item.
+func decodeEntityItem(c context.Context, key *datastore.Key, codec Codec,
+	item *memcache.Item) (datastore.PropertyList, error) {
+
+	if err := checkItemKind(c, key, item); err != nil {
+		return nil, err
+	}
+	if err := checkItemGeneration(c, item); err != nil {
+		return nil, err
+	}
+	data, err := entityItemData(c, item)
+	if err != nil {
+		return nil, err
+	}
+
+	pl, err := codec.Unmarshal(data)
+	if err != nil {
+		return nil, err
+	}
+	if item.Flags&fieldCompressedFlag != 0 {
+		if pl, err = expandFields(pl); err != nil {
+			return nil, err
+		}
+	}
+	sortProperties(pl)
+	normalizeTimes(pl)
+	return pl, nil
+}
+
+// sortProperties sorts pl by property name, keeping the order of the values of
+// each repeated property. The datastore groups properties by whether they are
+// indexed, so sorting gives entities read from the datastore and from the
+// cache the same property order whatever wrote them, and a
+// datastore.PropertyLoadSaver building maps or slices from them sees the same
+// sequence on both paths.
+func sortProperties(pl datastore.PropertyList) {
+	sort.SliceStable(pl, func(i, j int) bool {
+		return pl[i].Name < pl[j].Name
+	})
+}
+
+// normalizeTimes represents the time.Time values of pl exactly as the
+// datastore returns them: truncated to microseconds, in the local time zone and
+// without a monotonic clock reading. This makes entities loaded from the cache
+// identical to those loaded from the datastore, whatever the codec preserves.
+func normalizeTimes(pl datastore.PropertyList) {
+	for i, p := range pl {
+		if t, ok := p.Value.(time.Time); ok {
+			pl[i].Value = time.Unix(t.Unix(), int64(t.Nanosecond()/1e3*1e3))
+		}
+	}
+}
+
+// MarshalEntity serializes val the same way NDS does when caching it using
+// the codec selected for c with WithCodec. It returns the value NDS stores for
+// an entity that is not compressed, allowing tests using a fake Cache to build
+// or check cache contents. val must be a non-nil struct pointer or a pointer
+// that implements datastore.PropertyLoadSaver.
+func MarshalEntity(c context.Context, val interface{}) ([]byte, error) {
+	v := reflect.ValueOf(val)
+	if v.Kind() != reflect.Ptr || v.IsNil() {
+		return nil, datastore.ErrInvalidEntityType
+	}
+
+	pl, err := saveValue(v)
+	if err != nil {
+		return nil, err
+	}
+	return codecFromContext(c).Marshal(pl)
+}
+
+// UnmarshalEntity loads data created by MarshalEntity into val, which must
+// be a non-nil struct pointer or a pointer that implements
+// datastore.PropertyLoadSaver.
+func UnmarshalEntity(c context.Context, data []byte, val interface{}) error {
+	v := reflect.ValueOf(val)
+	if v.Kind() != reflect.Ptr || v.IsNil() {
+		return datastore.ErrInvalidEntityType
+	}
+
+	pl, err := codecFromContext(c).Unmarshal(data)
+	if err != nil {
+		return err
+	}
+	return setValue(v, pl)
+}
@@ -0,0 +1,199 @@
+package nds_test
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/qedus/nds"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/memcache"
+)
+
+func TestMarshalUnmarshalEntity(t *testing.T) {
+	c, closeFunc := NewContext(t, nil)
+	defer closeFunc()
+
+	type testEntity struct {
+		Val int
+	}
+
+	rc := &recordingCache{}
+	cc := nds.WithCache(c, rc)
+
+	key := datastore.NewKey(c, "Entity", "", 1, nil)
+	if _, err := nds.Put(cc, key, &testEntity{7}); err != nil {
+		t.Fatal(err)
+	}
+	if err := nds.Get(cc, key, &testEntity{}); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := nds.MarshalEntity(cc, &testEntity{7})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rc.casItems) != 1 || !bytes.Equal(rc.casItems[0].Value, data) {
+		t.Fatal("expected cached value to match MarshalEntity")
+	}
+
+	te := &testEntity{}
+	if err := nds.UnmarshalEntity(cc, rc.casItems[0].Value, te); err != nil {
+		t.Fatal(err)
+	} else if te.Val != 7 {
+		t.Fatal("incorrect val", te.Val)
+	}
+
+	// The codec selected with WithCodec is used.
+	pc := &prefixCodec{}
+	if data, err = nds.MarshalEntity(nds.WithCodec(c, pc),
+		&testEntity{8}); err != nil {
+		t.Fatal(err)
+	}
+	te = &testEntity{}
+	if err := nds.UnmarshalEntity(nds.WithCodec(c, pc), data, te); err != nil {
+		t.Fatal(err)
+	} else if te.Val != 8 || pc.marshals != 1 || pc.unmarshals != 1 {
+		t.Fatal("expected codec to be used", te.Val, pc)
+	}
+
+	if _, err := nds.MarshalEntity(c, testEntity{}); err != datastore.ErrInvalidEntityType {
+		t.Fatal("expected datastore.ErrInvalidEntityType", err)
+	}
+	var nilEntity *testEntity
+	if err := nds.UnmarshalEntity(c, data, nilEntity); err != datastore.ErrInvalidEntityType {
+		t.Fatal("expected datastore.ErrInvalidEntityType", err)
+	}
+}
+
+func TestItemType(t *testing.T) {
+	tests := []struct {
+		flags    uint32
+		itemType uint32
+	}{
+		{nds.NoneItem, nds.NoneItem},
+		{nds.EntityItem, nds.EntityItem},
+		{nds.EntityItem | nds.CompressedFlag, nds.EntityItem},
+		{nds.LockItem, nds.LockItem},
+		{nds.LockItem | nds.CompressedFlag, nds.LockItem},
+		{nds.EntityItem | 1<<9, nds.UnknownItem},
+		{nds.LockItem | 1<<31, nds.UnknownItem},
+	}
+	for _, test := range tests {
+		if it := nds.ItemType(test.flags); it != test.itemType {
+			t.Fatal("incorrect item type", test.flags, it)
+		}
+	}
+}
+
+func TestGetItemFlags(t *testing.T) {
+	c, closeFunc := NewContext(t, nil)
+	defer closeFunc()
+
+	type testEntity struct {
+		Val int
+	}
+
+	key := datastore.NewKey(c, "Entity", "", 1, nil)
+	if _, err := nds.Put(c, key, &testEntity{1}); err != nil {
+		t.Fatal(err)
+	}
+	memcacheKey := nds.CreateMemcacheKey(key)
+
+	cachedValue, err := nds.MarshalEntity(c, &testEntity{2})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		flags  uint32
+		value  []byte
+		val    int
+		cached bool
+	}{
+		// A compressed flag on a lock must not be mistaken for an entity.
+		{nds.LockItem | nds.CompressedFlag, []byte{1, 2, 3, 4}, 1, false},
+		// Unknown modifiers are never interpreted.
+		{nds.EntityItem | 1<<9, cachedValue, 1, false},
+		{nds.EntityItem, cachedValue, 2, true},
+	}
+
+	for i, test := range tests {
+		if err := memcache.Set(c, &memcache.Item{
+			Key:   memcacheKey,
+			Flags: test.flags,
+			Value: test.value,
+		}); err != nil {
+			t.Fatal(err)
+		}
+
+		te := &testEntity{}
+		if err := nds.Get(c, key, te); err != nil {
+			t.Fatal(i, err)
+		} else if te.Val != test.val {
+			t.Fatal("incorrect val", i, te.Val)
+		}
+
+		item, err := memcache.Get(c, memcacheKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if test.cached != (item.Flags == nds.EntityItem) {
+			t.Fatal("incorrect cache state", i, item.Flags)
+		}
+		if !test.cached && item.Flags != test.flags {
+			t.Fatal("expected item to be left alone", i, item.Flags)
+		}
+	}
+}
+
+func TestCachedTimesMatchDatastore(t *testing.T) {
+	c, closeFunc := NewContext(t, nil)
+	defer closeFunc()
+
+	type testEntity struct {
+		Time time.Time
+	}
+
+	key := datastore.NewKey(c, "Entity", "", 1, nil)
+	now := time.Now().In(time.FixedZone("test", 3600))
+	if _, err := nds.Put(c, key, &testEntity{now}); err != nil {
+		t.Fatal(err)
+	}
+
+	fresh := &testEntity{}
+	if err := datastore.Get(c, key, fresh); err != nil {
+		t.Fatal(err)
+	}
+
+	// The first get caches the entity and the second is served from the
+	// cache.
+	for i := 0; i < 2; i++ {
+		got := &testEntity{}
+		if err := nds.Get(c, key, got); err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got, fresh) {
+			t.Fatal("cached entity differs from datastore", i, got, fresh)
+		}
+	}
+
+	// Entities read back within a transaction match too.
+	if err := nds.RunInTransaction(c, func(tc context.Context) error {
+		if _, err := nds.Put(tc, key, &testEntity{now}); err != nil {
+			return err
+		}
+		got := &testEntity{}
+		if err := nds.Get(tc, key, got); err != nil {
+			return err
+		}
+		if !reflect.DeepEqual(got, fresh) {
+			t.Fatal("transaction entity differs from datastore", got, fresh)
+		}
+		return nil
+	}, nil); err != nil {
+		t.Fatal(err)
+	}
+}
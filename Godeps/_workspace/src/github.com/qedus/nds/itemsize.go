@@ -0,0 +1,23 @@
+package nds
+
+import "golang.org/x/net/context"
+
+var maxItemSizeKey = "used for max item size"
+
+// WithMaxItemSize returns a context that stops NDS caching entities whose
+// serialized value, after any compression, is larger than n bytes. Such
+// entities are still read from and written to the datastore as usual and the
+// rest of the batch is cached. Values of n above the memcache limit of just
+// under 1MB, or of zero or less, use the memcache limit.
+func WithMaxItemSize(c context.Context, n int) context.Context {
+	return context.WithValue(c, &maxItemSizeKey, n)
+}
+
+// maxItemSize returns the largest value NDS caches for entities in c.
+func maxItemSize(c context.Context) int {
+	n, ok := c.Value(&maxItemSizeKey).(int)
+	if !ok || n <= 0 || n > memcacheMaxItemSize {
+		return memcacheMaxItemSize
+	}
+	return n
+}
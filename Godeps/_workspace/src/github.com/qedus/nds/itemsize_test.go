@@ -0,0 +1,54 @@
+package nds_test
+
+import (
+	"testing"
+
+	"github.com/qedus/nds"
+	"google.golang.org/appengine/datastore"
+)
+
+func TestWithMaxItemSize(t *testing.T) {
+	c, closeFunc := NewContext(t, nil)
+	defer closeFunc()
+
+	type testEntity struct {
+		Data []byte `datastore:",noindex"`
+	}
+
+	keys := []*datastore.Key{
+		datastore.NewKey(c, "Entity", "", 1, nil),
+		datastore.NewKey(c, "Entity", "", 2, nil),
+		datastore.NewKey(c, "Entity", "", 3, nil),
+	}
+	entities := []testEntity{
+		{make([]byte, 10)},
+		{make([]byte, 2000)},
+		{make([]byte, 10)},
+	}
+	if _, err := nds.PutMulti(c, keys, entities); err != nil {
+		t.Fatal(err)
+	}
+
+	rc := &recordingCache{}
+	mc := nds.WithMaxItemSize(nds.WithCache(c, rc), 1000)
+
+	got := make([]testEntity, len(keys))
+	if err := nds.GetMulti(mc, keys, got); err != nil {
+		t.Fatal(err)
+	}
+	for i := range got {
+		if len(got[i].Data) != len(entities[i].Data) {
+			t.Fatal("incorrect entity", i, len(got[i].Data))
+		}
+	}
+
+	// Only the oversized entity is left uncached.
+	if len(rc.casItems) != 2 {
+		t.Fatal("expected 2 cached entities", len(rc.casItems))
+	}
+	for _, item := range rc.casItems {
+		if item.Key == nds.CacheKey(c, keys[1]) {
+			t.Fatal("oversized entity cached")
+		}
+	}
+}
@@ -0,0 +1,40 @@
+package nds
+
+import (
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/datastore"
+)
+
+var keyAliasKey = "used for key alias"
+
+// WithKeyAlias returns a context that makes NDS cache the entity for each key
+// under the cache entry of canonical(key) while still reading and writing the
+// entity for key itself in the datastore. Keys that alias the same canonical
+// key therefore share one cache entry, so a cache hit through any of them
+// serves the same entity and a put or delete through any of them invalidates
+// it. This avoids caching a logical entity twice while it is migrated from
+// legacy keys to canonical ones. canonical must return its argument, or nil,
+// for keys that have no alias.
+//
+// canonical must be a stable, deterministic mapping and every context that
+// reads or writes the aliased entities must use the same one, otherwise
+// writes through a context without it leave the shared cache entry stale.
+// The aliased keys must hold the same entity in the datastore, as whichever
+// is read first is cached for all of them.
+func WithKeyAlias(c context.Context,
+	canonical func(*datastore.Key) *datastore.Key) context.Context {
+	return context.WithValue(c, &keyAliasKey, canonical)
+}
+
+// canonicalKey returns the key whose cache entry the entity for key is cached
+// under.
+func canonicalKey(c context.Context, key *datastore.Key) *datastore.Key {
+	f, _ := c.Value(&keyAliasKey).(func(*datastore.Key) *datastore.Key)
+	if f == nil {
+		return key
+	}
+	if canonical := f(key); canonical != nil {
+		return canonical
+	}
+	return key
+}
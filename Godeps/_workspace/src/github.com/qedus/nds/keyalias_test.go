@@ -0,0 +1,68 @@
+package nds_test
+
+import (
+	"testing"
+
+	"github.com/qedus/nds"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/memcache"
+)
+
+func TestWithKeyAlias(t *testing.T) {
+	c, closeFunc := NewContext(t, nil)
+	defer closeFunc()
+
+	type testEntity struct {
+		Val int
+	}
+
+	legacy := datastore.NewKey(c, "LegacyEntity", "one", 0, nil)
+	canonical := datastore.NewKey(c, "Entity", "", 1, nil)
+	ac := nds.WithKeyAlias(c, func(key *datastore.Key) *datastore.Key {
+		if key.Equal(legacy) {
+			return canonical
+		}
+		return nil
+	})
+
+	if _, err := datastore.PutMulti(c, []*datastore.Key{legacy, canonical},
+		[]testEntity{{1}, {1}}); err != nil {
+		t.Fatal(err)
+	}
+	if nds.CacheKey(ac, legacy) != nds.CacheKey(c, canonical) {
+		t.Fatal("expected aliases to share a cache key")
+	}
+
+	reads := 0
+	nds.SetDatastoreGetMulti(func(c context.Context,
+		keys []*datastore.Key, vals interface{}) error {
+		reads += len(keys)
+		return datastore.GetMulti(c, keys, vals)
+	})
+	defer nds.SetDatastoreGetMulti(datastore.GetMulti)
+
+	// Reading through the legacy key caches the canonical entry, which then
+	// serves the canonical key.
+	te := &testEntity{}
+	if err := nds.Get(ac, legacy, te); err != nil {
+		t.Fatal(err)
+	} else if te.Val != 1 {
+		t.Fatal("incorrect val", te.Val)
+	}
+	if err := nds.Get(ac, canonical, &testEntity{}); err != nil {
+		t.Fatal(err)
+	}
+	if reads != 1 {
+		t.Fatal("expected one datastore read", reads)
+	}
+
+	// Writing through the legacy key invalidates the shared entry.
+	if _, err := nds.Put(ac, legacy, &testEntity{2}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := memcache.Get(c,
+		nds.CacheKey(c, canonical)); err != memcache.ErrCacheMiss {
+		t.Fatal("expected shared entry to be invalidated", err)
+	}
+}
@@ -0,0 +1,145 @@
+package nds
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+)
+
+// KeyCodec serializes datastore keys to and from the strings NDS uses for them
+// in memcache keys and in cached values, such as the keys recorded by
+// GetByUnique, RegisterDependency and GetQueryCached. EncodeKey must return
+// memcache safe characters and encode every key, including incomplete ones,
+// to a distinct string.
+type KeyCodec interface {
+	EncodeKey(key *datastore.Key) string
+	DecodeKey(c context.Context, encoded string) (*datastore.Key, error)
+}
+
+var keyCodecKey = "used for KeyCodec"
+
+// WithKeyCodec returns a context that makes NDS serialize datastore keys in
+// the cache using kc. By default keys are serialized with key.Encode, which
+// matches previous versions of NDS but depends on the internal key encoding of
+// the App Engine SDK. PathKeyCodec is stable across SDK versions instead.
+//
+// Every context sharing a cache must use the same key codec. Changing it
+// changes every memcache key NDS uses, so entries cached with the old codec
+// are simply no longer read, but they are not invalidated by writes either, so
+// only change it along with WithCacheKeyPrefix or after flushing the cache.
+func WithKeyCodec(c context.Context, kc KeyCodec) context.Context {
+	return context.WithValue(c, &keyCodecKey, kc)
+}
+
+func keyCodecFromContext(c context.Context) KeyCodec {
+	if kc, ok := c.Value(&keyCodecKey).(KeyCodec); ok && kc != nil {
+		return kc
+	}
+	return sdkKeyCodec{}
+}
+
+// encodeCacheKey serializes key as the key codec of c does.
+func encodeCacheKey(c context.Context, key *datastore.Key) string {
+	return keyCodecFromContext(c).EncodeKey(key)
+}
+
+// decodeCacheKey deserializes a key serialized by encodeCacheKey.
+func decodeCacheKey(c context.Context,
+	encoded string) (*datastore.Key, error) {
+	return keyCodecFromContext(c).DecodeKey(c, encoded)
+}
+
+// sdkKeyCodec is the default KeyCodec and uses the App Engine SDK encoding.
+type sdkKeyCodec struct{}
+
+func (sdkKeyCodec) EncodeKey(key *datastore.Key) string {
+	return key.Encode()
+}
+
+func (sdkKeyCodec) DecodeKey(c context.Context,
+	encoded string) (*datastore.Key, error) {
+	return datastore.DecodeKey(encoded)
+}
+
+// PathKeyCodec is a KeyCodec that serializes keys as their app ID, namespace
+// and path from the root entity, such as "app/ns/Parent,s:name/Child,i:42",
+// with each part URL path escaped. Unlike the default it does not depend on the
+// internal key encoding of the App Engine SDK. Keys of other apps cannot be
+// decoded.
+type PathKeyCodec struct{}
+
+// EncodeKey returns the path of key.
+func (PathKeyCodec) EncodeKey(key *datastore.Key) string {
+	var path []string
+	for k := key; k != nil; k = k.Parent() {
+		id := "i:" + strconv.FormatInt(k.IntID(), 10)
+		if k.StringID() != "" {
+			id = "s:" + url.PathEscape(k.StringID())
+		}
+		path = append(path, url.PathEscape(k.Kind())+","+id)
+	}
+	parts := []string{url.PathEscape(key.AppID()), url.PathEscape(key.Namespace())}
+	for i := len(path) - 1; i >= 0; i-- {
+		parts = append(parts, path[i])
+	}
+	return strings.Join(parts, "/")
+}
+
+// DecodeKey returns the key with the path encoded by EncodeKey.
+func (PathKeyCodec) DecodeKey(c context.Context,
+	encoded string) (*datastore.Key, error) {
+
+	parts := strings.Split(encoded, "/")
+	if len(parts) < 3 {
+		return nil, errors.New("nds: invalid key path")
+	}
+	appID, err := url.PathUnescape(parts[0])
+	if err != nil {
+		return nil, err
+	}
+	namespace, err := url.PathUnescape(parts[1])
+	if err != nil {
+		return nil, err
+	}
+	nc, err := appengine.Namespace(c, namespace)
+	if err != nil {
+		return nil, err
+	}
+
+	var key *datastore.Key
+	for _, part := range parts[2:] {
+		element := strings.SplitN(part, ",", 2)
+		if len(element) != 2 || len(element[1]) < 2 || element[1][1] != ':' {
+			return nil, fmt.Errorf("nds: invalid key path element %q", part)
+		}
+		kind, err := url.PathUnescape(element[0])
+		if err != nil {
+			return nil, err
+		}
+		var stringID string
+		var intID int64
+		switch element[1][0] {
+		case 's':
+			stringID, err = url.PathUnescape(element[1][2:])
+		case 'i':
+			intID, err = strconv.ParseInt(element[1][2:], 10, 64)
+		default:
+			err = fmt.Errorf("nds: invalid key path element %q", part)
+		}
+		if err != nil {
+			return nil, err
+		}
+		key = datastore.NewKey(nc, kind, stringID, intID, key)
+	}
+
+	if key.AppID() != appID {
+		return nil, fmt.Errorf("nds: cannot decode key of app %q", appID)
+	}
+	return key, nil
+}
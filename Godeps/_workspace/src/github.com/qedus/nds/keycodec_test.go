@@ -0,0 +1,80 @@
+package nds_test
+
+import (
+	"testing"
+
+	"github.com/qedus/nds"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+)
+
+func TestPathKeyCodec(t *testing.T) {
+	c, closeFunc := NewContext(t, nil)
+	defer closeFunc()
+
+	nc, err := appengine.Namespace(c, "other.ns")
+	if err != nil {
+		t.Fatal(err)
+	}
+	root := datastore.NewKey(c, "Root", "a/b, c", 0, nil)
+	keys := []*datastore.Key{
+		datastore.NewKey(c, "Entity", "", 1, nil),
+		datastore.NewKey(c, "Entity", "name", 0, nil),
+		datastore.NewKey(c, "Child,Kind", "", 2,
+			datastore.NewKey(c, "Parent", "", -3, root)),
+		datastore.NewIncompleteKey(c, "Entity", root),
+		datastore.NewKey(nc, "Entity", "1", 0, nil),
+	}
+
+	kc := nds.PathKeyCodec{}
+	encoded := map[string]bool{}
+	for _, key := range keys {
+		e := kc.EncodeKey(key)
+		if encoded[e] {
+			t.Fatal("duplicate encoding", e)
+		}
+		encoded[e] = true
+
+		decoded, err := kc.DecodeKey(c, e)
+		if err != nil {
+			t.Fatal(err)
+		} else if !decoded.Equal(key) {
+			t.Fatal("incorrect key", e, decoded, key)
+		}
+	}
+	if encoded[kc.EncodeKey(datastore.NewKey(c, "Entity", "1", 0,
+		nil))] {
+		t.Fatal("expected string ID to differ from the int ID")
+	}
+
+	if _, err := kc.DecodeKey(c, "app"); err == nil {
+		t.Fatal("expected invalid key path error")
+	}
+}
+
+func TestWithKeyCodec(t *testing.T) {
+	c, closeFunc := NewContext(t, nil)
+	defer closeFunc()
+
+	type testEntity struct {
+		Val int
+	}
+
+	kc := nds.WithKeyCodec(c, nds.PathKeyCodec{})
+	key := datastore.NewKey(c, "Entity", "", 1, nil)
+	if nds.CacheKey(kc, key) == nds.CacheKey(c, key) {
+		t.Fatal("expected a different cache key")
+	}
+
+	if _, err := nds.Put(kc, key, &testEntity{1}); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		te := &testEntity{}
+		if err := nds.Get(kc, key, te); err != nil {
+			t.Fatal(err)
+		} else if te.Val != 1 {
+			t.Fatal("incorrect val", te.Val)
+		}
+	}
+}
@@ -0,0 +1,62 @@
+package nds
+
+import (
+	"reflect"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+)
+
+var keyFieldKey = "used for key field"
+
+var typeOfKeyPtr = reflect.TypeOf(&datastore.Key{})
+
+// WithKeyField returns a context that makes GetMulti, and Get, set the
+// *datastore.Key field called fieldName of each loaded struct to the key of
+// its entity. The field is set in the same way whether the entity came from
+// the cache or the datastore. It is set for every entity that loads without
+// an error, or with only a datastore.ErrFieldMismatch, and is left alone for
+// vals without such a field. The field should be tagged datastore:"-" so the
+// key is not also saved as a property when the struct is put.
+func WithKeyField(c context.Context, fieldName string) context.Context {
+	return context.WithValue(c, &keyFieldKey, fieldName)
+}
+
+func keyFieldFromContext(c context.Context) (string, bool) {
+	fieldName, _ := c.Value(&keyFieldKey).(string)
+	return fieldName, fieldName != ""
+}
+
+// setKeyFields sets the key field called fieldName of each element of vals
+// that loaded, according to err, to its key.
+func setKeyFields(keys []*datastore.Key, vals reflect.Value, fieldName string,
+	err error) {
+
+	me, ok := err.(appengine.MultiError)
+	if err != nil && !ok {
+		return
+	}
+	for i, key := range keys {
+		if ok && me[i] != nil {
+			if _, mismatch := me[i].(*datastore.ErrFieldMismatch); !mismatch {
+				continue
+			}
+		}
+
+		val := vals.Index(i)
+		for val.Kind() == reflect.Interface || val.Kind() == reflect.Ptr {
+			if val.IsNil() {
+				break
+			}
+			val = val.Elem()
+		}
+		if val.Kind() != reflect.Struct {
+			continue
+		}
+		field := val.FieldByName(fieldName)
+		if field.IsValid() && field.CanSet() && field.Type() == typeOfKeyPtr {
+			field.Set(reflect.ValueOf(key))
+		}
+	}
+}
@@ -0,0 +1,57 @@
+package nds_test
+
+import (
+	"testing"
+
+	"github.com/qedus/nds"
+	"google.golang.org/appengine/datastore"
+)
+
+func TestWithKeyField(t *testing.T) {
+	c, closeFunc := NewContext(t, nil)
+	defer closeFunc()
+
+	type testEntity struct {
+		Key *datastore.Key `datastore:"-"`
+		Val int
+	}
+
+	keys := []*datastore.Key{
+		datastore.NewKey(c, "Entity", "", 1, nil),
+		datastore.NewKey(c, "Entity", "", 2, nil),
+	}
+	if _, err := nds.PutMulti(c, keys, []testEntity{{Val: 1}, {Val: 2}}); err != nil {
+		t.Fatal(err)
+	}
+
+	kc := nds.WithKeyField(c, "Key")
+
+	// Once from the datastore and once from the cache.
+	for i := 0; i < 2; i++ {
+		vals := make([]testEntity, len(keys))
+		if err := nds.GetMulti(kc, keys, vals); err != nil {
+			t.Fatal(err)
+		}
+		for j, val := range vals {
+			if !val.Key.Equal(keys[j]) {
+				t.Fatal("incorrect key", i, j, val.Key)
+			}
+		}
+
+		te := &testEntity{}
+		if err := nds.Get(kc, keys[1], te); err != nil {
+			t.Fatal(err)
+		} else if !te.Key.Equal(keys[1]) {
+			t.Fatal("incorrect key", i, te.Key)
+		}
+	}
+
+	// Missing entities are left alone.
+	te := &testEntity{}
+	missing := datastore.NewKey(c, "Entity", "", 3, nil)
+	if err := nds.Get(kc, missing, te); err != datastore.ErrNoSuchEntity {
+		t.Fatal("expected datastore.ErrNoSuchEntity", err)
+	} else if te.Key != nil {
+		t.Fatal("expected no key", te.Key)
+	}
+}
@@ -0,0 +1,80 @@
+package nds
+
+import (
+	"fmt"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+)
+
+var keyMapperKey = "used for key mapper"
+
+// WithKeyMapper returns a context that makes GetMulti, PutMulti and
+// DeleteMulti apply f to every key before it is used with the cache or the
+// datastore. This allows logical keys to be transparently stored under
+// different physical keys, for example to shard entities. f must map a given
+// logical key to the same physical key every time so that entities put with
+// one context can be got with another.
+//
+// PutMulti returns the logical keys it was given. When a logical key is
+// incomplete the ID the datastore allocates for the physical key is set on
+// the returned logical key. CacheKey also maps key so it returns the cache key
+// of the physical key. If f returns nil for a key the operation fails with an
+// error.
+func WithKeyMapper(c context.Context,
+	f func(*datastore.Key) *datastore.Key) context.Context {
+	return context.WithValue(c, &keyMapperKey, f)
+}
+
+func keyMapperFromContext(c context.Context) (func(*datastore.Key) *datastore.Key,
+	bool) {
+	f, ok := c.Value(&keyMapperKey).(func(*datastore.Key) *datastore.Key)
+	return f, ok && f != nil
+}
+
+// withoutKeyMapper returns a context in which keys are no longer mapped, used
+// once keys have been mapped to their physical form.
+func withoutKeyMapper(c context.Context) context.Context {
+	return context.WithValue(c, &keyMapperKey,
+		(func(*datastore.Key) *datastore.Key)(nil))
+}
+
+// mapKeys returns the physical keys for keys. Nil keys are left nil so the
+// usual invalid key errors are reported for them.
+func mapKeys(keys []*datastore.Key,
+	f func(*datastore.Key) *datastore.Key) ([]*datastore.Key, error) {
+
+	mapped := make([]*datastore.Key, len(keys))
+	for i, key := range keys {
+		if key == nil {
+			continue
+		}
+		if mapped[i] = f(key); mapped[i] == nil {
+			return nil, fmt.Errorf("nds: key mapper returned nil for key %s",
+				key)
+		}
+	}
+	return mapped, nil
+}
+
+// unmapKeys returns the logical form of the physical keys returned by PutMulti
+// for the logical keys it was given. Keys are rebuilt in the namespace of the
+// logical key, whatever the namespace of c.
+func unmapKeys(c context.Context,
+	keys, physicalKeys []*datastore.Key) ([]*datastore.Key, error) {
+
+	logicalKeys := make([]*datastore.Key, len(keys))
+	for i, key := range keys {
+		if key.Incomplete() && physicalKeys[i] != nil {
+			nc, err := appengine.Namespace(c, key.Namespace())
+			if err != nil {
+				return nil, err
+			}
+			key = datastore.NewKey(nc, key.Kind(), "",
+				physicalKeys[i].IntID(), key.Parent())
+		}
+		logicalKeys[i] = key
+	}
+	return logicalKeys, nil
+}
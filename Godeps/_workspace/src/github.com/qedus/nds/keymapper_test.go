@@ -0,0 +1,88 @@
+package nds_test
+
+import (
+	"testing"
+
+	"github.com/qedus/nds"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+)
+
+func TestWithKeyMapper(t *testing.T) {
+	c, closeFunc := NewContext(t, nil)
+	defer closeFunc()
+
+	type testEntity struct {
+		Val int
+	}
+
+	physical := func(key *datastore.Key) *datastore.Key {
+		return datastore.NewKey(c, "Shard0"+key.Kind(), key.StringID(),
+			key.IntID(), key.Parent())
+	}
+	mc := nds.WithKeyMapper(c, physical)
+
+	keys := []*datastore.Key{
+		datastore.NewKey(c, "Entity", "", 1, nil),
+		datastore.NewIncompleteKey(c, "Entity", nil),
+	}
+	putKeys, err := nds.PutMulti(mc, keys, []testEntity{{1}, {2}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !putKeys[0].Equal(keys[0]) {
+		t.Fatal("expected logical key", putKeys[0])
+	}
+	if putKeys[1].Kind() != "Entity" || putKeys[1].Incomplete() {
+		t.Fatal("expected complete logical key", putKeys[1])
+	}
+
+	// Allocated logical keys keep their own namespace.
+	tc, err := appengine.Namespace(c, "tenant")
+	if err != nil {
+		t.Fatal(err)
+	}
+	nsKey, err := nds.Put(mc, datastore.NewIncompleteKey(tc, "Entity", nil),
+		&testEntity{3})
+	if err != nil {
+		t.Fatal(err)
+	} else if nsKey.Namespace() != "tenant" || nsKey.Incomplete() {
+		t.Fatal("expected complete key in namespace", nsKey)
+	}
+
+	// The entities are stored under the physical keys.
+	te := &testEntity{}
+	if err := datastore.Get(c, physical(putKeys[1]), te); err != nil {
+		t.Fatal(err)
+	} else if te.Val != 2 {
+		t.Fatal("incorrect val", te.Val)
+	}
+	if err := nds.Get(c, putKeys[0], &testEntity{}); err != datastore.ErrNoSuchEntity {
+		t.Fatal("expected no logical entity", err)
+	}
+	if nds.CacheKey(mc, keys[0]) != nds.CacheKey(c, physical(keys[0])) {
+		t.Fatal("expected physical cache key")
+	}
+
+	got := make([]testEntity, len(putKeys))
+	if err := nds.GetMulti(mc, putKeys, got); err != nil {
+		t.Fatal(err)
+	} else if got[0].Val != 1 || got[1].Val != 2 {
+		t.Fatal("incorrect entities", got)
+	}
+
+	if err := nds.DeleteMulti(mc, putKeys); err != nil {
+		t.Fatal(err)
+	}
+	if err := datastore.Get(c, physical(putKeys[0]),
+		&testEntity{}); err != datastore.ErrNoSuchEntity {
+		t.Fatal("expected physical entity to be deleted", err)
+	}
+
+	nc := nds.WithKeyMapper(c, func(*datastore.Key) *datastore.Key {
+		return nil
+	})
+	if _, err := nds.Put(nc, keys[0], &testEntity{}); err == nil {
+		t.Fatal("expected nil key mapping error")
+	}
+}
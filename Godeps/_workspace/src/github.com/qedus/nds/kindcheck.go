@@ -0,0 +1,87 @@
+package nds
+
+import (
+	"fmt"
+	"reflect"
+	"sync"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/datastore"
+)
+
+var kindCheckKey = "used for kind checks"
+
+var registeredKinds = struct {
+	sync.RWMutex
+	m map[reflect.Type]string
+}{m: map[reflect.Type]string{}}
+
+// RegisterKind records kind as the kind of the entities stored in the struct
+// type of val, which must be a struct or struct pointer, for use by
+// WithKindCheck. Struct types that are not registered are expected to have
+// the same name as their kind.
+func RegisterKind(kind string, val interface{}) {
+	t := reflect.TypeOf(val)
+	for t != nil && t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if t == nil || t.Kind() != reflect.Struct {
+		panic(fmt.Sprintf("nds: RegisterKind needs a struct, got %T", val))
+	}
+
+	registeredKinds.Lock()
+	registeredKinds.m[t] = kind
+	registeredKinds.Unlock()
+}
+
+// WithKindCheck returns a context that makes GetMulti, and Get, check that
+// the kind of each key matches the struct type it is to be loaded into, as
+// registered with RegisterKind or else given by the name of the struct type.
+// If any key does not match an error naming it is returned before any entity
+// is got. Vals that are not structs, such as datastore.PropertyList, are not
+// checked.
+func WithKindCheck(c context.Context) context.Context {
+	return context.WithValue(c, &kindCheckKey, true)
+}
+
+func isKindCheck(c context.Context) bool {
+	check, _ := c.Value(&kindCheckKey).(bool)
+	return check
+}
+
+// structKind returns the kind expected for entities loaded into t.
+func structKind(t reflect.Type) string {
+	registeredKinds.RLock()
+	kind, ok := registeredKinds.m[t]
+	registeredKinds.RUnlock()
+	if ok {
+		return kind
+	}
+	return t.Name()
+}
+
+// checkKinds returns an error for the first key in keys whose kind does not
+// match the struct type of its element of vals.
+func checkKinds(keys []*datastore.Key, vals reflect.Value) error {
+	for i, key := range keys {
+		t := vals.Index(i).Type()
+		if t.Kind() == reflect.Interface {
+			if vals.Index(i).IsNil() {
+				continue
+			}
+			t = vals.Index(i).Elem().Type()
+		}
+		for t.Kind() == reflect.Ptr {
+			t = t.Elem()
+		}
+		if t.Kind() != reflect.Struct {
+			continue
+		}
+		if kind := structKind(t); kind != key.Kind() {
+			return fmt.Errorf(
+				"nds: key %s of kind %s cannot be loaded into %s of kind %s",
+				key, key.Kind(), t, kind)
+		}
+	}
+	return nil
+}
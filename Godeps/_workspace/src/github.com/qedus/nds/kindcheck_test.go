@@ -0,0 +1,61 @@
+package nds_test
+
+import (
+	"testing"
+
+	"github.com/qedus/nds"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+)
+
+type Order struct {
+	Total int
+}
+
+type account struct {
+	Name string
+}
+
+func TestWithKindCheck(t *testing.T) {
+	c, closeFunc := NewContext(t, nil)
+	defer closeFunc()
+
+	nds.RegisterKind("User", &account{})
+
+	orderKey := datastore.NewKey(c, "Order", "", 1, nil)
+	userKey := datastore.NewKey(c, "User", "", 1, nil)
+	if _, err := nds.PutMulti(c, []*datastore.Key{orderKey, userKey},
+		[]interface{}{&Order{5}, &account{"alice"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	kc := nds.WithKindCheck(c)
+	if err := nds.GetMulti(kc, []*datastore.Key{orderKey, userKey},
+		[]interface{}{&Order{}, &account{}}); err != nil {
+		t.Fatal(err)
+	}
+
+	orders := make([]*Order, 2)
+	err := nds.GetMulti(kc, []*datastore.Key{orderKey, userKey}, orders)
+	if err == nil {
+		t.Fatal("expected kind mismatch error")
+	} else if _, ok := err.(appengine.MultiError); ok {
+		t.Fatal("expected a single error", err)
+	}
+	if orders[0] != nil {
+		t.Fatal("expected nothing to be loaded")
+	}
+
+	// Without the check mismatched kinds are loaded as before.
+	if err := nds.Get(c, userKey, &Order{}); err == nil {
+		t.Fatal("expected field mismatch error")
+	} else if _, ok := err.(*datastore.ErrFieldMismatch); !ok {
+		t.Fatal("expected *datastore.ErrFieldMismatch", err)
+	}
+
+	// Property lists are not checked.
+	if err := nds.GetMulti(kc, []*datastore.Key{userKey},
+		make([]datastore.PropertyList, 1)); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,46 @@
+package nds
+
+import (
+	"errors"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/memcache"
+)
+
+var kindHeaderKey = "used for kind headers"
+
+// errKindMismatch is returned when decoding a cached entity stored with the
+// kind of a different key.
+var errKindMismatch = errors.New("nds: cached entity has a different kind")
+
+// WithKindHeader returns a context that makes GetMulti store the kind of each
+// key with the entity it caches for it. A cached entity whose kind does not
+// match the key it is read for, because of a cache key collision or an app
+// bug writing to the wrong cache key, is logged as a warning, treated as a
+// cache miss and replaced with the entity read from the datastore rather than
+// being loaded into the wrong struct. The kind counts towards the maximum size
+// of cached entities. Kinds are verified whether or not c uses WithKindHeader.
+func WithKindHeader(c context.Context) context.Context {
+	return context.WithValue(c, &kindHeaderKey, true)
+}
+
+func isKindHeader(c context.Context) bool {
+	kindHeader, _ := c.Value(&kindHeaderKey).(bool)
+	return kindHeader
+}
+
+// checkItemKind returns errKindMismatch if the entity item was stored with a
+// kind other than that of key.
+func checkItemKind(c context.Context, key *datastore.Key,
+	item *memcache.Item) error {
+
+	if item.Flags&kindFlag == 0 {
+		return nil
+	}
+	if header, _ := splitItemHeader(item); header.kind != key.Kind() {
+		warningf(c, "nds: cached entity for %s has kind %q", key, header.kind)
+		return errKindMismatch
+	}
+	return nil
+}
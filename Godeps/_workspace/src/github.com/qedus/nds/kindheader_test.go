@@ -0,0 +1,76 @@
+package nds_test
+
+import (
+	"testing"
+
+	"github.com/qedus/nds"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/memcache"
+)
+
+func TestWithKindHeader(t *testing.T) {
+	c, closeFunc := NewContext(t, nil)
+	defer closeFunc()
+
+	type testEntity struct {
+		Val int
+	}
+	type otherEntity struct {
+		Name string
+	}
+
+	rc := &recordingCache{}
+	kc := nds.WithKindHeader(nds.WithCache(c, rc))
+
+	key := datastore.NewKey(c, "Entity", "", 1, nil)
+	if _, err := nds.Put(kc, key, &testEntity{1}); err != nil {
+		t.Fatal(err)
+	}
+	otherKey := datastore.NewKey(c, "Other", "", 1, nil)
+	if _, err := nds.Put(kc, otherKey, &otherEntity{"other"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Cache the other entity with its kind.
+	if err := nds.Get(kc, otherKey, &otherEntity{}); err != nil {
+		t.Fatal(err)
+	}
+	if len(rc.casItems) != 1 {
+		t.Fatal("expected entity to be cached", len(rc.casItems))
+	}
+	other := rc.casItems[0]
+	if other.Flags != nds.EntityItem|nds.KindFlag {
+		t.Fatal("expected kind header", other.Flags)
+	}
+
+	// Store the other entity under the cache key of key.
+	if err := memcache.Set(c, &memcache.Item{
+		Key:   nds.CreateMemcacheKey(key),
+		Value: other.Value,
+		Flags: other.Flags,
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	// The mismatched entity is ignored, even without WithKindHeader, and is
+	// replaced with the entity from the datastore.
+	te := &testEntity{}
+	if err := nds.Get(nds.WithCache(c, rc), key, te); err != nil {
+		t.Fatal(err)
+	} else if te.Val != 1 {
+		t.Fatal("incorrect val", te.Val)
+	}
+	if len(rc.casItems) != 2 {
+		t.Fatal("expected entity to be replaced", len(rc.casItems))
+	}
+	if rc.casItems[1].Flags != nds.EntityItem {
+		t.Fatal("expected no kind header", rc.casItems[1].Flags)
+	}
+
+	te = &testEntity{}
+	if err := nds.Get(kc, key, te); err != nil {
+		t.Fatal(err)
+	} else if te.Val != 1 {
+		t.Fatal("incorrect val", te.Val)
+	}
+}
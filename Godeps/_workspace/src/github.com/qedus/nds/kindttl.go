@@ -0,0 +1,39 @@
+package nds
+
+import (
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/datastore"
+)
+
+var kindTTLKey = "used for kind TTLs"
+
+// WithKindTTL returns a context that caches entities of each kind in ttls for
+// the duration mapped to that kind. Entities of other kinds, and durations of
+// zero or less, keep the default of being cached until the entity is written
+// with Put or Delete, or is evicted by memcache. Durations longer than 30 days
+// are reduced to 30 days. The durations only apply to cached entities, locks
+// and missing entities are unaffected.
+func WithKindTTL(c context.Context,
+	ttls map[string]time.Duration) context.Context {
+
+	copied := make(map[string]time.Duration, len(ttls))
+	for kind, ttl := range ttls {
+		copied[kind] = ttl
+	}
+	return context.WithValue(c, &kindTTLKey, copied)
+}
+
+// entityExpiration returns the expiration of the cached entity for key.
+func entityExpiration(c context.Context, key *datastore.Key) time.Duration {
+	ttls, _ := c.Value(&kindTTLKey).(map[string]time.Duration)
+	ttl, ok := ttls[key.Kind()]
+	if !ok || ttl <= 0 {
+		return 0
+	}
+	if ttl > memcacheMaxExpiration {
+		return memcacheMaxExpiration
+	}
+	return ttl
+}
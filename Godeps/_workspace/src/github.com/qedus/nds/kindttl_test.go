@@ -0,0 +1,55 @@
+package nds_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/qedus/nds"
+	"google.golang.org/appengine/datastore"
+)
+
+func TestWithKindTTL(t *testing.T) {
+	c, closeFunc := NewContext(t, nil)
+	defer closeFunc()
+
+	type testEntity struct {
+		Val int
+	}
+
+	rc := &recordingCache{}
+	kc := nds.WithKindTTL(nds.WithCache(c, rc), map[string]time.Duration{
+		"Session": time.Minute,
+		"Country": 24 * time.Hour,
+	})
+
+	keys := []*datastore.Key{
+		datastore.NewKey(c, "Session", "", 1, nil),
+		datastore.NewKey(c, "Country", "", 1, nil),
+		datastore.NewKey(c, "Other", "", 1, nil),
+	}
+	if _, err := nds.PutMulti(kc, keys,
+		[]testEntity{{1}, {2}, {3}}); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, item := range rc.setItems {
+		if item.Expiration == time.Minute || item.Expiration == 24*time.Hour {
+			t.Fatal("expected lock items to keep the lock time")
+		}
+	}
+
+	if err := nds.GetMulti(kc, keys, make([]testEntity, 3)); err != nil {
+		t.Fatal(err)
+	}
+
+	expirations := map[string]time.Duration{}
+	for _, item := range rc.casItems {
+		expirations[item.Key] = item.Expiration
+	}
+	expected := []time.Duration{time.Minute, 24 * time.Hour, 0}
+	for i, key := range keys {
+		if e := expirations[nds.CreateMemcacheKey(key)]; e != expected[i] {
+			t.Fatal("incorrect expiration", key.Kind(), e)
+		}
+	}
+}
@@ -0,0 +1,97 @@
+package nds
+
+import (
+	"reflect"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+)
+
+var loadFieldsKey = "used for load fields"
+
+// WithLoadFields returns a context that makes GetMulti load and cache only
+// fields of entities of kind, as if WithProjection had been used for their
+// keys alone. This suits list views that show a few fields of wide entities:
+// misses read just those fields from the datastore and the cache items are
+// kept small. Fields of other kinds can be set by calling WithLoadFields again
+// with the returned context, and empty fields stop filtering kind.
+//
+// The filtered entities are cached under their own cache keys so reads of
+// full entities, and with other fields, never see them. They carry the same
+// caveats as projected entities: every field must be indexed and single
+// valued, entities lacking any of the fields are reported as
+// datastore.ErrNoSuchEntity, they can be stale for up to the lock time and
+// they must not be written back with Put. The fields are ignored within a
+// transaction and when WithProjection is also used.
+func WithLoadFields(c context.Context, kind string,
+	fields []string) context.Context {
+
+	prev, _ := c.Value(&loadFieldsKey).(map[string][]string)
+	kinds := make(map[string][]string, len(prev)+1)
+	for k, f := range prev {
+		kinds[k] = f
+	}
+	if len(fields) == 0 {
+		delete(kinds, kind)
+	} else {
+		kinds[kind] = distinctFields(fields)
+	}
+	return context.WithValue(c, &loadFieldsKey, kinds)
+}
+
+// splitLoadFields returns the indexes of keys grouped by the kinds that have
+// load fields and the indexes of the rest. Nil keys are left with the rest.
+func splitLoadFields(c context.Context,
+	keys []*datastore.Key) (map[string][]int, []int) {
+
+	kinds, _ := c.Value(&loadFieldsKey).(map[string][]string)
+	if len(kinds) == 0 {
+		return nil, nil
+	}
+	if _, ok := projectionFromContext(c); ok {
+		return nil, nil
+	}
+
+	var filtered map[string][]int
+	var rest []int
+	for i, key := range keys {
+		if key == nil || kinds[key.Kind()] == nil {
+			rest = append(rest, i)
+			continue
+		}
+		if filtered == nil {
+			filtered = map[string][]int{}
+		}
+		filtered[key.Kind()] = append(filtered[key.Kind()], i)
+	}
+	return filtered, rest
+}
+
+// getLoadFields gets the entities at the filtered indexes of each kind
+// projected to its load fields and the rest in full.
+func getLoadFields(c context.Context, keys []*datastore.Key,
+	vals reflect.Value, filtered map[string][]int, rest []int) error {
+
+	kinds, _ := c.Value(&loadFieldsKey).(map[string][]string)
+	c = context.WithValue(c, &loadFieldsKey, map[string][]string(nil))
+
+	get := func(c context.Context, keys []*datastore.Key,
+		vals reflect.Value) ([]*datastore.Key, error) {
+		return nil, GetMulti(c, keys, vals.Interface())
+	}
+	resKeys := make([]*datastore.Key, len(keys))
+	errs := make(appengine.MultiError, len(keys))
+	for kind, indexes := range filtered {
+		runIndexes(WithProjection(c, kinds[kind]), keys, vals, indexes, get,
+			resKeys, errs)
+	}
+	runIndexes(c, keys, vals, rest, get, resKeys, errs)
+
+	for _, err := range errs {
+		if err != nil {
+			return errs
+		}
+	}
+	return nil
+}
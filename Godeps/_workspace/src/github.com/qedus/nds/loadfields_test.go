@@ -0,0 +1,68 @@
+package nds_test
+
+import (
+	"testing"
+
+	"github.com/qedus/nds"
+	"google.golang.org/appengine/datastore"
+)
+
+func TestWithLoadFields(t *testing.T) {
+	c, closeFunc := NewContext(t, nil)
+	defer closeFunc()
+
+	type testEntity struct {
+		Name string
+		Blob []byte `datastore:",noindex"`
+	}
+
+	keys := []*datastore.Key{
+		datastore.NewKey(c, "Wide", "", 1, nil),
+		datastore.NewKey(c, "Other", "", 1, nil),
+	}
+	if _, err := nds.PutMulti(c, keys, []testEntity{
+		{"wide", make([]byte, 1000)},
+		{"other", make([]byte, 1000)},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	rc := &recordingCache{}
+	lc := nds.WithLoadFields(nds.WithCache(c, rc), "Wide", []string{"Name"})
+
+	for i := 0; i < 2; i++ {
+		entities := make([]testEntity, len(keys))
+		if err := nds.GetMulti(lc, keys, entities); err != nil {
+			t.Fatal(err)
+		}
+		if entities[0].Name != "wide" || entities[0].Blob != nil {
+			t.Fatal("expected filtered entity", i, entities[0])
+		}
+		if entities[1].Name != "other" || len(entities[1].Blob) != 1000 {
+			t.Fatal("expected full entity of other kind", i, entities[1])
+		}
+	}
+
+	// The filtered entity is cached under its own key, so a full read is
+	// never served it.
+	for _, item := range rc.addItems {
+		if item.Key == nds.CacheKey(c, keys[0]) {
+			t.Fatal("filtered entity cached under full entity key")
+		}
+	}
+	entity := &testEntity{}
+	if err := nds.Get(nds.WithCache(c, rc), keys[0], entity); err != nil {
+		t.Fatal(err)
+	} else if len(entity.Blob) != 1000 {
+		t.Fatal("expected full entity", len(entity.Blob))
+	}
+
+	// Empty fields stop filtering the kind.
+	entity = &testEntity{}
+	if err := nds.Get(nds.WithLoadFields(lc, "Wide", nil), keys[0],
+		entity); err != nil {
+		t.Fatal(err)
+	} else if len(entity.Blob) != 1000 {
+		t.Fatal("expected full entity", len(entity.Blob))
+	}
+}
@@ -0,0 +1,122 @@
+package nds
+
+import (
+	"sync"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/datastore"
+)
+
+var localCacheKey = "used for *localCache"
+
+// localCache holds the entities read through a single context so repeated
+// gets of the same key do not need a memcache round trip.
+type localCache struct {
+	sync.Mutex
+	entities map[string]localCacheEntry
+}
+
+// localCacheEntry is an entity held by a localCache. partial is set for
+// entities read from a cache entry made without their nds:"nocache" fields.
+type localCacheEntry struct {
+	pl      datastore.PropertyList
+	partial bool
+}
+
+// WithLocalCache returns a context that caches entities in process memory
+// in front of memcache. Entities got with the returned context, or any
+// context derived from it, are kept until they are put or deleted through
+// NDS. The cache lives as long as the context so it should be scoped to a
+// single request.
+//
+// Every entity read is retained, so a context used for very large or very
+// many GetMulti calls will grow accordingly. Reads made inside a transaction
+// are never added to the local cache. Entities read from cache entries made
+// without their nds:"nocache" fields are not returned to contexts made with
+// WithFullEntities.
+func WithLocalCache(c context.Context) context.Context {
+	return context.WithValue(c, &localCacheKey, &localCache{
+		entities: map[string]localCacheEntry{},
+	})
+}
+
+// ClearLocalCache drops every entity held by the local cache attached to c
+// with WithLocalCache, including those added through derived contexts. The
+// cache itself stays attached so later gets are cached again. Long running
+// handlers can call it between units of work to bound memory use. It does
+// nothing if c has no local cache.
+func ClearLocalCache(c context.Context) {
+	lc, ok := localCacheFromContext(c)
+	if !ok {
+		return
+	}
+
+	lc.Lock()
+	lc.entities = map[string]localCacheEntry{}
+	lc.Unlock()
+}
+
+func localCacheFromContext(c context.Context) (*localCache, bool) {
+	lc, ok := c.Value(&localCacheKey).(*localCache)
+	return lc, ok
+}
+
+func loadLocalCache(c context.Context, cacheItems []cacheItem) {
+	lc, ok := localCacheFromContext(c)
+	if !ok {
+		return
+	}
+
+	lc.Lock()
+	defer lc.Unlock()
+	for i, cacheItem := range cacheItems {
+		if cacheItem.state != miss {
+			continue
+		}
+		entry, ok := lc.entities[cacheItem.memcacheKey]
+		if !ok || entry.partial && isFullEntities(c) {
+			continue
+		}
+		if err := setValue(cacheItem.val, entry.pl); err == nil {
+			cacheItems[i].pl = entry.pl
+			cacheItems[i].partial = entry.partial
+			cacheItems[i].state = done
+		}
+	}
+}
+
+func saveLocalCache(c context.Context, cacheItems []cacheItem) {
+	if _, ok := transactionFromContext(c); ok {
+		return
+	}
+	lc, ok := localCacheFromContext(c)
+	if !ok {
+		return
+	}
+
+	lc.Lock()
+	defer lc.Unlock()
+	for _, cacheItem := range cacheItems {
+		if cacheItem.err == nil && cacheItem.pl != nil {
+			lc.entities[cacheItem.memcacheKey] = localCacheEntry{
+				pl: cacheItem.pl, partial: cacheItem.partial}
+		}
+	}
+}
+
+// evictLocalCache removes the entities for memcacheKeys from the local cache
+// and the process cache of c.
+func evictLocalCache(c context.Context, memcacheKeys []string) {
+	evictProcessCache(c, memcacheKeys)
+
+	lc, ok := localCacheFromContext(c)
+	if !ok {
+		return
+	}
+
+	lc.Lock()
+	defer lc.Unlock()
+	for _, memcacheKey := range memcacheKeys {
+		delete(lc.entities, memcacheKey)
+	}
+}
@@ -0,0 +1,124 @@
+package nds_test
+
+import (
+	"testing"
+
+	"github.com/qedus/nds"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/datastore"
+)
+
+func TestWithLocalCache(t *testing.T) {
+	c, closeFunc := NewContext(t, nil)
+	defer closeFunc()
+
+	type testEntity struct {
+		IntVal int
+	}
+
+	rc := &recordingCache{}
+	lc := nds.WithLocalCache(nds.WithCache(c, rc))
+
+	key := datastore.NewKey(c, "Entity", "", 1, nil)
+	if _, err := nds.Put(lc, key, &testEntity{42}); err != nil {
+		t.Fatal(err)
+	}
+
+	te := &testEntity{}
+	if err := nds.Get(lc, key, te); err != nil {
+		t.Fatal(err)
+	} else if te.IntVal != 42 {
+		t.Fatal("expected 42", te.IntVal)
+	}
+
+	// Served from the local cache so memcache should not be touched.
+	rc.getKeys = nil
+	te = &testEntity{}
+	if err := nds.Get(lc, key, te); err != nil {
+		t.Fatal(err)
+	} else if te.IntVal != 42 {
+		t.Fatal("expected 42", te.IntVal)
+	}
+	if len(rc.getKeys) != 0 {
+		t.Fatal("expected no memcache lookups", rc.getKeys)
+	}
+
+	// Puts must invalidate the local cache.
+	if _, err := nds.Put(lc, key, &testEntity{43}); err != nil {
+		t.Fatal(err)
+	}
+	te = &testEntity{}
+	if err := nds.Get(lc, key, te); err != nil {
+		t.Fatal(err)
+	} else if te.IntVal != 43 {
+		t.Fatal("expected 43", te.IntVal)
+	}
+
+	// Transactional puts must invalidate the local cache on commit.
+	if err := nds.RunInTransaction(lc, func(tc context.Context) error {
+		_, err := nds.Put(tc, key, &testEntity{44})
+		return err
+	}, nil); err != nil {
+		t.Fatal(err)
+	}
+	te = &testEntity{}
+	if err := nds.Get(lc, key, te); err != nil {
+		t.Fatal(err)
+	} else if te.IntVal != 44 {
+		t.Fatal("expected 44", te.IntVal)
+	}
+
+	// Deletes must invalidate the local cache.
+	if err := nds.Delete(lc, key); err != nil {
+		t.Fatal(err)
+	}
+	if err := nds.Get(lc, key, &testEntity{}); err != datastore.ErrNoSuchEntity {
+		t.Fatal("expected datastore.ErrNoSuchEntity", err)
+	}
+}
+
+func TestClearLocalCache(t *testing.T) {
+	c, closeFunc := NewContext(t, nil)
+	defer closeFunc()
+
+	type testEntity struct {
+		IntVal int
+	}
+
+	// Clearing without a local cache does nothing.
+	nds.ClearLocalCache(c)
+
+	rc := &recordingCache{}
+	lc := nds.WithLocalCache(nds.WithCache(c, rc))
+
+	key := datastore.NewKey(c, "Entity", "", 1, nil)
+	if _, err := nds.Put(lc, key, &testEntity{42}); err != nil {
+		t.Fatal(err)
+	}
+	if err := nds.Get(lc, key, &testEntity{}); err != nil {
+		t.Fatal(err)
+	}
+
+	nds.ClearLocalCache(lc)
+
+	// The entity must now come from memcache again.
+	rc.getKeys = nil
+	te := &testEntity{}
+	if err := nds.Get(lc, key, te); err != nil {
+		t.Fatal(err)
+	} else if te.IntVal != 42 {
+		t.Fatal("expected 42", te.IntVal)
+	}
+	if len(rc.getKeys) != 1 {
+		t.Fatal("expected a memcache lookup", rc.getKeys)
+	}
+
+	// The local cache is still attached.
+	rc.getKeys = nil
+	if err := nds.Get(lc, key, &testEntity{}); err != nil {
+		t.Fatal(err)
+	}
+	if len(rc.getKeys) != 0 {
+		t.Fatal("expected no memcache lookups", rc.getKeys)
+	}
+}
@@ -0,0 +1,194 @@
+package nds
+
+import (
+	"fmt"
+	"math/rand"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/memcache"
+)
+
+var lockTimeKey = "used for lock time"
+
+// WithLockTime returns a context that makes NDS hold memcache locks for d
+// instead of the default 32 seconds. Increase it if datastore calls made
+// with the context can take longer than the default, otherwise the lock may
+// expire before the call completes. d must not be longer than the maximum
+// memcache expiration of 30 days. A d of zero or less uses the default.
+func WithLockTime(c context.Context, d time.Duration) context.Context {
+	return context.WithValue(c, &lockTimeKey, d)
+}
+
+// lockTime returns the lock expiration to use for c.
+func lockTime(c context.Context) (time.Duration, error) {
+	d, ok := c.Value(&lockTimeKey).(time.Duration)
+	if !ok || d <= 0 {
+		return memcacheLockTime, nil
+	}
+	if d > memcacheMaxExpiration {
+		return 0, fmt.Errorf(
+			"nds: lock time %s exceeds memcache maximum expiration %s",
+			d, memcacheMaxExpiration)
+	}
+	return d, nil
+}
+
+var lockJitterKey = "used for lock jitter"
+
+// maxLockJitter bounds the jitter so locks never last longer than one and a
+// half times the lock time.
+const maxLockJitter = 0.5
+
+// WithLockJitter returns a context that randomly lengthens the lock time of
+// each entity put or deleted by up to fraction of the lock time. This stops
+// the locks of entities written together all expiring at the same moment and
+// causing a burst of datastore reads. Jitter is only ever added on top of the
+// lock time so a lock never expires before the datastore call it protects
+// could have completed. Jitter is off unless this is used, a fraction of zero
+// or less disables it and fractions above 0.5 are reduced to 0.5.
+func WithLockJitter(c context.Context, fraction float64) context.Context {
+	return context.WithValue(c, &lockJitterKey, fraction)
+}
+
+// jitterLockTime randomly lengthens d by up to the lock jitter fraction of c.
+func jitterLockTime(c context.Context, d time.Duration) time.Duration {
+	fraction, ok := c.Value(&lockJitterKey).(float64)
+	if !ok || fraction <= 0 {
+		return d
+	}
+	if fraction > maxLockJitter {
+		fraction = maxLockJitter
+	}
+
+	d += time.Duration(rand.Float64() * fraction * float64(d))
+	if d > memcacheMaxExpiration {
+		d = memcacheMaxExpiration
+	}
+	return d
+}
+
+func newLockItem(memcacheKey string, expiration time.Duration) *memcache.Item {
+	return &memcache.Item{
+		Key:        memcacheKey,
+		Flags:      lockItem,
+		Value:      itemLock(),
+		Expiration: expiration,
+	}
+}
+
+// newLockItems returns a lock item, along with its memcache key, for each
+// replica of each distinct complete key in keys and the distinct keys
+// themselves. Duplicate keys share lock items as the datastore only keeps the
+// last of their values anyway.
+func newLockItems(c context.Context, keys []*datastore.Key,
+	expiration time.Duration) ([]*memcache.Item, []string, []*datastore.Key) {
+
+	items := make([]*memcache.Item, 0, len(keys))
+	memcacheKeys := make([]string, 0, len(keys))
+	lockedKeys := make([]*datastore.Key, 0, len(keys))
+	seen := make(map[string]bool, len(keys))
+	for _, key := range keys {
+		if key == nil || key.Incomplete() {
+			continue
+		}
+
+		memcacheKey := createMemcacheKey(c, key)
+		if seen[memcacheKey] {
+			continue
+		}
+		seen[memcacheKey] = true
+
+		for _, memcacheKey := range writeMemcacheKeys(c, key) {
+			items = append(items,
+				newLockItem(memcacheKey, jitterLockTime(c, expiration)))
+			memcacheKeys = append(memcacheKeys, memcacheKey)
+		}
+		lockedKeys = append(lockedKeys, key)
+	}
+	return items, memcacheKeys, lockedKeys
+}
+
+// setLocks sets items, retrying as configured with WithRetry. A
+// appengine.MultiError is only retried if all of its failed items failed with
+// a transient error. If some items still fail to be set the locks that were
+// set are deleted before the error is returned, so entities that are not
+// going to be written are not left locked until their locks expire.
+func setLocks(c context.Context, items []*memcache.Item) error {
+	err := retry(c, func() error {
+		return checkMultiError(cacheFromContext(c).SetMulti(c, items),
+			len(items))
+	})
+	me, ok := err.(appengine.MultiError)
+	if !ok {
+		return err
+	}
+
+	setKeys := make([]string, 0, len(items))
+	for i, item := range items {
+		if me[i] == nil {
+			setKeys = append(setKeys, item.Key)
+		}
+	}
+	if len(setKeys) > 0 {
+		if delErr := cacheFromContext(c).DeleteMulti(c,
+			setKeys); delErr != nil && !isCacheMissErrors(delErr) {
+			warningf(c, "nds:setLocks DeleteMulti %s", delErr)
+		}
+	}
+	return err
+}
+
+// writeLockPollInterval is how often a write waiting for the write lock of an
+// entity checks whether it has been released.
+var writeLockPollInterval = 20 * time.Millisecond
+
+// runWriteLocked calls f with c while holding the write lock of the entity for
+// key, a lock item in the cache that serializes the NDS writes which read an
+// entity before deciding how to put it. Such a write waits for any other to
+// release the lock, which expires after the lock time of c if it never is,
+// unless c is done first. f is called within the current transaction instead if
+// there is one, and without the lock for nil or incomplete keys as no other
+// writer can have the entity. If the cache cannot hold the lock f is run within
+// its own transaction.
+func runWriteLocked(c context.Context, key *datastore.Key,
+	f func(tc context.Context) error) error {
+
+	if _, ok := transactionFromContext(c); ok ||
+		key == nil || key.Incomplete() {
+		return f(c)
+	}
+	expiration, err := lockTime(c)
+	if err != nil {
+		return err
+	}
+
+	memcacheKey := createSuffixedMemcacheKey(c, key, ":write")
+	for {
+		err := cacheFromContext(c).AddMulti(c, []*memcache.Item{
+			newLockItem(memcacheKey, expiration),
+		})
+		if err == nil {
+			break
+		} else if !isNotStoredErrors(err) {
+			warningf(c, "nds:runWriteLocked AddMulti %s", err)
+			return RunInTransaction(c, f, nil)
+		}
+
+		select {
+		case <-c.Done():
+			return c.Err()
+		case <-time.After(writeLockPollInterval):
+		}
+	}
+
+	defer func() {
+		if err := cacheFromContext(c).DeleteMulti(c,
+			[]string{memcacheKey}); err != nil && !isCacheMissErrors(err) {
+			warningf(c, "nds:runWriteLocked DeleteMulti %s", err)
+		}
+	}()
+	return f(c)
+}
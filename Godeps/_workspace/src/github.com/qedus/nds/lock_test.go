@@ -0,0 +1,184 @@
+package nds_test
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/qedus/nds"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/memcache"
+)
+
+func TestWithLockTime(t *testing.T) {
+	c, closeFunc := NewContext(t, nil)
+	defer closeFunc()
+
+	type testEntity struct {
+		IntVal int
+	}
+
+	rc := &recordingCache{}
+	lc := nds.WithLockTime(nds.WithLockJitter(nds.WithCache(c, rc), 0),
+		2*time.Minute)
+
+	key := datastore.NewKey(c, "Entity", "", 1, nil)
+	if _, err := nds.Put(lc, key, &testEntity{42}); err != nil {
+		t.Fatal(err)
+	}
+	if len(rc.setItems) != 1 {
+		t.Fatal("expected 1 lock item")
+	} else if exp := rc.setItems[0].Expiration; exp != 2*time.Minute {
+		t.Fatal("expected 2 minute lock", exp)
+	}
+
+	if err := nds.Get(lc, key, &testEntity{}); err != nil {
+		t.Fatal(err)
+	}
+	if len(rc.addItems) != 1 {
+		t.Fatal("expected 1 read lock item")
+	} else if exp := rc.addItems[0].Expiration; exp != 2*time.Minute {
+		t.Fatal("expected 2 minute lock", exp)
+	}
+
+	// Unset lock times use the default.
+	rc = &recordingCache{}
+	if _, err := nds.Put(nds.WithLockJitter(nds.WithCache(c, rc), 0), key,
+		&testEntity{43}); err != nil {
+		t.Fatal(err)
+	}
+	if exp := rc.setItems[0].Expiration; exp != 32*time.Second {
+		t.Fatal("expected default lock time", exp)
+	}
+}
+
+func TestWithLockTimeTooLong(t *testing.T) {
+	c, closeFunc := NewContext(t, nil)
+	defer closeFunc()
+
+	type testEntity struct {
+		IntVal int
+	}
+
+	lc := nds.WithLockTime(c, 31*24*time.Hour)
+	key := datastore.NewKey(c, "Entity", "", 1, nil)
+
+	if _, err := nds.Put(lc, key, &testEntity{42}); err == nil {
+		t.Fatal("expected lock time error")
+	}
+	if err := nds.Get(lc, key, &testEntity{}); err == nil {
+		t.Fatal("expected lock time error")
+	}
+	if err := nds.Delete(lc, key); err == nil {
+		t.Fatal("expected lock time error")
+	}
+}
+
+func TestWithLockJitter(t *testing.T) {
+	c, closeFunc := NewContext(t, nil)
+	defer closeFunc()
+
+	type testEntity struct {
+		IntVal int
+	}
+
+	keys := make([]*datastore.Key, 20)
+	for i := range keys {
+		keys[i] = datastore.NewKey(c, "Entity", "", int64(i+1), nil)
+	}
+
+	tests := []struct {
+		c        context.Context
+		min, max time.Duration
+		varied   bool
+	}{
+		// No jitter by default.
+		{c, 32 * time.Second, 32 * time.Second, false},
+		// Only ever lengthened.
+		{nds.WithLockJitter(c, 0.1), 32 * time.Second,
+			35200 * time.Millisecond, true},
+		// Clamped to 50%.
+		{nds.WithLockJitter(c, 2), 32 * time.Second, 48 * time.Second, true},
+	}
+
+	for i, test := range tests {
+		rc := &recordingCache{}
+		if _, err := nds.PutMulti(nds.WithCache(test.c, rc), keys,
+			make([]testEntity, len(keys))); err != nil {
+			t.Fatal(err)
+		}
+
+		varied := false
+		for _, item := range rc.setItems {
+			if item.Expiration < test.min || item.Expiration > test.max {
+				t.Fatal("lock time out of bounds", i, item.Expiration)
+			}
+			if item.Expiration != rc.setItems[0].Expiration {
+				varied = true
+			}
+		}
+		if varied != test.varied {
+			t.Fatal("expected lock times to vary", test.varied, i)
+		}
+	}
+}
+
+// partialSetCache is a recordingCache whose SetMulti only sets the first item.
+type partialSetCache struct {
+	*recordingCache
+}
+
+func (pc partialSetCache) SetMulti(c context.Context,
+	items []*memcache.Item) error {
+	if err := pc.recordingCache.SetMulti(c, items[:1]); err != nil {
+		return err
+	}
+	me := make(appengine.MultiError, len(items))
+	for i := 1; i < len(items); i++ {
+		me[i] = errors.New("expected error")
+	}
+	return me
+}
+
+func TestPartialLockFailure(t *testing.T) {
+	c, closeFunc := NewContext(t, nil)
+	defer closeFunc()
+
+	type testEntity struct {
+		IntVal int
+	}
+
+	keys := []*datastore.Key{
+		datastore.NewKey(c, "Entity", "", 1, nil),
+		datastore.NewKey(c, "Entity", "", 2, nil),
+	}
+
+	pc := partialSetCache{&recordingCache{}}
+	cd := &countingDatastore{}
+	lc := nds.WithDatastore(nds.WithCache(c, pc), cd)
+	if _, err := nds.PutMulti(lc, keys,
+		[]testEntity{{1}, {2}}); err == nil {
+		t.Fatal("expected error")
+	}
+	if cd.puts != 0 {
+		t.Fatal("expected entities not to be put")
+	}
+
+	// The lock that was set has been removed.
+	memcacheKey := nds.CreateMemcacheKey(keys[0])
+	if len(pc.delKeys) != 1 || pc.delKeys[0] != memcacheKey {
+		t.Fatal("expected set lock to be deleted", pc.delKeys)
+	}
+	if _, err := memcache.Get(c, memcacheKey); err != memcache.ErrCacheMiss {
+		t.Fatal("expected memcache.ErrCacheMiss", err)
+	}
+
+	if err := nds.DeleteMulti(lc, keys); err == nil {
+		t.Fatal("expected error")
+	}
+	if len(pc.delKeys) != 2 || cd.deletes != 0 {
+		t.Fatal("expected set lock to be deleted", pc.delKeys)
+	}
+}
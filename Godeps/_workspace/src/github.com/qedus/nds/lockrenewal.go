@@ -0,0 +1,55 @@
+package nds
+
+import (
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/memcache"
+)
+
+var lockRenewalKey = "used for transaction lock renewal"
+
+// WithTransactionLockRenewal returns a context that makes RunInTransaction set
+// the cache locks of the entities written in a transaction again every
+// interval once they have been set, until the transaction has committed or
+// failed. Each renewal restarts the lock time, so locks cannot expire and let
+// stale entities be cached while a slow commit is still in progress. interval
+// should be well within the lock time. An interval of zero or less disables
+// renewal, which is the default.
+func WithTransactionLockRenewal(c context.Context,
+	interval time.Duration) context.Context {
+	return context.WithValue(c, &lockRenewalKey, interval)
+}
+
+func lockRenewalInterval(c context.Context) time.Duration {
+	interval, _ := c.Value(&lockRenewalKey).(time.Duration)
+	return interval
+}
+
+// renewLocks sets items in the cache every interval until the returned
+// function is called, which returns once renewal has stopped.
+func renewLocks(c context.Context, items []*memcache.Item,
+	interval time.Duration) func() {
+
+	stop, stopped := make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(stopped)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				err := setLockBatches(c, restampLocks(items))
+				if err != nil {
+					warningf(c, "nds:renewLocks SetMulti %s", err)
+				}
+			}
+		}
+	}()
+	return func() {
+		close(stop)
+		<-stopped
+	}
+}
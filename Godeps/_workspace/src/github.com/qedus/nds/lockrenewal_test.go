@@ -0,0 +1,63 @@
+package nds_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/qedus/nds"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/datastore"
+)
+
+// slowCommitDatastore delays returning from each transaction as though its
+// commit were slow.
+type slowCommitDatastore struct {
+	countingDatastore
+	delay time.Duration
+}
+
+func (sd *slowCommitDatastore) RunInTransaction(c context.Context,
+	f func(tc context.Context) error,
+	opts *datastore.TransactionOptions) error {
+
+	err := datastore.RunInTransaction(c, f, opts)
+	time.Sleep(sd.delay)
+	return err
+}
+
+func TestWithTransactionLockRenewal(t *testing.T) {
+	c, closeFunc := NewContext(t, nil)
+	defer closeFunc()
+
+	type testEntity struct {
+		Val int
+	}
+
+	rc := &recordingCache{}
+	sd := &slowCommitDatastore{delay: 100 * time.Millisecond}
+	lc := nds.WithTransactionLockRenewal(
+		nds.WithDatastore(nds.WithCache(c, rc), sd), 20*time.Millisecond)
+
+	key := datastore.NewKey(c, "Entity", "", 1, nil)
+	if err := nds.RunInTransaction(lc, func(tc context.Context) error {
+		_, err := nds.Put(tc, key, &testEntity{1})
+		return err
+	}, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	rc.Lock()
+	sets := len(rc.setItems)
+	rc.Unlock()
+	if sets < 2 {
+		t.Fatal("expected the lock to be renewed", sets)
+	}
+
+	// Renewal stops once the transaction has finished.
+	time.Sleep(60 * time.Millisecond)
+	rc.Lock()
+	defer rc.Unlock()
+	if len(rc.setItems) != sets {
+		t.Fatal("expected renewal to stop", len(rc.setItems), sets)
+	}
+}
@@ -0,0 +1,55 @@
+package nds
+
+import (
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/log"
+)
+
+// Logger receives the messages NDS logs. Failures that NDS recovers from,
+// such as a memcache error, are logged with Warningf.
+type Logger interface {
+	Debugf(c context.Context, format string, args ...interface{})
+	Errorf(c context.Context, format string, args ...interface{})
+	Warningf(c context.Context, format string, args ...interface{})
+}
+
+var loggerKey = "used for Logger"
+
+// WithLogger returns a context that makes NDS log through l instead of App
+// Engine log. Passing a nil l restores the default logger.
+func WithLogger(c context.Context, l Logger) context.Context {
+	return context.WithValue(c, &loggerKey, l)
+}
+
+func loggerFromContext(c context.Context) Logger {
+	if l, ok := c.Value(&loggerKey).(Logger); ok && l != nil {
+		return l
+	}
+	return appengineLogger{}
+}
+
+func debugf(c context.Context, format string, args ...interface{}) {
+	loggerFromContext(c).Debugf(c, format, args...)
+}
+
+func warningf(c context.Context, format string, args ...interface{}) {
+	loggerFromContext(c).Warningf(c, format, args...)
+}
+
+// appengineLogger is the default Logger and uses App Engine log.
+type appengineLogger struct{}
+
+func (appengineLogger) Debugf(c context.Context, format string,
+	args ...interface{}) {
+	log.Debugf(c, format, args...)
+}
+
+func (appengineLogger) Errorf(c context.Context, format string,
+	args ...interface{}) {
+	log.Errorf(c, format, args...)
+}
+
+func (appengineLogger) Warningf(c context.Context, format string,
+	args ...interface{}) {
+	log.Warningf(c, format, args...)
+}
@@ -0,0 +1,76 @@
+package nds_test
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/qedus/nds"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/memcache"
+)
+
+// recordingLogger is a nds.Logger that records the debug messages and
+// warnings it is given.
+type recordingLogger struct {
+	sync.Mutex
+	debugs   []string
+	warnings []string
+}
+
+func (rl *recordingLogger) Debugf(c context.Context, format string,
+	args ...interface{}) {
+	rl.Lock()
+	rl.debugs = append(rl.debugs, fmt.Sprintf(format, args...))
+	rl.Unlock()
+}
+
+func (rl *recordingLogger) Errorf(c context.Context, format string,
+	args ...interface{}) {
+}
+
+func (rl *recordingLogger) Warningf(c context.Context, format string,
+	args ...interface{}) {
+	rl.Lock()
+	rl.warnings = append(rl.warnings, fmt.Sprintf(format, args...))
+	rl.Unlock()
+}
+
+func TestWithLogger(t *testing.T) {
+	c, closeFunc := NewContext(t, nil)
+	defer closeFunc()
+
+	type testEntity struct {
+		Val int
+	}
+
+	nds.SetMemcacheDeleteMulti(func(c context.Context, keys []string) error {
+		return errors.New("expected error")
+	})
+	defer nds.SetMemcacheDeleteMulti(memcache.DeleteMulti)
+
+	rl := &recordingLogger{}
+	lc := nds.WithLogger(c, rl)
+
+	key := datastore.NewKey(c, "Entity", "", 1, nil)
+	if _, err := nds.Put(lc, key, &testEntity{5}); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(rl.warnings) != 1 ||
+		!strings.HasPrefix(rl.warnings[0], "putMulti memcache.DeleteMulti") {
+		t.Fatal("expected DeleteMulti warning", rl.warnings)
+	}
+
+	// A nil logger falls back to the default logger.
+	if _, err := nds.Put(nds.WithLogger(lc, nil), key,
+		&testEntity{6}); err != nil {
+		t.Fatal(err)
+	}
+	if len(rl.warnings) != 1 {
+		t.Fatal("expected no more warnings", rl.warnings)
+	}
+}
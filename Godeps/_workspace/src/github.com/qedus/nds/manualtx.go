@@ -0,0 +1,80 @@
+package nds
+
+import (
+	"errors"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/datastore"
+)
+
+// WithManualTransaction returns a context for using NDS within a transaction
+// run with datastore.RunInTransaction, or some other way, instead of
+// RunInTransaction. tc must be the transaction context. PutMulti and
+// DeleteMulti using the returned context buffer their cache locks as they do
+// within RunInTransaction, and FlushTransactionLocks must be called with it
+// once the transaction has committed or cached entities will go stale.
+//
+// Mixing NDS with transactions it does not run is strongly discouraged as
+// nothing ensures the locks are flushed, and flushing them only after the
+// commit leaves a window in which stale entities can be read from the cache.
+// This is an escape hatch for legacy code only; use RunInTransaction wherever
+// possible. If tc is already an NDS transaction context it is returned as is.
+func WithManualTransaction(tc context.Context) context.Context {
+	if _, ok := transactionFromContext(tc); ok {
+		return tc
+	}
+	return context.WithValue(tc, &transactionKey, &transaction{
+		lockMemcacheKeys: map[string]bool{},
+		entities:         map[string]datastore.PropertyList{},
+		manual:           true,
+	})
+}
+
+// FlushTransactionLocks writes and then deletes the cache locks buffered by
+// writes made with c, which must be a context returned by
+// WithManualTransaction, invalidating the cached entities written within the
+// transaction. It must be called after the transaction has committed. Once
+// flushed the buffer is empty so later calls do nothing until more writes are
+// made. It does nothing outside a transaction and returns an error within a
+// transaction run by RunInTransaction, which flushes its own locks.
+func FlushTransactionLocks(c context.Context) error {
+	tx, ok := transactionFromContext(c)
+	if !ok {
+		return nil
+	}
+	if !tx.manual {
+		return errors.New(
+			"nds: RunInTransaction transactions flush their own locks")
+	}
+
+	tx.Lock()
+	items, lockedKeys := tx.lockMemcacheItems, tx.lockedKeys
+	deleteMemcacheKeys := tx.deleteMemcacheKeys
+	deleteKeys := tx.deleteKeys
+	tx.lockMemcacheItems, tx.lockedKeys = nil, nil
+	tx.lockMemcacheKeys = map[string]bool{}
+	tx.deleteMemcacheKeys, tx.deleteKeys = nil, nil
+	tx.Unlock()
+
+	memcacheKeys := make([]string, 0, len(items)+len(deleteMemcacheKeys))
+	for _, item := range items {
+		memcacheKeys = append(memcacheKeys, item.Key)
+	}
+	memcacheKeys = append(memcacheKeys, deleteMemcacheKeys...)
+	if len(memcacheKeys) == 0 {
+		return nil
+	}
+	evictLocalCache(c, memcacheKeys)
+
+	if len(items) > 0 {
+		if err := setLockBatches(c, items); err != nil {
+			return err
+		}
+	}
+	if err := cacheFromContext(c).DeleteMulti(c,
+		memcacheKeys); err != nil && !isCacheMissErrors(err) {
+		return err
+	}
+	invalidated(c, append(lockedKeys, deleteKeys...))
+	return nil
+}
@@ -0,0 +1,73 @@
+package nds_test
+
+import (
+	"testing"
+
+	"github.com/qedus/nds"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/datastore"
+)
+
+func TestFlushTransactionLocks(t *testing.T) {
+	c, closeFunc := NewContext(t, nil)
+	defer closeFunc()
+
+	type testEntity struct {
+		Val int
+	}
+
+	key := datastore.NewKey(c, "Entity", "", 1, nil)
+	if _, err := nds.Put(c, key, &testEntity{1}); err != nil {
+		t.Fatal(err)
+	}
+	if err := nds.Get(c, key, &testEntity{}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := nds.FlushTransactionLocks(c); err != nil {
+		t.Fatal("expected no-op outside a transaction", err)
+	}
+
+	rc := &recordingCache{}
+	cc := nds.WithCache(c, rc)
+	var mtc context.Context
+	if err := datastore.RunInTransaction(cc, func(tc context.Context) error {
+		mtc = nds.WithManualTransaction(tc)
+		_, err := nds.Put(mtc, key, &testEntity{2})
+		return err
+	}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if len(rc.setItems) != 0 {
+		t.Fatal("expected locks to be buffered", len(rc.setItems))
+	}
+
+	if err := nds.FlushTransactionLocks(mtc); err != nil {
+		t.Fatal(err)
+	}
+	if len(rc.setItems) != 1 || len(rc.delKeys) != 1 {
+		t.Fatal("expected lock to be flushed", len(rc.setItems),
+			len(rc.delKeys))
+	}
+	if err := nds.FlushTransactionLocks(mtc); err != nil {
+		t.Fatal(err)
+	} else if len(rc.setItems) != 1 {
+		t.Fatal("expected nothing more to flush", len(rc.setItems))
+	}
+
+	te := &testEntity{}
+	if err := nds.Get(c, key, te); err != nil {
+		t.Fatal(err)
+	} else if te.Val != 2 {
+		t.Fatal("expected fresh val", te.Val)
+	}
+
+	if err := nds.RunInTransaction(c, func(tc context.Context) error {
+		if err := nds.FlushTransactionLocks(tc); err == nil {
+			t.Fatal("expected error within RunInTransaction")
+		}
+		return nil
+	}, nil); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,41 @@
+package nds
+
+import (
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/memcache"
+)
+
+var maxCacheAgeKey = "used for max cache age"
+
+// WithMaxCacheAge returns a context that makes GetMulti ignore cached entities
+// written more than d ago, reading them from the datastore and replacing them
+// in the cache as if they had not been cached. Unlike WithKindTTL this does
+// not give items a memcache expiration, so it bounds how stale a cached entity
+// can be without changing how memcache evicts it.
+//
+// Entities cached by a context with a max age carry the time they were
+// written. Entities cached without it, such as by other contexts or previous
+// versions of NDS, are treated as too old and replaced the first time they are
+// read. Entities cached as missing are unaffected, WithNegativeCache bounds
+// how long they are cached for. Durations of zero or less have no effect.
+func WithMaxCacheAge(c context.Context, d time.Duration) context.Context {
+	return context.WithValue(c, &maxCacheAgeKey, d)
+}
+
+func maxCacheAge(c context.Context) (time.Duration, bool) {
+	d, _ := c.Value(&maxCacheAgeKey).(time.Duration)
+	return d, d > 0
+}
+
+// isTooOld reports whether the entity item was written longer ago than the
+// max cache age of c allows.
+func isTooOld(c context.Context, item *memcache.Item) bool {
+	d, ok := maxCacheAge(c)
+	if !ok {
+		return false
+	}
+	header, _ := splitItemHeader(item)
+	return header.written.IsZero() || timeNow().Sub(header.written) > d
+}
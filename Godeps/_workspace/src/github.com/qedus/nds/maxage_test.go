@@ -0,0 +1,90 @@
+package nds_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/qedus/nds"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/memcache"
+)
+
+func TestWithMaxCacheAge(t *testing.T) {
+	c, closeFunc := NewContext(t, nil)
+	defer closeFunc()
+
+	type testEntity struct {
+		Val int
+	}
+
+	now := time.Now()
+	nds.SetTimeNow(func() time.Time { return now })
+	defer nds.SetTimeNow(time.Now)
+
+	rc := &recordingCache{}
+	mc := nds.WithMaxCacheAge(nds.WithCache(c, rc), time.Minute)
+
+	key := datastore.NewKey(c, "Entity", "", 1, nil)
+	if _, err := nds.Put(mc, key, &testEntity{1}); err != nil {
+		t.Fatal(err)
+	}
+
+	// The first get caches the entity with its write time.
+	for i := 0; i < 2; i++ {
+		te := &testEntity{}
+		if err := nds.Get(mc, key, te); err != nil {
+			t.Fatal(err)
+		} else if te.Val != 1 {
+			t.Fatal("incorrect val", te.Val)
+		}
+	}
+	if len(rc.casItems) != 1 {
+		t.Fatal("expected entity to be cached once", len(rc.casItems))
+	}
+	if rc.casItems[0].Flags != nds.EntityItem|nds.WrittenFlag {
+		t.Fatal("expected write time header", rc.casItems[0].Flags)
+	}
+
+	// Change the entity without invalidating the cache.
+	if _, err := datastore.Put(c, key, &testEntity{2}); err != nil {
+		t.Fatal(err)
+	}
+	te := &testEntity{}
+	if err := nds.Get(mc, key, te); err != nil {
+		t.Fatal(err)
+	} else if te.Val != 1 {
+		t.Fatal("expected cached val", te.Val)
+	}
+
+	// Once the cached entity is too old it is read again and replaced.
+	now = now.Add(2 * time.Minute)
+	for i := 0; i < 2; i++ {
+		te := &testEntity{}
+		if err := nds.Get(mc, key, te); err != nil {
+			t.Fatal(err)
+		} else if te.Val != 2 {
+			t.Fatal("incorrect val", te.Val)
+		}
+	}
+	if len(rc.casItems) != 2 {
+		t.Fatal("expected entity to be cached again", len(rc.casItems))
+	}
+
+	// Entities cached without a write time are replaced.
+	if err := memcache.Delete(c, nds.CreateMemcacheKey(key)); err != nil {
+		t.Fatal(err)
+	}
+	if err := nds.Get(nds.WithCache(c, rc), key, &testEntity{}); err != nil {
+		t.Fatal(err)
+	}
+	if rc.casItems[2].Flags != nds.EntityItem {
+		t.Fatal("expected no write time header", rc.casItems[2].Flags)
+	}
+	if err := nds.Get(mc, key, &testEntity{}); err != nil {
+		t.Fatal(err)
+	}
+	if len(rc.casItems) != 4 ||
+		rc.casItems[3].Flags != nds.EntityItem|nds.WrittenFlag {
+		t.Fatal("expected entity to be replaced", len(rc.casItems))
+	}
+}
@@ -0,0 +1,99 @@
+package nds
+
+import (
+	"reflect"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+)
+
+var serializationMemoryLimitKey = "used for serialization memory limit"
+
+// WithSerializationMemoryLimit returns a context that makes PutMulti split
+// its entities into batches whose estimated serialized size is at most bytes,
+// as well as at most the usual batch size, and put those batches one after
+// another. This bounds the memory held by serialized entities during bulk
+// writes of large entities. An entity larger than bytes on its own is put in
+// a batch of its own. The size of each entity is estimated from the size of
+// its property values. Returned keys stay in the same order as keys. A limit
+// of zero or less disables it, which is the default.
+func WithSerializationMemoryLimit(c context.Context, bytes int) context.Context {
+	return context.WithValue(c, &serializationMemoryLimitKey, bytes)
+}
+
+func serializationMemoryLimit(c context.Context) (int, bool) {
+	limit, _ := c.Value(&serializationMemoryLimitKey).(int)
+	return limit, limit > 0
+}
+
+// estimateEntitySize estimates the serialized size of the entity in val.
+func estimateEntitySize(val reflect.Value) int {
+	pl, err := saveValue(val)
+	if err != nil {
+		// Leave the error for the datastore to report.
+		return 0
+	}
+
+	size := 0
+	for _, p := range pl {
+		size += len(p.Name)
+		switch v := p.Value.(type) {
+		case string:
+			size += len(v)
+		case []byte:
+			size += len(v)
+		case datastore.ByteString:
+			size += len(v)
+		case *datastore.Key:
+			if v != nil {
+				size += len(v.Encode())
+			}
+		default:
+			size += 8
+		}
+	}
+	return size
+}
+
+// putBounded puts the entities in vals in consecutive batches of at most size
+// entities and about limit bytes.
+func putBounded(c context.Context, keys []*datastore.Key, vals reflect.Value,
+	size, limit int) ([]*datastore.Key, error) {
+
+	putKeys := make([]*datastore.Key, len(keys))
+	errs, errsNil := make(appengine.MultiError, len(keys)), true
+	for lo := 0; lo < len(keys); {
+		if err := c.Err(); err != nil {
+			return nil, err
+		}
+
+		hi, bytes := lo, 0
+		for hi < len(keys) && hi-lo < size {
+			n := estimateEntitySize(vals.Index(hi))
+			if hi > lo && bytes+n > limit {
+				break
+			}
+			bytes += n
+			hi++
+		}
+
+		dsKeys, err := putMulti(c, keys[lo:hi], vals.Slice(lo, hi).Interface())
+		copy(putKeys[lo:hi], dsKeys)
+		if me, ok := err.(appengine.MultiError); ok {
+			copy(errs[lo:hi], me)
+			errsNil = false
+		} else if err != nil {
+			for i := lo; i < hi; i++ {
+				errs[i] = err
+			}
+			errsNil = false
+		}
+		lo = hi
+	}
+
+	if errsNil {
+		return putKeys, nil
+	}
+	return nil, errs
+}
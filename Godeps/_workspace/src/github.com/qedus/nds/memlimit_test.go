@@ -0,0 +1,47 @@
+package nds_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/qedus/nds"
+	"google.golang.org/appengine/datastore"
+)
+
+func TestWithSerializationMemoryLimit(t *testing.T) {
+	c, closeFunc := NewContext(t, nil)
+	defer closeFunc()
+
+	type testEntity struct {
+		Blob string `datastore:",noindex"`
+	}
+
+	keys := make([]*datastore.Key, 5)
+	vals := make([]testEntity, len(keys))
+	for i := range keys {
+		keys[i] = datastore.NewIncompleteKey(c, "Entity", nil)
+		vals[i] = testEntity{strings.Repeat("x", 1000)}
+	}
+	// The third entity needs a batch of its own.
+	vals[2].Blob = strings.Repeat("y", 5000)
+
+	cd := &countingDatastore{}
+	mc := nds.WithSerializationMemoryLimit(nds.WithDatastore(c, cd), 2500)
+	putKeys, err := nds.PutMulti(mc, keys, vals)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cd.puts != 3 {
+		t.Fatal("expected 3 batches", cd.puts)
+	}
+
+	got := make([]testEntity, len(putKeys))
+	if err := nds.GetMulti(c, putKeys, got); err != nil {
+		t.Fatal(err)
+	}
+	for i := range got {
+		if got[i].Blob != vals[i].Blob {
+			t.Fatal("keys out of order", i)
+		}
+	}
+}
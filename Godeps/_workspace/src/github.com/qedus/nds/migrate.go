@@ -0,0 +1,115 @@
+package nds
+
+import (
+	"golang.org/x/net/context"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/memcache"
+)
+
+// MigrateCache rewrites the cached entities for keys, decoding them with
+// oldCodec and encoding them again with newCodec, so the cache keeps its
+// entities when the codec set with WithCodec is changed. Migrating ahead of
+// switching codecs, or in the background just after, avoids flushing the cache
+// and reading every entity from the datastore again.
+//
+// Keys that are not cached, are cached as missing or are locked are skipped,
+// as are entities that fail to decode with oldCodec, such as those already
+// migrated. Entities are replaced using compare and swap so an entity put or
+// deleted while it is migrated is never overwritten. MigrateCache returns the
+// number of entities that were migrated, processing keys in batches of at most
+// 500.
+func MigrateCache(c context.Context, keys []*datastore.Key, oldCodec,
+	newCodec Codec) (int, error) {
+
+	if err := checkCacheKeyPrefix(c); err != nil {
+		return 0, err
+	}
+
+	size := batchSize(c, putMultiLimit)
+	counts := make([]int, (len(keys)+size-1)/size)
+	err := runBatches(c, len(keys), size, func(lo, hi int) error {
+		n, err := migrateCacheMulti(c, keys[lo:hi], oldCodec, newCodec)
+		counts[lo/size] = n
+		return err
+	})
+
+	migrated := 0
+	for _, n := range counts {
+		migrated += n
+	}
+	return migrated, err
+}
+
+func migrateCacheMulti(c context.Context, keys []*datastore.Key, oldCodec,
+	newCodec Codec) (int, error) {
+
+	memcacheKeys := make([]string, len(keys))
+	for i, key := range keys {
+		memcacheKeys[i] = createMemcacheKey(c, key)
+	}
+
+	items, err := cacheFromContext(c).GetMulti(c, memcacheKeys)
+	if err != nil {
+		return 0, err
+	}
+
+	casItems := make([]*memcache.Item, 0, len(items))
+	for i, memcacheKey := range memcacheKeys {
+		item, ok := items[memcacheKey]
+		if !ok || itemType(item.Flags) != entityItem {
+			continue
+		}
+		pl, err := decodeEntityItem(c, keys[i], oldCodec, item)
+		if err != nil {
+			debugf(c, "nds:MigrateCache decode %s", err)
+			continue
+		}
+		if err := reencodeItem(c, keys[i], newCodec, item, pl); err != nil {
+			return 0, err
+		}
+		casItems = append(casItems, item)
+		// Only migrate duplicate keys once.
+		delete(items, memcacheKey)
+	}
+	if len(casItems) == 0 {
+		return 0, nil
+	}
+
+	err = checkMultiError(cacheFromContext(c).CompareAndSwapMulti(c,
+		casItems), len(casItems))
+	me, ok := err.(appengine.MultiError)
+	if err != nil && !ok {
+		return 0, err
+	}
+	migrated := 0
+	for i := range casItems {
+		if !ok || me[i] == nil {
+			migrated++
+		}
+	}
+	return migrated, nil
+}
+
+// reencodeItem replaces the value and flags of item, the entity item caching
+// pl for key, with pl encoded with codec. The header keeps the write time and
+// kind of the entry as migrating an entity does not make it any fresher.
+func reencodeItem(c context.Context, key *datastore.Key, codec Codec,
+	item *memcache.Item, pl datastore.PropertyList) error {
+
+	partial := item.Flags & partialFlag
+	old, _ := splitItemHeader(item)
+	value, flags, err := encodeEntityItem(c, key, codec, pl)
+	if err != nil {
+		return err
+	}
+	item.Value, item.Flags = value, flags|partial
+	item.Expiration = entityExpiration(c, key)
+	header := newItemHeader(c, key, item.Expiration)
+	header.written = old.written
+	if old.kind != "" {
+		header.kind = old.kind
+	}
+	item.Value, item.Flags = header.add(item.Value, item.Flags)
+	return nil
+}
@@ -0,0 +1,54 @@
+package nds_test
+
+import (
+	"testing"
+
+	"github.com/qedus/nds"
+	"google.golang.org/appengine/datastore"
+)
+
+func TestMigrateCache(t *testing.T) {
+	c, closeFunc := NewContext(t, nil)
+	defer closeFunc()
+
+	type testEntity struct {
+		Val int
+	}
+
+	keys := []*datastore.Key{
+		datastore.NewKey(c, "Entity", "", 1, nil),
+		datastore.NewKey(c, "Entity", "", 2, nil),
+		datastore.NewKey(c, "Entity", "", 3, nil),
+		datastore.NewKey(c, "Entity", "", 4, nil),
+	}
+	if _, err := nds.PutMulti(c, keys[:3], []testEntity{{1}, {2}, {3}}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Cache the first two entities and the missing one.
+	cacheKeys := []*datastore.Key{keys[0], keys[1], keys[3]}
+	if err := nds.GetMulti(c, cacheKeys,
+		make([]testEntity, len(cacheKeys))); err == nil {
+		t.Fatal("expected missing entity error")
+	}
+
+	pc := &prefixCodec{}
+	if n, err := nds.MigrateCache(nds.WithMaxBatchSize(c, 2), keys, nds.GobCodec,
+		pc); err != nil {
+		t.Fatal(err)
+	} else if n != 2 {
+		t.Fatal("expected 2 migrated entities", n)
+	}
+
+	cd := &countingDatastore{}
+	pcc := nds.WithCodec(nds.WithDatastore(c, cd), pc)
+	vals := make([]testEntity, 2)
+	if err := nds.GetMulti(pcc, keys[:2], vals); err != nil {
+		t.Fatal(err)
+	} else if vals[0].Val != 1 || vals[1].Val != 2 {
+		t.Fatal("incorrect vals", vals)
+	}
+	if cd.gets != 0 {
+		t.Fatal("expected migrated entities to be cached", cd.gets)
+	}
+}
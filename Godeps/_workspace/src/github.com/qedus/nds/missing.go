@@ -0,0 +1,47 @@
+package nds
+
+import (
+	"golang.org/x/net/context"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+)
+
+var missingAsNilKey = "used for missing as nil"
+
+// WithMissingAsNil returns a context that makes GetMulti, and Get, treat
+// entities that do not exist as if they had loaded successfully. Their vals
+// are left unmodified, so are zero valued if vals was freshly made, and they
+// contribute no datastore.ErrNoSuchEntity error. nil is returned when the
+// only errors are missing entities, otherwise other errors are still returned
+// in a appengine.MultiError. This is intended for optional lookups where
+// missing entities are expected.
+func WithMissingAsNil(c context.Context) context.Context {
+	return context.WithValue(c, &missingAsNilKey, true)
+}
+
+func isMissingAsNil(c context.Context) bool {
+	missingAsNil, _ := c.Value(&missingAsNilKey).(bool)
+	return missingAsNil
+}
+
+// dropMissing removes datastore.ErrNoSuchEntity errors from err, returning nil
+// if no other errors remain.
+func dropMissing(err error) error {
+	me, ok := err.(appengine.MultiError)
+	if !ok {
+		return err
+	}
+
+	errsNil := true
+	for i, e := range me {
+		if e == datastore.ErrNoSuchEntity {
+			me[i] = nil
+		} else if e != nil {
+			errsNil = false
+		}
+	}
+	if errsNil {
+		return nil
+	}
+	return me
+}
@@ -0,0 +1,54 @@
+package nds_test
+
+import (
+	"testing"
+
+	"github.com/qedus/nds"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+)
+
+func TestWithMissingAsNil(t *testing.T) {
+	c, closeFunc := NewContext(t, nil)
+	defer closeFunc()
+
+	type testEntity struct {
+		Val int
+	}
+
+	keys := []*datastore.Key{
+		datastore.NewKey(c, "Entity", "", 1, nil),
+		datastore.NewKey(c, "Entity", "", 2, nil),
+	}
+	if _, err := nds.Put(c, keys[0], &testEntity{1}); err != nil {
+		t.Fatal(err)
+	}
+
+	mc := nds.WithMissingAsNil(c)
+
+	// Read twice so the second read is served from the cache.
+	for i := 0; i < 2; i++ {
+		entities := make([]testEntity, len(keys))
+		if err := nds.GetMulti(mc, keys, entities); err != nil {
+			t.Fatal(err)
+		}
+		if entities[0].Val != 1 || entities[1].Val != 0 {
+			t.Fatal("incorrect entities", i, entities)
+		}
+	}
+
+	if err := nds.Get(mc, keys[1], &testEntity{}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Other errors are still returned.
+	type otherEntity struct {
+		Other string
+	}
+	err := nds.GetMultiPartial(mc, keys, make([]otherEntity, len(keys)))
+	if me, ok := err.(appengine.MultiError); !ok {
+		t.Fatal("expected appengine.MultiError", err)
+	} else if me[0] == nil || me[1] != nil {
+		t.Fatal("incorrect errors", me)
+	}
+}
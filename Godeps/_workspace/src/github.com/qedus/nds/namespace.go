@@ -0,0 +1,124 @@
+package nds
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+)
+
+// WithNamespace returns a context scoped to the App Engine namespace. Keys
+// created with the returned context belong to namespace and, as NDS cache keys
+// are derived from the encoded datastore key which includes its namespace,
+// their cache entries are isolated from those of other namespaces. An error is
+// returned if namespace is not a valid namespace name.
+//
+// It is equivalent to appengine.Namespace and exists so multi-tenant code can
+// scope datastore and cache access with a single call.
+func WithNamespace(c context.Context, namespace string) (context.Context,
+	error) {
+	return appengine.Namespace(c, namespace)
+}
+
+// NamespaceErrors is returned by GetMultiNamespaced with the error for each
+// namespace whose entities could not all be got.
+type NamespaceErrors map[string]error
+
+func (e NamespaceErrors) Error() string {
+	namespaces := make([]string, 0, len(e))
+	for namespace := range e {
+		namespaces = append(namespaces, namespace)
+	}
+	sort.Strings(namespaces)
+
+	switch len(namespaces) {
+	case 0:
+		return "nds: no namespace errors"
+	case 1:
+		return fmt.Sprintf("nds: namespace %q: %s", namespaces[0],
+			e[namespaces[0]])
+	}
+	return fmt.Sprintf("nds: namespace %q: %s (and %d other errors)",
+		namespaces[0], e[namespaces[0]], len(namespaces)-1)
+}
+
+// GetMultiNamespaced gets the entities for the keys of each namespace in
+// keysByNamespace, through a context scoped to the namespace with
+// WithNamespace, and loads each into a new value returned by factory as
+// GetMultiDispatch does. The values are returned by namespace in the same
+// order as their keys. Namespaces are got concurrently, or as many at once as
+// WithConcurrency allows, and the keys of each are batched as GetMulti would
+// batch them. Every key must belong to the namespace it is listed under, so
+// cache entries are never shared between namespaces.
+//
+// If any namespace fails a NamespaceErrors is returned holding its error,
+// which is a appengine.MultiError if only some of its entities could not be
+// got. The values of such namespaces are still returned.
+func GetMultiNamespaced(c context.Context,
+	keysByNamespace map[string][]*datastore.Key,
+	factory func(kind string) interface{}) (map[string][]interface{}, error) {
+
+	if factory == nil {
+		return nil, errors.New("nds: factory is nil")
+	}
+
+	var sem chan struct{}
+	if n := concurrency(c); n > 0 {
+		sem = make(chan struct{}, n)
+	}
+
+	mu := sync.Mutex{}
+	results := make(map[string][]interface{}, len(keysByNamespace))
+	errs := NamespaceErrors{}
+	wg := sync.WaitGroup{}
+	for namespace, keys := range keysByNamespace {
+		if sem != nil {
+			sem <- struct{}{}
+		}
+		wg.Add(1)
+		go func(namespace string, keys []*datastore.Key) {
+			defer wg.Done()
+			vals, err := getNamespaced(c, namespace, keys, factory)
+			if sem != nil {
+				<-sem
+			}
+
+			mu.Lock()
+			defer mu.Unlock()
+			if vals != nil {
+				results[namespace] = vals
+			}
+			if err != nil {
+				errs[namespace] = err
+			}
+		}(namespace, keys)
+	}
+	wg.Wait()
+
+	if len(errs) > 0 {
+		return results, errs
+	}
+	return results, nil
+}
+
+// getNamespaced gets the entities for keys, which must belong to namespace,
+// through a context scoped to namespace.
+func getNamespaced(c context.Context, namespace string, keys []*datastore.Key,
+	factory func(kind string) interface{}) ([]interface{}, error) {
+
+	nc, err := WithNamespace(c, namespace)
+	if err != nil {
+		return nil, err
+	}
+	for _, key := range keys {
+		if key != nil && key.Namespace() != namespace {
+			return nil, fmt.Errorf("nds: key %s is not in namespace %q", key,
+				namespace)
+		}
+	}
+	return GetMultiDispatch(nc, keys, factory)
+}
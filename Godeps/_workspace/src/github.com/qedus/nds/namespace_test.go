@@ -0,0 +1,116 @@
+package nds_test
+
+import (
+	"testing"
+
+	"github.com/qedus/nds"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+)
+
+func TestWithNamespace(t *testing.T) {
+	c, closeFunc := NewContext(t, nil)
+	defer closeFunc()
+
+	type testEntity struct {
+		Val int
+	}
+
+	if _, err := nds.WithNamespace(c, "not valid!"); err == nil {
+		t.Fatal("expected invalid namespace error")
+	}
+
+	rc := &recordingCache{}
+	cc := nds.WithCache(c, rc)
+
+	ac, err := nds.WithNamespace(cc, "tenantA")
+	if err != nil {
+		t.Fatal(err)
+	}
+	bc, err := nds.WithNamespace(cc, "tenantB")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	aKey := datastore.NewKey(ac, "Entity", "", 1, nil)
+	bKey := datastore.NewKey(bc, "Entity", "", 1, nil)
+	if aKey.Namespace() != "tenantA" || bKey.Namespace() != "tenantB" {
+		t.Fatal("incorrect namespaces", aKey, bKey)
+	}
+	if nds.CacheKey(ac, aKey) == nds.CacheKey(bc, bKey) {
+		t.Fatal("cache keys collide across namespaces")
+	}
+
+	if _, err := nds.Put(ac, aKey, &testEntity{1}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := nds.Put(bc, bKey, &testEntity{2}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Read each twice so the second read is served from the cache.
+	for i := 0; i < 2; i++ {
+		ae, be := &testEntity{}, &testEntity{}
+		if err := nds.Get(ac, aKey, ae); err != nil {
+			t.Fatal(err)
+		}
+		if err := nds.Get(bc, bKey, be); err != nil {
+			t.Fatal(err)
+		}
+		if ae.Val != 1 || be.Val != 2 {
+			t.Fatal("namespaces leaked", i, ae.Val, be.Val)
+		}
+	}
+}
+
+func TestGetMultiNamespaced(t *testing.T) {
+	c, closeFunc := NewContext(t, nil)
+	defer closeFunc()
+
+	type testEntity struct {
+		Val int
+	}
+
+	keysByNamespace := map[string][]*datastore.Key{}
+	for i, namespace := range []string{"tenantA", "tenantB"} {
+		nc, err := nds.WithNamespace(c, namespace)
+		if err != nil {
+			t.Fatal(err)
+		}
+		keys := []*datastore.Key{
+			datastore.NewKey(nc, "Entity", "", 1, nil),
+			datastore.NewKey(nc, "Entity", "", 2, nil),
+		}
+		if _, err := nds.Put(nc, keys[0], &testEntity{i + 1}); err != nil {
+			t.Fatal(err)
+		}
+		keysByNamespace[namespace] = keys
+	}
+
+	factory := func(kind string) interface{} { return &testEntity{} }
+	for i := 0; i < 2; i++ {
+		vals, err := nds.GetMultiNamespaced(c, keysByNamespace, factory)
+		nes, ok := err.(nds.NamespaceErrors)
+		if !ok || len(nes) != 2 {
+			t.Fatal("expected an error per namespace", i, err)
+		}
+		for j, namespace := range []string{"tenantA", "tenantB"} {
+			me, ok := nes[namespace].(appengine.MultiError)
+			if !ok || me[0] != nil || me[1] != datastore.ErrNoSuchEntity {
+				t.Fatal("incorrect errors", i, namespace, nes[namespace])
+			}
+			if len(vals[namespace]) != 2 ||
+				vals[namespace][0].(*testEntity).Val != j+1 {
+				t.Fatal("incorrect vals", i, namespace, vals[namespace])
+			}
+		}
+	}
+
+	// Keys must belong to the namespace they are listed under.
+	_, err := nds.GetMultiNamespaced(c, map[string][]*datastore.Key{
+		"tenantA": keysByNamespace["tenantB"],
+	}, factory)
+	if nes, ok := err.(nds.NamespaceErrors); !ok || nes["tenantA"] == nil {
+		t.Fatal("expected namespace mismatch error", err)
+	}
+}
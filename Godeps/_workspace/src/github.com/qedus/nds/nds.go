@@ -2,15 +2,15 @@ package nds
 
 import (
 	"bytes"
-	"crypto/sha1"
 	"encoding/binary"
 	"encoding/gob"
-	"encoding/hex"
 	"errors"
+	"fmt"
 	"math/rand"
 	"reflect"
 	"time"
 
+	"golang.org/x/net/context"
 	"google.golang.org/appengine"
 	"google.golang.org/appengine/datastore"
 	"google.golang.org/appengine/memcache"
@@ -29,6 +29,14 @@ const (
 	// memcacheMaxKeySize is the maximum size a memcache item key can be. Keys
 	// greater than this size are automatically hashed to a smaller size.
 	memcacheMaxKeySize = 250
+
+	// memcacheMaxItemSize is the maximum size of a memcache item value.
+	// Entities that serialize to more than this are not cached.
+	memcacheMaxItemSize = 1000000
+
+	// memcacheMaxExpiration is the longest relative expiration memcache
+	// accepts. Memcache treats anything longer as an absolute Unix time.
+	memcacheMaxExpiration = 30 * 24 * time.Hour
 )
 
 var (
@@ -40,6 +48,7 @@ var (
 // The variables in this block are here so that we can test all error code
 // paths by substituting the respective functions with error producing ones.
 var (
+	datastoreAllocateIDs = datastore.AllocateIDs
 	datastoreDeleteMulti = datastore.DeleteMulti
 	datastoreGetMulti    = datastore.GetMulti
 	datastorePutMulti    = datastore.PutMulti
@@ -48,18 +57,100 @@ var (
 	memcacheCompareAndSwapMulti = memcache.CompareAndSwapMulti
 	memcacheDeleteMulti         = memcache.DeleteMulti
 	memcacheGetMulti            = memcache.GetMulti
+	memcacheIncrement           = memcache.Increment
+	memcacheIncrementExisting   = memcache.IncrementExisting
 	memcacheSetMulti            = memcache.SetMulti
 
 	marshal   = marshalPropertyList
 	unmarshal = unmarshalPropertyList
 )
 
+// The flags of every memcache item NDS stores hold the item type in the low
+// byte, selected by itemTypeMask, and modifier bits above it. Item types are
+// exclusive values whereas modifiers are distinct bits that can be combined.
 const (
 	noneItem uint32 = iota
 	entityItem
 	lockItem
+
+	// keyItem holds an encoded key or memcache key rather than an entity,
+	// as used by GetByUnique.
+	keyItem
+
+	// tombstoneItem marks an entity deleted with WithTombstones. Unlike a
+	// lockItem it is a final answer so GetMulti returns ErrDeleted for it.
+	tombstoneItem
+
+	// refreshItem replaces the cache entry of an entity written with
+	// WithGraceRefresh. The first reader to replace it with a refresh lock
+	// reads the entity through to the cache while other readers wait.
+	refreshItem
+
+	// unknownItem is returned by itemType for flags it does not recognise.
+	// It is never stored.
+	unknownItem uint32 = itemTypeMask
 )
 
+const itemTypeMask uint32 = 0xff
+
+// compressedFlag is combined with entityItem for entities whose serialized
+// value is gzip compressed.
+const compressedFlag uint32 = 1 << 8
+
+// schemaFlag is combined with entityItem for entities whose value starts with
+// the schema version set by WithSchemaVersion.
+const schemaFlag uint32 = 1 << 9
+
+// expiryFlag is combined with entityItem for entities whose value starts with
+// the time the item expires, as used by WithStaleWhileRevalidate.
+const expiryFlag uint32 = 1 << 10
+
+// checksumFlag is combined with entityItem for entities whose value ends with
+// the checksum added by WithChecksum of everything after the expiry header.
+const checksumFlag uint32 = 1 << 11
+
+// partialFlag is combined with entityItem for entities cached without the
+// fields tagged nds:"nocache".
+const partialFlag uint32 = 1 << 12
+
+// fieldCompressedFlag is combined with entityItem for entities with fields
+// compressed by WithFieldCompression.
+const fieldCompressedFlag uint32 = 1 << 13
+
+// writtenFlag is combined with entityItem for entities whose value starts with
+// the time the item was written, after any expiry time, as used by
+// WithMaxCacheAge.
+const writtenFlag uint32 = 1 << 14
+
+// kindFlag is combined with entityItem for entities whose value starts with
+// the kind of their key, after any expiry and write times, as used by
+// WithKindHeader.
+const kindFlag uint32 = 1 << 15
+
+// refreshFlag is combined with lockItem for the lock of a reader that claimed
+// a refreshItem, which other readers wait for the entity to be cached behind.
+const refreshFlag uint32 = 1 << 16
+
+// generationFlag is combined with entityItem for entities whose value starts
+// with the cache generation set by WithCacheGeneration, after any expiry and
+// write times and kind.
+const generationFlag uint32 = 1 << 17
+
+// itemModifiers are the modifier bits this version of NDS understands.
+const itemModifiers = compressedFlag | schemaFlag | expiryFlag | checksumFlag |
+	partialFlag | fieldCompressedFlag | writtenFlag | kindFlag | refreshFlag |
+	generationFlag
+
+// itemType returns the type of a memcache item with flags. Items with
+// modifier bits that are not understood return unknownItem so they are never
+// misinterpreted.
+func itemType(flags uint32) uint32 {
+	if flags&^(itemTypeMask|itemModifiers) != 0 {
+		return unknownItem
+	}
+	return flags & itemTypeMask
+}
+
 func init() {
 	gob.Register(time.Time{})
 	gob.Register(datastore.ByteString{})
@@ -69,18 +160,47 @@ func init() {
 }
 
 func itemLock() []byte {
-	b := make([]byte, 4)
+	b := make([]byte, lockValueSize)
 	binary.LittleEndian.PutUint32(b, rand.Uint32())
+	binary.BigEndian.PutUint64(b[4:], uint64(time.Now().UnixNano()))
 	return b
 }
 
+// errEmptyMultiError replaces an appengine.MultiError that holds no errors
+// where the error of a single entity is expected.
+var errEmptyMultiError = errors.New("nds: empty appengine.MultiError")
+
+// singleError returns the only error of err if it is a appengine.MultiError
+// for a batch of one entity, the error of a single entity call.
+func singleError(err error) error {
+	me, ok := err.(appengine.MultiError)
+	if !ok {
+		return err
+	} else if len(me) == 0 {
+		return errEmptyMultiError
+	}
+	return me[0]
+}
+
+// checkMultiError returns err unless it is a appengine.MultiError that does
+// not hold an error for each of n entities, which is replaced with a generic
+// error so that callers can index it by position.
+func checkMultiError(err error, n int) error {
+	if me, ok := err.(appengine.MultiError); ok && len(me) != n {
+		return fmt.Errorf("nds: appengine.MultiError has %d errors for %d "+
+			"entities", len(me), n)
+	}
+	return err
+}
+
 func checkMultiArgs(keys []*datastore.Key, v reflect.Value) error {
 	if v.Kind() != reflect.Slice {
 		return errors.New("nds: vals is not a slice")
 	}
 
 	if len(keys) != v.Len() {
-		return errors.New("nds: keys and vals slices have different length")
+		return fmt.Errorf("nds: keys and vals slices have different lengths "+
+			"(got %d keys, %d vals)", len(keys), v.Len())
 	}
 
 	isNilErr, nilErr := false, make(appengine.MultiError, len(keys))
@@ -104,8 +224,10 @@ func checkMultiArgs(keys []*datastore.Key, v reflect.Value) error {
 	}
 
 	switch elemType.Kind() {
-	case reflect.Struct, reflect.Interface:
+	case reflect.Struct:
 		return nil
+	case reflect.Interface:
+		return checkInterfaceVals(v)
 	case reflect.Ptr:
 		elemType = elemType.Elem()
 		if elemType.Kind() == reflect.Struct {
@@ -115,13 +237,58 @@ func checkMultiArgs(keys []*datastore.Key, v reflect.Value) error {
 	return errors.New("nds: unsupported vals type")
 }
 
-func createMemcacheKey(key *datastore.Key) string {
-	memcacheKey := memcachePrefix + key.Encode()
-	if len(memcacheKey) > memcacheMaxKeySize {
-		hash := sha1.Sum([]byte(memcacheKey))
-		memcacheKey = hex.EncodeToString(hash[:])
+// checkPutArgs checks the arguments of PutMulti. Unlike GetMulti, which
+// allocates entities for nil pointer elements, PutMulti has nothing to save
+// for them so they are reported with their index once the slice lengths are
+// known to match.
+func checkPutArgs(keys []*datastore.Key, v reflect.Value) error {
+	if v.Kind() == reflect.Slice && v.Len() == len(keys) {
+		for i := 0; i < v.Len(); i++ {
+			elem := v.Index(i)
+			if elem.Kind() == reflect.Interface {
+				elem = elem.Elem()
+			}
+			if !elem.IsValid() {
+				return fmt.Errorf("nds: vals[%d] is nil", i)
+			} else if elem.Kind() == reflect.Ptr && elem.IsNil() {
+				return fmt.Errorf("nds: vals[%d] is a nil pointer", i)
+			}
+		}
 	}
-	return memcacheKey
+	return checkMultiArgs(keys, v)
+}
+
+// checkInterfaceVals checks that no element of the []I v is nil. Elements of
+// the wrong type are reported when their entity is loaded, as with the
+// datastore package, so that missing entities still report
+// datastore.ErrNoSuchEntity.
+func checkInterfaceVals(v reflect.Value) error {
+	isErr, errs := false, make(appengine.MultiError, v.Len())
+	for i := 0; i < v.Len(); i++ {
+		elem := v.Index(i).Elem()
+		if !elem.IsValid() || elem.Kind() == reflect.Ptr && elem.IsNil() {
+			isErr = true
+			errs[i] = datastore.ErrInvalidEntityType
+		}
+	}
+	if isErr {
+		return errs
+	}
+	return nil
+}
+
+// checkAppIDs checks that every key belongs to the app of c. The datastore
+// rejects keys of another app with an error that does not say which key was
+// at fault, so the first such key is reported with its index.
+func checkAppIDs(c context.Context, keys []*datastore.Key) error {
+	appID := datastore.NewKey(c, "", "", 0, nil).AppID()
+	for i, key := range keys {
+		if key != nil && key.AppID() != appID {
+			return fmt.Errorf("nds: keys[%d] has app ID %q, not %q", i,
+				key.AppID(), appID)
+		}
+	}
+	return nil
 }
 
 func marshalPropertyList(pl datastore.PropertyList) ([]byte, error) {
@@ -136,21 +303,40 @@ func unmarshalPropertyList(data []byte, pl *datastore.PropertyList) error {
 	return gob.NewDecoder(bytes.NewBuffer(data)).Decode(pl)
 }
 
-func setValue(val reflect.Value, pl datastore.PropertyList) error {
+func saveValue(val reflect.Value) (datastore.PropertyList, error) {
 
 	if reflect.PtrTo(val.Type()).Implements(typeOfPropertyLoadSaver) {
 		val = val.Addr()
 	}
 
 	if pls, ok := val.Interface().(datastore.PropertyLoadSaver); ok {
-		return pls.Load(pl)
+		return pls.Save()
 	}
 
 	if val.Kind() == reflect.Struct {
 		val = val.Addr()
 	}
-	if val.Kind() == reflect.Ptr && val.Type().Elem().Kind() == reflect.Struct && val.IsNil() {
+	return datastore.SaveStruct(val.Interface())
+}
+
+func setValue(val reflect.Value, pl datastore.PropertyList) error {
+
+	// Allocate nil pointers so a *S that implements
+	// datastore.PropertyLoadSaver is not loaded into through a nil receiver.
+	if val.Kind() == reflect.Ptr && val.IsNil() {
 		val.Set(reflect.New(val.Type().Elem()))
 	}
+
+	if reflect.PtrTo(val.Type()).Implements(typeOfPropertyLoadSaver) {
+		val = val.Addr()
+	}
+
+	if pls, ok := val.Interface().(datastore.PropertyLoadSaver); ok {
+		return pls.Load(pl)
+	}
+
+	if val.Kind() == reflect.Struct {
+		val = val.Addr()
+	}
 	return datastore.LoadStruct(val.Interface(), pl)
 }
@@ -1,11 +1,13 @@
 package nds_test
 
 import (
+	"encoding/base64"
 	"encoding/hex"
 	"math/rand"
 	"net/http"
 	"reflect"
 	"strconv"
+	"strings"
 	"testing"
 	"time"
 
@@ -695,3 +697,56 @@ func TestCreateMemcacheKey(t *testing.T) {
 		t.Fatal("incorrect memcache key size")
 	}
 }
+
+// foreignKey returns the key of kind and id in the app appID. It is decoded
+// from an encoded datastore reference because datastore.NewKey only creates
+// keys in the app of its context.
+func foreignKey(t *testing.T, appID, kind string, id byte) *datastore.Key {
+	ref := append([]byte{0x6a, byte(len(appID))}, appID...)
+	ref = append(ref, 0x72, byte(len(kind)+6), 0x0b, 0x12, byte(len(kind)))
+	ref = append(ref, kind...)
+	ref = append(ref, 0x18, id, 0x0c)
+	key, err := datastore.DecodeKey(base64.RawURLEncoding.EncodeToString(ref))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func TestMismatchedAppIDs(t *testing.T) {
+	c, closeFunc := NewContext(t, nil)
+	defer closeFunc()
+
+	type testEntity struct {
+		Val int
+	}
+
+	keys := []*datastore.Key{
+		datastore.NewKey(c, "Entity", "", 1, nil),
+		foreignKey(t, "other-app", "Entity", 2),
+	}
+	if keys[1].AppID() != "other-app" {
+		t.Fatal("incorrect app ID", keys[1].AppID())
+	}
+	checkErr := func(op string, err error) {
+		if err == nil {
+			t.Fatal(op, "expected error")
+		}
+		if msg := err.Error(); !strings.Contains(msg, "keys[1]") ||
+			!strings.Contains(msg, `"other-app"`) ||
+			!strings.Contains(msg, keys[0].AppID()) {
+			t.Fatal(op, "incorrect error", msg)
+		}
+	}
+
+	_, err := nds.PutMulti(c, keys, []testEntity{{1}, {2}})
+	checkErr("PutMulti", err)
+	checkErr("GetMulti", nds.GetMulti(c, keys, make([]testEntity, 2)))
+	checkErr("DeleteMulti", nds.DeleteMulti(c, keys))
+
+	// Nothing in the batch is put.
+	err = nds.Get(c, keys[0], &testEntity{})
+	if err != datastore.ErrNoSuchEntity {
+		t.Fatal("expected no entity", err)
+	}
+}
@@ -0,0 +1,327 @@
+package ndstest
+
+import (
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/memcache"
+)
+
+// Cache is an in-memory nds.Cache following the semantics of App Engine
+// memcache. Items are never evicted other than by expiring and, as with
+// memcache, calls with no items or keys do nothing. It is safe for concurrent
+// use.
+type Cache struct {
+	mu      sync.Mutex
+	items   map[string]cacheItem
+	version uint64
+	offset  time.Duration
+	errFunc ErrorFunc
+}
+
+type cacheItem struct {
+	item    memcache.Item
+	expiry  time.Time
+	version uint64
+}
+
+// casID is held in the Object field of the items returned by GetMulti. It is
+// the version of the item when it was got, so CompareAndSwapMulti can tell
+// whether the item has been modified since, even for copies of the item.
+type casID uint64
+
+// NewCache returns an empty Cache.
+func NewCache() *Cache {
+	return &Cache{items: map[string]cacheItem{}}
+}
+
+// SetErrorFunc makes the methods of the cache that implement nds.Cache and
+// nds.Incrementer fail when f returns an error. A nil f stops them failing.
+func (cache *Cache) SetErrorFunc(f ErrorFunc) {
+	cache.mu.Lock()
+	cache.errFunc = f
+	cache.mu.Unlock()
+}
+
+// Advance moves the clock the cache expires items by forward by d.
+func (cache *Cache) Advance(d time.Duration) {
+	cache.mu.Lock()
+	cache.offset += d
+	cache.mu.Unlock()
+}
+
+// Flush removes every item from the cache.
+func (cache *Cache) Flush() {
+	cache.mu.Lock()
+	cache.items = map[string]cacheItem{}
+	cache.mu.Unlock()
+}
+
+// Item returns a copy of the unexpired item for key.
+func (cache *Cache) Item(key string) (*memcache.Item, bool) {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	ci, ok := cache.get(key)
+	if !ok {
+		return nil, false
+	}
+	return copyItem(&ci.item), true
+}
+
+// Keys returns the keys of the unexpired items in the cache in order.
+func (cache *Cache) Keys() []string {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	keys := make([]string, 0, len(cache.items))
+	for key := range cache.items {
+		if _, ok := cache.get(key); ok {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// AddMulti stores the items whose keys are not already present.
+func (cache *Cache) AddMulti(c context.Context, items []*memcache.Item) error {
+	if len(items) == 0 {
+		return nil
+	}
+	if err := cache.fail("AddMulti", itemKeys(items)); err != nil {
+		return err
+	}
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	return cache.setMulti(items, func(item *memcache.Item) error {
+		if _, ok := cache.get(item.Key); ok {
+			return memcache.ErrNotStored
+		}
+		return nil
+	})
+}
+
+// CompareAndSwapMulti stores the items, which must have been returned by
+// GetMulti or be copies of such items, that have not been modified since they
+// were returned.
+func (cache *Cache) CompareAndSwapMulti(c context.Context,
+	items []*memcache.Item) error {
+
+	if len(items) == 0 {
+		return nil
+	}
+	if err := cache.fail("CompareAndSwapMulti", itemKeys(items)); err != nil {
+		return err
+	}
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	return cache.setMulti(items, func(item *memcache.Item) error {
+		version, ok := item.Object.(casID)
+		if !ok {
+			return memcache.ErrNotStored
+		}
+		ci, ok := cache.get(item.Key)
+		if !ok {
+			return memcache.ErrNotStored
+		} else if ci.version != uint64(version) {
+			return memcache.ErrCASConflict
+		}
+		return nil
+	})
+}
+
+// DeleteMulti removes the items for keys, reporting memcache.ErrCacheMiss for
+// keys that are not present.
+func (cache *Cache) DeleteMulti(c context.Context, keys []string) error {
+	if len(keys) == 0 {
+		return nil
+	}
+	if err := cache.fail("DeleteMulti", keys); err != nil {
+		return err
+	}
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+
+	me, errsNil := make(appengine.MultiError, len(keys)), true
+	for i, key := range keys {
+		if _, ok := cache.get(key); !ok {
+			me[i] = memcache.ErrCacheMiss
+			errsNil = false
+		}
+		delete(cache.items, key)
+	}
+	if errsNil {
+		return nil
+	}
+	return me
+}
+
+// GetMulti returns copies of the unexpired items for keys. Keys that are not
+// present are left out of the map. The Object field of each item records its
+// version for CompareAndSwapMulti and must be left as it is.
+func (cache *Cache) GetMulti(c context.Context,
+	keys []string) (map[string]*memcache.Item, error) {
+
+	if len(keys) == 0 {
+		return nil, nil
+	}
+	if err := cache.fail("GetMulti", keys); err != nil {
+		return nil, err
+	}
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+
+	items := make(map[string]*memcache.Item, len(keys))
+	for _, key := range keys {
+		if ci, ok := cache.get(key); ok {
+			item := copyItem(&ci.item)
+			item.Object = casID(ci.version)
+			items[key] = item
+		}
+	}
+	return items, nil
+}
+
+// SetMulti stores the items whether or not their keys are present.
+func (cache *Cache) SetMulti(c context.Context, items []*memcache.Item) error {
+	if len(items) == 0 {
+		return nil
+	}
+	if err := cache.fail("SetMulti", itemKeys(items)); err != nil {
+		return err
+	}
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	return cache.setMulti(items, func(*memcache.Item) error { return nil })
+}
+
+// Increment atomically adds delta to the decimal value of the item for key,
+// storing initialValue first if the key is not present.
+func (cache *Cache) Increment(c context.Context, key string, delta int64,
+	initialValue uint64) (uint64, error) {
+	return cache.increment(key, delta, &initialValue)
+}
+
+// IncrementExisting atomically adds delta to the decimal value of the item for
+// key, returning memcache.ErrCacheMiss if it is not present.
+func (cache *Cache) IncrementExisting(c context.Context, key string,
+	delta int64) (uint64, error) {
+	return cache.increment(key, delta, nil)
+}
+
+func (cache *Cache) increment(key string, delta int64,
+	initialValue *uint64) (uint64, error) {
+
+	method := "IncrementExisting"
+	if initialValue != nil {
+		method = "Increment"
+	}
+	if err := cache.fail(method, []string{key}); err != nil {
+		return 0, err
+	}
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+
+	ci, ok := cache.get(key)
+	if !ok {
+		if initialValue == nil {
+			return 0, memcache.ErrCacheMiss
+		}
+		ci.item = memcache.Item{
+			Key:   key,
+			Value: []byte(strconv.FormatUint(*initialValue, 10)),
+		}
+	}
+
+	v, err := strconv.ParseUint(string(ci.item.Value), 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	// As with memcache, decrements stop at zero.
+	if delta < 0 && uint64(-delta) > v {
+		v = 0
+	} else {
+		v += uint64(delta)
+	}
+
+	ci.item.Value = []byte(strconv.FormatUint(v, 10))
+	cache.version++
+	ci.version = cache.version
+	cache.items[key] = ci
+	return v, nil
+}
+
+// setMulti stores copies of the items that check does not return an error
+// for, reporting the errors in a appengine.MultiError.
+func (cache *Cache) setMulti(items []*memcache.Item,
+	check func(*memcache.Item) error) error {
+
+	me, errsNil := make(appengine.MultiError, len(items)), true
+	for i, item := range items {
+		if err := check(item); err != nil {
+			me[i] = err
+			errsNil = false
+			continue
+		}
+
+		ci := cacheItem{item: *copyItem(item)}
+		if item.Expiration > 0 {
+			ci.expiry = cache.now().Add(item.Expiration)
+		}
+		cache.version++
+		ci.version = cache.version
+		cache.items[item.Key] = ci
+	}
+	if errsNil {
+		return nil
+	}
+	return me
+}
+
+// get returns the item for key if it has not expired. cache.mu must be held.
+func (cache *Cache) get(key string) (cacheItem, bool) {
+	ci, ok := cache.items[key]
+	if !ok {
+		return cacheItem{}, false
+	}
+	if !ci.expiry.IsZero() && !cache.now().Before(ci.expiry) {
+		delete(cache.items, key)
+		return cacheItem{}, false
+	}
+	return ci, true
+}
+
+func (cache *Cache) now() time.Time {
+	return time.Now().Add(cache.offset)
+}
+
+// fail returns the error of the ErrorFunc of the cache for method, if any.
+func (cache *Cache) fail(method string, keys []string) error {
+	cache.mu.Lock()
+	f := cache.errFunc
+	cache.mu.Unlock()
+	if f == nil {
+		return nil
+	}
+	return f(method, keys)
+}
+
+func copyItem(item *memcache.Item) *memcache.Item {
+	return &memcache.Item{
+		Key:        item.Key,
+		Value:      append([]byte(nil), item.Value...),
+		Flags:      item.Flags,
+		Expiration: item.Expiration,
+	}
+}
+
+func itemKeys(items []*memcache.Item) []string {
+	keys := make([]string, len(items))
+	for i, item := range items {
+		keys[i] = item.Key
+	}
+	return keys
+}
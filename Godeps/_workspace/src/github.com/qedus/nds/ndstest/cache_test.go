@@ -0,0 +1,120 @@
+package ndstest_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/qedus/nds/ndstest"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/memcache"
+)
+
+func TestCache(t *testing.T) {
+	c := context.Background()
+	cache := ndstest.NewCache()
+
+	items := []*memcache.Item{
+		{Key: "one", Value: []byte("1"), Flags: 1},
+		{Key: "two", Value: []byte("2"), Expiration: time.Minute},
+	}
+	if err := cache.AddMulti(c, items); err != nil {
+		t.Fatal(err)
+	}
+
+	// Items are only added when not present.
+	err := cache.AddMulti(c, items[:1])
+	if me, ok := err.(appengine.MultiError); !ok {
+		t.Fatal("expected appengine.MultiError", err)
+	} else if me[0] != memcache.ErrNotStored {
+		t.Fatal("expected memcache.ErrNotStored", me[0])
+	}
+
+	got, err := cache.GetMulti(c, []string{"one", "two", "three"})
+	if err != nil {
+		t.Fatal(err)
+	} else if len(got) != 2 {
+		t.Fatal("expected two items", got)
+	} else if got["one"].Flags != 1 || string(got["one"].Value) != "1" {
+		t.Fatal("incorrect item", got["one"])
+	}
+
+	// Only unmodified items are swapped.
+	if err := cache.SetMulti(c, []*memcache.Item{
+		{Key: "two", Value: []byte("22")},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	got["one"].Value, got["two"].Value = []byte("11"), []byte("222")
+	err = cache.CompareAndSwapMulti(c, []*memcache.Item{got["one"], got["two"]})
+	if me, ok := err.(appengine.MultiError); !ok {
+		t.Fatal("expected appengine.MultiError", err)
+	} else if me[0] != nil || me[1] != memcache.ErrCASConflict {
+		t.Fatal(me)
+	}
+	if item, _ := cache.Item("one"); string(item.Value) != "11" {
+		t.Fatal("incorrect value", string(item.Value))
+	}
+	if item, _ := cache.Item("two"); string(item.Value) != "22" {
+		t.Fatal("incorrect value", string(item.Value))
+	}
+
+	// Copies of got items can be swapped, but only once.
+	got, err = cache.GetMulti(c, []string{"two"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cp := *got["two"]
+	cp.Value = []byte("2222")
+	if err := cache.CompareAndSwapMulti(c,
+		[]*memcache.Item{&cp}); err != nil {
+		t.Fatal(err)
+	}
+	err = cache.CompareAndSwapMulti(c, []*memcache.Item{got["two"]})
+	if me, ok := err.(appengine.MultiError); !ok ||
+		me[0] != memcache.ErrCASConflict {
+		t.Fatal("expected memcache.ErrCASConflict", err)
+	}
+	if item, _ := cache.Item("two"); string(item.Value) != "2222" {
+		t.Fatal("incorrect value", string(item.Value))
+	}
+
+	// Items expire.
+	if err := cache.SetMulti(c, []*memcache.Item{
+		{Key: "three", Value: []byte("3"), Expiration: time.Minute},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	cache.Advance(2 * time.Minute)
+	if keys := cache.Keys(); len(keys) != 2 || keys[0] != "one" ||
+		keys[1] != "two" {
+		t.Fatal("expected three to expire", keys)
+	}
+
+	err = cache.DeleteMulti(c, []string{"one", "three"})
+	if me, ok := err.(appengine.MultiError); !ok {
+		t.Fatal("expected appengine.MultiError", err)
+	} else if me[0] != nil || me[1] != memcache.ErrCacheMiss {
+		t.Fatal(me)
+	}
+}
+
+func TestCacheIncrement(t *testing.T) {
+	c := context.Background()
+	cache := ndstest.NewCache()
+
+	if _, err := cache.IncrementExisting(c, "counter",
+		1); err != memcache.ErrCacheMiss {
+		t.Fatal("expected memcache.ErrCacheMiss", err)
+	}
+	if v, err := cache.Increment(c, "counter", 2, 10); err != nil {
+		t.Fatal(err)
+	} else if v != 12 {
+		t.Fatal("incorrect value", v)
+	}
+	if v, err := cache.IncrementExisting(c, "counter", -20); err != nil {
+		t.Fatal(err)
+	} else if v != 0 {
+		t.Fatal("expected decrement to stop at zero", v)
+	}
+}
@@ -0,0 +1,483 @@
+package ndstest
+
+import (
+	"errors"
+	"reflect"
+	"sort"
+	"sync"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+)
+
+// maxXGEntityGroups is the most entity groups a cross group transaction can
+// use, as with App Engine datastore.
+const maxXGEntityGroups = 25
+
+var (
+	typeOfPropertyLoadSaver = reflect.TypeOf(
+		(*datastore.PropertyLoadSaver)(nil)).Elem()
+
+	errNestedTransaction = errors.New(
+		"ndstest: nested transactions are not supported")
+	errTooManyEntityGroups = errors.New(
+		"ndstest: too many entity groups in transaction")
+)
+
+var transactionKey = "used for ndstest transaction"
+
+// Datastore is an in-memory nds.DatastoreClient following the semantics of
+// App Engine datastore. Reads are always strongly consistent and, as with App
+// Engine, calls with no keys do nothing. It is safe for concurrent use.
+type Datastore struct {
+	mu       sync.Mutex
+	entities map[string]entity
+	lastID   int64
+	errFunc  ErrorFunc
+
+	// versions counts the writes to each entity group, by encoded root key,
+	// so transactions can detect concurrent modification.
+	versions map[string]int64
+}
+
+// entity is a stored entity or a write of one, which deletes the entity if
+// deleted is set.
+type entity struct {
+	key     *datastore.Key
+	pl      datastore.PropertyList
+	deleted bool
+}
+
+// transaction buffers the writes of a transaction until it commits.
+type transaction struct {
+	ds     *Datastore
+	xg     bool
+	groups map[string]int64
+	writes map[string]entity
+}
+
+// NewDatastore returns an empty Datastore.
+func NewDatastore() *Datastore {
+	return &Datastore{
+		entities: map[string]entity{},
+		versions: map[string]int64{},
+	}
+}
+
+// SetErrorFunc makes the methods of the datastore that implement
+// nds.DatastoreClient and nds.IDAllocator fail when f returns an error. A nil f
+// stops them failing.
+func (ds *Datastore) SetErrorFunc(f ErrorFunc) {
+	ds.mu.Lock()
+	ds.errFunc = f
+	ds.mu.Unlock()
+}
+
+// Entity returns a copy of the properties of the entity for key.
+func (ds *Datastore) Entity(key *datastore.Key) (datastore.PropertyList,
+	bool) {
+
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+	e, ok := ds.entities[key.Encode()]
+	if !ok {
+		return nil, false
+	}
+	return copyPropertyList(e.pl), true
+}
+
+// Keys returns the keys of every entity in the datastore, ordered by their
+// encoded form.
+func (ds *Datastore) Keys() []*datastore.Key {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+	encoded := make([]string, 0, len(ds.entities))
+	for k := range ds.entities {
+		encoded = append(encoded, k)
+	}
+	sort.Strings(encoded)
+	keys := make([]*datastore.Key, len(encoded))
+	for i, k := range encoded {
+		keys[i] = ds.entities[k].key
+	}
+	return keys
+}
+
+// DeleteMulti deletes the entities for keys. Deleting a missing entity is not
+// an error.
+func (ds *Datastore) DeleteMulti(c context.Context,
+	keys []*datastore.Key) error {
+
+	if len(keys) == 0 {
+		return nil
+	}
+	if err := ds.fail("DeleteMulti", keys); err != nil {
+		return err
+	}
+	if err := checkKeys(keys, true); err != nil {
+		return err
+	}
+
+	writes := make([]entity, len(keys))
+	for i, key := range keys {
+		writes[i] = entity{key: key, deleted: true}
+	}
+	if tx, ok := ds.transaction(c); ok {
+		return tx.write(writes)
+	}
+
+	ds.mu.Lock()
+	ds.apply(writes)
+	ds.mu.Unlock()
+	return nil
+}
+
+// GetMulti loads the entities for keys into vals, which must be a slice of
+// the types datastore.GetMulti accepts. Missing entities are reported with
+// datastore.ErrNoSuchEntity in a appengine.MultiError.
+func (ds *Datastore) GetMulti(c context.Context, keys []*datastore.Key,
+	vals interface{}) error {
+
+	if len(keys) == 0 {
+		return nil
+	}
+	if err := ds.fail("GetMulti", keys); err != nil {
+		return err
+	}
+	v := reflect.ValueOf(vals)
+	if err := checkVals(keys, v); err != nil {
+		return err
+	}
+	if err := checkKeys(keys, true); err != nil {
+		return err
+	}
+
+	tx, inTx := ds.transaction(c)
+	if inTx {
+		if err := tx.use(keys); err != nil {
+			return err
+		}
+	}
+
+	ds.mu.Lock()
+	pls := make([]datastore.PropertyList, len(keys))
+	found := make([]bool, len(keys))
+	for i, key := range keys {
+		var e entity
+		if e, found[i] = ds.entities[key.Encode()]; found[i] {
+			pls[i] = copyPropertyList(e.pl)
+		}
+	}
+	ds.mu.Unlock()
+
+	me, errsNil := make(appengine.MultiError, len(keys)), true
+	for i := range keys {
+		if !found[i] {
+			me[i] = datastore.ErrNoSuchEntity
+		} else {
+			me[i] = loadEntity(v.Index(i), pls[i])
+		}
+		if me[i] != nil {
+			errsNil = false
+		}
+	}
+	if errsNil {
+		return nil
+	}
+	return me
+}
+
+// PutMulti saves vals, which must be a slice of the types datastore.PutMulti
+// accepts, as the entities for keys. Incomplete keys are given new integer IDs.
+func (ds *Datastore) PutMulti(c context.Context, keys []*datastore.Key,
+	vals interface{}) ([]*datastore.Key, error) {
+
+	if len(keys) == 0 {
+		return nil, nil
+	}
+	if err := ds.fail("PutMulti", keys); err != nil {
+		return nil, err
+	}
+	v := reflect.ValueOf(vals)
+	if err := checkVals(keys, v); err != nil {
+		return nil, err
+	}
+	if err := checkKeys(keys, false); err != nil {
+		return nil, err
+	}
+
+	writes := make([]entity, len(keys))
+	for i, key := range keys {
+		pl, err := saveEntity(v.Index(i))
+		if err != nil {
+			return nil, err
+		}
+		if key.Incomplete() {
+			if key, err = ds.completeKey(c, key); err != nil {
+				return nil, err
+			}
+		}
+		writes[i] = entity{key: key, pl: pl}
+	}
+
+	if tx, ok := ds.transaction(c); ok {
+		if err := tx.write(writes); err != nil {
+			return nil, err
+		}
+	} else {
+		ds.mu.Lock()
+		ds.apply(writes)
+		ds.mu.Unlock()
+	}
+
+	putKeys := make([]*datastore.Key, len(writes))
+	for i, w := range writes {
+		putKeys[i] = w.key
+	}
+	return putKeys, nil
+}
+
+// RunInTransaction runs f in a transaction. Writes made with the context
+// passed to f are only applied once f returns nil, and only if no other write
+// has changed an entity group used by the transaction since the transaction
+// first used it. Otherwise f is run up to three times in all, as with App
+// Engine datastore, before datastore.ErrConcurrentTransaction is returned.
+func (ds *Datastore) RunInTransaction(c context.Context,
+	f func(tc context.Context) error,
+	opts *datastore.TransactionOptions) error {
+
+	if err := ds.fail("RunInTransaction", nil); err != nil {
+		return err
+	}
+	if _, ok := ds.transaction(c); ok {
+		return errNestedTransaction
+	}
+
+	for i := 0; i < 3; i++ {
+		tx := &transaction{
+			ds:     ds,
+			xg:     opts != nil && opts.XG,
+			groups: map[string]int64{},
+			writes: map[string]entity{},
+		}
+		err := f(context.WithValue(c, &transactionKey, tx))
+		if err == nil {
+			err = tx.commit()
+		}
+		if err != datastore.ErrConcurrentTransaction {
+			return err
+		}
+	}
+	return datastore.ErrConcurrentTransaction
+}
+
+func (ds *Datastore) transaction(c context.Context) (*transaction, bool) {
+	tx, ok := c.Value(&transactionKey).(*transaction)
+	return tx, ok && tx.ds == ds
+}
+
+// AllocateIDs reserves n integer IDs that are never given to incomplete keys.
+func (ds *Datastore) AllocateIDs(c context.Context, kind string,
+	parent *datastore.Key, n int) (int64, int64, error) {
+
+	if err := ds.fail("AllocateIDs", nil); err != nil {
+		return 0, 0, err
+	}
+	ds.mu.Lock()
+	low := ds.lastID + 1
+	ds.lastID += int64(n)
+	ds.mu.Unlock()
+	return low, low + int64(n), nil
+}
+
+// completeKey returns key with a new integer ID.
+func (ds *Datastore) completeKey(c context.Context,
+	key *datastore.Key) (*datastore.Key, error) {
+
+	nc, err := appengine.Namespace(c, key.Namespace())
+	if err != nil {
+		return nil, err
+	}
+	ds.mu.Lock()
+	ds.lastID++
+	id := ds.lastID
+	ds.mu.Unlock()
+	return datastore.NewKey(nc, key.Kind(), "", id, key.Parent()), nil
+}
+
+// apply saves or deletes the entities of writes. ds.mu must be held.
+func (ds *Datastore) apply(writes []entity) {
+	for _, w := range writes {
+		k := w.key.Encode()
+		if w.deleted {
+			delete(ds.entities, k)
+		} else {
+			ds.entities[k] = entity{key: w.key, pl: copyPropertyList(w.pl)}
+		}
+		ds.versions[rootKey(w.key)]++
+	}
+}
+
+// fail returns the error of the ErrorFunc of the datastore for method, if
+// any.
+func (ds *Datastore) fail(method string, keys []*datastore.Key) error {
+	ds.mu.Lock()
+	f := ds.errFunc
+	ds.mu.Unlock()
+	if f == nil {
+		return nil
+	}
+	encoded := make([]string, len(keys))
+	for i, key := range keys {
+		if key != nil {
+			encoded[i] = key.Encode()
+		}
+	}
+	return f(method, encoded)
+}
+
+// use records the versions of the entity groups of keys the first time the
+// transaction uses them.
+func (tx *transaction) use(keys []*datastore.Key) error {
+	tx.ds.mu.Lock()
+	defer tx.ds.mu.Unlock()
+	for _, key := range keys {
+		root := rootKey(key)
+		if _, ok := tx.groups[root]; !ok {
+			tx.groups[root] = tx.ds.versions[root]
+		}
+	}
+
+	limit := 1
+	if tx.xg {
+		limit = maxXGEntityGroups
+	}
+	if len(tx.groups) > limit {
+		return errTooManyEntityGroups
+	}
+	return nil
+}
+
+// write buffers writes until the transaction commits.
+func (tx *transaction) write(writes []entity) error {
+	keys := make([]*datastore.Key, len(writes))
+	for i, w := range writes {
+		keys[i] = w.key
+	}
+	if err := tx.use(keys); err != nil {
+		return err
+	}
+	for _, w := range writes {
+		tx.writes[w.key.Encode()] = w
+	}
+	return nil
+}
+
+// commit applies the writes of the transaction unless one of its entity
+// groups has been modified since it was first used.
+func (tx *transaction) commit() error {
+	tx.ds.mu.Lock()
+	defer tx.ds.mu.Unlock()
+	for root, version := range tx.groups {
+		if tx.ds.versions[root] != version {
+			return datastore.ErrConcurrentTransaction
+		}
+	}
+	writes := make([]entity, 0, len(tx.writes))
+	for _, w := range tx.writes {
+		writes = append(writes, w)
+	}
+	tx.ds.apply(writes)
+	return nil
+}
+
+// rootKey returns the encoded root key of the entity group of key.
+func rootKey(key *datastore.Key) string {
+	for key.Parent() != nil {
+		key = key.Parent()
+	}
+	return key.Encode()
+}
+
+// checkKeys reports invalid keys, including incomplete keys if complete is
+// true, in a appengine.MultiError.
+func checkKeys(keys []*datastore.Key, complete bool) error {
+	me, errsNil := make(appengine.MultiError, len(keys)), true
+	for i, key := range keys {
+		if key == nil || complete && key.Incomplete() {
+			me[i] = datastore.ErrInvalidKey
+			errsNil = false
+		}
+	}
+	if errsNil {
+		return nil
+	}
+	return me
+}
+
+func checkVals(keys []*datastore.Key, v reflect.Value) error {
+	if v.Kind() != reflect.Slice {
+		return errors.New("ndstest: vals is not a slice")
+	}
+	if v.Len() != len(keys) {
+		return errors.New("ndstest: keys and vals slices have different length")
+	}
+	return nil
+}
+
+// loadEntity loads pl into the slice element v.
+func loadEntity(v reflect.Value, pl datastore.PropertyList) error {
+	if v.Kind() == reflect.Interface {
+		v = v.Elem()
+	}
+	if v.Kind() == reflect.Ptr && v.IsNil() {
+		v.Set(reflect.New(v.Type().Elem()))
+	}
+	if v.Kind() != reflect.Ptr && v.CanAddr() {
+		v = v.Addr()
+	}
+
+	if pls, ok := v.Interface().(datastore.PropertyLoadSaver); ok {
+		return pls.Load(pl)
+	}
+	if v.Kind() == reflect.Ptr && v.Elem().Kind() == reflect.Struct {
+		return datastore.LoadStruct(v.Interface(), pl)
+	}
+	return datastore.ErrInvalidEntityType
+}
+
+// saveEntity returns the properties of the slice element v.
+func saveEntity(v reflect.Value) (datastore.PropertyList, error) {
+	if v.Kind() == reflect.Interface {
+		v = v.Elem()
+	}
+	if v.Kind() != reflect.Ptr && v.CanAddr() &&
+		reflect.PtrTo(v.Type()).Implements(typeOfPropertyLoadSaver) {
+		v = v.Addr()
+	}
+
+	if pls, ok := v.Interface().(datastore.PropertyLoadSaver); ok {
+		return pls.Save()
+	}
+	if v.Kind() == reflect.Ptr && !v.IsNil() &&
+		v.Elem().Kind() == reflect.Struct {
+		return datastore.SaveStruct(v.Interface())
+	}
+	if v.Kind() == reflect.Struct && v.CanAddr() {
+		return datastore.SaveStruct(v.Addr().Interface())
+	}
+	return nil, datastore.ErrInvalidEntityType
+}
+
+// copyPropertyList returns a copy of pl that shares no byte slices with it.
+func copyPropertyList(pl datastore.PropertyList) datastore.PropertyList {
+	cp := make(datastore.PropertyList, len(pl))
+	for i, p := range pl {
+		if b, ok := p.Value.([]byte); ok {
+			p.Value = append([]byte(nil), b...)
+		}
+		cp[i] = p
+	}
+	return cp
+}
@@ -0,0 +1,87 @@
+package ndstest_test
+
+import (
+	"testing"
+
+	"github.com/qedus/nds/ndstest"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+)
+
+func TestDatastore(t *testing.T) {
+	c, _, _ := ndstest.NewContext()
+	ds := ndstest.NewDatastore()
+
+	keys := []*datastore.Key{
+		datastore.NewIncompleteKey(c, "Entity", nil),
+		datastore.NewKey(c, "Entity", "b", 0, nil),
+	}
+	keys, err := ds.PutMulti(c, keys, []*testEntity{{1}, {2}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if keys[0].Incomplete() {
+		t.Fatal("expected a complete key")
+	}
+	if len(ds.Keys()) != 2 {
+		t.Fatal("expected two entities", ds.Keys())
+	}
+
+	pls := make([]datastore.PropertyList, 3)
+	err = ds.GetMulti(c, append(keys, datastore.NewKey(c, "Entity", "c", 0,
+		nil)), pls)
+	if me, ok := err.(appengine.MultiError); !ok {
+		t.Fatal("expected appengine.MultiError", err)
+	} else if me[0] != nil || me[1] != nil ||
+		me[2] != datastore.ErrNoSuchEntity {
+		t.Fatal(me)
+	}
+	if pls[1][0].Value != int64(2) {
+		t.Fatal("incorrect property", pls[1])
+	}
+
+	// Allocated IDs are never given to incomplete keys.
+	low, high, err := ds.AllocateIDs(c, "Entity", nil, 2)
+	if err != nil {
+		t.Fatal(err)
+	} else if high-low != 2 {
+		t.Fatal("incorrect range", low, high)
+	}
+	putKeys, err := ds.PutMulti(c, []*datastore.Key{
+		datastore.NewIncompleteKey(c, "Entity", nil),
+	}, []*testEntity{{3}})
+	if err != nil {
+		t.Fatal(err)
+	} else if id := putKeys[0].IntID(); id >= low && id < high {
+		t.Fatal("allocated ID reused", id)
+	}
+	if err := ds.DeleteMulti(c, putKeys); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := ds.DeleteMulti(c, keys[:1]); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := ds.Entity(keys[0]); ok {
+		t.Fatal("expected entity to be deleted")
+	}
+
+	// Transactions are limited to one entity group unless XG is set.
+	err = ds.RunInTransaction(c, func(tc context.Context) error {
+		return ds.GetMulti(tc, keys, make([]testEntity, len(keys)))
+	}, nil)
+	if err == nil {
+		t.Fatal("expected too many entity groups error")
+	}
+	err = ds.RunInTransaction(c, func(tc context.Context) error {
+		_, err := ds.PutMulti(tc, keys, []testEntity{{3}, {4}})
+		return err
+	}, &datastore.TransactionOptions{XG: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ds.Keys()) != 2 {
+		t.Fatal("expected two entities", ds.Keys())
+	}
+}
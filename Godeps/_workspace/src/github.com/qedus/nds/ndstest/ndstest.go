@@ -0,0 +1,73 @@
+// Package ndstest provides in-memory implementations of the datastore and
+// cache backends NDS uses, so code using NDS can be tested without the App
+// Engine development server or aetest.
+//
+// Datastore implements nds.DatastoreClient and nds.IDAllocator, and Cache
+// implements nds.Cache and nds.Incrementer. Both follow the semantics of App
+// Engine datastore and memcache closely enough for the caching behaviour of
+// NDS, including its lock items, to be tested: errors for individual keys are
+// reported in a appengine.MultiError, missing entities with
+// datastore.ErrNoSuchEntity, transactions fail with
+// datastore.ErrConcurrentTransaction when an entity group they used is changed
+// by another write, and cache items are stored with their flags, value and
+// expiration unaltered. Both can be inspected and made to fail with an
+// ErrorFunc.
+//
+// Queries are not supported so NDS functions that run queries, such as
+// EvictAncestors, ExistsMulti and GetByUnique, still need App Engine.
+package ndstest
+
+import (
+	"os"
+
+	"github.com/qedus/nds"
+	"golang.org/x/net/context"
+)
+
+// AppID is the application ID of the keys created with contexts returned by
+// NewContext.
+const AppID = "ndstest"
+
+// ErrorFunc is called with the name of each Datastore or Cache method, such
+// as "GetMulti", before it is run. The method fails with the returned error
+// without doing anything if it is not nil. keys are the encoded datastore keys
+// or the memcache keys the method was called with.
+type ErrorFunc func(method string, keys []string) error
+
+// NewContext returns a context that makes NDS use a new Datastore and Cache,
+// which are also returned, and discard the messages it logs.
+//
+// Creating datastore keys outside of App Engine needs an application ID, which
+// App Engine reads from the environment. NewContext sets the GAE_LONG_APP_ID
+// and GAE_PARTITION environment variables to AppID and "dev" if they are not
+// already set.
+func NewContext() (context.Context, *Datastore, *Cache) {
+	if os.Getenv("GAE_LONG_APP_ID") == "" {
+		os.Setenv("GAE_LONG_APP_ID", AppID)
+	}
+	if os.Getenv("GAE_PARTITION") == "" {
+		os.Setenv("GAE_PARTITION", "dev")
+	}
+
+	ds, cache := NewDatastore(), NewCache()
+	c := context.Background()
+	c = nds.WithDatastore(c, ds)
+	c = nds.WithCache(c, cache)
+	c = nds.WithLogger(c, discardLogger{})
+	return c, ds, cache
+}
+
+// discardLogger is an nds.Logger that discards every message.
+type discardLogger struct{}
+
+func (discardLogger) Debugf(c context.Context, format string,
+	args ...interface{}) {
+}
+
+func (discardLogger) Errorf(c context.Context, format string,
+	args ...interface{}) {
+}
+
+func (discardLogger) Warningf(c context.Context, format string,
+	args ...interface{}) {
+}
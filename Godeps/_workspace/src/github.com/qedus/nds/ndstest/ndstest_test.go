@@ -0,0 +1,135 @@
+package ndstest_test
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/qedus/nds"
+	"github.com/qedus/nds/ndstest"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+)
+
+type testEntity struct {
+	Val int
+}
+
+func TestNewContext(t *testing.T) {
+	c, ds, cache := ndstest.NewContext()
+
+	keys := []*datastore.Key{
+		datastore.NewKey(c, "Entity", "", 1, nil),
+		datastore.NewKey(c, "Entity", "", 2, nil),
+	}
+	if _, err := nds.Put(c, keys[0], &testEntity{1}); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := ds.Entity(keys[0]); !ok {
+		t.Fatal("expected entity to be put")
+	}
+
+	entities := make([]testEntity, len(keys))
+	err := nds.GetMulti(c, keys, entities)
+	if me, ok := err.(appengine.MultiError); !ok {
+		t.Fatal("expected appengine.MultiError", err)
+	} else if me[0] != nil || me[1] != datastore.ErrNoSuchEntity {
+		t.Fatal(me)
+	}
+	if entities[0].Val != 1 {
+		t.Fatal("incorrect val", entities[0].Val)
+	}
+
+	// Both the entity and the missing entity are now cached.
+	entries, err := nds.InspectCache(c, keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !entries[0].Present || entries[0].Type != "entity" {
+		t.Fatal("expected cached entity", entries[0])
+	}
+	if !entries[1].Present || entries[1].Type != "none" {
+		t.Fatal("expected cached missing entity", entries[1])
+	}
+	if len(cache.Keys()) != 2 {
+		t.Fatal("expected two cache items", cache.Keys())
+	}
+
+	// Reads are served from the cache while the datastore fails.
+	dsErr := errors.New("datastore down")
+	ds.SetErrorFunc(func(string, []string) error { return dsErr })
+	entity := &testEntity{}
+	if err := nds.Get(c, keys[0], entity); err != nil {
+		t.Fatal(err)
+	} else if entity.Val != 1 {
+		t.Fatal("incorrect val", entity.Val)
+	}
+	if _, err := nds.Put(c, keys[0], &testEntity{2}); err != dsErr {
+		t.Fatal("expected dsErr", err)
+	}
+	ds.SetErrorFunc(nil)
+
+	// A failed put leaves the entity locked in the cache.
+	entries, err = nds.InspectCache(c, keys[:1])
+	if err != nil {
+		t.Fatal(err)
+	} else if entries[0].Type != "lock" {
+		t.Fatal("expected the cached entity to be locked", entries[0])
+	}
+}
+
+func TestRunInTransaction(t *testing.T) {
+	c, ds, _ := ndstest.NewContext()
+
+	key := datastore.NewKey(c, "Entity", "", 1, nil)
+	if _, err := nds.Put(c, key, &testEntity{1}); err != nil {
+		t.Fatal(err)
+	}
+
+	// A concurrent write makes the first attempt retry.
+	attempts := 0
+	if err := nds.RunInTransaction(c, func(tc context.Context) error {
+		attempts++
+		entity := &testEntity{}
+		if err := nds.Get(tc, key, entity); err != nil {
+			return err
+		}
+		if attempts == 1 {
+			if _, err := ds.PutMulti(c, []*datastore.Key{key},
+				[]testEntity{{10}}); err != nil {
+				return err
+			}
+		}
+		entity.Val++
+		_, err := nds.Put(tc, key, entity)
+		return err
+	}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if attempts != 2 {
+		t.Fatal("expected two attempts", attempts)
+	}
+
+	entity := &testEntity{}
+	if err := nds.Get(c, key, entity); err != nil {
+		t.Fatal(err)
+	} else if entity.Val != 11 {
+		t.Fatal("incorrect val", entity.Val)
+	}
+
+	// Writes are discarded when the transaction fails.
+	txErr := errors.New("tx failed")
+	if err := nds.RunInTransaction(c, func(tc context.Context) error {
+		if _, err := nds.Put(tc, key, &testEntity{20}); err != nil {
+			return err
+		}
+		return txErr
+	}, nil); err != txErr {
+		t.Fatal("expected txErr", err)
+	}
+	if err := nds.Get(c, key, entity); err != nil {
+		t.Fatal(err)
+	} else if entity.Val != 11 {
+		t.Fatal("incorrect val", entity.Val)
+	}
+}
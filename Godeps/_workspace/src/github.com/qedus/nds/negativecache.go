@@ -0,0 +1,34 @@
+package nds
+
+import (
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+var negativeCacheKey = "used for negative cache TTL"
+
+// WithNegativeCache returns a context that caches missing entities for ttl.
+//
+// When GetMulti finds that an entity does not exist it stores a "not found"
+// marker in memcache so subsequent reads return datastore.ErrNoSuchEntity
+// without touching the datastore. By default the marker lives until the key is
+// written with Put or Delete, or is evicted by memcache. WithNegativeCache
+// makes the marker expire after ttl so entities created outside of NDS are
+// eventually seen. A ttl of zero or less keeps the default and a ttl longer
+// than 30 days is reduced to 30 days.
+func WithNegativeCache(c context.Context, ttl time.Duration) context.Context {
+	return context.WithValue(c, &negativeCacheKey, ttl)
+}
+
+// negativeCacheExpiration returns the expiration of "not found" markers.
+func negativeCacheExpiration(c context.Context) time.Duration {
+	ttl, ok := c.Value(&negativeCacheKey).(time.Duration)
+	if !ok || ttl <= 0 {
+		return 0
+	}
+	if ttl > memcacheMaxExpiration {
+		return memcacheMaxExpiration
+	}
+	return ttl
+}
@@ -0,0 +1,61 @@
+package nds_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/qedus/nds"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/datastore"
+)
+
+func TestWithNegativeCache(t *testing.T) {
+	c, closeFunc := NewContext(t, nil)
+	defer closeFunc()
+
+	type testEntity struct {
+		IntVal int
+	}
+
+	getCalls := 0
+	nds.SetDatastoreGetMulti(func(c context.Context,
+		keys []*datastore.Key, vals interface{}) error {
+		getCalls++
+		return datastore.GetMulti(c, keys, vals)
+	})
+	defer nds.SetDatastoreGetMulti(datastore.GetMulti)
+
+	rc := &recordingCache{}
+	nc := nds.WithNegativeCache(nds.WithCache(c, rc), time.Minute)
+	key := datastore.NewKey(c, "Entity", "", 1, nil)
+
+	if err := nds.Get(nc, key, &testEntity{}); err != datastore.ErrNoSuchEntity {
+		t.Fatal("expected datastore.ErrNoSuchEntity", err)
+	}
+	if len(rc.casItems) != 1 {
+		t.Fatal("expected negative cache entry")
+	} else if item := rc.casItems[0]; item.Flags != nds.NoneItem {
+		t.Fatal("expected none item flags", item.Flags)
+	} else if item.Expiration != time.Minute {
+		t.Fatal("expected 1 minute expiration", item.Expiration)
+	}
+
+	// Served from the negative cache.
+	if err := nds.Get(nc, key, &testEntity{}); err != datastore.ErrNoSuchEntity {
+		t.Fatal("expected datastore.ErrNoSuchEntity", err)
+	}
+	if getCalls != 1 {
+		t.Fatal("expected a single datastore read", getCalls)
+	}
+
+	// Put must purge the negative entry.
+	if _, err := nds.Put(nc, key, &testEntity{42}); err != nil {
+		t.Fatal(err)
+	}
+	te := &testEntity{}
+	if err := nds.Get(nc, key, te); err != nil {
+		t.Fatal(err)
+	} else if te.IntVal != 42 {
+		t.Fatal("expected 42", te.IntVal)
+	}
+}
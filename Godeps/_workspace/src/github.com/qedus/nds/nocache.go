@@ -0,0 +1,24 @@
+package nds
+
+import "golang.org/x/net/context"
+
+var noCacheKey = "used for no cache"
+
+// WithNoCache returns a context that makes NDS skip its caching strategy.
+// GetMulti reads entities straight from the datastore without consulting or
+// populating the cache. PutMulti and DeleteMulti do not lock the cache but
+// still delete any cached copies of the entities after writing them so other
+// contexts do not go on reading stale entities. This is intended for
+// maintenance jobs that touch many entities which would otherwise evict hot
+// entities from the cache.
+//
+// Within a transaction PutMulti and DeleteMulti lock the cache as usual as
+// cached copies can only be invalidated once the transaction commits.
+func WithNoCache(c context.Context) context.Context {
+	return context.WithValue(c, &noCacheKey, true)
+}
+
+func isNoCache(c context.Context) bool {
+	noCache, _ := c.Value(&noCacheKey).(bool)
+	return noCache || isBreakerOpen(c) || isCacheUnavailable(c)
+}
@@ -0,0 +1,90 @@
+package nds_test
+
+import (
+	"testing"
+
+	"github.com/qedus/nds"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/datastore"
+)
+
+func TestWithNoCache(t *testing.T) {
+	c, closeFunc := NewContext(t, nil)
+	defer closeFunc()
+
+	type testEntity struct {
+		Val int
+	}
+
+	rc := &recordingCache{}
+	nc := nds.WithNoCache(nds.WithCache(c, rc))
+
+	key := datastore.NewKey(c, "Entity", "", 1, nil)
+	if _, err := nds.Put(nc, key, &testEntity{1}); err != nil {
+		t.Fatal(err)
+	}
+
+	te := &testEntity{}
+	if err := nds.Get(nc, key, te); err != nil {
+		t.Fatal(err)
+	} else if te.Val != 1 {
+		t.Fatal("incorrect val", te.Val)
+	}
+
+	if err := nds.Delete(nc, key); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(rc.setItems) != 0 || len(rc.addItems) != 0 ||
+		len(rc.casItems) != 0 || len(rc.getKeys) != 0 {
+		t.Fatal("expected cache to be bypassed")
+	}
+	if len(rc.delKeys) != 2 {
+		t.Fatal("expected cached entities to be removed", rc.delKeys)
+	}
+}
+
+func TestWithNoCacheEvictsCachedEntity(t *testing.T) {
+	c, closeFunc := NewContext(t, nil)
+	defer closeFunc()
+
+	type testEntity struct {
+		Val int
+	}
+
+	key := datastore.NewKey(c, "Entity", "", 1, nil)
+	if _, err := nds.Put(c, key, &testEntity{1}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Prime the cache.
+	if err := nds.Get(c, key, &testEntity{}); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := nds.Put(nds.WithNoCache(c), key, &testEntity{2}); err != nil {
+		t.Fatal(err)
+	}
+
+	te := &testEntity{}
+	if err := nds.Get(c, key, te); err != nil {
+		t.Fatal(err)
+	} else if te.Val != 2 {
+		t.Fatal("expected updated entity", te.Val)
+	}
+
+	// Transactions still lock the cache.
+	if err := nds.RunInTransaction(c, func(tc context.Context) error {
+		_, err := nds.Put(nds.WithNoCache(tc), key, &testEntity{3})
+		return err
+	}, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	te = &testEntity{}
+	if err := nds.Get(c, key, te); err != nil {
+		t.Fatal(err)
+	} else if te.Val != 3 {
+		t.Fatal("expected transaction entity", te.Val)
+	}
+}
@@ -0,0 +1,25 @@
+package nds
+
+import "golang.org/x/net/context"
+
+var partialDecodeKey = "used for partial decode"
+
+// WithPartialDecode returns a context that makes GetMulti load what it can of
+// an entity that only partly loads into its destination, such as when the type
+// of one of its fields changed incompatibly. The fields that do load are kept
+// and the load error, such as a *datastore.ErrFieldMismatch, is returned for
+// the key in an appengine.MultiError alongside the other entities rather than
+// failing the whole batch. This is intended for tools inspecting corrupt or
+// migrated entities. The entity is still cached as it is stored, so later
+// reads load it the same way.
+//
+// Unlike GetMultiPartial, errors other than load errors still fail their
+// batch as usual.
+func WithPartialDecode(c context.Context) context.Context {
+	return context.WithValue(c, &partialDecodeKey, true)
+}
+
+func isPartialDecode(c context.Context) bool {
+	partialDecode, _ := c.Value(&partialDecodeKey).(bool)
+	return partialDecode
+}
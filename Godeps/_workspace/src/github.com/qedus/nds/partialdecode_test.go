@@ -0,0 +1,65 @@
+package nds_test
+
+import (
+	"testing"
+
+	"github.com/qedus/nds"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+)
+
+func TestWithPartialDecode(t *testing.T) {
+	c, closeFunc := NewContext(t, nil)
+	defer closeFunc()
+
+	type oldEntity struct {
+		Val   string
+		Other int
+	}
+	type newEntity struct {
+		Val   int
+		Other int
+	}
+
+	keys := []*datastore.Key{
+		datastore.NewKey(c, "Entity", "", 1, nil),
+		datastore.NewKey(c, "Entity", "", 2, nil),
+	}
+	if _, err := nds.PutMulti(c, keys[:1],
+		[]oldEntity{{"one", 1}}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := nds.PutMulti(c, keys[1:],
+		[]newEntity{{2, 2}}); err != nil {
+		t.Fatal(err)
+	}
+
+	// By default the batch fails.
+	if err := nds.GetMulti(c, keys, make([]newEntity, 2)); err == nil {
+		t.Fatal("expected error")
+	} else if _, ok := err.(appengine.MultiError); ok {
+		t.Fatal("expected batch error", err)
+	}
+
+	// From the datastore and then from the cache.
+	for i := 0; i < 2; i++ {
+		entities := make([]newEntity, 2)
+		err := nds.GetMulti(nds.WithPartialDecode(c), keys, entities)
+		me, ok := err.(appengine.MultiError)
+		if !ok {
+			t.Fatal("expected appengine.MultiError", err)
+		}
+		if _, ok := me[0].(*datastore.ErrFieldMismatch); !ok {
+			t.Fatal("expected field mismatch", me[0])
+		}
+		if me[1] != nil {
+			t.Fatal(me[1])
+		}
+		if entities[0].Other != 1 {
+			t.Fatal("expected loaded field", entities[0].Other)
+		}
+		if entities[1].Val != 2 {
+			t.Fatal("incorrect val", entities[1].Val)
+		}
+	}
+}
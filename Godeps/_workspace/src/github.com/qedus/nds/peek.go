@@ -0,0 +1,91 @@
+package nds
+
+import (
+	"reflect"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+)
+
+// Peek loads the cached entities for keys into vals without ever reading the
+// datastore. The returned slice reports whether each key was cached. Keys that
+// are not cached, or are locked because they are being written or read
+// through, report false and leave their vals unmodified. Keys cached as
+// missing report true and datastore.ErrNoSuchEntity within a
+// appengine.MultiError. Entities are decoded exactly as GetMulti would.
+//
+// Peek is intended for reading hot values, such as counters, where falling
+// back to the datastore is undesirable. The local cache and transactions are
+// not consulted.
+func Peek(c context.Context,
+	keys []*datastore.Key, vals interface{}) ([]bool, error) {
+
+	v := reflect.ValueOf(vals)
+	if err := checkMultiArgs(keys, v); err != nil {
+		return nil, err
+	}
+	if err := checkCacheKeyPrefix(c); err != nil {
+		return nil, err
+	}
+
+	if f, ok := keyMapperFromContext(c); ok {
+		physicalKeys, err := mapKeys(keys, f)
+		if err != nil {
+			return nil, err
+		}
+		keys = physicalKeys
+	}
+
+	present := make([]bool, len(keys))
+	err := runBatches(c, len(keys), batchSize(c, getMultiLimit),
+		func(lo, hi int) error {
+			return peekMulti(c, keys[lo:hi], v.Slice(lo, hi), present[lo:hi])
+		})
+	return present, err
+}
+
+func peekMulti(c context.Context, keys []*datastore.Key, vals reflect.Value,
+	present []bool) error {
+
+	memcacheKeys := make([]string, len(keys))
+	for i, key := range keys {
+		memcacheKeys[i] = createMemcacheKey(c, key)
+	}
+
+	items, err := cacheFromContext(c).GetMulti(c, memcacheKeys)
+	if err != nil {
+		return err
+	}
+
+	me, errsNil := make(appengine.MultiError, len(keys)), true
+	for i, memcacheKey := range memcacheKeys {
+		item, ok := items[memcacheKey]
+		if !ok {
+			continue
+		}
+
+		switch itemType(item.Flags) {
+		case noneItem:
+			present[i] = true
+			me[i] = datastore.ErrNoSuchEntity
+		case entityItem:
+			pl, _, err := decodeCachedEntity(c, keys[i], item)
+			if isReplaceableItemError(err) {
+				continue
+			} else if err == nil {
+				err = setValue(vals.Index(i), pl)
+			}
+			present[i] = err == nil
+			me[i] = err
+		}
+		if me[i] != nil {
+			errsNil = false
+		}
+	}
+
+	if errsNil {
+		return nil
+	}
+	return me
+}
@@ -0,0 +1,66 @@
+package nds_test
+
+import (
+	"testing"
+
+	"github.com/qedus/nds"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+)
+
+func TestPeek(t *testing.T) {
+	c, closeFunc := NewContext(t, nil)
+	defer closeFunc()
+
+	type testEntity struct {
+		Val int
+	}
+
+	keys := []*datastore.Key{
+		datastore.NewKey(c, "Entity", "", 1, nil),
+		datastore.NewKey(c, "Entity", "", 2, nil),
+		datastore.NewKey(c, "Entity", "", 3, nil),
+	}
+	if _, err := nds.PutMulti(c, keys[:2],
+		[]testEntity{{1}, {2}}); err != nil {
+		t.Fatal(err)
+	}
+
+	cd := &countingDatastore{}
+	pc := nds.WithDatastore(c, cd)
+
+	// Nothing has been cached yet.
+	present, err := nds.Peek(pc, keys, make([]testEntity, len(keys)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, p := range present {
+		if p {
+			t.Fatal("expected key not to be cached", i)
+		}
+	}
+
+	// Cache the first entity and the third as missing.
+	if _, err := nds.Warm(c, []*datastore.Key{keys[0], keys[2]}); err != nil {
+		t.Fatal(err)
+	}
+
+	entities := make([]testEntity, len(keys))
+	present, err = nds.Peek(pc, keys, entities)
+	if me, ok := err.(appengine.MultiError); !ok {
+		t.Fatal("expected appengine.MultiError", err)
+	} else if me[0] != nil || me[1] != nil ||
+		me[2] != datastore.ErrNoSuchEntity {
+		t.Fatal("incorrect errors", me)
+	}
+	if !present[0] || present[1] || !present[2] {
+		t.Fatal("incorrect present", present)
+	}
+	if entities[0].Val != 1 || entities[1].Val != 0 {
+		t.Fatal("incorrect entities", entities)
+	}
+
+	if cd.gets != 0 {
+		t.Fatal("expected no datastore reads", cd.gets)
+	}
+}
@@ -0,0 +1,50 @@
+package nds
+
+import (
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/datastore"
+)
+
+var pinnedKeysKey = "used for pinned keys"
+
+// WithPinnedKeys returns a context that makes PutMulti re-cache the entities
+// for keys straight after it invalidates them, rather than leaving them to be
+// cached by the next read. This suits entities, such as configuration, that
+// are read constantly but rarely written, at the cost of an extra datastore
+// read per pinned entity put. Puts within a transaction do not re-cache pinned
+// entities as their locks are only released when they expire.
+//
+// Pinning only counters the invalidations NDS itself makes. Memcache may
+// still evict pinned entities under memory pressure.
+func WithPinnedKeys(c context.Context, keys []*datastore.Key) context.Context {
+	pinned := make(map[string]bool, len(keys))
+	for _, key := range keys {
+		if key != nil {
+			pinned[key.Encode()] = true
+		}
+	}
+	return context.WithValue(c, &pinnedKeysKey, pinned)
+}
+
+// rewarmPinned caches the entities for the pinned keys among keys, which have
+// just been invalidated.
+func rewarmPinned(c context.Context, keys []*datastore.Key) {
+	pinned, ok := c.Value(&pinnedKeysKey).(map[string]bool)
+	if !ok || len(pinned) == 0 {
+		return
+	}
+
+	warmKeys := make([]*datastore.Key, 0, len(keys))
+	for _, key := range keys {
+		if pinned[key.Encode()] {
+			warmKeys = append(warmKeys, key)
+		}
+	}
+	if len(warmKeys) == 0 {
+		return
+	}
+
+	if _, err := warmMulti(c, warmKeys); err != nil {
+		warningf(c, "nds:rewarmPinned warmMulti %s", err)
+	}
+}
@@ -0,0 +1,41 @@
+package nds_test
+
+import (
+	"testing"
+
+	"github.com/qedus/nds"
+	"google.golang.org/appengine/datastore"
+)
+
+func TestWithPinnedKeys(t *testing.T) {
+	c, closeFunc := NewContext(t, nil)
+	defer closeFunc()
+
+	type testEntity struct {
+		Val int
+	}
+
+	keys := []*datastore.Key{
+		datastore.NewKey(c, "Config", "", 1, nil),
+		datastore.NewKey(c, "Entity", "", 1, nil),
+	}
+
+	pc := nds.WithPinnedKeys(c, keys[:1])
+	if _, err := nds.PutMulti(pc, keys,
+		[]testEntity{{1}, {2}}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Only the pinned entity should be cached.
+	entities := make([]testEntity, len(keys))
+	present, err := nds.Peek(c, keys, entities)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !present[0] || present[1] {
+		t.Fatal("expected only the pinned entity cached", present)
+	}
+	if entities[0].Val != 1 {
+		t.Fatal("incorrect cached entity", entities[0])
+	}
+}
@@ -0,0 +1,63 @@
+package nds
+
+import (
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/datastore"
+)
+
+// Mutation describes an entity written within a transaction.
+type Mutation struct {
+	Key *datastore.Key
+
+	// Entity holds the properties of the entity as it was last put, or is
+	// nil if it was last deleted.
+	Entity datastore.PropertyList
+}
+
+var preCommitHookKey = "used for pre-commit hook"
+
+// WithPreCommitHook returns a context that makes RunInTransaction call f with
+// the entities written within the transaction once the transaction function
+// has returned successfully, but before the transaction commits. Each entity
+// written appears once, as it was last written, in the order the entities were
+// first written. If f returns an error the transaction is rolled back, its
+// buffered cache locks are discarded and RunInTransaction returns the error.
+// This gives one place to check invariants spanning the entities written, such
+// as balances that must total zero. f is called for each attempt of the
+// transaction. It is not called for transactions begun with
+// WithManualTransaction, whose commits NDS does not make.
+func WithPreCommitHook(c context.Context,
+	f func(mutations []Mutation) error) context.Context {
+	return context.WithValue(c, &preCommitHookKey, f)
+}
+
+// runPreCommitHook calls the pre-commit hook of c, if any, with the entities
+// written within tx.
+func runPreCommitHook(c context.Context, tx *transaction) error {
+	f, ok := c.Value(&preCommitHookKey).(func([]Mutation) error)
+	if !ok || f == nil {
+		return nil
+	}
+
+	tx.Lock()
+	mutations := make([]Mutation, len(tx.mutations))
+	copy(mutations, tx.mutations)
+	tx.Unlock()
+	return f(mutations)
+}
+
+// addMutation records that the entity for key, with the memcache key
+// memcacheKey, was written as pl within tx. tx must be locked.
+func (tx *transaction) addMutation(memcacheKey string, key *datastore.Key,
+	pl datastore.PropertyList) {
+
+	if tx.mutationIndexes == nil {
+		tx.mutationIndexes = map[string]int{}
+	}
+	if i, ok := tx.mutationIndexes[memcacheKey]; ok {
+		tx.mutations[i].Entity = pl
+		return
+	}
+	tx.mutationIndexes[memcacheKey] = len(tx.mutations)
+	tx.mutations = append(tx.mutations, Mutation{Key: key, Entity: pl})
+}
@@ -0,0 +1,76 @@
+package nds_test
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/qedus/nds"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/memcache"
+)
+
+func TestWithPreCommitHook(t *testing.T) {
+	c, closeFunc := NewContext(t, nil)
+	defer closeFunc()
+
+	type testEntity struct {
+		Val int64
+	}
+
+	errUnbalanced := errors.New("unbalanced")
+	hc := nds.WithPreCommitHook(c, func(mutations []nds.Mutation) error {
+		total := int64(0)
+		for _, m := range mutations {
+			for _, p := range m.Entity {
+				total += p.Value.(int64)
+			}
+		}
+		if total != 0 {
+			return errUnbalanced
+		}
+		return nil
+	})
+
+	parent := datastore.NewKey(c, "Parent", "", 1, nil)
+	keys := []*datastore.Key{
+		datastore.NewKey(c, "Entity", "", 1, parent),
+		datastore.NewKey(c, "Entity", "", 2, parent),
+	}
+	transfer := func(vals []testEntity) func(tc context.Context) error {
+		return func(tc context.Context) error {
+			// Only the last write to the first entity counts.
+			if _, err := nds.Put(tc, keys[0], &testEntity{100}); err != nil {
+				return err
+			}
+			_, err := nds.PutMulti(tc, keys, vals)
+			return err
+		}
+	}
+
+	// The hook rejects the commit.
+	if err := nds.RunInTransaction(hc,
+		transfer([]testEntity{{5}, {-3}}), nil); err != errUnbalanced {
+		t.Fatal("expected hook error", err)
+	}
+	if err := nds.GetMulti(c, keys,
+		make([]testEntity, 2)); err == nil {
+		t.Fatal("expected entities not to be put")
+	}
+	if item, err := memcache.Get(c,
+		nds.CreateMemcacheKey(keys[0])); err == nil && item.Flags == nds.LockItem {
+		t.Fatal("expected no lock")
+	}
+
+	// A balanced transaction commits.
+	if err := nds.RunInTransaction(hc,
+		transfer([]testEntity{{5}, {-5}}), nil); err != nil {
+		t.Fatal(err)
+	}
+	entities := make([]testEntity, 2)
+	if err := nds.GetMulti(c, keys, entities); err != nil {
+		t.Fatal(err)
+	} else if entities[0].Val != 5 || entities[1].Val != -5 {
+		t.Fatal("incorrect vals", entities)
+	}
+}
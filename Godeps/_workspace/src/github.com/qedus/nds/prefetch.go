@@ -0,0 +1,55 @@
+package nds
+
+import (
+	"sync"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/datastore"
+)
+
+var prefetchGroupKey = "used for prefetch wait group"
+
+// WithPrefetchGroup returns a context that makes Prefetch add each prefetch it
+// starts to wg, so the caller can wait for them all to finish, for example
+// before a request handler returns.
+func WithPrefetchGroup(c context.Context, wg *sync.WaitGroup) context.Context {
+	return context.WithValue(c, &prefetchGroupKey, wg)
+}
+
+// Prefetch starts getting the entities for keys in the background so they are
+// cached, including in any local cache attached to c, by the time a later
+// GetMulti asks for them. It returns immediately and errors are only logged
+// at debug level, as the later GetMulti will report them.
+//
+// Use WithPrefetchGroup to be able to wait for prefetches to finish. A
+// prefetch still running when c is done stops without getting any remaining
+// batches. Prefetch does nothing within a transaction, as entities got in a
+// transaction are never cached.
+func Prefetch(c context.Context, keys []*datastore.Key) {
+	if len(keys) == 0 || c.Err() != nil {
+		return
+	}
+	if _, ok := transactionFromContext(c); ok {
+		return
+	}
+
+	wg, _ := c.Value(&prefetchGroupKey).(*sync.WaitGroup)
+	if wg != nil {
+		wg.Add(1)
+	}
+	go func() {
+		defer func() {
+			if wg != nil {
+				wg.Done()
+			}
+			// App Engine APIs can panic once the request behind c has
+			// finished. Prefetching is only an optimisation so give up.
+			recover()
+		}()
+
+		pls := make([]datastore.PropertyList, len(keys))
+		if err := GetMulti(c, keys, pls); err != nil && c.Err() == nil {
+			debugf(c, "nds:Prefetch GetMulti %s", err)
+		}
+	}()
+}
@@ -0,0 +1,53 @@
+package nds_test
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/qedus/nds"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/datastore"
+)
+
+func TestPrefetch(t *testing.T) {
+	c, closeFunc := NewContext(t, nil)
+	defer closeFunc()
+
+	type testEntity struct {
+		Val int
+	}
+
+	keys := []*datastore.Key{
+		datastore.NewKey(c, "Entity", "", 1, nil),
+		datastore.NewKey(c, "Entity", "", 2, nil),
+	}
+	if _, err := nds.PutMulti(c, keys, []testEntity{{1}, {2}}); err != nil {
+		t.Fatal(err)
+	}
+
+	wg := &sync.WaitGroup{}
+	nds.Prefetch(nds.WithPrefetchGroup(c, wg), keys)
+	wg.Wait()
+
+	cd := &countingDatastore{}
+	vals := make([]testEntity, len(keys))
+	if err := nds.GetMulti(nds.WithDatastore(c, cd), keys, vals); err != nil {
+		t.Fatal(err)
+	} else if vals[0].Val != 1 || vals[1].Val != 2 {
+		t.Fatal("incorrect vals", vals)
+	}
+	if cd.gets != 0 {
+		t.Fatal("expected prefetched entities to be cached", cd.gets)
+	}
+
+	// Prefetching with a finished context does nothing.
+	cc, cancel := context.WithCancel(c)
+	cancel()
+	cd = &countingDatastore{}
+	nds.Prefetch(nds.WithPrefetchGroup(nds.WithDatastore(cc, cd), wg),
+		[]*datastore.Key{datastore.NewKey(c, "Entity", "", 3, nil)})
+	wg.Wait()
+	if cd.gets != 0 {
+		t.Fatal("expected no reads", cd.gets)
+	}
+}
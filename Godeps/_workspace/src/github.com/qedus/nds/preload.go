@@ -0,0 +1,61 @@
+package nds
+
+import (
+	"reflect"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/datastore"
+)
+
+var preloadedKey = "used for preloaded entities"
+
+// WithPreloaded returns a context that makes GetMulti resolve entities from m
+// before consulting the cache or datastore. m is keyed by the CacheKey of the
+// entity's key and holds entities the caller already has in memory, such as
+// those met earlier during a graph traversal. Only the keys missing from m
+// are got from the cache or datastore and entities resolved from m are never
+// written to any cache.
+//
+// Entities in m are copied into the GetMulti elements through their datastore
+// properties, loading into the entity an interface element points to as
+// GetMulti does, so the elements never share memory with m. m must not be
+// modified while it is in use. Within a transaction, or with WithNoCache, m
+// is ignored.
+func WithPreloaded(c context.Context, m map[string]interface{}) context.Context {
+	return context.WithValue(c, &preloadedKey, m)
+}
+
+func loadPreloaded(c context.Context, cacheItems []cacheItem) {
+	m, ok := c.Value(&preloadedKey).(map[string]interface{})
+	if !ok || len(m) == 0 {
+		return
+	}
+
+	for i, cacheItem := range cacheItems {
+		entity, ok := m[createMemcacheKey(c, cacheItem.key)]
+		if !ok || entity == nil {
+			continue
+		}
+		cacheItems[i].err = setPreloadedValue(cacheItem.val, entity)
+		cacheItems[i].state = done
+	}
+}
+
+// setPreloadedValue copies entity into val through its properties.
+func setPreloadedValue(val reflect.Value, entity interface{}) error {
+	ev := reflect.ValueOf(entity)
+	if ev.Kind() == reflect.Ptr && ev.IsNil() {
+		return datastore.ErrInvalidEntityType
+	} else if ev.Kind() != reflect.Ptr {
+		// saveValue needs an addressable value.
+		cp := reflect.New(ev.Type()).Elem()
+		cp.Set(ev)
+		ev = cp
+	}
+
+	pl, err := saveValue(ev)
+	if err != nil {
+		return err
+	}
+	return setValue(val, copyPropertyList(pl))
+}
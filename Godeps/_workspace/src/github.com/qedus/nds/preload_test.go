@@ -0,0 +1,83 @@
+package nds_test
+
+import (
+	"testing"
+
+	"github.com/qedus/nds"
+	"google.golang.org/appengine/datastore"
+)
+
+func TestWithPreloaded(t *testing.T) {
+	c, closeFunc := NewContext(t, nil)
+	defer closeFunc()
+
+	type testEntity struct {
+		Val int
+	}
+
+	keys := []*datastore.Key{
+		datastore.NewKey(c, "Entity", "", 1, nil),
+		datastore.NewKey(c, "Entity", "", 2, nil),
+		datastore.NewKey(c, "Entity", "", 3, nil),
+	}
+	if _, err := datastore.Put(c, keys[2], &testEntity{3}); err != nil {
+		t.Fatal(err)
+	}
+
+	rc := &recordingCache{}
+	pc := nds.WithPreloaded(nds.WithCache(c, rc), map[string]interface{}{
+		nds.CacheKey(c, keys[0]): &testEntity{1},
+		nds.CacheKey(c, keys[1]): testEntity{2},
+	})
+
+	entities := make([]testEntity, len(keys))
+	if err := nds.GetMulti(pc, keys, entities); err != nil {
+		t.Fatal(err)
+	}
+	for i, entity := range entities {
+		if entity.Val != i+1 {
+			t.Fatal("incorrect val", i, entity.Val)
+		}
+	}
+
+	// Only the remaining key should touch the cache.
+	if len(rc.getKeys) != 1 || rc.getKeys[0] != nds.CacheKey(c, keys[2]) {
+		t.Fatal("expected one cache get", rc.getKeys)
+	}
+	for _, item := range append(rc.setItems, rc.casItems...) {
+		if item.Key != nds.CacheKey(c, keys[2]) {
+			t.Fatal("preloaded entity written to cache", item.Key)
+		}
+	}
+
+	// Pointer elements are copied rather than shared with the preloaded map.
+	ptrs := make([]*testEntity, 1)
+	if err := nds.GetMulti(pc, keys[:1], ptrs); err != nil {
+		t.Fatal(err)
+	} else if ptrs[0].Val != 1 {
+		t.Fatal("incorrect val", ptrs[0].Val)
+	}
+	ptrs[0].Val = 10
+	if err := nds.GetMulti(pc, keys[:1], ptrs); err != nil {
+		t.Fatal(err)
+	} else if ptrs[0].Val != 1 {
+		t.Fatal("expected preloaded entity to be unchanged", ptrs[0].Val)
+	}
+
+	// Interface elements are loaded into the entities they point to.
+	entity := &testEntity{}
+	ifaces := []interface{}{entity}
+	if err := nds.GetMulti(pc, keys[:1], ifaces); err != nil {
+		t.Fatal(err)
+	} else if ifaces[0] != entity || entity.Val != 1 {
+		t.Fatal("expected entity to be loaded into", ifaces[0], entity.Val)
+	}
+
+	// Entities of a different type are copied through their properties.
+	pls := make([]datastore.PropertyList, 1)
+	if err := nds.GetMulti(pc, keys[1:2], pls); err != nil {
+		t.Fatal(err)
+	} else if len(pls[0]) != 1 || pls[0][0].Value != int64(2) {
+		t.Fatal("incorrect property list", pls[0])
+	}
+}
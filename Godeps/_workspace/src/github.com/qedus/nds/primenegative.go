@@ -0,0 +1,125 @@
+package nds
+
+import (
+	"errors"
+	"reflect"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+)
+
+// PrimeNegative caches the keys without an entity as missing, the same as
+// GetMulti does when it finds an entity does not exist, so later reads of
+// them are answered from the cache without touching the datastore. This
+// suits checks against a known set of keys that mostly do not exist. Whether
+// each entity exists is checked as ExistsMulti checks it, so entity bodies are
+// only read for the keys that do exist, which are cached as GetMulti would
+// cache them. Keys that are already cached, or that are locked by another
+// request, are skipped.
+//
+// Each key is locked in the cache before it is checked and its marker only
+// replaces that lock, so an entity put concurrently is never marked missing.
+// Markers expire after ttl, or last until their keys are written if ttl is
+// zero or less, as with WithNegativeCache. Keys are processed in batches of at
+// most 500 and invalid keys, or keys that fail to be checked, are reported in a
+// appengine.MultiError. PrimeNegative cannot be used within a transaction.
+func PrimeNegative(c context.Context, keys []*datastore.Key,
+	ttl time.Duration) error {
+
+	if _, ok := transactionFromContext(c); ok {
+		return errors.New(
+			"nds: PrimeNegative cannot be used within a transaction")
+	}
+	if f, ok := keyMapperFromContext(c); ok {
+		physicalKeys, err := mapKeys(keys, f)
+		if err != nil {
+			return err
+		}
+		keys = physicalKeys
+	}
+
+	c = WithNegativeCache(c, ttl)
+	return runBatches(c, len(keys), batchSize(c, existsMultiLimit),
+		func(lo, hi int) error {
+			return primeNegativeMulti(c, keys[lo:hi])
+		})
+}
+
+func primeNegativeMulti(c context.Context, keys []*datastore.Key) error {
+	expiration, err := lockTime(c)
+	if err != nil {
+		return err
+	}
+	if err := checkCacheKeyPrefix(c); err != nil {
+		return err
+	}
+
+	errs, errsNil := make(appengine.MultiError, len(keys)), true
+	vals := reflect.ValueOf(make([]datastore.PropertyList, len(keys)))
+	cacheItems := make([]cacheItem, 0, len(keys))
+	indexes := make([]int, 0, len(keys))
+	for i, key := range keys {
+		if key == nil || key.Incomplete() {
+			errs[i] = datastore.ErrInvalidKey
+			errsNil = false
+			continue
+		}
+		cacheItems = append(cacheItems, cacheItem{
+			key:         key,
+			memcacheKey: createMemcacheKey(c, key),
+			val:         vals.Index(i),
+			state:       miss,
+		})
+		indexes = append(indexes, i)
+	}
+
+	loadMemcache(c, cacheItems)
+	lockMemcache(c, cacheItems, expiration)
+
+	exists := make([]bool, len(cacheItems))
+	checkErrs := make([]error, len(cacheItems))
+	var locked []int
+	var lockedKeys []*datastore.Key
+	for i, cacheItem := range cacheItems {
+		if cacheItem.state == internalLock {
+			locked = append(locked, i)
+			lockedKeys = append(lockedKeys, cacheItem.key)
+		}
+	}
+	found, foundErrs := datastoreExistsMulti(c, lockedKeys)
+	for i, index := range locked {
+		exists[index], checkErrs[index] = found[i], foundErrs[i]
+	}
+
+	// Entities that exist are read so their locks are replaced by them.
+	var absent, present []cacheItem
+	for i, cacheItem := range cacheItems {
+		switch {
+		case cacheItem.state != internalLock:
+		case checkErrs[i] != nil:
+			errs[indexes[i]] = checkErrs[i]
+			errsNil = false
+		case exists[i]:
+			present = append(present, cacheItem)
+		default:
+			cacheItem.item.Flags = noneItem
+			cacheItem.item.Value = []byte{}
+			cacheItem.item.Expiration = negativeCacheExpiration(c)
+			absent = append(absent, cacheItem)
+		}
+	}
+
+	if len(present) > 0 {
+		if err := loadDatastore(c, present, vals.Type()); err != nil {
+			return err
+		}
+	}
+	saveMemcache(c, append(absent, present...))
+
+	if errsNil {
+		return nil
+	}
+	return errs
+}
@@ -0,0 +1,89 @@
+package nds_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/qedus/nds"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/memcache"
+)
+
+func TestPrimeNegative(t *testing.T) {
+	c, closeFunc := NewContext(t, nil)
+	defer closeFunc()
+
+	type testEntity struct {
+		Val int
+	}
+
+	keys := []*datastore.Key{
+		datastore.NewKey(c, "Entity", "", 1, nil),
+		datastore.NewKey(c, "Entity", "", 2, nil),
+		datastore.NewKey(c, "Entity", "", 3, nil),
+	}
+	if _, err := datastore.Put(c, keys[0], &testEntity{1}); err != nil {
+		t.Fatal(err)
+	}
+	if err := nds.PrimeNegative(c, keys, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+
+	// Only the missing entities are marked missing.
+	for i, key := range keys {
+		item, err := memcache.Get(c, nds.CacheKey(c, key))
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected := nds.NoneItem
+		if i == 0 {
+			expected = nds.EntityItem
+		}
+		if nds.ItemType(item.Flags) != expected {
+			t.Fatal("incorrect item type", i, item.Flags)
+		}
+	}
+
+	entities := make([]testEntity, len(keys))
+	stats, err := nds.GetMultiStats(c, keys, entities)
+	me, ok := err.(appengine.MultiError)
+	if !ok {
+		t.Fatal("expected appengine.MultiError", err)
+	}
+	if me[0] != nil || me[1] != datastore.ErrNoSuchEntity ||
+		me[2] != datastore.ErrNoSuchEntity {
+		t.Fatal("incorrect errors", me)
+	}
+	if entities[0].Val != 1 {
+		t.Fatal("incorrect val", entities[0].Val)
+	}
+	if stats.DatastoreReads != 0 {
+		t.Fatal("expected no datastore reads", stats.DatastoreReads)
+	}
+}
+
+func TestPrimeNegativeInvalidKey(t *testing.T) {
+	c, closeFunc := NewContext(t, nil)
+	defer closeFunc()
+
+	keys := []*datastore.Key{
+		datastore.NewIncompleteKey(c, "Entity", nil),
+		datastore.NewKey(c, "Entity", "", 1, nil),
+	}
+	err := nds.PrimeNegative(c, keys, 0)
+	me, ok := err.(appengine.MultiError)
+	if !ok {
+		t.Fatal("expected appengine.MultiError", err)
+	}
+	if me[0] != datastore.ErrInvalidKey || me[1] != nil {
+		t.Fatal("incorrect errors", me)
+	}
+
+	item, err := memcache.Get(c, nds.CacheKey(c, keys[1]))
+	if err != nil {
+		t.Fatal(err)
+	} else if nds.ItemType(item.Flags) != nds.NoneItem {
+		t.Fatal("expected missing marker", item.Flags)
+	}
+}
@@ -0,0 +1,183 @@
+package nds
+
+import (
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/datastore"
+)
+
+var processCacheKey = "used for *ProcessCache"
+
+// ProcessCache holds entities in process memory across requests, in front of
+// the local cache set with WithLocalCache and memcache. Create one with
+// NewProcessCache when the process starts and attach it to the contexts of
+// requests with WithProcessCache.
+//
+// A ProcessCache is safe for concurrent use by any number of goroutines and
+// requests. Entities read through it are shared between them, so GetMulti
+// loads each one from a copy of its properties, []byte values included, and
+// the values it loads may be modified freely.
+type ProcessCache struct {
+	ttl     time.Duration
+	entries sync.Map
+}
+
+type processCacheEntry struct {
+	pl      datastore.PropertyList
+	partial bool
+	expiry  time.Time
+}
+
+// NewProcessCache returns an empty ProcessCache that keeps each entity for
+// ttl after it is read from memcache or the datastore. A ttl of zero or less
+// keeps entities until they are invalidated.
+func NewProcessCache(ttl time.Duration) *ProcessCache {
+	return &ProcessCache{ttl: ttl}
+}
+
+// WithProcessCache returns a context that makes GetMulti look for entities in
+// pc before memcache and add the entities it reads to pc. It suits immutable
+// or rarely changed reference data, such as enum tables or feature flags.
+//
+// Puts and deletes made through NDS with the returned context, or any other
+// context using pc, remove the entities they write from pc. Writes made by
+// other instances, or with other contexts, are not seen until the entities
+// expire after the ttl of pc, so pc can return stale entities for up to that
+// long. Reads made within a transaction, with WithNoCache or with
+// WithStrongRead never use pc, and reads made with WithFullEntities skip the
+// entities pc holds without their nds:"nocache" fields.
+//
+// Every entity read is kept until it expires or is invalidated, so the keys
+// read with pc should be bounded. Expired entities are only dropped when they
+// are next read or when Purge is called.
+func WithProcessCache(c context.Context, pc *ProcessCache) context.Context {
+	return context.WithValue(c, &processCacheKey, pc)
+}
+
+func processCacheFromContext(c context.Context) (*ProcessCache, bool) {
+	pc, ok := c.Value(&processCacheKey).(*ProcessCache)
+	return pc, ok && pc != nil
+}
+
+// Invalidate removes the entities for keys from pc. Keys are matched using
+// the cache key prefix and namespace of c.
+func (pc *ProcessCache) Invalidate(c context.Context, keys []*datastore.Key) {
+	for _, key := range keys {
+		if key != nil {
+			pc.entries.Delete(createMemcacheKey(c, key))
+		}
+	}
+}
+
+// Clear removes every entity from pc.
+func (pc *ProcessCache) Clear() {
+	pc.entries.Range(func(k, _ interface{}) bool {
+		pc.entries.Delete(k)
+		return true
+	})
+}
+
+// Purge removes the expired entities from pc.
+func (pc *ProcessCache) Purge() {
+	now := time.Now()
+	pc.entries.Range(func(k, v interface{}) bool {
+		if v.(processCacheEntry).expired(now) {
+			pc.entries.Delete(k)
+		}
+		return true
+	})
+}
+
+func (e processCacheEntry) expired(now time.Time) bool {
+	return !e.expiry.IsZero() && !now.Before(e.expiry)
+}
+
+func loadProcessCache(c context.Context, cacheItems []cacheItem) {
+	pc, ok := processCacheFromContext(c)
+	if !ok {
+		return
+	}
+	if _, ok := transactionFromContext(c); ok {
+		return
+	}
+
+	now := time.Now()
+	for i, cacheItem := range cacheItems {
+		if cacheItem.state != miss {
+			continue
+		}
+		memcacheKey := createMemcacheKey(c, cacheItem.key)
+		v, ok := pc.entries.Load(memcacheKey)
+		if !ok {
+			continue
+		}
+		entry := v.(processCacheEntry)
+		if entry.expired(now) {
+			pc.entries.Delete(memcacheKey)
+			continue
+		}
+		if entry.partial && isFullEntities(c) {
+			continue
+		}
+		if err := setValue(cacheItem.val,
+			copyPropertyList(entry.pl)); err == nil {
+			cacheItems[i].pl = entry.pl
+			cacheItems[i].partial = entry.partial
+			cacheItems[i].state = done
+		}
+	}
+}
+
+func saveProcessCache(c context.Context, cacheItems []cacheItem) {
+	pc, ok := processCacheFromContext(c)
+	if !ok {
+		return
+	}
+	if _, ok := transactionFromContext(c); ok {
+		return
+	}
+
+	var expiry time.Time
+	if pc.ttl > 0 {
+		expiry = time.Now().Add(pc.ttl)
+	}
+	for _, cacheItem := range cacheItems {
+		// Entities read while another request held the lock may already be
+		// stale, and their put clears pc before releasing it.
+		if cacheItem.state == externalLock {
+			continue
+		}
+		// Entities already held keep their expiry so hits do not extend it.
+		if cacheItem.err == nil && cacheItem.pl != nil {
+			pc.entries.LoadOrStore(createMemcacheKey(c, cacheItem.key),
+				processCacheEntry{pl: copyPropertyList(cacheItem.pl),
+					partial: cacheItem.partial, expiry: expiry})
+		}
+	}
+}
+
+// evictProcessCache removes the entities for memcacheKeys from the process
+// cache of c.
+func evictProcessCache(c context.Context, memcacheKeys []string) {
+	pc, ok := processCacheFromContext(c)
+	if !ok {
+		return
+	}
+	for _, memcacheKey := range memcacheKeys {
+		pc.entries.Delete(memcacheKey)
+	}
+}
+
+// copyPropertyList returns a copy of pl that shares no []byte values with it.
+func copyPropertyList(pl datastore.PropertyList) datastore.PropertyList {
+	copied := make(datastore.PropertyList, len(pl))
+	copy(copied, pl)
+	for i, p := range copied {
+		if b, ok := p.Value.([]byte); ok {
+			copied[i].Value = append([]byte(nil), b...)
+		}
+	}
+	return copied
+}
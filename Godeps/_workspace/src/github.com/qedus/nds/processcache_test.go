@@ -0,0 +1,183 @@
+package nds_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/qedus/nds"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/datastore"
+)
+
+func TestWithProcessCache(t *testing.T) {
+	c, closeFunc := NewContext(t, nil)
+	defer closeFunc()
+
+	type testEntity struct {
+		Val int
+	}
+
+	key := datastore.NewKey(c, "Entity", "", 1, nil)
+	if _, err := nds.Put(c, key, &testEntity{1}); err != nil {
+		t.Fatal(err)
+	}
+
+	pc := nds.NewProcessCache(time.Hour)
+	rc := &recordingCache{}
+	newRequest := func() context.Context {
+		return nds.WithProcessCache(nds.WithCache(c, rc), pc)
+	}
+
+	if err := nds.Get(newRequest(), key, &testEntity{}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Later requests are served from the process cache.
+	rc.getKeys = nil
+	entity := &testEntity{}
+	if err := nds.Get(newRequest(), key, entity); err != nil {
+		t.Fatal(err)
+	} else if entity.Val != 1 {
+		t.Fatal("incorrect val", entity.Val)
+	}
+	if len(rc.getKeys) != 0 {
+		t.Fatal("expected no memcache lookups", rc.getKeys)
+	}
+
+	// Puts invalidate the process cache.
+	if _, err := nds.Put(newRequest(), key, &testEntity{2}); err != nil {
+		t.Fatal(err)
+	}
+	if err := nds.Get(newRequest(), key, entity); err != nil {
+		t.Fatal(err)
+	} else if entity.Val != 2 {
+		t.Fatal("incorrect val", entity.Val)
+	}
+
+	// Writes made without the process cache are only seen once invalidated.
+	if _, err := nds.Put(c, key, &testEntity{3}); err != nil {
+		t.Fatal(err)
+	}
+	if err := nds.Get(newRequest(), key, entity); err != nil {
+		t.Fatal(err)
+	} else if entity.Val != 2 {
+		t.Fatal("expected the process cached entity", entity.Val)
+	}
+	pc.Invalidate(c, []*datastore.Key{key})
+	if err := nds.Get(newRequest(), key, entity); err != nil {
+		t.Fatal(err)
+	} else if entity.Val != 3 {
+		t.Fatal("incorrect val", entity.Val)
+	}
+
+	// Deletes invalidate the process cache.
+	if err := nds.Delete(newRequest(), key); err != nil {
+		t.Fatal(err)
+	}
+	if err := nds.Get(newRequest(), key,
+		&testEntity{}); err != datastore.ErrNoSuchEntity {
+		t.Fatal("expected datastore.ErrNoSuchEntity", err)
+	}
+}
+
+func TestProcessCacheExpiry(t *testing.T) {
+	c, closeFunc := NewContext(t, nil)
+	defer closeFunc()
+
+	type testEntity struct {
+		Val int
+	}
+
+	key := datastore.NewKey(c, "Entity", "", 1, nil)
+	if _, err := nds.Put(c, key, &testEntity{1}); err != nil {
+		t.Fatal(err)
+	}
+
+	pc := nds.NewProcessCache(time.Millisecond)
+	pcc := nds.WithProcessCache(c, pc)
+	if err := nds.Get(pcc, key, &testEntity{}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := nds.Put(c, key, &testEntity{2}); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(5 * time.Millisecond)
+
+	entity := &testEntity{}
+	if err := nds.Get(pcc, key, entity); err != nil {
+		t.Fatal(err)
+	} else if entity.Val != 2 {
+		t.Fatal("expected the entity to expire", entity.Val)
+	}
+}
+
+func TestProcessCacheCopiesBytes(t *testing.T) {
+	c, closeFunc := NewContext(t, nil)
+	defer closeFunc()
+
+	type testEntity struct {
+		Data []byte
+	}
+
+	key := datastore.NewKey(c, "Entity", "", 1, nil)
+	if _, err := nds.Put(c, key, &testEntity{[]byte("abc")}); err != nil {
+		t.Fatal(err)
+	}
+
+	pc := nds.NewProcessCache(time.Hour)
+	pcc := nds.WithProcessCache(c, pc)
+	entity := &testEntity{}
+	if err := nds.Get(pcc, key, entity); err != nil {
+		t.Fatal(err)
+	}
+	entity.Data[0] = 'x'
+
+	// Modifying a loaded value does not change the cached entity.
+	entity = &testEntity{}
+	if err := nds.Get(pcc, key, entity); err != nil {
+		t.Fatal(err)
+	}
+	entity.Data[1] = 'y'
+	entity = &testEntity{}
+	if err := nds.Get(pcc, key, entity); err != nil {
+		t.Fatal(err)
+	} else if string(entity.Data) != "abc" {
+		t.Fatal("incorrect data", string(entity.Data))
+	}
+}
+
+func TestProcessCacheFullEntities(t *testing.T) {
+	c, closeFunc := NewContext(t, nil)
+	defer closeFunc()
+
+	type testEntity struct {
+		Val     int
+		Derived string `datastore:"derived,noindex" nds:"nocache"`
+	}
+
+	key := datastore.NewKey(c, "Entity", "", 1, nil)
+	if _, err := nds.Put(c, key, &testEntity{1, "large"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := nds.Get(c, key, &testEntity{}); err != nil {
+		t.Fatal(err)
+	}
+
+	// The partial hit from memcache is held by the process cache.
+	pc := nds.NewProcessCache(time.Hour)
+	entity := &testEntity{}
+	if err := nds.Get(nds.WithProcessCache(c, pc), key, entity); err != nil {
+		t.Fatal(err)
+	} else if entity.Derived != "" {
+		t.Fatal("expected a partial hit", entity)
+	}
+
+	// Later full reads skip it.
+	entity = &testEntity{}
+	if err := nds.Get(nds.WithFullEntities(nds.WithProcessCache(c, pc)), key,
+		entity); err != nil {
+		t.Fatal(err)
+	} else if entity.Val != 1 || entity.Derived != "large" {
+		t.Fatal("incorrect entity", entity)
+	}
+}
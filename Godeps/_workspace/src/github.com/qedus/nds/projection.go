@@ -0,0 +1,314 @@
+package nds
+
+import (
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/memcache"
+)
+
+var projectionKey = "used for projection fields"
+
+// WithProjection returns a context that makes GetMulti load and cache only
+// fields of each entity. This keeps cache items small for entities with large
+// fields that are rarely read. Projected entities are cached under their own
+// cache keys, one per distinct set of fields, so reads of full entities never
+// see projected ones.
+//
+// On a cache miss the fields are read with a projection query, so each field
+// must be indexed and single valued. Entities that lack any of the fields are
+// reported as datastore.ErrNoSuchEntity, as projection queries do not return
+// them. The projection query is eventually consistent, so projected entities
+// are not cached while the entity is locked and expire after the lock time.
+// Putting or deleting an entity with PutMulti or DeleteMulti also clears the
+// projections of it read by this instance. At most WithConcurrency queries are
+// run at once.
+//
+// Projected entities are partial and must not be written back with Put as
+// every field outside the projection would be lost. Within a transaction the
+// projection is ignored and whole entities are got.
+func WithProjection(c context.Context, fields []string) context.Context {
+	return context.WithValue(c, &projectionKey, distinctFields(fields))
+}
+
+// distinctFields returns fields sorted and without duplicates, so that equal
+// sets of fields share cache keys.
+func distinctFields(fields []string) []string {
+	sorted := make([]string, 0, len(fields))
+	seen := make(map[string]bool, len(fields))
+	for _, field := range fields {
+		if !seen[field] {
+			seen[field] = true
+			sorted = append(sorted, field)
+		}
+	}
+	sort.Strings(sorted)
+	return sorted
+}
+
+// projectionFields records the sets of fields each kind has been projected to
+// in this instance, so writes to entities of the kind clear their projections.
+var projectionFields = struct {
+	sync.RWMutex
+	m map[string]map[string][]string
+}{m: map[string]map[string][]string{}}
+
+func addProjectionFields(kind string, fields []string) {
+	joined := strings.Join(fields, ",")
+	projectionFields.RLock()
+	_, ok := projectionFields.m[kind][joined]
+	projectionFields.RUnlock()
+	if ok {
+		return
+	}
+
+	projectionFields.Lock()
+	if projectionFields.m[kind] == nil {
+		projectionFields.m[kind] = map[string][]string{}
+	}
+	projectionFields.m[kind][joined] = fields
+	projectionFields.Unlock()
+}
+
+// clearProjections deletes the cached projections of keys.
+func clearProjections(c context.Context, keys []*datastore.Key) {
+	projectionFields.RLock()
+	var memcacheKeys []string
+	for _, key := range keys {
+		for _, fields := range projectionFields.m[key.Kind()] {
+			memcacheKeys = append(memcacheKeys,
+				createProjectionMemcacheKey(c, key, fields))
+		}
+	}
+	projectionFields.RUnlock()
+	if len(memcacheKeys) == 0 {
+		return
+	}
+
+	if err := invalidationCache(c).DeleteMulti(c, memcacheKeys); err != nil &&
+		!isCacheMissErrors(err) {
+		warningf(c, "nds:clearProjections DeleteMulti %s", err)
+	}
+}
+
+func projectionFromContext(c context.Context) ([]string, bool) {
+	fields, ok := c.Value(&projectionKey).([]string)
+	return fields, ok && len(fields) > 0
+}
+
+// createProjectionMemcacheKey returns the memcache key of the entity for key
+// projected to fields.
+func createProjectionMemcacheKey(c context.Context, key *datastore.Key,
+	fields []string) string {
+
+	key = canonicalKey(c, key)
+	return limitKindMemcacheKey(c, key.Kind(),
+		memcachePrefix+encodeCacheKey(c, key)+":projection:"+
+			strings.Join(fields, ","))
+}
+
+// getProjected gets the projection of each entity, first from the cache then
+// with a projection query per entity.
+func getProjected(c context.Context, keys []*datastore.Key,
+	vals reflect.Value, fields []string) error {
+
+	expiration, err := lockTime(c)
+	if err != nil {
+		return err
+	}
+	if err := checkCacheKeyPrefix(c); err != nil {
+		return err
+	}
+
+	cacheKeys := make([]string, len(keys))
+	projectionKeys := make([]string, len(keys))
+	for i, key := range keys {
+		addProjectionFields(key.Kind(), fields)
+		cacheKeys[i] = createMemcacheKey(c, key)
+		projectionKeys[i] = createProjectionMemcacheKey(c, key, fields)
+	}
+
+	errs := make(appengine.MultiError, len(keys))
+	resolved := make([]bool, len(keys))
+	canSave := make([]bool, len(keys))
+	if !isNoCache(c) {
+		items, err := cacheFromContext(c).GetMulti(c,
+			append(append([]string{}, cacheKeys...), projectionKeys...))
+		if err != nil {
+			items = nil
+			warningf(c, "nds:getProjected GetMulti %s", err)
+		}
+		for i := range keys {
+			if items == nil {
+				continue
+			}
+			if item, ok := items[cacheKeys[i]]; ok &&
+				itemType(item.Flags) == lockItem {
+				continue
+			}
+			canSave[i] = true
+
+			item, ok := items[projectionKeys[i]]
+			if !ok {
+				continue
+			}
+			switch itemType(item.Flags) {
+			case noneItem:
+				errs[i] = datastore.ErrNoSuchEntity
+			case entityItem:
+				pl, _, err := decodeCachedEntity(c, keys[i], item)
+				if isReplaceableItemError(err) {
+					continue
+				} else if err != nil {
+					warningf(c, "nds:getProjected decodeEntityItem %s", err)
+					continue
+				}
+				errs[i] = setValue(vals.Index(i), pl)
+			default:
+				continue
+			}
+			resolved[i] = true
+			recordCacheHit(c, cacheKeys[i])
+			addStat(c, statMemcacheHits, 1)
+		}
+	}
+
+	if isCacheOnlyReads(c) {
+		for i := range keys {
+			if !resolved[i] {
+				errs[i], resolved[i] = ErrCacheMiss, true
+			}
+		}
+	}
+
+	var sem chan struct{}
+	if n := concurrency(c); n > 0 {
+		sem = make(chan struct{}, n)
+	}
+
+	pls := make([]datastore.PropertyList, len(keys))
+	wg := sync.WaitGroup{}
+	misses := 0
+	for i := range keys {
+		if resolved[i] {
+			continue
+		}
+		misses++
+		wg.Add(1)
+		if sem != nil {
+			sem <- struct{}{}
+		}
+		go func(i int) {
+			pls[i], errs[i] = loadProjection(c, keys[i], fields)
+			if errs[i] == nil {
+				errs[i] = setValue(vals.Index(i), pls[i])
+			}
+			if sem != nil {
+				<-sem
+			}
+			wg.Done()
+		}(i)
+	}
+	wg.Wait()
+	addStat(c, statMemcacheMisses, misses)
+	addStat(c, statDatastoreReads, misses)
+
+	saveProjections(c, keys, pls, errs, projectionKeys, resolved, canSave,
+		expiration)
+
+	for _, err := range errs {
+		if err != nil {
+			return errs
+		}
+	}
+	return nil
+}
+
+// loadProjection reads fields of the entity for key with a projection query.
+func loadProjection(c context.Context, key *datastore.Key,
+	fields []string) (datastore.PropertyList, error) {
+
+	q := datastore.NewQuery(key.Kind()).Filter("__key__ =", key).
+		Project(fields...).Limit(1)
+
+	sc, endSpan := startSpan(c, "datastore", "datastore.Run", 1)
+	var pl datastore.PropertyList
+	_, err := q.Run(sc).Next(&pl)
+	endSpan(err)
+	if err == datastore.Done {
+		return nil, datastore.ErrNoSuchEntity
+	}
+	return pl, err
+}
+
+// saveProjections adds the projected entities read from the datastore to the
+// cache. Entities that were locked when the cache was read are not saved.
+func saveProjections(c context.Context, keys []*datastore.Key,
+	pls []datastore.PropertyList, errs appengine.MultiError,
+	projectionKeys []string, resolved, canSave []bool,
+	expiration time.Duration) {
+
+	items := make([]*memcache.Item, 0, len(keys))
+	for i := range keys {
+		if resolved[i] || !canSave[i] {
+			continue
+		}
+
+		item := &memcache.Item{
+			Key:        projectionKeys[i],
+			Expiration: expiration,
+		}
+		switch errs[i] {
+		case nil:
+			data, flags, err := encodeEntityItem(c, keys[i],
+				codecFor(c, keys[i]), pls[i])
+			if err != nil {
+				warningf(c, "nds:saveProjections encodeEntityItem %s", err)
+				continue
+			}
+			data, flags = newItemHeader(c, keys[i], expiration).add(data,
+				flags)
+			if len(data) > maxItemSize(c) {
+				continue
+			}
+			item.Flags, item.Value = flags, data
+		case datastore.ErrNoSuchEntity:
+			item.Flags = noneItem
+		default:
+			continue
+		}
+		items = append(items, item)
+	}
+	if len(items) == 0 {
+		return
+	}
+
+	if err := cacheFromContext(c).AddMulti(c, items); err != nil &&
+		!isNotStoredErrors(err) {
+		warningf(c, "nds:saveProjections AddMulti %s", err)
+	}
+}
+
+// isNotStoredErrors reports whether err only reports items that were already
+// present in the cache.
+func isNotStoredErrors(err error) bool {
+	if err == memcache.ErrNotStored {
+		return true
+	}
+	me, ok := err.(appengine.MultiError)
+	if !ok {
+		return false
+	}
+	for _, err := range me {
+		if err != nil && err != memcache.ErrNotStored {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,81 @@
+package nds_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/qedus/nds"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+)
+
+func TestWithProjection(t *testing.T) {
+	c, closeFunc := NewContext(t, nil)
+	defer closeFunc()
+
+	type testEntity struct {
+		Name string
+		Blob []byte `datastore:",noindex"`
+	}
+
+	keys := []*datastore.Key{
+		datastore.NewKey(c, "Entity", "", 1, nil),
+		datastore.NewKey(c, "Entity", "", 2, nil),
+	}
+	if _, err := nds.Put(c, keys[0], &testEntity{"one",
+		make([]byte, 1000)}); err != nil {
+		t.Fatal(err)
+	}
+
+	rc := &recordingCache{}
+	pc := nds.WithProjection(nds.WithCache(c, rc), []string{"Name"})
+
+	for i := 0; i < 2; i++ {
+		entities := make([]testEntity, len(keys))
+		err := nds.GetMulti(pc, keys, entities)
+		me, ok := err.(appengine.MultiError)
+		if !ok {
+			t.Fatal("expected appengine.MultiError", i, err)
+		} else if me[0] != nil || me[1] != datastore.ErrNoSuchEntity {
+			t.Fatal("incorrect errors", i, me)
+		}
+		if entities[0].Name != "one" || entities[0].Blob != nil {
+			t.Fatal("expected projected entity", i, entities[0])
+		}
+	}
+
+	// Projected entities are added once under their own keys.
+	if len(rc.addItems) != 2 {
+		t.Fatal("expected 2 projected items", len(rc.addItems))
+	}
+	for _, item := range rc.addItems {
+		if item.Key == nds.CacheKey(c, keys[0]) ||
+			item.Key == nds.CacheKey(c, keys[1]) {
+			t.Fatal("projected entity cached under full entity key")
+		}
+	}
+
+	// A full read is unaffected by the projected entries.
+	entity := &testEntity{}
+	if err := nds.Get(nds.WithCache(c, rc), keys[0], entity); err != nil {
+		t.Fatal(err)
+	} else if len(entity.Blob) != 1000 {
+		t.Fatal("expected full entity", len(entity.Blob))
+	}
+
+	// Putting the entity clears its projection.
+	rc.delKeys = nil
+	if _, err := nds.Put(nds.WithCache(c, rc), keys[0], &testEntity{"uno",
+		nil}); err != nil {
+		t.Fatal(err)
+	}
+	cleared := false
+	for _, key := range rc.delKeys {
+		if strings.Contains(key, ":projection:") {
+			cleared = true
+		}
+	}
+	if !cleared {
+		t.Fatal("expected projection to be cleared", rc.delKeys)
+	}
+}
@@ -0,0 +1,107 @@
+//go:build prometheus
+// +build prometheus
+
+package nds
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	collectorOnce sync.Once
+	collector     *statsCollector
+)
+
+// NewCollector returns a prometheus.Collector exporting counters describing
+// every NDS operation made by the process, the same as PublishExpvar, under
+// the nds namespace: nds_gets_total, nds_puts_total, nds_deletes_total,
+// nds_memcache_hits_total, nds_memcache_misses_total,
+// nds_datastore_reads_total and nds_lock_contentions_total. The cache hit rate
+// is the rate of memcache hits over the rate of hits and misses. The duration
+// of each datastore and cache call is exported as the histogram
+// nds_operation_duration_seconds, labelled with the operation, such as
+// "memcache.GetMulti". The ages of the cache entries recorded with
+// WithEntryAges are exported as the histogram nds_cache_entry_age_seconds.
+//
+// NewCollector is only available when NDS is built with the prometheus build
+// tag, so other users need not depend on the Prometheus client. Every call
+// returns the same collector, which is safe to collect from concurrently, so
+// it must only be registered once.
+func NewCollector() prometheus.Collector {
+	collectorOnce.Do(func() {
+		collector = newStatsCollector()
+		operationObserver.Store(func(name string, took time.Duration) {
+			collector.durations.WithLabelValues(name).Observe(took.Seconds())
+		})
+	})
+	return collector
+}
+
+type statsCollector struct {
+	counters  map[stat]*prometheus.Desc
+	durations *prometheus.HistogramVec
+	entryAges *prometheus.Desc
+}
+
+func newStatsCollector() *statsCollector {
+	counters := map[stat]*prometheus.Desc{}
+	for s, metric := range map[stat]struct{ name, help string }{
+		statGets:    {"gets_total", "Entities requested by gets."},
+		statPuts:    {"puts_total", "Entities put."},
+		statDeletes: {"deletes_total", "Entities deleted."},
+		statMemcacheHits: {"memcache_hits_total",
+			"Entities served from memcache."},
+		statMemcacheMisses: {"memcache_misses_total",
+			"Entities missing from memcache."},
+		statDatastoreReads: {"datastore_reads_total",
+			"Entities read from the datastore."},
+		statLockContentions: {"lock_contentions_total",
+			"Entities locked by another request."},
+	} {
+		counters[s] = prometheus.NewDesc(
+			prometheus.BuildFQName("nds", "", metric.name), metric.help, nil, nil)
+	}
+
+	return &statsCollector{
+		counters: counters,
+		durations: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: "nds",
+			Name:      "operation_duration_seconds",
+			Help:      "Duration of the datastore and cache calls made by NDS.",
+			Buckets:   prometheus.DefBuckets,
+		}, []string{"operation"}),
+		entryAges: prometheus.NewDesc(
+			prometheus.BuildFQName("nds", "", "cache_entry_age_seconds"),
+			"Age of cache entries when invalidated by a write.", nil, nil),
+	}
+}
+
+func (sc *statsCollector) Describe(ch chan<- *prometheus.Desc) {
+	for _, desc := range sc.counters {
+		ch <- desc
+	}
+	sc.durations.Describe(ch)
+	ch <- sc.entryAges
+}
+
+func (sc *statsCollector) Collect(ch chan<- prometheus.Metric) {
+	for s, desc := range sc.counters {
+		ch <- prometheus.MustNewConstMetric(desc, prometheus.CounterValue,
+			float64(atomic.LoadInt64(&processStats.counts[s])))
+	}
+	sc.durations.Collect(ch)
+
+	h := EntryAges()
+	buckets := make(map[float64]uint64, len(h.Buckets))
+	cumulative := uint64(0)
+	for i, bound := range h.Buckets {
+		cumulative += uint64(h.Counts[i])
+		buckets[bound.Seconds()] = cumulative
+	}
+	ch <- prometheus.MustNewConstHistogram(sc.entryAges, uint64(h.Count),
+		h.Sum.Seconds(), buckets)
+}
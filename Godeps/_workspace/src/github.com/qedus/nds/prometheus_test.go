@@ -0,0 +1,56 @@
+//go:build prometheus
+// +build prometheus
+
+package nds_test
+
+import (
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/qedus/nds"
+	"google.golang.org/appengine/datastore"
+)
+
+func TestNewCollector(t *testing.T) {
+	c, closeFunc := NewContext(t, nil)
+	defer closeFunc()
+
+	type testEntity struct {
+		Val int
+	}
+
+	if nds.NewCollector() != nds.NewCollector() {
+		t.Fatal("expected the same collector")
+	}
+	registry := prometheus.NewRegistry()
+	if err := registry.Register(nds.NewCollector()); err != nil {
+		t.Fatal(err)
+	}
+
+	key := datastore.NewKey(c, "Entity", "", 1, nil)
+	if _, err := nds.Put(c, key, &testEntity{1}); err != nil {
+		t.Fatal(err)
+	}
+	if err := nds.Get(c, key, &testEntity{}); err != nil {
+		t.Fatal(err)
+	}
+
+	families, err := registry.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := map[string]bool{}
+	for _, family := range families {
+		names[family.GetName()] = true
+	}
+	for _, name := range []string{
+		"nds_gets_total",
+		"nds_memcache_misses_total",
+		"nds_datastore_reads_total",
+		"nds_operation_duration_seconds",
+	} {
+		if !names[name] {
+			t.Fatal("expected metric", name)
+		}
+	}
+}
@@ -1,13 +1,13 @@
 package nds
 
 import (
+	"errors"
+	"fmt"
 	"reflect"
 
 	"golang.org/x/net/context"
 	"google.golang.org/appengine"
 	"google.golang.org/appengine/datastore"
-	"google.golang.org/appengine/log"
-	"google.golang.org/appengine/memcache"
 )
 
 // putMultiLimit is the App Engine datastore limit for the maximum number
@@ -15,74 +15,250 @@ import (
 const putMultiLimit = 500
 
 // PutMulti is a batch version of Put. It works just like datastore.PutMulti
-// except it interacts appropriately with NDS's caching strategy.
+// except it interacts appropriately with NDS's caching strategy. It also
+// removes the API limit of 500 entities per request by calling the datastore
+// as many times as required. If c is cancelled part way through, the remaining
+// entities are not put and c.Err() is returned. If c has a deadline too close
+// for the next batch, the remaining entities are not put and a
+// *DeadlineBudgetError is returned with the keys of the entities that were.
+//
+// Structs with a signed integer field tagged nds:"version" are versioned. The
+// field must hold the version stored in the datastore, zero for a new entity,
+// and is incremented as the entity is put. If the stored version differs the
+// entity is not put and ErrConcurrentModification is reported for it. Each
+// versioned entity is checked and put while holding a write lock item in the
+// cache, which other versioned puts of the entity wait for, rather than in a
+// transaction. Within a transaction the check is made as part of it instead,
+// as it is if the cache cannot hold the lock. Only entities that vals holds
+// addressably, such as struct and struct pointer elements, are versioned.
 func PutMulti(c context.Context,
 	keys []*datastore.Key, vals interface{}) ([]*datastore.Key, error) {
 
-	if err := checkMultiArgs(keys, reflect.ValueOf(vals)); err != nil {
+	v := reflect.ValueOf(vals)
+	if err := checkPutArgs(keys, v); err != nil {
 		return nil, err
 	}
+	if err := checkAppIDs(c, keys); err != nil {
+		return nil, err
+	}
+	c = withBreakerDecision(c)
+	c, flush := batchLogging(c)
+	defer flush()
+
+	if r, ok := recorderFromContext(c); ok {
+		return recordPutMulti(c, r, keys, vals)
+	}
+
+	if f, ok := idAssignedHandler(c); ok {
+		putKeys, err := PutMulti(withoutIDAssignedHandler(c), keys, vals)
+		idsAssigned(f, keys, putKeys)
+		return putKeys, err
+	}
+
+	if f, ok := keyMapperFromContext(c); ok {
+		physicalKeys, err := mapKeys(keys, f)
+		if err != nil {
+			return nil, err
+		}
+		putKeys, err := PutMulti(withoutKeyMapper(c), physicalKeys, vals)
+		if err != nil {
+			return nil, err
+		}
+		return unmapKeys(c, keys, putKeys)
+	}
+
+	if uncached, cached := splitUncachedKinds(c, keys); len(uncached) > 0 {
+		return runUncachedSplit(c, keys, v, uncached, cached,
+			func(c context.Context, keys []*datastore.Key,
+				vals reflect.Value) ([]*datastore.Key, error) {
+				return PutMulti(c, keys, vals.Interface())
+			})
+	}
+
+	if !isVersionChecked(c) && hasVersionedStruct(v) {
+		return putVersionedMulti(c, keys, v)
+	}
+
+	addStat(c, statPuts, len(keys))
 
-	return putMulti(c, keys, vals)
+	size := batchSize(c, putMultiLimit)
+	if limit, ok := serializationMemoryLimit(c); ok {
+		return putBounded(c, keys, v, size, limit)
+	}
+	if len(keys) <= size {
+		return putMulti(c, keys, vals)
+	}
+
+	putKeys := make([]*datastore.Key, len(keys))
+	fc, ff := newFailFast(c)
+	err := runBudgetedBatches(fc, len(keys), size, &batchBudget{},
+		func(lo, hi int) error {
+			dsKeys, err := putMulti(fc, keys[lo:hi],
+				v.Slice(lo, hi).Interface())
+			copy(putKeys[lo:hi], dsKeys)
+			ff.record(err)
+			return err
+		})
+	err = ff.done(err)
+	if be, ok := err.(*DeadlineBudgetError); ok {
+		return putKeys[:be.Done], err
+	} else if err != nil {
+		return nil, err
+	}
+	return putKeys, nil
+}
+
+// KeyError is returned by Put when the datastore rejects the entity with an
+// error specific to its key, such as an incomplete key or a kind mismatch.
+type KeyError struct {
+	Key *datastore.Key
+	Err error
+}
+
+func (e *KeyError) Error() string {
+	return fmt.Sprintf("nds: failed to put key %s: %s", e.Key, e.Err)
+}
+
+// Unwrap returns the underlying datastore error.
+func (e *KeyError) Unwrap() error {
+	return e.Err
 }
 
 // Put saves the entity val into the datastore with key. val must be a struct
 // pointer; if a struct pointer then any unexported fields of that struct will
 // be skipped. If key is an incomplete key, the returned key will be a unique
-// key generated by the datastore.
+// key generated by the datastore. Errors the datastore reports for the key
+// itself are returned as a *KeyError.
 func Put(c context.Context,
 	key *datastore.Key, val interface{}) (*datastore.Key, error) {
 
+	if v := reflect.ValueOf(val); v.Kind() == reflect.Ptr && v.IsNil() {
+		return nil, errors.New("nds: val is a nil pointer")
+	}
+
 	keys, err := PutMulti(c, []*datastore.Key{key}, []interface{}{val})
 	switch e := err.(type) {
 	case nil:
 		return keys[0], nil
 	case appengine.MultiError:
-		return nil, e[0]
+		if len(e) == 0 {
+			return nil, errEmptyMultiError
+		} else if e[0] == nil {
+			return nil, err
+		}
+		return nil, &KeyError{Key: key, Err: e[0]}
 	default:
 		return nil, err
 	}
 }
 
+var upsertKey = "used for UpsertMulti"
+
+// UpsertMulti works just like PutMulti except that the cache is neither
+// locked nor invalidated, saving two memcache calls per batch. It is intended
+// for append only entities, such as event logs, that are never read through
+// NDS. Cached copies of the entities are not invalidated so reading upserted
+// entities with GetMulti can return stale entities. Within a transaction the
+// entities are written as part of the transaction as usual.
+func UpsertMulti(c context.Context,
+	keys []*datastore.Key, vals interface{}) ([]*datastore.Key, error) {
+
+	return PutMulti(context.WithValue(c, &upsertKey, true), keys, vals)
+}
+
+func isUpsert(c context.Context) bool {
+	upsert, _ := c.Value(&upsertKey).(bool)
+	return upsert
+}
+
 // putMulti puts the entities into the datastore and then its local cache.
 func putMulti(c context.Context,
 	keys []*datastore.Key, vals interface{}) ([]*datastore.Key, error) {
 
-	lockMemcacheKeys := make([]string, 0, len(keys))
-	lockMemcacheItems := make([]*memcache.Item, 0, len(keys))
-	for _, key := range keys {
-		if !key.Incomplete() {
-			item := &memcache.Item{
-				Key:        createMemcacheKey(key),
-				Flags:      lockItem,
-				Value:      itemLock(),
-				Expiration: memcacheLockTime,
-			}
-			lockMemcacheItems = append(lockMemcacheItems, item)
-			lockMemcacheKeys = append(lockMemcacheKeys, item.Key)
-		}
+	expiration, err := lockTime(c)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkCacheKeyPrefix(c); err != nil {
+		return nil, err
+	}
+
+	if recordDryRun(c, "PutMulti", keys) {
+		return keys, nil
 	}
 
 	if tx, ok := transactionFromContext(c); ok {
-		tx.Lock()
-		tx.lockMemcacheItems = append(tx.lockMemcacheItems,
-			lockMemcacheItems...)
-		tx.Unlock()
-	} else if err := memcacheSetMulti(c, lockMemcacheItems); err != nil {
-		return nil, err
+		if err := tx.addEntityGroups(keys); err != nil {
+			return nil, err
+		}
+	}
+
+	lockMemcacheItems, lockMemcacheKeys, lockedKeys := newLockItems(c, keys,
+		expiration)
+
+	if isUpsert(c) {
+		// Upserted entities are never locked or invalidated.
+		lockMemcacheItems, lockMemcacheKeys, lockedKeys = nil, nil, nil
+	} else if tx, ok := transactionFromContext(c); ok {
+		if isWithoutLocks(c) && !isStrictCommitOrdering(c) {
+			tx.addDeleteKeys(lockMemcacheKeys, lockedKeys)
+		} else {
+			tx.addLockItems(c, lockMemcacheItems, lockedKeys)
+		}
+	} else if !isNoCache(c) && !isWithoutLocks(c) {
+		recordEntryAges(c, lockedKeys)
+		if err := setLocks(c, lockMemcacheItems); err != nil {
+			return nil, err
+		}
 	}
 
 	// Save to the datastore.
-	dsKeys, err := datastorePutMulti(c, keys, vals)
+	var dsKeys []*datastore.Key
+	put := func() error {
+		sc, endSpan := startSpan(c, "datastore", "datastore.PutMulti",
+			len(keys))
+		var err error
+		dsKeys, err = datastoreFromContext(c).PutMulti(sc, keys,
+			vals)
+		endSpan(err)
+		return checkMultiError(err, len(keys))
+	}
+	if hasIncompleteKey(keys) {
+		// A failed put may still have stored entities under IDs it never
+		// returned, so retrying it could store them twice.
+		err = put()
+	} else {
+		err = retry(c, put)
+	}
+	evictLocalCache(c, lockMemcacheKeys)
 	if err != nil {
 		return nil, err
 	}
 
-	if _, ok := transactionFromContext(c); !ok {
-		// Remove the locks.
-		if err := memcacheDeleteMulti(c, lockMemcacheKeys); err != nil {
-			log.Warningf(c, "putMulti memcache.DeleteMulti %s", err)
+	if tx, ok := transactionFromContext(c); ok {
+		tx.putEntities(c, dsKeys, reflect.ValueOf(vals))
+	} else if isUpsert(c) {
+		return dsKeys, nil
+	} else if isWriteThrough(c) && !isNoCache(c) && !isWithoutLocks(c) {
+		if err := writeThrough(c, lockMemcacheItems, lockedKeys, keys,
+			reflect.ValueOf(vals)); err != nil {
+			return nil, err
 		}
+	} else if wg, ok := asyncInvalidationGroup(c); ok {
+		invalidatePutAsync(c, wg, lockMemcacheKeys, lockedKeys)
+	} else if err := invalidatePut(c, lockMemcacheKeys,
+		lockedKeys); err != nil {
+		return nil, err
 	}
 	return dsKeys, nil
 }
+
+// hasIncompleteKey reports whether any of keys is incomplete.
+func hasIncompleteKey(keys []*datastore.Key) bool {
+	for _, key := range keys {
+		if key != nil && key.Incomplete() {
+			return true
+		}
+	}
+	return false
+}
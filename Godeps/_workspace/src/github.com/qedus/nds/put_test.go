@@ -2,6 +2,8 @@ package nds_test
 
 import (
 	"errors"
+	"fmt"
+	"strings"
 	"testing"
 
 	"github.com/qedus/nds"
@@ -142,8 +144,14 @@ func TestPutDatastoreMultiError(t *testing.T) {
 
 	if _, err := nds.Put(c, key, val); err == nil {
 		t.Fatal("expected error")
-	} else if err != expectedErr {
+	} else if ke, ok := err.(*nds.KeyError); !ok {
+		t.Fatal("expected *nds.KeyError", err)
+	} else if ke.Err != expectedErr {
 		t.Fatal("should be expectedErr")
+	} else if !ke.Key.Equal(key) {
+		t.Fatal("incorrect key", ke.Key)
+	} else if !strings.Contains(ke.Error(), key.String()) {
+		t.Fatal("expected key in error message", ke.Error())
 	}
 }
 
@@ -156,3 +164,219 @@ func TestPutMultiZeroKeys(t *testing.T) {
 		t.Fatal(err)
 	}
 }
+
+func TestPutMultiDuplicateKeys(t *testing.T) {
+	c, closeFunc := NewContext(t, nil)
+	defer closeFunc()
+
+	type testEntity struct {
+		Val int
+	}
+
+	rc := &recordingCache{}
+	cc := nds.WithCache(c, rc)
+
+	key := datastore.NewKey(c, "Entity", "", 1, nil)
+	keys := []*datastore.Key{key, key}
+	if _, err := nds.PutMulti(cc, keys, []testEntity{{1}, {2}}); err != nil {
+		t.Fatal(err)
+	}
+	if len(rc.setItems) != 1 {
+		t.Fatal("expected a single lock item", len(rc.setItems))
+	}
+
+	te := &testEntity{}
+	if err := nds.Get(cc, key, te); err != nil {
+		t.Fatal(err)
+	} else if te.Val != 2 {
+		t.Fatal("expected last value", te.Val)
+	}
+}
+
+func TestPutMultiDuplicateKeysInTransaction(t *testing.T) {
+	c, closeFunc := NewContext(t, nil)
+	defer closeFunc()
+
+	type testEntity struct {
+		Val int
+	}
+
+	rc := &recordingCache{}
+	cc := nds.WithCache(c, rc)
+
+	key := datastore.NewKey(c, "Entity", "", 1, nil)
+	keys := []*datastore.Key{key, key}
+	if err := nds.RunInTransaction(cc, func(tc context.Context) error {
+		if _, err := nds.PutMulti(tc, keys,
+			[]testEntity{{1}, {2}}); err != nil {
+			return err
+		}
+		if _, err := nds.Put(tc, key, &testEntity{3}); err != nil {
+			return err
+		}
+		return nds.Delete(tc, key)
+	}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if len(rc.setItems) != 1 {
+		t.Fatal("expected a single lock item", len(rc.setItems))
+	}
+
+	if err := nds.Get(cc, key, &testEntity{}); err != datastore.ErrNoSuchEntity {
+		t.Fatal("expected datastore.ErrNoSuchEntity", err)
+	}
+}
+
+func TestUpsertMulti(t *testing.T) {
+	c, closeFunc := NewContext(t, nil)
+	defer closeFunc()
+
+	type testEntity struct {
+		Val int
+	}
+
+	rc := &recordingCache{}
+	cc := nds.WithCache(c, rc)
+
+	keys := []*datastore.Key{
+		datastore.NewKey(c, "Event", "", 1, nil),
+		datastore.NewIncompleteKey(c, "Event", nil),
+	}
+	putKeys, err := nds.UpsertMulti(cc, keys, []testEntity{{1}, {2}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(putKeys) != 2 || putKeys[1].Incomplete() {
+		t.Fatal("expected complete keys", putKeys)
+	}
+
+	if err := nds.RunInTransaction(cc, func(tc context.Context) error {
+		_, err := nds.UpsertMulti(tc, keys[:1], []testEntity{{3}})
+		return err
+	}, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(rc.setItems) != 0 || len(rc.delKeys) != 0 {
+		t.Fatal("expected the cache to be untouched")
+	}
+
+	entities := make([]testEntity, 2)
+	if err := datastore.GetMulti(c, putKeys, entities); err != nil {
+		t.Fatal(err)
+	} else if entities[0].Val != 3 || entities[1].Val != 2 {
+		t.Fatal("incorrect entities", entities)
+	}
+}
+
+func TestPutMultiNilVals(t *testing.T) {
+	c, closeFunc := NewContext(t, nil)
+	defer closeFunc()
+
+	type testEntity struct {
+		Val int
+	}
+
+	keys := []*datastore.Key{
+		datastore.NewKey(c, "Entity", "", 1, nil),
+		datastore.NewKey(c, "Entity", "", 2, nil),
+		datastore.NewKey(c, "Entity", "", 3, nil),
+	}
+
+	for i := range keys {
+		vals := []*testEntity{{1}, {2}, {3}}
+		vals[i] = nil
+		expected := fmt.Sprintf("nds: vals[%d] is a nil pointer", i)
+		if _, err := nds.PutMulti(c, keys, vals); err == nil ||
+			err.Error() != expected {
+			t.Fatal("expected nil pointer error", i, err)
+		}
+
+		ivals := []interface{}{&testEntity{1}, &testEntity{2}, &testEntity{3}}
+		ivals[i] = (*testEntity)(nil)
+		if _, err := nds.PutMulti(c, keys, ivals); err == nil ||
+			err.Error() != expected {
+			t.Fatal("expected nil pointer error", i, err)
+		}
+
+		ivals[i] = nil
+		expected = fmt.Sprintf("nds: vals[%d] is nil", i)
+		if _, err := nds.PutMulti(c, keys, ivals); err == nil ||
+			err.Error() != expected {
+			t.Fatal("expected nil error", i, err)
+		}
+	}
+
+	if _, err := nds.Put(c, keys[0], (*testEntity)(nil)); err == nil ||
+		err.Error() != "nds: val is a nil pointer" {
+		t.Fatal("expected nil pointer error", err)
+	}
+
+	if err := nds.GetMulti(c, keys, make([]testEntity, 3)); err == nil {
+		t.Fatal("expected nothing to be put")
+	}
+}
+
+func TestPutMultiLengthMismatch(t *testing.T) {
+	c, closeFunc := NewContext(t, nil)
+	defer closeFunc()
+
+	type testEntity struct {
+		Val int
+	}
+
+	keys := []*datastore.Key{
+		datastore.NewKey(c, "Entity", "", 1, nil),
+		datastore.NewKey(c, "Entity", "", 2, nil),
+	}
+
+	// More keys than vals.
+	_, err := nds.PutMulti(c, keys, []testEntity{{1}})
+	expected := "nds: keys and vals slices have different lengths " +
+		"(got 2 keys, 1 vals)"
+	if err == nil || err.Error() != expected {
+		t.Fatal("expected length error", err)
+	}
+
+	// More vals than keys, including a nil val the keys do not reach.
+	_, err = nds.PutMulti(c, keys[:1], []*testEntity{{1}, nil})
+	expected = "nds: keys and vals slices have different lengths " +
+		"(got 1 keys, 2 vals)"
+	if err == nil || err.Error() != expected {
+		t.Fatal("expected length error", err)
+	}
+
+	if err := nds.GetMulti(c, keys, make([]testEntity, 2)); err == nil {
+		t.Fatal("expected nothing to be put")
+	}
+}
+
+func TestPutEmptyMultiError(t *testing.T) {
+	c, closeFunc := NewContext(t, nil)
+	defer closeFunc()
+
+	type testEntity struct {
+		Val int
+	}
+
+	nds.SetDatastorePutMulti(func(c context.Context,
+		keys []*datastore.Key, vals interface{}) ([]*datastore.Key, error) {
+		return nil, appengine.MultiError{}
+	})
+	defer nds.SetDatastorePutMulti(datastore.PutMulti)
+
+	key := datastore.NewKey(c, "Entity", "", 1, nil)
+	if _, err := nds.Put(c, key, &testEntity{1}); err == nil {
+		t.Fatal("expected error")
+	} else if _, ok := err.(appengine.MultiError); ok {
+		t.Fatal("expected generic error", err)
+	}
+
+	keys := []*datastore.Key{key, datastore.NewKey(c, "Entity", "", 2, nil)}
+	if _, err := nds.PutMulti(c, keys,
+		[]testEntity{{1}, {2}}); err == nil {
+		t.Fatal("expected error")
+	} else if _, ok := err.(appengine.MultiError); ok {
+		t.Fatal("expected generic error", err)
+	}
+}
@@ -0,0 +1,63 @@
+package nds
+
+import (
+	"errors"
+	"reflect"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/datastore"
+)
+
+// PutIf puts val with key only if predicate returns true for the entity
+// currently stored with key, and reports whether val was put. val must be a
+// struct pointer or a pointer to a datastore.PropertyLoadSaver. predicate is
+// given a new value of the same type as val loaded with the current entity, or
+// nil if there is none or key is incomplete.
+//
+// The entity is read straight from the datastore and put while holding a write
+// lock item in the cache rather than within a transaction, so no other PutIf
+// or versioned put of the entity can come between predicate being called and
+// val being put. Puts that do not check the entity first, such as those made
+// with Put, do not wait for the lock. Within a transaction the read and the
+// put are made as part of it instead, as they are within their own
+// transaction if the cache cannot hold the lock. predicate can be called more
+// than once if a transaction is retried.
+func PutIf(c context.Context, key *datastore.Key, val interface{},
+	predicate func(existing interface{}) bool) (bool, error) {
+
+	v := reflect.ValueOf(val)
+	if v.Kind() != reflect.Ptr || v.IsNil() {
+		return false, errors.New("nds: val must be a non-nil pointer")
+	}
+
+	var written bool
+	f := func(tc context.Context) error {
+		written = false
+
+		var existing interface{}
+		if key != nil && !key.Incomplete() {
+			current := reflect.New(v.Type().Elem()).Interface()
+			switch err := Get(WithStrongRead(tc), key, current); err {
+			case nil:
+				existing = current
+			case datastore.ErrNoSuchEntity:
+			default:
+				return err
+			}
+		}
+
+		if !predicate(existing) {
+			return nil
+		}
+		if _, err := Put(tc, key, val); err != nil {
+			return err
+		}
+		written = true
+		return nil
+	}
+
+	if err := runWriteLocked(c, key, f); err != nil {
+		return false, err
+	}
+	return written, nil
+}
@@ -0,0 +1,122 @@
+package nds_test
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/qedus/nds"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/datastore"
+)
+
+func TestPutIf(t *testing.T) {
+	c, closeFunc := NewContext(t, nil)
+	defer closeFunc()
+
+	type testEntity struct {
+		Val int
+	}
+
+	key := datastore.NewKey(c, "Entity", "", 1, nil)
+	isMissing := func(existing interface{}) bool {
+		return existing == nil
+	}
+
+	// The entity does not exist yet.
+	if written, err := nds.PutIf(c, key, &testEntity{1},
+		isMissing); err != nil {
+		t.Fatal(err)
+	} else if !written {
+		t.Fatal("expected entity to be put")
+	}
+
+	// It does now so the predicate fails.
+	if written, err := nds.PutIf(c, key, &testEntity{2},
+		isMissing); err != nil {
+		t.Fatal(err)
+	} else if written {
+		t.Fatal("expected entity not to be put")
+	}
+
+	isOne := func(existing interface{}) bool {
+		te, ok := existing.(*testEntity)
+		return ok && te.Val == 1
+	}
+	if written, err := nds.PutIf(c, key, &testEntity{3},
+		isOne); err != nil {
+		t.Fatal(err)
+	} else if !written {
+		t.Fatal("expected entity to be put")
+	}
+
+	te := &testEntity{}
+	if err := nds.Get(c, key, te); err != nil {
+		t.Fatal(err)
+	} else if te.Val != 3 {
+		t.Fatal("incorrect val", te.Val)
+	}
+
+	// Entities written earlier in a transaction are seen by the predicate.
+	if err := nds.RunInTransaction(c, func(tc context.Context) error {
+		if _, err := nds.Put(tc, key, &testEntity{1}); err != nil {
+			return err
+		}
+		written, err := nds.PutIf(tc, key, &testEntity{4}, isOne)
+		if err == nil && !written {
+			t.Fatal("expected entity to be put")
+		}
+		return err
+	}, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := nds.Get(c, key, te); err != nil {
+		t.Fatal(err)
+	} else if te.Val != 4 {
+		t.Fatal("incorrect val", te.Val)
+	}
+
+	if _, err := nds.PutIf(c, key, testEntity{5}, isMissing); err == nil {
+		t.Fatal("expected error for non pointer val")
+	}
+}
+
+func TestPutIfRacing(t *testing.T) {
+	c, closeFunc := NewContext(t, nil)
+	defer closeFunc()
+
+	type testEntity struct {
+		Val int
+	}
+
+	// Writers checking the same entity are serialized by the write lock, so
+	// only the first of them sees it missing.
+	key := datastore.NewKey(c, "Entity", "", 1, nil)
+	const writers = 5
+	written := make([]bool, writers)
+	errs := make([]error, writers)
+	wg := sync.WaitGroup{}
+	for i := 0; i < writers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			written[i], errs[i] = nds.PutIf(c, key, &testEntity{i},
+				func(existing interface{}) bool {
+					return existing == nil
+				})
+		}(i)
+	}
+	wg.Wait()
+
+	n := 0
+	for i, err := range errs {
+		if err != nil {
+			t.Fatal(err)
+		} else if written[i] {
+			n++
+		}
+	}
+	if n != 1 {
+		t.Fatal("expected exactly one put", written)
+	}
+}
@@ -0,0 +1,81 @@
+package nds
+
+import (
+	"bytes"
+	"errors"
+	"reflect"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/datastore"
+)
+
+// PutIfChanged puts val with key only if it differs from the entity currently
+// stored with key, and reports whether val was put. Skipping unchanged
+// entities saves both the datastore write and the cache invalidation, which
+// suits sync jobs that repeatedly push mostly unchanged data. val must be a
+// struct pointer or a pointer to a datastore.PropertyLoadSaver.
+//
+// The current entity is read with Get, so it usually comes from the cache, and
+// is compared with val once both are serialized with the codec used to cache
+// entities of the kind of key. Properties are compared in name order and times
+// as the datastore stores them, so entities that only differ in property order,
+// time zone or sub-microsecond precision are equal. val is always put if key is
+// incomplete or there is no current entity. Unlike PutIf the read and the put
+// are not made within a transaction, so a concurrent write between them can be
+// overwritten.
+func PutIfChanged(c context.Context, key *datastore.Key,
+	val interface{}) (bool, error) {
+
+	v := reflect.ValueOf(val)
+	if v.Kind() != reflect.Ptr || v.IsNil() {
+		return false, errors.New("nds: val must be a non-nil pointer")
+	}
+
+	if key != nil && !key.Incomplete() {
+		var current datastore.PropertyList
+		switch err := Get(c, key, &current); err {
+		case nil:
+			pl, err := saveValue(v)
+			if err != nil {
+				return false, err
+			}
+			if same, err := sameEntity(codecFor(c, key), current,
+				pl); err != nil {
+				return false, err
+			} else if same {
+				return false, nil
+			}
+		case datastore.ErrNoSuchEntity:
+		default:
+			return false, err
+		}
+	}
+
+	if _, err := Put(c, key, val); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// sameEntity reports whether a and b serialize to the same bytes with codec
+// once their properties are in name order and their times are normalized.
+func sameEntity(codec Codec, a, b datastore.PropertyList) (bool, error) {
+	aData, err := codec.Marshal(canonicalPropertyList(a))
+	if err != nil {
+		return false, err
+	}
+	bData, err := codec.Marshal(canonicalPropertyList(b))
+	if err != nil {
+		return false, err
+	}
+	return bytes.Equal(aData, bData), nil
+}
+
+// canonicalPropertyList returns a copy of pl sorted by property name, keeping
+// the order of multiple values, with its times normalized.
+func canonicalPropertyList(pl datastore.PropertyList) datastore.PropertyList {
+	canonical := append(datastore.PropertyList(nil), pl...)
+	sortProperties(canonical)
+	normalizeTimes(canonical)
+	return canonical
+}
@@ -0,0 +1,60 @@
+package nds_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/qedus/nds"
+	"google.golang.org/appengine/datastore"
+)
+
+func TestPutIfChanged(t *testing.T) {
+	c, closeFunc := NewContext(t, nil)
+	defer closeFunc()
+
+	type testEntity struct {
+		Val  int
+		Time time.Time
+	}
+
+	rc := &recordingCache{}
+	cc := nds.WithCache(c, rc)
+
+	now := time.Now()
+	key := datastore.NewKey(c, "Entity", "", 1, nil)
+
+	// The entity does not exist yet.
+	if written, err := nds.PutIfChanged(cc, key,
+		&testEntity{1, now}); err != nil {
+		t.Fatal(err)
+	} else if !written {
+		t.Fatal("expected entity to be put")
+	}
+
+	// The same entity in another time zone is not put again.
+	deletes := len(rc.delKeys)
+	if written, err := nds.PutIfChanged(cc, key,
+		&testEntity{1, now.UTC()}); err != nil {
+		t.Fatal(err)
+	} else if written {
+		t.Fatal("expected entity not to be put")
+	}
+	if len(rc.delKeys) != deletes {
+		t.Fatal("expected cache not to be invalidated")
+	}
+
+	// A changed entity is put.
+	if written, err := nds.PutIfChanged(cc, key,
+		&testEntity{2, now}); err != nil {
+		t.Fatal(err)
+	} else if !written {
+		t.Fatal("expected entity to be put")
+	}
+
+	te := &testEntity{}
+	if err := nds.Get(cc, key, te); err != nil {
+		t.Fatal(err)
+	} else if te.Val != 2 {
+		t.Fatal("incorrect val", te.Val)
+	}
+}
@@ -0,0 +1,418 @@
+package nds
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/memcache"
+)
+
+// queryMemcacheKey returns the memcache key used to cache a result of q.
+// The key is derived from the contents of the query, rather than its memory
+// address, so it is the same across instances.
+func queryMemcacheKey(c context.Context, name string,
+	q *datastore.Query) string {
+
+	h := sha1.New()
+	writeQueryValue(h, reflect.ValueOf(q), 0)
+	return limitMemcacheKey(c, memcachePrefix+name+":"+
+		hex.EncodeToString(h.Sum(nil)))
+}
+
+// maxQueryValueDepth stops writeQueryValue recursing forever on cyclic
+// values.
+const maxQueryValueDepth = 16
+
+// writeQueryValue writes a stable representation of v to h. Unexported
+// fields are read using reflection as datastore.Query has no exported
+// representation.
+func writeQueryValue(h hash.Hash, v reflect.Value, depth int) {
+	if depth > maxQueryValueDepth {
+		return
+	}
+	switch v.Kind() {
+	case reflect.Invalid:
+		fmt.Fprint(h, "nil;")
+	case reflect.Ptr, reflect.Interface:
+		if v.IsNil() {
+			fmt.Fprint(h, "nil;")
+			return
+		}
+		writeQueryValue(h, v.Elem(), depth+1)
+	case reflect.Struct:
+		fmt.Fprintf(h, "%s{", v.Type())
+		for i := 0; i < v.NumField(); i++ {
+			fmt.Fprintf(h, "%s:", v.Type().Field(i).Name)
+			writeQueryValue(h, v.Field(i), depth+1)
+		}
+		fmt.Fprint(h, "};")
+	case reflect.Slice, reflect.Array:
+		fmt.Fprintf(h, "%s[", v.Type())
+		for i := 0; i < v.Len(); i++ {
+			writeQueryValue(h, v.Index(i), depth+1)
+		}
+		fmt.Fprint(h, "];")
+	case reflect.String:
+		fmt.Fprintf(h, "%q;", v.String())
+	case reflect.Bool:
+		fmt.Fprintf(h, "%t;", v.Bool())
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32,
+		reflect.Int64:
+		fmt.Fprintf(h, "%d;", v.Int())
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32,
+		reflect.Uint64, reflect.Uintptr:
+		fmt.Fprintf(h, "%d;", v.Uint())
+	case reflect.Float32, reflect.Float64:
+		fmt.Fprintf(h, "%g;", v.Float())
+	default:
+		fmt.Fprintf(h, "%s;", v.Kind())
+	}
+}
+
+// Count works just like q.Count except the result is cached in memcache for
+// ttl. Instances share the cached count as the cache key is derived from the
+// contents of the query.
+//
+// NDS cannot tell which counts a Put or Delete affects so cached counts are
+// never invalidated by writes. The ttl is the only thing that keeps a count
+// fresh, so it should be as short as the caller can tolerate stale counts for.
+func Count(c context.Context, q *datastore.Query,
+	ttl time.Duration) (int, error) {
+
+	if err := checkCacheKeyPrefix(c); err != nil {
+		return 0, err
+	}
+
+	memcacheKey := queryMemcacheKey(c, "count", q)
+	cache := cacheFromContext(c)
+
+	if items, err := cache.GetMulti(c, []string{memcacheKey}); err != nil {
+		warningf(c, "nds:Count GetMulti %s", err)
+	} else if item, ok := items[memcacheKey]; ok {
+		if count, err := strconv.Atoi(string(item.Value)); err == nil {
+			return count, nil
+		}
+	}
+
+	count, err := q.Count(c)
+	if err != nil {
+		return 0, err
+	}
+
+	item := &memcache.Item{
+		Key:        memcacheKey,
+		Value:      []byte(strconv.Itoa(count)),
+		Expiration: ttl,
+	}
+	if err := cache.SetMulti(c, []*memcache.Item{item}); err != nil {
+		warningf(c, "nds:Count SetMulti %s", err)
+	}
+	return count, nil
+}
+
+// GetAllCached works like q.GetAll except the keys of the results are cached
+// in memcache for ttl. The entities are then loaded into dst using GetMulti
+// so they are cached individually and are always consistent with writes made
+// through NDS. Only the list of keys can be stale, as writes cannot tell which
+// queries they affect, so use EvictQuery when it is known to have changed. If
+// an entity in a cached list no longer exists the list is evicted and the
+// query is run again.
+//
+// dst must be a pointer to a slice of any type GetMulti accepts, or nil to
+// only return the keys. Results are appended to dst. q must not be a
+// projection query as whole entities are always loaded, so projected fields
+// could not be cached or invalidated separately.
+func GetAllCached(c context.Context, q *datastore.Query, dst interface{},
+	ttl time.Duration) ([]*datastore.Key, error) {
+
+	if err := checkCacheKeyPrefix(c); err != nil {
+		return nil, err
+	}
+
+	memcacheKey := queryMemcacheKey(c, "keys", q)
+	keys, cached := loadQueryKeys(c, memcacheKey)
+	for {
+		if !cached {
+			var err error
+			if keys, err = q.KeysOnly().GetAll(c, nil); err != nil {
+				return nil, err
+			}
+			saveQueryKeys(c, memcacheKey, keys, ttl)
+		}
+
+		if dst == nil {
+			return keys, nil
+		}
+
+		err := appendEntities(c, keys, dst)
+		if cached && hasNoSuchEntity(err) {
+			cached = false
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		return keys, nil
+	}
+}
+
+// GetPageCached works like GetAllCached for one page of up to pageSize
+// results of q starting at cursor, or at the start of q if cursor is the zero
+// datastore.Cursor. The keys of the page are cached in memcache for ttl along
+// with the cursor after the page, so a cached feed can be paged through
+// without running q again. The entities are loaded into dst using GetMulti as
+// with GetAllCached, and a cached page with entities that no longer exist is
+// fetched again.
+//
+// The returned cursor starts the next page. A page with fewer than pageSize
+// keys is the last one. As with any datastore cursor, entities written while
+// paging can be skipped or returned twice, and more so here as each page is
+// cached separately for ttl. EvictQuery does not evict cached pages, they are
+// only refreshed by their ttl expiring.
+func GetPageCached(c context.Context, q *datastore.Query,
+	cursor datastore.Cursor, pageSize int, dst interface{},
+	ttl time.Duration) ([]*datastore.Key, datastore.Cursor, error) {
+
+	if pageSize <= 0 {
+		return nil, datastore.Cursor{},
+			errors.New("nds: pageSize must be positive")
+	}
+	if err := checkCacheKeyPrefix(c); err != nil {
+		return nil, datastore.Cursor{}, err
+	}
+
+	memcacheKey := pageMemcacheKey(c, q, cursor, pageSize)
+	keys, next, cached := loadQueryPage(c, memcacheKey)
+	for {
+		if !cached {
+			var err error
+			if keys, next, err = runQueryPage(c, q, cursor,
+				pageSize); err != nil {
+				return nil, datastore.Cursor{}, err
+			}
+			saveQueryPage(c, memcacheKey, keys, next, ttl)
+		}
+
+		if dst == nil {
+			return keys, next, nil
+		}
+
+		err := appendEntities(c, keys, dst)
+		if cached && hasNoSuchEntity(err) {
+			cached = false
+			continue
+		} else if err != nil {
+			return nil, datastore.Cursor{}, err
+		}
+		return keys, next, nil
+	}
+}
+
+// pageMemcacheKey returns the memcache key used to cache the page of q of
+// pageSize results starting at cursor.
+func pageMemcacheKey(c context.Context, q *datastore.Query,
+	cursor datastore.Cursor, pageSize int) string {
+
+	h := sha1.New()
+	writeQueryValue(h, reflect.ValueOf(q), 0)
+	fmt.Fprintf(h, "%q;%d;", cursor.String(), pageSize)
+	return cacheKeyPrefix(c) + memcachePrefix + "page:" +
+		hex.EncodeToString(h.Sum(nil))
+}
+
+// runQueryPage returns the keys of the page of q of up to pageSize results
+// starting at cursor and the cursor after them.
+func runQueryPage(c context.Context, q *datastore.Query,
+	cursor datastore.Cursor, pageSize int) ([]*datastore.Key,
+	datastore.Cursor, error) {
+
+	q = q.KeysOnly().Limit(pageSize)
+	if cursor.String() != "" {
+		q = q.Start(cursor)
+	}
+
+	keys := make([]*datastore.Key, 0, pageSize)
+	t := q.Run(c)
+	for {
+		key, err := t.Next(nil)
+		if err == datastore.Done {
+			break
+		} else if err != nil {
+			return nil, datastore.Cursor{}, err
+		}
+		keys = append(keys, key)
+	}
+	next, err := t.Cursor()
+	if err != nil {
+		return nil, datastore.Cursor{}, err
+	}
+	return keys, next, nil
+}
+
+// loadQueryPage returns the keys of a page cached by saveQueryPage and the
+// cursor after them. The cursor is held on the first line of the item.
+func loadQueryPage(c context.Context,
+	memcacheKey string) ([]*datastore.Key, datastore.Cursor, bool) {
+
+	items, err := cacheFromContext(c).GetMulti(c, []string{memcacheKey})
+	if err != nil {
+		warningf(c, "nds:GetPageCached GetMulti %s", err)
+		return nil, datastore.Cursor{}, false
+	}
+	item, ok := items[memcacheKey]
+	if !ok {
+		return nil, datastore.Cursor{}, false
+	}
+
+	parts := strings.SplitN(string(item.Value), "\n", 2)
+	if len(parts) != 2 {
+		warningf(c, "nds:GetPageCached invalid page %s", memcacheKey)
+		return nil, datastore.Cursor{}, false
+	}
+	var next datastore.Cursor
+	if parts[0] != "" {
+		if next, err = datastore.DecodeCursor(parts[0]); err != nil {
+			warningf(c, "nds:GetPageCached DecodeCursor %s", err)
+			return nil, datastore.Cursor{}, false
+		}
+	}
+	keys, err := decodeQueryKeys(c, parts[1])
+	if err != nil {
+		warningf(c, "nds:GetPageCached DecodeKey %s", err)
+		return nil, datastore.Cursor{}, false
+	}
+	return keys, next, true
+}
+
+func saveQueryPage(c context.Context, memcacheKey string,
+	keys []*datastore.Key, next datastore.Cursor, ttl time.Duration) {
+
+	item := &memcache.Item{
+		Key:        memcacheKey,
+		Value:      []byte(next.String() + "\n" + encodeQueryKeys(c, keys)),
+		Expiration: ttl,
+	}
+	if err := cacheFromContext(c).SetMulti(c,
+		[]*memcache.Item{item}); err != nil {
+		warningf(c, "nds:GetPageCached SetMulti %s", err)
+	}
+}
+
+// EvictQuery removes the key list cached for q by GetAllCached.
+func EvictQuery(c context.Context, q *datastore.Query) error {
+	if err := checkCacheKeyPrefix(c); err != nil {
+		return err
+	}
+
+	err := cacheFromContext(c).DeleteMulti(c,
+		[]string{queryMemcacheKey(c, "keys", q)})
+	if err != nil && !isCacheMissErrors(err) {
+		return err
+	}
+	return nil
+}
+
+func loadQueryKeys(c context.Context,
+	memcacheKey string) ([]*datastore.Key, bool) {
+
+	items, err := cacheFromContext(c).GetMulti(c, []string{memcacheKey})
+	if err != nil {
+		warningf(c, "nds:GetAllCached GetMulti %s", err)
+		return nil, false
+	}
+	item, ok := items[memcacheKey]
+	if !ok {
+		return nil, false
+	}
+
+	keys, err := decodeQueryKeys(c, string(item.Value))
+	if err != nil {
+		warningf(c, "nds:GetAllCached DecodeKey %s", err)
+		return nil, false
+	}
+	return keys, true
+}
+
+func saveQueryKeys(c context.Context, memcacheKey string,
+	keys []*datastore.Key, ttl time.Duration) {
+
+	item := &memcache.Item{
+		Key:        memcacheKey,
+		Value:      []byte(encodeQueryKeys(c, keys)),
+		Expiration: ttl,
+	}
+	if err := cacheFromContext(c).SetMulti(c,
+		[]*memcache.Item{item}); err != nil {
+		warningf(c, "nds:GetAllCached SetMulti %s", err)
+	}
+}
+
+// encodeQueryKeys returns keys as a newline separated list of keys encoded
+// with the key codec of c.
+func encodeQueryKeys(c context.Context, keys []*datastore.Key) string {
+	encoded := make([]string, len(keys))
+	for i, key := range keys {
+		encoded[i] = encodeCacheKey(c, key)
+	}
+	return strings.Join(encoded, "\n")
+}
+
+// decodeQueryKeys returns the keys of a list created by encodeQueryKeys.
+func decodeQueryKeys(c context.Context,
+	data string) ([]*datastore.Key, error) {
+
+	keys := []*datastore.Key{}
+	if len(data) == 0 {
+		return keys, nil
+	}
+	for _, encoded := range strings.Split(data, "\n") {
+		key, err := decodeCacheKey(c, encoded)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+// appendEntities gets the entities for keys and appends them to the slice
+// pointed to by dst.
+func appendEntities(c context.Context, keys []*datastore.Key,
+	dst interface{}) error {
+
+	dv := reflect.ValueOf(dst)
+	if dv.Kind() != reflect.Ptr || dv.IsNil() ||
+		dv.Elem().Kind() != reflect.Slice {
+		return errors.New("nds: dst must be a pointer to a slice")
+	}
+
+	sv := dv.Elem()
+	vals := reflect.MakeSlice(sv.Type(), len(keys), len(keys))
+	if err := GetMulti(c, keys, vals.Interface()); err != nil {
+		return err
+	}
+	sv.Set(reflect.AppendSlice(sv, vals))
+	return nil
+}
+
+func hasNoSuchEntity(err error) bool {
+	me, ok := err.(appengine.MultiError)
+	if !ok {
+		return false
+	}
+	for _, e := range me {
+		if e == datastore.ErrNoSuchEntity {
+			return true
+		}
+	}
+	return false
+}
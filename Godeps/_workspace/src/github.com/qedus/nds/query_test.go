@@ -0,0 +1,197 @@
+package nds_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/qedus/nds"
+	"google.golang.org/appengine/datastore"
+)
+
+func TestCount(t *testing.T) {
+	c, closeFunc := NewContext(t, nil)
+	defer closeFunc()
+
+	type testEntity struct {
+		IntVal int
+	}
+
+	parent := datastore.NewKey(c, "Parent", "", 1, nil)
+	keys := []*datastore.Key{
+		datastore.NewKey(c, "Entity", "", 1, parent),
+		datastore.NewKey(c, "Entity", "", 2, parent),
+	}
+	if _, err := nds.PutMulti(c, keys, []testEntity{{1}, {2}}); err != nil {
+		t.Fatal(err)
+	}
+
+	q := datastore.NewQuery("Entity").Ancestor(parent)
+	if count, err := nds.Count(c, q, time.Minute); err != nil {
+		t.Fatal(err)
+	} else if count != 2 {
+		t.Fatal("expected 2", count)
+	}
+
+	// The count is cached so it should not see the new entity.
+	key := datastore.NewKey(c, "Entity", "", 3, parent)
+	if _, err := nds.Put(c, key, &testEntity{3}); err != nil {
+		t.Fatal(err)
+	}
+
+	// An equivalent query built separately must share the cached count.
+	parent = datastore.NewKey(c, "Parent", "", 1, nil)
+	q = datastore.NewQuery("Entity").Ancestor(parent)
+	if count, err := nds.Count(c, q, time.Minute); err != nil {
+		t.Fatal(err)
+	} else if count != 2 {
+		t.Fatal("expected cached count of 2", count)
+	}
+
+	// A different query must not.
+	q = datastore.NewQuery("Entity").Ancestor(parent).Filter("IntVal >", 1)
+	if count, err := nds.Count(c, q, time.Minute); err != nil {
+		t.Fatal(err)
+	} else if count != 2 {
+		t.Fatal("expected 2", count)
+	}
+}
+
+func TestGetAllCached(t *testing.T) {
+	c, closeFunc := NewContext(t, nil)
+	defer closeFunc()
+
+	type testEntity struct {
+		Val int
+	}
+
+	parent := datastore.NewKey(c, "Parent", "", 1, nil)
+	keys := []*datastore.Key{
+		datastore.NewKey(c, "Entity", "", 1, parent),
+		datastore.NewKey(c, "Entity", "", 2, parent),
+	}
+	if _, err := nds.PutMulti(c, keys, []testEntity{{1}, {2}}); err != nil {
+		t.Fatal(err)
+	}
+
+	q := datastore.NewQuery("Entity").Ancestor(parent)
+	entities := []testEntity{}
+	gotKeys, err := nds.GetAllCached(c, q, &entities, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(gotKeys) != 2 || len(entities) != 2 || entities[1].Val != 2 {
+		t.Fatal("incorrect results", gotKeys, entities)
+	}
+
+	// Entities are always fresh but the list of keys is cached.
+	added := datastore.NewKey(c, "Entity", "", 3, parent)
+	if _, err := nds.Put(c, added, &testEntity{3}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := nds.Put(c, keys[0], &testEntity{10}); err != nil {
+		t.Fatal(err)
+	}
+	entities = []testEntity{}
+	if _, err := nds.GetAllCached(c, q, &entities, time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if len(entities) != 2 || entities[0].Val != 10 {
+		t.Fatal("expected cached key list", entities)
+	}
+
+	if err := nds.EvictQuery(c, q); err != nil {
+		t.Fatal(err)
+	}
+	if gotKeys, err = nds.GetAllCached(c, q, nil, time.Minute); err != nil {
+		t.Fatal(err)
+	} else if len(gotKeys) != 3 {
+		t.Fatal("expected evicted key list", gotKeys)
+	}
+
+	// A cached list with deleted entities is refreshed.
+	if err := nds.Delete(c, keys[1]); err != nil {
+		t.Fatal(err)
+	}
+	entities = []testEntity{}
+	if gotKeys, err = nds.GetAllCached(c, q, &entities,
+		time.Minute); err != nil {
+		t.Fatal(err)
+	} else if len(gotKeys) != 2 || len(entities) != 2 {
+		t.Fatal("expected refreshed key list", gotKeys, entities)
+	}
+}
+
+func TestGetPageCached(t *testing.T) {
+	c, closeFunc := NewContext(t, nil)
+	defer closeFunc()
+
+	type testEntity struct {
+		Val int
+	}
+
+	parent := datastore.NewKey(c, "Parent", "", 1, nil)
+	keys := []*datastore.Key{
+		datastore.NewKey(c, "Entity", "", 1, parent),
+		datastore.NewKey(c, "Entity", "", 2, parent),
+		datastore.NewKey(c, "Entity", "", 3, parent),
+	}
+	if _, err := nds.PutMulti(c, keys,
+		[]testEntity{{1}, {2}, {3}}); err != nil {
+		t.Fatal(err)
+	}
+
+	q := datastore.NewQuery("Entity").Ancestor(parent).Order("Val")
+	getPages := func() ([]testEntity, int) {
+		entities := []testEntity{}
+		cursor, pages := datastore.Cursor{}, 0
+		for {
+			pageKeys, next, err := nds.GetPageCached(c, q, cursor, 2,
+				&entities, time.Minute)
+			if err != nil {
+				t.Fatal(err)
+			}
+			pages++
+			if len(pageKeys) < 2 {
+				return entities, pages
+			}
+			cursor = next
+		}
+	}
+
+	entities, pages := getPages()
+	if pages != 2 || len(entities) != 3 || entities[2].Val != 3 {
+		t.Fatal("incorrect pages", pages, entities)
+	}
+
+	// Entities are always fresh but the pages of keys are cached.
+	added := datastore.NewKey(c, "Entity", "", 4, parent)
+	if _, err := nds.Put(c, added, &testEntity{4}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := nds.Put(c, keys[0], &testEntity{0}); err != nil {
+		t.Fatal(err)
+	}
+	entities, pages = getPages()
+	if pages != 2 || len(entities) != 3 || entities[0].Val != 0 {
+		t.Fatal("expected cached pages", pages, entities)
+	}
+
+	// A cached page with deleted entities is refreshed.
+	if err := nds.Delete(c, keys[0]); err != nil {
+		t.Fatal(err)
+	}
+	entities = []testEntity{}
+	pageKeys, _, err := nds.GetPageCached(c, q, datastore.Cursor{}, 2,
+		&entities, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pageKeys) != 2 || entities[0].Val != 2 || entities[1].Val != 3 {
+		t.Fatal("expected refreshed page", entities)
+	}
+
+	if _, _, err := nds.GetPageCached(c, q, datastore.Cursor{}, 0, nil,
+		time.Minute); err == nil {
+		t.Fatal("expected pageSize error")
+	}
+}
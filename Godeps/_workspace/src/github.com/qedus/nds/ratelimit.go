@@ -0,0 +1,74 @@
+package nds
+
+import "golang.org/x/net/context"
+
+// Limiter limits the rate of datastore reads made on cache misses. Wait must
+// block until a read is allowed, or return an error once c is done.
+// golang.org/x/time/rate.Limiter implements Limiter.
+type Limiter interface {
+	Wait(c context.Context) error
+}
+
+var fallbackRateLimitKey = "used for fallback rate limit"
+
+// WithFallbackRateLimit returns a context that makes GetMulti wait for
+// limiter before each call it makes to the datastore for entities that are not
+// cached. Locks in the cache make sure each missing entity is only read by one
+// request at a time, but after the cache is flushed every request misses; a
+// shared limiter caps the rate of datastore calls so such a cold start cannot
+// stampede the datastore. Each datastore call takes one token however many
+// entities it reads, and entities found in the cache take none. Reads within
+// a transaction are never limited. Calls made with WithNoCache always read the
+// datastore, so each of them takes a token.
+//
+// If limiter returns an error, such as when c reaches its deadline before a
+// token is available, GetMulti returns a *FallbackRateLimitError wrapping it
+// without reading the datastore.
+func WithFallbackRateLimit(c context.Context, limiter Limiter) context.Context {
+	return context.WithValue(c, &fallbackRateLimitKey, limiter)
+}
+
+// FallbackRateLimitError is returned by GetMulti when the Limiter set with
+// WithFallbackRateLimit does not allow it to read missing entities from the
+// datastore.
+type FallbackRateLimitError struct {
+	Err error
+}
+
+func (e *FallbackRateLimitError) Error() string {
+	return "nds: waiting for datastore fallback rate limit: " + e.Err.Error()
+}
+
+// Unwrap returns the error returned by the Limiter.
+func (e *FallbackRateLimitError) Unwrap() error {
+	return e.Err
+}
+
+// waitFallbackRateLimit waits for the fallback rate limiter of c, if any,
+// before cacheItems not found in the cache are read from the datastore.
+func waitFallbackRateLimit(c context.Context, cacheItems []cacheItem) error {
+	for _, cacheItem := range cacheItems {
+		switch cacheItem.state {
+		case miss, internalLock, externalLock:
+			return waitFallbackLimiter(c)
+		}
+	}
+	return nil
+}
+
+// waitFallbackLimiter waits for a token from the fallback rate limiter of c,
+// if any, before the datastore is read.
+func waitFallbackLimiter(c context.Context) error {
+	limiter, _ := c.Value(&fallbackRateLimitKey).(Limiter)
+	if limiter == nil {
+		return nil
+	}
+	if _, ok := transactionFromContext(c); ok {
+		return nil
+	}
+
+	if err := limiter.Wait(c); err != nil {
+		return &FallbackRateLimitError{Err: err}
+	}
+	return nil
+}
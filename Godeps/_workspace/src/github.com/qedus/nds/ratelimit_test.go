@@ -0,0 +1,75 @@
+package nds_test
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/qedus/nds"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/datastore"
+)
+
+// countingLimiter is a nds.Limiter that counts waits and returns err.
+type countingLimiter struct {
+	waits int
+	err   error
+}
+
+func (cl *countingLimiter) Wait(c context.Context) error {
+	cl.waits++
+	return cl.err
+}
+
+func TestWithFallbackRateLimit(t *testing.T) {
+	c, closeFunc := NewContext(t, nil)
+	defer closeFunc()
+
+	type testEntity struct {
+		Val int
+	}
+
+	keys := []*datastore.Key{
+		datastore.NewKey(c, "Entity", "", 1, nil),
+		datastore.NewKey(c, "Entity", "", 2, nil),
+	}
+	if _, err := nds.PutMulti(c, keys, []testEntity{{1}, {2}}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Denied reads return an error without reading the datastore.
+	limitErr := errors.New("no token")
+	cl := &countingLimiter{err: limitErr}
+	lc := nds.WithFallbackRateLimit(c, cl)
+	err := nds.GetMulti(lc, keys, make([]testEntity, 2))
+	if fe, ok := err.(*nds.FallbackRateLimitError); !ok || fe.Err != limitErr {
+		t.Fatal("expected rate limit error", err)
+	}
+
+	// One token is taken for both entities, and none once they are cached.
+	cl.err = nil
+	for i := 0; i < 2; i++ {
+		if err := nds.GetMulti(lc, keys, make([]testEntity, 2)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if cl.waits != 2 {
+		t.Fatal("expected two waits", cl.waits)
+	}
+
+	// Reads that skip the cache always take a token.
+	for i := 0; i < 2; i++ {
+		if err := nds.GetMulti(nds.WithNoCache(lc), keys,
+			make([]testEntity, 2)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if cl.waits != 4 {
+		t.Fatal("expected four waits", cl.waits)
+	}
+
+	cl.err = limitErr
+	err = nds.GetMulti(nds.WithNoCache(lc), keys, make([]testEntity, 2))
+	if fe, ok := err.(*nds.FallbackRateLimitError); !ok || fe.Err != limitErr {
+		t.Fatal("expected rate limit error", err)
+	}
+}
@@ -0,0 +1,130 @@
+package nds
+
+import (
+	"golang.org/x/net/context"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+)
+
+// GetMultiRaw works like GetMulti except that it returns each entity
+// serialized as NDS caches it rather than loading it into a struct. The bytes
+// are those MarshalEntity produces, so they can be passed on as they are and
+// later loaded with UnmarshalEntity. Cached entities are returned without
+// being decoded. Entities that are not cached are read through the cache as
+// GetMulti would and then serialized.
+//
+// The returned bool slice reports whether each entity exists. Missing
+// entities have nil bytes and, unlike GetMulti, do not cause an error. Other
+// errors are returned in a appengine.MultiError.
+func GetMultiRaw(c context.Context,
+	keys []*datastore.Key) ([][]byte, []bool, error) {
+
+	if err := checkCacheKeyPrefix(c); err != nil {
+		return nil, nil, err
+	}
+
+	if f, ok := keyMapperFromContext(c); ok {
+		physicalKeys, err := mapKeys(keys, f)
+		if err != nil {
+			return nil, nil, err
+		}
+		keys, c = physicalKeys, withoutKeyMapper(c)
+	}
+
+	data := make([][]byte, len(keys))
+	present := make([]bool, len(keys))
+	resolved := make([]bool, len(keys))
+
+	_, inTransaction := transactionFromContext(c)
+	if !inTransaction && !isNoCache(c) {
+		loadRawMemcache(c, keys, data, present, resolved)
+	}
+
+	missKeys := make([]*datastore.Key, 0, len(keys))
+	missIndexes := make([]int, 0, len(keys))
+	for i, key := range keys {
+		if !resolved[i] {
+			missKeys = append(missKeys, key)
+			missIndexes = append(missIndexes, i)
+		}
+	}
+	if len(missKeys) == 0 {
+		return data, present, nil
+	}
+
+	pls := make([]datastore.PropertyList, len(missKeys))
+	err := GetMulti(c, missKeys, pls)
+	me, ok := err.(appengine.MultiError)
+	if err != nil && !ok {
+		return nil, nil, err
+	}
+
+	errs, errsNil := make(appengine.MultiError, len(keys)), true
+	for i, index := range missIndexes {
+		if me != nil && me[i] != nil {
+			if me[i] != datastore.ErrNoSuchEntity {
+				errs[index] = me[i]
+				errsNil = false
+			}
+			continue
+		}
+		if data[index], err = codecFor(c, keys[index]).Marshal(
+			pls[i]); err != nil {
+			errs[index] = err
+			errsNil = false
+			continue
+		}
+		present[index] = true
+	}
+
+	if errsNil {
+		return data, present, nil
+	}
+	return data, present, errs
+}
+
+// loadRawMemcache fills data with the cached bytes of each entity in keys
+// that is cached, marking it resolved.
+func loadRawMemcache(c context.Context, keys []*datastore.Key,
+	data [][]byte, present, resolved []bool) {
+
+	memcacheKeys := make([]string, 0, len(keys))
+	for _, key := range keys {
+		if key != nil {
+			memcacheKeys = append(memcacheKeys, createMemcacheKey(c, key))
+		}
+	}
+
+	items, err := cacheFromContext(c).GetMulti(c, memcacheKeys)
+	if err != nil {
+		warningf(c, "nds:loadRawMemcache GetMulti %s", err)
+		return
+	}
+
+	for i, key := range keys {
+		if key == nil {
+			continue
+		}
+		item, ok := items[createMemcacheKey(c, key)]
+		if !ok {
+			continue
+		}
+
+		switch itemType(item.Flags) {
+		case noneItem:
+			resolved[i] = true
+		case entityItem:
+			value, err := entityItemData(c, item)
+			if isReplaceableItemError(err) {
+				continue
+			} else if err != nil {
+				warningf(c, "nds:loadRawMemcache decompress %s", err)
+				continue
+			}
+			data[i], present[i], resolved[i] = value, true, true
+		default:
+			continue
+		}
+		addStat(c, statMemcacheHits, 1)
+	}
+}
@@ -0,0 +1,49 @@
+package nds_test
+
+import (
+	"testing"
+
+	"github.com/qedus/nds"
+	"google.golang.org/appengine/datastore"
+)
+
+func TestGetMultiRaw(t *testing.T) {
+	c, closeFunc := NewContext(t, nil)
+	defer closeFunc()
+
+	type testEntity struct {
+		Val int
+	}
+
+	keys := []*datastore.Key{
+		datastore.NewKey(c, "Entity", "", 1, nil),
+		datastore.NewKey(c, "Entity", "", 2, nil),
+	}
+	if _, err := nds.Put(c, keys[0], &testEntity{1}); err != nil {
+		t.Fatal(err)
+	}
+
+	// The first call reads through to the datastore and the second is
+	// served from the cache.
+	for i := 0; i < 2; i++ {
+		cd := &countingDatastore{}
+		data, present, err := nds.GetMultiRaw(nds.WithDatastore(c, cd), keys)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !present[0] || present[1] || data[1] != nil {
+			t.Fatal("incorrect present", i, present)
+		}
+
+		te := &testEntity{}
+		if err := nds.UnmarshalEntity(c, data[0], te); err != nil {
+			t.Fatal(err)
+		} else if te.Val != 1 {
+			t.Fatal("incorrect val", i, te.Val)
+		}
+
+		if i == 1 && cd.gets != 0 {
+			t.Fatal("expected cached bytes", cd.gets)
+		}
+	}
+}
@@ -0,0 +1,72 @@
+package nds
+
+import (
+	"encoding/binary"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/memcache"
+)
+
+var readRepairKey = "used for read repair"
+
+// lockValueSize is the size of the values of the lock items NDS creates: four
+// random bytes followed by the time the lock was created, which previous
+// versions of NDS did not add.
+const lockValueSize = 12
+
+// WithReadRepair returns a context that makes GetMulti treat lock items older
+// than the lock time of the context, 32 seconds unless set with WithLockTime,
+// as abandoned by a request that died part way through a write or read. An
+// abandoned lock is replaced with the entity just read from the datastore,
+// using compare and swap so a lock that is renewed or replaced meanwhile is
+// left alone, rather than leaving the entity uncached until the lock expires.
+// This heals locks set with a long WithLockTime by writers that never
+// finished.
+//
+// Any write held up for longer than the lock time will have its lock treated
+// as abandoned, so the lock time should cover the longest write. Locks set by
+// previous versions of NDS, which do not record when they were created, are
+// never treated as abandoned. Read repair does nothing when reading with
+// WithEventualConsistency.
+func WithReadRepair(c context.Context) context.Context {
+	return context.WithValue(c, &readRepairKey, true)
+}
+
+func isReadRepair(c context.Context) bool {
+	repair, _ := c.Value(&readRepairKey).(bool)
+	return repair
+}
+
+// isAbandonedLock reports whether the lock item should be replaced by read
+// repair.
+func isAbandonedLock(c context.Context, item *memcache.Item) bool {
+	if !isReadRepair(c) || isEventualConsistency(c) {
+		return false
+	}
+	if len(item.Value) != lockValueSize {
+		return false
+	}
+	d, err := lockTime(c)
+	if err != nil {
+		return false
+	}
+	created := time.Unix(0, int64(binary.BigEndian.Uint64(item.Value[4:])))
+	return time.Since(created) > d
+}
+
+// restampLocks returns copies of the lock items with their creation times set
+// to now, so renewed locks are not mistaken for abandoned ones.
+func restampLocks(items []*memcache.Item) []*memcache.Item {
+	now := uint64(time.Now().UnixNano())
+	restamped := make([]*memcache.Item, len(items))
+	for i, item := range items {
+		cp := *item
+		if len(item.Value) == lockValueSize {
+			cp.Value = append([]byte(nil), item.Value...)
+			binary.BigEndian.PutUint64(cp.Value[4:], now)
+		}
+		restamped[i] = &cp
+	}
+	return restamped
+}
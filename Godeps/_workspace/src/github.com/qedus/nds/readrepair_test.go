@@ -0,0 +1,84 @@
+package nds_test
+
+import (
+	"encoding/binary"
+	"testing"
+	"time"
+
+	"github.com/qedus/nds"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/memcache"
+)
+
+// lockValue returns the value of a lock item created at created.
+func lockValue(created time.Time) []byte {
+	b := []byte{1, 2, 3, 4, 0, 0, 0, 0, 0, 0, 0, 0}
+	binary.BigEndian.PutUint64(b[4:], uint64(created.UnixNano()))
+	return b
+}
+
+func TestWithReadRepair(t *testing.T) {
+	c, closeFunc := NewContext(t, nil)
+	defer closeFunc()
+
+	type testEntity struct {
+		Val int
+	}
+
+	keys := []*datastore.Key{
+		datastore.NewKey(c, "Entity", "", 1, nil),
+		datastore.NewKey(c, "Entity", "", 2, nil),
+	}
+	if _, err := nds.PutMulti(c, keys,
+		[]testEntity{{1}, {2}}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Simulate a writer that died an hour ago and one still writing.
+	created := []time.Time{time.Now().Add(-time.Hour), time.Now()}
+	for i, key := range keys {
+		if err := memcache.Set(c, &memcache.Item{
+			Key:        nds.CreateMemcacheKey(key),
+			Flags:      nds.LockItem,
+			Value:      lockValue(created[i]),
+			Expiration: 24 * time.Hour,
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Without read repair both keys stay locked.
+	if err := nds.GetMulti(c, keys, make([]testEntity, 2)); err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range keys {
+		item, err := memcache.Get(c, nds.CreateMemcacheKey(key))
+		if err != nil {
+			t.Fatal(err)
+		} else if item.Flags != nds.LockItem {
+			t.Fatal("expected lock to remain", item.Flags)
+		}
+	}
+
+	entities := make([]testEntity, 2)
+	if err := nds.GetMulti(nds.WithReadRepair(c), keys,
+		entities); err != nil {
+		t.Fatal(err)
+	} else if entities[0].Val != 1 || entities[1].Val != 2 {
+		t.Fatal("incorrect vals", entities)
+	}
+
+	// Only the abandoned lock was replaced.
+	item, err := memcache.Get(c, nds.CreateMemcacheKey(keys[0]))
+	if err != nil {
+		t.Fatal(err)
+	} else if item.Flags == nds.LockItem {
+		t.Fatal("expected the abandoned lock to be repaired")
+	}
+	item, err = memcache.Get(c, nds.CreateMemcacheKey(keys[1]))
+	if err != nil {
+		t.Fatal(err)
+	} else if item.Flags != nds.LockItem {
+		t.Fatal("expected the recent lock to remain", item.Flags)
+	}
+}
@@ -0,0 +1,148 @@
+package nds
+
+import (
+	"errors"
+	"reflect"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/memcache"
+)
+
+// Reconcile brings the cache up to date with the datastore for keys whose
+// entities were written to the datastore without NDS, such as by another
+// service. Each entity is read again from the datastore and replaces whatever
+// is cached for it, including an entity cached as missing. Entities that no
+// longer exist are removed from the cache. Entities are also removed from the
+// local cache and process cache of c. Reconcile should be called once the out
+// of band writes have completed.
+//
+// Keys locked by an NDS write or read that is still in progress are locked
+// again for the full lock time instead of being read. This stops a read that
+// began before the out of band write from caching the old entity, without
+// caching an entity an NDS write is about to replace. The entity is cached
+// again by the next GetMulti once the lock expires.
+//
+// Keys are processed in batches of at most 500. If any keys fail to be read a
+// appengine.MultiError is returned with an error for each such key. Reconcile
+// cannot be used within a transaction.
+func Reconcile(c context.Context, keys []*datastore.Key) error {
+	if _, ok := transactionFromContext(c); ok {
+		return errors.New("nds: Reconcile cannot be used within a transaction")
+	}
+	if err := checkCacheKeyPrefix(c); err != nil {
+		return err
+	}
+	for _, key := range keys {
+		if key == nil || key.Incomplete() {
+			return datastore.ErrInvalidKey
+		}
+	}
+
+	size := batchSize(c, putMultiLimit)
+	return runBatches(c, len(keys), size, func(lo, hi int) error {
+		return reconcileMulti(c, keys[lo:hi])
+	})
+}
+
+func reconcileMulti(c context.Context, keys []*datastore.Key) error {
+	expiration, err := lockTime(c)
+	if err != nil {
+		return err
+	}
+
+	// Every replica of each entity is reconciled.
+	var replicaKeys []*datastore.Key
+	var memcacheKeys []string
+	keyIndexes := map[string]int{}
+	for i, key := range keys {
+		for _, memcacheKey := range writeMemcacheKeys(c, key) {
+			keyIndexes[memcacheKey] = i
+			replicaKeys = append(replicaKeys, key)
+			memcacheKeys = append(memcacheKeys, memcacheKey)
+		}
+	}
+	evictLocalCache(c, memcacheKeys)
+
+	items, err := cacheFromContext(c).GetMulti(c, memcacheKeys)
+	if err != nil {
+		return err
+	}
+
+	var relockItems []*memcache.Item
+	var deleteKeys []string
+	for _, memcacheKey := range memcacheKeys {
+		item, ok := items[memcacheKey]
+		switch {
+		case !ok:
+		case itemType(item.Flags) == lockItem:
+			relockItems = append(relockItems,
+				newLockItem(memcacheKey, expiration))
+		default:
+			deleteKeys = append(deleteKeys, memcacheKey)
+		}
+	}
+	if err := cacheFromContext(c).SetMulti(c, relockItems); err != nil {
+		return err
+	}
+	if err := cacheFromContext(c).DeleteMulti(c,
+		deleteKeys); err != nil && !isCacheMissErrors(err) {
+		return err
+	}
+
+	// The remaining keys are now read through as GetMulti would, skipping
+	// any that another request has started reading since.
+	vals := reflect.ValueOf(make([]datastore.PropertyList, len(replicaKeys)))
+	cacheItems := make([]cacheItem, len(replicaKeys))
+	for i, key := range replicaKeys {
+		cacheItems[i].key = key
+		cacheItems[i].memcacheKey = memcacheKeys[i]
+		cacheItems[i].val = vals.Index(i)
+		cacheItems[i].state = miss
+		if item, ok := items[memcacheKeys[i]]; ok &&
+			itemType(item.Flags) == lockItem {
+			cacheItems[i].state = done
+		}
+	}
+
+	lockMemcache(c, cacheItems, expiration)
+
+	for i, cacheItem := range cacheItems {
+		if cacheItem.state == externalLock {
+			cacheItems[i].state = done
+		}
+	}
+
+	if err := loadDatastore(c, cacheItems, vals.Type()); err != nil {
+		return err
+	}
+
+	// Entities that no longer exist are removed rather than cached as
+	// missing.
+	var missingKeys []string
+	for i, cacheItem := range cacheItems {
+		if cacheItem.state == internalLock &&
+			cacheItem.err == datastore.ErrNoSuchEntity {
+			missingKeys = append(missingKeys, cacheItem.memcacheKey)
+			cacheItems[i].state = done
+		}
+	}
+	saveMemcache(c, cacheItems)
+	if err := cacheFromContext(c).DeleteMulti(c,
+		missingKeys); err != nil && !isCacheMissErrors(err) {
+		warningf(c, "nds:Reconcile DeleteMulti %s", err)
+	}
+
+	me, errsNil := make(appengine.MultiError, len(keys)), true
+	for _, cacheItem := range cacheItems {
+		if cacheItem.err != nil && cacheItem.err != datastore.ErrNoSuchEntity {
+			me[keyIndexes[cacheItem.memcacheKey]] = cacheItem.err
+			errsNil = false
+		}
+	}
+	if errsNil {
+		return nil
+	}
+	return me
+}
@@ -0,0 +1,111 @@
+package nds_test
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/qedus/nds"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/memcache"
+)
+
+func TestReconcile(t *testing.T) {
+	c, closeFunc := NewContext(t, nil)
+	defer closeFunc()
+
+	type testEntity struct {
+		Val int
+	}
+
+	keys := []*datastore.Key{
+		datastore.NewKey(c, "Entity", "", 1, nil),
+		datastore.NewKey(c, "Entity", "", 2, nil),
+		datastore.NewKey(c, "Entity", "", 3, nil),
+	}
+	if _, err := nds.PutMulti(c, keys[:2],
+		[]testEntity{{1}, {2}}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Cache the entities, the third as missing.
+	nds.GetMulti(c, keys, make([]testEntity, len(keys)))
+
+	// Change every entity without NDS.
+	if _, err := datastore.Put(c, keys[0], &testEntity{10}); err != nil {
+		t.Fatal(err)
+	}
+	if err := datastore.Delete(c, keys[1]); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := datastore.Put(c, keys[2], &testEntity{30}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := nds.Reconcile(c, keys); err != nil {
+		t.Fatal(err)
+	}
+
+	// The deleted entity is no longer cached.
+	if _, err := memcache.Get(c,
+		nds.CreateMemcacheKey(keys[1])); err != memcache.ErrCacheMiss {
+		t.Fatal("expected memcache.ErrCacheMiss", err)
+	}
+
+	// The others are cached with their new values.
+	rc := &recordingCache{}
+	entities := make([]testEntity, 3)
+	if err := nds.GetMulti(nds.WithCache(c, rc), []*datastore.Key{
+		keys[0], keys[2]}, entities[:2]); err != nil {
+		t.Fatal(err)
+	}
+	if entities[0].Val != 10 || entities[1].Val != 30 {
+		t.Fatal("incorrect vals", entities)
+	}
+	if len(rc.addItems) != 0 {
+		t.Fatal("expected cache hits", rc.addItems)
+	}
+}
+
+func TestReconcileLocked(t *testing.T) {
+	c, closeFunc := NewContext(t, nil)
+	defer closeFunc()
+
+	type testEntity struct {
+		Val int
+	}
+
+	key := datastore.NewKey(c, "Entity", "", 1, nil)
+	if _, err := datastore.Put(c, key, &testEntity{1}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Lock the key as an in flight read or write would.
+	memcacheKey := nds.CreateMemcacheKey(key)
+	lock := []byte{1, 2, 3, 4}
+	if err := memcache.Set(c, &memcache.Item{
+		Key:   memcacheKey,
+		Flags: nds.LockItem,
+		Value: lock,
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := nds.Reconcile(c, []*datastore.Key{key}); err != nil {
+		t.Fatal(err)
+	}
+
+	// The key is locked again rather than cached.
+	item, err := memcache.Get(c, memcacheKey)
+	if err != nil {
+		t.Fatal(err)
+	} else if item.Flags != nds.LockItem {
+		t.Fatal("expected a lock item", item.Flags)
+	} else if bytes.Equal(item.Value, lock) {
+		t.Fatal("expected a new lock")
+	}
+
+	if err := nds.Reconcile(c,
+		[]*datastore.Key{nil}); err != datastore.ErrInvalidKey {
+		t.Fatal("expected datastore.ErrInvalidKey", err)
+	}
+}
@@ -0,0 +1,261 @@
+package nds
+
+import (
+	"fmt"
+	"reflect"
+	"sync"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+)
+
+var recorderKey = "used for *Recorder"
+
+// Operation is a GetMulti, PutMulti or DeleteMulti call captured by a
+// Recorder.
+type Operation struct {
+	// Op is "GetMulti", "PutMulti" or "DeleteMulti". Get, Put and Delete are
+	// captured as their multi equivalents.
+	Op string
+
+	// Keys are the keys the operation was called with.
+	Keys []*datastore.Key
+
+	// Sources are where GetMulti found the entity for each key, and are nil
+	// for other operations or if GetMulti failed as a whole.
+	Sources []Source
+
+	// Err is the error the operation returned.
+	Err error
+
+	// Entities are the entities PutMulti was called with. They are only
+	// captured if the Recorder's Entities field is set.
+	Entities []datastore.PropertyList
+}
+
+// Recorder captures the operations made through a context returned by
+// WithRecorder. It is safe for concurrent use.
+type Recorder struct {
+	// Entities makes PutMulti capture the entities it puts in addition to
+	// their keys. Entity payloads are left out by default to keep recording
+	// cheap and recordings free of user data.
+	Entities bool
+
+	// Capacity is the most operations kept, the oldest being dropped to make
+	// room for new ones. Zero or less keeps every operation, so long lived
+	// recorders should set it or be drained regularly. It must be set before
+	// the Recorder is used.
+	Capacity int
+
+	mu    sync.Mutex
+	ops   []Operation
+	start int
+}
+
+// Operations returns the operations captured so far, in the order they
+// returned.
+func (r *Recorder) Operations() []Operation {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.operations()
+}
+
+// Drain returns the operations captured so far, in the order they returned,
+// and removes them from r.
+func (r *Recorder) Drain() []Operation {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	ops := r.operations()
+	r.ops, r.start = nil, 0
+	return ops
+}
+
+func (r *Recorder) operations() []Operation {
+	ops := make([]Operation, 0, len(r.ops))
+	ops = append(ops, r.ops[r.start:]...)
+	return append(ops, r.ops[:r.start]...)
+}
+
+func (r *Recorder) record(op Operation) {
+	r.mu.Lock()
+	if r.Capacity > 0 && len(r.ops) >= r.Capacity {
+		r.ops[r.start] = op
+		r.start = (r.start + 1) % len(r.ops)
+	} else {
+		r.ops = append(r.ops, op)
+	}
+	r.mu.Unlock()
+}
+
+// WithRecorder returns a context that captures every GetMulti, PutMulti and
+// DeleteMulti call made through it in r, with its keys, where each entity
+// was got from and the error it returned. This is intended for debugging
+// caching behaviour, for example by replaying a production sequence against
+// a local cache and datastore with Replay.
+func WithRecorder(c context.Context, r *Recorder) context.Context {
+	return context.WithValue(c, &recorderKey, r)
+}
+
+func recorderFromContext(c context.Context) (*Recorder, bool) {
+	r, ok := c.Value(&recorderKey).(*Recorder)
+	return r, ok && r != nil
+}
+
+func withoutRecorder(c context.Context) context.Context {
+	return context.WithValue(c, &recorderKey, (*Recorder)(nil))
+}
+
+// recordGetMulti calls GetMulti without r and captures it.
+func recordGetMulti(c context.Context, r *Recorder, keys []*datastore.Key,
+	vals interface{}) error {
+
+	// Reuse the source recorder of GetMultiWithSource if it is the caller.
+	sr, ok := c.Value(&sourceKey).(*sourceRecorder)
+	if !ok {
+		sr = &sourceRecorder{hits: map[string]bool{}}
+		c = context.WithValue(c, &sourceKey, sr)
+	}
+	err := GetMulti(withoutRecorder(c), keys, vals)
+	sources, _ := sr.sources(c, keys, err)
+
+	r.record(Operation{
+		Op:      "GetMulti",
+		Keys:    copyKeys(keys),
+		Sources: sources,
+		Err:     err,
+	})
+	return err
+}
+
+// recordPutMulti calls PutMulti without r and captures it.
+func recordPutMulti(c context.Context, r *Recorder, keys []*datastore.Key,
+	vals interface{}) ([]*datastore.Key, error) {
+
+	var entities []datastore.PropertyList
+	if r.Entities {
+		entities = saveEntities(reflect.ValueOf(vals))
+	}
+
+	putKeys, err := PutMulti(withoutRecorder(c), keys, vals)
+	r.record(Operation{
+		Op:       "PutMulti",
+		Keys:     copyKeys(keys),
+		Err:      err,
+		Entities: entities,
+	})
+	return putKeys, err
+}
+
+// recordDeleteMulti calls del, which is DeleteMulti or the deleteMulti used by
+// Delete, without r and captures it.
+func recordDeleteMulti(c context.Context, r *Recorder, keys []*datastore.Key,
+	del func(context.Context, []*datastore.Key) error) error {
+
+	err := del(withoutRecorder(c), keys)
+	r.record(Operation{
+		Op:   "DeleteMulti",
+		Keys: copyKeys(keys),
+		Err:  err,
+	})
+	return err
+}
+
+// copyKeys copies keys so that callers reusing the slice do not alter a
+// recording.
+func copyKeys(keys []*datastore.Key) []*datastore.Key {
+	return append([]*datastore.Key(nil), keys...)
+}
+
+// saveEntities saves each element of vals as a property list. Elements that
+// cannot be saved are captured as nil.
+func saveEntities(vals reflect.Value) []datastore.PropertyList {
+	pls := make([]datastore.PropertyList, vals.Len())
+	for i := range pls {
+		val := vals.Index(i)
+		if val.Kind() == reflect.Interface {
+			val = val.Elem()
+		}
+		if !val.IsValid() || val.Kind() == reflect.Ptr && val.IsNil() {
+			continue
+		}
+		if val.Kind() == reflect.Ptr && val.Elem().Kind() == reflect.Struct {
+			val = val.Elem()
+		} else if val.Kind() != reflect.Ptr && !val.CanAddr() {
+			// saveValue may need to address values held in interfaces.
+			addressable := reflect.New(val.Type()).Elem()
+			addressable.Set(val)
+			val = addressable
+		}
+		if pl, err := saveValue(val); err == nil {
+			pls[i] = pl
+		}
+	}
+	return pls
+}
+
+// Replay makes the operations captured by r again through c, which is
+// usually set up with WithCache and WithDatastore to use local fakes. Entities
+// are put as they were captured, or as empty entities if r did not capture
+// them, and got into property lists. An error is returned for the first
+// operation whose error, or whose source for any key, differs from the one
+// captured. Errors are compared by their messages.
+func Replay(c context.Context, r *Recorder) error {
+	for i, op := range r.Operations() {
+		var sources []Source
+		var err error
+		switch op.Op {
+		case "GetMulti":
+			pls := make([]datastore.PropertyList, len(op.Keys))
+			sources, err = GetMultiWithSource(c, op.Keys, pls)
+		case "PutMulti":
+			pls := op.Entities
+			if pls == nil {
+				pls = make([]datastore.PropertyList, len(op.Keys))
+			}
+			_, err = PutMulti(c, op.Keys, pls)
+		case "DeleteMulti":
+			err = DeleteMulti(c, op.Keys)
+		default:
+			return fmt.Errorf("nds: replayed operation %d has unknown op %q",
+				i, op.Op)
+		}
+
+		if !sameError(op.Err, err) {
+			return fmt.Errorf("nds: replayed operation %d %s diverged with "+
+				"error %v, recorded %v", i, op.Op, err, op.Err)
+		}
+		if op.Sources != nil && !reflect.DeepEqual(op.Sources, sources) {
+			return fmt.Errorf("nds: replayed operation %d %s diverged with "+
+				"sources %v, recorded %v", i, op.Op, sources, op.Sources)
+		}
+	}
+	return nil
+}
+
+// sameError reports whether a and b are the same error or have the same
+// message, comparing each error of a appengine.MultiError.
+func sameError(a, b error) bool {
+	if a == b {
+		return true
+	} else if a == nil || b == nil {
+		return false
+	}
+
+	ame, aok := a.(appengine.MultiError)
+	bme, bok := b.(appengine.MultiError)
+	if aok != bok {
+		return false
+	} else if !aok {
+		return a.Error() == b.Error()
+	}
+	if len(ame) != len(bme) {
+		return false
+	}
+	for i := range ame {
+		if !sameError(ame[i], bme[i]) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,176 @@
+package nds_test
+
+import (
+	"testing"
+
+	"github.com/qedus/nds"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/memcache"
+)
+
+func TestWithRecorder(t *testing.T) {
+	c, closeFunc := NewContext(t, nil)
+	defer closeFunc()
+
+	type testEntity struct {
+		Val int
+	}
+
+	r := &nds.Recorder{}
+	rc := nds.WithRecorder(c, r)
+	key := datastore.NewKey(c, "Entity", "", 1, nil)
+
+	if _, err := nds.Put(rc, key, &testEntity{1}); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		if err := nds.Get(rc, key, &testEntity{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := nds.Delete(rc, key); err != nil {
+		t.Fatal(err)
+	}
+	if err := nds.Get(rc, key,
+		&testEntity{}); err != datastore.ErrNoSuchEntity {
+		t.Fatal("expected no such entity", err)
+	}
+
+	ops := r.Operations()
+	expected := []struct {
+		op     string
+		source nds.Source
+	}{
+		{"PutMulti", 0},
+		{"GetMulti", nds.DatastoreRead},
+		{"GetMulti", nds.CacheHit},
+		{"DeleteMulti", 0},
+		{"GetMulti", nds.Missing},
+	}
+	if len(ops) != len(expected) {
+		t.Fatal("incorrect operation count", len(ops))
+	}
+	for i, e := range expected {
+		op := ops[i]
+		if op.Op != e.op || len(op.Keys) != 1 || !op.Keys[0].Equal(key) {
+			t.Fatal("incorrect operation", i, op.Op, op.Keys)
+		}
+		if op.Entities != nil {
+			t.Fatal("expected no entities to be captured", i)
+		}
+		if op.Op == "GetMulti" && (len(op.Sources) != 1 ||
+			op.Sources[0] != e.source) {
+			t.Fatal("incorrect sources", i, op.Sources)
+		}
+	}
+	if ops[4].Err == nil {
+		t.Fatal("expected the missing entity error to be captured")
+	}
+
+	// The recording replays without diverging once the cache is cleared.
+	if err := memcache.Flush(c); err != nil {
+		t.Fatal(err)
+	}
+	if err := nds.Replay(c, r); err != nil {
+		t.Fatal(err)
+	}
+
+	// An entity that now exists makes a read of it diverge.
+	missing := &nds.Recorder{}
+	if err := nds.Get(nds.WithRecorder(c, missing), key,
+		&testEntity{}); err != datastore.ErrNoSuchEntity {
+		t.Fatal("expected no such entity", err)
+	}
+	if _, err := nds.Put(c, key, &testEntity{2}); err != nil {
+		t.Fatal(err)
+	}
+	if err := nds.Replay(c, missing); err == nil {
+		t.Fatal("expected replay to diverge")
+	}
+}
+
+func TestWithRecorderEntities(t *testing.T) {
+	c, closeFunc := NewContext(t, nil)
+	defer closeFunc()
+
+	type testEntity struct {
+		Val int
+	}
+
+	r := &nds.Recorder{Entities: true}
+	keys := []*datastore.Key{
+		datastore.NewKey(c, "Entity", "", 1, nil),
+		datastore.NewKey(c, "Entity", "", 2, nil),
+	}
+	if _, err := nds.PutMulti(nds.WithRecorder(c, r), keys,
+		[]interface{}{&testEntity{1}, &testEntity{2}}); err != nil {
+		t.Fatal(err)
+	}
+
+	ops := r.Operations()
+	if len(ops) != 1 || len(ops[0].Entities) != 2 {
+		t.Fatal("expected two captured entities", ops)
+	}
+	for i, pl := range ops[0].Entities {
+		if len(pl) != 1 || pl[0].Value != int64(i+1) {
+			t.Fatal("incorrect entity", i, pl)
+		}
+	}
+
+	// Replaying puts the captured entities.
+	if err := nds.DeleteMulti(c, keys); err != nil {
+		t.Fatal(err)
+	}
+	if err := nds.Replay(c, r); err != nil {
+		t.Fatal(err)
+	}
+	entities := make([]testEntity, len(keys))
+	if err := nds.GetMulti(c, keys, entities); err != nil {
+		t.Fatal(err)
+	}
+	for i, entity := range entities {
+		if entity.Val != i+1 {
+			t.Fatal("incorrect val", i, entity.Val)
+		}
+	}
+}
+
+func TestRecorderCapacity(t *testing.T) {
+	c, closeFunc := NewContext(t, nil)
+	defer closeFunc()
+
+	type testEntity struct {
+		Val int
+	}
+
+	r := &nds.Recorder{Capacity: 2}
+	rc := nds.WithRecorder(c, r)
+	keys := make([]*datastore.Key, 5)
+	for i := range keys {
+		keys[i] = datastore.NewKey(c, "Entity", "", int64(i+1), nil)
+		if _, err := nds.Put(rc, keys[i], &testEntity{i}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Only the newest operations are kept, oldest first.
+	ops := r.Operations()
+	if len(ops) != 2 || !ops[0].Keys[0].Equal(keys[3]) ||
+		!ops[1].Keys[0].Equal(keys[4]) {
+		t.Fatal("expected the two newest operations", ops)
+	}
+
+	if ops := r.Drain(); len(ops) != 2 || !ops[1].Keys[0].Equal(keys[4]) {
+		t.Fatal("expected drained operations", ops)
+	}
+	if ops := r.Operations(); len(ops) != 0 {
+		t.Fatal("expected no operations after drain", ops)
+	}
+
+	if err := nds.Delete(rc, keys[0]); err != nil {
+		t.Fatal(err)
+	}
+	if ops := r.Drain(); len(ops) != 1 || ops[0].Op != "DeleteMulti" {
+		t.Fatal("expected the delete to be recorded", ops)
+	}
+}
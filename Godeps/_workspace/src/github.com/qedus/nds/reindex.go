@@ -0,0 +1,160 @@
+package nds
+
+import (
+	"errors"
+	"reflect"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+)
+
+// Reindex puts every entity matching q again so the datastore rebuilds its
+// indexes, such as after changing which properties are indexed, and returns
+// the number of entities put. val is the struct pointer, or pointer to a
+// datastore.PropertyLoadSaver, the entities are loaded with; each entity is
+// loaded into a new value of its type and saved from it, so the current struct
+// tags apply. A nil val puts the stored properties back unchanged.
+//
+// Entities are read straight from the datastore, one page of up to the put
+// batch size at a time, following the query cursor. A limit set on q with Limit
+// is respected, so at most that many entities are put. Only entities whose
+// serialized form changes are locked and invalidated in the cache as PutMulti
+// does; the others are put as UpsertMulti does, leaving their cache entries in
+// place. An entity that fails to load into val stops Reindex with an error
+// rather than losing its unloaded properties. The entities put before an error
+// are still counted.
+//
+// Entities are read and put outside of any transaction, so a write made
+// between an entity being read and put is overwritten. Run Reindex while the
+// entities matching q are not being written.
+func Reindex(c context.Context, q *datastore.Query,
+	val interface{}) (int, error) {
+
+	var t reflect.Type
+	if val != nil {
+		if t = reflect.TypeOf(val); t.Kind() != reflect.Ptr {
+			return 0, errors.New("nds: val must be a pointer")
+		}
+	}
+
+	limit, limited := queryLimit(q)
+	size := batchSize(c, putMultiLimit)
+	q = q.KeysOnly()
+
+	reindexed, read := 0, 0
+	var cursor *datastore.Cursor
+	for {
+		if err := c.Err(); err != nil {
+			return reindexed, err
+		}
+		if limited && limit-read < size {
+			size = limit - read
+		}
+		if size <= 0 {
+			return reindexed, nil
+		}
+
+		pq := q.Limit(size)
+		if cursor != nil {
+			pq = pq.Start(*cursor)
+		}
+		keys := make([]*datastore.Key, 0, size)
+		it := pq.Run(c)
+		for {
+			key, err := it.Next(nil)
+			if err == datastore.Done {
+				break
+			} else if err != nil {
+				return reindexed, err
+			}
+			keys = append(keys, key)
+		}
+		if len(keys) == 0 {
+			return reindexed, nil
+		}
+		read += len(keys)
+
+		next, err := it.Cursor()
+		if err != nil {
+			return reindexed, err
+		}
+		n, err := reindexPage(c, keys, t)
+		reindexed += n
+		if err != nil {
+			return reindexed, err
+		}
+		if len(keys) < size {
+			return reindexed, nil
+		}
+		cursor = &next
+	}
+}
+
+// queryLimit returns the limit set on q with Limit, if any. Query does not
+// export it so it is read by reflection, as queryMemcacheKey reads the rest of
+// a query.
+func queryLimit(q *datastore.Query) (int, bool) {
+	f := reflect.ValueOf(q).Elem().FieldByName("limit")
+	if f.Kind() != reflect.Int32 {
+		return 0, false
+	}
+	limit := int(f.Int())
+	return limit, limit >= 0
+}
+
+// reindexPage puts the entities for keys again, loaded with t if it is not
+// nil, and returns the number put.
+func reindexPage(c context.Context, keys []*datastore.Key,
+	t reflect.Type) (int, error) {
+
+	pls := make([]datastore.PropertyList, len(keys))
+	err := getDatastore(c, keys, pls)
+	me, ok := err.(appengine.MultiError)
+	if err != nil && !ok {
+		return 0, err
+	}
+
+	var changedKeys, sameKeys []*datastore.Key
+	var changed, same []datastore.PropertyList
+	for i, key := range keys {
+		if me != nil && me[i] != nil {
+			if me[i] == datastore.ErrNoSuchEntity {
+				// Deleted since the query ran.
+				continue
+			}
+			return 0, me[i]
+		}
+
+		pl := pls[i]
+		if t != nil {
+			v := reflect.New(t.Elem())
+			if err := setValue(v, pl); err != nil {
+				return 0, err
+			}
+			if pl, err = saveValue(v); err != nil {
+				return 0, err
+			}
+		}
+
+		if ok, err := sameEntity(codecFor(c, key), pls[i], pl); err != nil {
+			return 0, err
+		} else if ok {
+			sameKeys, same = append(sameKeys, key), append(same, pl)
+		} else {
+			changedKeys, changed = append(changedKeys, key), append(changed, pl)
+		}
+	}
+
+	if len(sameKeys) > 0 {
+		if _, err := UpsertMulti(c, sameKeys, same); err != nil {
+			return 0, err
+		}
+	}
+	if len(changedKeys) > 0 {
+		if _, err := PutMulti(c, changedKeys, changed); err != nil {
+			return len(sameKeys), err
+		}
+	}
+	return len(sameKeys) + len(changedKeys), nil
+}
@@ -0,0 +1,89 @@
+package nds_test
+
+import (
+	"testing"
+
+	"github.com/qedus/nds"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/memcache"
+)
+
+func TestReindex(t *testing.T) {
+	c, closeFunc := NewContext(t, nil)
+	defer closeFunc()
+
+	type oldEntity struct {
+		Val  int
+		Note string
+	}
+	type newEntity struct {
+		Val  int
+		Note string `datastore:",noindex"`
+	}
+
+	parent := datastore.NewKey(c, "Parent", "", 1, nil)
+	keys := make([]*datastore.Key, 3)
+	entities := make([]oldEntity, len(keys))
+	for i := range keys {
+		keys[i] = datastore.NewKey(c, "Entity", "", int64(i+1), parent)
+		entities[i] = oldEntity{i, "note"}
+	}
+	if _, err := nds.PutMulti(c, keys, entities); err != nil {
+		t.Fatal(err)
+	}
+	if err := nds.GetMulti(c, keys, make([]oldEntity, len(keys))); err != nil {
+		t.Fatal(err)
+	}
+
+	isCached := func() bool {
+		for _, key := range keys {
+			if _, err := memcache.Get(c, nds.CreateMemcacheKey(key)); err != nil {
+				return false
+			}
+		}
+		return true
+	}
+
+	// Putting the same properties back leaves the cache alone.
+	bc := nds.WithMaxBatchSize(c, 2)
+	q := datastore.NewQuery("Entity").Ancestor(parent)
+	if n, err := nds.Reindex(bc, q, nil); err != nil {
+		t.Fatal(err)
+	} else if n != len(keys) {
+		t.Fatal("incorrect number reindexed", n)
+	}
+	if !isCached() {
+		t.Fatal("expected entities to stay cached")
+	}
+
+	// The limit of the query is respected across pages.
+	if n, err := nds.Reindex(nds.WithMaxBatchSize(c, 1), q.Limit(2),
+		nil); err != nil {
+		t.Fatal(err)
+	} else if n != 2 {
+		t.Fatal("incorrect number reindexed with limit", n)
+	}
+	if n, err := nds.Reindex(bc, q.Limit(1), nil); err != nil {
+		t.Fatal(err)
+	} else if n != 1 {
+		t.Fatal("incorrect number reindexed with limit", n)
+	}
+
+	// Changed index settings invalidate the cache.
+	if n, err := nds.Reindex(bc, q, &newEntity{}); err != nil {
+		t.Fatal(err)
+	} else if n != len(keys) {
+		t.Fatal("incorrect number reindexed", n)
+	}
+	if isCached() {
+		t.Fatal("expected entities to be invalidated")
+	}
+
+	// Note is no longer indexed.
+	if n, err := datastore.NewQuery("Entity").Ancestor(parent).
+		Filter("Note =", "note").Count(c); err != nil {
+		t.Fatal(err)
+	} else if n != 0 {
+		t.Fatal("expected note not to be indexed", n)
+	}
+}
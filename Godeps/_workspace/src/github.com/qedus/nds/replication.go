@@ -0,0 +1,81 @@
+package nds
+
+import (
+	"math/rand"
+	"strconv"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/datastore"
+)
+
+var keyReplicationKey = "used for key replication"
+
+// WithKeyReplication returns a context that caches every entity under n
+// replica cache keys, as WithKeyReplicationFunc does.
+func WithKeyReplication(c context.Context, n int) context.Context {
+	return WithKeyReplicationFunc(c, func(*datastore.Key) int {
+		return n
+	})
+}
+
+// WithKeyReplicationFunc returns a context that caches the entity for each
+// key under f(key) replica cache keys, which spreads the reads of extremely
+// hot entities across memcache servers. GetMulti reads a replica chosen at
+// random, filling it from the datastore as usual when it is missing, while
+// PutMulti and DeleteMulti lock and then clear every replica with the same
+// cache calls they would make for one. Counts of one or less, including when
+// f is nil, mean the entity is cached under its usual cache key only, which is
+// always the first replica.
+//
+// Each replica is filled separately, so after an entity is written up to
+// f(key) datastore reads are needed before every replica is cached again. No
+// replica returns the old entity once the write has locked them, but every
+// context that writes an entity must use the same replica count for it,
+// otherwise replicas a writer does not know about are never invalidated and
+// keep serving the old entity.
+func WithKeyReplicationFunc(c context.Context,
+	f func(*datastore.Key) int) context.Context {
+	return context.WithValue(c, &keyReplicationKey, f)
+}
+
+// replicaCount returns the number of replica cache keys for key.
+func replicaCount(c context.Context, key *datastore.Key) int {
+	f, _ := c.Value(&keyReplicationKey).(func(*datastore.Key) int)
+	if f == nil {
+		return 1
+	}
+	if n := f(key); n > 1 {
+		return n
+	}
+	return 1
+}
+
+// replicaMemcacheKey returns the memcache key of replica r of the entity for
+// key. Replica 0 is the memcache key of the entity.
+func replicaMemcacheKey(c context.Context, key *datastore.Key, r int) string {
+	if r == 0 {
+		return createMemcacheKey(c, key)
+	}
+	return createSuffixedMemcacheKey(c, key, "#"+strconv.Itoa(r))
+}
+
+// readMemcacheKey returns the memcache key of a random replica of the entity
+// for key, for reading it.
+func readMemcacheKey(c context.Context, key *datastore.Key) string {
+	n := replicaCount(c, key)
+	if n == 1 {
+		return createMemcacheKey(c, key)
+	}
+	return replicaMemcacheKey(c, key, rand.Intn(n))
+}
+
+// writeMemcacheKeys returns the memcache keys of every replica of the entity
+// for key, for locking or invalidating it.
+func writeMemcacheKeys(c context.Context, key *datastore.Key) []string {
+	n := replicaCount(c, key)
+	memcacheKeys := make([]string, n)
+	for r := range memcacheKeys {
+		memcacheKeys[r] = replicaMemcacheKey(c, key, r)
+	}
+	return memcacheKeys
+}
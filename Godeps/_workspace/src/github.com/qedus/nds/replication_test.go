@@ -0,0 +1,100 @@
+package nds_test
+
+import (
+	"testing"
+
+	"github.com/qedus/nds"
+	"google.golang.org/appengine/datastore"
+)
+
+func TestWithKeyReplication(t *testing.T) {
+	c, closeFunc := NewContext(t, nil)
+	defer closeFunc()
+
+	type testEntity struct {
+		Val int
+	}
+
+	rc := &recordingCache{}
+	rpc := nds.WithKeyReplication(nds.WithCache(c, rc), 3)
+
+	key := datastore.NewKey(c, "Entity", "", 1, nil)
+	if _, err := nds.Put(rpc, key, &testEntity{1}); err != nil {
+		t.Fatal(err)
+	}
+	if len(rc.setItems) != 3 || len(rc.delKeys) != 3 {
+		t.Fatal("expected every replica to be locked and cleared",
+			len(rc.setItems), len(rc.delKeys))
+	}
+	replicas := map[string]bool{}
+	for _, item := range rc.setItems {
+		replicas[item.Key] = true
+	}
+	if len(replicas) != 3 || !replicas[nds.CreateMemcacheKey(key)] {
+		t.Fatal("incorrect replicas", replicas)
+	}
+
+	// Reads are spread across the replicas.
+	rc.getKeys = nil
+	for i := 0; i < 30; i++ {
+		te := &testEntity{}
+		if err := nds.Get(rpc, key, te); err != nil {
+			t.Fatal(err)
+		} else if te.Val != 1 {
+			t.Fatal("incorrect val", te.Val)
+		}
+	}
+	read := map[string]bool{}
+	for _, memcacheKey := range rc.getKeys {
+		if !replicas[memcacheKey] {
+			t.Fatal("unexpected memcache key", memcacheKey)
+		}
+		read[memcacheKey] = true
+	}
+	if len(read) < 2 {
+		t.Fatal("expected reads to be spread across replicas", read)
+	}
+
+	// Writes invalidate every replica.
+	if _, err := nds.Put(rpc, key, &testEntity{2}); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 30; i++ {
+		te := &testEntity{}
+		if err := nds.Get(rpc, key, te); err != nil {
+			t.Fatal(err)
+		} else if te.Val != 2 {
+			t.Fatal("expected stale replica to be invalidated", te.Val)
+		}
+	}
+}
+
+func TestWithKeyReplicationFunc(t *testing.T) {
+	c, closeFunc := NewContext(t, nil)
+	defer closeFunc()
+
+	type testEntity struct {
+		Val int
+	}
+
+	rc := &recordingCache{}
+	rpc := nds.WithKeyReplicationFunc(nds.WithCache(c, rc),
+		func(key *datastore.Key) int {
+			if key.Kind() == "Hot" {
+				return 4
+			}
+			return 1
+		})
+
+	keys := []*datastore.Key{
+		datastore.NewKey(c, "Hot", "", 1, nil),
+		datastore.NewKey(c, "Entity", "", 1, nil),
+	}
+	if _, err := nds.PutMulti(rpc, keys,
+		[]testEntity{{1}, {2}}); err != nil {
+		t.Fatal(err)
+	}
+	if len(rc.setItems) != 5 {
+		t.Fatal("expected only the hot key to be replicated", len(rc.setItems))
+	}
+}
@@ -0,0 +1,83 @@
+package nds
+
+import (
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/memcache"
+)
+
+var retryKey = "used for retryOptions"
+
+type retryOptions struct {
+	attempts int
+	backoff  time.Duration
+}
+
+// WithRetry returns a context that makes PutMulti and DeleteMulti retry
+// datastore and memcache calls that fail with a transient error, such as a
+// timeout or a concurrent transaction error, up to attempts times in total.
+// The delay before the first retry is backoff and it doubles for each retry
+// after that. Errors caused by invalid arguments are never retried, nor are
+// PutMulti calls with incomplete keys, as a failed call may already have stored
+// entities under IDs it never returned.
+//
+// Retries are disabled inside transactions as the datastore retries the
+// whole transaction itself.
+func WithRetry(c context.Context, attempts int,
+	backoff time.Duration) context.Context {
+	return context.WithValue(c, &retryKey, retryOptions{attempts, backoff})
+}
+
+// retry calls f until it succeeds, it returns an error that is not
+// transient or the attempts configured with WithRetry are used up.
+func retry(c context.Context, f func() error) error {
+	opts, ok := c.Value(&retryKey).(retryOptions)
+	if !ok || opts.attempts <= 1 {
+		return f()
+	}
+	if _, ok := transactionFromContext(c); ok {
+		return f()
+	}
+
+	delay := opts.backoff
+	for attempt := 1; ; attempt++ {
+		err := f()
+		if err == nil || attempt >= opts.attempts || !isTransientError(err) {
+			return err
+		}
+
+		select {
+		case <-c.Done():
+			return err
+		case <-time.After(delay):
+		}
+		delay *= 2
+	}
+}
+
+// isTransientError reports whether err is likely to succeed if retried.
+// A appengine.MultiError is only transient if all of its errors are.
+func isTransientError(err error) bool {
+	if me, ok := err.(appengine.MultiError); ok {
+		transient := false
+		for _, e := range me {
+			if e == nil {
+				continue
+			}
+			if !isTransientError(e) {
+				return false
+			}
+			transient = true
+		}
+		return transient
+	}
+
+	switch err {
+	case datastore.ErrConcurrentTransaction, memcache.ErrServerError:
+		return true
+	}
+	return appengine.IsTimeoutError(err)
+}
@@ -0,0 +1,137 @@
+package nds_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/qedus/nds"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/memcache"
+)
+
+func TestWithRetry(t *testing.T) {
+	c, closeFunc := NewContext(t, nil)
+	defer closeFunc()
+
+	type testEntity struct {
+		IntVal int
+	}
+
+	putCalls, setCalls := 0, 0
+	nds.SetDatastorePutMulti(func(c context.Context,
+		keys []*datastore.Key, vals interface{}) ([]*datastore.Key, error) {
+		putCalls++
+		if putCalls < 3 {
+			return nil, datastore.ErrConcurrentTransaction
+		}
+		return datastore.PutMulti(c, keys, vals)
+	})
+	nds.SetMemcacheSetMulti(func(c context.Context,
+		items []*memcache.Item) error {
+		setCalls++
+		if setCalls < 2 {
+			return memcache.ErrServerError
+		}
+		return memcache.SetMulti(c, items)
+	})
+	defer func() {
+		nds.SetDatastorePutMulti(datastore.PutMulti)
+		nds.SetMemcacheSetMulti(memcache.SetMulti)
+	}()
+
+	rc := nds.WithRetry(c, 3, time.Millisecond)
+	key := datastore.NewKey(c, "Entity", "", 1, nil)
+	if _, err := nds.Put(rc, key, &testEntity{42}); err != nil {
+		t.Fatal(err)
+	}
+	if putCalls != 3 {
+		t.Fatal("expected 3 datastore calls", putCalls)
+	}
+	if setCalls != 2 {
+		t.Fatal("expected 2 memcache calls", setCalls)
+	}
+}
+
+func TestWithRetryNotTransient(t *testing.T) {
+	c, closeFunc := NewContext(t, nil)
+	defer closeFunc()
+
+	type testEntity struct {
+		IntVal int
+	}
+
+	putCalls := 0
+	nds.SetDatastorePutMulti(func(c context.Context,
+		keys []*datastore.Key, vals interface{}) ([]*datastore.Key, error) {
+		putCalls++
+		return nil, datastore.ErrInvalidKey
+	})
+	defer nds.SetDatastorePutMulti(datastore.PutMulti)
+
+	rc := nds.WithRetry(c, 3, time.Millisecond)
+	key := datastore.NewKey(c, "Entity", "", 1, nil)
+	if _, err := nds.Put(rc, key, &testEntity{42}); err != datastore.ErrInvalidKey {
+		t.Fatal("expected datastore.ErrInvalidKey", err)
+	}
+	if putCalls != 1 {
+		t.Fatal("expected 1 datastore call", putCalls)
+	}
+}
+
+func TestWithRetryIncompleteKey(t *testing.T) {
+	c, closeFunc := NewContext(t, nil)
+	defer closeFunc()
+
+	type testEntity struct {
+		IntVal int
+	}
+
+	putCalls := 0
+	nds.SetDatastorePutMulti(func(c context.Context,
+		keys []*datastore.Key, vals interface{}) ([]*datastore.Key, error) {
+		putCalls++
+		return nil, datastore.ErrConcurrentTransaction
+	})
+	defer nds.SetDatastorePutMulti(datastore.PutMulti)
+
+	rc := nds.WithRetry(c, 3, time.Millisecond)
+	key := datastore.NewIncompleteKey(c, "Entity", nil)
+	if _, err := nds.Put(rc, key,
+		&testEntity{42}); err != datastore.ErrConcurrentTransaction {
+		t.Fatal("expected datastore.ErrConcurrentTransaction", err)
+	}
+	if putCalls != 1 {
+		t.Fatal("expected 1 datastore call", putCalls)
+	}
+}
+
+func TestWithRetryTransaction(t *testing.T) {
+	c, closeFunc := NewContext(t, nil)
+	defer closeFunc()
+
+	type testEntity struct {
+		IntVal int
+	}
+
+	putCalls := 0
+	nds.SetDatastorePutMulti(func(c context.Context,
+		keys []*datastore.Key, vals interface{}) ([]*datastore.Key, error) {
+		putCalls++
+		return nil, datastore.ErrConcurrentTransaction
+	})
+	defer nds.SetDatastorePutMulti(datastore.PutMulti)
+
+	rc := nds.WithRetry(c, 3, time.Millisecond)
+	key := datastore.NewKey(c, "Entity", "", 1, nil)
+	err := nds.RunInTransaction(rc, func(tc context.Context) error {
+		_, err := nds.Put(tc, key, &testEntity{42})
+		return err
+	}, nil)
+	if err == nil {
+		t.Fatal("expected error")
+	}
+	if putCalls != 1 {
+		t.Fatal("expected 1 datastore call", putCalls)
+	}
+}
@@ -0,0 +1,126 @@
+package nds
+
+import (
+	"reflect"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/memcache"
+)
+
+var staleWhileRevalidateKey = "used for stale while revalidate"
+
+// WithStaleWhileRevalidate returns a context that makes GetMulti refresh
+// cached entities that will expire within window. The cached entity is still
+// returned straight away while it is read again from the datastore in the
+// background and written back to the cache with a fresh expiration, so hot
+// entities never expire and leave readers waiting for the datastore. Only one
+// request refreshes a given entity at a time, guarded by a lock item in the
+// cache, and a refresh is abandoned if the entity is put or deleted meanwhile.
+// Refreshes are added to any WaitGroup set with WithPrefetchGroup.
+//
+// Cached entities only expire when they are given a TTL with WithKindTTL, so
+// this has no effect on entities of other kinds. Entities cached without an
+// expiry time, such as by previous versions of NDS, are not refreshed.
+func WithStaleWhileRevalidate(c context.Context,
+	window time.Duration) context.Context {
+	return context.WithValue(c, &staleWhileRevalidateKey, window)
+}
+
+func revalidateWindow(c context.Context) (time.Duration, bool) {
+	window, _ := c.Value(&staleWhileRevalidateKey).(time.Duration)
+	return window, window > 0
+}
+
+// revalidateIfStale starts refreshing the entity for key, of struct type t or
+// nil if it is not a struct, in the background if the item it was read from
+// expires within the revalidation window of c.
+func revalidateIfStale(c context.Context, key *datastore.Key,
+	item *memcache.Item, t reflect.Type) {
+
+	window, ok := revalidateWindow(c)
+	if !ok || isCacheOnlyReads(c) {
+		return
+	}
+	header, _ := splitItemHeader(item)
+	if header.expiry.IsZero() || header.expiry.Sub(timeNow()) > window {
+		return
+	}
+
+	wg, _ := c.Value(&prefetchGroupKey).(*sync.WaitGroup)
+	if wg != nil {
+		wg.Add(1)
+	}
+	go func() {
+		defer func() {
+			if wg != nil {
+				wg.Done()
+			}
+			// As with Prefetch, give up if the request behind c has finished.
+			recover()
+		}()
+		revalidate(c, key, item, t)
+	}()
+}
+
+// revalidate reads the entity for key from the datastore and replaces item
+// with it, unless item has been modified since it was read.
+func revalidate(c context.Context, key *datastore.Key, item *memcache.Item,
+	t reflect.Type) {
+	expiration, err := lockTime(c)
+	if err != nil {
+		return
+	}
+
+	refreshKey := createSuffixedMemcacheKey(c, key, ":refresh")
+	if err := cacheFromContext(c).AddMulti(c, []*memcache.Item{
+		newLockItem(refreshKey, expiration),
+	}); err != nil {
+		// Another request is already refreshing the entity.
+		return
+	}
+	defer func() {
+		if err := cacheFromContext(c).DeleteMulti(c,
+			[]string{refreshKey}); err != nil && !isCacheMissErrors(err) {
+			warningf(c, "nds:revalidate DeleteMulti %s", err)
+		}
+	}()
+
+	pls := make([]datastore.PropertyList, 1)
+	sc, endSpan := startSpan(c, "datastore", "datastore.GetMulti", 1)
+	err = datastoreFromContext(c).GetMulti(sc, []*datastore.Key{key}, pls)
+	endSpan(err)
+	addStat(c, statDatastoreReads, 1)
+	err = singleError(err)
+
+	fresh := *item
+	switch err {
+	case nil:
+		fresh.Expiration = entityExpiration(c, key)
+		pl, partial := cacheablePropertyList(t, pls[0])
+		data, flags, err := encodeEntityItem(c, key, codecFor(c, key), pl)
+		if err != nil {
+			warningf(c, "nds:revalidate marshal %s", err)
+			return
+		}
+		flags |= partial
+		fresh.Value, fresh.Flags = newItemHeader(c, key,
+			fresh.Expiration).add(data, flags)
+		if len(fresh.Value) > maxItemSize(c) {
+			return
+		}
+	case datastore.ErrNoSuchEntity:
+		fresh.Flags, fresh.Value = noneItem, []byte{}
+		fresh.Expiration = negativeCacheExpiration(c)
+	default:
+		warningf(c, "nds:revalidate GetMulti %s", err)
+		return
+	}
+
+	if err := cacheFromContext(c).CompareAndSwapMulti(c,
+		[]*memcache.Item{&fresh}); err != nil {
+		debugf(c, "nds:revalidate CompareAndSwapMulti %s", err)
+	}
+}
@@ -0,0 +1,66 @@
+package nds_test
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/qedus/nds"
+	"google.golang.org/appengine/datastore"
+)
+
+func TestWithStaleWhileRevalidate(t *testing.T) {
+	c, closeFunc := NewContext(t, nil)
+	defer closeFunc()
+
+	type testEntity struct {
+		Val int
+	}
+
+	tc := nds.WithKindTTL(c, map[string]time.Duration{"Entity": time.Hour})
+
+	key := datastore.NewKey(c, "Entity", "", 1, nil)
+	if _, err := nds.Put(tc, key, &testEntity{1}); err != nil {
+		t.Fatal(err)
+	}
+	if err := nds.Get(tc, key, &testEntity{}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Change the entity behind the cache's back.
+	if _, err := datastore.Put(c, key, &testEntity{2}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Without revalidation the cached entity is used.
+	te := &testEntity{}
+	if err := nds.Get(tc, key, te); err != nil {
+		t.Fatal(err)
+	} else if te.Val != 1 {
+		t.Fatal("expected cached val", te.Val)
+	}
+
+	// The entity expires within the window so is refreshed, though the
+	// cached entity is still returned.
+	wg := &sync.WaitGroup{}
+	rc := nds.WithPrefetchGroup(nds.WithStaleWhileRevalidate(tc, 2*time.Hour),
+		wg)
+	te = &testEntity{}
+	if err := nds.Get(rc, key, te); err != nil {
+		t.Fatal(err)
+	} else if te.Val != 1 {
+		t.Fatal("expected cached val", te.Val)
+	}
+	wg.Wait()
+
+	cd := &countingDatastore{}
+	te = &testEntity{}
+	if err := nds.Get(nds.WithDatastore(tc, cd), key, te); err != nil {
+		t.Fatal(err)
+	} else if te.Val != 2 {
+		t.Fatal("expected refreshed val", te.Val)
+	}
+	if cd.gets != 0 {
+		t.Fatal("expected the refreshed entity to be cached", cd.gets)
+	}
+}
@@ -0,0 +1,109 @@
+package nds
+
+import (
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/datastore"
+)
+
+var rollbackEvictionKey = "used for rollback eviction"
+
+// WithRollbackEviction returns a context that makes RunInTransaction remove
+// the cached entities for every key got, put or deleted within a transaction
+// attempt that does not commit, whether f failed, the pre-commit hook
+// rejected it or the commit itself failed. Without it the cache locks of an
+// attempt are simply discarded as they were never set. Evicting the entities
+// as well guarantees that nothing a concurrent reader cached while the
+// transaction ran outlives it, at the cost of reading them from the datastore
+// again. Entities an attempt locked before failing to commit are left locked
+// instead, and attempts that are retried are evicted once the transaction
+// finishes.
+func WithRollbackEviction(c context.Context) context.Context {
+	return context.WithValue(c, &rollbackEvictionKey, true)
+}
+
+func isRollbackEviction(c context.Context) bool {
+	evict, _ := c.Value(&rollbackEvictionKey).(bool)
+	return evict
+}
+
+// addReadKeys records keys as got within the transaction, for evicting if it
+// rolls back.
+func (tx *transaction) addReadKeys(c context.Context, keys []*datastore.Key) {
+	if !isRollbackEviction(c) {
+		return
+	}
+	if tx.readMemcacheKeys == nil {
+		tx.readMemcacheKeys = map[string]bool{}
+	}
+	for _, key := range keys {
+		if key == nil || key.Incomplete() {
+			continue
+		}
+		for _, memcacheKey := range writeMemcacheKeys(c, key) {
+			tx.readMemcacheKeys[memcacheKey] = true
+		}
+	}
+}
+
+// touchedMemcacheKeys returns the memcache keys of the entities got, put or
+// deleted within the transaction. It must only be called once the transaction
+// function has returned, as tx can be left locked after that.
+func (tx *transaction) touchedMemcacheKeys() []string {
+	memcacheKeys := make([]string, 0,
+		len(tx.lockMemcacheKeys)+len(tx.deleteMemcacheKeys)+
+			len(tx.readMemcacheKeys))
+	for memcacheKey := range tx.lockMemcacheKeys {
+		memcacheKeys = append(memcacheKeys, memcacheKey)
+	}
+	memcacheKeys = append(memcacheKeys, tx.deleteMemcacheKeys...)
+	for memcacheKey := range tx.readMemcacheKeys {
+		memcacheKeys = append(memcacheKeys, memcacheKey)
+	}
+	return memcacheKeys
+}
+
+// evictRolledBack removes the cached entities touched by the transaction
+// attempts that did not commit, which is every attempt unless the last one
+// committed. Entities locked by any attempt are left locked as the lock
+// already hides them and may guard a commit that failed ambiguously.
+func evictRolledBack(c context.Context, attempts []*transaction,
+	committed bool) {
+
+	seen := map[string]bool{}
+	for _, tx := range attempts {
+		if tx.locksSet {
+			for memcacheKey := range tx.lockMemcacheKeys {
+				seen[memcacheKey] = true
+			}
+		}
+	}
+
+	rolledBack := attempts
+	if committed && len(rolledBack) > 0 {
+		rolledBack = rolledBack[:len(rolledBack)-1]
+	}
+	var memcacheKeys []string
+	for _, tx := range rolledBack {
+		for _, memcacheKey := range tx.touchedMemcacheKeys() {
+			if !seen[memcacheKey] {
+				seen[memcacheKey] = true
+				memcacheKeys = append(memcacheKeys, memcacheKey)
+			}
+		}
+	}
+	if len(memcacheKeys) == 0 {
+		return
+	}
+
+	evictLocalCache(c, memcacheKeys)
+	for lo := 0; lo < len(memcacheKeys); lo += deleteMultiLimit {
+		hi := lo + deleteMultiLimit
+		if hi > len(memcacheKeys) {
+			hi = len(memcacheKeys)
+		}
+		if err := cacheFromContext(c).DeleteMulti(c,
+			memcacheKeys[lo:hi]); err != nil && !isCacheMissErrors(err) {
+			warningf(c, "nds:evictRolledBack DeleteMulti %s", err)
+		}
+	}
+}
@@ -0,0 +1,83 @@
+package nds_test
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/qedus/nds"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/memcache"
+)
+
+func TestWithRollbackEviction(t *testing.T) {
+	c, closeFunc := NewContext(t, nil)
+	defer closeFunc()
+
+	type testEntity struct {
+		Val int
+	}
+
+	keys := []*datastore.Key{
+		datastore.NewKey(c, "Entity", "", 1, nil),
+		datastore.NewKey(c, "Entity", "", 2, nil),
+		datastore.NewKey(c, "Entity", "", 3, nil),
+	}
+	if _, err := nds.PutMulti(c, keys,
+		[]testEntity{{1}, {2}, {3}}); err != nil {
+		t.Fatal(err)
+	}
+
+	isCached := func(key *datastore.Key) bool {
+		_, err := memcache.Get(c, nds.CacheKey(c, key))
+		return err == nil
+	}
+	rollBack := func(c context.Context) {
+		if err := nds.GetMulti(c, keys, make([]testEntity, 3)); err != nil {
+			t.Fatal(err)
+		}
+		txErr := errors.New("roll back")
+		if err := nds.RunInTransaction(c, func(tc context.Context) error {
+			if err := nds.Get(tc, keys[0], &testEntity{}); err != nil {
+				return err
+			}
+			if _, err := nds.Put(tc, keys[1], &testEntity{4}); err != nil {
+				return err
+			}
+			return txErr
+		}, nil); err != txErr {
+			t.Fatal("expected transaction error", err)
+		}
+	}
+
+	// By default rolling back leaves the cache alone.
+	rollBack(c)
+	for _, key := range keys {
+		if !isCached(key) {
+			t.Fatal("expected entity to stay cached", key)
+		}
+	}
+
+	// Otherwise the touched entities are evicted.
+	rollBack(nds.WithRollbackEviction(c))
+	if isCached(keys[0]) || isCached(keys[1]) {
+		t.Fatal("expected touched entities to be evicted")
+	}
+	if !isCached(keys[2]) {
+		t.Fatal("expected untouched entity to stay cached")
+	}
+
+	// Entities written by a transaction that commits stay locked.
+	if err := nds.RunInTransaction(nds.WithRollbackEviction(c),
+		func(tc context.Context) error {
+			_, err := nds.Put(tc, keys[2], &testEntity{5})
+			return err
+		}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if item, err := memcache.Get(c, nds.CacheKey(c, keys[2])); err != nil {
+		t.Fatal(err)
+	} else if item.Flags != nds.LockItem {
+		t.Fatal("expected lock item", item.Flags)
+	}
+}
@@ -0,0 +1,76 @@
+package nds
+
+import (
+	"encoding/binary"
+	"errors"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/memcache"
+)
+
+var schemaVersionKey = "used for the schema version"
+
+// errSchemaMismatch is returned when decoding a cached entity stored under a
+// different schema version from the one selected with WithSchemaVersion.
+var errSchemaMismatch = errors.New("nds: cached entity has another schema version")
+
+// schemaHeaderSize is the size of the version header prepended to the value
+// of entity items carrying schemaFlag.
+const schemaHeaderSize = 4
+
+// WithSchemaVersion returns a context that tags the entities GetMulti caches
+// with schema version v. Cached entities tagged with any other version, or
+// cached without a version, are treated as cache misses and replaced with
+// the entity read from the datastore. Bumping v when the shape of an entity
+// changes therefore makes every read refresh stale cache entries, even those
+// that would still decode without error. Version 0 is the same as not setting
+// a version.
+func WithSchemaVersion(c context.Context, v int) context.Context {
+	return context.WithValue(c, &schemaVersionKey, uint32(v))
+}
+
+func schemaVersion(c context.Context) uint32 {
+	v, _ := c.Value(&schemaVersionKey).(uint32)
+	return v
+}
+
+// addSchemaHeader prepends the schema version of c to data, returning the
+// modifier flag to store with it.
+func addSchemaHeader(c context.Context, data []byte) ([]byte, uint32) {
+	v := schemaVersion(c)
+	if v == 0 {
+		return data, 0
+	}
+	header := make([]byte, schemaHeaderSize, schemaHeaderSize+len(data))
+	binary.BigEndian.PutUint32(header, v)
+	return append(header, data...), schemaFlag
+}
+
+// entityItemData returns the serialized entity held in the entity item,
+// removing its item header, verifying and removing its checksum, checking
+// and removing its schema version header and decompressing it.
+func entityItemData(c context.Context, item *memcache.Item) ([]byte, error) {
+	_, data := splitItemHeader(item)
+	if item.Flags&checksumFlag != 0 {
+		var err error
+		if data, err = verifyChecksum(data); err != nil {
+			return nil, err
+		}
+	}
+
+	var v uint32
+	if item.Flags&schemaFlag != 0 {
+		if len(data) < schemaHeaderSize {
+			return nil, errSchemaMismatch
+		}
+		v, data = binary.BigEndian.Uint32(data), data[schemaHeaderSize:]
+	}
+	if v != schemaVersion(c) {
+		return nil, errSchemaMismatch
+	}
+
+	if item.Flags&compressedFlag != 0 {
+		return decompress(data)
+	}
+	return data, nil
+}
@@ -0,0 +1,56 @@
+package nds_test
+
+import (
+	"testing"
+
+	"github.com/qedus/nds"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/datastore"
+)
+
+func TestWithSchemaVersion(t *testing.T) {
+	c, closeFunc := NewContext(t, nil)
+	defer closeFunc()
+
+	type testEntity struct {
+		Val int
+	}
+
+	key := datastore.NewKey(c, "Entity", "", 1, nil)
+	if _, err := nds.Put(c, key, &testEntity{1}); err != nil {
+		t.Fatal(err)
+	}
+
+	get := func(c context.Context, expected int) {
+		te := &testEntity{}
+		if err := nds.Get(c, key, te); err != nil {
+			t.Fatal(err)
+		} else if te.Val != expected {
+			t.Fatal("incorrect val", te.Val, expected)
+		}
+	}
+
+	v1 := nds.WithSchemaVersion(c, 1)
+	get(v1, 1)
+
+	// Change the entity behind the cache's back.
+	if _, err := datastore.Put(c, key, &testEntity{2}); err != nil {
+		t.Fatal(err)
+	}
+	get(v1, 1)
+
+	// Entries cached under another version are refreshed.
+	get(c, 2)
+	if _, err := datastore.Put(c, key, &testEntity{3}); err != nil {
+		t.Fatal(err)
+	}
+	get(c, 2)
+
+	v2 := nds.WithSchemaVersion(c, 2)
+	get(v2, 3)
+	if _, err := datastore.Put(c, key, &testEntity{4}); err != nil {
+		t.Fatal(err)
+	}
+	get(v2, 3)
+	get(v1, 4)
+}
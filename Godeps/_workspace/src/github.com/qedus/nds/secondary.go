@@ -0,0 +1,99 @@
+package nds
+
+import (
+	"reflect"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+)
+
+var secondaryDatastoreKey = "used for secondary DatastoreClient"
+
+// WithSecondaryDatastore returns a context that makes GetMulti read the
+// entities that are missing from the primary datastore, the one set with
+// WithDatastore or App Engine datastore by default, from fallback instead.
+// Entities found in fallback are cached just like those read from the primary
+// datastore. Puts, deletes and transactions only ever use the primary
+// datastore and within a transaction fallback is not consulted.
+//
+// This is intended as a temporary aid while migrating entities from fallback
+// to the primary datastore. Entities cached from fallback are not invalidated
+// by writes made directly to fallback, and an entity deleted from the primary
+// datastore is read from fallback again if it is still there.
+func WithSecondaryDatastore(c context.Context,
+	fallback DatastoreClient) context.Context {
+	return context.WithValue(c, &secondaryDatastoreKey, fallback)
+}
+
+func secondaryDatastoreFromContext(c context.Context) (DatastoreClient, bool) {
+	fallback, ok := c.Value(&secondaryDatastoreKey).(DatastoreClient)
+	if !ok || fallback == nil {
+		return nil, false
+	}
+	_, inTx := transactionFromContext(c)
+	return fallback, !inTx
+}
+
+// getSecondary reads the entities the primary datastore reported missing in
+// err from the secondary datastore of c, if it has one, and returns the
+// errors that remain. If the secondary datastore fails entirely its error is
+// returned so the missing entities are not cached as missing.
+func getSecondary(c context.Context, keys []*datastore.Key, vals interface{},
+	err error) error {
+
+	fallback, ok := secondaryDatastoreFromContext(c)
+	if !ok {
+		return err
+	}
+	me, ok := err.(appengine.MultiError)
+	if !ok {
+		return err
+	}
+
+	v := reflect.ValueOf(vals)
+	var missingKeys []*datastore.Key
+	var missingIndexes []int
+	for i, e := range me {
+		if e == datastore.ErrNoSuchEntity {
+			missingKeys = append(missingKeys, keys[i])
+			missingIndexes = append(missingIndexes, i)
+		}
+	}
+	if len(missingKeys) == 0 {
+		return err
+	}
+
+	missingVals := reflect.MakeSlice(v.Type(), len(missingKeys),
+		len(missingKeys))
+	for j, i := range missingIndexes {
+		missingVals.Index(j).Set(v.Index(i))
+	}
+
+	sc, endSpan := startSpan(c, "datastore", "secondary.GetMulti",
+		len(missingKeys))
+	fallbackErr := fallback.GetMulti(sc, missingKeys, missingVals.Interface())
+	endSpan(fallbackErr)
+	addStat(c, statDatastoreReads, len(missingKeys))
+	fallbackErr = checkMultiError(fallbackErr, len(missingKeys))
+	fme, ok := fallbackErr.(appengine.MultiError)
+	if fallbackErr != nil && !ok {
+		return fallbackErr
+	}
+
+	for j, i := range missingIndexes {
+		v.Index(i).Set(missingVals.Index(j))
+		if fme == nil {
+			me[i] = nil
+		} else {
+			me[i] = fme[j]
+		}
+	}
+
+	for _, e := range me {
+		if e != nil {
+			return me
+		}
+	}
+	return nil
+}
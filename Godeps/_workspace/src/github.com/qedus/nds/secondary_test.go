@@ -0,0 +1,143 @@
+package nds_test
+
+import (
+	"testing"
+
+	"github.com/qedus/nds"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+)
+
+// namespacedDatastore reads and writes the root entities of its keys within
+// namespace, as a stand in for a separate datastore.
+type namespacedDatastore struct {
+	namespace string
+	gets      int
+}
+
+func (nd *namespacedDatastore) keys(c context.Context,
+	keys []*datastore.Key) ([]*datastore.Key, error) {
+
+	nc, err := appengine.Namespace(c, nd.namespace)
+	if err != nil {
+		return nil, err
+	}
+	nsKeys := make([]*datastore.Key, len(keys))
+	for i, key := range keys {
+		nsKeys[i] = datastore.NewKey(nc, key.Kind(), key.StringID(),
+			key.IntID(), nil)
+	}
+	return nsKeys, nil
+}
+
+func (nd *namespacedDatastore) DeleteMulti(c context.Context,
+	keys []*datastore.Key) error {
+	nsKeys, err := nd.keys(c, keys)
+	if err != nil {
+		return err
+	}
+	return datastore.DeleteMulti(c, nsKeys)
+}
+
+func (nd *namespacedDatastore) GetMulti(c context.Context,
+	keys []*datastore.Key, vals interface{}) error {
+	nd.gets++
+	nsKeys, err := nd.keys(c, keys)
+	if err != nil {
+		return err
+	}
+	return datastore.GetMulti(c, nsKeys, vals)
+}
+
+func (nd *namespacedDatastore) PutMulti(c context.Context,
+	keys []*datastore.Key, vals interface{}) ([]*datastore.Key, error) {
+	nsKeys, err := nd.keys(c, keys)
+	if err != nil {
+		return nil, err
+	}
+	return datastore.PutMulti(c, nsKeys, vals)
+}
+
+func (nd *namespacedDatastore) RunInTransaction(c context.Context,
+	f func(tc context.Context) error,
+	opts *datastore.TransactionOptions) error {
+	return datastore.RunInTransaction(c, f, opts)
+}
+
+func TestWithSecondaryDatastore(t *testing.T) {
+	c, closeFunc := NewContext(t, nil)
+	defer closeFunc()
+
+	type testEntity struct {
+		Val int
+	}
+
+	keys := []*datastore.Key{
+		datastore.NewKey(c, "Entity", "", 1, nil),
+		datastore.NewKey(c, "Entity", "", 2, nil),
+		datastore.NewKey(c, "Entity", "", 3, nil),
+	}
+	fallback := &namespacedDatastore{namespace: "fallback"}
+
+	// The first entity is in both datastores, the second only in fallback.
+	if _, err := nds.Put(c, keys[0], &testEntity{1}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fallback.PutMulti(c, keys[:2],
+		[]testEntity{{10}, {20}}); err != nil {
+		t.Fatal(err)
+	}
+
+	sc := nds.WithSecondaryDatastore(c, fallback)
+	entities := make([]testEntity, len(keys))
+	err := nds.GetMulti(sc, keys, entities)
+	if me, ok := err.(appengine.MultiError); !ok {
+		t.Fatal("expected appengine.MultiError", err)
+	} else if me[0] != nil || me[1] != nil {
+		t.Fatal(me)
+	} else if me[2] != datastore.ErrNoSuchEntity {
+		t.Fatal("expected datastore.ErrNoSuchEntity", me[2])
+	}
+	if entities[0].Val != 1 || entities[1].Val != 20 {
+		t.Fatal("incorrect vals", entities)
+	}
+	if fallback.gets != 1 {
+		t.Fatal("expected one fallback get", fallback.gets)
+	}
+
+	// The entity read from fallback is now cached.
+	entity := &testEntity{}
+	if err := nds.Get(sc, keys[1], entity); err != nil {
+		t.Fatal(err)
+	} else if entity.Val != 20 {
+		t.Fatal("incorrect val", entity.Val)
+	} else if fallback.gets != 1 {
+		t.Fatal("expected the entity to be cached", fallback.gets)
+	}
+
+	// Writes only go to the primary datastore.
+	if _, err := nds.Put(sc, keys[1], &testEntity{2}); err != nil {
+		t.Fatal(err)
+	}
+	fallbackEntities := make([]testEntity, 1)
+	if err := fallback.GetMulti(c, keys[1:2], fallbackEntities); err != nil {
+		t.Fatal(err)
+	} else if fallbackEntities[0].Val != 20 {
+		t.Fatal("expected fallback to be unchanged", fallbackEntities[0].Val)
+	}
+	if err := datastore.Get(c, keys[1], entity); err != nil {
+		t.Fatal(err)
+	} else if entity.Val != 2 {
+		t.Fatal("incorrect val", entity.Val)
+	}
+
+	// Fallback is also read when the cache is skipped.
+	if err := nds.Get(nds.WithNoCache(sc), keys[2],
+		&testEntity{}); err != datastore.ErrNoSuchEntity {
+		t.Fatal("expected datastore.ErrNoSuchEntity", err)
+	}
+	if fallback.gets != 3 {
+		t.Fatal("expected a fallback get", fallback.gets)
+	}
+}
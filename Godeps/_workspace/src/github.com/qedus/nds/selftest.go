@@ -0,0 +1,167 @@
+package nds
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math/rand"
+	"strconv"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/memcache"
+)
+
+// selfTestKind is the kind of the entity SelfTest caches.
+const selfTestKind = "NDSSelfTest"
+
+// selfTestFlag is set on the entity SelfTest caches to check that every flag
+// bit is kept. NDS never sets it on items it reads.
+const selfTestFlag uint32 = 1 << 31
+
+// SelfTest checks that the cache of c, usually one set with WithCache,
+// round trips items the way NDS relies on. It caches a known entity,
+// including bytes that are not valid text, under a cache key of its own and
+// checks that it is returned intact with every bit of its flags and that its
+// expiration is treated as relative. It then exercises the locking NDS uses
+// when reading entities through: adding a lock item, replacing it using CAS
+// and rejecting a stale CAS. The first discrepancy is returned as an error.
+// Its cache key is deleted once done and never clashes with an entity's.
+//
+// This is intended to be run as a startup health check so a misconfigured
+// cache backend is caught before it serves or stores corrupt entities.
+func SelfTest(c context.Context) error {
+	if err := checkCacheKeyPrefix(c); err != nil {
+		return err
+	}
+
+	memcacheKey := limitMemcacheKey(c, memcachePrefix+"selftest:"+
+		strconv.FormatInt(rand.Int63(), 36))
+	cache := cacheFromContext(c)
+	defer func() {
+		if err := cache.DeleteMulti(c, []string{memcacheKey}); err != nil &&
+			!isCacheMissErrors(err) {
+			warningf(c, "nds:SelfTest DeleteMulti %s", err)
+		}
+	}()
+
+	key := datastore.NewKey(c, selfTestKind, "", 1, nil)
+	pl := datastore.PropertyList{
+		{Name: "Bytes", Value: []byte{0, 1, '\n', '\r', 0x7f, 0x80, 0xff},
+			NoIndex: true},
+		{Name: "Int", Value: int64(-1)},
+		{Name: "String", Value: "nds é世 self test"},
+	}
+	data, flags, err := encodeEntityItem(c, key, codecFor(c, key), pl)
+	if err != nil {
+		return err
+	}
+	data, flags = newItemHeader(c, key, 0).add(data, flags)
+
+	// A minute is short enough to be taken as an absolute Unix time by a
+	// cache that does not treat expirations as relative.
+	entity := &memcache.Item{
+		Key:        memcacheKey,
+		Flags:      flags | selfTestFlag,
+		Value:      data,
+		Expiration: time.Minute,
+	}
+	if err := cache.SetMulti(c, []*memcache.Item{entity}); err != nil {
+		return fmt.Errorf("nds: self test SetMulti %s", err)
+	}
+	item, err := selfTestGet(c, cache, memcacheKey)
+	if err != nil {
+		return err
+	} else if item == nil {
+		return errors.New("nds: self test item missing after SetMulti, " +
+			"its expiration may have been treated as absolute")
+	} else if item.Flags != entity.Flags {
+		return fmt.Errorf("nds: self test flags %#x returned as %#x",
+			entity.Flags, item.Flags)
+	} else if !bytes.Equal(item.Value, entity.Value) {
+		return fmt.Errorf("nds: self test value of %d bytes returned "+
+			"altered as %d bytes", len(entity.Value), len(item.Value))
+	}
+	item.Flags &^= selfTestFlag
+	got, err := decodeEntityItem(c, key, codecFor(c, key), item)
+	if err != nil {
+		return fmt.Errorf("nds: self test decode %s", err)
+	} else if same, err := sameEntity(codecFor(c, key), pl, got); err != nil {
+		return err
+	} else if !same {
+		return errors.New("nds: self test entity returned altered")
+	}
+
+	// AddMulti must not replace items that are present.
+	if err := cache.AddMulti(c, []*memcache.Item{
+		newLockItem(memcacheKey, time.Minute),
+	}); err == nil {
+		return errors.New("nds: self test AddMulti replaced a present item")
+	} else if !isNotStoredErrors(err) {
+		return fmt.Errorf("nds: self test AddMulti %s", err)
+	}
+
+	return selfTestLock(c, cache, memcacheKey, entity)
+}
+
+// selfTestLock locks memcacheKey, after removing its item, and then replaces
+// the lock with entity as GetMulti does when it reads an entity through.
+func selfTestLock(c context.Context, cache Cache, memcacheKey string,
+	entity *memcache.Item) error {
+
+	if err := cache.DeleteMulti(c, []string{memcacheKey}); err != nil {
+		return fmt.Errorf("nds: self test DeleteMulti %s", err)
+	}
+	if item, err := selfTestGet(c, cache, memcacheKey); err != nil {
+		return err
+	} else if item != nil {
+		return errors.New("nds: self test item present after DeleteMulti")
+	}
+
+	lock := newLockItem(memcacheKey, time.Minute)
+	if err := cache.AddMulti(c, []*memcache.Item{lock}); err != nil {
+		return fmt.Errorf("nds: self test AddMulti %s", err)
+	}
+	locked, err := selfTestGet(c, cache, memcacheKey)
+	if err != nil {
+		return err
+	} else if locked == nil || locked.Flags != lockItem ||
+		!bytes.Equal(locked.Value, lock.Value) {
+		return errors.New("nds: self test lock item not returned intact")
+	}
+
+	// A stale CAS must fail once the lock has been replaced.
+	stale := *locked
+	locked.Flags, locked.Value = entity.Flags, entity.Value
+	if err := cache.CompareAndSwapMulti(c,
+		[]*memcache.Item{locked}); err != nil {
+		return fmt.Errorf("nds: self test CompareAndSwapMulti %s", err)
+	}
+	if err := cache.CompareAndSwapMulti(c,
+		[]*memcache.Item{&stale}); err == nil {
+		return errors.New("nds: self test CompareAndSwapMulti replaced a " +
+			"modified item")
+	}
+
+	item, err := selfTestGet(c, cache, memcacheKey)
+	if err != nil {
+		return err
+	} else if item == nil || item.Flags != entity.Flags ||
+		!bytes.Equal(item.Value, entity.Value) {
+		return errors.New("nds: self test item not replaced by " +
+			"CompareAndSwapMulti")
+	}
+	return nil
+}
+
+// selfTestGet gets the item for memcacheKey, returning nil if it is missing.
+func selfTestGet(c context.Context, cache Cache,
+	memcacheKey string) (*memcache.Item, error) {
+
+	items, err := cache.GetMulti(c, []string{memcacheKey})
+	if err != nil {
+		return nil, fmt.Errorf("nds: self test GetMulti %s", err)
+	}
+	return items[memcacheKey], nil
+}
@@ -0,0 +1,50 @@
+package nds_test
+
+import (
+	"testing"
+
+	"github.com/qedus/nds"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/memcache"
+)
+
+// lossyFlagsCache is a recordingCache that only keeps the low 16 bits of
+// item flags.
+type lossyFlagsCache struct {
+	recordingCache
+}
+
+func (lc *lossyFlagsCache) SetMulti(c context.Context,
+	items []*memcache.Item) error {
+	truncated := make([]*memcache.Item, len(items))
+	for i, item := range items {
+		cp := *item
+		cp.Flags &= 0xffff
+		truncated[i] = &cp
+	}
+	return lc.recordingCache.SetMulti(c, truncated)
+}
+
+func TestSelfTest(t *testing.T) {
+	c, closeFunc := NewContext(t, nil)
+	defer closeFunc()
+
+	rc := &recordingCache{}
+	if err := nds.SelfTest(nds.WithCache(c, rc)); err != nil {
+		t.Fatal(err)
+	}
+
+	// The test item is removed afterwards.
+	if len(rc.getKeys) == 0 {
+		t.Fatal("expected the cache to be read")
+	}
+	testKey := rc.getKeys[0]
+	if _, err := memcache.Get(c, testKey); err != memcache.ErrCacheMiss {
+		t.Fatal("expected test item to be deleted", err)
+	}
+
+	if err := nds.SelfTest(nds.WithCache(c,
+		&lossyFlagsCache{})); err == nil {
+		t.Fatal("expected lost flags to be reported")
+	}
+}
@@ -0,0 +1,102 @@
+package nds
+
+import (
+	"bytes"
+	"math/rand"
+	"sync"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/memcache"
+)
+
+var shadowReadKey = "used for shadow reads"
+
+type shadowReadConfig struct {
+	sampleRate   float64
+	onDivergence func(key *datastore.Key)
+}
+
+// WithShadowRead returns a context that makes GetMulti check a sampleRate
+// fraction of its cache hits, between 0 and 1, against the datastore. Each
+// sampled entity is read again from the datastore in the background and if it
+// differs from the cached entity the divergence is logged as a warning and
+// onDivergence, if not nil, is called with its key. What GetMulti returns, and
+// how quickly, is unchanged, making this suitable for catching cache
+// coherency bugs in canary deployments. Shadow reads are added to any
+// WaitGroup set with WithPrefetchGroup.
+//
+// An entity written between being read from the cache and from the datastore
+// is only reported if its cache entry is unchanged afterwards, which happens
+// when it is written without NDS. Comparisons are made as with Verify.
+func WithShadowRead(c context.Context, sampleRate float64,
+	onDivergence func(key *datastore.Key)) context.Context {
+
+	return context.WithValue(c, &shadowReadKey, shadowReadConfig{
+		sampleRate:   sampleRate,
+		onDivergence: onDivergence,
+	})
+}
+
+// shadowRead starts comparing the entity for key, read from item in the cache,
+// with the datastore in the background if c samples it.
+func shadowRead(c context.Context, key *datastore.Key, item *memcache.Item) {
+	config, ok := c.Value(&shadowReadKey).(shadowReadConfig)
+	if !ok || isCacheOnlyReads(c) || config.sampleRate <= 0 ||
+		rand.Float64() >= config.sampleRate {
+		return
+	}
+
+	wg, _ := c.Value(&prefetchGroupKey).(*sync.WaitGroup)
+	if wg != nil {
+		wg.Add(1)
+	}
+	go func() {
+		defer func() {
+			if wg != nil {
+				wg.Done()
+			}
+			// As with Prefetch, give up if the request behind c has finished.
+			recover()
+		}()
+		if compareShadowRead(c, key, item) {
+			warningf(c, "nds:shadowRead cached entity for %s differs from "+
+				"the datastore", key)
+			if config.onDivergence != nil {
+				config.onDivergence(key)
+			}
+		}
+	}()
+}
+
+// compareShadowRead reports whether the datastore entity for key differs from
+// the one cached in item, and item is still cached.
+func compareShadowRead(c context.Context, key *datastore.Key,
+	item *memcache.Item) bool {
+
+	pls := make([]datastore.PropertyList, 1)
+	err := getDatastore(c, []*datastore.Key{key}, pls)
+	err = singleError(err)
+	if err != nil && err != datastore.ErrNoSuchEntity {
+		debugf(c, "nds:shadowRead GetMulti %s", err)
+		return false
+	}
+
+	same, cmpErr := cachedEquals(c, key, item, pls[0], err == nil)
+	if cmpErr != nil {
+		debugf(c, "nds:shadowRead compare %s", cmpErr)
+		return false
+	} else if same {
+		return false
+	}
+
+	// Ignore entities written since item was read.
+	items, err := cacheFromContext(c).GetMulti(c, []string{item.Key})
+	if err != nil {
+		debugf(c, "nds:shadowRead GetMulti %s", err)
+		return false
+	}
+	current, ok := items[item.Key]
+	return ok && current.Flags == item.Flags &&
+		bytes.Equal(current.Value, item.Value)
+}
@@ -0,0 +1,57 @@
+package nds_test
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/qedus/nds"
+	"google.golang.org/appengine/datastore"
+)
+
+func TestWithShadowRead(t *testing.T) {
+	c, closeFunc := NewContext(t, nil)
+	defer closeFunc()
+
+	type testEntity struct {
+		Val int
+	}
+
+	var diverged []*datastore.Key
+	wg := &sync.WaitGroup{}
+	sc := nds.WithPrefetchGroup(nds.WithShadowRead(c, 1,
+		func(key *datastore.Key) {
+			diverged = append(diverged, key)
+		}), wg)
+
+	key := datastore.NewKey(c, "Entity", "", 1, nil)
+	if _, err := nds.Put(c, key, &testEntity{1}); err != nil {
+		t.Fatal(err)
+	}
+	if err := nds.Get(c, key, &testEntity{}); err != nil {
+		t.Fatal(err)
+	}
+
+	// A consistent cache hit is not reported.
+	if err := nds.Get(sc, key, &testEntity{}); err != nil {
+		t.Fatal(err)
+	}
+	wg.Wait()
+	if len(diverged) != 0 {
+		t.Fatal("expected no divergence", diverged)
+	}
+
+	// Change the entity without invalidating the cache.
+	if _, err := datastore.Put(c, key, &testEntity{2}); err != nil {
+		t.Fatal(err)
+	}
+	te := &testEntity{}
+	if err := nds.Get(sc, key, te); err != nil {
+		t.Fatal(err)
+	} else if te.Val != 1 {
+		t.Fatal("expected cached val", te.Val)
+	}
+	wg.Wait()
+	if len(diverged) != 1 || !diverged[0].Equal(key) {
+		t.Fatal("expected divergence", diverged)
+	}
+}
@@ -0,0 +1,44 @@
+package nds
+
+import (
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+var slowOpKey = "used for slow operation threshold"
+
+// slowOp is the threshold and callback set with WithSlowOpThreshold.
+type slowOp struct {
+	d time.Duration
+	f func(op string, keys int, took time.Duration)
+}
+
+// WithSlowOpThreshold returns a context that makes NDS call f after every
+// datastore or cache call that takes longer than d. op names the call, as for
+// Tracer spans, for example "memcache.GetMulti" or "datastore.PutMulti", keys
+// is the number of entities or cache items in it and took is how long it
+// took. f is called synchronously by the goroutine that made the call so it
+// should return quickly. Calls are not timed at all unless a threshold is set.
+func WithSlowOpThreshold(c context.Context, d time.Duration,
+	f func(op string, keys int, took time.Duration)) context.Context {
+	return context.WithValue(c, &slowOpKey, slowOp{d, f})
+}
+
+func slowOpFromContext(c context.Context) (slowOp, bool) {
+	so, ok := c.Value(&slowOpKey).(slowOp)
+	return so, ok && so.f != nil
+}
+
+// timeOp wraps end so that so is told if the call it ends is slow.
+func timeOp(so slowOp, name string, count int,
+	end func(error)) func(error) {
+
+	start := time.Now()
+	return func(err error) {
+		end(err)
+		if took := time.Since(start); took > so.d {
+			so.f(name, count, took)
+		}
+	}
+}
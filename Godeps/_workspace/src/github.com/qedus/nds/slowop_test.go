@@ -0,0 +1,57 @@
+package nds_test
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/qedus/nds"
+	"google.golang.org/appengine/datastore"
+)
+
+func TestWithSlowOpThreshold(t *testing.T) {
+	c, closeFunc := NewContext(t, nil)
+	defer closeFunc()
+
+	type testEntity struct {
+		Val int
+	}
+
+	var mu sync.Mutex
+	ops := map[string]int{}
+	record := func(op string, keys int, took time.Duration) {
+		mu.Lock()
+		ops[op] = keys
+		mu.Unlock()
+	}
+
+	// Every call is slower than a negative threshold.
+	sc := nds.WithSlowOpThreshold(c, -1, record)
+	keys := []*datastore.Key{
+		datastore.NewKey(c, "Entity", "", 1, nil),
+		datastore.NewKey(c, "Entity", "", 2, nil),
+	}
+	if _, err := nds.PutMulti(sc, keys, []testEntity{{1}, {2}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := nds.GetMulti(sc, keys, make([]testEntity, 2)); err != nil {
+		t.Fatal(err)
+	}
+	for _, op := range []string{
+		"memcache.SetMulti", "datastore.PutMulti", "memcache.DeleteMulti",
+		"memcache.GetMulti", "datastore.GetMulti",
+	} {
+		if n, ok := ops[op]; !ok || n != 2 {
+			t.Fatal("expected slow op", op, n, ops)
+		}
+	}
+
+	ops = map[string]int{}
+	fc := nds.WithSlowOpThreshold(c, time.Hour, record)
+	if err := nds.GetMulti(fc, keys, make([]testEntity, 2)); err != nil {
+		t.Fatal(err)
+	}
+	if len(ops) != 0 {
+		t.Fatal("expected no slow ops", ops)
+	}
+}
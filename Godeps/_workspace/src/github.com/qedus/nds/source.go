@@ -0,0 +1,125 @@
+package nds
+
+import (
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/memcache"
+)
+
+// Source is where GetMultiWithSource found the entity for a key.
+type Source int
+
+const (
+	// CacheHit is an entity, or a missing entity, read from the cache.
+	CacheHit Source = iota
+
+	// DatastoreRead is an entity read from the datastore, including entities
+	// that were locked in the cache when they were read.
+	DatastoreRead
+
+	// Missing is an entity that does not exist, whether the cache or the
+	// datastore reported it.
+	Missing
+)
+
+var sourceKey = "used for *sourceRecorder"
+
+// sourceRecorder records the memcache keys of the entities GetMulti served
+// from the cache and, if expiries is not nil, the expiry times of those read
+// from memcache entries.
+type sourceRecorder struct {
+	sync.Mutex
+	hits     map[string]bool
+	expiries map[string]time.Time
+}
+
+// GetMultiWithSource works just like GetMulti except that it also returns
+// where the entity for each key was found. Entities that do not exist, or
+// were deleted with WithTombstones, are reported as Missing. Within a
+// transaction, and with WithNoCache, every entity is a DatastoreRead. If
+// GetMulti returns an error other than a appengine.MultiError no sources are
+// returned.
+func GetMultiWithSource(c context.Context,
+	keys []*datastore.Key, vals interface{}) ([]Source, error) {
+
+	sr := &sourceRecorder{hits: map[string]bool{}}
+	err := GetMulti(context.WithValue(c, &sourceKey, sr), keys, vals)
+	return sr.sources(c, keys, err)
+}
+
+// sources returns where the entity for each of keys was found by the GetMulti
+// call that recorded its cache hits in sr and returned err.
+func (sr *sourceRecorder) sources(c context.Context, keys []*datastore.Key,
+	err error) ([]Source, error) {
+
+	me, ok := err.(appengine.MultiError)
+	if err != nil && !ok {
+		return nil, err
+	}
+
+	physicalKeys := keys
+	if f, ok := keyMapperFromContext(c); ok {
+		var mapErr error
+		if physicalKeys, mapErr = mapKeys(keys, f); mapErr != nil {
+			return nil, mapErr
+		}
+	}
+
+	sources := make([]Source, len(keys))
+	for i, key := range physicalKeys {
+		switch {
+		case me != nil && (me[i] == datastore.ErrNoSuchEntity ||
+			me[i] == ErrDeleted):
+			sources[i] = Missing
+		case key != nil && sr.hits[createMemcacheKey(c, key)]:
+			sources[i] = CacheHit
+		default:
+			sources[i] = DatastoreRead
+		}
+	}
+	return sources, err
+}
+
+// recordCacheHits records the cache items that have been loaded from the
+// cache, if c is used by GetMultiWithSource.
+func recordCacheHits(c context.Context, cacheItems []cacheItem) {
+	if _, ok := c.Value(&sourceKey).(*sourceRecorder); !ok {
+		return
+	}
+	for _, cacheItem := range cacheItems {
+		if cacheItem.state == done {
+			recordCacheHit(c, createMemcacheKey(c, cacheItem.key))
+		}
+	}
+}
+
+// recordCacheHit records that the entity for memcacheKey was loaded from the
+// cache, if c is used by GetMultiWithSource.
+func recordCacheHit(c context.Context, memcacheKey string) {
+	sr, ok := c.Value(&sourceKey).(*sourceRecorder)
+	if !ok {
+		return
+	}
+	sr.Lock()
+	sr.hits[memcacheKey] = true
+	sr.Unlock()
+}
+
+// recordCacheExpiry records the expiry of item, the memcache entry the entity
+// for key was loaded from, if c is used by GetMultiWithExpiry.
+func recordCacheExpiry(c context.Context, key *datastore.Key,
+	item *memcache.Item) {
+
+	sr, ok := c.Value(&sourceKey).(*sourceRecorder)
+	if !ok || sr.expiries == nil {
+		return
+	}
+	header, _ := splitItemHeader(item)
+	sr.Lock()
+	sr.expiries[createMemcacheKey(c, key)] = header.expiry
+	sr.Unlock()
+}
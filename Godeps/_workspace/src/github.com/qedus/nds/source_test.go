@@ -0,0 +1,77 @@
+package nds_test
+
+import (
+	"testing"
+
+	"github.com/qedus/nds"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/memcache"
+)
+
+func TestGetMultiWithSource(t *testing.T) {
+	c, closeFunc := NewContext(t, nil)
+	defer closeFunc()
+
+	type testEntity struct {
+		Val int
+	}
+
+	keys := []*datastore.Key{
+		datastore.NewKey(c, "Entity", "", 1, nil),
+		datastore.NewKey(c, "Entity", "", 2, nil),
+		datastore.NewKey(c, "Entity", "", 3, nil),
+		datastore.NewKey(c, "Entity", "", 4, nil),
+	}
+	if _, err := nds.PutMulti(c, keys[:3],
+		[]testEntity{{1}, {2}, {3}}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Cache the first entity and lock the second.
+	if _, err := nds.Warm(c, keys[:1]); err != nil {
+		t.Fatal(err)
+	}
+	if err := memcache.Set(c, &memcache.Item{
+		Key:   nds.CreateMemcacheKey(keys[1]),
+		Flags: nds.LockItem,
+		Value: []byte{1, 2, 3, 4},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []nds.Source{nds.CacheHit, nds.DatastoreRead, nds.DatastoreRead,
+		nds.Missing}
+	entities := make([]testEntity, len(keys))
+	sources, err := nds.GetMultiWithSource(c, keys, entities)
+	if me, ok := err.(appengine.MultiError); !ok {
+		t.Fatal("expected appengine.MultiError", err)
+	} else if me[3] != datastore.ErrNoSuchEntity {
+		t.Fatal("expected datastore.ErrNoSuchEntity", me[3])
+	}
+	for i := range keys {
+		if sources[i] != want[i] {
+			t.Fatal("incorrect source", i, sources[i])
+		}
+	}
+	if entities[1].Val != 2 {
+		t.Fatal("incorrect val", entities[1].Val)
+	}
+
+	// The third entity has now been cached, the second is still locked.
+	want[2] = nds.CacheHit
+	sources, _ = nds.GetMultiWithSource(c, keys,
+		make([]testEntity, len(keys)))
+	for i := range keys {
+		if sources[i] != want[i] {
+			t.Fatal("incorrect source", i, sources[i])
+		}
+	}
+
+	// Nothing comes from the cache when it is skipped.
+	sources, _ = nds.GetMultiWithSource(nds.WithNoCache(c), keys[:1],
+		make([]testEntity, 1))
+	if sources[0] != nds.DatastoreRead {
+		t.Fatal("incorrect source", sources[0])
+	}
+}
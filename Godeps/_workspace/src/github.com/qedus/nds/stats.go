@@ -0,0 +1,91 @@
+package nds
+
+import (
+	"sync/atomic"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/datastore"
+)
+
+// Stats describes how the entities of a GetMultiStats call were retrieved.
+type Stats struct {
+	// MemcacheHits is the number of entities, or cached missing entities,
+	// served from memcache.
+	MemcacheHits int64
+
+	// MemcacheMisses is the number of entities looked up in memcache that
+	// had to be read from the datastore.
+	MemcacheMisses int64
+
+	// DatastoreReads is the number of entities read from the datastore.
+	DatastoreReads int64
+
+	// LockContentions is the number of entities that were locked by another
+	// request and so were read from the datastore without being cached.
+	LockContentions int64
+}
+
+type stat int
+
+const (
+	statMemcacheHits stat = iota
+	statMemcacheMisses
+	statDatastoreReads
+	statLockContentions
+	statGets
+	statPuts
+	statDeletes
+	statCount
+)
+
+var statsKey = "used for *statsCounter"
+
+// statsCounter accumulates stats for all the operations made with a context.
+type statsCounter struct {
+	counts [statCount]int64
+	parent *statsCounter
+}
+
+func (sc *statsCounter) stats() Stats {
+	return Stats{
+		MemcacheHits:    atomic.LoadInt64(&sc.counts[statMemcacheHits]),
+		MemcacheMisses:  atomic.LoadInt64(&sc.counts[statMemcacheMisses]),
+		DatastoreReads:  atomic.LoadInt64(&sc.counts[statDatastoreReads]),
+		LockContentions: atomic.LoadInt64(&sc.counts[statLockContentions]),
+	}
+}
+
+// withStatsCounter returns a context that accumulates stats into a new
+// statsCounter as well as any existing one.
+func withStatsCounter(c context.Context) (context.Context, *statsCounter) {
+	parent, _ := c.Value(&statsKey).(*statsCounter)
+	sc := &statsCounter{parent: parent}
+	return context.WithValue(c, &statsKey, sc), sc
+}
+
+// processStats accumulates stats for every operation made by the process.
+var processStats statsCounter
+
+// addStat adds n to the stat s of processStats and every statsCounter
+// attached to c.
+func addStat(c context.Context, s stat, n int) {
+	if n == 0 {
+		return
+	}
+	atomic.AddInt64(&processStats.counts[s], int64(n))
+	sc, _ := c.Value(&statsKey).(*statsCounter)
+	for ; sc != nil; sc = sc.parent {
+		atomic.AddInt64(&sc.counts[s], int64(n))
+	}
+}
+
+// GetMultiStats works just like GetMulti but also reports how the entities
+// were retrieved. Stats are accumulated over all the batches GetMulti splits
+// keys into.
+func GetMultiStats(c context.Context,
+	keys []*datastore.Key, vals interface{}) (Stats, error) {
+
+	c, sc := withStatsCounter(c)
+	err := GetMulti(c, keys, vals)
+	return sc.stats(), err
+}
@@ -0,0 +1,76 @@
+package nds_test
+
+import (
+	"testing"
+
+	"github.com/qedus/nds"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/memcache"
+)
+
+func TestGetMultiStats(t *testing.T) {
+	c, closeFunc := NewContext(t, nil)
+	defer closeFunc()
+
+	type testEntity struct {
+		IntVal int
+	}
+
+	keys := []*datastore.Key{
+		datastore.NewKey(c, "Entity", "", 1, nil),
+		datastore.NewKey(c, "Entity", "", 2, nil),
+		datastore.NewKey(c, "Entity", "", 3, nil),
+	}
+	if _, err := nds.PutMulti(c, keys[:2],
+		[]testEntity{{1}, {2}}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Use a batch size of one to check stats are summed across batches.
+	bc := nds.WithMaxBatchSize(c, 1)
+
+	stats, err := nds.GetMultiStats(bc, keys, make([]testEntity, 3))
+	if _, ok := err.(appengine.MultiError); !ok {
+		t.Fatal("expected appengine.MultiError", err)
+	}
+	expected := nds.Stats{
+		MemcacheMisses: 3,
+		DatastoreReads: 3,
+	}
+	if stats != expected {
+		t.Fatalf("incorrect stats %+v", stats)
+	}
+
+	stats, err = nds.GetMultiStats(bc, keys, make([]testEntity, 3))
+	if _, ok := err.(appengine.MultiError); !ok {
+		t.Fatal("expected appengine.MultiError", err)
+	}
+	expected = nds.Stats{
+		MemcacheHits: 3,
+	}
+	if stats != expected {
+		t.Fatalf("incorrect stats %+v", stats)
+	}
+
+	// Lock the first entity as if it was being written.
+	if err := memcache.Set(c, &memcache.Item{
+		Key:   nds.CreateMemcacheKey(keys[0]),
+		Flags: nds.LockItem,
+		Value: []byte{1, 2, 3, 4},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	stats, err = nds.GetMultiStats(c, keys[:1], make([]testEntity, 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected = nds.Stats{
+		MemcacheMisses:  1,
+		DatastoreReads:  1,
+		LockContentions: 1,
+	}
+	if stats != expected {
+		t.Fatalf("incorrect stats %+v", stats)
+	}
+}
@@ -0,0 +1,130 @@
+package nds
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+)
+
+// Result is an entity, or the error getting it, sent by GetMultiStream.
+type Result struct {
+	Key *datastore.Key
+	Val interface{}
+	Err error
+}
+
+// GetMultiStream gets the entities for keys in batches, loading each into a
+// new value returned by factory for its kind as GetMultiDispatch does, and
+// sends a Result for every key on the returned channel as soon as its batch
+// completes. Downstream work can therefore start before every entity has been
+// read and only the batches in flight are held in memory. Batches are sized
+// as GetMulti would size them and run one at a time, or as many at once as
+// WithConcurrency allows, so results are in key order within a batch but
+// batches can complete in any order.
+//
+// The channel is closed once a Result has been sent for every key, or early if
+// c is done, in which case no further batches are started and results that
+// have not been received are dropped. A final Result with a nil Key and the
+// error of c is then sent before the channel is closed, so callers must
+// receive until the channel is closed. An error is returned, and no channel,
+// if any key is nil.
+func GetMultiStream(c context.Context, keys []*datastore.Key,
+	factory func(kind string) interface{}) (<-chan Result, error) {
+
+	if factory == nil {
+		return nil, errors.New("nds: factory is nil")
+	}
+	isNilErr, nilErr := false, make(appengine.MultiError, len(keys))
+	for i, key := range keys {
+		if key == nil {
+			isNilErr = true
+			nilErr[i] = datastore.ErrInvalidKey
+		}
+	}
+	if isNilErr {
+		return nil, nilErr
+	}
+
+	results := make(chan Result)
+	go streamBatches(c, keys, factory, results)
+	return results, nil
+}
+
+// streamBatches gets the batches of keys and sends their results, closing
+// results when done.
+func streamBatches(c context.Context, keys []*datastore.Key,
+	factory func(kind string) interface{}, results chan<- Result) {
+
+	defer close(results)
+
+	size := batchSize(c, getMultiLimit)
+	n := concurrency(c)
+	if n < 1 {
+		n = 1
+	}
+	sem := make(chan struct{}, n)
+	wg := sync.WaitGroup{}
+	var sent int64
+	for lo := 0; lo < len(keys); lo += size {
+		select {
+		case sem <- struct{}{}:
+		case <-c.Done():
+		}
+		if c.Err() != nil {
+			break
+		}
+		hi := lo + size
+		if hi > len(keys) {
+			hi = len(keys)
+		}
+
+		wg.Add(1)
+		go func(keys []*datastore.Key) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			atomic.AddInt64(&sent, int64(streamBatch(c, keys, factory,
+				results)))
+		}(keys[lo:hi])
+	}
+	wg.Wait()
+
+	if err := c.Err(); err != nil &&
+		atomic.LoadInt64(&sent) < int64(len(keys)) {
+		results <- Result{Err: err}
+	}
+}
+
+// streamBatch gets the entities for keys and sends their results until c is
+// done, returning how many it sent.
+func streamBatch(c context.Context, keys []*datastore.Key,
+	factory func(kind string) interface{}, results chan<- Result) int {
+
+	vals, err := GetMultiDispatch(c, keys, factory)
+	me, ok := err.(appengine.MultiError)
+	for i, key := range keys {
+		result := Result{Key: key}
+		switch {
+		case err == nil:
+			result.Val = vals[i]
+		case ok:
+			result.Val, result.Err = vals[i], me[i]
+		default:
+			result.Err = err
+		}
+
+		// Check c first as select picks at random when both are ready.
+		if c.Err() != nil {
+			return i
+		}
+		select {
+		case results <- result:
+		case <-c.Done():
+			return i
+		}
+	}
+	return len(keys)
+}
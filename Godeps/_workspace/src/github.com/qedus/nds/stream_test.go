@@ -0,0 +1,106 @@
+package nds_test
+
+import (
+	"testing"
+
+	"github.com/qedus/nds"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/datastore"
+)
+
+func TestGetMultiStream(t *testing.T) {
+	c, closeFunc := NewContext(t, nil)
+	defer closeFunc()
+
+	type testEntity struct {
+		Val int
+	}
+
+	keys := []*datastore.Key{}
+	entities := []testEntity{}
+	for i := 1; i <= 5; i++ {
+		keys = append(keys, datastore.NewKey(c, "Entity", "", int64(i), nil))
+		entities = append(entities, testEntity{i})
+	}
+	if _, err := nds.PutMulti(c, keys[:4], entities[:4]); err != nil {
+		t.Fatal(err)
+	}
+
+	factory := func(kind string) interface{} {
+		return &testEntity{}
+	}
+	results, err := nds.GetMultiStream(nds.WithMaxBatchSize(c, 2), keys,
+		factory)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	seen := map[int64]bool{}
+	for result := range results {
+		id := result.Key.IntID()
+		seen[id] = true
+		if id == 5 {
+			if result.Err != datastore.ErrNoSuchEntity {
+				t.Fatal("expected datastore.ErrNoSuchEntity", result.Err)
+			}
+			continue
+		}
+		if result.Err != nil {
+			t.Fatal(result.Err)
+		}
+		if te, ok := result.Val.(*testEntity); !ok || int64(te.Val) != id {
+			t.Fatal("incorrect val", result.Val)
+		}
+	}
+	if len(seen) != len(keys) {
+		t.Fatal("incorrect results", seen)
+	}
+
+	if _, err := nds.GetMultiStream(c, []*datastore.Key{nil},
+		factory); err == nil {
+		t.Fatal("expected nil key error")
+	}
+}
+
+func TestGetMultiStreamCancelled(t *testing.T) {
+	c, closeFunc := NewContext(t, nil)
+	defer closeFunc()
+
+	type testEntity struct {
+		Val int
+	}
+
+	keys := []*datastore.Key{
+		datastore.NewKey(c, "Entity", "", 1, nil),
+		datastore.NewKey(c, "Entity", "", 2, nil),
+	}
+	if _, err := nds.PutMulti(c, keys,
+		[]testEntity{{1}, {2}}); err != nil {
+		t.Fatal(err)
+	}
+
+	cc, cancel := context.WithCancel(nds.WithMaxBatchSize(c, 1))
+	results, err := nds.GetMultiStream(cc, keys, func(string) interface{} {
+		return &testEntity{}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Only the first batch is received before cancelling.
+	if result := <-results; result.Err != nil || !result.Key.Equal(keys[0]) {
+		t.Fatal("incorrect first result", result.Key, result.Err)
+	}
+
+	// After cancelling only the context error is received before the channel
+	// closes.
+	cancel()
+	var received []nds.Result
+	for result := range results {
+		received = append(received, result)
+	}
+	if len(received) != 1 || received[0].Key != nil ||
+		received[0].Err != context.Canceled {
+		t.Fatal("expected only the context error", received)
+	}
+}
@@ -0,0 +1,28 @@
+package nds
+
+import "golang.org/x/net/context"
+
+var strictCommitOrderingKey = "used for strict commit ordering"
+
+// WithStrictCommitOrdering returns a context that makes RunInTransaction
+// lock every entity written within the transaction in the cache before the
+// transaction commits, and only then evict them from the local cache set with
+// WithLocalCache. Readers therefore find the entities locked, and read them
+// from the datastore, from before the commit until the locks expire or are
+// replaced.
+//
+// By default the local cache is evicted just before the locks are set, so a
+// reader using the same local cache in between can keep the old entity
+// locally, and writes made with WithoutLocks are only deleted from the cache
+// after the commit, leaving the old entity readable until then. With strict
+// commit ordering entities written with WithoutLocks within the transaction
+// are locked like any other write, at the cost of setting their locks before
+// the commit rather than deleting them after it.
+func WithStrictCommitOrdering(c context.Context) context.Context {
+	return context.WithValue(c, &strictCommitOrderingKey, true)
+}
+
+func isStrictCommitOrdering(c context.Context) bool {
+	strict, _ := c.Value(&strictCommitOrderingKey).(bool)
+	return strict
+}
@@ -0,0 +1,68 @@
+package nds_test
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/qedus/nds"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/memcache"
+)
+
+func TestWithStrictCommitOrdering(t *testing.T) {
+	c, closeFunc := NewContext(t, nil)
+	defer closeFunc()
+
+	type testEntity struct {
+		Val int
+	}
+
+	key := datastore.NewKey(c, "Entity", "", 1, nil)
+	if _, err := nds.Put(c, key, &testEntity{1}); err != nil {
+		t.Fatal(err)
+	}
+
+	lc := nds.WithStrictCommitOrdering(nds.WithLocalCache(c))
+	if err := nds.Get(lc, key, &testEntity{}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Race a reader against the commit by reading while the transaction sets
+	// its locks, when the old entity is still cached.
+	var readErr error
+	var readVal int
+	once := sync.Once{}
+	nds.SetMemcacheSetMulti(func(c context.Context,
+		items []*memcache.Item) error {
+		once.Do(func() {
+			entity := &testEntity{}
+			readErr = nds.Get(lc, key, entity)
+			readVal = entity.Val
+		})
+		return memcache.SetMulti(c, items)
+	})
+	defer nds.SetMemcacheSetMulti(memcache.SetMulti)
+
+	if err := nds.RunInTransaction(lc, func(tc context.Context) error {
+		_, err := nds.Put(nds.WithoutLocks(tc), key, &testEntity{2})
+		return err
+	}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if readErr != nil {
+		t.Fatal(readErr)
+	} else if readVal != 1 {
+		t.Fatal("expected the reader to see the old entity", readVal)
+	}
+
+	// Neither the local cache nor memcache kept the old entity.
+	for _, rc := range []context.Context{lc, c} {
+		entity := &testEntity{}
+		if err := nds.Get(rc, key, entity); err != nil {
+			t.Fatal(err)
+		} else if entity.Val != 2 {
+			t.Fatal("expected a fresh entity", entity.Val)
+		}
+	}
+}
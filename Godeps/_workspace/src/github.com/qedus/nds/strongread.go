@@ -0,0 +1,19 @@
+package nds
+
+import "golang.org/x/net/context"
+
+var strongReadKey = "used for strong reads"
+
+// WithStrongRead returns a context that makes GetMulti and Get always read
+// entities from the datastore, ignoring anything cached for them. The fresh
+// entities are then written back to the cache, unless a concurrent put or
+// delete has locked the cache entry in the meantime, so later reads through
+// any context also see them.
+func WithStrongRead(c context.Context) context.Context {
+	return context.WithValue(c, &strongReadKey, true)
+}
+
+func isStrongRead(c context.Context) bool {
+	strong, _ := c.Value(&strongReadKey).(bool)
+	return strong
+}
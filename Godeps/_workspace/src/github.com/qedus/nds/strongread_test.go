@@ -0,0 +1,91 @@
+package nds_test
+
+import (
+	"testing"
+
+	"github.com/qedus/nds"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/memcache"
+)
+
+func TestWithStrongRead(t *testing.T) {
+	c, closeFunc := NewContext(t, nil)
+	defer closeFunc()
+
+	type testEntity struct {
+		Val int
+	}
+
+	key := datastore.NewKey(c, "Entity", "", 1, nil)
+	if _, err := nds.Put(c, key, &testEntity{1}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Prime the cache then make it stale by bypassing NDS.
+	if err := nds.Get(c, key, &testEntity{}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := datastore.Put(c, key, &testEntity{2}); err != nil {
+		t.Fatal(err)
+	}
+
+	te := &testEntity{}
+	if err := nds.Get(c, key, te); err != nil {
+		t.Fatal(err)
+	} else if te.Val != 1 {
+		t.Fatal("expected stale cached entity", te.Val)
+	}
+
+	te = &testEntity{}
+	if err := nds.Get(nds.WithStrongRead(c), key, te); err != nil {
+		t.Fatal(err)
+	} else if te.Val != 2 {
+		t.Fatal("expected datastore entity", te.Val)
+	}
+
+	// The strong read refreshed the cache.
+	te = &testEntity{}
+	if err := nds.Get(c, key, te); err != nil {
+		t.Fatal(err)
+	} else if te.Val != 2 {
+		t.Fatal("expected refreshed cached entity", te.Val)
+	}
+}
+
+func TestWithStrongReadKeepsLock(t *testing.T) {
+	c, closeFunc := NewContext(t, nil)
+	defer closeFunc()
+
+	type testEntity struct {
+		Val int
+	}
+
+	key := datastore.NewKey(c, "Entity", "", 1, nil)
+	if _, err := nds.Put(c, key, &testEntity{1}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Simulate a concurrent put holding the lock.
+	memcacheKey := nds.CreateMemcacheKey(key)
+	lock := &memcache.Item{
+		Key:   memcacheKey,
+		Flags: nds.LockItem,
+		Value: []byte{1, 2, 3, 4},
+	}
+	if err := memcache.Set(c, lock); err != nil {
+		t.Fatal(err)
+	}
+
+	te := &testEntity{}
+	if err := nds.Get(nds.WithStrongRead(c), key, te); err != nil {
+		t.Fatal(err)
+	} else if te.Val != 1 {
+		t.Fatal("incorrect val", te.Val)
+	}
+
+	if item, err := memcache.Get(c, memcacheKey); err != nil {
+		t.Fatal(err)
+	} else if item.Flags != nds.LockItem {
+		t.Fatal("expected lock to be kept", item.Flags)
+	}
+}
@@ -0,0 +1,57 @@
+package nds
+
+import (
+	"errors"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/memcache"
+)
+
+// ErrDeleted is returned by GetMulti, and Get, for an entity that was
+// recently deleted using a context created with WithTombstones.
+var ErrDeleted = errors.New("nds: entity deleted")
+
+var tombstoneTTLKey = "used for tombstone TTL"
+
+// WithTombstones returns a context that makes DeleteMulti leave a tombstone
+// in the cache for each deleted entity, lasting for ttl. Until it expires, or
+// the entity is put again, GetMulti returns ErrDeleted for the entity through
+// any context instead of reading it from the datastore, so a lagging
+// datastore read can never bring the just deleted entity back. Tombstones are
+// stored with their own item type, distinct from cache locks, and are not
+// written for deletes within a transaction. ttl must not be longer than the
+// maximum memcache expiration of 30 days; a ttl of zero or less disables
+// tombstones, which is the default.
+func WithTombstones(c context.Context, ttl time.Duration) context.Context {
+	return context.WithValue(c, &tombstoneTTLKey, ttl)
+}
+
+func tombstoneTTL(c context.Context) (time.Duration, bool) {
+	ttl, _ := c.Value(&tombstoneTTLKey).(time.Duration)
+	if ttl > memcacheMaxExpiration {
+		ttl = memcacheMaxExpiration
+	}
+	return ttl, ttl > 0
+}
+
+// setTombstones replaces the cache entries at memcacheKeys with tombstones,
+// reporting whether it succeeded.
+func setTombstones(c context.Context, memcacheKeys []string,
+	ttl time.Duration) bool {
+
+	items := make([]*memcache.Item, len(memcacheKeys))
+	for i, memcacheKey := range memcacheKeys {
+		items[i] = &memcache.Item{
+			Key:        memcacheKey,
+			Flags:      tombstoneItem,
+			Value:      []byte{},
+			Expiration: ttl,
+		}
+	}
+	if err := cacheFromContext(c).SetMulti(c, items); err != nil {
+		warningf(c, "nds:setTombstones SetMulti %s", err)
+		return false
+	}
+	return true
+}
@@ -0,0 +1,57 @@
+package nds_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/qedus/nds"
+	"google.golang.org/appengine/datastore"
+)
+
+func TestWithTombstones(t *testing.T) {
+	c, closeFunc := NewContext(t, nil)
+	defer closeFunc()
+
+	type testEntity struct {
+		Val int
+	}
+
+	key := datastore.NewKey(c, "Entity", "", 1, nil)
+	if _, err := nds.Put(c, key, &testEntity{1}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := nds.Delete(nds.WithTombstones(c, time.Minute), key); err != nil {
+		t.Fatal(err)
+	}
+
+	// Reading through any context sees the tombstone, even if the datastore
+	// still has the entity.
+	if _, err := datastore.Put(c, key, &testEntity{1}); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		if err := nds.Get(c, key, &testEntity{}); err != nds.ErrDeleted {
+			t.Fatal("expected nds.ErrDeleted", err)
+		}
+	}
+
+	// Putting the entity again replaces the tombstone.
+	if _, err := nds.Put(c, key, &testEntity{2}); err != nil {
+		t.Fatal(err)
+	}
+	te := &testEntity{}
+	if err := nds.Get(c, key, te); err != nil {
+		t.Fatal(err)
+	} else if te.Val != 2 {
+		t.Fatal("incorrect val", te.Val)
+	}
+
+	// Without tombstones deleted entities are missing as usual.
+	if err := nds.Delete(c, key); err != nil {
+		t.Fatal(err)
+	}
+	if err := nds.Get(c, key, &testEntity{}); err != datastore.ErrNoSuchEntity {
+		t.Fatal("expected datastore.ErrNoSuchEntity", err)
+	}
+}
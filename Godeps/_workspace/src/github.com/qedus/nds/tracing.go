@@ -0,0 +1,137 @@
+package nds
+
+import (
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/memcache"
+)
+
+// Tracer creates spans around the datastore and cache calls NDS makes so they
+// can be recorded by tracing systems such as OpenCensus or OpenTelemetry.
+//
+// StartSpan is called before each call with the operation name, for example
+// "memcache.SetMulti" or "datastore.GetMulti", and info describing the call.
+// The returned context is used for the call and the returned function is
+// called with the call's error once it completes.
+type Tracer interface {
+	StartSpan(c context.Context, name string,
+		info SpanInfo) (context.Context, func(err error))
+}
+
+// SpanInfo describes the call a span is created for.
+type SpanInfo struct {
+	// Backend is either "memcache" or "datastore".
+	Backend string
+
+	// Count is the number of entities or cache items in the call.
+	Count int
+}
+
+var tracerKey = "used for Tracer"
+
+// WithTracer returns a context that reports all datastore and cache calls
+// made with it to t.
+func WithTracer(c context.Context, t Tracer) context.Context {
+	return context.WithValue(c, &tracerKey, t)
+}
+
+func tracerFromContext(c context.Context) (Tracer, bool) {
+	t, ok := c.Value(&tracerKey).(Tracer)
+	return t, ok && t != nil
+}
+
+// operationObserver holds a func(name string, took time.Duration) called with
+// the duration of every datastore and cache call made by the process, such as
+// the one set by NewCollector.
+var operationObserver atomic.Value
+
+func operationObserverFunc() (func(string, time.Duration), bool) {
+	f, _ := operationObserver.Load().(func(string, time.Duration))
+	return f, f != nil
+}
+
+func endSpanNoop(error) {}
+
+// startSpan starts a span for an operation if c has a Tracer, and times it if
+// c has a slow operation threshold or the process has an operation observer.
+// It does not allocate if there are none of these.
+func startSpan(c context.Context, backend, name string,
+	count int) (context.Context, func(error)) {
+
+	t, traced := tracerFromContext(c)
+	so, timed := slowOpFromContext(c)
+	observe, observed := operationObserverFunc()
+	if !traced && !timed && !observed {
+		return c, endSpanNoop
+	}
+
+	end := endSpanNoop
+	if traced {
+		c, end = t.StartSpan(c, name, SpanInfo{Backend: backend, Count: count})
+	}
+	if timed {
+		end = timeOp(so, name, count, end)
+	}
+	if observed {
+		end = observeOp(observe, name, end)
+	}
+	return c, end
+}
+
+func observeOp(observe func(string, time.Duration), name string,
+	end func(error)) func(error) {
+
+	start := time.Now()
+	return func(err error) {
+		end(err)
+		observe(name, time.Since(start))
+	}
+}
+
+// tracedCache reports the calls made to a Cache to a Tracer, the slow
+// operation callback and the operation observer.
+type tracedCache struct {
+	cache Cache
+}
+
+func (tc tracedCache) AddMulti(c context.Context,
+	items []*memcache.Item) error {
+	c, end := startSpan(c, "memcache", "memcache.AddMulti", len(items))
+	err := tc.cache.AddMulti(c, items)
+	end(err)
+	return err
+}
+
+func (tc tracedCache) CompareAndSwapMulti(c context.Context,
+	items []*memcache.Item) error {
+	c, end := startSpan(c, "memcache", "memcache.CompareAndSwapMulti",
+		len(items))
+	err := tc.cache.CompareAndSwapMulti(c, items)
+	end(err)
+	return err
+}
+
+func (tc tracedCache) DeleteMulti(c context.Context, keys []string) error {
+	c, end := startSpan(c, "memcache", "memcache.DeleteMulti", len(keys))
+	err := tc.cache.DeleteMulti(c, keys)
+	end(err)
+	return err
+}
+
+func (tc tracedCache) GetMulti(c context.Context,
+	keys []string) (map[string]*memcache.Item, error) {
+	c, end := startSpan(c, "memcache", "memcache.GetMulti", len(keys))
+	items, err := tc.cache.GetMulti(c, keys)
+	end(err)
+	return items, err
+}
+
+func (tc tracedCache) SetMulti(c context.Context,
+	items []*memcache.Item) error {
+	c, end := startSpan(c, "memcache", "memcache.SetMulti", len(items))
+	err := tc.cache.SetMulti(c, items)
+	end(err)
+	return err
+}
@@ -0,0 +1,88 @@
+package nds_test
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/qedus/nds"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/datastore"
+)
+
+type recordingTracer struct {
+	sync.Mutex
+	names []string
+	infos []nds.SpanInfo
+	ended int
+}
+
+func (rt *recordingTracer) StartSpan(c context.Context, name string,
+	info nds.SpanInfo) (context.Context, func(error)) {
+	rt.Lock()
+	rt.names = append(rt.names, name)
+	rt.infos = append(rt.infos, info)
+	rt.Unlock()
+	return c, func(error) {
+		rt.Lock()
+		rt.ended++
+		rt.Unlock()
+	}
+}
+
+func TestWithTracer(t *testing.T) {
+	c, closeFunc := NewContext(t, nil)
+	defer closeFunc()
+
+	type testEntity struct {
+		IntVal int
+	}
+
+	rt := &recordingTracer{}
+	tc := nds.WithTracer(c, rt)
+
+	keys := []*datastore.Key{
+		datastore.NewKey(c, "Entity", "", 1, nil),
+		datastore.NewKey(c, "Entity", "", 2, nil),
+	}
+	if _, err := nds.PutMulti(tc, keys,
+		[]testEntity{{1}, {2}}); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []string{
+		"memcache.SetMulti",
+		"datastore.PutMulti",
+		"memcache.DeleteMulti",
+	}
+	if len(rt.names) != len(expected) {
+		t.Fatal("incorrect spans", rt.names)
+	}
+	for i, name := range expected {
+		if rt.names[i] != name {
+			t.Fatal("incorrect span", i, rt.names[i])
+		}
+		if rt.infos[i].Count != 2 {
+			t.Fatal("incorrect span count", rt.infos[i].Count)
+		}
+	}
+	if rt.infos[1].Backend != "datastore" || rt.infos[0].Backend != "memcache" {
+		t.Fatal("incorrect span backends", rt.infos)
+	}
+	if rt.ended != len(expected) {
+		t.Fatal("not all spans ended", rt.ended)
+	}
+
+	rt.names = nil
+	if err := nds.GetMulti(tc, keys, make([]testEntity, 2)); err != nil {
+		t.Fatal(err)
+	}
+	found := false
+	for _, name := range rt.names {
+		if name == "datastore.GetMulti" {
+			found = true
+		}
+	}
+	if !found {
+		t.Fatal("expected datastore.GetMulti span", rt.names)
+	}
+}
@@ -1,18 +1,67 @@
 package nds
 
 import (
+	"reflect"
 	"sync"
 
 	"golang.org/x/net/context"
+	"google.golang.org/appengine"
 	"google.golang.org/appengine/datastore"
 	"google.golang.org/appengine/memcache"
 )
 
 var transactionKey = "used for *transaction"
 
+// memcacheSetMultiLimit is the maximum number of lock items a transaction
+// sets with each memcache.SetMulti call when it commits.
+const memcacheSetMultiLimit = 500
+
+// maxXGEntityGroups is the datastore limit for the number of entity groups a
+// cross group transaction can write to. Other transactions can only write to
+// one.
+const maxXGEntityGroups = 25
+
 type transaction struct {
 	sync.Mutex
 	lockMemcacheItems []*memcache.Item
+	lockMemcacheKeys  map[string]bool
+	lockedKeys        []*datastore.Key
+
+	// deleteMemcacheKeys are cache entries deleted after the transaction
+	// commits, rather than locked, for writes made using WithoutLocks.
+	deleteMemcacheKeys []string
+	deleteKeys         []*datastore.Key
+
+	// readMemcacheKeys are the cache entries of the entities got within the
+	// transaction, only recorded for WithRollbackEviction.
+	readMemcacheKeys map[string]bool
+
+	// locksSet is whether lockMemcacheItems have been set in the cache,
+	// which happens just before the transaction commits.
+	locksSet bool
+
+	// entities holds the entities written within the transaction by memcache
+	// key so they can be read back before the transaction commits. A nil
+	// datastore.PropertyList marks a deleted entity.
+	entities map[string]datastore.PropertyList
+
+	// mutations holds the entities written within the transaction in the
+	// order they were first written, for the pre-commit hook, indexed by
+	// memcache key in mutationIndexes.
+	mutations       []Mutation
+	mutationIndexes map[string]int
+
+	// manual is set for transactions begun with WithManualTransaction, whose
+	// locks are flushed with FlushTransactionLocks.
+	manual bool
+
+	// entityGroups holds the encoded root keys of the entity groups written
+	// within the transaction, up to maxEntityGroups if it is not zero.
+	// newEntityGroups counts the incomplete root keys written, each of which
+	// starts an entity group of its own.
+	entityGroups    map[string]bool
+	newEntityGroups int
+	maxEntityGroups int
 }
 
 func transactionFromContext(c context.Context) (*transaction, bool) {
@@ -23,19 +72,303 @@ func transactionFromContext(c context.Context) (*transaction, bool) {
 // RunInTransaction works just like datastore.RunInTransaction however it
 // interacts correctly with memcache. You should always use this method for
 // transactions if you are using the NDS package.
+//
+// Entities put or deleted within the transaction are returned by GetMulti
+// and Get using tc as they were written, rather than as they were when the
+// transaction started. Queries are unaffected.
+//
+// Each attempt at the transaction buffers its own cache locks. They are
+// discarded if f fails and only set once f returns successfully, so retried
+// attempts never carry over the locks of earlier ones. The locks are set in
+// batches small enough for memcache however many entities were written.
+//
+// Puts and deletes that would take the transaction over the datastore limit
+// of one entity group, or 25 for cross group transactions, fail with a
+// *TooManyEntityGroupsError, which wraps ErrTooManyEntityGroups, before
+// anything is written rather than when the transaction commits.
+// WithMaxEntityGroups changes the limit.
 func RunInTransaction(c context.Context, f func(tc context.Context) error,
 	opts *datastore.TransactionOptions) error {
 
-	return datastore.RunInTransaction(c, func(tc context.Context) error {
-		tx := &transaction{}
+	var lockedKeys, deleteKeys []*datastore.Key
+	var deleteMemcacheKeys []string
+	stopRenewal := func() {}
+	var attempts []*transaction
+	client := datastoreFromContext(c)
+	err := client.RunInTransaction(c, func(tc context.Context) error {
+		// Stop renewing the locks of any failed attempt.
+		stopRenewal()
+		stopRenewal = func() {}
+
+		tx := &transaction{
+			lockMemcacheKeys: map[string]bool{},
+			entities:         map[string]datastore.PropertyList{},
+			maxEntityGroups:  maxEntityGroups(c, opts != nil && opts.XG),
+		}
+		attempts = append(attempts, tx)
 		tc = context.WithValue(tc, &transactionKey, tx)
 		if err := f(tc); err != nil {
 			return err
 		}
+		if err := runPreCommitHook(tc, tx); err != nil {
+			return err
+		}
 
 		// tx.Unlock() is not called as the tx context should never be called
 		//again so we rather block than allow people to misuse the context.
 		tx.Lock()
-		return memcacheSetMulti(tc, tx.lockMemcacheItems)
+		memcacheKeys := make([]string, len(tx.lockMemcacheItems))
+		for i, item := range tx.lockMemcacheItems {
+			memcacheKeys[i] = item.Key
+		}
+		strict := isStrictCommitOrdering(tc)
+		if !strict {
+			evictLocalCache(tc, memcacheKeys)
+			evictLocalCache(tc, tx.deleteMemcacheKeys)
+		}
+		if err := setLockBatches(tc, tx.lockMemcacheItems); err != nil {
+			return err
+		}
+		tx.locksSet = true
+		if strict {
+			// Nothing can be cached locally again once the locks are set.
+			evictLocalCache(tc, memcacheKeys)
+		}
+		if interval := lockRenewalInterval(c); interval > 0 &&
+			len(tx.lockMemcacheItems) > 0 {
+			stopRenewal = renewLocks(c, tx.lockMemcacheItems, interval)
+		}
+		lockedKeys = tx.lockedKeys
+		deleteKeys, deleteMemcacheKeys = tx.deleteKeys, tx.deleteMemcacheKeys
+		return nil
 	}, opts)
+	stopRenewal()
+	if isRollbackEviction(c) {
+		evictRolledBack(c, attempts, err == nil)
+	}
+	if err != nil {
+		return err
+	}
+
+	invalidated(c, lockedKeys)
+	if len(deleteMemcacheKeys) > 0 {
+		if err := cacheFromContext(c).DeleteMulti(c,
+			deleteMemcacheKeys); err != nil && !isCacheMissErrors(err) {
+			warningf(c, "nds:RunInTransaction DeleteMulti %s", err)
+		} else {
+			invalidated(c, deleteKeys)
+		}
+	}
+	return nil
+}
+
+// TransactionOptions are the options for RunInTransactionWithOptions.
+type TransactionOptions struct {
+	// XG is whether the transaction can cross multiple entity groups, as with
+	// datastore.TransactionOptions.
+	XG bool
+
+	// Attempts is the number of times the datastore transaction is run while
+	// it fails with datastore.ErrConcurrentTransaction. The datastore itself
+	// retries commits a few times within each attempt. Zero or less means
+	// one attempt, the same as RunInTransaction.
+	Attempts int
+}
+
+// RunInTransactionWithOptions works just like RunInTransaction except that the
+// transaction is retried up to opts.Attempts times when it fails with
+// datastore.ErrConcurrentTransaction. Cache locks are buffered per attempt as
+// with RunInTransaction, so only the locks of the attempt that commits, or
+// that last failed to commit, are set. A nil opts is the same as
+// RunInTransaction with nil options.
+func RunInTransactionWithOptions(c context.Context,
+	f func(tc context.Context) error, opts *TransactionOptions) error {
+
+	if opts == nil {
+		return RunInTransaction(c, f, nil)
+	}
+
+	dsOpts := &datastore.TransactionOptions{XG: opts.XG}
+	var err error
+	for i := 0; i < opts.Attempts || i == 0; i++ {
+		if err = RunInTransaction(c, f,
+			dsOpts); err != datastore.ErrConcurrentTransaction {
+			return err
+		}
+	}
+	return err
+}
+
+// setLockBatches sets items in batches small enough for memcache.
+func setLockBatches(c context.Context, items []*memcache.Item) error {
+	for lo := 0; lo < len(items); lo += memcacheSetMultiLimit {
+		hi := lo + memcacheSetMultiLimit
+		if hi > len(items) {
+			hi = len(items)
+		}
+		if err := cacheFromContext(c).SetMulti(c, items[lo:hi]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// addEntityGroups records the entity groups of keys as written within the
+// transaction. If that would take the transaction over its entity group limit
+// a *TooManyEntityGroupsError is returned instead, so the write fails before
+// the transaction tries to commit.
+func (tx *transaction) addEntityGroups(keys []*datastore.Key) error {
+	tx.Lock()
+	defer tx.Unlock()
+	if tx.entityGroups == nil {
+		tx.entityGroups = map[string]bool{}
+	}
+
+	added := map[string]bool{}
+	newGroups := 0
+	for _, key := range keys {
+		if key == nil {
+			continue
+		}
+		root := key
+		for root.Parent() != nil {
+			root = root.Parent()
+		}
+		if root.Incomplete() {
+			newGroups++
+		} else if encoded := root.Encode(); !tx.entityGroups[encoded] {
+			added[encoded] = true
+		}
+	}
+
+	n := len(tx.entityGroups) + tx.newEntityGroups + len(added) + newGroups
+	if tx.maxEntityGroups > 0 && n > tx.maxEntityGroups {
+		return &TooManyEntityGroupsError{Groups: n, Limit: tx.maxEntityGroups}
+	}
+	for encoded := range added {
+		tx.entityGroups[encoded] = true
+	}
+	tx.newEntityGroups += newGroups
+	return nil
+}
+
+// addLockItems adds items, the lock items for keys, to the locks set when the
+// transaction commits, skipping any keys that are already going to be locked.
+func (tx *transaction) addLockItems(c context.Context,
+	items []*memcache.Item, keys []*datastore.Key) {
+
+	tx.Lock()
+	defer tx.Unlock()
+	for _, key := range keys {
+		if !tx.lockMemcacheKeys[createMemcacheKey(c, key)] {
+			tx.lockedKeys = append(tx.lockedKeys, key)
+		}
+	}
+	for _, item := range items {
+		if !tx.lockMemcacheKeys[item.Key] {
+			tx.lockMemcacheKeys[item.Key] = true
+			tx.lockMemcacheItems = append(tx.lockMemcacheItems, item)
+		}
+	}
+}
+
+// addDeleteKeys adds the cache entries memcacheKeys, for keys, to those
+// deleted once the transaction commits.
+func (tx *transaction) addDeleteKeys(memcacheKeys []string,
+	keys []*datastore.Key) {
+
+	tx.Lock()
+	defer tx.Unlock()
+	tx.deleteMemcacheKeys = append(tx.deleteMemcacheKeys, memcacheKeys...)
+	tx.deleteKeys = append(tx.deleteKeys, keys...)
+}
+
+// putEntities records the entities just put within the transaction.
+func (tx *transaction) putEntities(c context.Context,
+	keys []*datastore.Key, vals reflect.Value) {
+
+	tx.Lock()
+	defer tx.Unlock()
+	for i, key := range keys {
+		memcacheKey := createMemcacheKey(c, key)
+		if pl, err := saveValue(vals.Index(i)); err == nil {
+			normalizeTimes(pl)
+			tx.entities[memcacheKey] = pl
+			tx.addMutation(memcacheKey, key, pl)
+		} else {
+			delete(tx.entities, memcacheKey)
+		}
+	}
+}
+
+// deleteEntities records the entities just deleted within the transaction.
+func (tx *transaction) deleteEntities(c context.Context,
+	keys []*datastore.Key) {
+
+	tx.Lock()
+	defer tx.Unlock()
+	for _, key := range keys {
+		memcacheKey := createMemcacheKey(c, key)
+		tx.entities[memcacheKey] = nil
+		tx.addMutation(memcacheKey, key, nil)
+	}
+}
+
+// txGetMulti gets entities within a transaction. Entities written within the
+// transaction are loaded from tx and the rest are got from the datastore.
+func txGetMulti(c context.Context, tx *transaction,
+	keys []*datastore.Key, vals reflect.Value) error {
+
+	me, errsNil := make(appengine.MultiError, len(keys)), true
+	dsKeys := make([]*datastore.Key, 0, len(keys))
+	dsIndexes := make([]int, 0, len(keys))
+
+	tx.Lock()
+	tx.addReadKeys(c, keys)
+	for i, key := range keys {
+		pl, ok := tx.entities[createMemcacheKey(c, key)]
+		switch {
+		case !ok:
+			dsKeys = append(dsKeys, key)
+			dsIndexes = append(dsIndexes, i)
+		case pl == nil:
+			me[i] = datastore.ErrNoSuchEntity
+		default:
+			me[i] = setValue(vals.Index(i), pl)
+		}
+		if me[i] != nil {
+			errsNil = false
+		}
+	}
+	tx.Unlock()
+
+	if len(dsKeys) == len(keys) {
+		return txGetDatastore(c, keys, vals)
+	}
+
+	if len(dsKeys) > 0 {
+		dsVals := reflect.MakeSlice(vals.Type(), len(dsKeys), len(dsKeys))
+		for i, index := range dsIndexes {
+			dsVals.Index(i).Set(vals.Index(index))
+		}
+
+		err := txGetDatastore(c, dsKeys, dsVals)
+		dsErrs, ok := err.(appengine.MultiError)
+		if err != nil && !ok {
+			return err
+		}
+
+		for i, index := range dsIndexes {
+			vals.Index(index).Set(dsVals.Index(i))
+			if dsErrs != nil && dsErrs[i] != nil {
+				me[index] = dsErrs[i]
+				errsNil = false
+			}
+		}
+	}
+
+	if errsNil {
+		return nil
+	}
+	return me
 }
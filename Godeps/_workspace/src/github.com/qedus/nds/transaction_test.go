@@ -1,11 +1,14 @@
 package nds_test
 
 import (
+	"errors"
 	"testing"
 
 	"github.com/qedus/nds"
 	"golang.org/x/net/context"
+	"google.golang.org/appengine"
 	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/memcache"
 )
 
 func TestTransactionOptions(t *testing.T) {
@@ -47,3 +50,244 @@ func TestTransactionOptions(t *testing.T) {
 	}
 
 }
+
+func TestTransactionReadYourWrites(t *testing.T) {
+	c, closeFunc := NewContext(t, nil)
+	defer closeFunc()
+
+	type testEntity struct {
+		Val int
+	}
+
+	parent := datastore.NewKey(c, "Parent", "", 1, nil)
+	keys := []*datastore.Key{
+		datastore.NewKey(c, "Entity", "", 1, parent),
+		datastore.NewKey(c, "Entity", "", 2, parent),
+		datastore.NewKey(c, "Entity", "", 3, parent),
+	}
+	if _, err := nds.PutMulti(c, keys, []testEntity{{1}, {2}, {3}}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := nds.RunInTransaction(c, func(tc context.Context) error {
+		if _, err := nds.Put(tc, keys[0], &testEntity{10}); err != nil {
+			return err
+		}
+		if err := nds.Delete(tc, keys[1]); err != nil {
+			return err
+		}
+
+		entities := make([]testEntity, len(keys))
+		err := nds.GetMulti(tc, keys, entities)
+		me, ok := err.(appengine.MultiError)
+		if !ok {
+			t.Fatal("expected appengine.MultiError", err)
+		}
+		if me[0] != nil || entities[0].Val != 10 {
+			t.Fatal("expected written entity", me[0], entities[0])
+		}
+		if me[1] != datastore.ErrNoSuchEntity {
+			t.Fatal("expected deleted entity", me[1])
+		}
+		if me[2] != nil || entities[2].Val != 3 {
+			t.Fatal("expected datastore entity", me[2], entities[2])
+		}
+		return nil
+	}, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	te := &testEntity{}
+	if err := nds.Get(c, keys[0], te); err != nil {
+		t.Fatal(err)
+	} else if te.Val != 10 {
+		t.Fatal("expected committed entity", te.Val)
+	}
+}
+
+func TestTransactionRollbackDiscardsWrites(t *testing.T) {
+	c, closeFunc := NewContext(t, nil)
+	defer closeFunc()
+
+	type testEntity struct {
+		Val int
+	}
+
+	key := datastore.NewKey(c, "Entity", "", 1, nil)
+	if _, err := nds.Put(c, key, &testEntity{1}); err != nil {
+		t.Fatal(err)
+	}
+
+	rollback := errors.New("rollback")
+	if err := nds.RunInTransaction(c, func(tc context.Context) error {
+		if _, err := nds.Put(tc, key, &testEntity{2}); err != nil {
+			return err
+		}
+		return rollback
+	}, nil); err != rollback {
+		t.Fatal("expected rollback error", err)
+	}
+
+	te := &testEntity{}
+	if err := nds.Get(c, key, te); err != nil {
+		t.Fatal(err)
+	} else if te.Val != 1 {
+		t.Fatal("expected original entity", te.Val)
+	}
+}
+
+// contendedDatastore fails the first fails transactions with
+// datastore.ErrConcurrentTransaction after running them.
+type contendedDatastore struct {
+	countingDatastore
+	fails int
+	xg    bool
+}
+
+func (cd *contendedDatastore) RunInTransaction(c context.Context,
+	f func(tc context.Context) error,
+	opts *datastore.TransactionOptions) error {
+
+	cd.transactions++
+	cd.xg = opts != nil && opts.XG
+	if err := datastore.RunInTransaction(c, f, opts); err != nil {
+		return err
+	}
+	if cd.transactions <= cd.fails {
+		return datastore.ErrConcurrentTransaction
+	}
+	return nil
+}
+
+func TestRunInTransactionWithOptions(t *testing.T) {
+	c, closeFunc := NewContext(t, nil)
+	defer closeFunc()
+
+	type testEntity struct {
+		Val int
+	}
+
+	rc := &recordingCache{}
+	cd := &contendedDatastore{fails: 2}
+	tc := nds.WithDatastore(nds.WithCache(c, rc), cd)
+
+	keys := []*datastore.Key{
+		datastore.NewKey(c, "Entity", "", 1, nil),
+		datastore.NewKey(c, "Group", "", 1, nil),
+	}
+
+	attempts := 0
+	f := func(tc context.Context) error {
+		attempts++
+		_, err := nds.PutMulti(tc, keys, []testEntity{{1}, {2}})
+		return err
+	}
+
+	opts := &nds.TransactionOptions{XG: true, Attempts: 3}
+	if err := nds.RunInTransactionWithOptions(tc, f, opts); err != nil {
+		t.Fatal(err)
+	}
+	if attempts != 3 || cd.transactions != 3 || !cd.xg {
+		t.Fatal("incorrect attempts", attempts, cd.transactions, cd.xg)
+	}
+
+	// Each attempt locks its own keys once rather than accumulating the
+	// locks of failed attempts.
+	if len(rc.setItems) != attempts*len(keys) {
+		t.Fatal("expected one lock per key per attempt", len(rc.setItems))
+	}
+
+	// Running out of attempts returns the contention error.
+	cd.transactions, cd.fails = 0, 5
+	if err := nds.RunInTransactionWithOptions(tc, f,
+		opts); err != datastore.ErrConcurrentTransaction {
+		t.Fatal("expected datastore.ErrConcurrentTransaction", err)
+	}
+}
+
+func TestTransactionManyEntities(t *testing.T) {
+	c, closeFunc := NewContext(t, nil)
+	defer closeFunc()
+
+	type testEntity struct {
+		Val int
+	}
+
+	// Fail any memcache.SetMulti call larger than memcache allows.
+	nds.SetMemcacheSetMulti(func(c context.Context,
+		items []*memcache.Item) error {
+		if len(items) > 500 {
+			return errors.New("too many items")
+		}
+		return memcache.SetMulti(c, items)
+	})
+	defer nds.SetMemcacheSetMulti(memcache.SetMulti)
+
+	parent := datastore.NewKey(c, "Parent", "", 1, nil)
+	keys := make([]*datastore.Key, 600)
+	entities := make([]testEntity, len(keys))
+	for i := range keys {
+		keys[i] = datastore.NewKey(c, "Entity", "", int64(i+1), parent)
+		entities[i].Val = i
+	}
+
+	if err := nds.RunInTransaction(c, func(tc context.Context) error {
+		_, err := nds.PutMulti(tc, keys, entities)
+		return err
+	}, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	got := make([]testEntity, len(keys))
+	if err := nds.GetMulti(c, keys, got); err != nil {
+		t.Fatal(err)
+	}
+	for i := range got {
+		if got[i].Val != i {
+			t.Fatal("incorrect val", i, got[i].Val)
+		}
+	}
+}
+
+func TestTransactionEntityGroupLimit(t *testing.T) {
+	c, closeFunc := NewContext(t, nil)
+	defer closeFunc()
+
+	type testEntity struct {
+		Val int
+	}
+
+	keys := make([]*datastore.Key, 26)
+	for i := range keys {
+		keys[i] = datastore.NewKey(c, "Entity", "", int64(i+1), nil)
+	}
+
+	cd := &countingDatastore{}
+	dc := nds.WithDatastore(c, cd)
+	err := nds.RunInTransaction(dc, func(tc context.Context) error {
+		if _, err := nds.PutMulti(tc, keys[:25],
+			make([]testEntity, 25)); err != nil {
+			t.Fatal(err)
+		}
+		_, err := nds.Put(tc, keys[25], &testEntity{})
+		return err
+	}, &datastore.TransactionOptions{XG: true})
+	if ge, ok := err.(*nds.TooManyEntityGroupsError); !ok ||
+		ge.Groups != 26 || ge.Limit != 25 {
+		t.Fatal("expected entity group limit error", err)
+	} else if !errors.Is(err, nds.ErrTooManyEntityGroups) {
+		t.Fatal("expected nds.ErrTooManyEntityGroups", err)
+	}
+	if cd.puts != 1 {
+		t.Fatal("expected entity over the limit not to be put", cd.puts)
+	}
+
+	// Transactions that are not cross group can write to one entity group.
+	err = nds.RunInTransaction(c, func(tc context.Context) error {
+		_, err := nds.PutMulti(tc, keys[:2], make([]testEntity, 2))
+		return err
+	}, nil)
+	if !errors.Is(err, nds.ErrTooManyEntityGroups) {
+		t.Fatal("expected entity group limit error", err)
+	}
+}
@@ -0,0 +1,113 @@
+package nds
+
+import (
+	"reflect"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+)
+
+var uncachedKindsKey = "used for uncached kinds"
+
+// WithUncachedKinds returns a context that makes GetMulti, PutMulti and
+// DeleteMulti treat entities of each of kinds as if WithNoCache had been used.
+// This suits kinds that are rarely read back, such as logs, which would
+// otherwise evict hot entities from the cache. Entities of other kinds in the
+// same call are cached as usual and results are returned in the order of the
+// keys given.
+func WithUncachedKinds(c context.Context, kinds []string) context.Context {
+	set := make(map[string]bool, len(kinds))
+	for _, kind := range kinds {
+		set[kind] = true
+	}
+	return context.WithValue(c, &uncachedKindsKey, set)
+}
+
+// splitUncachedKinds returns the indexes of keys whose kinds are uncached and
+// the indexes of the rest. Nil keys are left with the rest.
+func splitUncachedKinds(c context.Context,
+	keys []*datastore.Key) ([]int, []int) {
+
+	kinds, _ := c.Value(&uncachedKindsKey).(map[string]bool)
+	if len(kinds) == 0 {
+		return nil, nil
+	}
+
+	var uncached, cached []int
+	for i, key := range keys {
+		if key != nil && kinds[key.Kind()] {
+			uncached = append(uncached, i)
+		} else {
+			cached = append(cached, i)
+		}
+	}
+	return uncached, cached
+}
+
+// runUncachedSplit calls f for the keys at uncached indexes with a context
+// using WithNoCache and for the keys at cached indexes as usual, then collates
+// the keys and errors f returns in the order of keys. vals, which may be the
+// zero reflect.Value, is split alongside keys and copied back afterwards.
+func runUncachedSplit(c context.Context, keys []*datastore.Key,
+	vals reflect.Value, uncached, cached []int,
+	f func(context.Context, []*datastore.Key,
+		reflect.Value) ([]*datastore.Key, error)) ([]*datastore.Key, error) {
+
+	c = context.WithValue(c, &uncachedKindsKey, map[string]bool(nil))
+
+	resKeys := make([]*datastore.Key, len(keys))
+	errs := make(appengine.MultiError, len(keys))
+	runIndexes(WithNoCache(c), keys, vals, uncached, f, resKeys, errs)
+	runIndexes(c, keys, vals, cached, f, resKeys, errs)
+
+	for _, err := range errs {
+		if err != nil {
+			return nil, errs
+		}
+	}
+	return resKeys, nil
+}
+
+// runIndexes calls f with the keys, and vals if valid, at indexes and copies
+// the values, result keys and errors f returns back to their indexes in vals,
+// resKeys and errs.
+func runIndexes(c context.Context, keys []*datastore.Key, vals reflect.Value,
+	indexes []int, f func(context.Context, []*datastore.Key,
+		reflect.Value) ([]*datastore.Key, error),
+	resKeys []*datastore.Key, errs appengine.MultiError) {
+
+	if len(indexes) == 0 {
+		return
+	}
+
+	subKeys := make([]*datastore.Key, len(indexes))
+	var subVals reflect.Value
+	if vals.IsValid() {
+		subVals = reflect.MakeSlice(vals.Type(), len(indexes), len(indexes))
+	}
+	for i, index := range indexes {
+		subKeys[i] = keys[index]
+		if vals.IsValid() {
+			subVals.Index(i).Set(vals.Index(index))
+		}
+	}
+
+	subResKeys, err := f(c, subKeys, subVals)
+	me, ok := err.(appengine.MultiError)
+	for i, index := range indexes {
+		if vals.IsValid() {
+			vals.Index(index).Set(subVals.Index(i))
+		}
+		switch {
+		case err == nil:
+			if subResKeys != nil {
+				resKeys[index] = subResKeys[i]
+			}
+		case ok:
+			errs[index] = me[i]
+		default:
+			errs[index] = err
+		}
+	}
+}
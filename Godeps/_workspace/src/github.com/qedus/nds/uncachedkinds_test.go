@@ -0,0 +1,66 @@
+package nds_test
+
+import (
+	"testing"
+
+	"github.com/qedus/nds"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+)
+
+func TestWithUncachedKinds(t *testing.T) {
+	c, closeFunc := NewContext(t, nil)
+	defer closeFunc()
+
+	type testEntity struct {
+		Val int
+	}
+
+	rc := &recordingCache{}
+	uc := nds.WithUncachedKinds(nds.WithCache(c, rc), []string{"Log"})
+
+	keys := []*datastore.Key{
+		datastore.NewKey(c, "Log", "", 1, nil),
+		datastore.NewKey(c, "Entity", "", 1, nil),
+		datastore.NewKey(c, "Log", "", 2, nil),
+	}
+	entities := []testEntity{{1}, {2}, {3}}
+	if _, err := nds.PutMulti(uc, keys, entities); err != nil {
+		t.Fatal(err)
+	}
+	if len(rc.setItems) != 1 {
+		t.Fatal("expected only the cached kind to be locked", rc.setItems)
+	}
+
+	rc.getKeys = nil
+	got := make([]testEntity, len(keys))
+	if err := nds.GetMulti(uc, keys, got); err != nil {
+		t.Fatal(err)
+	}
+	for i, te := range got {
+		if te.Val != entities[i].Val {
+			t.Fatal("incorrect val", i, te.Val)
+		}
+	}
+	if len(rc.getKeys) != 2 || len(rc.addItems) != 1 {
+		t.Fatal("expected only the cached kind to be cached", rc.getKeys)
+	}
+
+	if err := nds.DeleteMulti(uc, keys); err != nil {
+		t.Fatal(err)
+	}
+	if len(rc.setItems) != 2 {
+		t.Fatal("expected only the cached kind to be locked", rc.setItems)
+	}
+
+	err := nds.GetMulti(uc, keys, make([]testEntity, len(keys)))
+	me, ok := err.(appengine.MultiError)
+	if !ok {
+		t.Fatal("expected appengine.MultiError", err)
+	}
+	for i, err := range me {
+		if err != datastore.ErrNoSuchEntity {
+			t.Fatal("expected datastore.ErrNoSuchEntity", i, err)
+		}
+	}
+}
@@ -0,0 +1,253 @@
+package nds
+
+import (
+	"fmt"
+	"reflect"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/memcache"
+)
+
+// uniqueProperties records the unique properties of each kind looked up with
+// GetByUnique in this instance, so writes to entities of the kind clear their
+// unique mappings.
+var uniqueProperties = struct {
+	sync.RWMutex
+	m map[string]map[string]bool
+}{m: map[string]map[string]bool{}}
+
+func addUniqueProperty(kind, property string) {
+	uniqueProperties.RLock()
+	ok := uniqueProperties.m[kind][property]
+	uniqueProperties.RUnlock()
+	if ok {
+		return
+	}
+
+	uniqueProperties.Lock()
+	if uniqueProperties.m[kind] == nil {
+		uniqueProperties.m[kind] = map[string]bool{}
+	}
+	uniqueProperties.m[kind][property] = true
+	uniqueProperties.Unlock()
+}
+
+// GetByUnique loads into val the entity of kind whose property equals value,
+// returning its key. property must be indexed and hold a distinct value for
+// every entity of kind. val must be a struct pointer or implement
+// datastore.PropertyLoadSaver, as with Get, and datastore.ErrNoSuchEntity is
+// returned if no entity has the value.
+//
+// The key each value maps to is cached, so repeated lookups need no query and
+// the entity itself is then got through the cache as Get does. As the query
+// is eventually consistent, its result is checked against the entity got by
+// key and a mapping is only cached if the entity has the value. Putting or
+// deleting an entity with PutMulti or DeleteMulti clears the cached mappings
+// to it from values looked up by this instance, and a mapping is discarded
+// whenever the entity it leads to no longer has the value. However entities
+// written outside NDS are not invalidated in the cache, so if the property is
+// changed that way GetByUnique can keep returning the stale entity until its
+// cache entry expires, just as Get would. Lookups are by datastore key so any
+// key mapper set on c is not applied. GetByUnique cannot be used within a
+// transaction as it queries outside of any entity group.
+func GetByUnique(c context.Context, kind, property string, value interface{},
+	val interface{}) (*datastore.Key, error) {
+
+	v := reflect.ValueOf(val)
+	if v.Kind() != reflect.Ptr || v.IsNil() {
+		return nil, datastore.ErrInvalidEntityType
+	}
+	if err := checkCacheKeyPrefix(c); err != nil {
+		return nil, err
+	}
+	c = withoutKeyMapper(c)
+	addUniqueProperty(kind, property)
+
+	mappingKey := createUniqueMemcacheKey(c, kind, property, value)
+	if key := loadUniqueMapping(c, mappingKey); key != nil {
+		switch err := Get(c, key, val); err {
+		case nil:
+			if hasUniqueValue(v, property, value) {
+				return key, nil
+			}
+		case datastore.ErrNoSuchEntity:
+		default:
+			return nil, err
+		}
+		if err := cacheFromContext(c).DeleteMulti(c,
+			[]string{mappingKey}); err != nil && !isCacheMissErrors(err) {
+			warningf(c, "nds:GetByUnique DeleteMulti %s", err)
+		}
+	}
+
+	q := datastore.NewQuery(kind).Filter(property+" =", value).KeysOnly().
+		Limit(2)
+	sc, endSpan := startSpan(c, "datastore", "datastore.GetAll", 1)
+	keys, err := q.GetAll(sc, nil)
+	endSpan(err)
+	addStat(c, statDatastoreReads, 1)
+	switch {
+	case err != nil:
+		return nil, err
+	case len(keys) == 0:
+		return nil, datastore.ErrNoSuchEntity
+	case len(keys) > 1:
+		return nil, fmt.Errorf("nds: %s of kind %s is not unique for %v",
+			property, kind, value)
+	}
+
+	// The query is eventually consistent, so only trust its result once the
+	// entity got by key confirms it still has the value.
+	key := keys[0]
+	if err := Get(c, key, val); err != nil {
+		return nil, err
+	}
+	if !hasUniqueValue(v, property, value) {
+		return nil, datastore.ErrNoSuchEntity
+	}
+	saveUniqueMapping(c, key, property, mappingKey)
+	return key, nil
+}
+
+// createUniqueMemcacheKey returns the memcache key mapping value of property
+// to the key of the entity of kind that has it.
+func createUniqueMemcacheKey(c context.Context, kind, property string,
+	value interface{}) string {
+
+	kindKey := datastore.NewIncompleteKey(c, kind, nil)
+	return limitKindMemcacheKey(c, kind, fmt.Sprintf("%s%s:unique:%s:%T:%v",
+		memcachePrefix, encodeCacheKey(c, kindKey), property, value, value))
+}
+
+// createUniqueReverseMemcacheKey returns the memcache key recording the
+// mapping from property to key, so it can be cleared when key is written.
+func createUniqueReverseMemcacheKey(c context.Context, key *datastore.Key,
+	property string) string {
+
+	return limitKindMemcacheKey(c, key.Kind(),
+		memcachePrefix+encodeCacheKey(c, key)+":unique:"+property)
+}
+
+// loadUniqueMapping returns the key cached under mappingKey, or nil if there
+// is none.
+func loadUniqueMapping(c context.Context, mappingKey string) *datastore.Key {
+	if isNoCache(c) {
+		return nil
+	}
+	items, err := cacheFromContext(c).GetMulti(c, []string{mappingKey})
+	if err != nil {
+		warningf(c, "nds:GetByUnique GetMulti %s", err)
+		return nil
+	}
+	item, ok := items[mappingKey]
+	if !ok || itemType(item.Flags) != keyItem {
+		return nil
+	}
+	key, err := decodeCacheKey(c, string(item.Value))
+	if err != nil {
+		warningf(c, "nds:GetByUnique DecodeKey %s", err)
+		return nil
+	}
+	addStat(c, statMemcacheHits, 1)
+	return key
+}
+
+// saveUniqueMapping caches the mapping from mappingKey to key along with the
+// reverse mapping used to clear it.
+func saveUniqueMapping(c context.Context, key *datastore.Key, property,
+	mappingKey string) {
+
+	if isNoCache(c) {
+		return
+	}
+	items := []*memcache.Item{
+		{
+			Key:        mappingKey,
+			Flags:      keyItem,
+			Value:      []byte(encodeCacheKey(c, key)),
+			Expiration: entityExpiration(c, key),
+		},
+		{
+			Key:        createUniqueReverseMemcacheKey(c, key, property),
+			Flags:      keyItem,
+			Value:      []byte(mappingKey),
+			Expiration: entityExpiration(c, key),
+		},
+	}
+	if err := cacheFromContext(c).SetMulti(c, items); err != nil {
+		warningf(c, "nds:GetByUnique SetMulti %s", err)
+	}
+}
+
+// hasUniqueValue reports whether the entity in val has value for property.
+func hasUniqueValue(val reflect.Value, property string,
+	value interface{}) bool {
+
+	pl, err := saveValue(val)
+	if err != nil {
+		return false
+	}
+	value = normalizeUniqueValue(value)
+	for _, p := range pl {
+		if p.Name != property {
+			continue
+		}
+		if t, ok := p.Value.(time.Time); ok {
+			if u, ok := value.(time.Time); ok && t.Equal(u) {
+				return true
+			}
+		} else if reflect.DeepEqual(normalizeUniqueValue(p.Value), value) {
+			return true
+		}
+	}
+	return false
+}
+
+// normalizeUniqueValue converts numeric values to the int64 and float64 types
+// the datastore stores them as.
+func normalizeUniqueValue(value interface{}) interface{} {
+	v := reflect.ValueOf(value)
+	switch v.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32,
+		reflect.Int64:
+		return v.Int()
+	case reflect.Float32, reflect.Float64:
+		return v.Float()
+	}
+	return value
+}
+
+// clearUniqueMappings deletes the cached unique mappings to keys.
+func clearUniqueMappings(c context.Context, keys []*datastore.Key) {
+	uniqueProperties.RLock()
+	var reverseKeys []string
+	for _, key := range keys {
+		for property := range uniqueProperties.m[key.Kind()] {
+			reverseKeys = append(reverseKeys,
+				createUniqueReverseMemcacheKey(c, key, property))
+		}
+	}
+	uniqueProperties.RUnlock()
+	if len(reverseKeys) == 0 {
+		return
+	}
+
+	items, err := cacheFromContext(c).GetMulti(c, reverseKeys)
+	if err != nil {
+		warningf(c, "nds:clearUniqueMappings GetMulti %s", err)
+		return
+	}
+	memcacheKeys := reverseKeys
+	for _, item := range items {
+		if itemType(item.Flags) == keyItem {
+			memcacheKeys = append(memcacheKeys, string(item.Value))
+		}
+	}
+	if err := cacheFromContext(c).DeleteMulti(c, memcacheKeys); err != nil &&
+		!isCacheMissErrors(err) {
+		warningf(c, "nds:clearUniqueMappings DeleteMulti %s", err)
+	}
+}
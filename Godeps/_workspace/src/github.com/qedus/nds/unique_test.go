@@ -0,0 +1,120 @@
+package nds_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/qedus/nds"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/memcache"
+
+	"appengine/aetest"
+)
+
+func TestGetByUnique(t *testing.T) {
+	c, closeFunc := NewContext(t, &aetest.Options{
+		StronglyConsistentDatastore: true,
+	})
+	defer closeFunc()
+
+	type user struct {
+		Email string
+		Age   int
+	}
+
+	rc := &recordingCache{}
+	cc := nds.WithCache(c, rc)
+
+	key := datastore.NewKey(c, "User", "", 1, nil)
+	if _, err := nds.Put(cc, key, &user{"a@example.com", 30}); err != nil {
+		t.Fatal(err)
+	}
+
+	u := &user{}
+	if _, err := nds.GetByUnique(cc, "User", "Email", "b@example.com",
+		u); err != datastore.ErrNoSuchEntity {
+		t.Fatal("expected datastore.ErrNoSuchEntity", err)
+	}
+
+	rc.setItems = nil
+	if got, err := nds.GetByUnique(cc, "User", "Email", "a@example.com",
+		u); err != nil {
+		t.Fatal(err)
+	} else if !got.Equal(key) || u.Age != 30 {
+		t.Fatal("incorrect entity", got, u)
+	}
+	if len(rc.setItems) != 2 {
+		t.Fatal("expected mapping to be cached", len(rc.setItems))
+	}
+
+	// Numeric values are matched whatever their type.
+	if got, err := nds.GetByUnique(cc, "User", "Age", int32(30),
+		&user{}); err != nil {
+		t.Fatal(err)
+	} else if !got.Equal(key) {
+		t.Fatal("incorrect key", got)
+	}
+
+	// Changing the property clears the old mapping.
+	rc.delKeys = nil
+	if _, err := nds.Put(cc, key, &user{"b@example.com", 30}); err != nil {
+		t.Fatal(err)
+	}
+	if len(rc.delKeys) < 3 {
+		t.Fatal("expected mappings to be cleared", rc.delKeys)
+	}
+	if _, err := nds.GetByUnique(cc, "User", "Email", "a@example.com",
+		u); err != datastore.ErrNoSuchEntity {
+		t.Fatal("expected datastore.ErrNoSuchEntity", err)
+	}
+	if got, err := nds.GetByUnique(cc, "User", "Email", "b@example.com",
+		u); err != nil {
+		t.Fatal(err)
+	} else if !got.Equal(key) || u.Email != "b@example.com" {
+		t.Fatal("incorrect entity", got, u)
+	}
+
+	// A mapping left stale by a write outside NDS is discarded.
+	if _, err := datastore.Put(c, key, &user{"c@example.com", 30}); err != nil {
+		t.Fatal(err)
+	}
+	if err := memcache.Delete(c, nds.CacheKey(c, key)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := nds.GetByUnique(c, "User", "Email", "b@example.com",
+		u); err != datastore.ErrNoSuchEntity {
+		t.Fatal("expected datastore.ErrNoSuchEntity", err)
+	}
+
+	// A query result the entity got by key contradicts is not cached.
+	if err := nds.Get(cc, key, u); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := datastore.Put(c, key, &user{"e@example.com", 30}); err != nil {
+		t.Fatal(err)
+	}
+	rc.setItems = nil
+	if _, err := nds.GetByUnique(cc, "User", "Email", "e@example.com",
+		u); err != datastore.ErrNoSuchEntity {
+		t.Fatal("expected datastore.ErrNoSuchEntity", err)
+	}
+	for _, item := range rc.setItems {
+		if strings.Contains(item.Key, ":unique:") {
+			t.Fatal("expected mapping not to be cached", item.Key)
+		}
+	}
+
+	keys := []*datastore.Key{
+		datastore.NewKey(c, "User", "", 2, nil),
+		datastore.NewKey(c, "User", "", 3, nil),
+	}
+	if _, err := nds.PutMulti(c, keys, []user{
+		{"d@example.com", 40}, {"d@example.com", 41},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := nds.GetByUnique(c, "User", "Email", "d@example.com",
+		u); err == nil {
+		t.Fatal("expected not unique error")
+	}
+}
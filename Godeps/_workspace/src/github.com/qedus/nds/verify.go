@@ -0,0 +1,168 @@
+package nds
+
+import (
+	"bytes"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/memcache"
+)
+
+// Verify compares the cached entity for each key with a fresh read from the
+// datastore and returns the keys whose cached entity differs, including keys
+// cached as missing that now have an entity and the reverse. It is a read
+// only diagnostic for tracking down stale cache entries and neither the cache
+// nor the datastore is modified.
+//
+// Keys that are not cached, or that are locked because they are being written
+// or read through, are never reported. Keys are processed in batches of at most
+// 1000. If any keys cannot be verified, including nil keys, a
+// appengine.MultiError is returned with an error for each such key alongside
+// the drifted keys that were found. Entities cached without their
+// nds:"nocache" fields are only compared on the properties that were cached.
+func Verify(c context.Context,
+	keys []*datastore.Key) ([]*datastore.Key, error) {
+
+	if err := checkCacheKeyPrefix(c); err != nil {
+		return nil, err
+	}
+
+	size := batchSize(c, getMultiLimit)
+	batches := make([][]*datastore.Key, (len(keys)+size-1)/size)
+	err := runBatches(c, len(keys), size, func(lo, hi int) error {
+		d, err := verifyMulti(c, keys[lo:hi])
+		batches[lo/size] = d
+		return err
+	})
+
+	var drifted []*datastore.Key
+	for _, d := range batches {
+		drifted = append(drifted, d...)
+	}
+	return drifted, err
+}
+
+func verifyMulti(c context.Context,
+	keys []*datastore.Key) ([]*datastore.Key, error) {
+
+	memcacheKeys := make([]string, len(keys))
+	getKeys := make([]string, 0, len(keys))
+	for i, key := range keys {
+		if key != nil {
+			memcacheKeys[i] = createMemcacheKey(c, key)
+			getKeys = append(getKeys, memcacheKeys[i])
+		}
+	}
+
+	items, err := cacheFromContext(c).GetMulti(c, getKeys)
+	if err != nil {
+		return nil, err
+	}
+
+	// Only read the entities that are cached.
+	dsKeys := make([]*datastore.Key, 0, len(keys))
+	dsIndexes := make([]int, 0, len(keys))
+	for i, memcacheKey := range memcacheKeys {
+		item, ok := items[memcacheKey]
+		if !ok {
+			continue
+		}
+		switch itemType(item.Flags) {
+		case noneItem, entityItem:
+			dsKeys = append(dsKeys, keys[i])
+			dsIndexes = append(dsIndexes, i)
+		}
+	}
+	pls := make([]datastore.PropertyList, len(dsKeys))
+	var dsErrs appengine.MultiError
+	if len(dsKeys) > 0 {
+		err := getDatastore(c, dsKeys, pls)
+		me, ok := err.(appengine.MultiError)
+		if err != nil && !ok {
+			return nil, err
+		}
+		dsErrs = me
+	}
+
+	var drifted []*datastore.Key
+	me, errsNil := make(appengine.MultiError, len(keys)), true
+	for i, key := range keys {
+		if key == nil {
+			me[i] = datastore.ErrInvalidKey
+			errsNil = false
+		}
+	}
+	for i, index := range dsIndexes {
+		var dsErr error
+		if dsErrs != nil {
+			dsErr = dsErrs[i]
+		}
+		if dsErr != nil && dsErr != datastore.ErrNoSuchEntity {
+			me[index] = dsErr
+			errsNil = false
+			continue
+		}
+
+		same, err := cachedEquals(c, keys[index],
+			items[memcacheKeys[index]], pls[i], dsErr == nil)
+		switch {
+		case err != nil:
+			me[index] = err
+			errsNil = false
+		case !same:
+			drifted = append(drifted, keys[index])
+		}
+	}
+
+	if errsNil {
+		return drifted, nil
+	}
+	return drifted, me
+}
+
+// cachedEquals reports whether the cached item for key holds the same entity
+// as pl, or holds a missing entity if exists is false.
+func cachedEquals(c context.Context, key *datastore.Key, item *memcache.Item,
+	pl datastore.PropertyList, exists bool) (bool, error) {
+
+	if itemType(item.Flags) == noneItem || !exists {
+		return itemType(item.Flags) == noneItem && !exists, nil
+	}
+
+	codec := codecFor(c, key)
+	cached, err := decodeEntityItem(c, key, codec, item)
+	if isReplaceableItemError(err) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	if item.Flags&partialFlag != 0 {
+		pl = cachedProperties(pl, cached)
+	}
+	cachedData, err := codec.Marshal(cached)
+	if err != nil {
+		return false, err
+	}
+	data, err := codec.Marshal(pl)
+	if err != nil {
+		return false, err
+	}
+	return bytes.Equal(cachedData, data), nil
+}
+
+// cachedProperties returns the properties of pl with names held in cached, so
+// that a partial cache entry is only compared on the properties it holds.
+func cachedProperties(pl, cached datastore.PropertyList) datastore.PropertyList {
+	names := make(map[string]bool, len(cached))
+	for _, p := range cached {
+		names[p.Name] = true
+	}
+	filtered := make(datastore.PropertyList, 0, len(pl))
+	for _, p := range pl {
+		if names[p.Name] {
+			filtered = append(filtered, p)
+		}
+	}
+	return filtered
+}
@@ -0,0 +1,71 @@
+package nds_test
+
+import (
+	"testing"
+
+	"github.com/qedus/nds"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+)
+
+func TestVerify(t *testing.T) {
+	c, closeFunc := NewContext(t, nil)
+	defer closeFunc()
+
+	type testEntity struct {
+		Val int
+	}
+
+	keys := []*datastore.Key{
+		datastore.NewKey(c, "Entity", "", 1, nil),
+		datastore.NewKey(c, "Entity", "", 2, nil),
+		datastore.NewKey(c, "Entity", "", 3, nil),
+		datastore.NewKey(c, "Entity", "", 4, nil),
+	}
+	if _, err := nds.PutMulti(c, keys[:3],
+		[]testEntity{{1}, {2}, {3}}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Cache all but the third entity, the fourth as missing.
+	cached := []*datastore.Key{keys[0], keys[1], keys[3]}
+	if _, err := nds.Warm(c, cached); err != nil {
+		t.Fatal(err)
+	}
+
+	if drifted, err := nds.Verify(c, keys); err != nil {
+		t.Fatal(err)
+	} else if len(drifted) != 0 {
+		t.Fatal("expected no drifted keys", drifted)
+	}
+
+	// Change the datastore behind the cache's back.
+	if _, err := datastore.Put(c, keys[1], &testEntity{22}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := datastore.Put(c, keys[3], &testEntity{4}); err != nil {
+		t.Fatal(err)
+	}
+
+	rc := &recordingCache{}
+	drifted, err := nds.Verify(nds.WithCache(c, rc), keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(drifted) != 2 || !drifted[0].Equal(keys[1]) ||
+		!drifted[1].Equal(keys[3]) {
+		t.Fatal("incorrect drifted keys", drifted)
+	}
+	if len(rc.setItems) != 0 || len(rc.addItems) != 0 ||
+		len(rc.casItems) != 0 || len(rc.delKeys) != 0 {
+		t.Fatal("expected cache to be unmodified")
+	}
+
+	// Nil keys cannot be verified.
+	_, err = nds.Verify(c, []*datastore.Key{keys[0], nil})
+	if me, ok := err.(appengine.MultiError); !ok {
+		t.Fatal("expected appengine.MultiError", err)
+	} else if me[0] != nil || me[1] != datastore.ErrInvalidKey {
+		t.Fatal("incorrect errors", me)
+	}
+}
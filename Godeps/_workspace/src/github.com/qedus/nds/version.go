@@ -0,0 +1,206 @@
+package nds
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"sync"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+)
+
+// ErrConcurrentModification is returned by PutMulti for a versioned entity
+// whose version does not match the version stored in the datastore, meaning
+// it was modified since it was read.
+var ErrConcurrentModification = errors.New("nds: concurrent modification")
+
+// versionField describes the version field of a struct type.
+type versionField struct {
+	index []int
+	name  string
+}
+
+var versionFields = struct {
+	sync.Mutex
+	m map[reflect.Type]*versionField
+}{m: map[reflect.Type]*versionField{}}
+
+// structVersionField returns the version field of struct type t, or nil if it
+// has none. Only signed integer fields tagged nds:"version" are recognised.
+func structVersionField(t reflect.Type) *versionField {
+	versionFields.Lock()
+	defer versionFields.Unlock()
+	if vf, ok := versionFields.m[t]; ok {
+		return vf
+	}
+
+	var vf *versionField
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if field.Tag.Get("nds") != "version" {
+			continue
+		}
+		switch field.Type.Kind() {
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32,
+			reflect.Int64:
+		default:
+			continue
+		}
+
+		name := strings.Split(field.Tag.Get("datastore"), ",")[0]
+		if name == "" {
+			name = field.Name
+		}
+		vf = &versionField{index: field.Index, name: name}
+		break
+	}
+	versionFields.m[t] = vf
+	return vf
+}
+
+// versionedStruct returns the addressable struct held by val and its version
+// field if it has one.
+func versionedStruct(val reflect.Value) (reflect.Value, *versionField) {
+	for val.Kind() == reflect.Interface || val.Kind() == reflect.Ptr {
+		if val.IsNil() {
+			return reflect.Value{}, nil
+		}
+		val = val.Elem()
+	}
+	if val.Kind() != reflect.Struct || !val.CanAddr() {
+		return reflect.Value{}, nil
+	}
+	return val, structVersionField(val.Type())
+}
+
+// hasVersionedStruct reports whether any element of vals is versioned.
+func hasVersionedStruct(vals reflect.Value) bool {
+	for i := 0; i < vals.Len(); i++ {
+		if _, vf := versionedStruct(vals.Index(i)); vf != nil {
+			return true
+		}
+	}
+	return false
+}
+
+var versionCheckedKey = "used for version checked puts"
+
+func isVersionChecked(c context.Context) bool {
+	checked, _ := c.Value(&versionCheckedKey).(bool)
+	return checked
+}
+
+// putVersionedMulti puts the entities in vals, checking and incrementing the
+// version of each versioned entity while holding its write lock.
+func putVersionedMulti(c context.Context, keys []*datastore.Key,
+	vals reflect.Value) ([]*datastore.Key, error) {
+
+	c = context.WithValue(c, &versionCheckedKey, true)
+
+	putKeys := make([]*datastore.Key, len(keys))
+	errs := make(appengine.MultiError, len(keys))
+
+	var restKeys []*datastore.Key
+	var restIndexes []int
+	wg := sync.WaitGroup{}
+	for i := range keys {
+		val, vf := versionedStruct(vals.Index(i))
+		if vf == nil {
+			restKeys = append(restKeys, keys[i])
+			restIndexes = append(restIndexes, i)
+			continue
+		}
+
+		wg.Add(1)
+		go func(i int) {
+			putKeys[i], errs[i] = putVersioned(c, keys[i], val, vf)
+			wg.Done()
+		}(i)
+	}
+
+	if len(restKeys) > 0 {
+		restVals := reflect.MakeSlice(vals.Type(), len(restKeys),
+			len(restKeys))
+		for i, index := range restIndexes {
+			restVals.Index(i).Set(vals.Index(index))
+		}
+
+		restPutKeys, err := PutMulti(c, restKeys, restVals.Interface())
+		me, ok := err.(appengine.MultiError)
+		for i, index := range restIndexes {
+			switch {
+			case err == nil:
+				putKeys[index] = restPutKeys[i]
+			case ok:
+				errs[index] = me[i]
+			default:
+				errs[index] = err
+			}
+		}
+	}
+	wg.Wait()
+
+	for _, err := range errs {
+		if err != nil {
+			return nil, errs
+		}
+	}
+	return putKeys, nil
+}
+
+// putVersioned puts the versioned entity val if its version matches the one
+// stored in the datastore, incrementing its version as it does so. The stored
+// version is read straight from the datastore under the write lock of key, so
+// no other versioned put of the entity can come between the check and the put.
+func putVersioned(c context.Context, key *datastore.Key, val reflect.Value,
+	vf *versionField) (*datastore.Key, error) {
+
+	field := val.FieldByIndex(vf.index)
+	expected := field.Int()
+
+	var putKey *datastore.Key
+	f := func(tc context.Context) error {
+		field.SetInt(expected)
+
+		if !key.Incomplete() {
+			pls := make([]datastore.PropertyList, 1)
+			err := getDatastore(tc, []*datastore.Key{key}, pls)
+			err = singleError(err)
+			var current int64
+			switch err {
+			case nil:
+				for _, p := range pls[0] {
+					if p.Name == vf.name {
+						current, _ = p.Value.(int64)
+					}
+				}
+			case datastore.ErrNoSuchEntity:
+			default:
+				return err
+			}
+			if current != expected {
+				return ErrConcurrentModification
+			}
+		} else if expected != 0 {
+			return ErrConcurrentModification
+		}
+
+		field.SetInt(expected + 1)
+		keys, err := PutMulti(tc, []*datastore.Key{key},
+			[]interface{}{val.Addr().Interface()})
+		err = singleError(err)
+		if err != nil {
+			return err
+		}
+		putKey = keys[0]
+		return nil
+	}
+
+	if err := runWriteLocked(c, key, f); err != nil {
+		field.SetInt(expected)
+		return nil, err
+	}
+	return putKey, nil
+}
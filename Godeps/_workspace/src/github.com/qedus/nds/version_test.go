@@ -0,0 +1,154 @@
+package nds_test
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/qedus/nds"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/memcache"
+)
+
+func TestPutVersioned(t *testing.T) {
+	c, closeFunc := NewContext(t, nil)
+	defer closeFunc()
+
+	type testEntity struct {
+		Val     int
+		Version int64 `nds:"version"`
+	}
+
+	key := datastore.NewKey(c, "Entity", "", 1, nil)
+	entity := &testEntity{Val: 1}
+	if _, err := nds.Put(c, key, entity); err != nil {
+		t.Fatal(err)
+	} else if entity.Version != 1 {
+		t.Fatal("expected version to be incremented", entity.Version)
+	}
+
+	// Two writers read the same version.
+	first, second := &testEntity{}, &testEntity{}
+	if err := nds.Get(c, key, first); err != nil {
+		t.Fatal(err)
+	}
+	if err := nds.Get(c, key, second); err != nil {
+		t.Fatal(err)
+	}
+
+	first.Val = 2
+	if _, err := nds.Put(c, key, first); err != nil {
+		t.Fatal(err)
+	} else if first.Version != 2 {
+		t.Fatal("incorrect version", first.Version)
+	}
+
+	second.Val = 3
+	if _, err := nds.Put(c, key, second); err == nil {
+		t.Fatal("expected error")
+	} else if ke, ok := err.(*nds.KeyError); !ok ||
+		ke.Err != nds.ErrConcurrentModification {
+		t.Fatal("expected nds.ErrConcurrentModification", err)
+	}
+	if second.Version != 1 {
+		t.Fatal("version should be unchanged", second.Version)
+	}
+
+	got := &testEntity{}
+	if err := nds.Get(c, key, got); err != nil {
+		t.Fatal(err)
+	} else if got.Val != 2 || got.Version != 2 {
+		t.Fatal("incorrect entity", got)
+	}
+
+	// Unversioned entities in the same call are put as usual.
+	type plainEntity struct {
+		Val int
+	}
+	keys := []*datastore.Key{key, datastore.NewKey(c, "Plain", "", 1, nil)}
+	vals := []interface{}{got, &plainEntity{4}}
+	if _, err := nds.PutMulti(c, keys, vals); err != nil {
+		t.Fatal(err)
+	} else if got.Version != 3 {
+		t.Fatal("incorrect version", got.Version)
+	}
+}
+
+func TestPutVersionedRacing(t *testing.T) {
+	c, closeFunc := NewContext(t, nil)
+	defer closeFunc()
+
+	type testEntity struct {
+		Val     int
+		Version int64 `nds:"version"`
+	}
+
+	key := datastore.NewKey(c, "Entity", "", 1, nil)
+	if _, err := nds.Put(c, key, &testEntity{}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Writers that read the same version are serialized by the write lock,
+	// so only the first of them can put the entity.
+	const writers = 5
+	errs := make([]error, writers)
+	wg := sync.WaitGroup{}
+	for i := 0; i < writers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			_, errs[i] = nds.Put(c, key, &testEntity{Val: i, Version: 1})
+		}(i)
+	}
+	wg.Wait()
+
+	written := 0
+	for _, err := range errs {
+		if err == nil {
+			written++
+		} else if ke, ok := err.(*nds.KeyError); !ok ||
+			ke.Err != nds.ErrConcurrentModification {
+			t.Fatal("expected nds.ErrConcurrentModification", err)
+		}
+	}
+	if written != 1 {
+		t.Fatal("expected exactly one put", errs)
+	}
+
+	got := &testEntity{}
+	if err := nds.Get(c, key, got); err != nil {
+		t.Fatal(err)
+	} else if got.Version != 2 {
+		t.Fatal("incorrect version", got.Version)
+	}
+	if _, err := memcache.Get(c, nds.CreateMemcacheKey(key)+
+		":write"); err != memcache.ErrCacheMiss {
+		t.Fatal("expected the write lock to be released", err)
+	}
+}
+
+func TestPutVersionedCacheDown(t *testing.T) {
+	c, closeFunc := NewContext(t, nil)
+	defer closeFunc()
+
+	type testEntity struct {
+		Val     int
+		Version int64 `nds:"version"`
+	}
+
+	key := datastore.NewKey(c, "Entity", "", 1, nil)
+	if _, err := nds.Put(c, key, &testEntity{}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Without the write lock the check is made within a transaction.
+	nds.ResetCacheProbe()
+	defer nds.ResetCacheProbe()
+	fc := &flakyCache{down: true}
+	entity := &testEntity{Val: 1, Version: 1}
+	if _, err := nds.Put(nds.WithCacheOptional(nds.WithCache(c, fc)), key,
+		entity); err != nil {
+		t.Fatal(err)
+	} else if entity.Version != 2 {
+		t.Fatal("incorrect version", entity.Version)
+	}
+}
@@ -0,0 +1,107 @@
+package nds
+
+import (
+	"errors"
+	"reflect"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+)
+
+// Warm reads the entities for keys from the datastore and stores them in
+// memcache exactly as GetMulti would, without the caller having to supply
+// somewhere to load them into. Keys that are already cached, or that are being
+// cached or updated by another request, are skipped. Keys without an entity
+// are cached as missing. Warm returns the number of keys that were written to
+// memcache, the remainder having been skipped.
+//
+// Keys are processed in batches of at most 500. If any keys fail to be read a
+// appengine.MultiError is returned with an error for each such key, and nil or
+// incomplete keys are reported as datastore.ErrInvalidKey. Warm cannot be
+// used within a transaction.
+func Warm(c context.Context, keys []*datastore.Key) (int, error) {
+	if _, ok := transactionFromContext(c); ok {
+		return 0, errors.New("nds: Warm cannot be used within a transaction")
+	}
+
+	size := batchSize(c, putMultiLimit)
+	counts := make([]int, (len(keys)+size-1)/size)
+	err := runBatches(c, len(keys), size, func(lo, hi int) error {
+		n, err := warmMulti(c, keys[lo:hi])
+		counts[lo/size] = n
+		return err
+	})
+
+	warmed := 0
+	for _, n := range counts {
+		warmed += n
+	}
+	return warmed, err
+}
+
+func warmMulti(c context.Context, keys []*datastore.Key) (int, error) {
+	expiration, err := lockTime(c)
+	if err != nil {
+		return 0, err
+	}
+	if err := checkCacheKeyPrefix(c); err != nil {
+		return 0, err
+	}
+
+	me, errsNil := make(appengine.MultiError, len(keys)), true
+	indexes := make([]int, 0, len(keys))
+	for i, key := range keys {
+		if key == nil || key.Incomplete() {
+			me[i] = datastore.ErrInvalidKey
+			errsNil = false
+		} else {
+			indexes = append(indexes, i)
+		}
+	}
+	if len(indexes) == 0 {
+		return 0, me
+	}
+
+	vals := reflect.ValueOf(make([]datastore.PropertyList, len(indexes)))
+	cacheItems := make([]cacheItem, len(indexes))
+	for i, index := range indexes {
+		cacheItems[i].key = keys[index]
+		cacheItems[i].memcacheKey = createMemcacheKey(c, keys[index])
+		cacheItems[i].val = vals.Index(i)
+		cacheItems[i].state = miss
+	}
+
+	loadMemcache(c, cacheItems)
+
+	lockMemcache(c, cacheItems, expiration)
+
+	// Only read the entities this call managed to lock.
+	for i, cacheItem := range cacheItems {
+		if cacheItem.state == externalLock {
+			cacheItems[i].state = done
+		}
+	}
+
+	if err := loadDatastore(c, cacheItems, vals.Type()); err != nil {
+		return 0, err
+	}
+
+	saveMemcache(c, cacheItems)
+
+	warmed := 0
+	for i, cacheItem := range cacheItems {
+		if cacheItem.state == internalLock {
+			warmed++
+		}
+		if cacheItem.err != nil && cacheItem.err != datastore.ErrNoSuchEntity {
+			me[indexes[i]] = cacheItem.err
+			errsNil = false
+		}
+	}
+
+	if errsNil {
+		return warmed, nil
+	}
+	return warmed, me
+}
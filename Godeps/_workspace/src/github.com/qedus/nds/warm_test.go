@@ -0,0 +1,84 @@
+package nds_test
+
+import (
+	"testing"
+
+	"github.com/qedus/nds"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/memcache"
+)
+
+func TestWarm(t *testing.T) {
+	c, closeFunc := NewContext(t, nil)
+	defer closeFunc()
+
+	type testEntity struct {
+		Val int
+	}
+
+	keys := []*datastore.Key{
+		datastore.NewKey(c, "Entity", "", 1, nil),
+		datastore.NewKey(c, "Entity", "", 2, nil),
+	}
+	if _, err := nds.PutMulti(c, keys, []testEntity{{1}, {2}}); err != nil {
+		t.Fatal(err)
+	}
+	keys = append(keys, datastore.NewKey(c, "Entity", "", 3, nil))
+
+	if n, err := nds.Warm(c, keys); err != nil {
+		t.Fatal(err)
+	} else if n != 3 {
+		t.Fatal("expected 3 keys warmed", n)
+	}
+
+	flags := []uint32{nds.EntityItem, nds.EntityItem, nds.NoneItem}
+	for i, key := range keys {
+		item, err := memcache.Get(c, nds.CreateMemcacheKey(key))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if item.Flags != flags[i] {
+			t.Fatal("incorrect flags", i, item.Flags)
+		}
+	}
+
+	// Already cached keys are skipped.
+	if n, err := nds.Warm(c, keys); err != nil {
+		t.Fatal(err)
+	} else if n != 0 {
+		t.Fatal("expected no keys warmed", n)
+	}
+
+	entities := make([]testEntity, 2)
+	if err := nds.GetMulti(c, keys[:2], entities); err != nil {
+		t.Fatal(err)
+	} else if entities[0].Val != 1 || entities[1].Val != 2 {
+		t.Fatal("incorrect entities", entities)
+	}
+
+	// Invalid keys are reported without stopping the others being warmed.
+	invalid := []*datastore.Key{
+		nil,
+		datastore.NewIncompleteKey(c, "Entity", nil),
+		datastore.NewKey(c, "Entity", "", 4, nil),
+	}
+	n, err := nds.Warm(c, invalid)
+	if me, ok := err.(appengine.MultiError); !ok {
+		t.Fatal("expected appengine.MultiError", err)
+	} else if me[0] != datastore.ErrInvalidKey ||
+		me[1] != datastore.ErrInvalidKey || me[2] != nil {
+		t.Fatal("incorrect errors", me)
+	}
+	if n != 1 {
+		t.Fatal("expected 1 key warmed", n)
+	}
+
+	if err := nds.RunInTransaction(c, func(tc context.Context) error {
+		_, err := nds.Warm(tc, keys)
+		return err
+	}, nil); err == nil {
+		t.Fatal("expected transaction error")
+	}
+}
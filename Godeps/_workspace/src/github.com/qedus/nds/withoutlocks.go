@@ -0,0 +1,25 @@
+package nds
+
+import "golang.org/x/net/context"
+
+var withoutLocksKey = "used for without locks"
+
+// WithoutLocks returns a context that makes PutMulti and DeleteMulti simply
+// delete cached entities after writing to the datastore instead of locking
+// them first. This halves the memcache calls made by each write but weakens
+// consistency: a GetMulti that reads the old entity from the datastore just
+// before the write, and caches it just after the cached entity is deleted,
+// leaves the old entity cached until it is next written or expires. It suits
+// read mostly entities where such rare stale reads are acceptable. Reads are
+// cached as usual.
+//
+// Within a transaction the deletes are buffered and made once the transaction
+// commits, unless WithStrictCommitOrdering is used.
+func WithoutLocks(c context.Context) context.Context {
+	return context.WithValue(c, &withoutLocksKey, true)
+}
+
+func isWithoutLocks(c context.Context) bool {
+	withoutLocks, _ := c.Value(&withoutLocksKey).(bool)
+	return withoutLocks
+}
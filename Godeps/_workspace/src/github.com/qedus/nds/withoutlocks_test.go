@@ -0,0 +1,73 @@
+package nds_test
+
+import (
+	"testing"
+
+	"github.com/qedus/nds"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/datastore"
+)
+
+func TestWithoutLocks(t *testing.T) {
+	c, closeFunc := NewContext(t, nil)
+	defer closeFunc()
+
+	type testEntity struct {
+		Val int
+	}
+
+	rc := &recordingCache{}
+	wc := nds.WithoutLocks(nds.WithCache(c, rc))
+
+	key := datastore.NewKey(c, "Entity", "", 1, nil)
+	if _, err := nds.Put(wc, key, &testEntity{1}); err != nil {
+		t.Fatal(err)
+	}
+	if len(rc.setItems) != 0 || len(rc.delKeys) != 1 {
+		t.Fatal("expected a plain delete", rc.setItems, rc.delKeys)
+	}
+
+	// Reads are still cached.
+	te := &testEntity{}
+	if err := nds.Get(wc, key, te); err != nil {
+		t.Fatal(err)
+	} else if te.Val != 1 {
+		t.Fatal("incorrect val", te.Val)
+	}
+	if len(rc.casItems) != 1 {
+		t.Fatal("expected entity to be cached", len(rc.casItems))
+	}
+
+	// Transactions delete the cached entity once they commit.
+	rc.delKeys = nil
+	if err := nds.RunInTransaction(wc, func(tc context.Context) error {
+		if _, err := nds.Put(tc, key, &testEntity{2}); err != nil {
+			return err
+		}
+		if len(rc.delKeys) != 0 {
+			t.Fatal("expected delete to be buffered", rc.delKeys)
+		}
+		return nil
+	}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if len(rc.setItems) != 0 || len(rc.delKeys) != 1 {
+		t.Fatal("expected a plain delete on commit", rc.setItems,
+			rc.delKeys)
+	}
+
+	te = &testEntity{}
+	if err := nds.Get(wc, key, te); err != nil {
+		t.Fatal(err)
+	} else if te.Val != 2 {
+		t.Fatal("incorrect val", te.Val)
+	}
+
+	rc.delKeys = nil
+	if err := nds.Delete(wc, key); err != nil {
+		t.Fatal(err)
+	}
+	if len(rc.setItems) != 0 || len(rc.delKeys) != 1 {
+		t.Fatal("expected a plain delete", rc.setItems, rc.delKeys)
+	}
+}
@@ -0,0 +1,141 @@
+package nds
+
+import (
+	"bytes"
+	"fmt"
+	"reflect"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/memcache"
+)
+
+var writeThroughKey = "used for write through"
+
+// WithWriteThrough returns a context that makes PutMulti cache the entities
+// it puts once they are written to the datastore, instead of removing them
+// from the cache. An entity read straight after it is put is then served
+// from the cache rather than the datastore, which suits entities that are
+// usually read back soon after being written.
+//
+// Entities are still locked before they are written, and each lock is only
+// replaced by its entity, using CAS, if it is still the lock the put set. An
+// entity whose lock was replaced or has expired meanwhile, such as by a
+// concurrent write, is removed from the cache as usual, as are entities that
+// cannot be cached. Write through has no effect within a transaction, with
+// WithoutLocks or with WithNoCache.
+func WithWriteThrough(c context.Context) context.Context {
+	return context.WithValue(c, &writeThroughKey, true)
+}
+
+func isWriteThrough(c context.Context) bool {
+	writeThrough, _ := c.Value(&writeThroughKey).(bool)
+	return writeThrough
+}
+
+// writeThrough replaces lockItems, the locks set by putMulti for lockedKeys,
+// with the entities put from vals, which are in the order of keys. Entries
+// that cannot be replaced are invalidated as invalidatePut would.
+func writeThrough(c context.Context, lockItems []*memcache.Item,
+	lockedKeys, keys []*datastore.Key, vals reflect.Value) error {
+
+	// Duplicate keys share locks, and the datastore keeps the last value.
+	last := make(map[string]int, len(keys))
+	for i, key := range keys {
+		if key != nil && !key.Incomplete() {
+			last[createMemcacheKey(c, key)] = i
+		}
+	}
+	locks := make(map[string][]byte, len(lockItems))
+	memcacheKeys := make([]string, len(lockItems))
+	for i, item := range lockItems {
+		locks[item.Key] = item.Value
+		memcacheKeys[i] = item.Key
+	}
+
+	items, err := cacheFromContext(c).GetMulti(c, memcacheKeys)
+	if err != nil {
+		warningf(c, "nds:writeThrough GetMulti %s", err)
+		return invalidatePut(c, memcacheKeys, lockedKeys)
+	}
+
+	casItems := make([]*memcache.Item, 0, len(lockItems))
+	var invalidKeys []string
+	for _, key := range lockedKeys {
+		replicaKeys := writeMemcacheKeys(c, key)
+		val := vals.Index(last[createMemcacheKey(c, key)])
+		data, flags, err := cachedPutItem(c, key, val)
+		recordCachedBytes(c, key, data)
+		if err != nil {
+			warningf(c, "nds:writeThrough %s %s", key, err)
+			invalidKeys = append(invalidKeys, replicaKeys...)
+			continue
+		}
+
+		for _, memcacheKey := range replicaKeys {
+			item, ok := items[memcacheKey]
+			if !ok || item.Flags != lockItem ||
+				!bytes.Equal(item.Value, locks[memcacheKey]) {
+				invalidKeys = append(invalidKeys, memcacheKey)
+				continue
+			}
+			item.Flags = flags
+			item.Value = data
+			item.Expiration = entityExpiration(c, key)
+			casItems = append(casItems, item)
+		}
+	}
+
+	invalidKeys = append(invalidKeys, swapWriteThrough(c, casItems)...)
+	if len(invalidKeys) > 0 {
+		return invalidatePut(c, invalidKeys, lockedKeys)
+	}
+	invalidated(c, lockedKeys)
+	return nil
+}
+
+// swapWriteThrough replaces the locks of items with their entities using CAS
+// and returns the memcache keys of the items that were not replaced.
+func swapWriteThrough(c context.Context, items []*memcache.Item) []string {
+	if len(items) == 0 {
+		return nil
+	}
+	err := checkMultiError(cacheFromContext(c).CompareAndSwapMulti(c, items),
+		len(items))
+	if err == nil {
+		return nil
+	}
+	debugf(c, "nds:writeThrough CompareAndSwapMulti %s", err)
+
+	me, ok := err.(appengine.MultiError)
+	var failedKeys []string
+	for i, item := range items {
+		if !ok || me[i] != nil {
+			failedKeys = append(failedKeys, item.Key)
+		}
+	}
+	return failedKeys
+}
+
+// cachedPutItem returns the value and flags of the entity item caching val,
+// the entity put for key, or an error if the entity cannot be cached.
+func cachedPutItem(c context.Context, key *datastore.Key,
+	val reflect.Value) ([]byte, uint32, error) {
+
+	pl, err := saveValue(val)
+	if err != nil {
+		return nil, 0, err
+	}
+	sortProperties(pl)
+	data, flags, err := encodeCacheableEntityItem(c, key, val, pl)
+	if err != nil {
+		return nil, 0, err
+	}
+	data, flags = newItemHeader(c, key, entityExpiration(c, key)).add(data,
+		flags)
+	if len(data) > maxItemSize(c) {
+		return nil, 0, fmt.Errorf("too large to cache at %d bytes", len(data))
+	}
+	return data, flags, nil
+}
@@ -0,0 +1,90 @@
+package nds_test
+
+import (
+	"testing"
+
+	"github.com/qedus/nds"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/memcache"
+)
+
+func TestWithWriteThrough(t *testing.T) {
+	c, closeFunc := NewContext(t, nil)
+	defer closeFunc()
+
+	type testEntity struct {
+		Val int
+	}
+
+	wc := nds.WithWriteThrough(c)
+	key := datastore.NewKey(c, "Entity", "", 1, nil)
+	if _, err := nds.Put(wc, key, &testEntity{1}); err != nil {
+		t.Fatal(err)
+	}
+
+	// The entity is read straight from the cache.
+	entity := &testEntity{}
+	stats, err := nds.GetMultiStats(c, []*datastore.Key{key},
+		[]*testEntity{entity})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.MemcacheHits != 1 || stats.DatastoreReads != 0 {
+		t.Fatal("expected a cache hit", stats)
+	}
+	if entity.Val != 1 {
+		t.Fatal("incorrect val", entity.Val)
+	}
+
+	// The last of duplicate keys is cached, as the datastore keeps it.
+	if _, err := nds.PutMulti(wc, []*datastore.Key{key, key},
+		[]testEntity{{2}, {3}}); err != nil {
+		t.Fatal(err)
+	}
+	entity = &testEntity{}
+	stats, err = nds.GetMultiStats(c, []*datastore.Key{key},
+		[]*testEntity{entity})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.MemcacheHits != 1 || entity.Val != 3 {
+		t.Fatal("expected the last entity to be cached", stats, entity.Val)
+	}
+}
+
+func TestWithWriteThroughLockReplaced(t *testing.T) {
+	c, closeFunc := NewContext(t, nil)
+	defer closeFunc()
+
+	type testEntity struct {
+		Val int
+	}
+
+	key := datastore.NewKey(c, "Entity", "", 1, nil)
+	memcacheKey := nds.CacheKey(c, key)
+
+	// A concurrent writer replaces the lock while the entity is put.
+	nds.SetDatastorePutMulti(func(c context.Context,
+		keys []*datastore.Key, vals interface{}) ([]*datastore.Key, error) {
+		if err := memcache.Set(c, &memcache.Item{
+			Key:   memcacheKey,
+			Flags: nds.LockItem,
+			Value: make([]byte, 12),
+		}); err != nil {
+			t.Fatal(err)
+		}
+		return datastore.PutMulti(c, keys, vals)
+	})
+	defer nds.SetDatastorePutMulti(datastore.PutMulti)
+
+	if _, err := nds.Put(nds.WithWriteThrough(c), key,
+		&testEntity{1}); err != nil {
+		t.Fatal(err)
+	}
+
+	// The entry is invalidated rather than written through.
+	if _, err := memcache.Get(c, memcacheKey); err != memcache.ErrCacheMiss {
+		t.Fatal("expected entry to be invalidated", err)
+	}
+}